@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Months of spending GET /plaid/dashboard covers
+const (
+	defaultDashboardMonths = 6
+	maxDashboardMonths     = 24
+)
+
+// Plaid account types holding money the user owes rather than owns
+var liabilityAccountTypes = map[string]bool{"credit": true, "loan": true}
+
+// nonSpendCategories are moves between the user's own accounts, which aren't
+// spending or income
+var nonSpendCategories = map[string]bool{"TRANSFER_IN": true, "TRANSFER_OUT": true, "LOAN_PAYMENTS": true}
+
+// DashboardAccount is one linked account and its balance
+type DashboardAccount struct {
+	ItemID    string `json:"item_id"`
+	AccountID string `json:"account_id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Subtype   string `json:"subtype,omitempty"`
+	Mask      string `json:"mask,omitempty"`
+	Current   int64  `json:"current"`
+	Available *int64 `json:"available,omitempty"`
+	Currency  string `json:"currency"`
+	Liability bool   `json:"liability"`
+}
+
+// NetWorth sums balances in one currency; liabilities are positive amounts owed
+type NetWorth struct {
+	Currency    string `json:"currency"`
+	Assets      int64  `json:"assets"`
+	Liabilities int64  `json:"liabilities"`
+	NetWorth    int64  `json:"net_worth"`
+}
+
+// MonthlySpend is one calendar month's posted spending and income in one
+// currency, with spending by category
+type MonthlySpend struct {
+	Month      string           `json:"month"`
+	Currency   string           `json:"currency"`
+	Spent      int64            `json:"spent"`
+	Income     int64            `json:"income"`
+	Categories map[string]int64 `json:"categories"`
+}
+
+// CategoryTrend compares a category's spending last month with its average
+// over the months before it
+type CategoryTrend struct {
+	Category  string   `json:"category"`
+	Currency  string   `json:"currency"`
+	LastMonth int64    `json:"last_month"`
+	Average   int64    `json:"average"`
+	ChangePct *float64 `json:"change_pct,omitempty"`
+}
+
+// DashboardItem is a linked institution's state; items that couldn't be read
+// are listed with the reason so the app can ask the user to reconnect
+type DashboardItem struct {
+	ItemID string `json:"item_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// itemAggregate is what one linked item contributed to the dashboard
+type itemAggregate struct {
+	accounts     []DashboardAccount
+	transactions []PlaidTransaction
+	err          error
+}
+
+// aggregateItem reads one item's accounts, balances, and transactions
+func aggregateItem(ctx context.Context, pc *PlaidClient, itemID, accessToken string, start, end time.Time) itemAggregate {
+	balances, err := pc.GetAccountBalances(ctx, accessToken)
+	if err != nil {
+		return itemAggregate{err: fmt.Errorf("failed to get balances: %w", err)}
+	}
+	txns, err := pc.GetTransactions(ctx, accessToken, start, end)
+	if err != nil {
+		return itemAggregate{err: fmt.Errorf("failed to get transactions: %w", err)}
+	}
+	agg := itemAggregate{transactions: txns}
+	for _, b := range balances {
+		agg.accounts = append(agg.accounts, DashboardAccount{
+			ItemID:    itemID,
+			AccountID: b.AccountID,
+			Name:      b.Name,
+			Type:      b.Type,
+			Subtype:   b.Subtype,
+			Mask:      b.Mask,
+			Current:   b.Balance.Current,
+			Available: b.Balance.Available,
+			Currency:  strings.ToLower(b.Balance.Currency),
+			Liability: liabilityAccountTypes[b.Type],
+		})
+	}
+	return agg
+}
+
+// netWorthByCurrency totals account balances per currency
+func netWorthByCurrency(accounts []DashboardAccount) []NetWorth {
+	byCurrency := map[string]*NetWorth{}
+	for _, a := range accounts {
+		nw, ok := byCurrency[a.Currency]
+		if !ok {
+			nw = &NetWorth{Currency: a.Currency}
+			byCurrency[a.Currency] = nw
+		}
+		if a.Liability {
+			nw.Liabilities += a.Current
+		} else {
+			nw.Assets += a.Current
+		}
+		nw.NetWorth = nw.Assets - nw.Liabilities
+	}
+	out := make([]NetWorth, 0, len(byCurrency))
+	for _, nw := range byCurrency {
+		out = append(out, *nw)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Currency < out[j].Currency })
+	return out
+}
+
+// monthlySpend buckets posted transactions by month and currency, oldest
+// first. Every month in the window is listed for each currency seen, so
+// months without spending show as zero.
+func monthlySpend(txns []PlaidTransaction, months []string) []MonthlySpend {
+	buckets := map[string]map[string]*MonthlySpend{}
+	for _, t := range txns {
+		if t.Pending || nonSpendCategories[t.Category] {
+			continue
+		}
+		currency := strings.ToLower(t.Currency)
+		if buckets[currency] == nil {
+			buckets[currency] = map[string]*MonthlySpend{}
+			for _, m := range months {
+				buckets[currency][m] = &MonthlySpend{Month: m, Currency: currency, Categories: map[string]int64{}}
+			}
+		}
+		bucket, ok := buckets[currency][t.Date.UTC().Format("2006-01")]
+		if !ok {
+			continue
+		}
+		if t.Amount < 0 {
+			bucket.Income -= t.Amount
+			continue
+		}
+		category := t.Category
+		if category == "" {
+			category = "OTHER"
+		}
+		bucket.Spent += t.Amount
+		bucket.Categories[category] += t.Amount
+	}
+	currencies := make([]string, 0, len(buckets))
+	for currency := range buckets {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	var out []MonthlySpend
+	for _, currency := range currencies {
+		for _, m := range months {
+			out = append(out, *buckets[currency][m])
+		}
+	}
+	return out
+}
+
+// categoryTrends compares each category's spending in the last complete month
+// with its average over the complete months before it; the current month is
+// left out because it is partial
+func categoryTrends(spend []MonthlySpend, currentMonth string) []CategoryTrend {
+	complete := map[string][]MonthlySpend{}
+	for _, m := range spend {
+		if m.Month != currentMonth {
+			complete[m.Currency] = append(complete[m.Currency], m)
+		}
+	}
+	var out []CategoryTrend
+	for currency, months := range complete {
+		if len(months) == 0 {
+			continue
+		}
+		last, earlier := months[len(months)-1], months[:len(months)-1]
+		categories := map[string]bool{}
+		for _, m := range months {
+			for category := range m.Categories {
+				categories[category] = true
+			}
+		}
+		for category := range categories {
+			trend := CategoryTrend{Category: category, Currency: currency, LastMonth: last.Categories[category]}
+			if len(earlier) > 0 {
+				var total int64
+				for _, m := range earlier {
+					total += m.Categories[category]
+				}
+				trend.Average = total / int64(len(earlier))
+				if trend.Average > 0 {
+					pct := float64(trend.LastMonth-trend.Average) / float64(trend.Average) * 100
+					pct = float64(int64(pct*10)) / 10
+					trend.ChangePct = &pct
+				}
+			}
+			out = append(out, trend)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Currency != out[j].Currency {
+			return out[i].Currency < out[j].Currency
+		}
+		if out[i].LastMonth != out[j].LastMonth {
+			return out[i].LastMonth > out[j].LastMonth
+		}
+		return out[i].Category < out[j].Category
+	})
+	return out
+}
+
+// GetBankDashboard aggregates every bank the caller linked through Plaid:
+// balances and net worth per currency, monthly spending and income with a
+// category breakdown, and how each category is trending. Query param months
+// (default 6, at most 24) sets how far back spending goes. Items that need
+// re-linking or fail are listed under items and left out of the totals.
+func GetBankDashboard(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	v, ok := c.Get("plaidClient")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Plaid client not available"})
+		return
+	}
+	pc := v.(*PlaidClient)
+	ctx := c.Request.Context()
+
+	months := defaultDashboardMonths
+	if m := c.Query("months"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil || n < 1 || n > maxDashboardMonths {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("months must be between 1 and %d", maxDashboardMonths)})
+			return
+		}
+		months = n
+	}
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month()-time.Month(months-1), 1, 0, 0, 0, 0, time.UTC)
+	window := make([]string, months)
+	for i := range window {
+		window[i] = start.AddDate(0, i, 0).Format("2006-01")
+	}
+
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load linked accounts"})
+		return
+	}
+	rawItems, _ := doc.Data()[providerUserField(ProcessorPlaid, "items")].(map[string]interface{})
+
+	// Items are read in parallel; a user with several banks shouldn't wait
+	// on each in turn. Items that can't be read are listed as they are.
+	skipped := []DashboardItem{}
+	items := make([]DashboardItem, 0, len(rawItems))
+	results := make([]itemAggregate, 0, len(rawItems))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for itemID, raw := range rawItems {
+		item, _ := raw.(map[string]interface{})
+		status := stringField(item, "status")
+		if status == "" {
+			status = PlaidItemActive
+		}
+		if status != PlaidItemActive {
+			skipped = append(skipped, DashboardItem{ItemID: itemID, Status: status, Error: stringField(item, "error_code")})
+			continue
+		}
+		accessToken, err := DecryptString(stringField(item, "access_token_encrypted"))
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to decrypt access token", "component", "plaid", "user_id", uid, "item_id", itemID, "error", err)
+			skipped = append(skipped, DashboardItem{ItemID: itemID, Status: PlaidItemError, Error: "unavailable"})
+			continue
+		}
+		wg.Add(1)
+		go func(itemID, accessToken string) {
+			defer wg.Done()
+			agg := aggregateItem(ctx, pc, itemID, accessToken, start, now)
+			mu.Lock()
+			defer mu.Unlock()
+			if agg.err != nil {
+				slog.WarnContext(ctx, "failed to aggregate plaid item", "component", "plaid", "user_id", uid, "item_id", itemID, "error", agg.err)
+				items = append(items, DashboardItem{ItemID: itemID, Status: PlaidItemError, Error: "unavailable"})
+				return
+			}
+			items = append(items, DashboardItem{ItemID: itemID, Status: PlaidItemActive})
+			results = append(results, agg)
+		}(itemID, accessToken)
+	}
+	wg.Wait()
+	items = append(items, skipped...)
+	sort.Slice(items, func(i, j int) bool { return items[i].ItemID < items[j].ItemID })
+
+	accounts := []DashboardAccount{}
+	var txns []PlaidTransaction
+	for _, r := range results {
+		accounts = append(accounts, r.accounts...)
+		txns = append(txns, r.transactions...)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].ItemID != accounts[j].ItemID {
+			return accounts[i].ItemID < accounts[j].ItemID
+		}
+		return accounts[i].AccountID < accounts[j].AccountID
+	})
+	spend := monthlySpend(txns, window)
+	if spend == nil {
+		spend = []MonthlySpend{}
+	}
+	trends := categoryTrends(spend, window[len(window)-1])
+	if trends == nil {
+		trends = []CategoryTrend{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"net_worth":    netWorthByCurrency(accounts),
+		"accounts":     accounts,
+		"spend":        spend,
+		"trends":       trends,
+		"items":        items,
+		"from":         start.Format("2006-01-02"),
+		"generated_at": now,
+	})
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Holds stop money moving while risk reviews it. An account hold keeps a user
+// from sending, withdrawing, or paying out; a transaction hold keeps a
+// payment's Connect transfer from being made. Either is placed by an admin or
+// a risk rule, and only an admin releases it.
+
+// What a hold is on
+const (
+	HoldSubjectUser        = "user"
+	HoldSubjectTransaction = "transaction"
+)
+
+// Hold statuses
+const (
+	HoldActive   = "active"
+	HoldReleased = "released"
+)
+
+// Risk rules that place holds
+const (
+	// HoldRuleDisputeRate holds a business whose dispute rate reaches
+	// accountHoldDisputeRate
+	HoldRuleDisputeRate = "dispute_rate"
+	// HoldRuleRecipientOnHold holds payments to a user whose account is held
+	HoldRuleRecipientOnHold = "recipient_on_hold"
+	// HoldRuleHighRiskAmount holds payments of at least RISK_HOLD_AMOUNT to
+	// high-risk recipients
+	HoldRuleHighRiskAmount = "high_risk_amount"
+	// HoldRuleRiskReview holds payments risk scoring sends for review
+	HoldRuleRiskReview = "risk_review"
+)
+
+const (
+	NotificationAccountHeld     = "account_held"
+	NotificationAccountReleased = "account_hold_released"
+)
+
+const (
+	// accountHoldDisputeRate is twice the rate that makes a recipient high risk
+	accountHoldDisputeRate = 0.02
+	// defaultRiskHoldAmount is RISK_HOLD_AMOUNT's default, in minor units
+	defaultRiskHoldAmount = 50000
+)
+
+var (
+	errHoldExists   = errors.New("already on hold")
+	errHoldReleased = errors.New("hold already released")
+	// errTransferMade is returned when holding a payment whose transfer
+	// already went out
+	errTransferMade = errors.New("transfer already made")
+)
+
+// Hold is a hold on a user or a payment, stored at holds/{id} and kept after
+// release for audit. The held user's document, or the payment's transaction,
+// carries hold_id while it is active.
+type Hold struct {
+	ID          string `json:"id" firestore:"-"`
+	SubjectType string `json:"subject_type" firestore:"subject_type"`
+	SubjectID   string `json:"subject_id" firestore:"subject_id"`
+	// UserID is the held user, or the payment's recipient
+	UserID string `json:"user_id" firestore:"user_id"`
+	Reason string `json:"reason" firestore:"reason"`
+	Rule   string `json:"rule,omitempty" firestore:"rule,omitempty"`
+	// PlacedBy is the admin's ID, or risk_rule:<rule>
+	PlacedBy    string     `json:"placed_by" firestore:"placed_by"`
+	PlacedAt    time.Time  `json:"placed_at" firestore:"placed_at"`
+	Status      string     `json:"status" firestore:"status"`
+	ReleasedBy  string     `json:"released_by,omitempty" firestore:"released_by,omitempty"`
+	ReleasedAt  *time.Time `json:"released_at,omitempty" firestore:"released_at,omitempty"`
+	ReleaseNote string     `json:"release_note,omitempty" firestore:"release_note,omitempty"`
+}
+
+// newHold starts a hold placed by adminID, or by rule when adminID is empty
+func newHold(subjectType, subjectID, uid, reason, rule, adminID string) Hold {
+	placedBy := adminID
+	if placedBy == "" {
+		placedBy = "risk_rule:" + rule
+	}
+	return Hold{
+		SubjectType: subjectType,
+		SubjectID:   subjectID,
+		UserID:      uid,
+		Reason:      reason,
+		Rule:        rule,
+		PlacedBy:    placedBy,
+		PlacedAt:    time.Now(),
+		Status:      HoldActive,
+	}
+}
+
+// accountHoldID returns the user's active account hold, empty if they have
+// none
+func accountHoldID(ctx context.Context, fs *firestore.Client, uid string) (string, error) {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if status.Code(err) == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return stringField(doc.Data(), "hold_id"), nil
+}
+
+// RequireNoAccountHold refuses money movement by users whose account is held
+func RequireNoAccountHold() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, ok := c.Get("firestore")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+			return
+		}
+		holdID, err := accountHoldID(c.Request.Context(), v.(*firestore.Client), c.GetString("userID"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check account status"})
+			return
+		}
+		if holdID != "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Your account is on hold. Contact support to find out more.",
+				"code":  "account_on_hold",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// PlaceAccountHold holds a user's account, by adminID or, when it is empty,
+// by rule
+func PlaceAccountHold(ctx context.Context, fs *firestore.Client, uid, reason, rule, adminID string) (*Hold, error) {
+	hold := newHold(HoldSubjectUser, uid, uid, reason, rule, adminID)
+	ref := fs.Collection("holds").NewDoc()
+	hold.ID = ref.ID
+	// The hold is written first so the user never points at a missing one
+	if _, err := ref.Create(ctx, hold); err != nil {
+		return nil, fmt.Errorf("failed to save hold: %w", err)
+	}
+	err := UpdateUser(ctx, fs, uid, func(doc *firestore.DocumentSnapshot) (map[string]interface{}, error) {
+		if doc.Exists() && stringField(doc.Data(), "hold_id") != "" {
+			return nil, errHoldExists
+		}
+		return map[string]interface{}{"hold_id": hold.ID, "updated_at": time.Now()}, nil
+	})
+	if err != nil {
+		if _, derr := ref.Delete(ctx); derr != nil {
+			slog.ErrorContext(ctx, "failed to remove unused hold", "component", "holds", "hold_id", hold.ID, "error", derr)
+		}
+		return nil, err
+	}
+	slog.InfoContext(ctx, "account held", "component", "holds", "user_id", uid, "hold_id", hold.ID, "placed_by", hold.PlacedBy)
+	NotifyUser(ctx, fs, uid, NotificationAccountHeld, "Your account is on hold",
+		"You can't send or withdraw money while we review your account. Contact support to find out more.",
+		map[string]interface{}{"hold_id": hold.ID})
+	return &hold, nil
+}
+
+// heldTransfer reports what of a payment's transfer a hold or report can
+// still stop: FrozenEscrow for an escrowed payment, FrozenTransfer for a
+// transfer waiting on the charge, being retried, or already frozen, or empty
+// when the money already left
+func heldTransfer(data map[string]interface{}) string {
+	transferStatus := stringField(data, "transfer_status")
+	escrow := stringField(data, "escrow_status")
+	switch {
+	case escrow == EscrowHeld || escrow == EscrowClaimed:
+		return FrozenEscrow
+	case escrow != "", stringField(data, "transfer_id") != "":
+		// Settled escrow, or a transfer that was made
+		return ""
+	case transferStatus == "" && !slices.Contains([]string{"failed", "canceled", "expired", "returned"}, stringField(data, "status")),
+		transferStatus == TransferStatusRetrying,
+		transferStatus == TransferStatusFrozen:
+		return FrozenTransfer
+	}
+	return ""
+}
+
+// placeTransactionHold holds a payment's transfer, by adminID or, when it is
+// empty, by rule. The transfer is frozen like a reported one's.
+func placeTransactionHold(ctx context.Context, fs *firestore.Client, transactionID, reason, rule, adminID string) (*Hold, error) {
+	txnRef := fs.Collection("transactions").Doc(transactionID)
+	ref := fs.Collection("holds").NewDoc()
+	var hold Hold
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(txnRef)
+		if err != nil {
+			return err
+		}
+		data := snap.Data()
+		if stringField(data, "hold_id") != "" {
+			return errHoldExists
+		}
+		if heldTransfer(data) == "" {
+			return errTransferMade
+		}
+		hold = newHold(HoldSubjectTransaction, transactionID, stringField(data, "recipient_user_id"), reason, rule, adminID)
+		if err := tx.Create(ref, hold); err != nil {
+			return err
+		}
+		return tx.Update(txnRef, []firestore.Update{
+			{Path: "hold_id", Value: ref.ID},
+			{Path: "transfer_status", Value: TransferStatusFrozen},
+			{Path: "updated_at", Value: time.Now()},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	hold.ID = ref.ID
+	slog.InfoContext(ctx, "transaction held", "component", "holds", "transaction_id", transactionID, "hold_id", hold.ID, "placed_by", hold.PlacedBy)
+	return &hold, nil
+}
+
+// riskHoldAmount is the smallest payment to a high-risk recipient that is held
+func riskHoldAmount() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("RISK_HOLD_AMOUNT"), 10, 64); err == nil && v > 0 {
+		return v
+	}
+	return defaultRiskHoldAmount
+}
+
+// paymentHoldRule returns the risk rule that holds a payment to recipientUID,
+// empty if none does
+func paymentHoldRule(ctx context.Context, fs *firestore.Client, recipientUID string, amount int64) string {
+	if holdID, err := accountHoldID(ctx, fs, recipientUID); err == nil && holdID != "" {
+		return HoldRuleRecipientOnHold
+	}
+	if amount >= riskHoldAmount() && recipientRiskTier(ctx, fs, recipientUID) == RiskTierHigh {
+		return HoldRuleHighRiskAmount
+	}
+	return ""
+}
+
+// holdRuleReasons describe holds placed by payment rules
+var holdRuleReasons = map[string]string{
+	HoldRuleRecipientOnHold: "Recipient's account is on hold",
+	HoldRuleHighRiskAmount:  "Large payment to a high-risk recipient",
+	HoldRuleRiskReview:      "Payment is in risk review",
+}
+
+// holdRiskyPayment holds a charged payment's transfer when a risk rule
+// catches it, reporting whether the transfer is held
+func holdRiskyPayment(ctx context.Context, fs *firestore.Client, transactionID, recipientUID string, amount int64) (bool, error) {
+	if fs == nil || recipientUID == "" {
+		return false, nil
+	}
+	rule := paymentHoldRule(ctx, fs, recipientUID, amount)
+	if rule == "" {
+		return false, nil
+	}
+	_, err := placeTransactionHold(ctx, fs, transactionID, holdRuleReasons[rule], rule, "")
+	switch {
+	case errors.Is(err, errHoldExists):
+		return true, nil
+	case errors.Is(err, errTransferMade):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to hold %s: %w", transactionID, err)
+	}
+	return true, nil
+}
+
+// releaseHold ends an active hold. An account hold lifts at once; a held
+// transfer goes out, unless an open report on the payment still freezes it.
+func releaseHold(ctx context.Context, fs *firestore.Client, holdID, adminID, note string) (*Hold, error) {
+	ref := fs.Collection("holds").Doc(holdID)
+	doc, err := getDocument(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	var hold Hold
+	if err := doc.DataTo(&hold); err != nil {
+		return nil, err
+	}
+	if hold.Status != HoldActive {
+		return nil, errHoldReleased
+	}
+	// Lifted before the hold is closed, so a failed release can be retried
+	if hold.SubjectType == HoldSubjectUser {
+		if err := UpdateUser(ctx, fs, hold.UserID, func(doc *firestore.DocumentSnapshot) (map[string]interface{}, error) {
+			if !doc.Exists() || stringField(doc.Data(), "hold_id") != holdID {
+				return nil, nil
+			}
+			return map[string]interface{}{"hold_id": firestore.Delete, "updated_at": time.Now()}, nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to lift hold on %s: %w", hold.UserID, err)
+		}
+	}
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := snap.DataTo(&hold); err != nil {
+			return err
+		}
+		if hold.Status != HoldActive {
+			return errHoldReleased
+		}
+		var txnSnap, report *firestore.DocumentSnapshot
+		if hold.SubjectType == HoldSubjectTransaction {
+			if txnSnap, err = tx.Get(fs.Collection("transactions").Doc(hold.SubjectID)); err != nil {
+				return err
+			}
+			report, err = tx.Get(fs.Collection("transaction_reports").Doc(hold.SubjectID))
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+		}
+		now := time.Now()
+		hold.Status, hold.ReleasedBy, hold.ReleasedAt, hold.ReleaseNote = HoldReleased, adminID, &now, note
+		if err := tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: hold.Status},
+			{Path: "released_by", Value: adminID},
+			{Path: "released_at", Value: now},
+			{Path: "release_note", Value: note},
+		}); err != nil {
+			return err
+		}
+		if txnSnap == nil || stringField(txnSnap.Data(), "hold_id") != holdID {
+			return nil
+		}
+		return tx.Update(txnSnap.Ref, unfreezeHeldTransfer(txnSnap.Data(), report, now))
+	})
+	if err != nil {
+		return nil, err
+	}
+	hold.ID = holdID
+	if hold.SubjectType == HoldSubjectUser {
+		NotifyUser(ctx, fs, hold.UserID, NotificationAccountReleased, "Your account is no longer on hold",
+			"You can send and withdraw money again.", map[string]interface{}{"hold_id": holdID})
+	}
+	slog.InfoContext(ctx, "hold released", "component", "holds", "hold_id", holdID, "subject_type", hold.SubjectType, "subject_id", hold.SubjectID, "released_by", adminID)
+	return &hold, nil
+}
+
+// unfreezeHeldTransfer is the update releasing a transaction's hold. Like
+// releaseReportedTransfers, a transfer whose charge has succeeded is retried
+// at once and one still waiting on the charge is made when it succeeds; an
+// escrowed payment settles as usual. An open report that froze the transfer
+// keeps it frozen.
+func unfreezeHeldTransfer(data map[string]interface{}, report *firestore.DocumentSnapshot, now time.Time) []firestore.Update {
+	updates := []firestore.Update{{Path: "hold_id", Value: firestore.Delete}, {Path: "updated_at", Value: now}}
+	if stringField(data, "transfer_status") != TransferStatusFrozen {
+		return updates
+	}
+	if report != nil && report.Exists() && stringField(report.Data(), "status") != ReportResolved {
+		var r TransactionReport
+		if err := report.DataTo(&r); err == nil && (slices.Contains(r.Frozen, FrozenTransfer) || slices.Contains(r.Frozen, FrozenEscrow)) {
+			return updates
+		}
+	}
+	if stringField(data, "escrow_status") == "" && stringField(data, "status") == "succeeded" {
+		return append(updates,
+			firestore.Update{Path: "transfer_status", Value: TransferStatusRetrying},
+			firestore.Update{Path: "transfer_retry_at", Value: now})
+	}
+	return append(updates, firestore.Update{Path: "transfer_status", Value: firestore.Delete})
+}
+
+// HoldUser lets an admin hold a user's account
+func HoldUser(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required,max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	uid := c.Param("uid")
+	if _, err := getDocument(ctx, UserDoc(ctx, fs, uid)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	hold, err := PlaceAccountHold(ctx, fs, uid, req.Reason, "", adminID)
+	switch {
+	case errors.Is(err, errHoldExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is already on hold"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to place hold"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "hold", SubjectID: hold.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log hold access", "component", "holds", "hold_id", hold.ID, "error", err)
+	}
+	c.JSON(http.StatusCreated, hold)
+}
+
+// HoldTransaction lets an admin hold a payment's transfer. A transfer that
+// already went out can't be held.
+func HoldTransaction(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required,max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	hold, err := placeTransactionHold(ctx, fs, c.Param("id"), req.Reason, "", adminID)
+	switch {
+	case status.Code(err) == codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	case errors.Is(err, errHoldExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "This transaction is already on hold"})
+		return
+	case errors.Is(err, errTransferMade):
+		c.JSON(http.StatusConflict, gin.H{"error": "This payment's transfer has already been made", "code": "transfer_made"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to place hold"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "hold", SubjectID: hold.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log hold access", "component", "holds", "hold_id", hold.ID, "error", err)
+	}
+	c.JSON(http.StatusCreated, hold)
+}
+
+// ListHolds returns holds newest first: ?user_id= gives one user's history,
+// otherwise ?status= (active by default) filters them all
+func ListHolds(c *gin.Context) {
+	_, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	q := fs.Collection("holds").Query
+	if uid := c.Query("user_id"); uid != "" {
+		q = q.Where("user_id", "==", uid)
+	} else {
+		holdStatus := c.DefaultQuery("status", HoldActive)
+		if holdStatus != HoldActive && holdStatus != HoldReleased {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be active or released"})
+			return
+		}
+		q = q.Where("status", "==", holdStatus)
+	}
+	docs, err := q.OrderBy("placed_at", firestore.Desc).Limit(100).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load holds"})
+		return
+	}
+	holds := make([]Hold, 0, len(docs))
+	for _, doc := range docs {
+		var h Hold
+		if err := doc.DataTo(&h); err != nil {
+			continue
+		}
+		h.ID = doc.Ref.ID
+		holds = append(holds, h)
+	}
+	c.JSON(http.StatusOK, gin.H{"holds": holds})
+}
+
+// ReleaseHold lets an admin end a hold
+func ReleaseHold(c *gin.Context) {
+	var req struct {
+		Note string `json:"note" binding:"required,max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	hold, err := releaseHold(ctx, fs, c.Param("id"), adminID, req.Note)
+	switch {
+	case status.Code(err) == codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hold not found"})
+		return
+	case errors.Is(err, errHoldReleased):
+		c.JSON(http.StatusConflict, gin.H{"error": "This hold has already been released"})
+		return
+	case err != nil:
+		slog.ErrorContext(ctx, "failed to release hold", "component", "holds", "hold_id", c.Param("id"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release hold"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "hold", SubjectID: hold.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log hold access", "component", "holds", "hold_id", hold.ID, "error", err)
+	}
+	c.JSON(http.StatusOK, hold)
+}
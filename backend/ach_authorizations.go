@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// ACH authorization frequencies
+const (
+	ACHFrequencySingle    = "single"
+	ACHFrequencyRecurring = "recurring"
+)
+
+// ACHAuthorization is the record NACHA expects for a consumer debit, stored at
+// ach_authorizations/{id}: what the customer agreed to, when, and from where.
+// A single debit authorizes Amount; a recurring one authorizes up to AmountMax.
+type ACHAuthorization struct {
+	ID              string    `json:"id" firestore:"-"`
+	UserID          string    `json:"user_id" firestore:"user_id"`
+	PaymentIntentID string    `json:"payment_intent_id,omitempty" firestore:"payment_intent_id,omitempty"`
+	Frequency       string    `json:"frequency" firestore:"frequency"`
+	Amount          int64     `json:"amount" firestore:"amount"`
+	AmountMax       int64     `json:"amount_max,omitempty" firestore:"amount_max,omitempty"`
+	Currency        string    `json:"currency" firestore:"currency"`
+	MandateVersion  string    `json:"mandate_version" firestore:"mandate_version"`
+	MandateText     string    `json:"mandate_text" firestore:"mandate_text"`
+	IPAddress       string    `json:"ip_address" firestore:"ip_address"`
+	UserAgent       string    `json:"user_agent,omitempty" firestore:"user_agent,omitempty"`
+	AuthorizedAt    time.Time `json:"authorized_at" firestore:"authorized_at"`
+
+	// Recurring mandates only
+	Status     string    `json:"status,omitempty" firestore:"status,omitempty"`
+	Interval   string    `json:"interval,omitempty" firestore:"interval,omitempty"`
+	ScheduleID string    `json:"schedule_id,omitempty" firestore:"schedule_id,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty" firestore:"updated_at,omitempty"`
+	RevokedAt  time.Time `json:"revoked_at,omitempty" firestore:"revoked_at,omitempty"`
+}
+
+// RecordACHAuthorization stores a single-debit authorization for a
+// PaymentIntent against the current ACH debit mandate text
+func RecordACHAuthorization(ctx context.Context, fs *firestore.Client, uid string, pi *StripePaymentIntent, ip, userAgent string) (*ACHAuthorization, error) {
+	return saveACHAuthorization(ctx, fs, uid, pi.ID, pi.Amount, pi.Currency, ip, userAgent)
+}
+
+// AuthorizeACHDebit stores a single-debit authorization for a bank debit
+// about to be created and confirmed in one call, which sends it as the
+// debit's mandate. LinkACHAuthorization then records the PaymentIntent.
+func AuthorizeACHDebit(ctx context.Context, fs *firestore.Client, uid string, amount int64, currency, ip, userAgent string) (*ACHAuthorization, error) {
+	return saveACHAuthorization(ctx, fs, uid, "", amount, currency, ip, userAgent)
+}
+
+func saveACHAuthorization(ctx context.Context, fs *firestore.Client, uid, paymentIntentID string, amount int64, currency, ip, userAgent string) (*ACHAuthorization, error) {
+	mandate := consentDocuments[ConsentACHDebit]
+	auth := &ACHAuthorization{
+		ID:              uuid.NewString(),
+		UserID:          uid,
+		PaymentIntentID: paymentIntentID,
+		Frequency:       ACHFrequencySingle,
+		Amount:          amount,
+		Currency:        currency,
+		MandateVersion:  mandate.Version,
+		MandateText:     mandate.Text,
+		IPAddress:       ip,
+		UserAgent:       userAgent,
+		AuthorizedAt:    time.Now(),
+	}
+	if _, err := fs.Collection("ach_authorizations").Doc(auth.ID).Set(ctx, auth); err != nil {
+		return nil, fmt.Errorf("failed to record ACH authorization: %w", err)
+	}
+	return auth, nil
+}
+
+// LinkACHAuthorization records the PaymentIntent an authorization was given
+// for, so the authorization can be produced as evidence if it is disputed
+func LinkACHAuthorization(ctx context.Context, fs *firestore.Client, auth *ACHAuthorization, paymentIntentID string) error {
+	auth.PaymentIntentID = paymentIntentID
+	if _, err := fs.Collection("ach_authorizations").Doc(auth.ID).Update(ctx, []firestore.Update{
+		{Path: "payment_intent_id", Value: paymentIntentID},
+	}); err != nil {
+		return fmt.Errorf("failed to link ACH authorization %s: %w", auth.ID, err)
+	}
+	return nil
+}
+
+// achAuthorizationEvidence describes an authorization for dispute evidence
+func achAuthorizationEvidence(auth *ACHAuthorization) string {
+	return fmt.Sprintf("The account holder authorized this ACH debit of %d %s (minor units) online at %s from IP address %s, user agent %q, accepting mandate version %s: %s",
+		auth.Amount, strings.ToUpper(auth.Currency), auth.AuthorizedAt.UTC().Format(time.RFC3339), auth.IPAddress, auth.UserAgent, auth.MandateVersion, auth.MandateText)
+}
+
+// achMandateData is an authorization as Stripe's mandate_data for a
+// us_bank_account debit: accepted online, from the recorded IP and user agent
+func achMandateData(auth *ACHAuthorization) *stripe.PaymentIntentMandateDataParams {
+	return &stripe.PaymentIntentMandateDataParams{
+		CustomerAcceptance: &stripe.PaymentIntentMandateDataCustomerAcceptanceParams{
+			Type:       stripe.String("online"),
+			AcceptedAt: stripe.Int64(auth.AuthorizedAt.Unix()),
+			Online: &stripe.PaymentIntentMandateDataCustomerAcceptanceOnlineParams{
+				IPAddress: stripe.String(auth.IPAddress),
+				UserAgent: stripe.String(auth.UserAgent),
+			},
+		},
+	}
+}
+
+// loadACHAuthorization reads an authorization by ID
+func loadACHAuthorization(ctx context.Context, fs *firestore.Client, id string) (*ACHAuthorization, error) {
+	doc, err := fs.Collection("ach_authorizations").Doc(id).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var auth ACHAuthorization
+	if err := doc.DataTo(&auth); err != nil {
+		return nil, err
+	}
+	auth.ID = doc.Ref.ID
+	return &auth, nil
+}
+
+// GetTransaction returns one of the caller's transactions, with the ACH
+// authorization behind it when it was a bank debit
+func GetTransaction(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	doc, err := fs.Collection("transactions").Doc(c.Param("id")).Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	participants, _ := doc.Data()["participants"].([]interface{})
+	if !slices.Contains(participants, interface{}(uid)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	var rec TransactionRecord
+	if err := doc.DataTo(&rec); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read transaction"})
+		return
+	}
+	rec.ID = doc.Ref.ID
+	if rec.FailureCode != "" {
+		rec.FailureMessage = failureMessageFor(rec.FailureCode, requestLocale(c))
+	}
+
+	resp := gin.H{"transaction": rec}
+	if rec.ACHAuthorizationID != "" {
+		// Only the account holder who authorized the debit sees its details
+		if auth, err := loadACHAuthorization(ctx, fs, rec.ACHAuthorizationID); err == nil && auth.UserID == uid {
+			resp["ach_authorization"] = auth
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
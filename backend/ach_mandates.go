@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Recurring mandate statuses
+const (
+	MandateActive  = "active"
+	MandateRevoked = "revoked"
+)
+
+// Notification types for changes to a recurring debit mandate
+const (
+	NotificationMandateCreated = "mandate_created"
+	NotificationMandateAmended = "mandate_amended"
+	NotificationMandateRevoked = "mandate_revoked"
+)
+
+// mandateIntervals are the schedules a recurring mandate can authorize
+var mandateIntervals = map[string]bool{"weekly": true, "biweekly": true, "monthly": true}
+
+var (
+	// ErrMandateInactive is returned when a recurring run has no active mandate behind it
+	ErrMandateInactive = errors.New("recurring debit mandate is not active")
+	// ErrMandateAmountExceeded is returned when a run is above the mandate's authorized maximum
+	ErrMandateAmountExceeded = errors.New("amount exceeds recurring debit mandate")
+)
+
+// MandateAmendment records a change to a recurring mandate's terms, stored at
+// ach_authorizations/{id}/amendments/{id}. The customer re-authorizes from the
+// IP and user agent recorded here.
+type MandateAmendment struct {
+	ID                string    `json:"id" firestore:"-"`
+	PreviousAmountMax int64     `json:"previous_amount_max" firestore:"previous_amount_max"`
+	AmountMax         int64     `json:"amount_max" firestore:"amount_max"`
+	PreviousInterval  string    `json:"previous_interval" firestore:"previous_interval"`
+	Interval          string    `json:"interval" firestore:"interval"`
+	MandateVersion    string    `json:"mandate_version" firestore:"mandate_version"`
+	IPAddress         string    `json:"ip_address" firestore:"ip_address"`
+	UserAgent         string    `json:"user_agent,omitempty" firestore:"user_agent,omitempty"`
+	CreatedAt         time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// CheckRecurringMandate confirms the user's mandate is active and covers the
+// amount. The scheduler calls this before executing each recurring payment and
+// reports SkipReasonMandateInvalid when it fails.
+func CheckRecurringMandate(ctx context.Context, fs *firestore.Client, uid, mandateID string, amount int64) error {
+	auth, err := loadACHAuthorization(ctx, fs, mandateID)
+	if status.Code(err) == codes.NotFound {
+		return ErrMandateInactive
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load mandate %s: %w", mandateID, err)
+	}
+	if auth.UserID != uid || auth.Frequency != ACHFrequencyRecurring || auth.Status != MandateActive {
+		return ErrMandateInactive
+	}
+	if amount > auth.AmountMax {
+		return fmt.Errorf("%d > %d: %w", amount, auth.AmountMax, ErrMandateAmountExceeded)
+	}
+	return nil
+}
+
+// CreateMandate records the caller's authorization for recurring debits up to
+// amount_max on an interval, against the current recurring payments text
+func CreateMandate(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	var req struct {
+		AmountMax  int64  `json:"amount_max" binding:"required,gt=0"`
+		Currency   string `json:"currency"`
+		Interval   string `json:"interval" binding:"required"`
+		ScheduleID string `json:"schedule_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !mandateIntervals[req.Interval] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be weekly, biweekly, or monthly"})
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = "usd"
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	mandate := consentDocuments[ConsentRecurringPayments]
+	now := time.Now()
+	auth := &ACHAuthorization{
+		ID:             uuid.NewString(),
+		UserID:         uid,
+		Frequency:      ACHFrequencyRecurring,
+		AmountMax:      req.AmountMax,
+		Currency:       strings.ToLower(req.Currency),
+		MandateVersion: mandate.Version,
+		MandateText:    mandate.Text,
+		IPAddress:      c.ClientIP(),
+		UserAgent:      c.Request.UserAgent(),
+		AuthorizedAt:   now,
+		Status:         MandateActive,
+		Interval:       req.Interval,
+		ScheduleID:     req.ScheduleID,
+		UpdatedAt:      now,
+	}
+	if _, err := fs.Collection("ach_authorizations").Doc(auth.ID).Set(ctx, auth); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record mandate"})
+		return
+	}
+
+	// NACHA requires the customer get a copy of a recurring authorization
+	NotifyUser(ctx, fs, uid, NotificationMandateCreated, "Recurring debit authorized",
+		fmt.Sprintf("You authorized %s debits of up to %s from your bank account.", auth.Interval, formatMandateAmount(auth.AmountMax, auth.Currency)),
+		map[string]interface{}{"mandate_id": auth.ID})
+	c.JSON(http.StatusCreated, gin.H{"mandate": auth})
+}
+
+// ListMandates returns the caller's recurring debit mandates and their status
+func ListMandates(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("ach_authorizations").
+		Where("user_id", "==", uid).
+		Where("frequency", "==", ACHFrequencyRecurring).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mandates"})
+		return
+	}
+	mandates := make([]ACHAuthorization, 0, len(docs))
+	for _, doc := range docs {
+		var auth ACHAuthorization
+		if err := doc.DataTo(&auth); err != nil {
+			continue
+		}
+		auth.ID = doc.Ref.ID
+		mandates = append(mandates, auth)
+	}
+	c.JSON(http.StatusOK, gin.H{"mandates": mandates})
+}
+
+// AmendMandate changes the maximum amount or interval of an active mandate.
+// The change is a new authorization, so it is recorded with the caller's IP and
+// the customer is notified whenever the amount changes.
+func AmendMandate(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	var req struct {
+		AmountMax int64  `json:"amount_max" binding:"omitempty,gt=0"`
+		Interval  string `json:"interval"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.AmountMax == 0 && req.Interval == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount_max or interval is required"})
+		return
+	}
+	if req.Interval != "" && !mandateIntervals[req.Interval] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be weekly, biweekly, or monthly"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := fs.Collection("ach_authorizations").Doc(c.Param("id"))
+	var auth ACHAuthorization
+	var amendment *MandateAmendment
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&auth); err != nil {
+			return err
+		}
+		if auth.UserID != uid || auth.Frequency != ACHFrequencyRecurring {
+			return status.Error(codes.NotFound, "mandate not found")
+		}
+		if auth.Status != MandateActive {
+			return ErrMandateInactive
+		}
+
+		mandate := consentDocuments[ConsentRecurringPayments]
+		amendment = &MandateAmendment{
+			ID:                uuid.NewString(),
+			PreviousAmountMax: auth.AmountMax,
+			AmountMax:         auth.AmountMax,
+			PreviousInterval:  auth.Interval,
+			Interval:          auth.Interval,
+			MandateVersion:    mandate.Version,
+			IPAddress:         c.ClientIP(),
+			UserAgent:         c.Request.UserAgent(),
+			CreatedAt:         time.Now(),
+		}
+		if req.AmountMax != 0 {
+			amendment.AmountMax = req.AmountMax
+		}
+		if req.Interval != "" {
+			amendment.Interval = req.Interval
+		}
+		if err := tx.Create(ref.Collection("amendments").Doc(amendment.ID), amendment); err != nil {
+			return err
+		}
+		auth.AmountMax = amendment.AmountMax
+		auth.Interval = amendment.Interval
+		auth.MandateVersion = mandate.Version
+		auth.MandateText = mandate.Text
+		auth.UpdatedAt = amendment.CreatedAt
+		return tx.Update(ref, []firestore.Update{
+			{Path: "amount_max", Value: auth.AmountMax},
+			{Path: "interval", Value: auth.Interval},
+			{Path: "mandate_version", Value: auth.MandateVersion},
+			{Path: "mandate_text", Value: auth.MandateText},
+			{Path: "updated_at", Value: auth.UpdatedAt},
+		})
+	})
+	if status.Code(err) == codes.NotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mandate not found"})
+		return
+	}
+	if errors.Is(err, ErrMandateInactive) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Mandate has been revoked"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to amend mandate"})
+		return
+	}
+	auth.ID = ref.ID
+
+	if amendment.AmountMax != amendment.PreviousAmountMax {
+		NotifyUser(ctx, fs, uid, NotificationMandateAmended, "Recurring debit amount changed",
+			fmt.Sprintf("Your %s debits can now be up to %s, previously %s.", auth.Interval,
+				formatMandateAmount(amendment.AmountMax, auth.Currency), formatMandateAmount(amendment.PreviousAmountMax, auth.Currency)),
+			map[string]interface{}{"mandate_id": auth.ID, "amendment_id": amendment.ID})
+	}
+	c.JSON(http.StatusOK, gin.H{"mandate": auth, "amendment": amendment})
+}
+
+// RevokeMandate stops all future debits under a recurring mandate
+func RevokeMandate(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := fs.Collection("ach_authorizations").Doc(c.Param("id"))
+	var auth ACHAuthorization
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&auth); err != nil {
+			return err
+		}
+		if auth.UserID != uid || auth.Frequency != ACHFrequencyRecurring {
+			return status.Error(codes.NotFound, "mandate not found")
+		}
+		if auth.Status == MandateRevoked {
+			return nil
+		}
+		now := time.Now()
+		auth.Status, auth.RevokedAt, auth.UpdatedAt = MandateRevoked, now, now
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: MandateRevoked},
+			{Path: "revoked_at", Value: now},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if status.Code(err) == codes.NotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mandate not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke mandate"})
+		return
+	}
+	auth.ID = ref.ID
+
+	NotifyUser(ctx, fs, uid, NotificationMandateRevoked, "Recurring debit cancelled",
+		fmt.Sprintf("Your %s debits of up to %s have been cancelled.", auth.Interval, formatMandateAmount(auth.AmountMax, auth.Currency)),
+		map[string]interface{}{"mandate_id": auth.ID})
+	c.JSON(http.StatusOK, gin.H{"mandate": auth})
+}
+
+// formatMandateAmount renders minor units for a notification body
+func formatMandateAmount(amount int64, currency string) string {
+	return currencyOrDefault(currency).Decimal(amount) + " " + strings.ToUpper(currency)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stripe/stripe-go/v76"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// NotificationPaymentReturned tells a sender their bank returned a payment
+	NotificationPaymentReturned = "payment_returned"
+	// NotificationPaymentReversed tells a recipient a returned payment was taken back
+	NotificationPaymentReversed = "payment_reversed"
+)
+
+// Clawback states for a returned payment that was already transferred
+const (
+	ClawbackReversed = "reversed"
+	ClawbackFailed   = "failed"
+)
+
+// achReturnCodes maps the failure codes Stripe reports for bank debits to the
+// NACHA return code behind them
+var achReturnCodes = map[string]string{
+	"insufficient_funds":      "R01",
+	"account_closed":          "R02",
+	"no_account":              "R03",
+	"invalid_account_number":  "R04",
+	"debit_not_authorized":    "R10",
+	"account_frozen":          "R16",
+	"bank_account_restricted": "R16",
+}
+
+// achReturnCode returns the NACHA return code for a failure code, or "" when
+// it isn't a bank return. NACHA codes from rails that report them directly
+// pass through.
+func achReturnCode(code string) string {
+	if len(code) == 3 && code[0] == 'R' && code[1] >= '0' && code[1] <= '9' && code[2] >= '0' && code[2] <= '9' {
+		return code
+	}
+	return achReturnCodes[code]
+}
+
+// isBankDebit reports whether a PaymentIntent debited a bank account
+func isBankDebit(pi *stripe.PaymentIntent) bool {
+	if pi.LastPaymentError != nil && pi.LastPaymentError.PaymentMethod != nil {
+		return pi.LastPaymentError.PaymentMethod.Type == stripe.PaymentMethodTypeUSBankAccount
+	}
+	return slices.Equal(pi.PaymentMethodTypes, []string{string(stripe.PaymentMethodTypeUSBankAccount)})
+}
+
+// chargeReturnCode returns the ACH return code on a refunded bank debit, or ""
+// when the charge was refunded for any other reason
+func chargeReturnCode(ch *stripe.Charge) string {
+	if ch.PaymentMethodDetails == nil || ch.PaymentMethodDetails.USBankAccount == nil {
+		return ""
+	}
+	return achReturnCode(ch.FailureCode)
+}
+
+// recordACHReturn records a bank debit returned with failureCode on its
+// transaction, tells the sender why, and claws back the transfer if the
+// recipient was already paid. succeeded marks a return after the payment
+// had succeeded, which moves it to returned; earlier returns are already
+// failed. Safe to repeat: the sender is told once, and the clawback is
+// retried until the transfer is reversed.
+func recordACHReturn(ctx context.Context, d *webhookDeps, paymentIntentID, failureCode string, succeeded bool) error {
+	returnCode := achReturnCode(failureCode)
+	doc, err := getDocument(ctx, d.fs.Collection("transactions").Doc(paymentIntentID))
+	if status.Code(err) == codes.NotFound {
+		// Wallet top-ups aren't transactions
+		_, err := reverseWalletTopUp(ctx, d.fs, d.ledger, paymentIntentID, failureCode)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	data := doc.Data()
+	senderUID := stringField(data, "sender_user_id")
+	recipientUID := stringField(data, "recipient_user_id")
+	amount, _ := data["amount"].(int64)
+	firstDelivery := stringField(data, "ach_return_code") == ""
+	msg := failureMessageFor(failureCode, defaultLocale)
+
+	fields := map[string]interface{}{
+		"ach_return_code": returnCode,
+		"failure_code":    failureCode,
+		"failure_reason":  msg.Reason,
+	}
+	if firstDelivery {
+		fields["returned_at"] = time.Now()
+	}
+	// Nothing was collected, so there is nothing to pay out
+	if s := stringField(data, "transfer_status"); s == TransferStatusRetrying || s == TransferStatusFrozen {
+		fields["transfer_status"] = TransferStatusCanceled
+		fields["transfer_retry_at"] = firestore.Delete
+	}
+	applied := false
+	if succeeded {
+		if applied, err = SetTransactionStatus(ctx, d.fs, paymentIntentID, TransactionStatusReturned, fields); err != nil {
+			return err
+		}
+	}
+	if !applied {
+		if err := SaveTransaction(ctx, d.fs, paymentIntentID, fields); err != nil {
+			return err
+		}
+	}
+
+	if transferID := stringField(data, "transfer_id"); strings.HasPrefix(transferID, "tr_") && stringField(data, "clawback_status") != ClawbackReversed {
+		if err := clawBackTransfer(ctx, d, paymentIntentID, transferID, recipientUID, amount); err != nil {
+			return err
+		}
+	}
+
+	if firstDelivery {
+		// Returns lower the sender's send limits for riskLookback
+		if senderUID != "" {
+			if err := SaveUserFields(ctx, d.fs, senderUID, map[string]interface{}{
+				"ach_returns": firestore.ArrayUnion(time.Now()),
+			}); err != nil {
+				slog.ErrorContext(ctx, "failed to record return on sender", "component", "ach_returns", "user_id", senderUID, "error", err)
+			}
+		}
+		NotifyUser(ctx, d.fs, senderUID, NotificationPaymentReturned, "Your bank returned a payment",
+			fmt.Sprintf("Your %s payment was returned by your bank. %s", currencyOrDefault(stringField(data, "currency")).Format(amount), msg.Message),
+			map[string]interface{}{"transaction_id": paymentIntentID, "return_code": returnCode, "reason": msg.Reason})
+		PublishEvent(ctx, d.fs, Event{
+			ID:            "ach_return_" + paymentIntentID,
+			Type:          EventTransactionReturned,
+			UserIDs:       []string{senderUID, recipientUID},
+			TransactionID: paymentIntentID,
+			Data:          map[string]interface{}{"amount": amount, "currency": stringField(data, "currency"), "return_code": returnCode, "reason": msg.Reason},
+		})
+	}
+	return nil
+}
+
+// clawBackTransfer reverses the transfer that paid a recipient for a debit
+// that was then returned. A failure is recorded and returned so the webhook
+// is retried; the reversal is keyed by PaymentIntent, so it happens once.
+func clawBackTransfer(ctx context.Context, d *webhookDeps, paymentIntentID, transferID, recipientUID string, amount int64) error {
+	reversal, err := d.sc.ReverseTransfer(ctx, transferID,
+		map[string]string{"reason": "ach_return", "payment_intent_id": paymentIntentID},
+		"ach_return_"+paymentIntentID)
+	if err != nil {
+		d.sc.LogAPIError(ctx, "ach_return_clawback", recipientUID, err)
+		if serr := SaveTransaction(ctx, d.fs, paymentIntentID, map[string]interface{}{
+			"clawback_status": ClawbackFailed,
+			"clawback_error":  err.Error(),
+		}); serr != nil {
+			slog.ErrorContext(ctx, "failed to record clawback", "component", "ach_returns", "payment_intent", paymentIntentID, "error", serr)
+		}
+		return fmt.Errorf("clawback for %s: %w", paymentIntentID, err)
+	}
+	d.sc.LogAPIInteraction(ctx, "ach_return_clawback", recipientUID, true, fmt.Sprintf("Reversal: %s", reversal.ID))
+	d.postLedger(ctx, recipientUID, TransferReversalLedgerTransaction(reversal.ID, recipientUID, reversal.Amount, string(reversal.Currency)))
+	if err := SaveTransaction(ctx, d.fs, paymentIntentID, map[string]interface{}{
+		"clawback_status":      ClawbackReversed,
+		"clawback_reversal_id": reversal.ID,
+		"clawback_error":       firestore.Delete,
+	}); err != nil {
+		slog.ErrorContext(ctx, "failed to record clawback", "component", "ach_returns", "payment_intent", paymentIntentID, "error", err)
+	}
+	NotifyUser(ctx, d.fs, recipientUID, NotificationPaymentReversed, "Payment reversed",
+		fmt.Sprintf("A %s payment to you was returned by the sender's bank, so it has been taken back", currencyOrDefault(string(reversal.Currency)).Format(amount)),
+		map[string]interface{}{"transaction_id": paymentIntentID, "reversal_id": reversal.ID})
+	return nil
+}
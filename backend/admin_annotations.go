@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Subjects admins can annotate
+const (
+	AnnotationSubjectTransaction = "transaction"
+	AnnotationSubjectUser        = "user"
+)
+
+// adminTags are the tags support may attach to a transaction or user
+var adminTags = map[string]bool{
+	"fraud-suspect":  true,
+	"refund-pending": true,
+	"vip":            true,
+}
+
+// incidentTagPattern matches incident-<slug> tags, which group the
+// transactions hit by one incident so they can be bulk refunded
+var incidentTagPattern = regexp.MustCompile(`^incident-[a-z0-9][a-z0-9-]{0,62}$`)
+
+// isAdminTag reports whether tag is a known tag or an incident tag
+func isAdminTag(tag string) bool {
+	return adminTags[tag] || incidentTagPattern.MatchString(tag)
+}
+
+// Admin access log actions
+const (
+	AdminAccessRead   = "read"
+	AdminAccessWrite  = "write"
+	AdminAccessSearch = "search"
+)
+
+// AdminAnnotation is an internal note about a transaction or user, stored at
+// admin_annotations/{id}. Annotations and the tag index are never written to
+// documents the app reads.
+type AdminAnnotation struct {
+	ID          string    `json:"id" firestore:"-"`
+	SubjectType string    `json:"subject_type" firestore:"subject_type"`
+	SubjectID   string    `json:"subject_id" firestore:"subject_id"`
+	Note        string    `json:"note,omitempty" firestore:"note,omitempty"`
+	Tags        []string  `json:"tags,omitempty" firestore:"tags,omitempty"`
+	AuthorID    string    `json:"author_id" firestore:"author_id"`
+	CreatedAt   time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// AdminTagSet is the current tags on a subject, kept at
+// admin_tags/{subjectType}_{subjectID} so subjects can be searched by tag
+type AdminTagSet struct {
+	SubjectType string    `json:"subject_type" firestore:"subject_type"`
+	SubjectID   string    `json:"subject_id" firestore:"subject_id"`
+	Tags        []string  `json:"tags" firestore:"tags"`
+	UpdatedAt   time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// AdminAccess is one admin read or change of annotations, stored at admin_access_log/{id}
+type AdminAccess struct {
+	AdminID     string    `json:"admin_id" firestore:"admin_id"`
+	Action      string    `json:"action" firestore:"action"`
+	SubjectType string    `json:"subject_type,omitempty" firestore:"subject_type,omitempty"`
+	SubjectID   string    `json:"subject_id,omitempty" firestore:"subject_id,omitempty"`
+	Query       string    `json:"query,omitempty" firestore:"query,omitempty"`
+	RequestID   string    `json:"request_id,omitempty" firestore:"request_id,omitempty"`
+	At          time.Time `json:"at" firestore:"at"`
+}
+
+// logAdminAccess records who looked at or changed internal annotations
+func logAdminAccess(ctx context.Context, fs *firestore.Client, entry AdminAccess) error {
+	entry.RequestID = RequestIDFromContext(ctx)
+	entry.At = time.Now()
+	_, _, err := fs.Collection("admin_access_log").Add(ctx, entry)
+	return err
+}
+
+// adminTagSetRef returns the tag index document for a subject
+func adminTagSetRef(fs *firestore.Client, subjectType, subjectID string) *firestore.DocumentRef {
+	return fs.Collection("admin_tags").Doc(subjectType + "_" + subjectID)
+}
+
+// annotationSubjectExists checks the transaction or user being annotated
+func annotationSubjectExists(ctx context.Context, fs *firestore.Client, subjectType, subjectID string) bool {
+	var ref *firestore.DocumentRef
+	switch subjectType {
+	case AnnotationSubjectTransaction:
+		ref = fs.Collection("transactions").Doc(subjectID)
+	case AnnotationSubjectUser:
+		ref = UserDoc(ctx, fs, subjectID)
+	default:
+		return false
+	}
+	_, err := getDocument(ctx, ref)
+	return err == nil
+}
+
+// CreateAdminAnnotation attaches a note and/or tags to a transaction or user
+func CreateAdminAnnotation(c *gin.Context) {
+	var req struct {
+		SubjectType string   `json:"subject_type" binding:"required,oneof=transaction user"`
+		SubjectID   string   `json:"subject_id" binding:"required"`
+		Note        string   `json:"note" binding:"max=4000"`
+		Tags        []string `json:"tags"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if req.Note == "" && len(req.Tags) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "note or tags is required"})
+		return
+	}
+	for _, tag := range req.Tags {
+		if !isAdminTag(tag) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tag " + tag})
+			return
+		}
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	adminID := c.GetString("userID")
+
+	if !annotationSubjectExists(ctx, fs, req.SubjectType, req.SubjectID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	annotation := AdminAnnotation{
+		ID:          uuid.NewString(),
+		SubjectType: req.SubjectType,
+		SubjectID:   req.SubjectID,
+		Note:        req.Note,
+		Tags:        req.Tags,
+		AuthorID:    adminID,
+		CreatedAt:   time.Now(),
+	}
+	batch := fs.Batch()
+	batch.Create(fs.Collection("admin_annotations").Doc(annotation.ID), annotation)
+	if len(req.Tags) > 0 {
+		tags := make([]interface{}, len(req.Tags))
+		for i, tag := range req.Tags {
+			tags[i] = tag
+		}
+		batch.Set(adminTagSetRef(fs, req.SubjectType, req.SubjectID), map[string]interface{}{
+			"subject_type": req.SubjectType,
+			"subject_id":   req.SubjectID,
+			"tags":         firestore.ArrayUnion(tags...),
+			"updated_at":   annotation.CreatedAt,
+		}, firestore.MergeAll)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save annotation"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: req.SubjectType, SubjectID: req.SubjectID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log access"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"annotation": annotation})
+}
+
+// GetAdminAnnotations returns a subject's notes, newest first, and its current tags
+func GetAdminAnnotations(c *gin.Context) {
+	subjectType, subjectID := c.Param("subjectType"), c.Param("subjectID")
+	if subjectType != AnnotationSubjectTransaction && subjectType != AnnotationSubjectUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject type must be transaction or user"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	// Logged before reading so a failed log never leaves an unrecorded view
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: c.GetString("userID"), Action: AdminAccessRead, SubjectType: subjectType, SubjectID: subjectID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log access"})
+		return
+	}
+
+	docs, err := fs.Collection("admin_annotations").
+		Where("subject_type", "==", subjectType).
+		Where("subject_id", "==", subjectID).
+		OrderBy("created_at", firestore.Desc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load annotations"})
+		return
+	}
+	annotations := make([]AdminAnnotation, 0, len(docs))
+	for _, doc := range docs {
+		var a AdminAnnotation
+		if err := doc.DataTo(&a); err != nil {
+			continue
+		}
+		a.ID = doc.Ref.ID
+		annotations = append(annotations, a)
+	}
+
+	tags := []string{}
+	if doc, err := adminTagSetRef(fs, subjectType, subjectID).Get(ctx); err == nil {
+		var set AdminTagSet
+		if doc.DataTo(&set) == nil && set.Tags != nil {
+			tags = set.Tags
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"annotations": annotations, "tags": tags})
+}
+
+// RemoveAdminTag takes a tag off a subject, e.g. once a pending refund is issued
+func RemoveAdminTag(c *gin.Context) {
+	subjectType, subjectID, tag := c.Param("subjectType"), c.Param("subjectID"), c.Param("tag")
+	if !isAdminTag(tag) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tag " + tag})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := adminTagSetRef(fs, subjectType, subjectID)
+	if _, err := ref.Update(ctx, []firestore.Update{
+		{Path: "tags", Value: firestore.ArrayRemove(tag)},
+		{Path: "updated_at", Value: time.Now()},
+	}); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject has no tags"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: c.GetString("userID"), Action: AdminAccessWrite, SubjectType: subjectType, SubjectID: subjectID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log access"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": tag})
+}
+
+// SearchAdminTags lists the transactions or users carrying a tag, most recently tagged first
+func SearchAdminTags(c *gin.Context) {
+	tag := c.Query("tag")
+	if !isAdminTag(tag) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tag must be one of fraud-suspect, refund-pending, vip, or incident-<slug>"})
+		return
+	}
+	subjectType := c.Query("subject_type")
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: c.GetString("userID"), Action: AdminAccessSearch, SubjectType: subjectType, Query: "tag=" + tag}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log access"})
+		return
+	}
+
+	q := fs.Collection("admin_tags").Where("tags", "array-contains", tag)
+	if subjectType != "" {
+		q = q.Where("subject_type", "==", subjectType)
+	}
+	docs, err := q.OrderBy("updated_at", firestore.Desc).Limit(100).Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search tags"})
+		return
+	}
+	results := make([]AdminTagSet, 0, len(docs))
+	for _, doc := range docs {
+		var set AdminTagSet
+		if err := doc.DataTo(&set); err != nil {
+			continue
+		}
+		results = append(results, set)
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// ListAdminAccessLog returns who read or changed a subject's annotations
+func ListAdminAccessLog(c *gin.Context) {
+	subjectID := c.Query("subject_id")
+	if subjectID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject_id is required"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("admin_access_log").
+		Where("subject_id", "==", subjectID).
+		OrderBy("at", firestore.Desc).
+		Limit(200).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load access log"})
+		return
+	}
+	entries := make([]AdminAccess, 0, len(docs))
+	for _, doc := range docs {
+		var entry AdminAccess
+		if err := doc.DataTo(&entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Scopes an API key can be granted
+const (
+	APIKeyScopePaymentLinks = "payment_links"
+	APIKeyScopeInvoices     = "invoices"
+	APIKeyScopeTransactions = "transactions"
+)
+
+const (
+	// apiKeyPrefix starts every key so leaked keys are easy to scan for
+	apiKeyPrefix = "dpk_"
+	// defaultAPIKeyRateLimit and maxAPIKeyRateLimit bound requests per minute per key
+	defaultAPIKeyRateLimit = 60
+	maxAPIKeyRateLimit     = 600
+	// apiKeyRotationGrace is how long the secret a rotation replaced keeps
+	// working, so integrations can be redeployed without downtime
+	apiKeyRotationGrace = 24 * time.Hour
+)
+
+var (
+	errAPIKeyInvalid     = errors.New("invalid API key")
+	errAPIKeyRateLimited = errors.New("API key rate limit exceeded")
+)
+
+// APIKey is stored at api_keys/{id}. Only a hash of the secret is kept; the
+// key itself is shown once, when created or rotated.
+type APIKey struct {
+	ID         string    `json:"id" firestore:"-"`
+	UserID     string    `json:"user_id" firestore:"user_id"`
+	Label      string    `json:"label" firestore:"label"`
+	Scopes     []string  `json:"scopes" firestore:"scopes"`
+	RateLimit  int       `json:"rate_limit" firestore:"rate_limit"` // requests per minute
+	Last4      string    `json:"last4" firestore:"last4"`
+	SecretHash string    `json:"-" firestore:"secret_hash"`
+	CreatedAt  time.Time `json:"created_at" firestore:"created_at"`
+	RotatedAt  time.Time `json:"rotated_at,omitempty" firestore:"rotated_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty" firestore:"last_used_at,omitempty"`
+	Revoked    bool      `json:"revoked" firestore:"revoked"`
+
+	// The secret a rotation replaced, accepted until PreviousExpiresAt
+	PreviousSecretHash string    `json:"-" firestore:"previous_secret_hash,omitempty"`
+	PreviousExpiresAt  time.Time `json:"previous_expires_at,omitempty" firestore:"previous_expires_at,omitempty"`
+
+	// Fixed one-minute rate limit window
+	WindowStart time.Time `json:"-" firestore:"window_start,omitempty"`
+	WindowCount int       `json:"-" firestore:"window_count"`
+}
+
+// hashAPIKeySecret is what's stored in place of a key's secret
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a random secret and its hash
+func newAPIKeySecret() (secret, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = hex.EncodeToString(b)
+	return secret, hashAPIKeySecret(secret), nil
+}
+
+// formatAPIKey joins a key's ID and secret into the string callers send
+func formatAPIKey(id, secret string) string {
+	return apiKeyPrefix + id + "_" + secret
+}
+
+// parseAPIKey splits a key into its ID and secret
+func parseAPIKey(key string) (id, secret string, ok bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+// verifiedBusiness reports whether a user may hold API keys: a service
+// provider that has completed full KYC
+func verifiedBusiness(data map[string]interface{}) bool {
+	provider, _ := data["service_provider"].(bool)
+	return provider && stringField(data, "kyc_level") == KYCVerified
+}
+
+// useAPIKey checks secret against the key, counts the request against its
+// rate limit, and records when it was used. retryAfter is set when the key
+// is over its limit.
+func useAPIKey(ctx context.Context, fs *firestore.Client, id, secret string) (key *APIKey, retryAfter time.Duration, err error) {
+	ref := fs.Collection("api_keys").Doc(id)
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return errAPIKeyInvalid
+		}
+		if err != nil {
+			return err
+		}
+		key = &APIKey{}
+		if err := doc.DataTo(key); err != nil {
+			return err
+		}
+		key.ID = doc.Ref.ID
+		now := time.Now()
+		hash := hashAPIKeySecret(secret)
+		current := subtle.ConstantTimeCompare([]byte(hash), []byte(key.SecretHash)) == 1
+		previous := key.PreviousSecretHash != "" && now.Before(key.PreviousExpiresAt) &&
+			subtle.ConstantTimeCompare([]byte(hash), []byte(key.PreviousSecretHash)) == 1
+		if key.Revoked || (!current && !previous) {
+			return errAPIKeyInvalid
+		}
+
+		if now.Sub(key.WindowStart) >= time.Minute {
+			key.WindowStart = now.Truncate(time.Minute)
+			key.WindowCount = 0
+		}
+		if key.WindowCount >= key.RateLimit {
+			retryAfter = key.WindowStart.Add(time.Minute).Sub(now)
+			return errAPIKeyRateLimited
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "window_start", Value: key.WindowStart},
+			{Path: "window_count", Value: key.WindowCount + 1},
+			{Path: "last_used_at", Value: now},
+		})
+	})
+	return key, retryAfter, err
+}
+
+// APIKeyMiddleware authenticates a business's API key and requires the given
+// scope. It sets userID and email to the key's owner, so the shared handlers
+// act for them, and apiKeyID to the key.
+func APIKeyMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		id, secret, ok := parseAPIKey(key)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key required"})
+			return
+		}
+		v, ok := c.Get("firestore")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+			return
+		}
+		fs := v.(*firestore.Client)
+		ctx := c.Request.Context()
+
+		record, retryAfter, err := useAPIKey(ctx, fs, id, secret)
+		switch {
+		case errors.Is(err, errAPIKeyRateLimited):
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded", "limit": record.RateLimit})
+			return
+		case errors.Is(err, errAPIKeyInvalid):
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or revoked API key"})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+			return
+		}
+		if !slices.Contains(record.Scopes, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+			return
+		}
+
+		// Keys stop working if the business loses its verification
+		doc, err := getDocument(ctx, UserDoc(ctx, fs, record.UserID))
+		if err != nil || !verifiedBusiness(doc.Data()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API access requires a verified business account"})
+			return
+		}
+		c.Set("userID", record.UserID)
+		email := stringField(doc.Data(), "email_address")
+		if email == "" {
+			email = stringField(doc.Data(), "email")
+		}
+		c.Set("email", email)
+		c.Set("apiKeyID", record.ID)
+		c.Next()
+	}
+}
+
+// apiKeyDeps resolves the caller and Firestore for key management
+func apiKeyDeps(c *gin.Context) (string, *firestore.Client, bool) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", nil, false
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return "", nil, false
+	}
+	return uidVal.(string), v.(*firestore.Client), true
+}
+
+// loadOwnAPIKey loads one of the caller's keys, responding 404 otherwise
+func loadOwnAPIKey(c *gin.Context, fs *firestore.Client, uid string) (*APIKey, bool) {
+	doc, err := getDocument(c.Request.Context(), fs.Collection("api_keys").Doc(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return nil, false
+	}
+	var key APIKey
+	if err := doc.DataTo(&key); err != nil || key.UserID != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return nil, false
+	}
+	key.ID = doc.Ref.ID
+	return &key, true
+}
+
+// CreateAPIKey issues a scoped API key to a verified business
+func CreateAPIKey(c *gin.Context) {
+	var req struct {
+		Label     string   `json:"label" binding:"required,max=100"`
+		Scopes    []string `json:"scopes" binding:"required,min=1,dive,oneof=payment_links invoices transactions"`
+		RateLimit int      `json:"rate_limit" binding:"omitempty,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RateLimit > maxAPIKeyRateLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("rate_limit may be at most %d", maxAPIKeyRateLimit)})
+		return
+	}
+	if req.RateLimit == 0 {
+		req.RateLimit = defaultAPIKeyRateLimit
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil || !verifiedBusiness(doc.Data()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys are available to verified business accounts"})
+		return
+	}
+
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	ref := fs.Collection("api_keys").NewDoc()
+	key := &APIKey{
+		ID:         ref.ID,
+		UserID:     uid,
+		Label:      req.Label,
+		Scopes:     slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		RateLimit:  req.RateLimit,
+		Last4:      secret[len(secret)-4:],
+		SecretHash: hash,
+		CreatedAt:  time.Now(),
+	}
+	if _, err := ref.Set(ctx, key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create key"})
+		return
+	}
+	// The key is only ever returned here and on rotation
+	c.JSON(http.StatusCreated, gin.H{"key": formatAPIKey(key.ID, secret), "api_key": key})
+}
+
+// ListAPIKeys returns the caller's API keys, without their secrets
+func ListAPIKeys(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("api_keys").Where("user_id", "==", uid).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load keys"})
+		return
+	}
+	keys := make([]APIKey, 0, len(docs))
+	for _, doc := range docs {
+		var k APIKey
+		if err := doc.DataTo(&k); err != nil {
+			continue
+		}
+		k.ID = doc.Ref.ID
+		keys = append(keys, k)
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// RotateAPIKey replaces a key's secret. The old secret keeps working for
+// apiKeyRotationGrace so integrations can switch over.
+func RotateAPIKey(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	key, ok := loadOwnAPIKey(c, fs, uid)
+	if !ok {
+		return
+	}
+	if key.Revoked {
+		c.JSON(http.StatusConflict, gin.H{"error": "API key has been revoked"})
+		return
+	}
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	now := time.Now()
+	key.PreviousSecretHash, key.PreviousExpiresAt = key.SecretHash, now.Add(apiKeyRotationGrace)
+	key.SecretHash, key.Last4, key.RotatedAt = hash, secret[len(secret)-4:], now
+	if _, err := fs.Collection("api_keys").Doc(key.ID).Update(c.Request.Context(), []firestore.Update{
+		{Path: "secret_hash", Value: key.SecretHash},
+		{Path: "last4", Value: key.Last4},
+		{Path: "rotated_at", Value: key.RotatedAt},
+		{Path: "previous_secret_hash", Value: key.PreviousSecretHash},
+		{Path: "previous_expires_at", Value: key.PreviousExpiresAt},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": formatAPIKey(key.ID, secret), "api_key": key})
+}
+
+// RevokeAPIKey immediately disables a key and any secret it was rotated from
+func RevokeAPIKey(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	key, ok := loadOwnAPIKey(c, fs, uid)
+	if !ok {
+		return
+	}
+	if _, err := fs.Collection("api_keys").Doc(key.ID).Update(c.Request.Context(), []firestore.Update{
+		{Path: "revoked", Value: true},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Scopes an auditor token can be granted
+const (
+	AuditorScopeTransactions = "transactions"
+	AuditorScopeStatements   = "statements"
+)
+
+// maxAuditorTokenTTL bounds how long an accountant's access can last
+const maxAuditorTokenTTL = 90 * 24 * time.Hour
+
+// AuditorToken is stored at auditor_tokens/{id}; the signed token itself is never stored
+type AuditorToken struct {
+	ID         string    `json:"id" firestore:"-"`
+	UserID     string    `json:"user_id" firestore:"user_id"`
+	Label      string    `json:"label" firestore:"label"`
+	Scopes     []string  `json:"scopes" firestore:"scopes"`
+	CreatedAt  time.Time `json:"created_at" firestore:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at" firestore:"expires_at"`
+	Revoked    bool      `json:"revoked" firestore:"revoked"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty" firestore:"last_used_at,omitempty"`
+}
+
+// auditorClaims are carried by auditor tokens
+type auditorClaims struct {
+	Scopes []string `json:"scopes"`
+	jwt.RegisteredClaims
+}
+
+// auditorSigningKey loads the HMAC key auditor tokens are signed with
+func auditorSigningKey() ([]byte, error) {
+	key := os.Getenv("AUDITOR_TOKEN_SECRET")
+	if len(key) < 32 {
+		return nil, fmt.Errorf("AUDITOR_TOKEN_SECRET must be at least 32 bytes")
+	}
+	return []byte(key), nil
+}
+
+// CreateAuditorToken issues a read-only, time-limited token for an accountant
+func CreateAuditorToken(c *gin.Context) {
+	var req struct {
+		Label          string   `json:"label" binding:"required"`
+		Scopes         []string `json:"scopes" binding:"required,min=1,dive,oneof=transactions statements"`
+		ExpiresInHours int      `json:"expires_in_hours" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl := time.Duration(req.ExpiresInHours) * time.Hour
+	if ttl > maxAuditorTokenTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in_hours may be at most %d", int(maxAuditorTokenTTL.Hours()))})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	key, err := auditorSigningKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Auditor access is not configured"})
+		return
+	}
+
+	now := time.Now()
+	record := &AuditorToken{
+		ID:        uuid.NewString(),
+		UserID:    uid,
+		Label:     req.Label,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, auditorClaims{
+		Scopes: record.Scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        record.ID,
+			Subject:   uid,
+			Audience:  jwt.ClaimStrings{"auditor"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(record.ExpiresAt),
+		},
+	}).SignedString(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+	if _, err := fs.Collection("auditor_tokens").Doc(record.ID).Set(c.Request.Context(), record); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+
+	// The token is only ever returned here; share it with the accountant directly
+	c.JSON(http.StatusCreated, gin.H{"token": signed, "auditor_token": record})
+}
+
+// ListAuditorTokens returns the caller's auditor tokens
+func ListAuditorTokens(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("auditor_tokens").Where("user_id", "==", uid).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tokens"})
+		return
+	}
+	tokens := make([]AuditorToken, 0, len(docs))
+	for _, doc := range docs {
+		var t AuditorToken
+		if err := doc.DataTo(&t); err != nil {
+			continue
+		}
+		t.ID = doc.Ref.ID
+		tokens = append(tokens, t)
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// RevokeAuditorToken immediately ends an accountant's access
+func RevokeAuditorToken(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := fs.Collection("auditor_tokens").Doc(c.Param("id"))
+	doc, err := ref.Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	if owner, _ := doc.Data()["user_id"].(string); owner != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	if _, err := ref.Set(ctx, map[string]interface{}{"revoked": true}, firestore.MergeAll); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
+
+// AuditorMiddleware authenticates an auditor token for read-only requests and
+// requires the given scope. It sets userID to the token's owner so the shared
+// read handlers serve that user's data.
+func AuditorMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{"error": "Auditor access is read-only"})
+			return
+		}
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if tokenString == "" || tokenString == c.GetHeader("Authorization") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			return
+		}
+		key, err := auditorSigningKey()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Auditor access is not configured"})
+			return
+		}
+
+		claims := &auditorClaims{}
+		_, err = jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+			return key, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience("auditor"))
+		if err != nil || !slices.Contains(claims.Scopes, scope) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired auditor token"})
+			return
+		}
+
+		v, ok := c.Get("firestore")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+			return
+		}
+		fs := v.(*firestore.Client)
+		ref := fs.Collection("auditor_tokens").Doc(claims.ID)
+		doc, err := ref.Get(c.Request.Context())
+		if err != nil || !doc.Exists() {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired auditor token"})
+			return
+		}
+		if revoked, _ := doc.Data()["revoked"].(bool); revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Auditor token has been revoked"})
+			return
+		}
+		_, _ = ref.Set(c.Request.Context(), map[string]interface{}{"last_used_at": time.Now()}, firestore.MergeAll)
+
+		c.Set("userID", claims.Subject)
+		c.Set("auditorTokenID", claims.ID)
+		c.Next()
+	}
+}
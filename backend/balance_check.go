@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Balance check outcomes
+const (
+	// BalanceSufficient covers the amount and the buffer
+	BalanceSufficient = "sufficient"
+	// BalanceLow covers the amount but not the buffer; the payment goes ahead
+	// with a warning
+	BalanceLow = "low"
+	// BalanceInsufficient doesn't cover the amount; the payment is rejected
+	// unless BALANCE_CHECK_MODE is warn
+	BalanceInsufficient = "insufficient"
+	// BalanceUnavailable means the balance couldn't be read; the payment goes
+	// ahead, as it did before balances were checked
+	BalanceUnavailable = "unavailable"
+)
+
+// MetricBalanceChecksTotal counts ACH balance checks by outcome
+const MetricBalanceChecksTotal = "ach_balance_checks_total"
+
+// balanceCheckTimeout bounds the Plaid call; real-time balances can take
+// several seconds at some institutions
+const balanceCheckTimeout = 8 * time.Second
+
+// BalanceCheck is the result of checking a sender's bank balance before an
+// ACH debit, returned to the client as balance_check
+type BalanceCheck struct {
+	Status    string `json:"status"`
+	Available *int64 `json:"available,omitempty"`
+	Required  int64  `json:"required"`
+	Buffer    int64  `json:"buffer"`
+	Warning   string `json:"warning,omitempty"`
+}
+
+// balanceCheckMode is BALANCE_CHECK_MODE: reject (default), warn, or off
+func balanceCheckMode() string {
+	switch mode := os.Getenv("BALANCE_CHECK_MODE"); mode {
+	case "warn", "off":
+		return mode
+	default:
+		return "reject"
+	}
+}
+
+// balanceCheckBuffer is BALANCE_CHECK_BUFFER, the cushion in minor units a
+// sender's available balance should keep above the amount, e.g. for other
+// debits landing the same day
+func balanceCheckBuffer() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("BALANCE_CHECK_BUFFER"), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	return 0
+}
+
+// evaluateBalance compares an available balance with what a debit needs.
+// Senders pay no fees, so the amount is all that leaves their account.
+func evaluateBalance(available, amount, buffer int64) *BalanceCheck {
+	check := &BalanceCheck{Status: BalanceSufficient, Available: &available, Required: amount, Buffer: buffer}
+	switch {
+	case available < amount:
+		check.Status = BalanceInsufficient
+		check.Warning = "Your bank balance is lower than this payment, so your bank may return it unpaid."
+	case available < amount+buffer:
+		check.Status = BalanceLow
+		check.Warning = "This payment will leave your bank balance low."
+	}
+	return check
+}
+
+// checkACHBalance reads the sender's available balance from Plaid before a
+// payment debits their linked bank account. It returns nil for payments that
+// aren't ACH debits of a Plaid-linked account. Any failure to read the
+// balance is reported as unavailable rather than blocking the payment.
+func checkACHBalance(c *gin.Context, pp PaymentProvider, fs *firestore.Client, uid, paymentMethodID string, amount int64) *BalanceCheck {
+	sc, ok := pp.(*StripeClient)
+	if !ok || fs == nil || paymentMethodID == "" || balanceCheckMode() == "off" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), balanceCheckTimeout)
+	defer cancel()
+
+	pm, err := sc.GetPaymentMethod(ctx, paymentMethodID)
+	if err != nil || pm.Type != stripe.PaymentMethodTypeUSBankAccount {
+		// An invalid payment method is reported when the payment is created
+		return nil
+	}
+	accountID := pm.Metadata["plaid_account_id"]
+	if accountID == "" {
+		return nil
+	}
+
+	buffer := balanceCheckBuffer()
+	check := &BalanceCheck{Status: BalanceUnavailable, Required: amount, Buffer: buffer}
+	if v, ok := c.Get("plaidClient"); ok {
+		available, err := plaidAvailableBalance(ctx, v.(*PlaidClient), fs, uid, accountID)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to check bank balance", "component", "balance_check", "user_id", uid, "error", err)
+		} else {
+			check = evaluateBalance(available, amount, buffer)
+		}
+	}
+	metrics.IncCounter(MetricBalanceChecksTotal, map[string]string{"status": check.Status})
+	return check
+}
+
+// plaidAvailableBalance finds the sender's item holding accountID and returns
+// its available balance, or its current balance when the institution doesn't
+// report an available one. Items awaiting re-link are skipped.
+func plaidAvailableBalance(ctx context.Context, pc *PlaidClient, fs *firestore.Client, uid, accountID string) (int64, error) {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to load user: %w", err)
+	}
+	items, _ := doc.Data()[providerUserField(ProcessorPlaid, "items")].(map[string]interface{})
+	var lastErr error
+	for itemID, raw := range items {
+		item, _ := raw.(map[string]interface{})
+		if s := stringField(item, "status"); s != "" && s != PlaidItemActive {
+			continue
+		}
+		accessToken, err := DecryptString(stringField(item, "access_token_encrypted"))
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt access token for item %s: %w", itemID, err)
+		}
+		balances, err := pc.GetBalances(ctx, accessToken, []string{accountID})
+		if err != nil {
+			// Plaid rejects account IDs from another item; try the next one
+			lastErr = err
+			continue
+		}
+		for _, b := range balances {
+			if b.AccountID != accountID {
+				continue
+			}
+			if b.Available != nil {
+				return *b.Available, nil
+			}
+			return b.Current, nil
+		}
+	}
+	if lastErr != nil {
+		return 0, fmt.Errorf("failed to get balance of account %s: %w", accountID, lastErr)
+	}
+	return 0, fmt.Errorf("no linked item has account %s", accountID)
+}
+
+// withBalanceCheck adds the request's balance check, if any, to a response
+func withBalanceCheck(c *gin.Context, resp gin.H) gin.H {
+	if check, ok := c.Get("balanceCheck"); ok {
+		resp["balance_check"] = check
+	}
+	return resp
+}
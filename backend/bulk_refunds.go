@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Bulk refund job statuses
+const (
+	BulkRefundPreviewed = "previewed"
+	BulkRefundRunning   = "running"
+	BulkRefundCompleted = "completed"
+	BulkRefundCancelled = "cancelled"
+)
+
+// Bulk refund item statuses
+const (
+	BulkRefundItemPending  = "pending"
+	BulkRefundItemRefunded = "refunded"
+	BulkRefundItemFailed   = "failed"
+	BulkRefundItemSkipped  = "skipped"
+)
+
+const (
+	// maxBulkRefundItems caps one job; larger incidents are split by date range
+	maxBulkRefundItems = 2000
+	// maxBulkRefundRange bounds the date filter
+	maxBulkRefundRange = 31 * 24 * time.Hour
+	// bulkRefundLease keeps other instances off a job while one works through it
+	bulkRefundLease = 2 * time.Minute
+	// bulkRefundRunBudget is how long one run refunds before giving up the lease
+	bulkRefundRunBudget = 45 * time.Second
+)
+
+// bulkRefundRate is the Stripe refund requests per second a job may make
+// (BULK_REFUND_RATE_PER_SECOND, default 5), leaving headroom for live traffic
+func bulkRefundRate() int {
+	if n, err := strconv.Atoi(os.Getenv("BULK_REFUND_RATE_PER_SECOND")); err == nil && n > 0 {
+		return n
+	}
+	return 5
+}
+
+// BulkRefundFilter selects the succeeded payments a bulk refund covers
+type BulkRefundFilter struct {
+	From            time.Time `json:"from" firestore:"from"`
+	To              time.Time `json:"to" firestore:"to"`
+	RecipientUserID string    `json:"recipient_user_id,omitempty" firestore:"recipient_user_id,omitempty"`
+	IncidentTag     string    `json:"incident_tag,omitempty" firestore:"incident_tag,omitempty"`
+}
+
+// BulkRefund is an admin-initiated batch of refunds, stored at
+// bulk_refunds/{id} with one item per payment at bulk_refunds/{id}/items/{paymentIntentID}
+type BulkRefund struct {
+	ID             string           `json:"id" firestore:"-"`
+	Filter         BulkRefundFilter `json:"filter" firestore:"filter"`
+	Reason         string           `json:"reason" firestore:"reason"`
+	Status         string           `json:"status" firestore:"status"`
+	ItemCount      int64            `json:"item_count" firestore:"item_count"`
+	TotalAmount    int64            `json:"total_amount" firestore:"total_amount"`
+	RefundedCount  int64            `json:"refunded_count" firestore:"refunded_count"`
+	RefundedAmount int64            `json:"refunded_amount" firestore:"refunded_amount"`
+	FailedCount    int64            `json:"failed_count" firestore:"failed_count"`
+	SkippedCount   int64            `json:"skipped_count" firestore:"skipped_count"`
+	CreatedBy      string           `json:"created_by" firestore:"created_by"`
+	ExecutedBy     string           `json:"executed_by,omitempty" firestore:"executed_by,omitempty"`
+	CancelledBy    string           `json:"cancelled_by,omitempty" firestore:"cancelled_by,omitempty"`
+	LeaseUntil     time.Time        `json:"-" firestore:"lease_until,omitempty"`
+	CreatedAt      time.Time        `json:"created_at" firestore:"created_at"`
+	StartedAt      time.Time        `json:"started_at,omitempty" firestore:"started_at,omitempty"`
+	CompletedAt    time.Time        `json:"completed_at,omitempty" firestore:"completed_at,omitempty"`
+}
+
+// BulkRefundItem is one payment in a bulk refund
+type BulkRefundItem struct {
+	PaymentIntentID string    `json:"payment_intent_id" firestore:"-"`
+	SenderUserID    string    `json:"sender_user_id" firestore:"sender_user_id"`
+	RecipientUserID string    `json:"recipient_user_id" firestore:"recipient_user_id"`
+	Amount          int64     `json:"amount" firestore:"amount"`
+	Currency        string    `json:"currency" firestore:"currency"`
+	Status          string    `json:"status" firestore:"status"`
+	RefundID        string    `json:"refund_id,omitempty" firestore:"refund_id,omitempty"`
+	Error           string    `json:"error,omitempty" firestore:"error,omitempty"`
+	ProcessedAt     time.Time `json:"processed_at,omitempty" firestore:"processed_at,omitempty"`
+}
+
+// bulkRefundIneligible explains why a payment can't be bulk refunded, or
+// returns "" if it can
+func bulkRefundIneligible(data map[string]interface{}) string {
+	switch {
+	case stringField(data, "status") != "succeeded":
+		return "payment has not succeeded"
+	case stringField(data, "compensation_refund_id") != "":
+		return "already refunded by transfer compensation"
+	case stringField(data, "bulk_refund_id") != "":
+		return "already refunded by bulk refund " + stringField(data, "bulk_refund_id")
+	case stringField(data, "refund_request_id") != "":
+		return "already refunded at the payer's request"
+	case stringField(data, "escrow_status") != "" && stringField(data, "escrow_status") != EscrowReleased:
+		return "escrowed payment"
+	}
+	return ""
+}
+
+// matchBulkRefundCandidates finds the succeeded payments the filter selects.
+// An incident tag is looked up through the admin tag index first.
+func matchBulkRefundCandidates(ctx context.Context, fs *firestore.Client, filter BulkRefundFilter) ([]*firestore.DocumentSnapshot, error) {
+	if filter.IncidentTag == "" {
+		q := fs.Collection("transactions").
+			Where("status", "==", "succeeded").
+			Where("created_at", ">=", filter.From).
+			Where("created_at", "<", filter.To)
+		if filter.RecipientUserID != "" {
+			q = q.Where("recipient_user_id", "==", filter.RecipientUserID)
+		}
+		return q.Limit(maxBulkRefundItems + 1).Documents(ctx).GetAll()
+	}
+
+	tagged, err := fs.Collection("admin_tags").
+		Where("subject_type", "==", AnnotationSubjectTransaction).
+		Where("tags", "array-contains", filter.IncidentTag).
+		Limit(maxBulkRefundItems + 1).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*firestore.DocumentRef, 0, len(tagged))
+	for _, doc := range tagged {
+		if id := stringField(doc.Data(), "subject_id"); id != "" {
+			refs = append(refs, fs.Collection("transactions").Doc(id))
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	docs, err := fs.GetAll(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]*firestore.DocumentSnapshot, 0, len(docs))
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		data := doc.Data()
+		createdAt, _ := data["created_at"].(time.Time)
+		if createdAt.Before(filter.From) || !createdAt.Before(filter.To) {
+			continue
+		}
+		if filter.RecipientUserID != "" && stringField(data, "recipient_user_id") != filter.RecipientUserID {
+			continue
+		}
+		matched = append(matched, doc)
+	}
+	return matched, nil
+}
+
+// PreviewBulkRefund builds a bulk refund from a filter without refunding
+// anything. The returned job lists what would be refunded and what was
+// excluded; POST /admin/refunds/bulk/:id/execute starts it.
+func PreviewBulkRefund(c *gin.Context) {
+	var req struct {
+		From            time.Time `json:"from" binding:"required"`
+		To              time.Time `json:"to" binding:"required"`
+		RecipientUserID string    `json:"recipient_user_id"`
+		IncidentTag     string    `json:"incident_tag"`
+		Reason          string    `json:"reason" binding:"required,max=500"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.To.After(req.From) || req.To.Sub(req.From) > maxBulkRefundRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from and within 31 days of it"})
+		return
+	}
+	if req.IncidentTag != "" && !incidentTagPattern.MatchString(req.IncidentTag) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "incident_tag must look like incident-<slug>"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	filter := BulkRefundFilter{From: req.From, To: req.To, RecipientUserID: req.RecipientUserID, IncidentTag: req.IncidentTag}
+	docs, err := matchBulkRefundCandidates(ctx, fs, filter)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to match bulk refund", "component", "bulk_refunds", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find payments"})
+		return
+	}
+	if len(docs) > maxBulkRefundItems {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Filter matches more than %d payments; narrow the date range", maxBulkRefundItems)})
+		return
+	}
+
+	job := BulkRefund{
+		ID:        uuid.New().String(),
+		Filter:    filter,
+		Reason:    req.Reason,
+		Status:    BulkRefundPreviewed,
+		CreatedBy: c.GetString("userID"),
+		CreatedAt: time.Now(),
+	}
+	items := make([]BulkRefundItem, 0, len(docs))
+	excluded := []gin.H{}
+	for _, doc := range docs {
+		data := doc.Data()
+		if why := bulkRefundIneligible(data); why != "" {
+			excluded = append(excluded, gin.H{"payment_intent_id": doc.Ref.ID, "reason": why})
+			continue
+		}
+		amount, _ := data["amount"].(int64)
+		items = append(items, BulkRefundItem{
+			PaymentIntentID: doc.Ref.ID,
+			SenderUserID:    stringField(data, "sender_user_id"),
+			RecipientUserID: stringField(data, "recipient_user_id"),
+			Amount:          amount,
+			Currency:        stringField(data, "currency"),
+			Status:          BulkRefundItemPending,
+		})
+		job.ItemCount++
+		job.TotalAmount += amount
+	}
+
+	ref := fs.Collection("bulk_refunds").Doc(job.ID)
+	// Batches hold at most 500 writes; the job document goes in the last one
+	for start := 0; start <= len(items); start += 499 {
+		batch := fs.Batch()
+		end := min(start+499, len(items))
+		for _, item := range items[start:end] {
+			batch.Set(ref.Collection("items").Doc(item.PaymentIntentID), item)
+		}
+		if end == len(items) {
+			batch.Set(ref, job)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save bulk refund"})
+			return
+		}
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: job.CreatedBy, Action: AdminAccessWrite, SubjectType: "bulk_refund", SubjectID: job.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log bulk refund access", "component", "bulk_refunds", "bulk_refund_id", job.ID, "error", err)
+	}
+	c.JSON(http.StatusCreated, gin.H{"bulk_refund": job, "items": items, "excluded": excluded})
+}
+
+// loadBulkRefund reads a job, writing the error response if it can't
+func loadBulkRefund(c *gin.Context, fs *firestore.Client) (*BulkRefund, bool) {
+	doc, err := fs.Collection("bulk_refunds").Doc(c.Param("id")).Get(c.Request.Context())
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bulk refund not found"})
+		return nil, false
+	}
+	var job BulkRefund
+	if err := doc.DataTo(&job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read bulk refund"})
+		return nil, false
+	}
+	job.ID = doc.Ref.ID
+	return &job, true
+}
+
+// setBulkRefundStatus moves a job from one status to another, reporting false
+// if it was no longer in the expected status
+func setBulkRefundStatus(ctx context.Context, fs *firestore.Client, id, from string, updates []firestore.Update) (bool, error) {
+	ref := fs.Collection("bulk_refunds").Doc(id)
+	moved := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		moved = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if stringField(snap.Data(), "status") != from {
+			return nil
+		}
+		moved = true
+		return tx.Update(ref, updates)
+	})
+	return moved, err
+}
+
+// ExecuteBulkRefund starts refunding a previewed job. The bulk_refunds job
+// works through it in the background at BULK_REFUND_RATE_PER_SECOND.
+func ExecuteBulkRefund(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	job, ok := loadBulkRefund(c, fs)
+	if !ok {
+		return
+	}
+	adminID := c.GetString("userID")
+	started, err := setBulkRefundStatus(ctx, fs, job.ID, BulkRefundPreviewed, []firestore.Update{
+		{Path: "status", Value: BulkRefundRunning},
+		{Path: "executed_by", Value: adminID},
+		{Path: "started_at", Value: time.Now()},
+		{Path: "lease_until", Value: time.Now()},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start bulk refund"})
+		return
+	}
+	if !started {
+		c.JSON(http.StatusConflict, gin.H{"error": "Bulk refund has already been executed or cancelled"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "bulk_refund", SubjectID: job.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log bulk refund access", "component", "bulk_refunds", "bulk_refund_id", job.ID, "error", err)
+	}
+	slog.InfoContext(ctx, "bulk refund started", "component", "bulk_refunds", "bulk_refund_id", job.ID, "admin_id", adminID, "items", job.ItemCount)
+	job.Status = BulkRefundRunning
+	c.JSON(http.StatusAccepted, gin.H{"bulk_refund": job})
+}
+
+// CancelBulkRefund stops a job; refunds already issued stand
+func CancelBulkRefund(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	job, ok := loadBulkRefund(c, fs)
+	if !ok {
+		return
+	}
+	if job.Status != BulkRefundPreviewed && job.Status != BulkRefundRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Bulk refund has already finished"})
+		return
+	}
+	updates := []firestore.Update{
+		{Path: "status", Value: BulkRefundCancelled},
+		{Path: "cancelled_by", Value: c.GetString("userID")},
+		{Path: "completed_at", Value: time.Now()},
+	}
+	cancelled, err := setBulkRefundStatus(ctx, fs, job.ID, job.Status, updates)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel bulk refund"})
+		return
+	}
+	if !cancelled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Bulk refund changed status; reload and try again"})
+		return
+	}
+	job.Status = BulkRefundCancelled
+	c.JSON(http.StatusOK, gin.H{"bulk_refund": job})
+}
+
+// GetBulkRefund returns a job and its progress
+func GetBulkRefund(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	job, ok := loadBulkRefund(c, fs)
+	if !ok {
+		return
+	}
+	processed := job.RefundedCount + job.FailedCount + job.SkippedCount
+	c.JSON(http.StatusOK, gin.H{
+		"bulk_refund": job,
+		"progress": gin.H{
+			"processed": processed,
+			"remaining": job.ItemCount - processed,
+		},
+	})
+}
+
+// bulkRefundReportColumns is the CSV header of a bulk refund report
+var bulkRefundReportColumns = []string{"payment_intent_id", "sender_user_id", "recipient_user_id", "amount", "currency", "status", "refund_id", "error", "processed_at"}
+
+// GetBulkRefundReport streams a job's items and their outcomes as CSV or
+// NDJSON (?format=)
+func GetBulkRefundReport(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	format, ok := exportFormat(c, ExportCSV, ExportNDJSON)
+	if !ok {
+		return
+	}
+	job, ok := loadBulkRefund(c, fs)
+	if !ok {
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: c.GetString("userID"), Action: AdminAccessRead, SubjectType: "bulk_refund", SubjectID: job.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log access"})
+		return
+	}
+
+	stream := NewExportStream(c, format, "bulk_refund_"+job.ID, bulkRefundReportColumns)
+	items := fs.Collection("bulk_refunds").Doc(job.ID).Collection("items").OrderBy(firestore.DocumentID, firestore.Asc)
+	err := stream.Query(items, func(doc *firestore.DocumentSnapshot) error {
+		var item BulkRefundItem
+		if err := doc.DataTo(&item); err != nil {
+			return nil
+		}
+		processedAt := ""
+		if !item.ProcessedAt.IsZero() {
+			processedAt = item.ProcessedAt.UTC().Format(time.RFC3339)
+		}
+		item.PaymentIntentID = doc.Ref.ID
+		cur := currencyOrDefault(item.Currency)
+		return stream.Write(item, []string{
+			doc.Ref.ID, item.SenderUserID, item.RecipientUserID,
+			cur.Decimal(item.Amount), cur.Code, item.Status,
+			item.RefundID, item.Error, processedAt,
+		})
+	})
+	stream.Close(err)
+}
+
+// ProcessBulkRefunds works through running bulk refund jobs, one lease per
+// job per instance, issuing refunds no faster than the configured rate
+func ProcessBulkRefunds(ctx context.Context, d *webhookDeps) error {
+	docs, err := d.fs.Collection("bulk_refunds").
+		Where("status", "==", BulkRefundRunning).
+		Where("lease_until", "<=", time.Now()).
+		Limit(5).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load bulk refunds: %w", err)
+	}
+	for _, doc := range docs {
+		claimed, err := claimBulkRefund(ctx, d.fs, doc.Ref)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to claim bulk refund", "component", "bulk_refunds", "bulk_refund_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		if claimed {
+			if err := runBulkRefund(ctx, d, doc.Ref); err != nil {
+				slog.ErrorContext(ctx, "bulk refund run failed", "component", "bulk_refunds", "bulk_refund_id", doc.Ref.ID, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// claimBulkRefund takes the job's lease, reporting false if another instance holds it
+func claimBulkRefund(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef) (bool, error) {
+	claimed := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		data := snap.Data()
+		leaseUntil, _ := data["lease_until"].(time.Time)
+		if stringField(data, "status") != BulkRefundRunning || leaseUntil.After(time.Now()) {
+			return nil
+		}
+		claimed = true
+		return tx.Update(ref, []firestore.Update{{Path: "lease_until", Value: time.Now().Add(bulkRefundLease)}})
+	})
+	return claimed, err
+}
+
+// runBulkRefund refunds a job's pending items until the run budget is spent,
+// completing the job once none are left
+func runBulkRefund(ctx context.Context, d *webhookDeps, ref *firestore.DocumentRef) error {
+	rate := bulkRefundRate()
+	limit := rate * int(bulkRefundRunBudget/time.Second)
+	items, err := ref.Collection("items").
+		Where("status", "==", BulkRefundItemPending).
+		Limit(limit).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		_, err := setBulkRefundStatus(ctx, d.fs, ref.ID, BulkRefundRunning, []firestore.Update{
+			{Path: "status", Value: BulkRefundCompleted},
+			{Path: "completed_at", Value: time.Now()},
+			{Path: "lease_until", Value: firestore.Delete},
+		})
+		if err == nil {
+			slog.InfoContext(ctx, "bulk refund completed", "component", "bulk_refunds", "bulk_refund_id", ref.ID)
+		}
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for i, doc := range items {
+		// Pick up a cancellation between refunds rather than only between runs
+		if i%rate == 0 {
+			snap, err := ref.Get(ctx)
+			if err != nil {
+				return err
+			}
+			if stringField(snap.Data(), "status") != BulkRefundRunning {
+				return nil
+			}
+		}
+		<-ticker.C
+		refundBulkItem(ctx, d, ref, doc)
+	}
+	// Release the lease so the next run continues straight away
+	_, err = ref.Update(ctx, []firestore.Update{{Path: "lease_until", Value: time.Now()}})
+	return err
+}
+
+// refundBulkItem refunds one payment and records the outcome on the item,
+// the job's counters, and the transaction
+func refundBulkItem(ctx context.Context, d *webhookDeps, jobRef *firestore.DocumentRef, doc *firestore.DocumentSnapshot) {
+	var item BulkRefundItem
+	if err := doc.DataTo(&item); err != nil {
+		return
+	}
+	piID := doc.Ref.ID
+	itemUpdates := []firestore.Update{{Path: "processed_at", Value: time.Now()}}
+	jobUpdates := []firestore.Update{}
+
+	// The payment may have been refunded another way since the preview
+	tx, err := getDocument(ctx, d.fs.Collection("transactions").Doc(piID))
+	why := ""
+	if err != nil {
+		why = "transaction not found"
+	} else {
+		why = bulkRefundIneligible(tx.Data())
+	}
+	if why != "" {
+		itemUpdates = append(itemUpdates, firestore.Update{Path: "status", Value: BulkRefundItemSkipped}, firestore.Update{Path: "error", Value: why})
+		jobUpdates = append(jobUpdates, firestore.Update{Path: "skipped_count", Value: firestore.Increment(1)})
+	} else if err := reverseBulkRefundTransfer(ctx, d, jobRef.ID, piID, tx.Data()); err != nil {
+		// Refunding without taking the payout back would pay for it twice
+		itemUpdates = append(itemUpdates, firestore.Update{Path: "status", Value: BulkRefundItemFailed}, firestore.Update{Path: "error", Value: err.Error()})
+		jobUpdates = append(jobUpdates, firestore.Update{Path: "failed_count", Value: firestore.Increment(1)})
+	} else {
+		refund, rerr := d.sc.RefundPaymentIntent(ctx, piID,
+			map[string]string{"reason": "bulk_refund", "bulk_refund_id": jobRef.ID},
+			"bulk_refund_"+piID)
+		var se *stripe.Error
+		switch {
+		case rerr == nil:
+			d.sc.LogAPIInteraction(ctx, "bulk_refund", item.SenderUserID, true, fmt.Sprintf("Refund: %s", refund.ID))
+			itemUpdates = append(itemUpdates, firestore.Update{Path: "status", Value: BulkRefundItemRefunded}, firestore.Update{Path: "refund_id", Value: refund.ID})
+			jobUpdates = append(jobUpdates,
+				firestore.Update{Path: "refunded_count", Value: firestore.Increment(1)},
+				firestore.Update{Path: "refunded_amount", Value: firestore.Increment(refund.Amount)})
+			fields := map[string]interface{}{"bulk_refund_id": jobRef.ID}
+			// A payout still waiting to go out has nothing left to pay
+			if s := stringField(tx.Data(), "transfer_status"); s == TransferStatusRetrying || s == TransferStatusFrozen {
+				fields["transfer_status"] = TransferStatusCanceled
+				fields["transfer_retry_at"] = firestore.Delete
+			}
+			if err := SaveTransaction(ctx, d.fs, piID, fields); err != nil {
+				slog.ErrorContext(ctx, "failed to mark bulk refunded transaction", "component", "bulk_refunds", "payment_intent", piID, "error", err)
+			}
+			NotifyUser(ctx, d.fs, item.SenderUserID, NotificationPaymentRefunded, "Payment refunded",
+				fmt.Sprintf("Your %s payment has been refunded", currencyOrDefault(item.Currency).Format(item.Amount)),
+				map[string]interface{}{"transaction_id": piID, "refund_id": refund.ID})
+		case errors.As(rerr, &se) && se.Code == stripe.ErrorCodeChargeAlreadyRefunded:
+			itemUpdates = append(itemUpdates, firestore.Update{Path: "status", Value: BulkRefundItemSkipped}, firestore.Update{Path: "error", Value: "charge already refunded"})
+			jobUpdates = append(jobUpdates, firestore.Update{Path: "skipped_count", Value: firestore.Increment(1)})
+		default:
+			d.sc.LogAPIError(ctx, "bulk_refund", item.SenderUserID, rerr)
+			itemUpdates = append(itemUpdates, firestore.Update{Path: "status", Value: BulkRefundItemFailed}, firestore.Update{Path: "error", Value: rerr.Error()})
+			jobUpdates = append(jobUpdates, firestore.Update{Path: "failed_count", Value: firestore.Increment(1)})
+		}
+	}
+
+	batch := d.fs.Batch()
+	batch.Update(doc.Ref, itemUpdates)
+	batch.Update(jobRef, jobUpdates)
+	if _, err := batch.Commit(ctx); err != nil {
+		slog.ErrorContext(ctx, "failed to record bulk refund item", "component", "bulk_refunds", "bulk_refund_id", jobRef.ID, "payment_intent", piID, "error", err)
+	}
+}
+
+// reverseBulkRefundTransfer takes back the transfer that paid the recipient
+// for a payment about to be refunded, so the refund isn't paid out of the
+// platform's balance. The reversal is keyed by PaymentIntent, so a retried
+// item reverses once; payments already clawed back are left alone.
+func reverseBulkRefundTransfer(ctx context.Context, d *webhookDeps, jobID, paymentIntentID string, data map[string]interface{}) error {
+	transferID := stringField(data, "transfer_id")
+	if !strings.HasPrefix(transferID, "tr_") || stringField(data, "clawback_status") == ClawbackReversed {
+		return nil
+	}
+	recipientUID := stringField(data, "recipient_user_id")
+	reversal, err := d.sc.ReverseTransfer(ctx, transferID,
+		map[string]string{"reason": "bulk_refund", "bulk_refund_id": jobID, "payment_intent_id": paymentIntentID},
+		"bulk_refund_reversal_"+paymentIntentID)
+	if err != nil {
+		d.sc.LogAPIError(ctx, "bulk_refund_reversal", recipientUID, err)
+		return fmt.Errorf("failed to reverse transfer %s: %w", transferID, err)
+	}
+	d.sc.LogAPIInteraction(ctx, "bulk_refund_reversal", recipientUID, true, fmt.Sprintf("Reversal: %s", reversal.ID))
+	d.postLedger(ctx, recipientUID, TransferReversalLedgerTransaction(reversal.ID, recipientUID, reversal.Amount, string(reversal.Currency)))
+	if err := SaveTransaction(ctx, d.fs, paymentIntentID, map[string]interface{}{
+		"clawback_status":      ClawbackReversed,
+		"clawback_reversal_id": reversal.ID,
+	}); err != nil {
+		slog.ErrorContext(ctx, "failed to record bulk refund reversal", "component", "bulk_refunds", "payment_intent", paymentIntentID, "error", err)
+	}
+	return nil
+}
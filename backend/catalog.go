@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CatalogItem is something a business sells, stored at
+// users/{uid}/catalog_items/{id}. Removed items are deactivated rather than
+// deleted, so payments that reference them still make sense.
+type CatalogItem struct {
+	ID          string    `json:"id" firestore:"-"`
+	Name        string    `json:"name" firestore:"name"`
+	Description string    `json:"description,omitempty" firestore:"description,omitempty"`
+	Price       int64     `json:"price" firestore:"price"` // cents
+	Currency    string    `json:"currency" firestore:"currency"`
+	Active      bool      `json:"active" firestore:"active"`
+	CreatedAt   time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// LineItemRequest is a catalog item a sender is paying for
+type LineItemRequest struct {
+	ItemID   string `json:"item_id" binding:"required"`
+	Quantity int64  `json:"quantity" binding:"required,min=1,max=999"`
+}
+
+// LineItem is a priced line on a payment, stored on its transaction under
+// line_items. Name and UnitAmount are copied from the catalog when the
+// payment is made, so later price changes don't rewrite past payments.
+type LineItem struct {
+	ItemID     string `json:"item_id" firestore:"item_id"`
+	Name       string `json:"name" firestore:"name"`
+	UnitAmount int64  `json:"unit_amount" firestore:"unit_amount"`
+	Quantity   int64  `json:"quantity" firestore:"quantity"`
+	Amount     int64  `json:"amount" firestore:"amount"`
+}
+
+func catalogItems(ctx context.Context, fs *firestore.Client, uid string) *firestore.CollectionRef {
+	return UserDoc(ctx, fs, uid).Collection("catalog_items")
+}
+
+// resolveLineItems prices requested items from the recipient's catalog and
+// returns them with their total. Items must be active and in currency.
+func resolveLineItems(ctx context.Context, fs *firestore.Client, recipientUID, currency string, requested []LineItemRequest) ([]LineItem, int64, error) {
+	items := make([]LineItem, 0, len(requested))
+	var total int64
+	for _, r := range requested {
+		doc, err := getDocument(ctx, catalogItems(ctx, fs, recipientUID).Doc(r.ItemID))
+		if status.Code(err) == codes.NotFound {
+			return nil, 0, fmt.Errorf("item %s not found", r.ItemID)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var item CatalogItem
+		if err := doc.DataTo(&item); err != nil || !item.Active {
+			return nil, 0, fmt.Errorf("item %s not found", r.ItemID)
+		}
+		if !strings.EqualFold(item.Currency, currency) {
+			return nil, 0, fmt.Errorf("item %s is priced in %s", r.ItemID, item.Currency)
+		}
+		line := LineItem{ItemID: r.ItemID, Name: item.Name, UnitAmount: item.Price, Quantity: r.Quantity, Amount: item.Price * r.Quantity}
+		total += line.Amount
+		items = append(items, line)
+	}
+	return items, total, nil
+}
+
+// formatLineItems renders line items priced in currency for a CSV cell,
+// e.g. "2 x Latte @ 4.50"
+func formatLineItems(items []LineItem, currency string) string {
+	cur := currencyOrDefault(currency)
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		parts = append(parts, fmt.Sprintf("%d x %s @ %s", item.Quantity, item.Name, cur.Decimal(item.UnitAmount)))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ListCatalog returns a business's active items; the business itself also
+// sees its inactive ones
+func ListCatalog(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	owner := c.Param("id")
+
+	query := catalogItems(ctx, fs, owner).OrderBy("name", firestore.Asc)
+	if owner != uidVal.(string) {
+		query = catalogItems(ctx, fs, owner).Where("active", "==", true).OrderBy("name", firestore.Asc)
+	}
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load catalog"})
+		return
+	}
+	items := make([]CatalogItem, 0, len(docs))
+	for _, doc := range docs {
+		var item CatalogItem
+		if err := doc.DataTo(&item); err != nil {
+			continue
+		}
+		item.ID = doc.Ref.ID
+		items = append(items, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+// catalogDeps pulls the caller and Firestore a catalog change needs, and
+// responds 403 unless the caller is a business
+func catalogDeps(c *gin.Context) (string, *firestore.Client, bool) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", nil, false
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return "", nil, false
+	}
+	uid, fs := uidVal.(string), v.(*firestore.Client)
+	if !acceptsTips(c.Request.Context(), fs, uid) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only business accounts have a catalog"})
+		return "", nil, false
+	}
+	return uid, fs, true
+}
+
+// CreateCatalogItem adds an item to the caller's catalog
+func CreateCatalogItem(c *gin.Context) {
+	var req struct {
+		Name        string `json:"name" binding:"required,max=100"`
+		Description string `json:"description" binding:"max=500"`
+		Price       int64  `json:"price" binding:"required,min=1"`
+		Currency    string `json:"currency"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := catalogDeps(c)
+	if !ok {
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = DefaultCurrency
+	}
+	cur, ok := lookupCurrency(req.Currency)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency", "code": "unsupported_currency"})
+		return
+	}
+	req.Currency = cur.Code
+	now := time.Now()
+	item := CatalogItem{
+		ID:          uuid.NewString(),
+		Name:        req.Name,
+		Description: req.Description,
+		Price:       req.Price,
+		Currency:    strings.ToLower(req.Currency),
+		Active:      true,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	ctx := c.Request.Context()
+	if _, err := catalogItems(ctx, fs, uid).Doc(item.ID).Create(ctx, item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save item"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": item})
+}
+
+// UpdateCatalogItem changes an item's name, description, price, or whether
+// it is offered
+func UpdateCatalogItem(c *gin.Context) {
+	var req struct {
+		Name        *string `json:"name" binding:"omitempty,min=1,max=100"`
+		Description *string `json:"description" binding:"omitempty,max=500"`
+		Price       *int64  `json:"price" binding:"omitempty,min=1"`
+		Active      *bool   `json:"active"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := catalogDeps(c)
+	if !ok {
+		return
+	}
+	updates := []firestore.Update{{Path: "updated_at", Value: time.Now()}}
+	if req.Name != nil {
+		updates = append(updates, firestore.Update{Path: "name", Value: *req.Name})
+	}
+	if req.Description != nil {
+		updates = append(updates, firestore.Update{Path: "description", Value: *req.Description})
+	}
+	if req.Price != nil {
+		updates = append(updates, firestore.Update{Path: "price", Value: *req.Price})
+	}
+	if req.Active != nil {
+		updates = append(updates, firestore.Update{Path: "active", Value: *req.Active})
+	}
+	updateCatalogItem(c, fs, uid, updates)
+}
+
+// DeleteCatalogItem stops offering an item. It is kept, inactive, for the
+// payments that reference it.
+func DeleteCatalogItem(c *gin.Context) {
+	uid, fs, ok := catalogDeps(c)
+	if !ok {
+		return
+	}
+	updateCatalogItem(c, fs, uid, []firestore.Update{
+		{Path: "active", Value: false},
+		{Path: "updated_at", Value: time.Now()},
+	})
+}
+
+func updateCatalogItem(c *gin.Context, fs *firestore.Client, uid string, updates []firestore.Update) {
+	ctx := c.Request.Context()
+	ref := catalogItems(ctx, fs, uid).Doc(c.Param("id"))
+	if _, err := ref.Update(ctx, updates); err != nil {
+		if status.Code(err) == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save item"})
+		return
+	}
+	doc, err := ref.Get(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load item"})
+		return
+	}
+	var item CatalogItem
+	if err := doc.DataTo(&item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load item"})
+		return
+	}
+	item.ID = doc.Ref.ID
+	c.JSON(http.StatusOK, gin.H{"item": item})
+}
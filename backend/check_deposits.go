@@ -0,0 +1,698 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Check deposits credit a Stripe-backed wallet with a paper check:
+//
+//  1. POST /wallet/check-deposits returns signed URLs the app uploads the
+//     front and back images to, in CHECK_IMAGES_BUCKET;
+//  2. POST /wallet/check-deposits/:id/submit sends the images to the remote
+//     deposit capture provider (see remote_deposit_client.go);
+//  3. the provider's webhooks move the deposit on. An accepted check is
+//     credited to the wallet at once, but the credit stays held for a period
+//     set by the user's risk tier, and is taken back if the check is returned.
+//
+// Holds are wallet holds, released by the wallet_hold_expiry job when their
+// period ends.
+
+// Check deposit statuses, kept on check_deposits/{id}.status
+const (
+	CheckDepositAwaitingImages = "awaiting_images"
+	CheckDepositSubmitted      = "submitted"
+	// CheckDepositAccepted is credited to the wallet; the credit is held
+	// until available_at
+	CheckDepositAccepted = "accepted"
+	CheckDepositCleared  = "cleared"
+	CheckDepositRejected = "rejected"
+	CheckDepositReturned = "returned"
+)
+
+// checkDepositTransitions lists the statuses a deposit may move to from each
+// status. Webhooks can arrive before submission is recorded, so a deposit
+// awaiting images can be accepted or rejected directly. Paying banks can
+// return checks after they clear.
+var checkDepositTransitions = map[string][]string{
+	CheckDepositAwaitingImages: {CheckDepositSubmitted, CheckDepositAccepted, CheckDepositRejected},
+	CheckDepositSubmitted:      {CheckDepositAccepted, CheckDepositRejected},
+	CheckDepositAccepted:       {CheckDepositCleared, CheckDepositReturned},
+	CheckDepositCleared:        {CheckDepositReturned},
+	CheckDepositRejected:       {},
+	CheckDepositReturned:       {},
+}
+
+// NotificationCheckRejected tells a user the check they deposited was rejected
+const NotificationCheckRejected = "check_deposit_rejected"
+
+// walletSourceCheckDeposit marks wallet entries for deposited checks and
+// their returns
+const walletSourceCheckDeposit = "check_deposit"
+
+// walletEntryCheckDeposit is the wallet entry type crediting a check
+const walletEntryCheckDeposit = "check_deposit"
+
+// LedgerAccountCheckDeposits is the funds the RDC provider owes the platform
+// for deposited checks
+const LedgerAccountCheckDeposits = "platform:check_deposits"
+
+const (
+	// checkImageMaxBytes bounds each uploaded image
+	checkImageMaxBytes = 10 << 20
+	// checkUploadURLTTL is how long the app has to upload the images
+	checkUploadURLTTL = 15 * time.Minute
+	// checkImageURLTTL is how long the provider has to fetch the images
+	checkImageURLTTL = time.Hour
+	// defaultCheckDepositMax is the largest check that can be deposited, in
+	// cents; CHECK_DEPOSIT_MAX overrides it
+	defaultCheckDepositMax = 500000
+)
+
+// checkImageContentTypes are the image formats the provider reads
+var checkImageContentTypes = []string{"image/jpeg", "image/png"}
+
+// checkHoldDaysDefaults are how many days a deposited check's credit is held
+// at each risk tier. CHECK_HOLD_DAYS_LOW, CHECK_HOLD_DAYS_ELEVATED, and
+// CHECK_HOLD_DAYS_HIGH override them.
+var checkHoldDaysDefaults = map[string]int{
+	RiskTierLow:      2,
+	RiskTierElevated: 5,
+	RiskTierHigh:     9,
+}
+
+// checkImageBucket holds check images; nil when CHECK_IMAGES_BUCKET isn't
+// set, and check deposits are unavailable
+var checkImageBucket *storage.BucketHandle
+
+// CheckDeposit is a check deposited to a wallet, kept at check_deposits/{id}.
+// Amount is what the user entered; the wallet is credited with
+// ConfirmedAmount, what the provider read from the check.
+type CheckDeposit struct {
+	ID                string     `json:"id" firestore:"-"`
+	UserID            string     `json:"user_id" firestore:"user_id"`
+	Status            string     `json:"status" firestore:"status"`
+	Amount            int64      `json:"amount" firestore:"amount"`
+	ConfirmedAmount   int64      `json:"confirmed_amount,omitempty" firestore:"confirmed_amount,omitempty"`
+	Currency          string     `json:"currency" firestore:"currency"`
+	ImageContentType  string     `json:"image_content_type" firestore:"image_content_type"`
+	ProviderDepositID string     `json:"-" firestore:"provider_deposit_id,omitempty"`
+	HoldID            string     `json:"-" firestore:"hold_id,omitempty"`
+	RiskTier          string     `json:"-" firestore:"risk_tier,omitempty"`
+	HoldDays          int        `json:"hold_days,omitempty" firestore:"hold_days,omitempty"`
+	AvailableAt       *time.Time `json:"available_at,omitempty" firestore:"available_at,omitempty"`
+	FailureReason     string     `json:"failure_reason,omitempty" firestore:"failure_reason,omitempty"`
+	SubmittedAt       *time.Time `json:"submitted_at,omitempty" firestore:"submitted_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at" firestore:"updated_at"`
+}
+
+// InitCheckDeposits sets up the RDC provider and the bucket for check images;
+// check deposits need both
+func InitCheckDeposits(ctx context.Context) error {
+	if err := InitRemoteDeposits(); err != nil {
+		return err
+	}
+	bucket := os.Getenv("CHECK_IMAGES_BUCKET")
+	if remoteDeposits == nil || bucket == "" {
+		if remoteDeposits != nil || bucket != "" {
+			remoteDeposits = nil
+			return fmt.Errorf("check deposits need both RDC_BASE_URL and CHECK_IMAGES_BUCKET")
+		}
+		return nil
+	}
+	handle, err := openBucket(ctx, bucket)
+	if err != nil {
+		remoteDeposits = nil
+		return err
+	}
+	checkImageBucket = handle
+	return nil
+}
+
+// checkDepositMax is the largest check that can be deposited
+func checkDepositMax() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("CHECK_DEPOSIT_MAX"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultCheckDepositMax
+}
+
+// checkHoldDays is how long a check deposited at a risk tier stays held
+func checkHoldDays(tier string) int {
+	if n, err := strconv.Atoi(os.Getenv("CHECK_HOLD_DAYS_" + strings.ToUpper(tier))); err == nil && n >= 0 {
+		return n
+	}
+	if days, ok := checkHoldDaysDefaults[tier]; ok {
+		return days
+	}
+	return checkHoldDaysDefaults[RiskTierHigh]
+}
+
+// canTransitionCheckDeposit reports whether a deposit in status from may move
+// to status to
+func canTransitionCheckDeposit(from, to string) bool {
+	return slices.Contains(checkDepositTransitions[from], to)
+}
+
+// checkImageObject names a deposit's front or back image
+func checkImageObject(d *CheckDeposit, side string) string {
+	return path.Join("check_deposits", d.UserID, d.ID, side)
+}
+
+// loadCheckDeposit reads a deposit by ID
+func loadCheckDeposit(ctx context.Context, fs *firestore.Client, id string) (*CheckDeposit, error) {
+	doc, err := getDocument(ctx, fs.Collection("check_deposits").Doc(id))
+	if err != nil {
+		return nil, err
+	}
+	var d CheckDeposit
+	if err := doc.DataTo(&d); err != nil {
+		return nil, err
+	}
+	d.ID = doc.Ref.ID
+	return &d, nil
+}
+
+// checkDepositsAvailable responds 503 and returns false when check deposits
+// aren't configured
+func checkDepositsAvailable(c *gin.Context) bool {
+	if remoteDeposits == nil || checkImageBucket == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Check deposits are not available", "code": "check_deposits_unavailable"})
+		return false
+	}
+	return true
+}
+
+// callerCheckDeposit loads the deposit in the path, responding 404 unless it
+// is the caller's
+func callerCheckDeposit(c *gin.Context, fs *firestore.Client, uid string) (*CheckDeposit, bool) {
+	d, err := loadCheckDeposit(c.Request.Context(), fs, c.Param("id"))
+	if err != nil || d.UserID != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Check deposit not found"})
+		return nil, false
+	}
+	return d, true
+}
+
+// CreateCheckDeposit starts a check deposit and returns signed URLs to PUT
+// the check's front and back images to. Each upload must send the
+// Content-Type and X-Goog-Content-Length-Range headers it is given.
+func CreateCheckDeposit(c *gin.Context) {
+	var req struct {
+		Amount           int64  `json:"amount" binding:"required,min=100"` // cents
+		ImageContentType string `json:"image_content_type"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok || !checkDepositsAvailable(c) {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if req.ImageContentType == "" {
+		req.ImageContentType = checkImageContentTypes[0]
+	}
+	if !slices.Contains(checkImageContentTypes, req.ImageContentType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image_content_type must be one of " + strings.Join(checkImageContentTypes, ", ")})
+		return
+	}
+	if limit := checkDepositMax(); req.Amount > limit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Checks over %s can't be deposited in the app", currencyOrDefault(walletCurrency).Format(limit)), "code": "check_amount_too_large"})
+		return
+	}
+	level, err := userKYCLevel(ctx, fs, uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check verification level"})
+		return
+	}
+	if kycRank(level) < kycRank(KYCBasic) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Verify your identity to deposit checks", "code": "kyc_required", "kyc_level": level, "required_level": KYCBasic})
+		return
+	}
+	if _, err := walletHandleForUser(ctx, fs, uid, ProcessorStripe); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Check deposits aren't available for wallets held with Sila", "code": "wallet_provider_unsupported"})
+		return
+	}
+
+	now := time.Now()
+	deposit := &CheckDeposit{
+		ID:               uuid.NewString(),
+		UserID:           uid,
+		Status:           CheckDepositAwaitingImages,
+		Amount:           req.Amount,
+		Currency:         walletCurrency,
+		ImageContentType: req.ImageContentType,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	expiresAt := now.Add(checkUploadURLTTL)
+	lengthRange := fmt.Sprintf("x-goog-content-length-range:0,%d", checkImageMaxBytes)
+	uploads := gin.H{}
+	for _, side := range []string{"front", "back"} {
+		url, err := checkImageBucket.SignedURL(checkImageObject(deposit, side), &storage.SignedURLOptions{
+			Scheme:      storage.SigningSchemeV4,
+			Method:      http.MethodPut,
+			ContentType: req.ImageContentType,
+			Headers:     []string{lengthRange},
+			Expires:     expiresAt,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to sign check upload url", "component", "check_deposits", "user_id", uid, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start deposit"})
+			return
+		}
+		uploads[side] = gin.H{
+			"url": url,
+			"headers": gin.H{
+				"Content-Type":                req.ImageContentType,
+				"X-Goog-Content-Length-Range": fmt.Sprintf("0,%d", checkImageMaxBytes),
+			},
+		}
+	}
+	if _, err := fs.Collection("check_deposits").Doc(deposit.ID).Create(ctx, deposit); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start deposit"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, gin.H{"deposit": deposit, "uploads": uploads, "uploads_expire_at": expiresAt.UTC()})
+}
+
+// SubmitCheckDeposit sends an uploaded check to the RDC provider.
+// Submitting again after an error is safe; the provider deduplicates by
+// deposit ID.
+func SubmitCheckDeposit(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok || !checkDepositsAvailable(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	deposit, ok := callerCheckDeposit(c, fs, uid)
+	if !ok {
+		return
+	}
+	if deposit.Status != CheckDepositAwaitingImages {
+		c.JSON(http.StatusConflict, gin.H{"error": "Check was already submitted", "code": "check_already_submitted", "deposit": deposit})
+		return
+	}
+
+	imageURLs := map[string]string{}
+	for _, side := range []string{"front", "back"} {
+		object := checkImageObject(deposit, side)
+		attrs, err := checkImageBucket.Object(object).Attrs(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Upload the %s of the check first", side), "code": "check_image_missing"})
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to read check image", "component", "check_deposits", "deposit_id", deposit.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit deposit"})
+			return
+		}
+		if attrs.Size == 0 || attrs.Size > checkImageMaxBytes || attrs.ContentType != deposit.ImageContentType {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The %s image isn't valid; upload it again", side), "code": "check_image_invalid"})
+			return
+		}
+		url, err := checkImageBucket.SignedURL(object, &storage.SignedURLOptions{
+			Scheme:  storage.SigningSchemeV4,
+			Method:  http.MethodGet,
+			Expires: time.Now().Add(checkImageURLTTL),
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to sign check image url", "component", "check_deposits", "deposit_id", deposit.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit deposit"})
+			return
+		}
+		imageURLs[side] = url
+	}
+
+	submitted, err := remoteDeposits.SubmitDeposit(ctx, RDCDepositRequest{
+		ExternalID:    deposit.ID,
+		Amount:        deposit.Amount,
+		Currency:      deposit.Currency,
+		FrontImageURL: imageURLs["front"],
+		BackImageURL:  imageURLs["back"],
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to submit check deposit", "component", "check_deposits", "deposit_id", deposit.ID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to submit deposit; try again", "code": "provider_error"})
+		return
+	}
+
+	// A webhook may already have moved the deposit on; only a deposit still
+	// awaiting images is marked submitted
+	ref := fs.Collection("check_deposits").Doc(deposit.ID)
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if stringField(snap.Data(), "status") != CheckDepositAwaitingImages {
+			return tx.Update(ref, []firestore.Update{{Path: "provider_deposit_id", Value: submitted.ID}})
+		}
+		now := time.Now()
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: CheckDepositSubmitted},
+			{Path: "provider_deposit_id", Value: submitted.ID},
+			{Path: "submitted_at", Value: now},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record check submission", "component", "check_deposits", "deposit_id", deposit.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit deposit"})
+		return
+	}
+	if deposit, err = loadCheckDeposit(ctx, fs, deposit.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load deposit"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deposit": deposit})
+}
+
+// GetCheckDeposit returns one of the caller's check deposits
+func GetCheckDeposit(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	deposit, ok := callerCheckDeposit(c, fs, uid)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deposit": deposit})
+}
+
+// ListCheckDeposits returns the caller's 50 most recent check deposits
+func ListCheckDeposits(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	docs, err := fs.Collection("check_deposits").
+		Where("user_id", "==", uid).
+		OrderBy("created_at", firestore.Desc).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load check deposits"})
+		return
+	}
+	deposits := make([]CheckDeposit, 0, len(docs))
+	for _, doc := range docs {
+		var d CheckDeposit
+		if err := doc.DataTo(&d); err != nil {
+			continue
+		}
+		d.ID = doc.Ref.ID
+		deposits = append(deposits, d)
+	}
+	c.JSON(http.StatusOK, gin.H{"deposits": deposits})
+}
+
+// HandleCheckDepositWebhook applies the RDC provider's deposit updates. Each
+// event is processed once, and a non-2xx makes the provider redeliver.
+func HandleCheckDepositWebhook(c *gin.Context) {
+	if remoteDeposits == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Check deposits are not available"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	event, err := remoteDeposits.ValidateWebhook(payload, c.GetHeader("RDC-Signature"))
+	if err != nil {
+		slog.WarnContext(ctx, "rdc webhook validation failed", "component", "check_deposits", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+		return
+	}
+	if event.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing event ID"})
+		return
+	}
+
+	eventRef := fs.Collection("check_deposit_events").Doc(event.ID)
+	if snap, err := eventRef.Get(ctx); err == nil && snap.Exists() {
+		c.JSON(http.StatusOK, gin.H{"received": true})
+		return
+	} else if err != nil && status.Code(err) != codes.NotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check event"})
+		return
+	}
+
+	if err := processCheckDepositEvent(c, fs, event); err != nil {
+		// Wallet entry references keep the redelivery idempotent
+		slog.ErrorContext(ctx, "failed to process rdc webhook", "component", "check_deposits", "event_id", event.ID, "event_type", event.Type, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event"})
+		return
+	}
+	if _, err := eventRef.Set(ctx, map[string]interface{}{
+		"type":         event.Type,
+		"deposit_id":   event.Data.ExternalID,
+		"processed_at": time.Now(),
+	}); err != nil {
+		slog.WarnContext(ctx, "failed to record rdc webhook", "component", "check_deposits", "event_id", event.ID, "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// processCheckDepositEvent moves a deposit on for one webhook. Events for
+// deposits this service doesn't know, or that can't follow its status, are
+// ignored.
+func processCheckDepositEvent(c *gin.Context, fs *firestore.Client, event *RDCWebhookEvent) error {
+	ctx := c.Request.Context()
+	deposit, err := loadCheckDeposit(ctx, fs, event.Data.ExternalID)
+	if err != nil {
+		slog.WarnContext(ctx, "unmatched check deposit", "component", "check_deposits", "deposit_id", event.Data.ExternalID, "error", err)
+		return nil
+	}
+	amount := currencyOrDefault(deposit.Currency)
+	switch event.Type {
+	case RDCEventAccepted:
+		entry, err := creditCheckDeposit(ctx, fs, deposit, event.Data.Amount)
+		if err != nil || entry == nil {
+			return err
+		}
+		recordWalletMovement(c, fs, entry)
+		if credited, err := loadCheckDeposit(ctx, fs, deposit.ID); err == nil {
+			deposit = credited
+		}
+		body := fmt.Sprintf("Your %s check was deposited", amount.Format(deposit.ConfirmedAmount))
+		if deposit.AvailableAt != nil && deposit.AvailableAt.After(time.Now()) {
+			body += fmt.Sprintf(" and will be available to spend on %s", deposit.AvailableAt.UTC().Format("January 2"))
+		}
+		NotifyUser(ctx, fs, deposit.UserID, NotificationWalletCredited, "Check deposited", body,
+			map[string]interface{}{"check_deposit_id": deposit.ID, "amount": deposit.ConfirmedAmount})
+
+	case RDCEventRejected:
+		moved, err := moveCheckDeposit(ctx, fs, deposit.ID, CheckDepositRejected, event.Data.Reason)
+		if err != nil || !moved {
+			return err
+		}
+		NotifyUser(ctx, fs, deposit.UserID, NotificationCheckRejected, "Check couldn't be deposited",
+			fmt.Sprintf("Your %s check couldn't be deposited. Nothing was added to your wallet.", amount.Format(deposit.Amount)),
+			map[string]interface{}{"check_deposit_id": deposit.ID, "reason": event.Data.Reason})
+
+	case RDCEventCleared:
+		_, err := moveCheckDeposit(ctx, fs, deposit.ID, CheckDepositCleared, "")
+		return err
+
+	case RDCEventReturned:
+		if !canTransitionCheckDeposit(deposit.Status, CheckDepositReturned) {
+			return nil
+		}
+		entry, err := reverseCheckDeposit(ctx, fs, deposit)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			recordWalletMovement(c, fs, entry)
+		}
+		moved, err := moveCheckDeposit(ctx, fs, deposit.ID, CheckDepositReturned, event.Data.Reason)
+		if err != nil || !moved {
+			return err
+		}
+		NotifyUser(ctx, fs, deposit.UserID, NotificationWalletDebited, "Check returned",
+			fmt.Sprintf("Your %s check was returned by the bank it was drawn on, so it has been taken back out of your wallet", amount.Format(deposit.ConfirmedAmount)),
+			map[string]interface{}{"check_deposit_id": deposit.ID, "reason": event.Data.Reason})
+	}
+	return nil
+}
+
+// moveCheckDeposit sets a deposit's status if it can move there, reporting
+// whether it moved
+func moveCheckDeposit(ctx context.Context, fs *firestore.Client, id, to, reason string) (bool, error) {
+	ref := fs.Collection("check_deposits").Doc(id)
+	moved := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		moved = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if !canTransitionCheckDeposit(stringField(snap.Data(), "status"), to) {
+			return nil
+		}
+		updates := []firestore.Update{{Path: "status", Value: to}, {Path: "updated_at", Value: time.Now()}}
+		if reason != "" {
+			updates = append(updates, firestore.Update{Path: "failure_reason", Value: reason})
+		}
+		moved = true
+		return tx.Update(ref, updates)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to move check deposit %s to %s: %w", id, to, err)
+	}
+	return moved, nil
+}
+
+// creditCheckDeposit credits an accepted check to the wallet and holds the
+// credit for the user's risk tier's hold period, all in one transaction so
+// the funds can't be spent before they are held. It returns the applied
+// entry, or nil if the deposit can't be accepted or already was.
+func creditCheckDeposit(ctx context.Context, fs *firestore.Client, deposit *CheckDeposit, confirmedAmount int64) (*WalletEntry, error) {
+	if confirmedAmount <= 0 {
+		return nil, fmt.Errorf("check deposit %s accepted without an amount", deposit.ID)
+	}
+	tier := recipientRiskTier(ctx, fs, deposit.UserID)
+	holdDays := checkHoldDays(tier)
+	depositRef := fs.Collection("check_deposits").Doc(deposit.ID)
+	walletRef := fs.Collection("wallets").Doc(deposit.UserID)
+	entryRef := fs.Collection("wallet_entries").Doc("check_" + deposit.ID)
+	holdID := "check_" + deposit.ID
+	holdRef := fs.Collection("wallet_holds").Doc(holdID)
+
+	var applied *WalletEntry
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		applied = nil
+		snap, err := tx.Get(depositRef)
+		if err != nil {
+			return err
+		}
+		if !canTransitionCheckDeposit(stringField(snap.Data(), "status"), CheckDepositAccepted) {
+			return nil
+		}
+		wallet := Wallet{UserID: deposit.UserID, Currency: walletCurrency}
+		walletSnap, err := tx.Get(walletRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if walletSnap != nil && walletSnap.Exists() {
+			if err := walletSnap.DataTo(&wallet); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		availableAt := now.AddDate(0, 0, holdDays)
+		wallet.Balance += confirmedAmount
+		wallet.UpdatedAt = now
+		entry := &WalletEntry{
+			UserID:       deposit.UserID,
+			Reference:    entryRef.ID,
+			Source:       walletSourceCheckDeposit,
+			Type:         walletEntryCheckDeposit,
+			Amount:       confirmedAmount,
+			BalanceAfter: wallet.Balance,
+			CreatedAt:    now,
+		}
+		if err := tx.Create(entryRef, entry); err != nil {
+			return err
+		}
+		if holdDays > 0 {
+			wallet.Held += confirmedAmount
+			if err := tx.Create(holdRef, WalletHold{
+				UserID:    deposit.UserID,
+				Amount:    confirmedAmount,
+				Status:    WalletHoldActive,
+				Reason:    "check_deposit",
+				Reference: deposit.ID,
+				ExpiresAt: availableAt,
+				CreatedAt: now,
+				UpdatedAt: now,
+			}); err != nil {
+				return err
+			}
+		}
+		if err := tx.Set(walletRef, wallet); err != nil {
+			return err
+		}
+		updates := []firestore.Update{
+			{Path: "status", Value: CheckDepositAccepted},
+			{Path: "confirmed_amount", Value: confirmedAmount},
+			{Path: "risk_tier", Value: tier},
+			{Path: "hold_days", Value: holdDays},
+			{Path: "available_at", Value: availableAt},
+			{Path: "updated_at", Value: now},
+		}
+		if holdDays > 0 {
+			updates = append(updates, firestore.Update{Path: "hold_id", Value: holdID})
+		}
+		applied = entry
+		return tx.Update(depositRef, updates)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to credit check deposit %s: %w", deposit.ID, err)
+	}
+	return applied, nil
+}
+
+// reverseCheckDeposit takes a returned check's credit back out of the wallet:
+// from the hold while it is still held, from the balance once released. It
+// returns the applied entry, or nil if the check was already reversed.
+func reverseCheckDeposit(ctx context.Context, fs *firestore.Client, deposit *CheckDeposit) (*WalletEntry, error) {
+	entry := &WalletEntry{
+		UserID:    deposit.UserID,
+		Reference: "check_" + deposit.ID + "_reversal",
+		Source:    walletSourceCheckDeposit,
+		Type:      walletEntryCheckDeposit + "_reversal",
+	}
+	if deposit.HoldID != "" {
+		err := CommitWalletHold(ctx, fs, deposit.HoldID, entry)
+		if err == nil {
+			return entry, nil
+		}
+		if !errors.Is(err, ErrWalletHoldClosed) {
+			return nil, err
+		}
+	}
+	// The hold was released, or committed by an earlier attempt, whose entry
+	// makes this one a no-op. The balance may go negative.
+	entry.Amount = -deposit.ConfirmedAmount
+	applied, err := ApplyWalletEntry(ctx, fs, entry, "")
+	if err != nil || !applied {
+		return nil, err
+	}
+	return entry, nil
+}
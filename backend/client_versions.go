@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Headers the mobile apps send with every request
+const (
+	HeaderAppVersion = "X-App-Version"
+	HeaderPlatform   = "X-Platform"
+)
+
+// MetricClientRequests counts requests per route and client version so old
+// app versions still calling a route can be found before it is removed
+const MetricClientRequests = "api_client_requests_total"
+
+// appPlatforms are the X-Platform values with a minimum supported version
+var appPlatforms = map[string]string{
+	"ios":     "MIN_APP_VERSION_IOS",
+	"android": "MIN_APP_VERSION_ANDROID",
+}
+
+// appVersion is a parsed X-App-Version, e.g. "4.12.1" or "4.12.1 (812)"
+type appVersion [3]int
+
+// parseAppVersion reads the major.minor.patch prefix of a version string,
+// ignoring a build number or pre-release suffix
+func parseAppVersion(s string) (appVersion, bool) {
+	var v appVersion
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, " -+("); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if s == "" || len(parts) > 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// less reports whether v is older than other
+func (v appVersion) less(other appVersion) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+// String renders the version as major.minor.patch
+func (v appVersion) String() string {
+	return strconv.Itoa(v[0]) + "." + strconv.Itoa(v[1]) + "." + strconv.Itoa(v[2])
+}
+
+// ClientInfo is the app platform and version a request came from. Either is
+// "unknown" when its header is missing or unrecognised.
+type ClientInfo struct {
+	Platform   string `json:"platform" firestore:"platform"`
+	AppVersion string `json:"app_version" firestore:"app_version"`
+}
+
+// known reports whether the request identified its app
+func (ci ClientInfo) known() bool {
+	return ci.Platform != "unknown" || ci.AppVersion != "unknown"
+}
+
+type clientInfoContextKey struct{}
+
+// ClientFromContext returns the client a request came from; work that didn't
+// start from an app request gets unknown for both
+func ClientFromContext(ctx context.Context) ClientInfo {
+	if ci, ok := ctx.Value(clientInfoContextKey{}).(ClientInfo); ok {
+		return ci
+	}
+	return ClientInfo{Platform: "unknown", AppVersion: "unknown"}
+}
+
+// parseClientInfo reads the X-Platform and X-App-Version headers
+func parseClientInfo(r *http.Request) ClientInfo {
+	ci := ClientInfo{Platform: strings.ToLower(strings.TrimSpace(r.Header.Get(HeaderPlatform))), AppVersion: "unknown"}
+	if _, ok := appPlatforms[ci.Platform]; !ok && ci.Platform != "web" {
+		ci.Platform = "unknown"
+	}
+	if v, ok := parseAppVersion(r.Header.Get(HeaderAppVersion)); ok {
+		ci.AppVersion = v.String()
+	}
+	return ci
+}
+
+// ClientInfoMiddleware puts the caller's platform and app version on the
+// request context, where logs, traces, new transactions, and feature flags
+// pick it up
+func ClientInfoMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci := parseClientInfo(c.Request)
+		c.Set("client", ci)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), clientInfoContextKey{}, ci))
+		c.Next()
+	}
+}
+
+// ClientUsageMiddleware counts each request by route, platform, and app
+// version. Calls to deprecated routes are also tallied per day in Firestore,
+// so usage is seen across every instance and both colours of a blue/green
+// deploy, not just the one being scraped.
+func ClientUsageMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		client := ClientFromContext(c.Request.Context())
+		platform, version := client.Platform, client.AppVersion
+		deprecated := c.GetBool("deprecatedRoute")
+		metrics.IncCounter(MetricClientRequests, map[string]string{
+			"method":      c.Request.Method,
+			"route":       route,
+			"platform":    platform,
+			"app_version": version,
+			"deprecated":  strconv.FormatBool(deprecated),
+		})
+		if !deprecated {
+			return
+		}
+		v, ok := c.Get("firestore")
+		if !ok || !inflightWork.start() {
+			return
+		}
+		fs := v.(*firestore.Client)
+		method := c.Request.Method
+		go func() {
+			defer inflightWork.done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			recordDeprecatedRouteUsage(ctx, fs, method, route, platform, version)
+		}()
+	}
+}
+
+// recordDeprecatedRouteUsage increments the day's tally for a deprecated
+// route and client version at deprecated_route_usage/{id}
+func recordDeprecatedRouteUsage(ctx context.Context, fs *firestore.Client, method, route, platform, version string) {
+	now := time.Now().UTC()
+	day := now.Format("2006-01-02")
+	key := sha256.Sum256([]byte(strings.Join([]string{day, method, route, platform, version}, "|")))
+	_, err := fs.Collection("deprecated_route_usage").Doc(day+"_"+hex.EncodeToString(key[:8])).Set(ctx, map[string]interface{}{
+		"date":         day,
+		"method":       method,
+		"route":        route,
+		"platform":     platform,
+		"app_version":  version,
+		"count":        firestore.Increment(1),
+		"last_seen_at": now,
+	}, firestore.MergeAll)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to record deprecated route usage", "component", "client_versions", "route", route, "error", err)
+	}
+}
+
+// Deprecated marks a route as deprecated: responses carry the Deprecation
+// and Sunset headers (RFC 9745, RFC 8594) and a link to the replacement, and
+// calls are tallied by ClientUsageMiddleware. sunset is the date the route
+// will be removed.
+func Deprecated(sunset time.Time, replacement string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("deprecatedRoute", true)
+		c.Header("Deprecation", "true")
+		c.Header("Sunset", sunset.UTC().Format(http.TimeFormat))
+		if replacement != "" {
+			c.Header("Link", "<"+replacement+">; rel=\"successor-version\"")
+		}
+		c.Next()
+	}
+}
+
+// RequireClientVersion rejects app versions older than the minimum supported
+// for their platform (MIN_APP_VERSION_IOS, MIN_APP_VERSION_ANDROID) with 426
+// and where to upgrade. Requests without an app version, such as web and
+// partner integrations, are let through.
+func RequireClientVersion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := ClientFromContext(c.Request.Context())
+		platform := client.Platform
+		env, ok := appPlatforms[platform]
+		if !ok {
+			c.Next()
+			return
+		}
+		minimum, ok := parseAppVersion(os.Getenv(env))
+		if !ok {
+			c.Next()
+			return
+		}
+		version, ok := parseAppVersion(client.AppVersion)
+		if !ok || !version.less(minimum) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUpgradeRequired, gin.H{
+			"error":       "This version of the app is no longer supported for payments. Please update to continue.",
+			"code":        "client_upgrade_required",
+			"min_version": os.Getenv(env),
+			"upgrade_url": os.Getenv("APP_UPGRADE_URL_" + strings.ToUpper(platform)),
+		})
+	}
+}
+
+// ListDeprecatedRouteUsage returns the daily tallies of deprecated route calls
+// by client version over the last `days` days (default 7, at most 90)
+func ListDeprecatedRouteUsage(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days < 1 || days > 90 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 90"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+	docs, err := fs.Collection("deprecated_route_usage").
+		Where("date", ">=", since).
+		OrderBy("date", firestore.Desc).
+		Limit(1000).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+	usage := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		usage = append(usage, doc.Data())
+	}
+	c.JSON(http.StatusOK, gin.H{"usage": usage, "since": since})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// redactedKeys are JSON fields whose values never leave the request path in clear text
+var redactedKeys = map[string]bool{
+	"account_number": true,
+	"routing_number": true,
+	"ssn":            true,
+	"identity_value": true,
+	"email":          true,
+	"phone":          true,
+	"access_token":   true,
+	"public_token":   true,
+	"client_secret":  true,
+	"number":         true,
+	"cvc":            true,
+}
+
+// redactedSuffixes catch prefixed variants of redacted fields, e.g. recipient_email
+var redactedSuffixes = []string{"email", "phone"}
+
+// isRedactedKey reports whether a JSON field (lowercased) is redacted
+func isRedactedKey(key string) bool {
+	if redactedKeys[key] {
+		return true
+	}
+	for _, suffix := range redactedSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// referenceKeys are JSON fields that identify the transaction a capture belongs to
+var referenceKeys = map[string]bool{
+	"payment_intent_id": true,
+	"transfer_id":       true,
+}
+
+// captureWriter tees the response body so it can be captured after the handler runs
+type captureWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// captureSampleRate returns the fraction of requests captured (default: all)
+func captureSampleRate() float64 {
+	rate, err := strconv.ParseFloat(os.Getenv("COMPLIANCE_CAPTURE_SAMPLE_RATE"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 1
+	}
+	return rate
+}
+
+// redactJSON replaces sensitive values and collects transaction references
+func redactJSON(value interface{}, refs map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			lower := strings.ToLower(key)
+			if isRedactedKey(lower) {
+				v[key] = "[REDACTED]"
+				continue
+			}
+			if s, ok := child.(string); ok && s != "" && referenceKeys[lower] {
+				refs[s] = true
+			}
+			v[key] = redactJSON(child, refs)
+		}
+		// Nested payment_intent / transfer objects carry their reference as "id"
+		if id, ok := v["id"].(string); ok && (strings.HasPrefix(id, "pi_") || strings.HasPrefix(id, "tr_")) {
+			refs[id] = true
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactJSON(child, refs)
+		}
+		return v
+	}
+	return value
+}
+
+// redactBody parses and redacts a JSON body; non-JSON bodies are dropped entirely
+func redactBody(body []byte, refs map[string]bool) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "[non-JSON body omitted]"
+	}
+	return redactJSON(parsed, refs)
+}
+
+// ComplianceCaptureMiddleware stores sampled, PII-redacted, encrypted copies of
+// money-movement requests and responses, retrievable by transaction reference.
+func ComplianceCaptureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, ok := c.Get("firestore")
+		if !ok || rand.Float64() >= captureSampleRate() {
+			c.Next()
+			return
+		}
+		fs := v.(*firestore.Client)
+
+		reqBody, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(reqBody))
+		writer := &captureWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = writer
+
+		c.Next()
+
+		refs := map[string]bool{}
+		if key := c.GetHeader("Idempotency-Key"); key != "" {
+			refs[key] = true
+		}
+		record := map[string]interface{}{
+			"request":  redactBody(reqBody, refs),
+			"response": redactBody(writer.body.Bytes(), refs),
+		}
+		plaintext, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+		references := make([]string, 0, len(refs))
+		for ref := range refs {
+			references = append(references, ref)
+		}
+		userID := c.GetString("userID")
+		client := ClientFromContext(c.Request.Context())
+		route := c.FullPath()
+		method := c.Request.Method
+		status := writer.Status()
+
+		if !inflightWork.start() {
+			return
+		}
+		go func() {
+			defer inflightWork.done()
+			encrypted, err := EncryptString(string(plaintext))
+			if err != nil {
+				slog.Error("compliance capture dropped, encryption unavailable", "component", "capture", "error", err)
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, _, err = fs.Collection("compliance_captures").Add(ctx, map[string]interface{}{
+				"references":  references,
+				"user_id":     userID,
+				"client":      client,
+				"route":       route,
+				"method":      method,
+				"status_code": status,
+				"payload":     encrypted,
+				"captured_at": time.Now(),
+			})
+			if err != nil {
+				slog.Error("failed to store compliance capture", "component", "capture", "route", route, "error", err)
+			}
+		}()
+	}
+}
+
+// GetComplianceCaptures returns decrypted captures for a transaction reference
+func GetComplianceCaptures(c *gin.Context) {
+	reference := c.Query("reference")
+	if reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reference is required"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("compliance_captures").Where("references", "array-contains", reference).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load captures"})
+		return
+	}
+
+	captures := make([]gin.H, 0, len(docs))
+	for _, doc := range docs {
+		data := doc.Data()
+		encrypted, _ := data["payload"].(string)
+		plaintext, err := DecryptString(encrypted)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "failed to decrypt compliance capture", "component", "capture", "capture_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		var payload interface{}
+		_ = json.Unmarshal([]byte(plaintext), &payload)
+		captures = append(captures, gin.H{
+			"id":          doc.Ref.ID,
+			"route":       data["route"],
+			"method":      data["method"],
+			"user_id":     data["user_id"],
+			"status_code": data["status_code"],
+			"captured_at": data["captured_at"],
+			"payload":     payload,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reference": reference, "captures": captures})
+}
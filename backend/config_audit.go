@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Configuration documents admins change at runtime
+const (
+	ConfigLimits       = "config/limits"
+	ConfigFees         = "config/fees"
+	ConfigKillSwitches = "config/kill_switches"
+)
+
+// Kill switches turn off a money movement flow for every user until an admin
+// turns it back on
+const (
+	KillSwitchPayments  = "payments"
+	KillSwitchTransfers = "transfers"
+	KillSwitchPayouts   = "payouts"
+	KillSwitchWallet    = "wallet"
+)
+
+var killSwitchNames = map[string]bool{
+	KillSwitchPayments:  true,
+	KillSwitchTransfers: true,
+	KillSwitchPayouts:   true,
+	KillSwitchWallet:    true,
+}
+
+// ConfigChange is one admin change to configuration, stored at
+// config_changes/{id}. Before and After are the whole document on either side
+// of the change, nil where it didn't exist, so a change can be rolled back.
+type ConfigChange struct {
+	ID         string      `json:"id" firestore:"-"`
+	Subject    string      `json:"subject" firestore:"subject"` // document path, e.g. config/fees or feature_flags/{name}
+	AdminID    string      `json:"admin_id" firestore:"admin_id"`
+	Reason     string      `json:"reason,omitempty" firestore:"reason,omitempty"`
+	Before     interface{} `json:"before" firestore:"before"`
+	After      interface{} `json:"after" firestore:"after"`
+	RollbackOf string      `json:"rollback_of,omitempty" firestore:"rollback_of,omitempty"`
+	CreatedAt  time.Time   `json:"created_at" firestore:"created_at"`
+}
+
+// LimitsConfig is config/limits
+type LimitsConfig struct {
+	Tiers     []LimitTier `json:"tiers" firestore:"tiers"`
+	UpdatedBy string      `json:"updated_by,omitempty" firestore:"updated_by,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at" firestore:"updated_at"`
+}
+
+// FeeConfig is config/fees; its rules override FEE_<SPEED>_<METHOD> and the
+// defaults
+type FeeConfig struct {
+	Rules     map[string]map[string]FeeRule `json:"rules" firestore:"rules"`
+	UpdatedBy string                        `json:"updated_by,omitempty" firestore:"updated_by,omitempty"`
+	UpdatedAt time.Time                     `json:"updated_at" firestore:"updated_at"`
+}
+
+// KillSwitchConfig is config/kill_switches
+type KillSwitchConfig struct {
+	Switches  map[string]bool `json:"switches" firestore:"switches"`
+	UpdatedBy string          `json:"updated_by,omitempty" firestore:"updated_by,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at" firestore:"updated_at"`
+}
+
+// runtimeConfig caches the fee and kill switch documents, which are read on
+// every payment. It is refreshed every minute and when this instance changes
+// them.
+var runtimeConfig struct {
+	mu           sync.RWMutex
+	fees         map[string]map[string]FeeRule
+	killSwitches map[string]bool
+}
+
+// LoadRuntimeConfig refreshes the cached fee and kill switch configuration.
+// If either can't be read the cached copy is kept.
+func LoadRuntimeConfig(ctx context.Context, fs *firestore.Client) error {
+	var fees FeeConfig
+	if err := readConfig(ctx, fs, ConfigFees, &fees); err != nil {
+		return err
+	}
+	var switches KillSwitchConfig
+	if err := readConfig(ctx, fs, ConfigKillSwitches, &switches); err != nil {
+		return err
+	}
+	runtimeConfig.mu.Lock()
+	defer runtimeConfig.mu.Unlock()
+	runtimeConfig.fees = fees.Rules
+	runtimeConfig.killSwitches = switches.Switches
+	return nil
+}
+
+// readConfig reads a configuration document into v, leaving v empty when it
+// doesn't exist
+func readConfig(ctx context.Context, fs *firestore.Client, path string, v interface{}) error {
+	doc, err := getDocument(ctx, fs.Doc(path))
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return doc.DataTo(v)
+}
+
+// configuredFeeRule returns the fee rule an admin set for a speed and method
+func configuredFeeRule(speed, method string) (FeeRule, bool) {
+	runtimeConfig.mu.RLock()
+	defer runtimeConfig.mu.RUnlock()
+	rule, ok := runtimeConfig.fees[speed][method]
+	return rule, ok
+}
+
+// killSwitchOn reports whether a kill switch is on
+func killSwitchOn(name string) bool {
+	runtimeConfig.mu.RLock()
+	defer runtimeConfig.mu.RUnlock()
+	return runtimeConfig.killSwitches[name]
+}
+
+// KillSwitch refuses a route while its kill switch is on
+func KillSwitch(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if killSwitchOn(name) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "This feature is temporarily unavailable", "code": "kill_switch", "switch": name})
+			return
+		}
+		c.Next()
+	}
+}
+
+// changeConfig applies an admin change to the configuration document at path
+// and records it, in one transaction. update gets the current document, nil
+// if it doesn't exist, and returns its replacement; nil deletes it.
+func changeConfig(ctx context.Context, fs *firestore.Client, path, adminID, reason, rollbackOf string, update func(*firestore.DocumentSnapshot) (interface{}, error)) (*ConfigChange, error) {
+	ref := fs.Doc(path)
+	changeRef := fs.Collection("config_changes").NewDoc()
+	var change *ConfigChange
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		change = &ConfigChange{
+			ID:         changeRef.ID,
+			Subject:    path,
+			AdminID:    adminID,
+			Reason:     reason,
+			RollbackOf: rollbackOf,
+			CreatedAt:  time.Now(),
+		}
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err != nil {
+			doc = nil
+		} else {
+			change.Before = doc.Data()
+		}
+		after, err := update(doc)
+		if err != nil {
+			return err
+		}
+		change.After = after
+		if after == nil {
+			if err := tx.Delete(ref); err != nil {
+				return err
+			}
+		} else if err := tx.Set(ref, after); err != nil {
+			return err
+		}
+		return tx.Create(changeRef, change)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if path == ConfigFees || path == ConfigKillSwitches {
+		if err := LoadRuntimeConfig(ctx, fs); err != nil {
+			slog.WarnContext(ctx, "failed to reload runtime config", "component", "config", "error", err)
+		}
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "config", SubjectID: path}); err != nil {
+		slog.ErrorContext(ctx, "failed to log config access", "component", "config", "subject", path, "error", err)
+	}
+	return change, nil
+}
+
+// configAdminDeps returns the admin's ID and Firestore for a config handler,
+// writing the error response if either is missing
+func configAdminDeps(c *gin.Context) (string, *firestore.Client, bool) {
+	adminID, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", nil, false
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return "", nil, false
+	}
+	return adminID.(string), v.(*firestore.Client), true
+}
+
+// GetConfig returns the configuration in effect: limit tiers, fee rules after
+// overrides, and kill switches
+func GetConfig(c *gin.Context) {
+	_, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	fees := map[string]map[string]FeeRule{}
+	for speed, methods := range defaultFeeRules {
+		fees[speed] = map[string]FeeRule{}
+		for method := range methods {
+			fees[speed][method] = feeRule(speed, method)
+		}
+	}
+	switches := map[string]bool{}
+	for name := range killSwitchNames {
+		switches[name] = killSwitchOn(name)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"limits":        gin.H{"tiers": loadLimitTiers(c.Request.Context(), fs)},
+		"fees":          fees,
+		"kill_switches": switches,
+	})
+}
+
+// SetLimitTiers replaces the send limit tiers, ordered from most to least
+// restrictive
+func SetLimitTiers(c *gin.Context) {
+	var req struct {
+		Tiers  []LimitTier `json:"tiers" binding:"required,min=1,dive"`
+		Reason string      `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	names := map[string]bool{}
+	for i, t := range req.Tiers {
+		if t.Name == "" || names[t.Name] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Each tier needs a unique name"})
+			return
+		}
+		names[t.Name] = true
+		if t.PerTransaction <= 0 || t.Daily < t.PerTransaction || t.Monthly < t.Daily {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Tier %s: limits must be positive with per_transaction <= daily <= monthly", t.Name)})
+			return
+		}
+		req.Tiers[i].Level = i
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	change, err := changeConfig(c.Request.Context(), fs, ConfigLimits, adminID, req.Reason, "", func(*firestore.DocumentSnapshot) (interface{}, error) {
+		return LimitsConfig{Tiers: req.Tiers, UpdatedBy: adminID, UpdatedAt: time.Now()}, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save limits"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"change": change})
+}
+
+// SetFeeRule sets the fee for one speed and funding method
+func SetFeeRule(c *gin.Context) {
+	speed, method := c.Param("speed"), c.Param("method")
+	if _, ok := defaultFeeRules[speed][method]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown fee speed or method"})
+		return
+	}
+	var req struct {
+		Flat       *int64 `json:"flat" binding:"required,min=0"`
+		PercentBPS *int64 `json:"percent_bps" binding:"required,min=0,max=10000"`
+		Reason     string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	change, err := changeConfig(c.Request.Context(), fs, ConfigFees, adminID, req.Reason, "", func(doc *firestore.DocumentSnapshot) (interface{}, error) {
+		var cfg FeeConfig
+		if doc != nil {
+			if err := doc.DataTo(&cfg); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.Rules == nil {
+			cfg.Rules = map[string]map[string]FeeRule{}
+		}
+		if cfg.Rules[speed] == nil {
+			cfg.Rules[speed] = map[string]FeeRule{}
+		}
+		cfg.Rules[speed][method] = FeeRule{Flat: *req.Flat, PercentBPS: *req.PercentBPS}
+		cfg.UpdatedBy, cfg.UpdatedAt = adminID, time.Now()
+		return cfg, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save fee"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"change": change})
+}
+
+// SetKillSwitch turns a kill switch on or off. Other instances pick the change
+// up within a minute.
+func SetKillSwitch(c *gin.Context) {
+	name := c.Param("name")
+	if !killSwitchNames[name] {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown kill switch"})
+		return
+	}
+	var req struct {
+		Enabled *bool  `json:"enabled" binding:"required"`
+		Reason  string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	change, err := changeConfig(c.Request.Context(), fs, ConfigKillSwitches, adminID, req.Reason, "", func(doc *firestore.DocumentSnapshot) (interface{}, error) {
+		var cfg KillSwitchConfig
+		if doc != nil {
+			if err := doc.DataTo(&cfg); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.Switches == nil {
+			cfg.Switches = map[string]bool{}
+		}
+		cfg.Switches[name] = *req.Enabled
+		cfg.UpdatedBy, cfg.UpdatedAt = adminID, time.Now()
+		return cfg, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save kill switch"})
+		return
+	}
+	slog.WarnContext(c.Request.Context(), "kill switch changed", "component", "config", "switch", name, "enabled", *req.Enabled, "admin_id", adminID)
+	c.JSON(http.StatusOK, gin.H{"change": change})
+}
+
+// ListConfigChanges returns configuration changes, newest first; ?subject=
+// narrows them to one document, e.g. config/fees
+func ListConfigChanges(c *gin.Context) {
+	_, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	q := fs.Collection("config_changes").Query
+	if subject := c.Query("subject"); subject != "" {
+		q = q.Where("subject", "==", subject)
+	}
+	docs, err := q.OrderBy("created_at", firestore.Desc).Limit(200).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load config history"})
+		return
+	}
+	changes := make([]ConfigChange, 0, len(docs))
+	for _, doc := range docs {
+		var change ConfigChange
+		if err := doc.DataTo(&change); err != nil {
+			continue
+		}
+		change.ID = doc.Ref.ID
+		changes = append(changes, change)
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": changes})
+}
+
+// RollbackConfigChange restores a document to how it was before a change,
+// recording the restore as a change of its own. Rolling back anything but the
+// latest change to a document needs ?force=true, since the later changes are
+// undone with it.
+func RollbackConfigChange(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, fs.Collection("config_changes").Doc(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Config change not found"})
+		return
+	}
+	var target ConfigChange
+	if err := doc.DataTo(&target); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read config change"})
+		return
+	}
+	target.ID = doc.Ref.ID
+	if !strings.HasPrefix(target.Subject, "config/") && !strings.HasPrefix(target.Subject, "feature_flags/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This change can't be rolled back"})
+		return
+	}
+	if c.Query("force") != "true" {
+		latest, err := fs.Collection("config_changes").
+			Where("subject", "==", target.Subject).
+			OrderBy("created_at", firestore.Desc).
+			Limit(1).
+			Documents(ctx).GetAll()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load config history"})
+			return
+		}
+		if len(latest) > 0 && latest[0].Ref.ID != target.ID {
+			c.JSON(http.StatusConflict, gin.H{"error": "Later changes to this configuration would also be undone; retry with force=true to roll back anyway", "code": "config_changed_since", "latest_change_id": latest[0].Ref.ID})
+			return
+		}
+	}
+
+	change, err := changeConfig(ctx, fs, target.Subject, adminID, req.Reason, target.ID, func(*firestore.DocumentSnapshot) (interface{}, error) {
+		return target.Before, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll back config change"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"change": change})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// NotificationConnectRequirementsDue tells a recipient Stripe needs more
+// information to keep paying them out
+const NotificationConnectRequirementsDue = "connect_requirements_due"
+
+// ConnectRequirements is what Stripe still needs from a connected account's
+// holder, stored at users/{uid}.connect_requirements. Fields are Stripe's
+// requirement names, e.g. individual.verification.document.
+type ConnectRequirements struct {
+	CurrentlyDue        []string                  `json:"currently_due" firestore:"currently_due"`
+	EventuallyDue       []string                  `json:"eventually_due" firestore:"eventually_due"`
+	PastDue             []string                  `json:"past_due" firestore:"past_due"`
+	PendingVerification []string                  `json:"pending_verification" firestore:"pending_verification"`
+	Errors              []ConnectRequirementError `json:"errors,omitempty" firestore:"errors,omitempty"`
+	DisabledReason      string                    `json:"disabled_reason,omitempty" firestore:"disabled_reason,omitempty"`
+	CurrentDeadline     time.Time                 `json:"current_deadline,omitempty" firestore:"current_deadline,omitempty"`
+	UpdatedAt           time.Time                 `json:"updated_at" firestore:"updated_at"`
+}
+
+// ConnectRequirementError is why Stripe rejected what was given for a field
+type ConnectRequirementError struct {
+	Requirement string `json:"requirement" firestore:"requirement"`
+	Code        string `json:"code" firestore:"code"`
+	Reason      string `json:"reason" firestore:"reason"`
+}
+
+// ConnectRequirementItem is one thing the app should ask the user for
+type ConnectRequirementItem struct {
+	Field  string `json:"field"`
+	Label  string `json:"label"`
+	Status string `json:"status"` // past_due or currently_due
+	Error  string `json:"error,omitempty"`
+}
+
+// connectRequirementLabels describe Stripe requirement fields to users; the
+// longest matching prefix wins
+var connectRequirementLabels = map[string]string{
+	"individual.verification.additional_document": "Proof of address",
+	"individual.verification.document":            "Photo ID",
+	"individual.id_number":                        "Social Security number",
+	"individual.ssn_last_4":                       "Last 4 digits of your Social Security number",
+	"individual.dob":                              "Date of birth",
+	"individual.address":                          "Home address",
+	"individual.first_name":                       "Legal name",
+	"individual.last_name":                        "Legal name",
+	"individual.email":                            "Email address",
+	"individual.phone":                            "Phone number",
+	"individual":                                  "Personal details",
+	"company.tax_id":                              "Business tax ID",
+	"company.verification.document":               "Business registration document",
+	"company":                                     "Business details",
+	"business_profile":                            "Business details",
+	"external_account":                            "Bank account or debit card for payouts",
+	"tos_acceptance":                              "Accept Stripe's terms of service",
+	"representative":                              "Details of the person running the business",
+	"owners":                                      "Business owners",
+	"directors":                                   "Business directors",
+}
+
+// connectRequirementLabel describes a requirement field. Fields about a
+// business's people (person_{id}.…) are described like an individual's.
+func connectRequirementLabel(field string) string {
+	key := field
+	if strings.HasPrefix(key, "person_") {
+		if _, rest, ok := strings.Cut(key, "."); ok {
+			key = "individual." + rest
+		}
+	}
+	best := ""
+	for prefix := range connectRequirementLabels {
+		if (key == prefix || strings.HasPrefix(key, prefix+".")) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return "Additional information"
+	}
+	return connectRequirementLabels[best]
+}
+
+// connectAccountStatus summarises a connected account
+func connectAccountStatus(acc *stripe.Account) *StripeConnectAccountStatus {
+	status := &StripeConnectAccountStatus{
+		ID:             acc.ID,
+		ChargesEnabled: acc.ChargesEnabled,
+		PayoutsEnabled: acc.PayoutsEnabled,
+		Requirements:   &ConnectRequirements{UpdatedAt: time.Now()},
+	}
+	r := acc.Requirements
+	if r == nil {
+		return status
+	}
+	req := status.Requirements
+	req.CurrentlyDue = append([]string{}, r.CurrentlyDue...)
+	req.EventuallyDue = append([]string{}, r.EventuallyDue...)
+	req.PastDue = append([]string{}, r.PastDue...)
+	req.PendingVerification = append([]string{}, r.PendingVerification...)
+	req.DisabledReason = string(r.DisabledReason)
+	if r.CurrentDeadline > 0 {
+		req.CurrentDeadline = time.Unix(r.CurrentDeadline, 0)
+	}
+	for _, e := range r.Errors {
+		req.Errors = append(req.Errors, ConnectRequirementError{Requirement: e.Requirement, Code: string(e.Code), Reason: e.Reason})
+	}
+	return status
+}
+
+// connectRequirementItems lists what the user has to provide, past due first
+func connectRequirementItems(req *ConnectRequirements) []ConnectRequirementItem {
+	errs := map[string]string{}
+	for _, e := range req.Errors {
+		errs[e.Requirement] = e.Reason
+	}
+	items := []ConnectRequirementItem{}
+	seen := map[string]bool{}
+	for _, group := range []struct {
+		status string
+		fields []string
+	}{{"past_due", req.PastDue}, {"currently_due", req.CurrentlyDue}} {
+		for _, field := range group.fields {
+			if seen[field] {
+				continue
+			}
+			seen[field] = true
+			items = append(items, ConnectRequirementItem{Field: field, Label: connectRequirementLabel(field), Status: group.status, Error: errs[field]})
+		}
+	}
+	return items
+}
+
+// saveConnectStatus stores a connected account's status on its user and
+// returns the requirements stored before
+func saveConnectStatus(ctx context.Context, fs *firestore.Client, uid string, status *StripeConnectAccountStatus) (*ConnectRequirements, error) {
+	var previous struct {
+		Requirements *ConnectRequirements `firestore:"connect_requirements"`
+	}
+	if doc, err := getDocument(ctx, UserDoc(ctx, fs, uid)); err == nil {
+		_ = doc.DataTo(&previous)
+	}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"charges_enabled":      status.ChargesEnabled,
+		"payouts_enabled":      status.PayoutsEnabled,
+		"connect_requirements": status.Requirements,
+		"updated_at":           time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	_, _ = AdvanceOnboarding(ctx, fs, uid)
+	return previous.Requirements, nil
+}
+
+// syncConnectAccount applies an account.updated event to the account's user
+// and tells them when Stripe starts asking for something new
+func syncConnectAccount(ctx context.Context, fs *firestore.Client, acc *stripe.Account) error {
+	uid, err := connectAccountUser(ctx, fs, acc.ID)
+	if err != nil {
+		return fmt.Errorf("failed to find user for account %s: %w", acc.ID, err)
+	}
+	if uid == "" {
+		return nil
+	}
+	status := connectAccountStatus(acc)
+	previous, err := saveConnectStatus(ctx, fs, uid, status)
+	if err != nil {
+		return fmt.Errorf("failed to save account %s status: %w", acc.ID, err)
+	}
+	var newlyDue []string
+	for _, field := range slices.Concat(status.Requirements.PastDue, status.Requirements.CurrentlyDue) {
+		if previous == nil || !(slices.Contains(previous.CurrentlyDue, field) || slices.Contains(previous.PastDue, field)) {
+			newlyDue = append(newlyDue, field)
+		}
+	}
+	if len(newlyDue) > 0 {
+		body := "Stripe needs a few more details to keep paying you out."
+		if !status.Requirements.CurrentDeadline.IsZero() {
+			body = fmt.Sprintf("Stripe needs a few more details by %s to keep paying you out.", status.Requirements.CurrentDeadline.Format("January 2"))
+		}
+		NotifyUser(ctx, fs, uid, NotificationConnectRequirementsDue, "Action needed", body,
+			map[string]interface{}{"fields": newlyDue, "disabled_reason": status.Requirements.DisabledReason})
+	}
+	return nil
+}
+
+// GetConnectRequirements returns what the caller still has to give Stripe to
+// receive payments and payouts, so the app can ask for exactly that
+func GetConnectRequirements(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	accountID := stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id"))
+	if accountID == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No connected account; create one with POST /stripe/connect/account"})
+		return
+	}
+	status, err := sc.GetConnectAccountStatus(ctx, accountID)
+	if err != nil {
+		sc.LogAPIError(ctx, "get_connect_requirements", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to load account requirements", err))
+		return
+	}
+	if _, err := saveConnectStatus(ctx, fs, uid, status); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save account requirements"})
+		return
+	}
+	items := connectRequirementItems(status.Requirements)
+	resp := gin.H{
+		"charges_enabled": status.ChargesEnabled,
+		"payouts_enabled": status.PayoutsEnabled,
+		"requirements":    status.Requirements,
+		"items":           items,
+	}
+	if len(items) > 0 {
+		resp["action"] = gin.H{"api_hint": "POST /stripe/connect/account-link", "deep_link": "digitalpayments://onboarding/payouts"}
+	}
+	c.JSON(http.StatusOK, resp)
+}
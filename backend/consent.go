@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Consent types a user grants before the operations that rely on them
+const (
+	ConsentDataAccess        = "data_access"
+	ConsentACHDebit          = "ach_debit"
+	ConsentRecurringPayments = "recurring_payments"
+)
+
+// Consent record actions
+const (
+	ConsentGranted = "granted"
+	ConsentRevoked = "revoked"
+)
+
+// ErrConsentRequired is returned when the user has not granted the current version of a consent
+var ErrConsentRequired = errors.New("consent required")
+
+// ConsentDocument is the text a user agrees to. Changing the text requires a
+// new version, which invalidates grants of earlier versions.
+type ConsentDocument struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	Text    string `json:"text"`
+}
+
+// consentDocuments are the current consent texts by type
+var consentDocuments = map[string]ConsentDocument{
+	ConsentDataAccess: {
+		Type:    ConsentDataAccess,
+		Version: "2026-01",
+		Text:    "I authorize Digital Payments and its service provider Plaid to access my linked bank account's details, balances, and transactions to verify the account and support payments I make.",
+	},
+	ConsentACHDebit: {
+		Type:    ConsentACHDebit,
+		Version: "2026-01",
+		Text:    "I authorize Digital Payments to electronically debit my linked bank account for each payment I initiate, and to debit or credit it to correct errors. I can revoke this authorization at any time in the app.",
+	},
+	ConsentRecurringPayments: {
+		Type:    ConsentRecurringPayments,
+		Version: "2026-01",
+		Text:    "I authorize Digital Payments to debit my linked bank account on the schedule I set up for recurring payments, until I cancel the schedule or revoke this authorization.",
+	},
+}
+
+// ConsentRecord is one grant or revocation, stored append-only at
+// users/{uid}/consent_records/{id}
+type ConsentRecord struct {
+	ID        string    `json:"id" firestore:"-"`
+	Type      string    `json:"type" firestore:"type"`
+	Action    string    `json:"action" firestore:"action"`
+	Version   string    `json:"version" firestore:"version"`
+	Text      string    `json:"text" firestore:"text"`
+	IPAddress string    `json:"ip_address" firestore:"ip_address"`
+	UserAgent string    `json:"user_agent,omitempty" firestore:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// ConsentState is the latest action per type, kept at users/{uid}.consents.{type}
+type ConsentState struct {
+	Granted   bool      `json:"granted" firestore:"granted"`
+	Version   string    `json:"version" firestore:"version"`
+	UpdatedAt time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// RecordConsent appends a grant or revocation of the current consent text and updates the user's consent state
+func RecordConsent(ctx context.Context, fs *firestore.Client, uid, consentType, action, ip, userAgent string) (*ConsentRecord, error) {
+	doc, ok := consentDocuments[consentType]
+	if !ok {
+		return nil, fmt.Errorf("unknown consent type %q", consentType)
+	}
+	rec := &ConsentRecord{
+		ID:        uuid.NewString(),
+		Type:      consentType,
+		Action:    action,
+		Version:   doc.Version,
+		Text:      doc.Text,
+		IPAddress: ip,
+		UserAgent: userAgent,
+		CreatedAt: time.Now(),
+	}
+	if _, err := UserDoc(ctx, fs, uid).Collection("consent_records").Doc(rec.ID).Set(ctx, rec); err != nil {
+		return nil, fmt.Errorf("failed to record consent: %w", err)
+	}
+	state := ConsentState{Granted: action == ConsentGranted, Version: doc.Version, UpdatedAt: rec.CreatedAt}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"consents": map[string]interface{}{consentType: state},
+	}); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// consentStates reads the user's latest consent state per type
+func consentStates(ctx context.Context, fs *firestore.Client, uid string) (map[string]ConsentState, error) {
+	snap, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user %s: %w", uid, err)
+	}
+	var user struct {
+		Consents map[string]ConsentState `firestore:"consents"`
+	}
+	if err := snap.DataTo(&user); err != nil {
+		return nil, err
+	}
+	if user.Consents == nil {
+		user.Consents = map[string]ConsentState{}
+	}
+	return user.Consents, nil
+}
+
+// RequireValidConsent returns ErrConsentRequired unless the user's latest action
+// for the type granted the current version of its text
+func RequireValidConsent(ctx context.Context, fs *firestore.Client, uid, consentType string) error {
+	states, err := consentStates(ctx, fs, uid)
+	if err != nil {
+		return err
+	}
+	state, ok := states[consentType]
+	if !ok || !state.Granted || state.Version != consentDocuments[consentType].Version {
+		return fmt.Errorf("%s: %w", consentType, ErrConsentRequired)
+	}
+	return nil
+}
+
+// RequireConsent rejects requests from users without valid consent of the type,
+// returning the text they need to agree to
+func RequireConsent(consentType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, ok := c.Get("firestore")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+			return
+		}
+		err := RequireValidConsent(c.Request.Context(), v.(*firestore.Client), c.GetString("userID"), consentType)
+		if errors.Is(err, ErrConsentRequired) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":   "Consent is required for this operation",
+				"code":    "consent_required",
+				"consent": consentDocuments[consentType],
+			})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check consent"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ListConsents returns the current consent texts and the caller's state for each
+func ListConsents(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	states, err := consentStates(c.Request.Context(), fs, uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load consents"})
+		return
+	}
+	consents := make([]gin.H, 0, len(consentDocuments))
+	for _, t := range []string{ConsentDataAccess, ConsentACHDebit, ConsentRecurringPayments} {
+		doc := consentDocuments[t]
+		state, ok := states[t]
+		item := gin.H{
+			"consent": doc,
+			"valid":   ok && state.Granted && state.Version == doc.Version,
+		}
+		if ok {
+			item["state"] = state
+		}
+		consents = append(consents, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"consents": consents})
+}
+
+// GrantConsent records the caller's agreement to the current version of a consent text
+func GrantConsent(c *gin.Context) {
+	var req struct {
+		Type    string `json:"type" binding:"required"`
+		Version string `json:"version" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	doc, known := consentDocuments[req.Type]
+	if !known {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown consent type"})
+		return
+	}
+	// The user must have been shown the text being recorded
+	if req.Version != doc.Version {
+		c.JSON(http.StatusConflict, gin.H{"error": "Consent text has changed", "consent": doc})
+		return
+	}
+	recordConsentAction(c, req.Type, ConsentGranted)
+}
+
+// RevokeConsent records the caller withdrawing a consent
+func RevokeConsent(c *gin.Context) {
+	if _, known := consentDocuments[c.Param("type")]; !known {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown consent type"})
+		return
+	}
+	recordConsentAction(c, c.Param("type"), ConsentRevoked)
+}
+
+// recordConsentAction stores a grant or revocation with the caller's IP and user agent
+func recordConsentAction(c *gin.Context, consentType, action string) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	rec, err := RecordConsent(c.Request.Context(), fs, uid, consentType, action, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record consent"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"record": rec})
+}
+
+// GetConsentHistory lists every consent the caller granted or revoked, newest first
+func GetConsentHistory(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	docs, err := UserDoc(ctx, fs, uid).Collection("consent_records").
+		OrderBy("created_at", firestore.Desc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load consent history"})
+		return
+	}
+	records := make([]ConsentRecord, 0, len(docs))
+	for _, doc := range docs {
+		var rec ConsentRecord
+		if err := doc.DataTo(&rec); err != nil {
+			continue
+		}
+		rec.ID = doc.Ref.ID
+		records = append(records, rec)
+	}
+	c.JSON(http.StatusOK, gin.H{"records": records})
+}
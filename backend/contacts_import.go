@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// maxContactImportBytes bounds the size of an uploaded contacts export
+const maxContactImportBytes = 2 << 20
+
+// maxImportedContacts bounds how many contacts one import may match
+const maxImportedContacts = 5000
+
+// firestoreInLimit is the most values Firestore accepts in one "in" filter
+const firestoreInLimit = 30
+
+// ImportedContact is one parsed contact and whether it matches a registered user
+type ImportedContact struct {
+	Name       string `json:"name"`
+	Email      string `json:"email,omitempty"`
+	Phone      string `json:"phone,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+	OnPlatform bool   `json:"on_platform"`
+}
+
+// csvContactColumns maps lower-cased header names from common exports to contact fields
+var csvContactColumns = map[string]string{
+	"name":             "name",
+	"full name":        "name",
+	"display name":     "name",
+	"email":            "email",
+	"e-mail":           "email",
+	"email address":    "email",
+	"e-mail address":   "email",
+	"e-mail 1 - value": "email",
+	"phone":            "phone",
+	"phone number":     "phone",
+	"mobile":           "phone",
+	"mobile phone":     "phone",
+	"phone 1 - value":  "phone",
+}
+
+// normalizeEmail lower-cases and trims an email address
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizePhone keeps digits and a leading +, so formatting differences still match
+func normalizePhone(phone string) string {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		if (r >= '0' && r <= '9') || (r == '+' && i == 0) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parseContactsCSV reads a CSV export with a header row naming its columns
+func parseContactsCSV(r io.Reader) ([]ImportedContact, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, h := range header {
+		if field, ok := csvContactColumns[strings.ToLower(strings.TrimSpace(h))]; ok {
+			if _, seen := columns[field]; !seen {
+				columns[field] = i
+			}
+		}
+	}
+	if _, ok := columns["email"]; !ok {
+		if _, ok := columns["phone"]; !ok {
+			return nil, fmt.Errorf("CSV must have an email or phone column")
+		}
+	}
+
+	cell := func(row []string, field string) string {
+		if i, ok := columns[field]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	var contacts []ImportedContact
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV row: %w", err)
+		}
+		contacts = append(contacts, ImportedContact{
+			Name:  cell(row, "name"),
+			Email: normalizeEmail(cell(row, "email")),
+			Phone: normalizePhone(cell(row, "phone")),
+		})
+	}
+	return contacts, nil
+}
+
+// parseVCards reads FN, EMAIL, and TEL properties from a vCard export
+func parseVCards(r io.Reader) ([]ImportedContact, error) {
+	// Unfold continuation lines (RFC 6350 section 3.2) before parsing properties
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read vCard: %w", err)
+	}
+
+	var contacts []ImportedContact
+	var current *ImportedContact
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// Property names may carry parameters (EMAIL;TYPE=work) and groups (item1.EMAIL)
+		prop, _, _ := strings.Cut(strings.ToUpper(name), ";")
+		if i := strings.LastIndex(prop, "."); i >= 0 {
+			prop = prop[i+1:]
+		}
+		switch {
+		case prop == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			current = &ImportedContact{}
+		case prop == "END" && strings.EqualFold(value, "VCARD") && current != nil:
+			contacts = append(contacts, *current)
+			current = nil
+		case current == nil:
+		case prop == "FN":
+			current.Name = strings.TrimSpace(value)
+		case prop == "EMAIL" && current.Email == "":
+			current.Email = normalizeEmail(value)
+		case prop == "TEL" && current.Phone == "":
+			current.Phone = normalizePhone(strings.TrimPrefix(value, "tel:"))
+		}
+	}
+	return contacts, nil
+}
+
+// matchRegisteredUsers marks contacts whose email or phone belongs to a registered user
+func matchRegisteredUsers(ctx context.Context, fs *firestore.Client, contacts []ImportedContact, selfUID string) error {
+	byValue := map[string]map[string]string{"email_address": {}, "phone": {}}
+	var emails, phones []string
+	for _, c := range contacts {
+		if c.Email != "" {
+			emails = append(emails, c.Email)
+		}
+		if c.Phone != "" {
+			phones = append(phones, c.Phone)
+		}
+	}
+
+	for field, values := range map[string][]string{"email_address": emails, "phone": phones} {
+		for start := 0; start < len(values); start += firestoreInLimit {
+			end := min(start+firestoreInLimit, len(values))
+			docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+				return users.Where(field, "in", values[start:end])
+			})
+			if err != nil {
+				return fmt.Errorf("failed to match contacts by %s: %w", field, err)
+			}
+			for _, doc := range docs {
+				if v, _ := doc.Data()[field].(string); v != "" {
+					byValue[field][v] = doc.Ref.ID
+				}
+			}
+		}
+	}
+
+	for i := range contacts {
+		uid := byValue["email_address"][contacts[i].Email]
+		if uid == "" {
+			uid = byValue["phone"][contacts[i].Phone]
+		}
+		if uid != "" {
+			contacts[i].UserID = uid
+			contacts[i].OnPlatform = uid != selfUID
+		}
+	}
+	return nil
+}
+
+// dedupeContacts drops rows without an email or phone and repeats of the same person
+func dedupeContacts(contacts []ImportedContact) []ImportedContact {
+	seen := map[string]bool{}
+	out := make([]ImportedContact, 0, len(contacts))
+	for _, c := range contacts {
+		key := c.Email
+		if key == "" {
+			key = c.Phone
+		}
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, c)
+	}
+	return out
+}
+
+// ImportContacts parses an uploaded CSV or vCard export and splits the contacts
+// into those already on the platform and those who can be invited.
+func ImportContacts(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a CSV or vCard file in the \"file\" field"})
+		return
+	}
+	if fileHeader.Size > maxContactImportBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Contacts file is too large"})
+		return
+	}
+	f, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to read contacts file"})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxContactImportBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to read contacts file"})
+		return
+	}
+
+	var contacts []ImportedContact
+	if bytes.Contains(bytes.ToUpper(data[:min(len(data), 512)]), []byte("BEGIN:VCARD")) {
+		contacts, err = parseVCards(bytes.NewReader(data))
+	} else {
+		contacts, err = parseContactsCSV(bytes.NewReader(data))
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	contacts = dedupeContacts(contacts)
+	if len(contacts) > maxImportedContacts {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("At most %d contacts can be imported at once", maxImportedContacts)})
+		return
+	}
+
+	if err := matchRegisteredUsers(c.Request.Context(), fs, contacts, uid); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match contacts"})
+		return
+	}
+
+	onPlatform := []ImportedContact{}
+	invitable := []ImportedContact{}
+	for _, contact := range contacts {
+		if contact.UserID == uid {
+			// The caller's own card is neither a contact nor invitable
+			continue
+		}
+		if contact.OnPlatform {
+			onPlatform = append(onPlatform, contact)
+		} else {
+			invitable = append(invitable, contact)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":       len(onPlatform) + len(invitable),
+		"on_platform": onPlatform,
+		"invitable":   invitable,
+	})
+}
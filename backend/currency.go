@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCurrency is used where a user's country allows nothing else or
+// isn't known
+const DefaultCurrency = "usd"
+
+// Currency is how a currency is charged and shown. Amounts are kept in minor
+// units: cents for USD, yen for JPY.
+type Currency struct {
+	Code string `json:"code"`
+	// Exponent is the number of minor unit digits; 0 for zero-decimal
+	// currencies like JPY, which Stripe takes in whole units
+	Exponent int    `json:"exponent"`
+	Symbol   string `json:"symbol"`
+	// MinTransfer is the smallest amount that can be sent with
+	// /stripe/transfers, in minor units
+	MinTransfer int64 `json:"min_transfer"`
+	// MinPayment is the smallest P2P payment or payment request, Stripe's
+	// minimum charge
+	MinPayment int64 `json:"min_payment"`
+}
+
+// currencies are the currencies money can move in, by lowercase ISO 4217 code
+var currencies = map[string]Currency{
+	"usd": {Code: "usd", Exponent: 2, Symbol: "$", MinTransfer: 100, MinPayment: 50},
+	"cad": {Code: "cad", Exponent: 2, Symbol: "CA$", MinTransfer: 100, MinPayment: 50},
+	"eur": {Code: "eur", Exponent: 2, Symbol: "€", MinTransfer: 100, MinPayment: 50},
+	"gbp": {Code: "gbp", Exponent: 2, Symbol: "£", MinTransfer: 100, MinPayment: 30},
+	"aud": {Code: "aud", Exponent: 2, Symbol: "A$", MinTransfer: 100, MinPayment: 50},
+	"jpy": {Code: "jpy", Exponent: 0, Symbol: "¥", MinTransfer: 100, MinPayment: 50},
+}
+
+// countryCurrencies are the currencies users in each country can send, the
+// first being their default. EEA countries not listed send euros; anywhere
+// else sends DefaultCurrency.
+var countryCurrencies = map[string][]string{
+	"US": {"usd"},
+	"CA": {"cad", "usd"},
+	"GB": {"gbp", "eur"},
+	"AU": {"aud"},
+	"JP": {"jpy"},
+}
+
+// lookupCurrency returns a supported currency by code, in any case
+func lookupCurrency(code string) (Currency, bool) {
+	cur, ok := currencies[strings.ToLower(code)]
+	return cur, ok
+}
+
+// currencyOrDefault returns a supported currency, DefaultCurrency's for an
+// unknown code
+func currencyOrDefault(code string) Currency {
+	if cur, ok := lookupCurrency(code); ok {
+		return cur
+	}
+	return currencies[DefaultCurrency]
+}
+
+// ToMinor converts an app-side amount in major units to minor units
+func (cur Currency) ToMinor(amount float64) int64 {
+	return int64(math.Round(amount * math.Pow10(cur.Exponent)))
+}
+
+// FromMinor converts minor units to major units for app-facing fields
+func (cur Currency) FromMinor(amount int64) float64 {
+	return float64(amount) / math.Pow10(cur.Exponent)
+}
+
+// Format renders an amount in minor units for messages, e.g. $1.50 or ¥150
+func (cur Currency) Format(amount int64) string {
+	return cur.Symbol + cur.Decimal(amount)
+}
+
+// Decimal renders an amount in minor units in major units without a symbol,
+// e.g. 1.50 or 150
+func (cur Currency) Decimal(amount int64) string {
+	return strconv.FormatFloat(cur.FromMinor(amount), 'f', cur.Exponent, 64)
+}
+
+// allowedCurrencies returns the currencies users in a country can send, the
+// default first
+func allowedCurrencies(country string) []string {
+	country = strings.ToUpper(country)
+	if codes, ok := countryCurrencies[country]; ok {
+		return codes
+	}
+	if euCountries[country] {
+		return []string{"eur"}
+	}
+	return []string{DefaultCurrency}
+}
+
+// userCurrencies returns the currencies a user can send, from the country
+// stored on their user document
+func userCurrencies(ctx context.Context, fs *firestore.Client, uid string) []string {
+	if fs == nil {
+		return allowedCurrencies("")
+	}
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return allowedCurrencies("")
+	}
+	return allowedCurrencies(stringField(doc.Data(), "country"))
+}
+
+// validateTransferCurrency checks a /stripe/transfers transfer's currency and
+// amount; see validateSendCurrency
+func validateTransferCurrency(c *gin.Context, uid string, currency *string, amount int64) bool {
+	return validateSendCurrency(c, uid, currency, amount, func(cur Currency) int64 { return cur.MinTransfer })
+}
+
+// validatePaymentCurrency checks a P2P payment's or payment request's
+// currency and amount; see validateSendCurrency
+func validatePaymentCurrency(c *gin.Context, uid string, currency *string, amount int64) bool {
+	return validateSendCurrency(c, uid, currency, amount, func(cur Currency) int64 { return cur.MinPayment })
+}
+
+// validateSendCurrency checks that the currency is supported and allowed in
+// the sender's country and that the amount meets its minimum. An empty
+// currency becomes the sender's default; the code is normalised to lowercase.
+// It writes a 400 and returns false when the money can't be sent.
+func validateSendCurrency(c *gin.Context, uid string, currency *string, amount int64, minimum func(Currency) int64) bool {
+	var fs *firestore.Client
+	if v, ok := c.Get("firestore"); ok {
+		fs = v.(*firestore.Client)
+	}
+	allowed := userCurrencies(c.Request.Context(), fs, uid)
+	code := strings.ToLower(strings.TrimSpace(*currency))
+	if code == "" {
+		code = allowed[0]
+	}
+	cur, ok := lookupCurrency(code)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Currency %s isn't supported", strings.ToUpper(code)), "code": "unsupported_currency"})
+		return false
+	}
+	if !slices.Contains(allowed, code) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("You can't send %s from your country", strings.ToUpper(code)), "code": "currency_not_allowed", "allowed_currencies": allowed})
+		return false
+	}
+	if min := minimum(cur); amount < min {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Minimum amount is " + cur.Format(min), "code": "amount_below_minimum", "min_amount": min})
+		return false
+	}
+	*currency = code
+	return true
+}
+
+// ListCurrencies returns the currencies the caller can send, their default first
+func ListCurrencies(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var fs *firestore.Client
+	if v, ok := c.Get("firestore"); ok {
+		fs = v.(*firestore.Client)
+	}
+	list := []Currency{}
+	for _, code := range userCurrencies(c.Request.Context(), fs, uidVal.(string)) {
+		list = append(list, currencies[code])
+	}
+	c.JSON(http.StatusOK, gin.H{"currencies": list, "default": list[0].Code})
+}
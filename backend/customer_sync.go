@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of drift between a Stripe customer and the user it belongs to
+const (
+	// CustomerConflictEmail means the customer's email was changed in Stripe;
+	// the app keeps the sign-in email as the source of truth
+	CustomerConflictEmail = "email_mismatch"
+	// CustomerConflictDeleted means the customer was deleted in Stripe while a
+	// user still referenced it
+	CustomerConflictDeleted = "customer_deleted"
+	// CustomerConflictUnlinked means the customer names a user in its metadata
+	// who doesn't reference it
+	CustomerConflictUnlinked = "unlinked_customer"
+)
+
+// Customer conflict statuses and resolutions
+const (
+	CustomerConflictOpen     = "open"
+	CustomerConflictResolved = "resolved"
+
+	CustomerResolutionPushToStripe = "push_to_stripe"
+	CustomerResolutionDismiss      = "dismiss"
+)
+
+// CustomerConflict flags a Stripe-side customer change for admin review,
+// stored at customer_sync_conflicts/{eventID}_{type}. It names the fields that
+// differ but not their values, which stay in the user's residency database.
+type CustomerConflict struct {
+	ID         string    `json:"id" firestore:"-"`
+	Type       string    `json:"type" firestore:"type"`
+	UserID     string    `json:"user_id" firestore:"user_id"`
+	CustomerID string    `json:"customer_id" firestore:"customer_id"`
+	Fields     []string  `json:"fields,omitempty" firestore:"fields,omitempty"`
+	EventID    string    `json:"event_id" firestore:"event_id"`
+	Status     string    `json:"status" firestore:"status"`
+	Resolution string    `json:"resolution,omitempty" firestore:"resolution,omitempty"`
+	ResolvedBy string    `json:"resolved_by,omitempty" firestore:"resolved_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at" firestore:"created_at"`
+	ResolvedAt time.Time `json:"resolved_at,omitempty" firestore:"resolved_at,omitempty"`
+}
+
+// SyncStripeCustomer applies a customer.updated or customer.deleted event to
+// the user holding the customer. Profile details Stripe owns are copied to
+// users/{uid}.stripe_customer; anything that would overwrite app-owned data
+// is flagged as a CustomerConflict instead.
+func SyncStripeCustomer(ctx context.Context, fs *firestore.Client, event stripe.Event) error {
+	var cust stripe.Customer
+	if err := json.Unmarshal(event.Data.Raw, &cust); err != nil {
+		return fmt.Errorf("failed to decode customer: %w", err)
+	}
+	docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+		return users.Where("stripe_customer_id", "==", cust.ID).Limit(1)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find user for %s: %w", cust.ID, err)
+	}
+	if len(docs) == 0 {
+		if uid := cust.Metadata["user_id"]; uid != "" && event.Type != "customer.deleted" {
+			return flagCustomerConflict(ctx, fs, event, CustomerConflictUnlinked, uid, cust.ID, nil)
+		}
+		return nil
+	}
+	uid := docs[0].Ref.ID
+	deleted := event.Type == "customer.deleted" || cust.Deleted
+
+	// Deliveries can arrive out of order; only apply events newer than the
+	// last. UpdateUser re-checks if another delivery lands in between.
+	applied := false
+	email := ""
+	err = UpdateUser(ctx, fs, uid, func(user *firestore.DocumentSnapshot) (map[string]interface{}, error) {
+		applied = false
+		if !user.Exists() {
+			return nil, nil
+		}
+		var synced struct {
+			StripeCustomer struct {
+				EventCreated int64 `firestore:"event_created"`
+			} `firestore:"stripe_customer"`
+			Email string `firestore:"email"`
+		}
+		if err := user.DataTo(&synced); err != nil {
+			return nil, err
+		}
+		if event.Created < synced.StripeCustomer.EventCreated {
+			return nil, nil
+		}
+		applied = true
+		email = synced.Email
+		if deleted {
+			// Saved payment methods went with the customer; onboarding creates a new one
+			return map[string]interface{}{
+				"stripe_customer_id":       firestore.Delete,
+				"verified_payment_methods": firestore.Delete,
+				"stripe_customer": map[string]interface{}{
+					"deleted":       true,
+					"event_created": event.Created,
+				},
+				"updated_at": time.Now(),
+			}, nil
+		}
+		return map[string]interface{}{
+			"stripe_customer": map[string]interface{}{
+				"name":          cust.Name,
+				"phone":         cust.Phone,
+				"email":         cust.Email,
+				"event_created": event.Created,
+			},
+			"updated_at": time.Now(),
+		}, nil
+	})
+	if err != nil || !applied {
+		return err
+	}
+	if deleted {
+		return flagCustomerConflict(ctx, fs, event, CustomerConflictDeleted, uid, cust.ID, nil)
+	}
+	if cust.Email != "" && email != "" && !strings.EqualFold(cust.Email, email) {
+		return flagCustomerConflict(ctx, fs, event, CustomerConflictEmail, uid, cust.ID, []string{"email"})
+	}
+	return nil
+}
+
+// flagCustomerConflict records a conflict once per event
+func flagCustomerConflict(ctx context.Context, fs *firestore.Client, event stripe.Event, conflictType, uid, customerID string, fields []string) error {
+	conflict := CustomerConflict{
+		Type:       conflictType,
+		UserID:     uid,
+		CustomerID: customerID,
+		Fields:     fields,
+		EventID:    event.ID,
+		Status:     CustomerConflictOpen,
+		CreatedAt:  time.Now(),
+	}
+	_, err := fs.Collection("customer_sync_conflicts").Doc(event.ID+"_"+conflictType).Create(ctx, conflict)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to flag customer conflict: %w", err)
+	}
+	return nil
+}
+
+// ListCustomerConflicts returns customer conflicts by status, open by default
+func ListCustomerConflicts(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("customer_sync_conflicts").
+		Where("status", "==", c.DefaultQuery("status", CustomerConflictOpen)).
+		OrderBy("created_at", firestore.Desc).
+		Limit(100).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load conflicts"})
+		return
+	}
+	conflicts := make([]CustomerConflict, 0, len(docs))
+	for _, doc := range docs {
+		var conflict CustomerConflict
+		if err := doc.DataTo(&conflict); err != nil {
+			continue
+		}
+		conflict.ID = doc.Ref.ID
+		conflicts = append(conflicts, conflict)
+	}
+	c.JSON(http.StatusOK, gin.H{"conflicts": conflicts})
+}
+
+// ResolveCustomerConflict closes a conflict. push_to_stripe overwrites the
+// Stripe customer's email with the user's; dismiss accepts the difference.
+func ResolveCustomerConflict(c *gin.Context) {
+	var req struct {
+		Resolution string `json:"resolution" binding:"required,oneof=push_to_stripe dismiss"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := fs.Collection("customer_sync_conflicts").Doc(c.Param("id"))
+	doc, err := ref.Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conflict not found"})
+		return
+	}
+	var conflict CustomerConflict
+	if err := doc.DataTo(&conflict); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read conflict"})
+		return
+	}
+	conflict.ID = doc.Ref.ID
+	if conflict.Status != CustomerConflictOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": "Conflict is already resolved"})
+		return
+	}
+
+	if req.Resolution == CustomerResolutionPushToStripe {
+		if conflict.Type != CustomerConflictEmail {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only email conflicts can be pushed to Stripe"})
+			return
+		}
+		scVal, exists := c.Get("stripeClient")
+		if !exists {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+			return
+		}
+		sc := scVal.(*StripeClient)
+		user, err := getDocument(ctx, UserDoc(ctx, fs, conflict.UserID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+		if err := sc.UpdateCustomerEmail(ctx, conflict.CustomerID, stringField(user.Data(), "email")); err != nil {
+			sc.LogAPIError(ctx, "resolve_customer_conflict", conflict.UserID, err)
+			c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to update Stripe customer", err))
+			return
+		}
+		sc.LogAPIInteraction(ctx, "resolve_customer_conflict", conflict.UserID, true, fmt.Sprintf("Customer: %s", conflict.CustomerID))
+	}
+
+	conflict.Status = CustomerConflictResolved
+	conflict.Resolution = req.Resolution
+	conflict.ResolvedBy = c.GetString("userID")
+	conflict.ResolvedAt = time.Now()
+	if _, err := ref.Update(ctx, []firestore.Update{
+		{Path: "status", Value: conflict.Status},
+		{Path: "resolution", Value: conflict.Resolution},
+		{Path: "resolved_by", Value: conflict.ResolvedBy},
+		{Path: "resolved_at", Value: conflict.ResolvedAt},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve conflict"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conflict": conflict})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// Dependencies with a per-call deadline
+const (
+	DependencyFirestore = "firestore"
+	DependencyStripe    = "stripe"
+	DependencyPlaid     = "plaid"
+	DependencySila      = "sila"
+	// DependencyRemoteDeposit is the remote deposit capture provider
+	DependencyRemoteDeposit = "remote_deposit"
+)
+
+// MetricDependencyTimeouts counts calls cut off by their dependency's deadline
+const MetricDependencyTimeouts = "dependency_timeouts_total"
+
+// defaultDependencyDeadlines bound one call to each dependency made while
+// serving a request; DEADLINE_<DEPENDENCY> (e.g. DEADLINE_FIRESTORE=1.5s)
+// overrides them
+var defaultDependencyDeadlines = map[string]time.Duration{
+	DependencyFirestore: 800 * time.Millisecond,
+	DependencyStripe:    10 * time.Second,
+	DependencyPlaid:     5 * time.Second,
+	DependencySila:      10 * time.Second,
+	// Submitting a check has the provider fetch its images
+	DependencyRemoteDeposit: 20 * time.Second,
+}
+
+// dependencyDeadline is the per-call deadline for a dependency
+func dependencyDeadline(dependency string) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("DEADLINE_" + strings.ToUpper(dependency))); err == nil && d > 0 {
+		return d
+	}
+	return defaultDependencyDeadlines[dependency]
+}
+
+// dependencyTimeouts collects the dependencies whose deadline a request hit
+type dependencyTimeouts struct {
+	mu   sync.Mutex
+	deps []string
+}
+
+func (t *dependencyTimeouts) add(dependency string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range t.deps {
+		if d == dependency {
+			return
+		}
+	}
+	t.deps = append(t.deps, dependency)
+}
+
+func (t *dependencyTimeouts) list() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.deps...)
+}
+
+type dependencyTimeoutsContextKey struct{}
+
+// withDependencyDeadline bounds a call to dependency. Deadlines only apply
+// while serving a request, so jobs and webhook processing keep their own
+// budgets; ok is false and ctx is returned as is otherwise.
+func withDependencyDeadline(ctx context.Context, dependency string) (context.Context, context.CancelFunc, bool) {
+	if _, ok := ctx.Value(dependencyTimeoutsContextKey{}).(*dependencyTimeouts); !ok {
+		return ctx, func() {}, false
+	}
+	callCtx, cancel := context.WithTimeout(ctx, dependencyDeadline(dependency))
+	return callCtx, cancel, true
+}
+
+// noteDependencyTimeout records dependency on the request when callCtx hit
+// its deadline before the request itself was cancelled
+func noteDependencyTimeout(parent, callCtx context.Context, dependency string) {
+	if !errors.Is(callCtx.Err(), context.DeadlineExceeded) || parent.Err() != nil {
+		return
+	}
+	timeouts, ok := parent.Value(dependencyTimeoutsContextKey{}).(*dependencyTimeouts)
+	if !ok {
+		return
+	}
+	timeouts.add(dependency)
+	metrics.IncCounter(MetricDependencyTimeouts, map[string]string{"dependency": dependency})
+	slog.WarnContext(parent, "dependency call timed out", "component", "deadlines", "dependency", dependency, "deadline", dependencyDeadline(dependency).String())
+}
+
+// deadlineTransport bounds each HTTP call to a dependency. The response body
+// is read before returning so the deadline covers it too; provider API
+// responses are small.
+type deadlineTransport struct {
+	dependency string
+	base       http.RoundTripper
+}
+
+func (t *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel, ok := withDependencyDeadline(req.Context(), t.dependency)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	defer cancel()
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if err != nil {
+		noteDependencyTimeout(req.Context(), ctx, t.dependency)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// firestoreDeadlineOptions bound each Firestore RPC made while serving a
+// request. Streamed reads and queries keep their deadline until the stream
+// ends.
+func firestoreDeadlineOptions() []option.ClientOption {
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		callCtx, cancel, ok := withDependencyDeadline(ctx, DependencyFirestore)
+		defer cancel()
+		err := invoker(callCtx, method, req, reply, cc, opts...)
+		if ok && err != nil {
+			noteDependencyTimeout(ctx, callCtx, DependencyFirestore)
+		}
+		return err
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		callCtx, cancel, ok := withDependencyDeadline(ctx, DependencyFirestore)
+		if !ok {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		s, err := streamer(callCtx, desc, cc, method, opts...)
+		if err != nil {
+			noteDependencyTimeout(ctx, callCtx, DependencyFirestore)
+			cancel()
+			return nil, err
+		}
+		return &deadlineStream{ClientStream: s, parent: ctx, ctx: callCtx, cancel: cancel}, nil
+	}
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(unary)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(stream)),
+	}
+}
+
+// deadlineStream releases a streamed call's deadline once the stream ends
+type deadlineStream struct {
+	grpc.ClientStream
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *deadlineStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		if err != io.EOF {
+			noteDependencyTimeout(s.parent, s.ctx, DependencyFirestore)
+		}
+		s.cancel()
+	}
+	return err
+}
+
+// timeoutWriter replaces a 5xx response with a 504 naming the dependency
+// that timed out, so the app can tell a slow dependency from a failure
+type timeoutWriter struct {
+	gin.ResponseWriter
+	timeouts *dependencyTimeouts
+	replaced bool
+}
+
+func (w *timeoutWriter) replace() bool {
+	if w.replaced {
+		return true
+	}
+	deps := w.timeouts.list()
+	if len(deps) == 0 || w.Status() < http.StatusInternalServerError || w.Written() {
+		return false
+	}
+	w.replaced = true
+	body, _ := json.Marshal(gin.H{
+		"error":        "A service this request depends on took too long to respond. Some of the request may have completed; check its status before retrying.",
+		"code":         "PARTIAL_TIMEOUT",
+		"dependency":   deps[0],
+		"dependencies": deps,
+	})
+	w.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+	w.ResponseWriter.Write(body)
+	return true
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if w.replace() {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) WriteString(s string) (int, error) {
+	if w.replace() {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// DependencyDeadlineMiddleware applies per-dependency deadlines to the calls
+// a request makes, and turns the error response of a request that hit one
+// into a 504 with code PARTIAL_TIMEOUT and the dependency, instead of leaving
+// the app waiting on a hung call.
+func DependencyDeadlineMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeouts := &dependencyTimeouts{}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), dependencyTimeoutsContextKey{}, timeouts))
+		c.Writer = &timeoutWriter{ResponseWriter: c.Writer, timeouts: timeouts}
+		c.Next()
+	}
+}
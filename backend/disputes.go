@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// disputeReminderWindow is how far ahead of the due date reminders start
+const disputeReminderWindow = 72 * time.Hour
+
+// disputeReminderInterval is the minimum gap between reminders for the same dispute
+const disputeReminderInterval = 24 * time.Hour
+
+// disputeEvidenceFiles maps multipart file fields to the Stripe evidence field they populate
+var disputeEvidenceFiles = map[string]func(*stripe.DisputeEvidenceParams, *string){
+	"receipt":                func(p *stripe.DisputeEvidenceParams, id *string) { p.Receipt = id },
+	"customer_communication": func(p *stripe.DisputeEvidenceParams, id *string) { p.CustomerCommunication = id },
+	"service_documentation":  func(p *stripe.DisputeEvidenceParams, id *string) { p.ServiceDocumentation = id },
+	"shipping_documentation": func(p *stripe.DisputeEvidenceParams, id *string) { p.ShippingDocumentation = id },
+	"uncategorized_file":     func(p *stripe.DisputeEvidenceParams, id *string) { p.UncategorizedFile = id },
+}
+
+// disputeEvidenceText maps multipart text fields to Stripe evidence fields
+var disputeEvidenceText = map[string]func(*stripe.DisputeEvidenceParams, *string){
+	"product_description":      func(p *stripe.DisputeEvidenceParams, v *string) { p.ProductDescription = v },
+	"service_date":             func(p *stripe.DisputeEvidenceParams, v *string) { p.ServiceDate = v },
+	"shipping_carrier":         func(p *stripe.DisputeEvidenceParams, v *string) { p.ShippingCarrier = v },
+	"shipping_tracking_number": func(p *stripe.DisputeEvidenceParams, v *string) { p.ShippingTrackingNumber = v },
+	"uncategorized_text":       func(p *stripe.DisputeEvidenceParams, v *string) { p.UncategorizedText = v },
+}
+
+// RecordDispute mirrors a Stripe dispute into disputes/{id}, linking it to the
+// transaction's participants and notifying the recipient when it first opens.
+func RecordDispute(ctx context.Context, fs *firestore.Client, d *stripe.Dispute) error {
+	ref := fs.Collection("disputes").Doc(d.ID)
+	existing, _ := ref.Get(ctx)
+	isNew := existing == nil || !existing.Exists()
+
+	data := map[string]interface{}{
+		"dispute_id": d.ID,
+		"amount":     d.Amount,
+		"currency":   string(d.Currency),
+		"reason":     string(d.Reason),
+		"status":     string(d.Status),
+		"updated_at": time.Now(),
+	}
+	if d.EvidenceDetails != nil && d.EvidenceDetails.DueBy > 0 {
+		data["due_by"] = time.Unix(d.EvidenceDetails.DueBy, 0)
+	}
+
+	var recipientUID string
+	if d.PaymentIntent != nil && d.PaymentIntent.ID != "" {
+		data["payment_intent_id"] = d.PaymentIntent.ID
+		if txDoc, err := fs.Collection("transactions").Doc(d.PaymentIntent.ID).Get(ctx); err == nil {
+			var rec TransactionRecord
+			if err := txDoc.DataTo(&rec); err == nil {
+				recipientUID = rec.RecipientUserID
+				data["recipient_user_id"] = rec.RecipientUserID
+				data["sender_user_id"] = rec.SenderUserID
+				if rec.ACHAuthorizationID != "" {
+					data["ach_authorization_id"] = rec.ACHAuthorizationID
+				}
+			}
+		}
+	}
+	if isNew {
+		data["evidence_status"] = "pending"
+		data["created_at"] = time.Now()
+	}
+
+	if _, err := ref.Set(ctx, data, firestore.MergeAll); err != nil {
+		return fmt.Errorf("failed to record dispute %s: %w", d.ID, err)
+	}
+
+	if isNew && recipientUID != "" {
+		NotifyUser(ctx, fs, recipientUID, NotificationDisputeOpened, "A payment you received was disputed",
+			"Submit receipts or other proof before the due date to contest it.",
+			map[string]interface{}{"dispute_id": d.ID})
+	}
+	return nil
+}
+
+// SendDisputeEvidenceReminders nudges recipients whose evidence is due soon
+func SendDisputeEvidenceReminders(ctx context.Context, fs *firestore.Client) error {
+	now := time.Now()
+	docs, err := fs.Collection("disputes").
+		Where("evidence_status", "==", "pending").
+		Where("due_by", ">", now).
+		Where("due_by", "<=", now.Add(disputeReminderWindow)).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to query disputes: %w", err)
+	}
+
+	for _, doc := range docs {
+		data := doc.Data()
+		recipientUID, _ := data["recipient_user_id"].(string)
+		if recipientUID == "" {
+			continue
+		}
+		if last, ok := data["last_reminder_at"].(time.Time); ok && now.Sub(last) < disputeReminderInterval {
+			continue
+		}
+		dueBy, _ := data["due_by"].(time.Time)
+
+		NotifyUser(ctx, fs, recipientUID, NotificationDisputeEvidenceDue, "Dispute evidence due soon",
+			fmt.Sprintf("Evidence for a disputed payment is due %s.", dueBy.UTC().Format("Jan 2 15:04 MST")),
+			map[string]interface{}{"dispute_id": doc.Ref.ID})
+		_, _ = doc.Ref.Set(ctx, map[string]interface{}{"last_reminder_at": now}, firestore.MergeAll)
+	}
+	return nil
+}
+
+// SubmitDisputeEvidence uploads evidence files and text to Stripe for a dispute
+func SubmitDisputeEvidence(c *gin.Context) {
+	disputeID := c.Param("id")
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	stripeClient, exists := c.Get("stripeClient")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+		return
+	}
+	sc := stripeClient.(*StripeClient)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	ctx := c.Request.Context()
+	ref := fs.Collection("disputes").Doc(disputeID)
+	doc, err := ref.Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dispute not found"})
+		return
+	}
+	data := doc.Data()
+	if recipient, _ := data["recipient_user_id"].(string); recipient != uid && !c.GetBool("isAdmin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the payment recipient can submit evidence"})
+		return
+	}
+	if dueBy, ok := data["due_by"].(time.Time); ok && time.Now().After(dueBy) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The evidence due date has passed"})
+		return
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected multipart form data"})
+		return
+	}
+
+	evidence := &stripe.DisputeEvidenceParams{}
+	uploaded := map[string]string{}
+	for field, apply := range disputeEvidenceFiles {
+		headers := form.File[field]
+		if len(headers) == 0 {
+			continue
+		}
+		f, err := headers[0].Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unable to read %s", field)})
+			return
+		}
+		fileID, err := sc.UploadDisputeEvidenceFile(ctx, headers[0].Filename, f)
+		f.Close()
+		if err != nil {
+			sc.LogAPIError(ctx, "upload_dispute_evidence", uid, err)
+			c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to upload evidence", err))
+			return
+		}
+		apply(evidence, stripe.String(fileID))
+		uploaded[field] = fileID
+	}
+	textFields := 0
+	for field, apply := range disputeEvidenceText {
+		if values := form.Value[field]; len(values) > 0 && values[0] != "" {
+			apply(evidence, stripe.String(values[0]))
+			textFields++
+		}
+	}
+	if len(uploaded) == 0 && textFields == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No evidence provided"})
+		return
+	}
+	// A disputed bank debit is contested with the sender's authorization
+	if authID, _ := data["ach_authorization_id"].(string); authID != "" && evidence.UncategorizedText == nil {
+		if auth, err := loadACHAuthorization(ctx, fs, authID); err == nil {
+			evidence.UncategorizedText = stripe.String(achAuthorizationEvidence(auth))
+		}
+	}
+
+	// Evidence is submitted to the bank immediately unless the caller asks to stage it
+	submit := c.PostForm("submit") != "false"
+	d, err := sc.SubmitDisputeEvidence(ctx, disputeID, evidence, submit)
+	if err != nil {
+		sc.LogAPIError(ctx, "submit_dispute_evidence", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to submit evidence", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "submit_dispute_evidence", uid, true, fmt.Sprintf("Dispute: %s", d.ID))
+
+	evidenceStatus := "staged"
+	update := map[string]interface{}{
+		"status":         string(d.Status),
+		"evidence_files": uploaded,
+		"updated_at":     time.Now(),
+	}
+	if submit {
+		evidenceStatus = "submitted"
+		update["submitted_at"] = time.Now()
+		update["submitted_by"] = uid
+	}
+	update["evidence_status"] = evidenceStatus
+	_, _ = ref.Set(ctx, update, firestore.MergeAll)
+
+	c.JSON(http.StatusOK, gin.H{
+		"dispute_id":      d.ID,
+		"status":          d.Status,
+		"evidence_status": evidenceStatus,
+		"evidence_files":  uploaded,
+	})
+}
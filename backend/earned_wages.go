@@ -0,0 +1,824 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Earned wage access lets employees of a business draw part of the pay they
+// have accrued this period before payday. An advance moves money from the
+// business's wallet to the employee's; the business's next payroll run
+// withholds it from the employee's pay, so only the rest moves then. Both
+// wallets must be Stripe-backed, since the platform holds those balances and
+// can move them between users itself.
+
+// Pay frequencies
+const (
+	PayWeekly   = "weekly"
+	PayBiweekly = "biweekly"
+	PayMonthly  = "monthly"
+)
+
+// Employment statuses
+const (
+	EmploymentActive = "active"
+	EmploymentEnded  = "ended"
+)
+
+// Wage advance statuses
+const (
+	WageAdvanceOutstanding = "outstanding"
+	WageAdvanceRepaid      = "repaid"
+)
+
+// Payroll statuses: a run is partial when some employees couldn't be paid
+const (
+	PayrollPaid      = "paid"
+	PayrollFailed    = "failed"
+	PayrollCompleted = "completed"
+	PayrollPartial   = "partial"
+)
+
+// Wallet entries for advances and payroll. They move money between two
+// users' wallets, so they post through LedgerAccountWalletClearing.
+const (
+	walletSourceEarnedWages       = "earned_wages"
+	walletEntryWageAdvance        = "wage_advance"
+	walletEntryWageAdvanceFunding = "wage_advance_funding"
+	walletEntryPayroll            = "payroll"
+	walletEntryPayrollFunding     = "payroll_funding"
+)
+
+// Ledger kinds for earned wage access
+const (
+	LedgerWageAdvance          = "wage_advance"
+	LedgerWageAdvanceRepayment = "wage_advance_repayment"
+)
+
+const (
+	NotificationWageAdvance = "wage_advance"
+	NotificationPayrollPaid = "payroll_paid"
+)
+
+const (
+	// defaultEWAMaxPercent is EWA_MAX_PERCENT's default: the share of accrued
+	// pay an employee may draw
+	defaultEWAMaxPercent = 50
+	// maxPayrollItems bounds a run, which is paid within the request
+	maxPayrollItems = 200
+)
+
+var (
+	errEmploymentInactive = errors.New("employment is not active")
+	errAdvanceLimit       = errors.New("advance exceeds available earned wages")
+	errAdvanceOutstanding = errors.New("advances outstanding")
+)
+
+// LedgerAccountWageAdvances is what an employee has drawn and not yet had
+// withheld from payroll
+func LedgerAccountWageAdvances(uid string) string {
+	return "user:" + uid + ":wage_advances"
+}
+
+// LedgerAccountWageAdvanceFunding is what a business has advanced its
+// employees; it is the counter account of their LedgerAccountWageAdvances
+func LedgerAccountWageAdvanceFunding(uid string) string {
+	return "user:" + uid + ":wage_advance_funding"
+}
+
+// WageAdvanceLedgerTransaction records an advance as owed back from the
+// employee's pay
+func WageAdvanceLedgerTransaction(advanceID, employerUID, employeeUID string, amount int64) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "wage_advance_" + advanceID,
+		Kind:      LedgerWageAdvance,
+		Reference: advanceID,
+		Currency:  walletCurrency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountWageAdvances(employeeUID), Direction: Debit, Amount: amount},
+			{Account: LedgerAccountWageAdvanceFunding(employerUID), Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// WageAdvanceRepaymentLedgerTransaction records advances withheld from an
+// employee's pay in a payroll run
+func WageAdvanceRepaymentLedgerTransaction(runID, employerUID, employeeUID string, amount int64) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "wage_advance_repayment_" + runID + "_" + employeeUID,
+		Kind:      LedgerWageAdvanceRepayment,
+		Reference: runID,
+		Currency:  walletCurrency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountWageAdvanceFunding(employerUID), Direction: Debit, Amount: amount},
+			{Account: LedgerAccountWageAdvances(employeeUID), Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// Employment is an employee a business pays through the platform, stored at
+// employments/{employerUID}_{employeeUID}
+type Employment struct {
+	ID             string `json:"id" firestore:"-"`
+	EmployerUserID string `json:"employer_user_id" firestore:"employer_user_id"`
+	EmployeeUserID string `json:"employee_user_id" firestore:"employee_user_id"`
+	Status         string `json:"status" firestore:"status"`
+	PayFrequency   string `json:"pay_frequency" firestore:"pay_frequency"`
+	// PeriodNetPay is what the employee is expected to be paid each period, cents
+	PeriodNetPay int64     `json:"period_net_pay" firestore:"period_net_pay"`
+	NextPayday   time.Time `json:"next_payday" firestore:"next_payday"`
+	// AdvanceOutstanding is drawn and not yet withheld from payroll
+	AdvanceOutstanding int64      `json:"advance_outstanding" firestore:"advance_outstanding"`
+	CreatedAt          time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at" firestore:"updated_at"`
+	EndedAt            *time.Time `json:"ended_at,omitempty" firestore:"ended_at,omitempty"`
+}
+
+// employmentID is the document ID for an employer and employee
+func employmentID(employerUID, employeeUID string) string {
+	return employerUID + "_" + employeeUID
+}
+
+// payPeriodStart is when the pay period ending on payday began
+func payPeriodStart(frequency string, payday time.Time) time.Time {
+	switch frequency {
+	case PayWeekly:
+		return payday.AddDate(0, 0, -7)
+	case PayBiweekly:
+		return payday.AddDate(0, 0, -14)
+	}
+	return payday.AddDate(0, -1, 0)
+}
+
+// followingPayday is the first payday after now in the schedule through payday
+func followingPayday(frequency string, payday, now time.Time) time.Time {
+	for !payday.After(now) {
+		switch frequency {
+		case PayWeekly:
+			payday = payday.AddDate(0, 0, 7)
+		case PayBiweekly:
+			payday = payday.AddDate(0, 0, 14)
+		default:
+			payday = payday.AddDate(0, 1, 0)
+		}
+	}
+	return payday
+}
+
+// Accrued is the pay earned so far this period, in proportion to how much
+// of it has passed; all of it once payday is reached
+func (e *Employment) Accrued(now time.Time) int64 {
+	start := payPeriodStart(e.PayFrequency, e.NextPayday)
+	switch {
+	case !now.After(start):
+		return 0
+	case !now.Before(e.NextPayday):
+		return e.PeriodNetPay
+	}
+	return int64(float64(e.PeriodNetPay) * float64(now.Sub(start)) / float64(e.NextPayday.Sub(start)))
+}
+
+// AdvanceAvailable is what the employee may draw now
+func (e *Employment) AdvanceAvailable(now time.Time) int64 {
+	return max(e.Accrued(now)*ewaMaxPercent()/100-e.AdvanceOutstanding, 0)
+}
+
+// ewaMaxPercent is the share of accrued pay that may be drawn, from EWA_MAX_PERCENT
+func ewaMaxPercent() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("EWA_MAX_PERCENT"), 10, 64); err == nil && n > 0 && n <= 100 {
+		return n
+	}
+	return defaultEWAMaxPercent
+}
+
+// employmentView is an employment with what has accrued and may be drawn
+func employmentView(e *Employment, now time.Time) gin.H {
+	return gin.H{
+		"employment":        e,
+		"accrued":           e.Accrued(now),
+		"advance_available": e.AdvanceAvailable(now),
+		"max_percent":       ewaMaxPercent(),
+	}
+}
+
+// WageAdvance is an early draw of earned pay, stored at wage_advances/{id}
+type WageAdvance struct {
+	ID             string     `json:"id" firestore:"-"`
+	EmploymentID   string     `json:"employment_id" firestore:"employment_id"`
+	EmployerUserID string     `json:"employer_user_id" firestore:"employer_user_id"`
+	EmployeeUserID string     `json:"employee_user_id" firestore:"employee_user_id"`
+	Amount         int64      `json:"amount" firestore:"amount"`
+	RepaidAmount   int64      `json:"repaid_amount" firestore:"repaid_amount"`
+	Status         string     `json:"status" firestore:"status"`
+	Payday         time.Time  `json:"payday" firestore:"payday"` // the payday it is due to be withheld on
+	PayrollRunIDs  []string   `json:"payroll_run_ids,omitempty" firestore:"payroll_run_ids,omitempty"`
+	CreatedAt      time.Time  `json:"created_at" firestore:"created_at"`
+	RepaidAt       *time.Time `json:"repaid_at,omitempty" firestore:"repaid_at,omitempty"`
+}
+
+// PayrollItem is one employee's pay in a run
+type PayrollItem struct {
+	EmployeeUserID string `json:"employee_user_id" firestore:"employee_user_id"`
+	Amount         int64  `json:"amount" firestore:"amount"`
+	AdvanceRepaid  int64  `json:"advance_repaid" firestore:"advance_repaid"`
+	Net            int64  `json:"net" firestore:"net"` // what moved: Amount less AdvanceRepaid
+	Status         string `json:"status" firestore:"status"`
+	Error          string `json:"error,omitempty" firestore:"error,omitempty"`
+}
+
+// PayrollRun is a business paying its employees, stored at payroll_runs/{id}
+type PayrollRun struct {
+	ID             string        `json:"id" firestore:"-"`
+	EmployerUserID string        `json:"employer_user_id" firestore:"employer_user_id"`
+	Status         string        `json:"status" firestore:"status"`
+	Items          []PayrollItem `json:"items" firestore:"items"`
+	TotalAmount    int64         `json:"total_amount" firestore:"total_amount"`
+	TotalRepaid    int64         `json:"total_repaid" firestore:"total_repaid"`
+	TotalNet       int64         `json:"total_net" firestore:"total_net"`
+	CreatedAt      time.Time     `json:"created_at" firestore:"created_at"`
+}
+
+// getWalletTx reads a user's wallet in a transaction; a user who has never
+// held funds gets an empty one
+func getWalletTx(tx *firestore.Transaction, fs *firestore.Client, uid string) (*Wallet, error) {
+	wallet := &Wallet{UserID: uid, Currency: walletCurrency}
+	snap, err := tx.Get(fs.Collection("wallets").Doc(uid))
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	if snap != nil && snap.Exists() {
+		if err := snap.DataTo(wallet); err != nil {
+			return nil, err
+		}
+	}
+	return wallet, nil
+}
+
+// applyWalletEntryTx moves a wallet read with getWalletTx by entry and
+// writes both, like ApplyWalletEntry within a larger transaction
+func applyWalletEntryTx(tx *firestore.Transaction, fs *firestore.Client, wallet *Wallet, entry *WalletEntry, now time.Time) error {
+	wallet.Balance += entry.Amount
+	wallet.UpdatedAt = now
+	entry.BalanceAfter = wallet.Balance
+	entry.CreatedAt = now
+	if err := tx.Create(fs.Collection("wallet_entries").Doc(entry.Reference), entry); err != nil {
+		return err
+	}
+	return tx.Set(fs.Collection("wallets").Doc(entry.UserID), wallet)
+}
+
+// drawWageAdvance moves amount from the employer's wallet to the employee's
+// and records it against their employment, in one transaction. The employer
+// can't go into overdraft to fund it.
+func drawWageAdvance(ctx context.Context, fs *firestore.Client, employerUID, employeeUID string, amount int64) (*WageAdvance, []*WalletEntry, error) {
+	employmentRef := fs.Collection("employments").Doc(employmentID(employerUID, employeeUID))
+	advanceRef := fs.Collection("wage_advances").NewDoc()
+	var advance *WageAdvance
+	var entries []*WalletEntry
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(employmentRef)
+		if err != nil {
+			return err
+		}
+		var e Employment
+		if err := snap.DataTo(&e); err != nil {
+			return err
+		}
+		if e.Status != EmploymentActive {
+			return errEmploymentInactive
+		}
+		now := time.Now()
+		if amount > e.AdvanceAvailable(now) {
+			return errAdvanceLimit
+		}
+		employer, err := getWalletTx(tx, fs, employerUID)
+		if err != nil {
+			return err
+		}
+		employee, err := getWalletTx(tx, fs, employeeUID)
+		if err != nil {
+			return err
+		}
+		if employer.Balance-employer.Held < amount {
+			return ErrInsufficientFunds
+		}
+
+		advance = &WageAdvance{
+			ID:             advanceRef.ID,
+			EmploymentID:   snap.Ref.ID,
+			EmployerUserID: employerUID,
+			EmployeeUserID: employeeUID,
+			Amount:         amount,
+			Status:         WageAdvanceOutstanding,
+			Payday:         e.NextPayday,
+			CreatedAt:      now,
+		}
+		entries = []*WalletEntry{
+			{UserID: employerUID, Reference: "ewa_" + advanceRef.ID + "_funding", Source: walletSourceEarnedWages, Type: walletEntryWageAdvanceFunding, Amount: -amount},
+			{UserID: employeeUID, Reference: "ewa_" + advanceRef.ID, Source: walletSourceEarnedWages, Type: walletEntryWageAdvance, Amount: amount},
+		}
+		if err := applyWalletEntryTx(tx, fs, employer, entries[0], now); err != nil {
+			return err
+		}
+		if err := applyWalletEntryTx(tx, fs, employee, entries[1], now); err != nil {
+			return err
+		}
+		if err := tx.Create(advanceRef, advance); err != nil {
+			return err
+		}
+		return tx.Update(employmentRef, []firestore.Update{
+			{Path: "advance_outstanding", Value: firestore.Increment(amount)},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return advance, entries, nil
+}
+
+// payEmployee pays one employee in a payroll run, in one transaction:
+// outstanding advances are withheld from item.Amount oldest first, the rest
+// moves from the employer's wallet to the employee's, and the employment
+// moves on to its next payday. It fills in item and returns the wallet
+// entries it applied.
+func payEmployee(ctx context.Context, fs *firestore.Client, runID, employerUID string, item *PayrollItem) ([]*WalletEntry, error) {
+	employmentRef := fs.Collection("employments").Doc(employmentID(employerUID, item.EmployeeUserID))
+	var entries []*WalletEntry
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		entries = nil
+		snap, err := tx.Get(employmentRef)
+		if err != nil {
+			return err
+		}
+		var e Employment
+		if err := snap.DataTo(&e); err != nil {
+			return err
+		}
+		if e.Status != EmploymentActive {
+			return errEmploymentInactive
+		}
+		advances, err := tx.Documents(fs.Collection("wage_advances").
+			Where("employment_id", "==", snap.Ref.ID).
+			Where("status", "==", WageAdvanceOutstanding).
+			OrderBy("created_at", firestore.Asc)).GetAll()
+		if err != nil {
+			return err
+		}
+		repaid := min(e.AdvanceOutstanding, item.Amount)
+		net := item.Amount - repaid
+		var employer, employee *Wallet
+		if net > 0 {
+			if employer, err = getWalletTx(tx, fs, employerUID); err != nil {
+				return err
+			}
+			if employee, err = getWalletTx(tx, fs, item.EmployeeUserID); err != nil {
+				return err
+			}
+			if employer.Balance-employer.Held < net {
+				return ErrInsufficientFunds
+			}
+		}
+
+		now := time.Now()
+		if net > 0 {
+			ref := "payroll_" + runID + "_" + item.EmployeeUserID
+			entries = []*WalletEntry{
+				{UserID: employerUID, Reference: ref + "_funding", Source: walletSourceEarnedWages, Type: walletEntryPayrollFunding, Amount: -net},
+				{UserID: item.EmployeeUserID, Reference: ref, Source: walletSourceEarnedWages, Type: walletEntryPayroll, Amount: net},
+			}
+			if err := applyWalletEntryTx(tx, fs, employer, entries[0], now); err != nil {
+				return err
+			}
+			if err := applyWalletEntryTx(tx, fs, employee, entries[1], now); err != nil {
+				return err
+			}
+		}
+		left := repaid
+		for _, doc := range advances {
+			if left == 0 {
+				break
+			}
+			var a WageAdvance
+			if err := doc.DataTo(&a); err != nil {
+				return err
+			}
+			take := min(a.Amount-a.RepaidAmount, left)
+			left -= take
+			updates := []firestore.Update{
+				{Path: "repaid_amount", Value: a.RepaidAmount + take},
+				{Path: "payroll_run_ids", Value: firestore.ArrayUnion(runID)},
+			}
+			if a.RepaidAmount+take == a.Amount {
+				updates = append(updates,
+					firestore.Update{Path: "status", Value: WageAdvanceRepaid},
+					firestore.Update{Path: "repaid_at", Value: now})
+			}
+			if err := tx.Update(doc.Ref, updates); err != nil {
+				return err
+			}
+		}
+		item.AdvanceRepaid, item.Net = repaid, net
+		return tx.Update(employmentRef, []firestore.Update{
+			{Path: "advance_outstanding", Value: e.AdvanceOutstanding - repaid},
+			{Path: "next_payday", Value: followingPayday(e.PayFrequency, e.NextPayday, now)},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	return entries, err
+}
+
+// postRequestLedger posts txn to the request's ledger, if there is one
+func postRequestLedger(c *gin.Context, txn *LedgerTransaction) {
+	v, ok := c.Get("ledger")
+	if !ok {
+		return
+	}
+	if _, err := v.(LedgerStore).Post(c.Request.Context(), txn); err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to post ledger transaction", "component", "earned_wages", "ledger_transaction", txn.ID, "error", err)
+	}
+}
+
+// requireEmployer loads the caller's profile and responds 403 unless they
+// are a business with a Stripe-backed wallet
+func requireEmployer(c *gin.Context, fs *firestore.Client, uid string) bool {
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return false
+	}
+	if provider, _ := doc.Data()["service_provider"].(bool); !provider {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only business accounts can run payroll"})
+		return false
+	}
+	if _, err := walletHandleForUser(ctx, fs, uid, ProcessorStripe); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payroll is paid from a Stripe-backed wallet", "code": "wallet_unsupported"})
+		return false
+	}
+	return true
+}
+
+// UpsertEmployee adds an employee to the caller's payroll, or changes their
+// pay schedule. The employee needs a Stripe-backed wallet.
+func UpsertEmployee(c *gin.Context) {
+	var req struct {
+		EmployeeUserID string `json:"employee_user_id" binding:"required"`
+		PayFrequency   string `json:"pay_frequency" binding:"required,oneof=weekly biweekly monthly"`
+		PeriodNetPay   int64  `json:"period_net_pay" binding:"required,min=100"`
+		NextPayday     string `json:"next_payday" binding:"required"` // YYYY-MM-DD, UTC
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if req.EmployeeUserID == uid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't employ yourself"})
+		return
+	}
+	payday, err := time.Parse("2006-01-02", req.NextPayday)
+	if err != nil || !payday.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "next_payday must be a future date (YYYY-MM-DD)"})
+		return
+	}
+	if !requireEmployer(c, fs, uid) {
+		return
+	}
+	if _, err := walletHandleForUser(ctx, fs, req.EmployeeUserID, ProcessorStripe); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Employee must have a Stripe-backed wallet", "code": "wallet_unsupported"})
+		return
+	}
+
+	ref := fs.Collection("employments").Doc(employmentID(uid, req.EmployeeUserID))
+	var e Employment
+	created := false
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now()
+		e = Employment{EmployerUserID: uid, EmployeeUserID: req.EmployeeUserID, CreatedAt: now}
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		created = snap == nil || !snap.Exists()
+		if !created {
+			if err := snap.DataTo(&e); err != nil {
+				return err
+			}
+		}
+		e.Status, e.EndedAt = EmploymentActive, nil
+		e.PayFrequency, e.PeriodNetPay, e.NextPayday, e.UpdatedAt = req.PayFrequency, req.PeriodNetPay, payday, now
+		return tx.Set(ref, e)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save employee"})
+		return
+	}
+	e.ID = ref.ID
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	c.JSON(code, employmentView(&e, time.Now()))
+}
+
+// ListEmployees returns the caller's employees with their outstanding advances
+func ListEmployees(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("employments").
+		Where("employer_user_id", "==", uid).
+		Where("status", "==", EmploymentActive).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load employees"})
+		return
+	}
+	now := time.Now()
+	employees := make([]gin.H, 0, len(docs))
+	for _, doc := range docs {
+		var e Employment
+		if err := doc.DataTo(&e); err != nil {
+			continue
+		}
+		e.ID = doc.Ref.ID
+		employees = append(employees, employmentView(&e, now))
+	}
+	c.JSON(http.StatusOK, gin.H{"employees": employees})
+}
+
+// RemoveEmployee takes an employee off the caller's payroll. One with
+// advances still outstanding stays on until a payroll run withholds them.
+func RemoveEmployee(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ref := fs.Collection("employments").Doc(employmentID(uid, c.Param("uid")))
+	err := fs.RunTransaction(c.Request.Context(), func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var e Employment
+		if err := snap.DataTo(&e); err != nil {
+			return err
+		}
+		if e.Status != EmploymentActive {
+			return errEmploymentInactive
+		}
+		if e.AdvanceOutstanding > 0 {
+			return errAdvanceOutstanding
+		}
+		now := time.Now()
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: EmploymentEnded},
+			{Path: "ended_at", Value: now},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	switch {
+	case status.Code(err) == codes.NotFound, errors.Is(err, errEmploymentInactive):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Employee not found"})
+	case errors.Is(err, errAdvanceOutstanding):
+		c.JSON(http.StatusConflict, gin.H{"error": "This employee has advances to withhold in a payroll run first", "code": "advance_outstanding"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove employee"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"removed": true})
+	}
+}
+
+// RunPayroll pays the caller's employees from their wallet. Each employee's
+// outstanding advances are withheld from their pay first. Employees are
+// paid one at a time, and one who can't be paid doesn't stop the rest; the
+// run is then partial.
+func RunPayroll(c *gin.Context) {
+	var req struct {
+		Items []struct {
+			EmployeeUserID string `json:"employee_user_id" binding:"required"`
+			Amount         int64  `json:"amount" binding:"required,min=1"`
+		} `json:"items" binding:"required,min=1,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if len(req.Items) > maxPayrollItems {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A payroll run can pay at most %d employees", maxPayrollItems)})
+		return
+	}
+	seen := map[string]bool{}
+	for _, item := range req.Items {
+		if seen[item.EmployeeUserID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Each employee can be paid once per run", "employee_user_id": item.EmployeeUserID})
+			return
+		}
+		seen[item.EmployeeUserID] = true
+	}
+	if !requireEmployer(c, fs, uid) {
+		return
+	}
+
+	run := PayrollRun{ID: uuid.NewString(), EmployerUserID: uid, Status: PayrollCompleted, CreatedAt: time.Now()}
+	for _, r := range req.Items {
+		item := PayrollItem{EmployeeUserID: r.EmployeeUserID, Amount: r.Amount, Status: PayrollPaid}
+		entries, err := payEmployee(ctx, fs, run.ID, uid, &item)
+		if err != nil {
+			item.Status, run.Status = PayrollFailed, PayrollPartial
+			switch {
+			case status.Code(err) == codes.NotFound, errors.Is(err, errEmploymentInactive):
+				item.Error = "not_employed"
+			case errors.Is(err, ErrInsufficientFunds):
+				item.Error = "insufficient_funds"
+			default:
+				item.Error = "failed"
+				slog.ErrorContext(ctx, "failed to pay employee", "component", "earned_wages", "payroll_run", run.ID, "employee_user_id", item.EmployeeUserID, "error", err)
+			}
+			run.Items = append(run.Items, item)
+			continue
+		}
+		for _, entry := range entries {
+			recordWalletMovement(c, fs, entry)
+		}
+		if item.AdvanceRepaid > 0 {
+			postRequestLedger(c, WageAdvanceRepaymentLedgerTransaction(run.ID, uid, item.EmployeeUserID, item.AdvanceRepaid))
+		}
+		cur := currencyOrDefault(walletCurrency)
+		body := fmt.Sprintf("%s of pay was added to your wallet", cur.Format(item.Net))
+		if item.AdvanceRepaid > 0 {
+			body = fmt.Sprintf("%s of pay was added to your wallet after %s you drew early", cur.Format(item.Net), cur.Format(item.AdvanceRepaid))
+		}
+		NotifyUser(ctx, fs, item.EmployeeUserID, NotificationPayrollPaid, "Payday", body,
+			map[string]interface{}{"payroll_run_id": run.ID, "employer_user_id": uid})
+		run.TotalAmount += item.Amount
+		run.TotalRepaid += item.AdvanceRepaid
+		run.TotalNet += item.Net
+		run.Items = append(run.Items, item)
+	}
+	if _, err := fs.Collection("payroll_runs").Doc(run.ID).Set(ctx, run); err != nil {
+		// Employees were paid; the run record is what's missing
+		slog.ErrorContext(ctx, "failed to save payroll run", "component", "earned_wages", "payroll_run", run.ID, "error", err)
+	}
+	slog.InfoContext(ctx, "payroll run", "component", "earned_wages", "payroll_run", run.ID, "status", run.Status,
+		"total_amount", run.TotalAmount, "total_repaid", run.TotalRepaid)
+	c.JSON(http.StatusCreated, run)
+}
+
+// ListPayrollRuns returns the caller's recent payroll runs, newest first
+func ListPayrollRuns(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("payroll_runs").
+		Where("employer_user_id", "==", uid).
+		OrderBy("created_at", firestore.Desc).
+		Limit(50).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load payroll runs"})
+		return
+	}
+	runs := make([]PayrollRun, 0, len(docs))
+	for _, doc := range docs {
+		var run PayrollRun
+		if err := doc.DataTo(&run); err != nil {
+			continue
+		}
+		run.ID = doc.Ref.ID
+		runs = append(runs, run)
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// GetEarnedWages returns the caller's employers with what they have accrued
+// this period and may draw
+func GetEarnedWages(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("employments").
+		Where("employee_user_id", "==", uid).
+		Where("status", "==", EmploymentActive).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load employers"})
+		return
+	}
+	now := time.Now()
+	employers := make([]gin.H, 0, len(docs))
+	for _, doc := range docs {
+		var e Employment
+		if err := doc.DataTo(&e); err != nil {
+			continue
+		}
+		e.ID = doc.Ref.ID
+		employers = append(employers, employmentView(&e, now))
+	}
+	c.JSON(http.StatusOK, gin.H{"employers": employers})
+}
+
+// DrawWageAdvance pays the caller part of their earned wages early from
+// their employer's wallet
+func DrawWageAdvance(c *gin.Context) {
+	var req struct {
+		EmployerUserID string `json:"employer_user_id" binding:"required"`
+		Amount         int64  `json:"amount" binding:"required,min=100"` // cents
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := walletHandleForUser(ctx, fs, uid, ProcessorStripe); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Earned wages are paid to a Stripe-backed wallet", "code": "wallet_unsupported"})
+		return
+	}
+
+	advance, entries, err := drawWageAdvance(ctx, fs, req.EmployerUserID, uid, req.Amount)
+	switch {
+	case status.Code(err) == codes.NotFound, errors.Is(err, errEmploymentInactive):
+		c.JSON(http.StatusNotFound, gin.H{"error": "You aren't employed by this business"})
+		return
+	case errors.Is(err, errAdvanceLimit):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "That's more than you can draw right now", "code": "advance_limit"})
+		return
+	case errors.Is(err, ErrInsufficientFunds):
+		c.JSON(http.StatusConflict, gin.H{"error": "Your employer can't fund an advance right now", "code": "employer_insufficient_funds"})
+		return
+	case err != nil:
+		slog.ErrorContext(ctx, "failed to draw wage advance", "component", "earned_wages", "user_id", uid, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to draw advance"})
+		return
+	}
+	for _, entry := range entries {
+		recordWalletMovement(c, fs, entry)
+	}
+	postRequestLedger(c, WageAdvanceLedgerTransaction(advance.ID, req.EmployerUserID, uid, advance.Amount))
+	slog.InfoContext(ctx, "wage advance drawn", "component", "earned_wages", "advance_id", advance.ID, "employer_user_id", req.EmployerUserID, "amount", advance.Amount)
+
+	amount := currencyOrDefault(walletCurrency).Format(advance.Amount)
+	NotifyUser(ctx, fs, uid, NotificationWalletCredited, "Earned wages received",
+		fmt.Sprintf("%s of your earned wages was added to your wallet. It will be taken from your next paycheck.", amount),
+		map[string]interface{}{"advance_id": advance.ID})
+	NotifyUser(ctx, fs, req.EmployerUserID, NotificationWageAdvance, "Earned wage advance",
+		fmt.Sprintf("An employee drew %s of earned wages; it will be withheld from their next payroll.", amount),
+		map[string]interface{}{"advance_id": advance.ID, "employee_user_id": uid})
+	c.JSON(http.StatusCreated, advance)
+}
+
+// ListWageAdvances returns the caller's advances, newest first
+func ListWageAdvances(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("wage_advances").
+		Where("employee_user_id", "==", uid).
+		OrderBy("created_at", firestore.Desc).
+		Limit(100).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load advances"})
+		return
+	}
+	advances := make([]WageAdvance, 0, len(docs))
+	for _, doc := range docs {
+		var a WageAdvance
+		if err := doc.DataTo(&a); err != nil {
+			continue
+		}
+		a.ID = doc.Ref.ID
+		advances = append(advances, a)
+	}
+	c.JSON(http.StatusOK, gin.H{"advances": advances})
+}
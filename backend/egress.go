@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Provider traffic can be sent through an egress proxy and pinned to known
+// keys, for deployments whose outbound traffic must leave from allowlisted
+// addresses. For each dependency (STRIPE, SILA, PLAID, SENDGRID,
+// REMOTE_DEPOSIT):
+//
+//   - EGRESS_PROXY_<DEPENDENCY> is the proxy URL for its calls, or "direct" to
+//     bypass a proxy set for everything else. Unset, the standard HTTPS_PROXY
+//     and NO_PROXY variables apply.
+//   - TLS_PINS_<DEPENDENCY> lists base64 SHA-256 hashes of the
+//     SubjectPublicKeyInfo of certificates the provider may present; at least
+//     one in the verified chain must match. Pin an intermediate or root rather
+//     than the leaf so certificate renewals don't break calls.
+//
+// EGRESS_CA_FILE adds PEM roots to the system pool for every provider, for
+// proxies that inspect TLS; pins still have to match the chain the proxy
+// presents.
+
+// egressConfig is how one dependency's calls leave the network
+type egressConfig struct {
+	proxy  func(*http.Request) (*url.URL, error)
+	pins   map[string]bool
+	caFile string
+}
+
+// loadEgressConfig reads a dependency's egress settings from the environment
+func loadEgressConfig(dependency string) (*egressConfig, error) {
+	suffix := strings.ToUpper(dependency)
+	cfg := &egressConfig{proxy: http.ProxyFromEnvironment, caFile: os.Getenv("EGRESS_CA_FILE")}
+	switch raw := strings.TrimSpace(os.Getenv("EGRESS_PROXY_" + suffix)); raw {
+	case "":
+	case "direct":
+		cfg.proxy = nil
+	default:
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return nil, fmt.Errorf("EGRESS_PROXY_%s must be an http, https, or socks5 URL", suffix)
+		}
+		cfg.proxy = http.ProxyURL(u)
+	}
+	for _, pin := range strings.Split(os.Getenv("TLS_PINS_"+suffix), ",") {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("TLS_PINS_%s: %q is not a base64 SHA-256 hash", suffix, pin)
+		}
+		if cfg.pins == nil {
+			cfg.pins = map[string]bool{}
+		}
+		cfg.pins[pin] = true
+	}
+	return cfg, nil
+}
+
+// providerTransport is the base transport for a dependency's API calls, with
+// its egress proxy, extra roots, and key pins applied
+func providerTransport(dependency string) (http.RoundTripper, error) {
+	cfg, err := loadEgressConfig(dependency)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = cfg.proxy
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.caFile != "" {
+		pem, err := os.ReadFile(cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("EGRESS_CA_FILE: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("EGRESS_CA_FILE: no PEM certificates in %s", cfg.caFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if len(cfg.pins) > 0 {
+		// Runs after the chain is verified, so a pin can't vouch for an
+		// untrusted certificate
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if cfg.pins[base64.StdEncoding.EncodeToString(sum[:])] {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("%s: certificate for %s matches no pinned key", dependency, cs.ServerName)
+		}
+	}
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+// failedTransport fails every call, for a client whose egress settings are
+// invalid; calls must not fall back to leaving the network unproxied
+type failedTransport struct{ err error }
+
+func (t failedTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Escrow states for a payment sent to someone without an account. The charge
+// is held on the platform until the recipient claims it through their invite
+// and finishes payout onboarding, or refunded if they never do.
+const (
+	EscrowHeld     = "held"
+	EscrowClaimed  = "claimed"
+	EscrowReleased = "released"
+	EscrowRefunded = "refunded"
+	EscrowExpired  = "expired"
+)
+
+// NotificationEscrowClaimed tells a recipient the payment they claimed is waiting on payout setup
+const NotificationEscrowClaimed = "escrow_claimed"
+
+// NotificationEscrowReleased tells a sender their escrowed payment reached the recipient
+const NotificationEscrowReleased = "escrow_released"
+
+const (
+	// defaultEscrowClaimDays is how long a recipient has to claim and onboard
+	defaultEscrowClaimDays = 14
+	// escrowLease keeps other instances off an escrowed payment while it settles
+	escrowLease = 2 * time.Minute
+)
+
+// escrowClaimWindow reads ESCROW_CLAIM_DAYS
+func escrowClaimWindow() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ESCROW_CLAIM_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultEscrowClaimDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// userIDForContact resolves an existing user by email or phone, returning ""
+// when nobody has registered with it yet
+func userIDForContact(ctx context.Context, fs *firestore.Client, email, phone string) (string, error) {
+	lookups := map[string]string{"phone": phone}
+	if email != "" {
+		lookups = map[string]string{"email_address": email, "email": email}
+	}
+	for field, value := range lookups {
+		docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+			return users.Where(field, "==", value).Limit(1)
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to look up user by %s: %w", field, err)
+		}
+		if len(docs) > 0 {
+			return docs[0].Ref.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// initiateEscrowedPayment charges the sender for a recipient without an
+// account and responds with the invite link the sender shares with them
+func initiateEscrowedPayment(c *gin.Context, pp PaymentProvider, fs *firestore.Client, email, phone string, p p2pPayment) {
+	ctx := c.Request.Context()
+	expiresAt := time.Now().Add(escrowClaimWindow())
+	p.Escrow = true
+	p.Fields = map[string]interface{}{
+		"escrow_status":     EscrowHeld,
+		"escrow_expires_at": expiresAt,
+	}
+	pi, _, err := createP2PPayment(c, pp, p)
+	if err != nil {
+		respondP2PError(c, err)
+		return
+	}
+
+	resp := gin.H{"payment_intent": pi, "escrow_status": EscrowHeld, "escrow_expires_at": expiresAt}
+	if p.Fee != nil {
+		resp["fee"] = p.Fee
+	}
+	if pi.NextAction != nil {
+		resp["requires_action"] = true
+	}
+	inv, token, err := createEscrowInvite(ctx, fs, p.SenderUID, pi.ID, email, phone, expiresAt)
+	if err != nil {
+		// The payment stands; the sender can still invite with POST /invites
+		slog.ErrorContext(ctx, "failed to create escrow invite", "component", "escrow", "payment_intent", pi.ID, "error", err)
+		c.JSON(http.StatusOK, withBalanceCheck(c, resp))
+		return
+	}
+	for k, v := range inviteLinks(token) {
+		resp[k] = v
+	}
+	resp["invite"] = inv
+	c.JSON(http.StatusOK, withBalanceCheck(c, resp))
+}
+
+// createEscrowInvite creates the payment invite the recipient claims an escrowed payment with
+func createEscrowInvite(ctx context.Context, fs *firestore.Client, senderUID, transactionID, email, phone string, expiresAt time.Time) (*Invite, string, error) {
+	inv := &Invite{
+		ID:            uuid.NewString(),
+		InviterUserID: senderUID,
+		Kind:          InvitePayment,
+		Email:         email,
+		Phone:         phone,
+		TransactionID: transactionID,
+		Status:        InviteCreated,
+		CreatedAt:     time.Now(),
+		ExpiresAt:     expiresAt,
+	}
+	token, err := signInvite(inv)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fs.Collection("invites").Doc(inv.ID).Set(ctx, inv); err != nil {
+		return nil, "", fmt.Errorf("failed to create invite: %w", err)
+	}
+	return inv, token, nil
+}
+
+// ClaimEscrowedPayment assigns a held payment to the user who accepted its
+// invite. The transfer follows once they can receive payouts.
+func ClaimEscrowedPayment(ctx context.Context, fs *firestore.Client, transactionID, uid string) error {
+	ref := fs.Collection("transactions").Doc(transactionID)
+	var data map[string]interface{}
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		data = nil
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if stringField(snap.Data(), "escrow_status") != EscrowHeld {
+			return nil
+		}
+		data = snap.Data()
+		return tx.Update(ref, []firestore.Update{
+			{Path: "escrow_status", Value: EscrowClaimed},
+			{Path: "recipient_user_id", Value: uid},
+			{Path: "participants", Value: firestore.ArrayUnion(uid)},
+			{Path: "updated_at", Value: time.Now()},
+		})
+	})
+	if err != nil || data == nil {
+		return err
+	}
+	amount, _ := data["amount"].(int64)
+	NotifyUser(ctx, fs, uid, NotificationEscrowClaimed, "You have money waiting",
+		fmt.Sprintf("Finish setting up payouts to receive your %s payment", currencyOrDefault(stringField(data, "currency")).Format(amount)),
+		map[string]interface{}{"transaction_id": transactionID})
+	return nil
+}
+
+// SettleEscrowedPayments transfers claimed payments to recipients who can now
+// receive payouts, and refunds payments nobody claimed in time
+func SettleEscrowedPayments(ctx context.Context, d *webhookDeps) error {
+	claimed, err := d.fs.Collection("transactions").
+		Where("escrow_status", "==", EscrowClaimed).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load claimed escrow: %w", err)
+	}
+	for _, doc := range claimed {
+		// A reported payment waits for its report to be resolved
+		if stringField(doc.Data(), "status") != "succeeded" || stringField(doc.Data(), "transfer_status") == TransferStatusFrozen {
+			continue
+		}
+		destination := escrowDestination(ctx, d.fs, stringField(doc.Data(), "recipient_user_id"))
+		if destination == "" {
+			continue
+		}
+		if ok, err := claimEscrow(ctx, d.fs, doc.Ref, EscrowClaimed); err != nil || !ok {
+			continue
+		}
+		releaseEscrow(ctx, d, doc.Ref.ID, doc.Data(), destination)
+	}
+
+	expired, err := d.fs.Collection("transactions").
+		Where("escrow_status", "in", []string{EscrowHeld, EscrowClaimed}).
+		Where("escrow_expires_at", "<=", time.Now()).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load expired escrow: %w", err)
+	}
+	for _, doc := range expired {
+		if ok, err := claimEscrow(ctx, d.fs, doc.Ref, stringField(doc.Data(), "escrow_status")); err != nil || !ok {
+			continue
+		}
+		refundEscrow(ctx, d, doc.Ref.ID, doc.Data())
+	}
+	return nil
+}
+
+// escrowDestination returns the recipient's connected account once payouts are enabled
+func escrowDestination(ctx context.Context, fs *firestore.Client, uid string) string {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return ""
+	}
+	if enabled, _ := doc.Data()["payouts_enabled"].(bool); !enabled {
+		return ""
+	}
+	return stringField(doc.Data(), "stripe_account_id")
+}
+
+// claimEscrow takes a lease on an escrowed payment still in the given state,
+// reporting false if another instance holds it
+func claimEscrow(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef, state string) (bool, error) {
+	claimed := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		lease, _ := snap.Data()["escrow_lease_until"].(time.Time)
+		if stringField(snap.Data(), "escrow_status") != state || lease.After(time.Now()) {
+			return nil
+		}
+		claimed = true
+		return tx.Update(ref, []firestore.Update{{Path: "escrow_lease_until", Value: time.Now().Add(escrowLease)}})
+	})
+	return claimed, err
+}
+
+// allocateEscrow moves a claimed payment from unallocated funds to what the platform owes the recipient
+func allocateEscrow(ctx context.Context, d *webhookDeps, paymentIntentID, recipientUID string, amount int64, currency string) {
+	d.postLedger(ctx, recipientUID, &LedgerTransaction{
+		ID:        "escrow_" + paymentIntentID,
+		Kind:      LedgerEscrowAllocation,
+		Reference: paymentIntentID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountUnallocated, Direction: Debit, Amount: amount},
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Credit, Amount: amount},
+		},
+	})
+}
+
+// releaseEscrow transfers a claimed payment to the recipient's connected account
+func releaseEscrow(ctx context.Context, d *webhookDeps, paymentIntentID string, data map[string]interface{}, destination string) {
+	sc := d.sc
+	senderUID := stringField(data, "sender_user_id")
+	recipientUID := stringField(data, "recipient_user_id")
+	amount, _ := data["amount"].(int64)
+	net := transactionNetAmount(data)
+	currency := stringField(data, "currency")
+
+	allocateEscrow(ctx, d, paymentIntentID, recipientUID, net, currency)
+	tr, err := sc.ProcessTransferWithIdempotency(ctx, net, currency, destination, paymentIntentID, "escrow_transfer_"+paymentIntentID)
+	if err != nil {
+		// Still claimed, so the next run tries again once the lease lapses
+		sc.LogAPIError(ctx, "escrow_transfer", recipientUID, err)
+		return
+	}
+	sc.LogAPIInteraction(ctx, "escrow_transfer", recipientUID, true, fmt.Sprintf("Transfer: %s", tr.ID))
+	d.postLedger(ctx, recipientUID, TransferLedgerTransaction(tr.ID, recipientUID, tr.Amount, tr.Currency))
+	if err := SaveTransaction(ctx, d.fs, paymentIntentID, map[string]interface{}{
+		"escrow_status":      EscrowReleased,
+		"escrow_lease_until": firestore.Delete,
+		"transfer_id":        tr.ID,
+	}); err != nil {
+		slog.ErrorContext(ctx, "failed to record escrow release", "component", "escrow", "payment_intent", paymentIntentID, "error", err)
+	}
+	NotifyUser(ctx, d.fs, senderUID, NotificationEscrowReleased, "Payment delivered",
+		fmt.Sprintf("Your %s payment was claimed and delivered", currencyOrDefault(currency).Format(amount)),
+		map[string]interface{}{"transaction_id": paymentIntentID})
+}
+
+// refundEscrow returns an unclaimed payment to the sender. Charges that never
+// succeeded have nothing to refund and just expire.
+func refundEscrow(ctx context.Context, d *webhookDeps, paymentIntentID string, data map[string]interface{}) {
+	sc := d.sc
+	senderUID := stringField(data, "sender_user_id")
+	amount, _ := data["amount"].(int64)
+
+	switch stringField(data, "status") {
+	case "succeeded":
+	case "processing":
+		// Wait for the charge to settle before deciding
+		return
+	default:
+		if err := SaveTransaction(ctx, d.fs, paymentIntentID, map[string]interface{}{
+			"escrow_status":      EscrowExpired,
+			"escrow_lease_until": firestore.Delete,
+		}); err != nil {
+			slog.ErrorContext(ctx, "failed to expire escrow", "component", "escrow", "payment_intent", paymentIntentID, "error", err)
+		}
+		return
+	}
+
+	// Refunds are booked against the recipient once one has claimed the payment
+	if recipientUID := stringField(data, "recipient_user_id"); recipientUID != "" {
+		allocateEscrow(ctx, d, paymentIntentID, recipientUID, transactionNetAmount(data), stringField(data, "currency"))
+	}
+	refund, err := sc.RefundPaymentIntent(ctx, paymentIntentID, map[string]string{"reason": "escrow_unclaimed"}, "escrow_refund_"+paymentIntentID)
+	if err != nil {
+		sc.LogAPIError(ctx, "escrow_refund", senderUID, err)
+		return
+	}
+	sc.LogAPIInteraction(ctx, "escrow_refund", senderUID, true, fmt.Sprintf("Refund: %s", refund.ID))
+	if err := SaveTransaction(ctx, d.fs, paymentIntentID, map[string]interface{}{
+		"escrow_status":          EscrowRefunded,
+		"escrow_lease_until":     firestore.Delete,
+		"compensation_refund_id": refund.ID,
+	}); err != nil {
+		slog.ErrorContext(ctx, "failed to record escrow refund", "component", "escrow", "payment_intent", paymentIntentID, "error", err)
+	}
+	NotifyUser(ctx, d.fs, senderUID, NotificationPaymentRefunded, "Payment refunded",
+		fmt.Sprintf("Your %s payment wasn't claimed in time, so it has been refunded", currencyOrDefault(stringField(data, "currency")).Format(amount)),
+		map[string]interface{}{"transaction_id": paymentIntentID, "refund_id": refund.ID})
+}
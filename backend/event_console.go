@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// eventConsoleEnabled gates the synthetic event endpoints; they run real
+// consumers against real documents, so only staging should turn them on.
+func eventConsoleEnabled() bool {
+	return os.Getenv("EVENT_CONSOLE_ENABLED") == "true"
+}
+
+// watchedDocuments are the documents a synthetic event's consumers may change
+func watchedDocuments(ctx context.Context, fs *firestore.Client, evt Event) []*firestore.DocumentRef {
+	var refs []*firestore.DocumentRef
+	for _, uid := range evt.UserIDs {
+		refs = append(refs, fs.Collection("user_summaries").Doc(uid))
+	}
+	if evt.TransactionID != "" {
+		tx := fs.Collection("transactions").Doc(evt.TransactionID)
+		refs = append(refs, tx)
+		if doc, err := tx.Get(ctx); err == nil {
+			if requestID := stringField(doc.Data(), "payment_request_id"); requestID != "" {
+				req := fs.Collection("requests").Doc(requestID)
+				refs = append(refs, req, req.Collection("payments").Doc(evt.TransactionID))
+			}
+		}
+	}
+	return refs
+}
+
+// snapshotDocuments reads each document's data keyed by path; missing documents map to nil
+func snapshotDocuments(ctx context.Context, fs *firestore.Client, refs []*firestore.DocumentRef) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{}, len(refs))
+	if len(refs) == 0 {
+		return out
+	}
+	docs, err := fs.GetAll(ctx, refs)
+	if err != nil {
+		return out
+	}
+	for i, doc := range docs {
+		path := refs[i].Path
+		if doc.Exists() {
+			out[path] = doc.Data()
+		} else {
+			out[path] = nil
+		}
+	}
+	return out
+}
+
+// FireTestEvent publishes a synthetic event through the registered consumers
+// without involving Stripe, and returns each consumer's result along with the
+// watched documents before and after and any notifications it created.
+func FireTestEvent(c *gin.Context) {
+	if !eventConsoleEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event console is disabled"})
+		return
+	}
+	var req struct {
+		Type          string                 `json:"type" binding:"required"`
+		UserIDs       []string               `json:"user_ids"`
+		TransactionID string                 `json:"transaction_id"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(eventConsumers[req.Type]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No consumers are registered for this event type"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	data := map[string]interface{}{}
+	for k, val := range req.Data {
+		data[k] = val
+	}
+	data["synthetic"] = true
+	data["fired_by"] = c.GetString("userID")
+	evt := Event{
+		ID:            "test_" + uuid.NewString(),
+		Type:          req.Type,
+		UserIDs:       req.UserIDs,
+		TransactionID: req.TransactionID,
+		Data:          data,
+		CreatedAt:     time.Now(),
+	}
+
+	refs := watchedDocuments(ctx, fs, evt)
+	before := snapshotDocuments(ctx, fs, refs)
+
+	if _, err := fs.Collection("events").Doc(evt.ID).Set(ctx, evt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record event"})
+		return
+	}
+	results := deliverEvent(ctx, fs, evt)
+
+	after := snapshotDocuments(ctx, fs, refs)
+	consumers := make([]gin.H, len(results))
+	for i, err := range results {
+		consumers[i] = gin.H{"index": i, "ok": err == nil}
+		if err != nil {
+			consumers[i]["error"] = err.Error()
+		}
+	}
+
+	var notifications []map[string]interface{}
+	for _, uid := range evt.UserIDs {
+		docs, err := fs.Collection("notifications").
+			Where("user_id", "==", uid).
+			Where("updated_at", ">=", evt.CreatedAt).
+			Documents(ctx).GetAll()
+		if err != nil {
+			continue
+		}
+		for _, doc := range docs {
+			n := doc.Data()
+			n["id"] = doc.Ref.ID
+			notifications = append(notifications, n)
+		}
+	}
+
+	changed := []string{}
+	for _, ref := range refs {
+		if !reflect.DeepEqual(before[ref.Path], after[ref.Path]) {
+			changed = append(changed, ref.Path)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"event":         evt,
+		"consumers":     consumers,
+		"before":        before,
+		"after":         after,
+		"changed":       changed,
+		"notifications": notifications,
+	})
+}
+
+// ListTestEvents returns the most recent synthetic events fired from the console
+func ListTestEvents(c *gin.Context) {
+	if !eventConsoleEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event console is disabled"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("events").
+		Where("data.synthetic", "==", true).
+		OrderBy("created_at", firestore.Desc).
+		Limit(50).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load events"})
+		return
+	}
+	events := make([]Event, 0, len(docs))
+	for _, doc := range docs {
+		var evt Event
+		if err := doc.DataTo(&evt); err != nil {
+			continue
+		}
+		events = append(events, evt)
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
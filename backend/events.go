@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+)
+
+// Event types emitted as transactions move through their lifecycle
+const (
+	EventTransactionCreated   = "transaction.created"
+	EventTransactionSucceeded = "transaction.succeeded"
+	EventTransactionFailed    = "transaction.failed"
+	EventTransactionRefunded  = "transaction.refunded"
+	EventTransactionExpired   = "transaction.expired"
+	EventTransactionReturned  = "transaction.returned"
+)
+
+// Event is a normalized domain event fanned out to registered consumers
+type Event struct {
+	ID            string                 `json:"id" firestore:"id"`
+	Type          string                 `json:"type" firestore:"type"`
+	UserIDs       []string               `json:"user_ids" firestore:"user_ids"`
+	TransactionID string                 `json:"transaction_id,omitempty" firestore:"transaction_id,omitempty"`
+	Data          map[string]interface{} `json:"data,omitempty" firestore:"data,omitempty"`
+	CreatedAt     time.Time              `json:"created_at" firestore:"created_at"`
+}
+
+// EventConsumer reacts to a published event
+type EventConsumer func(ctx context.Context, fs *firestore.Client, evt Event) error
+
+// eventConsumers is populated at startup before the server begins handling requests
+var eventConsumers = map[string][]EventConsumer{}
+
+// RegisterEventConsumer subscribes a consumer to an event type ("*" for all events)
+func RegisterEventConsumer(eventType string, consumer EventConsumer) {
+	eventConsumers[eventType] = append(eventConsumers[eventType], consumer)
+}
+
+// PublishEvent records the event in Firestore and delivers it to its consumers
+func PublishEvent(ctx context.Context, fs *firestore.Client, evt Event) {
+	if evt.ID == "" {
+		evt.ID = uuid.NewString()
+	}
+	if evt.CreatedAt.IsZero() {
+		evt.CreatedAt = time.Now()
+	}
+
+	if fs != nil {
+		if _, err := fs.Collection("events").Doc(evt.ID).Set(ctx, evt); err != nil {
+			slog.ErrorContext(ctx, "failed to persist event", "component", "events", "event_type", evt.Type, "event_id", evt.ID, "error", err)
+		}
+	}
+
+	for _, err := range deliverEvent(ctx, fs, evt) {
+		if err != nil {
+			slog.ErrorContext(ctx, "event consumer failed", "component", "events", "event_type", evt.Type, "event_id", evt.ID, "error", err)
+		}
+	}
+}
+
+// deliverEvent runs the event's consumers in registration order, returning each
+// consumer's result
+func deliverEvent(ctx context.Context, fs *firestore.Client, evt Event) []error {
+	var consumers []EventConsumer
+	consumers = append(consumers, eventConsumers[evt.Type]...)
+	consumers = append(consumers, eventConsumers["*"]...)
+	results := make([]error, len(consumers))
+	for i, consumer := range consumers {
+		results[i] = consumer(ctx, fs, evt)
+	}
+	return results
+}
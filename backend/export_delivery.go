@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Exports and statements are delivered as chosen with ?delivery=:
+//
+//   - inline (default): the file is the response body;
+//   - url: the file is written to EXPORTS_BUCKET in Cloud Storage and the
+//     response is a signed URL for it, valid for EXPORT_URL_TTL (default
+//     15m). Give the bucket a lifecycle rule deleting objects under exports/
+//     after a day; nothing else removes them.
+//
+// Unset EXPORTS_BUCKET, only inline delivery is offered.
+
+// Delivery modes, chosen with ?delivery=
+const (
+	DeliveryInline = "inline"
+	DeliveryURL    = "url"
+)
+
+const (
+	defaultExportURLTTL = 15 * time.Minute
+	// maxExportURLTTL is the longest a V4 signed URL can be valid
+	maxExportURLTTL = 7 * 24 * time.Hour
+)
+
+// exportContentTypes are the Content-Types of export files, by format
+var exportContentTypes = map[string]string{
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportNDJSON: "application/x-ndjson",
+	ExportOFX:    "application/x-ofx",
+	ExportPDF:    "application/pdf",
+}
+
+// exportBucket holds exports delivered by signed URL; nil when EXPORTS_BUCKET
+// isn't set
+var exportBucket *storage.BucketHandle
+
+// exportURLTTL is how long a signed export URL is valid
+var exportURLTTL = defaultExportURLTTL
+
+// InitExportStorage opens the bucket EXPORTS_BUCKET names
+func InitExportStorage(ctx context.Context) error {
+	bucket := os.Getenv("EXPORTS_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	if raw := os.Getenv("EXPORT_URL_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 || ttl > maxExportURLTTL {
+			return fmt.Errorf("EXPORT_URL_TTL must be a duration of at most %s", maxExportURLTTL)
+		}
+		exportURLTTL = ttl
+	}
+	handle, err := openBucket(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	exportBucket = handle
+	return nil
+}
+
+// storageClient is the Cloud Storage client every bucket shares
+var storageClient struct {
+	once   sync.Once
+	client *storage.Client
+	err    error
+}
+
+// openBucket returns a handle on a Cloud Storage bucket. Credentials come
+// from GOOGLE_APPLICATION_CREDENTIALS or the metadata server; URLs are signed
+// with the service account's key or, without one, through the IAM
+// Credentials API.
+func openBucket(ctx context.Context, name string) (*storage.BucketHandle, error) {
+	storageClient.once.Do(func() {
+		storageClient.client, storageClient.err = storage.NewClient(ctx)
+	})
+	if storageClient.err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", storageClient.err)
+	}
+	return storageClient.client.Bucket(name), nil
+}
+
+// exportDelivery reads ?delivery=, inline by default. It responds 400 for
+// unknown modes and 503 for url when no bucket is configured.
+func exportDelivery(c *gin.Context) (string, bool) {
+	switch delivery := c.DefaultQuery("delivery", DeliveryInline); delivery {
+	case DeliveryInline:
+		return delivery, true
+	case DeliveryURL:
+		if exportBucket == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Signed URL delivery is not available", "code": "delivery_unavailable"})
+			return "", false
+		}
+		return delivery, true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "delivery must be inline or url"})
+		return "", false
+	}
+}
+
+// setExportHeaders marks the response as a file download. filename's
+// extension is the export format.
+func setExportHeaders(c *gin.Context, filename string) {
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Header("Content-Type", exportContentTypes[path.Ext(filename)[1:]])
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+}
+
+// deliverExportURL writes an export to Cloud Storage with write and responds
+// with a signed URL for it. Objects are under exports/{uid}/ with a random
+// segment, so their names can't be guessed from one another.
+func deliverExportURL(c *gin.Context, ctx context.Context, uid, filename string, write func(io.Writer) error) {
+	object := path.Join("exports", uid, uuid.NewString(), filename)
+	// Cancelling the upload's context is how a storage.Writer discards what
+	// it has written
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := exportBucket.Object(object).NewWriter(uploadCtx)
+	w.ContentType = exportContentTypes[path.Ext(filename)[1:]]
+	w.ContentDisposition = fmt.Sprintf(`attachment; filename="%s"`, filename)
+	w.CacheControl = "private, no-store"
+	if err := write(w); err != nil {
+		cancel()
+		_ = w.Close()
+		slog.WarnContext(ctx, "export upload failed", "component", "exports", "path", c.FullPath(), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare export", "code": "export_failed"})
+		return
+	}
+	if err := w.Close(); err != nil {
+		slog.ErrorContext(ctx, "export upload failed", "component", "exports", "path", c.FullPath(), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare export", "code": "export_failed"})
+		return
+	}
+	expiresAt := time.Now().Add(exportURLTTL)
+	url, err := exportBucket.SignedURL(object, &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  http.MethodGet,
+		Expires: expiresAt,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to sign export url", "component", "exports", "path", c.FullPath(), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare export", "code": "export_failed"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"url": url, "filename": filename, "expires_at": expiresAt.UTC()})
+}
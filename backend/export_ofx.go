@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OFX exports are OFX 2.2 bank statements, which personal finance software
+// imports. A statement has one currency, so only succeeded transactions in
+// that currency are listed; payments aren't drawn from a held balance, so the
+// ledger balance is the statement's net.
+
+// ofxBankID stands in for a routing number in BANKACCTFROM; the account ID is
+// the user's ID
+const ofxBankID = "DIGIPAY"
+
+// ofxNameLength is the longest NAME OFX allows
+const ofxNameLength = 32
+
+// ofxWriter writes one OFX statement as transactions are added
+type ofxWriter struct {
+	w        io.Writer
+	uid      string
+	currency Currency
+	end      time.Time
+	net      int64
+}
+
+// newOFXWriter writes the statement's header for transactions in [start, end)
+func newOFXWriter(w io.Writer, uid, currency string, start, end time.Time) (*ofxWriter, error) {
+	o := &ofxWriter{w: w, uid: uid, currency: currencyOrDefault(currency), end: end}
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS><DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+<STMTRS><CURDEF>%s</CURDEF>
+<BANKACCTFROM><BANKID>%s</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>
+<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>
+`, ofxTime(time.Now()), strings.ToUpper(o.currency.Code), ofxBankID, ofxText(uid), ofxTime(start), ofxTime(end))
+	return o, err
+}
+
+// Add lists a transaction, skipping ones that haven't settled or are in
+// another currency
+func (o *ofxWriter) Add(rec *TransactionRecord) error {
+	if rec.Status != "succeeded" || !strings.EqualFold(rec.Currency, o.currency.Code) {
+		return nil
+	}
+	trnType, amount, name := "CREDIT", rec.Amount, "Payment from "+rec.SenderUserID
+	if rec.SenderUserID == o.uid {
+		trnType, amount, name = "DEBIT", -rec.Amount, "Payment to "+rec.RecipientUserID
+	}
+	o.net += amount
+	if len(name) > ofxNameLength {
+		name = name[:ofxNameLength]
+	}
+	memo := ""
+	if len(rec.LineItems) > 0 {
+		memo = "<MEMO>" + ofxText(formatLineItems(rec.LineItems, rec.Currency)) + "</MEMO>"
+	}
+	_, err := fmt.Fprintf(o.w, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%s</FITID><NAME>%s</NAME>%s</STMTTRN>\n",
+		trnType, ofxTime(rec.CreatedAt), o.amount(amount), ofxText(rec.ID), ofxText(name), memo)
+	return err
+}
+
+// Close writes the ledger balance and ends the statement
+func (o *ofxWriter) Close() error {
+	_, err := fmt.Fprintf(o.w, `</BANKTRANLIST>
+<LEDGERBAL><BALAMT>%s</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`, o.amount(o.net), ofxTime(o.end))
+	return err
+}
+
+// amount renders minor units as OFX's signed decimal amount
+func (o *ofxWriter) amount(minor int64) string {
+	return strconv.FormatFloat(o.currency.FromMinor(minor), 'f', o.currency.Exponent, 64)
+}
+
+// ofxTime formats a time as OFX's datetime, in UTC
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000") + "[0:GMT]"
+}
+
+// ofxText escapes text for an OFX element
+func ofxText(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Recovery actions offered alongside a payment failure
+const (
+	FailureActionUseAnotherAccount = "use_another_account"
+	FailureActionContactBank       = "contact_bank"
+	FailureActionVerifyIdentity    = "verify_identity"
+	FailureActionUpdateDetails     = "update_details"
+	FailureActionChangeAmount      = "change_amount"
+	FailureActionRetryLater        = "retry_later"
+	FailureActionContactSupport    = "contact_support"
+)
+
+// defaultLocale is used when the caller's Accept-Language matches no catalog
+const defaultLocale = "en"
+
+// FailureAction is a recovery step a client can offer, with a localized label
+type FailureAction struct {
+	Code  string `json:"code"`
+	Label string `json:"label"`
+}
+
+// FailureMessage explains a payment failure to the user and what they can do about it
+type FailureMessage struct {
+	Reason  string          `json:"reason"`
+	Message string          `json:"message"`
+	Actions []FailureAction `json:"actions"`
+	Locale  string          `json:"locale"`
+}
+
+type failureReason struct {
+	reason  string
+	actions []string
+}
+
+// failureReasons groups Stripe error, decline and ACH return codes into the
+// reasons users are shown. NACHA return codes are included for rails that
+// report them directly.
+var failureReasons = map[string]failureReason{
+	"insufficient_funds": {"insufficient_funds", []string{FailureActionUseAnotherAccount, FailureActionRetryLater}},
+	"R01":                {"insufficient_funds", []string{FailureActionUseAnotherAccount, FailureActionRetryLater}},
+	"R09":                {"insufficient_funds", []string{FailureActionUseAnotherAccount, FailureActionRetryLater}},
+
+	"card_declined":                   {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"generic_decline":                 {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"do_not_honor":                    {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"transaction_not_allowed":         {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"bank_account_declined":           {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"payment_method_provider_decline": {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"lost_card":                       {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"stolen_card":                     {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"pickup_card":                     {"declined", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+
+	"debit_not_authorized": {"not_authorized", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R05":                  {"not_authorized", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R07":                  {"not_authorized", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R08":                  {"not_authorized", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R10":                  {"not_authorized", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R11":                  {"not_authorized", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R29":                  {"not_authorized", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+
+	"account_closed":          {"account_unavailable", []string{FailureActionUseAnotherAccount}},
+	"no_account":              {"account_unavailable", []string{FailureActionUseAnotherAccount}},
+	"bank_account_unusable":   {"account_unavailable", []string{FailureActionUseAnotherAccount}},
+	"bank_account_restricted": {"account_unavailable", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"account_frozen":          {"account_unavailable", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R02":                     {"account_unavailable", []string{FailureActionUseAnotherAccount}},
+	"R03":                     {"account_unavailable", []string{FailureActionUseAnotherAccount}},
+	"R16":                     {"account_unavailable", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+	"R20":                     {"account_unavailable", []string{FailureActionContactBank, FailureActionUseAnotherAccount}},
+
+	"invalid_account_number": {"invalid_details", []string{FailureActionUpdateDetails, FailureActionUseAnotherAccount}},
+	"incorrect_number":       {"invalid_details", []string{FailureActionUpdateDetails, FailureActionUseAnotherAccount}},
+	"incorrect_cvc":          {"invalid_details", []string{FailureActionUpdateDetails}},
+	"invalid_cvc":            {"invalid_details", []string{FailureActionUpdateDetails}},
+	"invalid_expiry_month":   {"invalid_details", []string{FailureActionUpdateDetails}},
+	"invalid_expiry_year":    {"invalid_details", []string{FailureActionUpdateDetails}},
+	"R04":                    {"invalid_details", []string{FailureActionUpdateDetails, FailureActionUseAnotherAccount}},
+	"expired_card":           {"expired", []string{FailureActionUpdateDetails, FailureActionUseAnotherAccount}},
+
+	"bank_account_unverified":               {"verification_required", []string{FailureActionVerifyIdentity}},
+	"authentication_required":               {"verification_required", []string{FailureActionVerifyIdentity}},
+	"payment_intent_authentication_failure": {"verification_required", []string{FailureActionVerifyIdentity, FailureActionUseAnotherAccount}},
+
+	"amount_too_large": {"amount_not_allowed", []string{FailureActionChangeAmount}},
+	"amount_too_small": {"amount_not_allowed", []string{FailureActionChangeAmount}},
+
+	"processing_error": {"temporary", []string{FailureActionRetryLater}},
+	"try_again_later":  {"temporary", []string{FailureActionRetryLater}},
+	"rate_limit":       {"temporary", []string{FailureActionRetryLater}},
+
+	"fraudulent":         {"blocked", []string{FailureActionContactSupport}},
+	"merchant_blacklist": {"blocked", []string{FailureActionContactSupport}},
+}
+
+// defaultFailureReason covers codes with no curated message
+var defaultFailureReason = failureReason{"unknown", []string{FailureActionUseAnotherAccount, FailureActionContactSupport}}
+
+// failureCatalog holds the user-facing copy per locale, keyed by reason and action
+var failureCatalog = map[string]map[string]string{
+	"en": {
+		"reason.insufficient_funds":    "There isn't enough money in this account to cover the payment.",
+		"reason.declined":              "Your bank declined this payment.",
+		"reason.not_authorized":        "Your bank reported that this payment wasn't authorized.",
+		"reason.account_unavailable":   "This account can't be used for payments right now.",
+		"reason.invalid_details":       "Some of your account details are incorrect.",
+		"reason.expired":               "This card has expired.",
+		"reason.verification_required": "We need to verify your identity before this payment can go through.",
+		"reason.amount_not_allowed":    "This amount isn't allowed for this payment method.",
+		"reason.temporary":             "Something went wrong on our side. No money was moved.",
+		"reason.blocked":               "This payment was blocked for your protection.",
+		"reason.unknown":               "We couldn't complete this payment.",
+
+		"action.use_another_account": "Use another account",
+		"action.contact_bank":        "Contact your bank",
+		"action.verify_identity":     "Verify your identity",
+		"action.update_details":      "Update account details",
+		"action.change_amount":       "Change the amount",
+		"action.retry_later":         "Try again later",
+		"action.contact_support":     "Contact support",
+	},
+	"es": {
+		"reason.insufficient_funds":    "No hay suficiente dinero en esta cuenta para cubrir el pago.",
+		"reason.declined":              "Tu banco rechazó este pago.",
+		"reason.not_authorized":        "Tu banco informó que este pago no fue autorizado.",
+		"reason.account_unavailable":   "Esta cuenta no se puede usar para pagos en este momento.",
+		"reason.invalid_details":       "Algunos datos de tu cuenta son incorrectos.",
+		"reason.expired":               "Esta tarjeta está vencida.",
+		"reason.verification_required": "Necesitamos verificar tu identidad antes de procesar este pago.",
+		"reason.amount_not_allowed":    "Este monto no está permitido para este método de pago.",
+		"reason.temporary":             "Algo salió mal de nuestro lado. No se movió dinero.",
+		"reason.blocked":               "Este pago fue bloqueado para protegerte.",
+		"reason.unknown":               "No pudimos completar este pago.",
+
+		"action.use_another_account": "Usar otra cuenta",
+		"action.contact_bank":        "Contactar a tu banco",
+		"action.verify_identity":     "Verificar tu identidad",
+		"action.update_details":      "Actualizar datos de la cuenta",
+		"action.change_amount":       "Cambiar el monto",
+		"action.retry_later":         "Intentar más tarde",
+		"action.contact_support":     "Contactar a soporte",
+	},
+}
+
+// requestLocale picks the first catalog locale in the caller's Accept-Language header
+func requestLocale(c *gin.Context) string {
+	for _, part := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if _, ok := failureCatalog[lang]; ok {
+			return lang
+		}
+	}
+	return defaultLocale
+}
+
+// failureMessageFor returns the localized message and recovery actions for a failure code
+func failureMessageFor(code, locale string) *FailureMessage {
+	fr, ok := failureReasons[code]
+	if !ok {
+		fr = defaultFailureReason
+	}
+	catalog, ok := failureCatalog[locale]
+	if !ok {
+		locale = defaultLocale
+		catalog = failureCatalog[locale]
+	}
+	msg := &FailureMessage{
+		Reason:  fr.reason,
+		Message: catalog["reason."+fr.reason],
+		Actions: make([]FailureAction, 0, len(fr.actions)),
+		Locale:  locale,
+	}
+	for _, a := range fr.actions {
+		msg.Actions = append(msg.Actions, FailureAction{Code: a, Label: catalog["action."+a]})
+	}
+	return msg
+}
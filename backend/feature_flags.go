@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// featureFlagCacheTTL is how long flag definitions are cached per instance
+const featureFlagCacheTTL = time.Minute
+
+// featureFlagNamePattern bounds flag names so they are safe as document IDs
+var featureFlagNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{0,62}$`)
+
+// FeatureFlag turns a feature on for some clients, stored at
+// feature_flags/{name}. Empty targeting fields match every client; an
+// unknown app version never matches a version bound.
+type FeatureFlag struct {
+	Name          string    `json:"name" firestore:"-"`
+	Enabled       bool      `json:"enabled" firestore:"enabled"`
+	Platforms     []string  `json:"platforms,omitempty" firestore:"platforms,omitempty"`
+	MinAppVersion string    `json:"min_app_version,omitempty" firestore:"min_app_version,omitempty"`
+	MaxAppVersion string    `json:"max_app_version,omitempty" firestore:"max_app_version,omitempty"`
+	Description   string    `json:"description,omitempty" firestore:"description,omitempty"`
+	UpdatedBy     string    `json:"updated_by,omitempty" firestore:"updated_by,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// matches reports whether the flag is on for a client
+func (f *FeatureFlag) matches(client ClientInfo) bool {
+	if !f.Enabled {
+		return false
+	}
+	if len(f.Platforms) > 0 {
+		found := false
+		for _, p := range f.Platforms {
+			found = found || p == client.Platform
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MinAppVersion == "" && f.MaxAppVersion == "" {
+		return true
+	}
+	version, ok := parseAppVersion(client.AppVersion)
+	if !ok {
+		return false
+	}
+	if minimum, ok := parseAppVersion(f.MinAppVersion); ok && version.less(minimum) {
+		return false
+	}
+	if maximum, ok := parseAppVersion(f.MaxAppVersion); ok && maximum.less(version) {
+		return false
+	}
+	return true
+}
+
+// featureFlagCache holds every flag, reloaded once it is older than the TTL
+var featureFlagCache struct {
+	mu       sync.Mutex
+	flags    map[string]*FeatureFlag
+	loadedAt time.Time
+}
+
+// loadFeatureFlags returns every flag, from the cache when it is fresh. If
+// Firestore can't be read the previous flags are kept.
+func loadFeatureFlags(ctx context.Context, fs *firestore.Client) map[string]*FeatureFlag {
+	featureFlagCache.mu.Lock()
+	defer featureFlagCache.mu.Unlock()
+	if featureFlagCache.flags != nil && time.Since(featureFlagCache.loadedAt) < featureFlagCacheTTL {
+		return featureFlagCache.flags
+	}
+	docs, err := fs.Collection("feature_flags").Documents(ctx).GetAll()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to load feature flags", "component", "feature_flags", "error", err)
+		return featureFlagCache.flags
+	}
+	flags := make(map[string]*FeatureFlag, len(docs))
+	for _, doc := range docs {
+		var flag FeatureFlag
+		if err := doc.DataTo(&flag); err != nil {
+			continue
+		}
+		flag.Name = doc.Ref.ID
+		flags[flag.Name] = &flag
+	}
+	featureFlagCache.flags = flags
+	featureFlagCache.loadedAt = time.Now()
+	return flags
+}
+
+// FeatureEnabled reports whether a flag is on for the client ctx came from.
+// Flags that don't exist are off.
+func FeatureEnabled(ctx context.Context, fs *firestore.Client, name string) bool {
+	flag, ok := loadFeatureFlags(ctx, fs)[name]
+	return ok && flag.matches(ClientFromContext(ctx))
+}
+
+// GetFeatures returns the names of the flags on for the calling app, sorted so
+// the ETag is stable while they are unchanged
+func GetFeatures(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	ctx := c.Request.Context()
+	client := ClientFromContext(ctx)
+	enabled := []string{}
+	for name, flag := range loadFeatureFlags(ctx, v.(*firestore.Client)) {
+		if flag.matches(client) {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	respondWithETag(c, gin.H{"features": enabled, "client": client})
+}
+
+// ListFeatureFlags returns every flag definition
+func ListFeatureFlags(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	docs, err := v.(*firestore.Client).Collection("feature_flags").Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load feature flags"})
+		return
+	}
+	flags := make([]FeatureFlag, 0, len(docs))
+	for _, doc := range docs {
+		var flag FeatureFlag
+		if err := doc.DataTo(&flag); err != nil {
+			continue
+		}
+		flag.Name = doc.Ref.ID
+		flags = append(flags, flag)
+	}
+	c.JSON(http.StatusOK, gin.H{"feature_flags": flags})
+}
+
+// SetFeatureFlag creates or replaces a flag. Changes reach every instance
+// within the cache TTL.
+func SetFeatureFlag(c *gin.Context) {
+	name := c.Param("name")
+	if !featureFlagNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Flag names are lowercase letters, digits, and _"})
+		return
+	}
+	var flag FeatureFlag
+	if err := c.ShouldBindJSON(&flag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, p := range flag.Platforms {
+		if _, ok := appPlatforms[p]; !ok && p != "web" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown platform " + p})
+			return
+		}
+	}
+	for _, bound := range []string{flag.MinAppVersion, flag.MaxAppVersion} {
+		if _, ok := parseAppVersion(bound); bound != "" && !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "App versions look like 4.12.1"})
+			return
+		}
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	flag.Name = name
+	flag.UpdatedBy = c.GetString("userID")
+	flag.UpdatedAt = time.Now()
+	// Recorded in config_changes like other configuration, so it can be rolled back
+	change, err := changeConfig(ctx, fs, "feature_flags/"+name, flag.UpdatedBy, c.Query("reason"), "", func(*firestore.DocumentSnapshot) (interface{}, error) {
+		return flag, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feature flag"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"feature_flag": flag, "change_id": change.ID})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Transfer speeds a sender can pick
+const (
+	FeeSpeedStandard = "standard"
+	FeeSpeedInstant  = "instant"
+)
+
+// How a payment is funded, which decides its fee. Clients pass one as
+// funding_source; wallet payments move Sila wallet balance rather than
+// charging a payment method.
+const (
+	FeeMethodBank   = "bank"
+	FeeMethodCard   = "card"
+	FeeMethodWallet = "wallet"
+	// FeeMethodPayout prices a recipient's instant payout rather than a payment
+	FeeMethodPayout = "payout"
+)
+
+// Who bears a payment's fee. The recipient does by default: the fee is kept
+// from what they are transferred. When the sender does, it is added to their
+// charge and the recipient gets the whole amount sent.
+const (
+	FeePayerRecipient = "recipient"
+	FeePayerSender    = "sender"
+)
+
+// FeeRule is a flat fee in cents plus a percentage in basis points
+type FeeRule struct {
+	Flat       int64 `json:"flat" firestore:"flat"`
+	PercentBPS int64 `json:"percent_bps" firestore:"percent_bps"`
+}
+
+// defaultFeeRules are keyed by speed then method; FEE_<SPEED>_<METHOD>, as
+// "flat,bps" (e.g. FEE_INSTANT_CARD=30,440), overrides one
+var defaultFeeRules = map[string]map[string]FeeRule{
+	FeeSpeedStandard: {
+		FeeMethodBank:   {},
+		FeeMethodCard:   {Flat: 30, PercentBPS: 290},
+		FeeMethodWallet: {},
+	},
+	FeeSpeedInstant: {
+		FeeMethodBank:   {Flat: 25, PercentBPS: 150},
+		FeeMethodCard:   {Flat: 30, PercentBPS: 440},
+		FeeMethodWallet: {},
+		// Moving received funds to a debit card; FEE_INSTANT_PAYOUT overrides it
+		FeeMethodPayout: {Flat: 50, PercentBPS: 150},
+	},
+}
+
+// feeRule returns the rule for a speed and funding method. One set by an
+// admin in config/fees wins over the environment.
+func feeRule(speed, method string) FeeRule {
+	if rule, ok := configuredFeeRule(speed, method); ok {
+		return rule
+	}
+	if v := os.Getenv("FEE_" + strings.ToUpper(speed) + "_" + strings.ToUpper(method)); v != "" {
+		flat, bps, ok := strings.Cut(v, ",")
+		f, ferr := strconv.ParseInt(strings.TrimSpace(flat), 10, 64)
+		p, perr := strconv.ParseInt(strings.TrimSpace(bps), 10, 64)
+		if ok && ferr == nil && perr == nil && f >= 0 && p >= 0 {
+			return FeeRule{Flat: f, PercentBPS: p}
+		}
+	}
+	return defaultFeeRules[speed][method]
+}
+
+// FeeBreakdown is the fee on one payment, stored on its transaction document
+// under "fee" and returned to the client. The sender is charged Amount; the
+// recipient is transferred NetAmount.
+type FeeBreakdown struct {
+	Speed      string `json:"speed" firestore:"speed"`
+	Method     string `json:"method" firestore:"method"`
+	Payer      string `json:"payer" firestore:"payer"`
+	Flat       int64  `json:"flat" firestore:"flat"`
+	PercentBPS int64  `json:"percent_bps" firestore:"percent_bps"`
+	Fee        int64  `json:"fee" firestore:"fee"`
+	Amount     int64  `json:"amount" firestore:"amount"`
+	NetAmount  int64  `json:"net_amount" firestore:"net_amount"`
+}
+
+// ComputeFee prices sending amount cents, with the fee borne by payer. The
+// percentage is rounded half up to the cent. A recipient's fee never exceeds
+// the amount; a sender's is charged on top of it.
+func ComputeFee(amount int64, speed, method, payer string) *FeeBreakdown {
+	rule := feeRule(speed, method)
+	fee := rule.Flat + (amount*rule.PercentBPS+5000)/10000
+	b := &FeeBreakdown{
+		Speed:      speed,
+		Method:     method,
+		Payer:      payer,
+		Flat:       rule.Flat,
+		PercentBPS: rule.PercentBPS,
+	}
+	if payer == FeePayerSender {
+		b.Fee, b.Amount, b.NetAmount = fee, amount+fee, amount
+		return b
+	}
+	if fee > amount {
+		fee = amount
+	}
+	b.Payer = FeePayerRecipient
+	b.Fee, b.Amount, b.NetAmount = fee, amount, amount-fee
+	return b
+}
+
+// validFeePayer reports whether s is a fee_payer clients may pass
+func validFeePayer(s string) bool {
+	return s == FeePayerRecipient || s == FeePayerSender
+}
+
+// paymentFeeMethod tells whether a payment method is a bank account or a
+// card. Other providers only debit bank accounts; a Stripe payment without a
+// method yet is priced as a card, since the client may confirm it with one.
+func paymentFeeMethod(ctx context.Context, pp PaymentProvider, paymentMethodID string) (string, error) {
+	sc, ok := pp.(*StripeClient)
+	if !ok {
+		return FeeMethodBank, nil
+	}
+	if paymentMethodID == "" {
+		return FeeMethodCard, nil
+	}
+	pm, err := sc.GetPaymentMethod(ctx, paymentMethodID)
+	if err != nil {
+		return "", err
+	}
+	if pm.Type == stripe.PaymentMethodTypeUSBankAccount {
+		return FeeMethodBank, nil
+	}
+	return FeeMethodCard, nil
+}
+
+// validFundingSource reports whether s is a funding_source clients may pass
+func validFundingSource(s string) bool {
+	return s == FeeMethodBank || s == FeeMethodCard || s == FeeMethodWallet
+}
+
+// fundingPaymentMethodTypes are the Stripe payment method types a payment
+// funded from source may be confirmed with; nil leaves the provider default
+func fundingPaymentMethodTypes(source string) []string {
+	switch source {
+	case FeeMethodBank:
+		return []string{string(stripe.PaymentMethodTypeUSBankAccount)}
+	case FeeMethodCard:
+		return []string{string(stripe.PaymentMethodTypeCard)}
+	}
+	return nil
+}
+
+// transferAmount is what a payment pays its recipient: the charge less the
+// fee recorded in its PaymentIntent metadata. Any reserve comes out of this.
+func transferAmount(amount int64, meta map[string]string) int64 {
+	fee, _ := strconv.ParseInt(meta["fee_amount"], 10, 64)
+	return amount - fee
+}
+
+// transactionNetAmount is what a stored transaction transfers to its
+// recipient: its amount less any fee and any reserve held back
+func transactionNetAmount(data map[string]interface{}) int64 {
+	amount, _ := data["amount"].(int64)
+	fee, _ := data["fee_amount"].(int64)
+	reserve, _ := data["reserve_amount"].(int64)
+	return amount - fee - reserve
+}
+
+// GetFeeQuote prices a payment before it is sent:
+// ?amount=&speed=&funding_source=&fee_payer=&tip=. With ?recipient_user_id=
+// of a service provider it also returns tip suggestions on the amount.
+func GetFeeQuote(c *gin.Context) {
+	amount, err := strconv.ParseInt(c.Query("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be a positive number of cents"})
+		return
+	}
+	var tip int64
+	if v := c.Query("tip"); v != "" {
+		if tip, err = strconv.ParseInt(v, 10, 64); err != nil || tip < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tip must be a non-negative number of cents"})
+			return
+		}
+	}
+	speed := c.DefaultQuery("speed", FeeSpeedStandard)
+	if speed != FeeSpeedStandard && speed != FeeSpeedInstant {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "speed must be standard or instant"})
+		return
+	}
+	source := c.DefaultQuery("funding_source", FeeMethodBank)
+	if !validFundingSource(source) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "funding_source must be bank, card, or wallet"})
+		return
+	}
+	payer := c.DefaultQuery("fee_payer", FeePayerRecipient)
+	if !validFeePayer(payer) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fee_payer must be sender or recipient"})
+		return
+	}
+
+	resp := gin.H{"fee": ComputeFee(amount+tip, speed, source, payer), "tip": tip, "accepts_tips": false}
+	if recipient := c.Query("recipient_user_id"); recipient != "" {
+		if v, ok := c.Get("firestore"); ok && acceptsTips(c.Request.Context(), v.(*firestore.Client), recipient) {
+			resp["accepts_tips"] = true
+			resp["tip_suggestions"] = tipSuggestions(amount)
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ConfigFXRates holds the exchange rates cross-currency payments are quoted at
+const ConfigFXRates = "config/fx_rates"
+
+// FX quote statuses
+const (
+	FXQuoteOpen = "open"
+	FXQuoteUsed = "used"
+)
+
+// Defaults for FX_QUOTE_TTL and FX_RATE_MAX_AGE
+const (
+	defaultFXQuoteTTL   = 2 * time.Minute
+	defaultFXRateMaxAge = 24 * time.Hour
+)
+
+// Errors claimFXQuote returns for a quote that can't be used
+var (
+	ErrFXQuoteNotFound = errors.New("quote not found")
+	ErrFXQuoteUsed     = errors.New("quote was already used")
+	ErrFXQuoteExpired  = errors.New("quote has expired")
+	ErrFXQuoteMismatch = errors.New("quote is for a different amount, currency, speed, or funding source")
+)
+
+// FXRatesConfig is config/fx_rates. Rates are units of each currency per US
+// dollar; MarkupBPS is the platform's fee on a conversion.
+type FXRatesConfig struct {
+	Rates     map[string]float64 `json:"rates" firestore:"rates"`
+	MarkupBPS int64              `json:"markup_bps" firestore:"markup_bps"`
+	UpdatedBy string             `json:"updated_by,omitempty" firestore:"updated_by,omitempty"`
+	UpdatedAt time.Time          `json:"updated_at" firestore:"updated_at"`
+}
+
+// FXQuote locks an exchange rate for a sender for a short time, stored at
+// fx_quotes/{id}. The sender pays SourceAmount; Fee, the payment's usual fee
+// plus the conversion markup, is kept from it and the rest reaches the
+// recipient as TargetAmount.
+type FXQuote struct {
+	ID             string `json:"id" firestore:"-"`
+	UserID         string `json:"user_id" firestore:"user_id"`
+	SourceCurrency string `json:"source_currency" firestore:"source_currency"`
+	TargetCurrency string `json:"target_currency" firestore:"target_currency"`
+	SourceAmount   int64  `json:"source_amount" firestore:"source_amount"`
+	// Speed and FundingSource price the payment's fee; the payment must use them
+	Speed           string    `json:"speed" firestore:"speed"`
+	FundingSource   string    `json:"funding_source" firestore:"funding_source"`
+	PaymentFee      int64     `json:"payment_fee" firestore:"payment_fee"`
+	FXFee           int64     `json:"fx_fee" firestore:"fx_fee"`
+	Fee             int64     `json:"fee" firestore:"fee"`
+	TargetAmount    int64     `json:"target_amount" firestore:"target_amount"`
+	Rate            float64   `json:"rate" firestore:"rate"` // mid-market, target major units per source major unit
+	MarkupBPS       int64     `json:"markup_bps" firestore:"markup_bps"`
+	Status          string    `json:"status" firestore:"status"`
+	PaymentIntentID string    `json:"payment_intent_id,omitempty" firestore:"payment_intent_id,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at" firestore:"expires_at"`
+	CreatedAt       time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// fxDuration reads a duration setting such as FX_QUOTE_TTL, e.g. "2m"
+func fxDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// fxRate returns the mid-market rate from one currency to another
+func fxRate(cfg *FXRatesConfig, from, to string) (float64, bool) {
+	perUSD := func(code string) (float64, bool) {
+		if code == "usd" {
+			return 1, true
+		}
+		r, ok := cfg.Rates[code]
+		return r, ok && r > 0
+	}
+	f, ok := perUSD(from)
+	if !ok {
+		return 0, false
+	}
+	t, ok := perUSD(to)
+	if !ok {
+		return 0, false
+	}
+	return t / f, true
+}
+
+// priceFXQuote fills in a quote's fees and target amount. The markup is on
+// the source amount, rounded half up; the target amount is rounded down so
+// the platform never pays out more than it converted.
+func priceFXQuote(q *FXQuote) {
+	q.PaymentFee = ComputeFee(q.SourceAmount, q.Speed, q.FundingSource, FeePayerRecipient).Fee
+	q.FXFee = (q.SourceAmount*q.MarkupBPS + 5000) / 10000
+	q.Fee = min(q.PaymentFee+q.FXFee, q.SourceAmount)
+	source, target := currencies[q.SourceCurrency], currencies[q.TargetCurrency]
+	converted := source.FromMinor(q.SourceAmount-q.Fee) * q.Rate
+	q.TargetAmount = int64(math.Floor(converted*math.Pow10(target.Exponent) + 1e-9))
+}
+
+// GetFXQuote quotes sending ?amount= minor units of ?from= to a recipient who
+// receives ?to=, at ?speed= and from ?funding_source= as for GetFeeQuote. The
+// recipient pays the fee. The quote can be used once with
+// InitiateP2PPayment's quote_id until it expires.
+func GetFXQuote(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	amount, err := strconv.ParseInt(c.Query("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be a positive number of minor units"})
+		return
+	}
+	speed := c.DefaultQuery("speed", FeeSpeedStandard)
+	if speed != FeeSpeedStandard && speed != FeeSpeedInstant {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "speed must be standard or instant"})
+		return
+	}
+	source := c.DefaultQuery("funding_source", FeeMethodBank)
+	if source != FeeMethodBank && source != FeeMethodCard {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "funding_source must be bank or card"})
+		return
+	}
+	from := c.Query("from")
+	if !validatePaymentCurrency(c, uid, &from, amount) {
+		return
+	}
+	to := strings.ToLower(c.Query("to"))
+	if _, ok := lookupCurrency(to); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported target currency", "code": "unsupported_currency"})
+		return
+	}
+	if to == from {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must differ"})
+		return
+	}
+	ctx := c.Request.Context()
+	var cfg FXRatesConfig
+	if err := readConfig(ctx, fs, ConfigFXRates, &cfg); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load exchange rates"})
+		return
+	}
+	rate, ok := fxRate(&cfg, from, to)
+	if !ok || time.Since(cfg.UpdatedAt) > fxDuration("FX_RATE_MAX_AGE", defaultFXRateMaxAge) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Exchange rates for this currency aren't available right now", "code": "fx_rate_unavailable"})
+		return
+	}
+
+	now := time.Now()
+	ref := fs.Collection("fx_quotes").NewDoc()
+	q := &FXQuote{
+		ID:             ref.ID,
+		UserID:         uid,
+		SourceCurrency: from,
+		TargetCurrency: to,
+		SourceAmount:   amount,
+		Speed:          speed,
+		FundingSource:  source,
+		Rate:           rate,
+		MarkupBPS:      cfg.MarkupBPS,
+		Status:         FXQuoteOpen,
+		ExpiresAt:      now.Add(fxDuration("FX_QUOTE_TTL", defaultFXQuoteTTL)),
+		CreatedAt:      now,
+	}
+	priceFXQuote(q)
+	if q.TargetAmount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount is too small to convert"})
+		return
+	}
+	if _, err := ref.Set(ctx, q); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save quote"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"quote": q})
+}
+
+// claimFXQuote marks a sender's quote used for a payment of amount in
+// currency at speed from funding source method. A payment that then fails to
+// be created gives it back with releaseFXQuote.
+func claimFXQuote(ctx context.Context, fs *firestore.Client, quoteID, uid, currency string, amount int64, speed, method string) (*FXQuote, error) {
+	ref := fs.Collection("fx_quotes").Doc(quoteID)
+	var q FXQuote
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrFXQuoteNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&q); err != nil {
+			return err
+		}
+		switch {
+		case q.UserID != uid:
+			return ErrFXQuoteNotFound
+		case q.Status != FXQuoteOpen:
+			return ErrFXQuoteUsed
+		case !time.Now().Before(q.ExpiresAt):
+			return ErrFXQuoteExpired
+		case q.SourceCurrency != currency || q.SourceAmount != amount || q.Speed != speed || q.FundingSource != method:
+			return ErrFXQuoteMismatch
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "status", Value: FXQuoteUsed}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.ID = quoteID
+	q.Status = FXQuoteUsed
+	return &q, nil
+}
+
+// releaseFXQuote reopens a claimed quote whose payment was never created
+func releaseFXQuote(ctx context.Context, fs *firestore.Client, quoteID string) error {
+	_, err := fs.Collection("fx_quotes").Doc(quoteID).Update(ctx, []firestore.Update{{Path: "status", Value: FXQuoteOpen}})
+	return err
+}
+
+// feeBreakdown is the quote's fee as the payment it pays for records it
+func (q *FXQuote) feeBreakdown() *FeeBreakdown {
+	rule := feeRule(q.Speed, q.FundingSource)
+	return &FeeBreakdown{
+		Speed:      q.Speed,
+		Method:     q.FundingSource,
+		Payer:      FeePayerRecipient,
+		Flat:       rule.Flat,
+		PercentBPS: rule.PercentBPS,
+		Fee:        q.Fee,
+		Amount:     q.SourceAmount,
+		NetAmount:  q.SourceAmount - q.Fee,
+	}
+}
+
+// fxPaymentMetadata is what a cross-currency payment's PaymentIntent carries
+// so every path that transfers it pays out the quoted target amount
+func fxPaymentMetadata(q *FXQuote) map[string]string {
+	return map[string]string{
+		"fx_quote_id":        q.ID,
+		"fx_target_amount":   strconv.FormatInt(q.TargetAmount, 10),
+		"fx_target_currency": q.TargetCurrency,
+	}
+}
+
+// fxPaymentFields are the transaction fields of a cross-currency payment
+func fxPaymentFields(q *FXQuote) map[string]interface{} {
+	return map[string]interface{}{
+		"fx_quote_id":        q.ID,
+		"fx_rate":            q.Rate,
+		"fx_target_amount":   q.TargetAmount,
+		"fx_target_currency": q.TargetCurrency,
+	}
+}
+
+// fxTransferLeg reads the target amount and currency from a PaymentIntent's
+// metadata; ok is false for payments in a single currency
+func fxTransferLeg(meta map[string]string) (amount int64, currency string, ok bool) {
+	if meta["fx_quote_id"] == "" {
+		return 0, "", false
+	}
+	amount, err := strconv.ParseInt(meta["fx_target_amount"], 10, 64)
+	if err != nil || meta["fx_target_currency"] == "" {
+		return 0, "", false
+	}
+	return amount, meta["fx_target_currency"], true
+}
+
+// transactionTransferLeg is what a stored transaction transfers to its
+// recipient and in which currency: the quoted target amount for a
+// cross-currency payment, else its net amount
+func transactionTransferLeg(data map[string]interface{}) (int64, string) {
+	if amount, ok := data["fx_target_amount"].(int64); ok && stringField(data, "fx_target_currency") != "" {
+		return amount, stringField(data, "fx_target_currency")
+	}
+	return transactionNetAmount(data), stringField(data, "currency")
+}
+
+// FXConversionLedgerTransactions record converting what a recipient is owed
+// from the source currency to the target. Each currency's side is a
+// transaction of its own, balanced through the platform's FX position.
+func FXConversionLedgerTransactions(paymentIntentID, recipientUID string, sourceAmount int64, sourceCurrency string, targetAmount int64, targetCurrency string) []*LedgerTransaction {
+	return []*LedgerTransaction{
+		{
+			ID:        "fx_out_" + paymentIntentID,
+			Kind:      LedgerFXConversion,
+			Reference: paymentIntentID,
+			Currency:  sourceCurrency,
+			Entries: []LedgerEntry{
+				{Account: LedgerAccountUserPayable(recipientUID), Direction: Debit, Amount: sourceAmount},
+				{Account: LedgerAccountFXPosition, Direction: Credit, Amount: sourceAmount},
+			},
+		},
+		{
+			ID:        "fx_in_" + paymentIntentID,
+			Kind:      LedgerFXConversion,
+			Reference: paymentIntentID,
+			Currency:  targetCurrency,
+			Entries: []LedgerEntry{
+				{Account: LedgerAccountFXPosition, Direction: Debit, Amount: targetAmount},
+				{Account: LedgerAccountUserPayable(recipientUID), Direction: Credit, Amount: targetAmount},
+			},
+		},
+	}
+}
+
+// SetFXRates replaces the exchange rates and markup quotes are priced at
+func SetFXRates(c *gin.Context) {
+	var req struct {
+		Rates     map[string]float64 `json:"rates" binding:"required"`
+		MarkupBPS *int64             `json:"markup_bps" binding:"required,min=0,max=2000"`
+		Reason    string             `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rates := map[string]float64{}
+	for code, rate := range req.Rates {
+		code = strings.ToLower(code)
+		if _, ok := lookupCurrency(code); !ok || code == "usd" || rate <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid rate for %s; rates are positive units per US dollar", strings.ToUpper(code))})
+			return
+		}
+		rates[code] = rate
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	change, err := changeConfig(c.Request.Context(), fs, ConfigFXRates, adminID, req.Reason, "", func(*firestore.DocumentSnapshot) (interface{}, error) {
+		return FXRatesConfig{Rates: rates, MarkupBPS: *req.MarkupBPS, UpdatedBy: adminID, UpdatedAt: time.Now()}, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save exchange rates"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"change": change})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "log/slog"
     "net/http"
     "time"
 
@@ -13,6 +14,7 @@ func HealthCheck(c *gin.Context) {
         "status":    "healthy",
         "timestamp": time.Now().UTC(),
         "service":   "digital-payments-backend",
+        "region":    currentRegion,
     })
 }
 
@@ -44,7 +46,7 @@ func Login(c *gin.Context) {
     }
     if v, ok := c.Get("firestore"); ok {
         fs := v.(*firestore.Client)
-        _, _ = fs.Collection("users").Doc(uid).Set(c.Request.Context(), map[string]interface{}{
+        _, _ = UserDoc(c.Request.Context(), fs, uid).Set(c.Request.Context(), map[string]interface{}{
             "uid":        uid,
             "email":      email,
             "updated_at": time.Now(),
@@ -65,14 +67,37 @@ func Register(c *gin.Context) {
     if emailVal != nil {
         email = emailVal.(string)
     }
+    // Users who signed up from an invite link are connected to their inviter;
+    // country decides where the user's data is stored
+    var body struct {
+        InviteToken string `json:"invite_token"`
+        Country     string `json:"country"`
+    }
+    _ = c.ShouldBindJSON(&body)
     if v, ok := c.Get("firestore"); ok {
         fs := v.(*firestore.Client)
-        _, _ = fs.Collection("users").Doc(uid).Set(c.Request.Context(), map[string]interface{}{
+        region := currentRegion.Name
+        if dataResidencyEnabled() {
+            assigned, err := AssignUserRegion(c.Request.Context(), fs, uid, body.Country)
+            if err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign data region"})
+                return
+            }
+            region = assigned
+        }
+        _, _ = UserDoc(c.Request.Context(), fs, uid).Set(c.Request.Context(), map[string]interface{}{
             "uid":        uid,
             "email":      email,
+            "region":     region,
             "created_at": time.Now(),
             "updated_at": time.Now(),
         }, firestore.MergeAll)
+
+        if body.InviteToken != "" {
+            if _, err := AcceptInvite(c.Request.Context(), fs, body.InviteToken, uid); err != nil {
+                slog.ErrorContext(c.Request.Context(), "failed to accept invite", "component", "invites", "user_id", uid, "error", err)
+            }
+        }
     }
     c.JSON(http.StatusCreated, gin.H{"userID": uid, "email": email})
 }
\ No newline at end of file
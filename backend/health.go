@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/auth"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Dependency probe outcomes
+const (
+	ProbeOK            = "ok"
+	ProbeFailed        = "failed"
+	ProbeNotConfigured = "not_configured"
+)
+
+// probeTimeout bounds each dependency check so a hung provider can't stall readiness
+const probeTimeout = 3 * time.Second
+
+// readinessCacheTTL keeps orchestrator polling from turning into a Stripe
+// request every few seconds per instance
+const readinessCacheTTL = 10 * time.Second
+
+// DependencyStatus is one dependency's probe result
+type DependencyStatus struct {
+	Status    string `json:"status"`
+	Required  bool   `json:"required"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// dependencyProbe checks one dependency; a nil check means it isn't configured
+type dependencyProbe struct {
+	name     string
+	required bool
+	check    func(ctx context.Context) error
+}
+
+var readinessCache struct {
+	mu      sync.Mutex
+	at      time.Time
+	ready   bool
+	results map[string]DependencyStatus
+}
+
+// runProbes checks every dependency concurrently
+func runProbes(ctx context.Context, probes []dependencyProbe) (bool, map[string]DependencyStatus) {
+	results := make(map[string]DependencyStatus, len(probes))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		if p.check == nil {
+			results[p.name] = DependencyStatus{Status: ProbeNotConfigured, Required: p.required}
+			continue
+		}
+		wg.Add(1)
+		go func(p dependencyProbe) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			start := time.Now()
+			err := p.check(probeCtx)
+			result := DependencyStatus{Status: ProbeOK, Required: p.required, LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status, result.Error = ProbeFailed, err.Error()
+			}
+			mu.Lock()
+			results[p.name] = result
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, r := range results {
+		if r.Required && r.Status != ProbeOK {
+			ready = false
+		}
+	}
+	return ready, results
+}
+
+// readinessProbes builds the checks from the clients injected into the request
+func readinessProbes(c *gin.Context) []dependencyProbe {
+	probes := []dependencyProbe{
+		{name: "stripe", required: true},
+		{name: "firestore", required: true},
+		{name: "firebase_auth", required: true},
+		{name: "plaid", required: false},
+	}
+	if v, ok := c.Get("stripeClient"); ok {
+		sc := v.(*StripeClient)
+		probes[0].check = sc.CheckAPIKey
+	}
+	if v, ok := c.Get("firestore"); ok {
+		fs := v.(*firestore.Client)
+		probes[1].check = func(ctx context.Context) error {
+			// A missing document still proves the database answered
+			_, err := fs.Collection("health").Doc("probe").Get(ctx)
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+	}
+	if v, ok := c.Get("firebaseAuth"); ok {
+		fbAuth := v.(*auth.Client)
+		probes[2].check = func(ctx context.Context) error {
+			_, err := fbAuth.GetUser(ctx, "health-probe")
+			if auth.IsUserNotFound(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	if v, ok := c.Get("plaidClient"); ok {
+		pc := v.(*PlaidClient)
+		probes[3].check = pc.TestConnection
+	}
+	return probes
+}
+
+// HealthLive reports that the process is up and serving; it checks no dependencies
+func HealthLive(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive", "timestamp": time.Now().UTC()})
+}
+
+// HealthReady probes Stripe, Firestore, Firebase Auth, and Plaid and returns
+// 503 unless every required dependency answered, so an instance that failed
+// to initialize a client is taken out of rotation
+func HealthReady(c *gin.Context) {
+	readinessCache.mu.Lock()
+	defer readinessCache.mu.Unlock()
+	if time.Since(readinessCache.at) > readinessCacheTTL {
+		readinessCache.ready, readinessCache.results = runProbes(c.Request.Context(), readinessProbes(c))
+		readinessCache.at = time.Now()
+	}
+
+	code, state := http.StatusOK, "ready"
+	if !readinessCache.ready {
+		code, state = http.StatusServiceUnavailable, "not_ready"
+	}
+	c.JSON(code, gin.H{
+		"status":       state,
+		"dependencies": readinessCache.results,
+		"checked_at":   readinessCache.at.UTC(),
+		"region":       currentRegion.Name,
+	})
+}
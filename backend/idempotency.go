@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Idempotency record states
+const (
+	IdempotencyInProgress = "in_progress"
+	IdempotencyCompleted  = "completed"
+)
+
+const (
+	// idempotencyKeyTTL is how long a key's response is replayed (via a TTL policy on expire_at)
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyLease is how long a request holds its key before a retry may
+	// take it over, e.g. after the instance serving it died
+	idempotencyLease = 2 * time.Minute
+	// maxIdempotencyKeyLength bounds the header like Stripe does
+	maxIdempotencyKeyLength = 255
+)
+
+// IdempotencyRecord is stored at idempotency_keys/{hash of user and key}
+type IdempotencyRecord struct {
+	UserID       string    `firestore:"user_id"`
+	Key          string    `firestore:"key"`
+	Method       string    `firestore:"method"`
+	Route        string    `firestore:"route"`
+	Fingerprint  string    `firestore:"fingerprint"`
+	Status       string    `firestore:"status"`
+	StatusCode   int       `firestore:"status_code,omitempty"`
+	ContentType  string    `firestore:"content_type,omitempty"`
+	ResponseBody []byte    `firestore:"response_body,omitempty"`
+	LeaseUntil   time.Time `firestore:"lease_until"`
+	CreatedAt    time.Time `firestore:"created_at"`
+	ExpireAt     time.Time `firestore:"expire_at"`
+}
+
+// idempotencyDocID scopes keys to the caller so users cannot collide with each other
+func idempotencyDocID(uid, key string) string {
+	sum := sha256.Sum256([]byte(uid + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint identifies the request a key was first used for
+func requestFingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IdempotencyMiddleware makes POST payment endpoints safe to retry. The first
+// request with an Idempotency-Key runs and its response is stored; repeats of
+// the same request replay that response instead of running again, a repeat
+// while it is still running gets 409, and reusing the key for a different
+// request gets 422. Server errors are not stored, so they can be retried.
+func IdempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		v, ok := c.Get("firestore")
+		if key == "" || !ok {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+		fs := v.(*firestore.Client)
+		ctx := c.Request.Context()
+		uid := c.GetString("userID")
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ref := fs.Collection("idempotency_keys").Doc(idempotencyDocID(uid, key))
+		fingerprint := requestFingerprint(c.Request.Method, c.Request.URL.Path, body)
+		var existing *IdempotencyRecord
+		err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			existing = nil
+			now := time.Now()
+			snap, err := tx.Get(ref)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if err == nil {
+				var rec IdempotencyRecord
+				if err := snap.DataTo(&rec); err != nil {
+					return err
+				}
+				abandoned := rec.Status == IdempotencyInProgress && rec.LeaseUntil.Before(now)
+				if rec.Fingerprint != fingerprint || !abandoned {
+					existing = &rec
+					return nil
+				}
+			}
+			return tx.Set(ref, IdempotencyRecord{
+				UserID:      uid,
+				Key:         key,
+				Method:      c.Request.Method,
+				Route:       c.FullPath(),
+				Fingerprint: fingerprint,
+				Status:      IdempotencyInProgress,
+				LeaseUntil:  now.Add(idempotencyLease),
+				CreatedAt:   now,
+				ExpireAt:    now.Add(idempotencyKeyTTL),
+			})
+		})
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+			return
+		}
+
+		switch {
+		case existing == nil:
+		case existing.Fingerprint != fingerprint:
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			return
+		case existing.Status == IdempotencyInProgress:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			return
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(existing.StatusCode, existing.ContentType, existing.ResponseBody)
+			c.Abort()
+			return
+		}
+
+		writer := &captureWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = writer
+
+		c.Next()
+
+		// Finish the record even if the client went away
+		saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if writer.Status() >= http.StatusInternalServerError {
+			if _, err := ref.Delete(saveCtx); err != nil {
+				slog.ErrorContext(saveCtx, "failed to release idempotency key", "component", "idempotency", "user_id", uid, "error", err)
+			}
+			return
+		}
+		if _, err := ref.Set(saveCtx, map[string]interface{}{
+			"status":        IdempotencyCompleted,
+			"status_code":   writer.Status(),
+			"content_type":  writer.Header().Get("Content-Type"),
+			"response_body": writer.body.Bytes(),
+		}, firestore.MergeAll); err != nil {
+			slog.ErrorContext(saveCtx, "failed to store idempotent response", "component", "idempotency", "user_id", uid, "error", err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// KYCClaim is the Firebase custom claim mirroring users/{uid}.kyc_level, so
+// clients and security rules can read the level from the ID token
+const KYCClaim = "kyc_level"
+
+// setKYCClaim sets the kyc_level custom claim, keeping the user's other
+// claims. The app sees it once it refreshes its ID token.
+func setKYCClaim(ctx context.Context, fbAuth *auth.Client, uid, level string) error {
+	if fbAuth == nil {
+		return nil
+	}
+	user, err := fbAuth.GetUser(ctx, uid)
+	if err != nil {
+		return fmt.Errorf("failed to get user %s: %w", uid, err)
+	}
+	claims := map[string]interface{}{}
+	for k, v := range user.CustomClaims {
+		claims[k] = v
+	}
+	if claims[KYCClaim] == level {
+		return nil
+	}
+	claims[KYCClaim] = level
+	if err := fbAuth.SetCustomUserClaims(ctx, uid, claims); err != nil {
+		return fmt.Errorf("failed to set claims for %s: %w", uid, err)
+	}
+	return nil
+}
+
+// CreateIdentitySession starts Stripe Identity verification for the caller,
+// or returns their session awaiting input so an abandoned attempt can be
+// finished. The app opens it with the Identity SDK using the ephemeral key
+// (pass stripe_version, the SDK's API version) or redirects to url.
+func CreateIdentitySession(c *gin.Context) {
+	var req struct {
+		ReturnURL     string `json:"return_url"`
+		StripeVersion string `json:"stripe_version"`
+	}
+	_ = c.ShouldBindJSON(&req)
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	stripeClient, exists := c.Get("stripeClient")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+		return
+	}
+	sc := stripeClient.(*StripeClient)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	data := doc.Data()
+	if stringField(data, "kyc_level") == KYCVerified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your identity is already verified", "kyc_level": KYCVerified})
+		return
+	}
+
+	var vs *stripe.IdentityVerificationSession
+	if sessionID := stringField(data, "identity_session_id"); sessionID != "" {
+		existing, err := sc.GetVerificationSession(ctx, sessionID)
+		if err != nil {
+			sc.LogAPIError(ctx, "get_verification_session", uid, err)
+		} else if existing.Status == stripe.IdentityVerificationSessionStatusProcessing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Your verification is being reviewed", "status": existing.Status})
+			return
+		} else if existing.Status == stripe.IdentityVerificationSessionStatusRequiresInput {
+			vs = existing
+		}
+	}
+	if vs == nil {
+		vs, err = sc.CreateVerificationSession(ctx, uid, req.ReturnURL)
+		if err != nil {
+			sc.LogAPIError(ctx, "create_verification_session", uid, err)
+			c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to start verification", err))
+			return
+		}
+		if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+			"identity_session_id": vs.ID,
+			"identity_status":     string(vs.Status),
+			"identity_updated_at": time.Now(),
+		}); err != nil {
+			slog.ErrorContext(ctx, "failed to save verification session", "component", "identity", "user_id", uid, "session", vs.ID, "error", err)
+		}
+		sc.LogAPIInteraction(ctx, "create_verification_session", uid, true, fmt.Sprintf("Verification session: %s", vs.ID))
+	}
+
+	resp := gin.H{
+		"verification_session_id": vs.ID,
+		"status":                  vs.Status,
+		"client_secret":           vs.ClientSecret,
+		"url":                     vs.URL,
+	}
+	if req.StripeVersion != "" {
+		key, err := sc.CreateVerificationSessionKey(ctx, vs.ID, req.StripeVersion)
+		if err != nil {
+			sc.LogAPIError(ctx, "create_ephemeral_key", uid, err)
+			c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to start verification", err))
+			return
+		}
+		resp["ephemeral_key_secret"] = key.Secret
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// processIdentityEvent applies a Stripe Identity outcome: a verified session
+// raises the user to the verified KYC level and its claim; one needing input
+// records why, so the app can ask them to try again.
+func processIdentityEvent(ctx context.Context, d *webhookDeps, event stripe.Event) error {
+	var vs stripe.IdentityVerificationSession
+	if err := json.Unmarshal(event.Data.Raw, &vs); err != nil {
+		return nil
+	}
+	uid := vs.Metadata["user_id"]
+	if uid == "" || d.fs == nil {
+		return nil
+	}
+
+	fields := map[string]interface{}{
+		"identity_session_id": vs.ID,
+		"identity_status":     string(vs.Status),
+		"identity_updated_at": time.Now(),
+	}
+	outcome := &KYCVerification{UserID: uid, Source: KYCSourceStripeIdentity, Reference: vs.ID}
+	switch event.Type {
+	case "identity.verification_session.verified":
+		outcome.Passed = true
+		outcome.Level = KYCVerified
+		fields["identity_error_code"] = firestore.Delete
+	case "identity.verification_session.requires_input":
+		if vs.LastError == nil {
+			// Created and not yet submitted
+			return nil
+		}
+		outcome.Reason = string(vs.LastError.Code)
+		fields["identity_error_code"] = string(vs.LastError.Code)
+	default:
+		return nil
+	}
+	if err := SaveUserFields(ctx, d.fs, uid, fields); err != nil {
+		return err
+	}
+	level, err := RecordKYCOutcome(ctx, d.fs, outcome)
+	if err != nil {
+		return err
+	}
+	if err := setKYCClaim(ctx, d.auth, uid, level); err != nil {
+		return err
+	}
+
+	if outcome.Passed {
+		NotifyUser(ctx, d.fs, uid, NotificationIdentityVerification, "Identity verified",
+			"Your identity is verified and your higher payment limits are active", map[string]interface{}{"kyc_level": level})
+	} else {
+		NotifyUser(ctx, d.fs, uid, NotificationIdentityVerification, "Verification unsuccessful",
+			"We couldn't verify your identity. Please try again.", map[string]interface{}{"code": outcome.Reason, "reason": vs.LastError.Reason})
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Incident severities, least to most severe
+const (
+	IncidentInfo     = "info"
+	IncidentWarning  = "warning"
+	IncidentCritical = "critical"
+)
+
+var incidentSeverityRank = map[string]int{IncidentInfo: 0, IncidentWarning: 1, IncidentCritical: 2}
+
+// incidentFeatures are the parts of the app an incident can be tagged with;
+// the kill switch names are among them
+var incidentFeatures = map[string]bool{
+	KillSwitchPayments:  true,
+	KillSwitchTransfers: true,
+	KillSwitchPayouts:   true,
+	KillSwitchWallet:    true,
+	"bank_linking":      true,
+	"identity":          true,
+	"notifications":     true,
+	"login":             true,
+}
+
+// incidentUpcomingWindow is how far ahead scheduled maintenance is announced
+const incidentUpcomingWindow = 7 * 24 * time.Hour
+
+// incidentCacheTTL is how long each instance serves /status from memory
+const incidentCacheTTL = 30 * time.Second
+
+// Incident is a status message shown in the app, such as scheduled
+// maintenance or ACH delays at the Fed, stored at incidents/{id}. It shows
+// from StartsAt until it is resolved or EndsAt passes.
+type Incident struct {
+	ID         string     `json:"id" firestore:"-"`
+	Title      string     `json:"title" firestore:"title"`
+	Message    string     `json:"message" firestore:"message"`
+	Severity   string     `json:"severity" firestore:"severity"`
+	Features   []string   `json:"features" firestore:"features"`
+	StartsAt   time.Time  `json:"starts_at" firestore:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at,omitempty" firestore:"ends_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty" firestore:"resolved_at"` // stored as null while open, so open ones can be queried
+	CreatedBy  string     `json:"created_by" firestore:"created_by"`
+	CreatedAt  time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" firestore:"updated_at"`
+}
+
+// activeAt reports whether the incident shows at now
+func (i *Incident) activeAt(now time.Time) bool {
+	return i.ResolvedAt == nil && !i.StartsAt.After(now) && (i.EndsAt == nil || i.EndsAt.After(now))
+}
+
+// upcomingAt reports whether the incident is scheduled to start soon after now
+func (i *Incident) upcomingAt(now time.Time) bool {
+	return i.ResolvedAt == nil && i.StartsAt.After(now) && i.StartsAt.Before(now.Add(incidentUpcomingWindow))
+}
+
+// incidentCache holds unresolved incidents, reloaded once older than the TTL
+var incidentCache struct {
+	mu        sync.Mutex
+	incidents []Incident
+	loadedAt  time.Time
+}
+
+// loadOpenIncidents returns unresolved incidents, from the cache when it is
+// fresh. If Firestore can't be read the previous incidents are kept.
+func loadOpenIncidents(ctx context.Context, fs *firestore.Client) []Incident {
+	incidentCache.mu.Lock()
+	defer incidentCache.mu.Unlock()
+	if incidentCache.incidents != nil && time.Since(incidentCache.loadedAt) < incidentCacheTTL {
+		return incidentCache.incidents
+	}
+	docs, err := fs.Collection("incidents").Where("resolved_at", "==", nil).Documents(ctx).GetAll()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to load incidents", "component", "incidents", "error", err)
+		return incidentCache.incidents
+	}
+	incidents := make([]Incident, 0, len(docs))
+	for _, doc := range docs {
+		var inc Incident
+		if err := doc.DataTo(&inc); err != nil {
+			continue
+		}
+		inc.ID = doc.Ref.ID
+		incidents = append(incidents, inc)
+	}
+	incidentCache.incidents = incidents
+	incidentCache.loadedAt = time.Now()
+	return incidents
+}
+
+// invalidateIncidentCache makes this instance's next /status read Firestore
+func invalidateIncidentCache() {
+	incidentCache.mu.Lock()
+	defer incidentCache.mu.Unlock()
+	incidentCache.incidents = nil
+}
+
+// GetStatus returns the incidents the app should show, most severe first,
+// maintenance starting within a week, and the features turned off by kill
+// switches. It needs no auth so the app can show it before sign-in.
+func GetStatus(c *gin.Context) {
+	active, upcoming := []Incident{}, []Incident{}
+	if v, ok := c.Get("firestore"); ok {
+		now := time.Now()
+		for _, inc := range loadOpenIncidents(c.Request.Context(), v.(*firestore.Client)) {
+			switch {
+			case inc.activeAt(now):
+				active = append(active, inc)
+			case inc.upcomingAt(now):
+				upcoming = append(upcoming, inc)
+			}
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if a, b := incidentSeverityRank[active[i].Severity], incidentSeverityRank[active[j].Severity]; a != b {
+			return a > b
+		}
+		return active[i].StartsAt.After(active[j].StartsAt)
+	})
+	sort.Slice(upcoming, func(i, j int) bool { return upcoming[i].StartsAt.Before(upcoming[j].StartsAt) })
+
+	disabled := []string{}
+	for name := range killSwitchNames {
+		if killSwitchOn(name) {
+			disabled = append(disabled, name)
+		}
+	}
+	sort.Strings(disabled)
+	respondWithETag(c, gin.H{"incidents": active, "upcoming": upcoming, "disabled_features": disabled})
+}
+
+// incidentRequest is the body for creating or updating an incident
+type incidentRequest struct {
+	Title    string     `json:"title" binding:"required,max=80"`
+	Message  string     `json:"message" binding:"required,max=500"`
+	Severity string     `json:"severity" binding:"required,oneof=info warning critical"`
+	Features []string   `json:"features"`
+	StartsAt *time.Time `json:"starts_at"` // defaults to now
+	EndsAt   *time.Time `json:"ends_at"`
+}
+
+// validate checks an incident request, writing the error response if it fails
+func (r *incidentRequest) validate(c *gin.Context) bool {
+	for _, f := range r.Features {
+		if !incidentFeatures[f] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown feature " + f})
+			return false
+		}
+	}
+	if r.StartsAt != nil && r.EndsAt != nil && !r.EndsAt.After(*r.StartsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be after starts_at"})
+		return false
+	}
+	return true
+}
+
+// apply copies the request onto an incident
+func (r *incidentRequest) apply(inc *Incident, now time.Time) {
+	inc.Title = r.Title
+	inc.Message = r.Message
+	inc.Severity = r.Severity
+	inc.Features = r.Features
+	if inc.Features == nil {
+		inc.Features = []string{}
+	}
+	if r.StartsAt != nil {
+		inc.StartsAt = *r.StartsAt
+	} else if inc.StartsAt.IsZero() {
+		inc.StartsAt = now
+	}
+	inc.EndsAt = r.EndsAt
+	inc.UpdatedAt = now
+}
+
+// ListIncidents returns the most recent incidents, resolved ones included
+func ListIncidents(c *gin.Context) {
+	_, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("incidents").OrderBy("created_at", firestore.Desc).Limit(100).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load incidents"})
+		return
+	}
+	incidents := make([]Incident, 0, len(docs))
+	for _, doc := range docs {
+		var inc Incident
+		if err := doc.DataTo(&inc); err != nil {
+			continue
+		}
+		inc.ID = doc.Ref.ID
+		incidents = append(incidents, inc)
+	}
+	c.JSON(http.StatusOK, gin.H{"incidents": incidents})
+}
+
+// CreateIncident posts a status message. Other instances show it within
+// the cache TTL.
+func CreateIncident(c *gin.Context) {
+	var req incidentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.validate(c) {
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	now := time.Now()
+	ref := fs.Collection("incidents").NewDoc()
+	inc := &Incident{ID: ref.ID, CreatedBy: adminID, CreatedAt: now}
+	req.apply(inc, now)
+	if _, err := ref.Set(ctx, inc); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save incident"})
+		return
+	}
+	invalidateIncidentCache()
+	logIncidentAccess(ctx, fs, adminID, inc.ID)
+	c.JSON(http.StatusCreated, inc)
+}
+
+// UpdateIncident replaces an open incident's message, severity, features,
+// or window
+func UpdateIncident(c *gin.Context) {
+	var req incidentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.validate(c) {
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	inc, ok := loadIncident(c, fs)
+	if !ok {
+		return
+	}
+	if inc.ResolvedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Incident is already resolved"})
+		return
+	}
+	req.apply(inc, time.Now())
+	if _, err := fs.Collection("incidents").Doc(inc.ID).Set(ctx, inc); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save incident"})
+		return
+	}
+	invalidateIncidentCache()
+	logIncidentAccess(ctx, fs, adminID, inc.ID)
+	c.JSON(http.StatusOK, inc)
+}
+
+// ResolveIncident takes an incident down
+func ResolveIncident(c *gin.Context) {
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	inc, ok := loadIncident(c, fs)
+	if !ok {
+		return
+	}
+	if inc.ResolvedAt == nil {
+		now := time.Now()
+		inc.ResolvedAt, inc.UpdatedAt = &now, now
+		if _, err := fs.Collection("incidents").Doc(inc.ID).Update(ctx, []firestore.Update{
+			{Path: "resolved_at", Value: now},
+			{Path: "updated_at", Value: now},
+		}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve incident"})
+			return
+		}
+		invalidateIncidentCache()
+		logIncidentAccess(ctx, fs, adminID, inc.ID)
+	}
+	c.JSON(http.StatusOK, inc)
+}
+
+// loadIncident loads the incident named in the path, writing the error
+// response if it can't
+func loadIncident(c *gin.Context, fs *firestore.Client) (*Incident, bool) {
+	doc, err := getDocument(c.Request.Context(), fs.Collection("incidents").Doc(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return nil, false
+	}
+	var inc Incident
+	if err := doc.DataTo(&inc); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read incident"})
+		return nil, false
+	}
+	inc.ID = doc.Ref.ID
+	return &inc, true
+}
+
+func logIncidentAccess(ctx context.Context, fs *firestore.Client, adminID, incidentID string) {
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "incident", SubjectID: incidentID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log incident access", "component", "incidents", "incident_id", incidentID, "error", err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// States of the fee debited for an instant payout
+const (
+	PayoutFeeCollected = "collected"
+	PayoutFeeFailed    = "failed"
+	PayoutFeeRefunded  = "refunded"
+)
+
+// Notification types for instant payouts
+const (
+	NotificationInstantPayoutPaid   = "instant_payout_paid"
+	NotificationInstantPayoutFailed = "instant_payout_failed"
+)
+
+// Why a recipient can't pay out instantly
+const (
+	InstantPayoutNoAccount      = "no_account"
+	InstantPayoutsDisabled      = "payouts_disabled"
+	InstantPayoutRiskTier       = "risk_tier"
+	InstantPayoutNoEligibleCard = "no_eligible_card"
+	InstantPayoutNoBalance      = "no_instant_balance"
+)
+
+// InstantPayoutCard is a debit card a recipient can pay out to
+type InstantPayoutCard struct {
+	ID    string `json:"id"`
+	Brand string `json:"brand"`
+	Last4 string `json:"last4"`
+}
+
+// InstantPayoutEligibility is whether a recipient can pay out instantly now
+type InstantPayoutEligibility struct {
+	Eligible         bool                `json:"eligible"`
+	Reason           string              `json:"reason,omitempty"`
+	InstantAvailable int64               `json:"instant_available"`
+	Cards            []InstantPayoutCard `json:"cards"`
+	accountID        string
+}
+
+// InstantPayoutFeeLedgerTransaction records an instant payout's fee debited
+// from the recipient's connected account to the platform
+func InstantPayoutFeeLedgerTransaction(transferID string, fee int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "instant_payout_fee_" + transferID,
+		Kind:      LedgerInstantPayoutFee,
+		Reference: transferID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountStripeBalance, Direction: Debit, Amount: fee},
+			{Account: LedgerAccountFeeRevenue, Direction: Credit, Amount: fee},
+		},
+	}
+}
+
+// InstantPayoutFeeRefundLedgerTransaction records returning the fee of a
+// failed instant payout
+func InstantPayoutFeeRefundLedgerTransaction(transferID string, fee int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "instant_payout_fee_refund_" + transferID,
+		Kind:      LedgerInstantPayoutFeeRefund,
+		Reference: transferID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountFeeRevenue, Direction: Debit, Amount: fee},
+			{Account: LedgerAccountStripeBalance, Direction: Credit, Amount: fee},
+		},
+	}
+}
+
+// checkInstantPayoutEligibility decides whether a recipient can pay out
+// instantly: they need a connected account with payouts enabled, a debit
+// card that supports instant payouts, and an instantly available balance.
+// Recipients whose risk tier delays payouts can't skip the delay.
+func checkInstantPayoutEligibility(ctx context.Context, sc *StripeClient, fs *firestore.Client, uid string) (*InstantPayoutEligibility, error) {
+	e := &InstantPayoutEligibility{Cards: []InstantPayoutCard{}}
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return nil, err
+	}
+	e.accountID = stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id"))
+	if e.accountID == "" {
+		e.Reason = InstantPayoutNoAccount
+		return e, nil
+	}
+	if riskTierTerms[recipientRiskTier(ctx, fs, uid)].PayoutDelayDays > 0 {
+		e.Reason = InstantPayoutRiskTier
+		return e, nil
+	}
+	acct, err := sc.GetConnectAccountStatus(ctx, e.accountID)
+	if err != nil {
+		return nil, err
+	}
+	if !acct.PayoutsEnabled {
+		e.Reason = InstantPayoutsDisabled
+		return e, nil
+	}
+	cards, err := sc.InstantPayoutCards(ctx, e.accountID)
+	if err != nil {
+		return nil, err
+	}
+	for _, card := range cards {
+		e.Cards = append(e.Cards, InstantPayoutCard{ID: card.ID, Brand: string(card.Brand), Last4: card.Last4})
+	}
+	if len(e.Cards) == 0 {
+		e.Reason = InstantPayoutNoEligibleCard
+		return e, nil
+	}
+	if e.InstantAvailable, err = sc.InstantAvailableBalance(ctx, e.accountID, payoutCurrency); err != nil {
+		return nil, err
+	}
+	if e.InstantAvailable <= 0 {
+		e.Reason = InstantPayoutNoBalance
+		return e, nil
+	}
+	e.Eligible = true
+	return e, nil
+}
+
+// GetInstantPayoutEligibility tells a recipient whether and where they can
+// pay out instantly, and with ?amount= what it would cost
+func GetInstantPayoutEligibility(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	e, err := checkInstantPayoutEligibility(ctx, sc, fs, uid)
+	if err != nil {
+		sc.LogAPIError(ctx, "instant_payout_eligibility", uid, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to check instant payout eligibility"})
+		return
+	}
+	resp := gin.H{"eligibility": e}
+	if amount, err := strconv.ParseInt(c.Query("amount"), 10, 64); err == nil && amount > 0 {
+		resp["fee"] = ComputeFee(amount, FeeSpeedInstant, FeeMethodPayout, FeePayerRecipient)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// CreateInstantPayout pays a recipient's received funds out to their debit
+// card within minutes, less the instant payout fee
+func CreateInstantPayout(c *gin.Context) {
+	var req struct {
+		Amount int64  `json:"amount" binding:"required,min=100"` // cents, fee included
+		CardID string `json:"card_id"`                           // defaults to the first eligible card
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	e, err := checkInstantPayoutEligibility(ctx, sc, fs, uid)
+	if err != nil {
+		sc.LogAPIError(ctx, "instant_payout_eligibility", uid, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to check instant payout eligibility"})
+		return
+	}
+	if !e.Eligible {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Instant payouts aren't available for your account", "code": e.Reason})
+		return
+	}
+	if req.Amount > e.InstantAvailable {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": fmt.Sprintf("Only %s is available for instant payout", currencyOrDefault(payoutCurrency).Format(e.InstantAvailable)), "instant_available": e.InstantAvailable})
+		return
+	}
+	card := e.Cards[0]
+	if req.CardID != "" {
+		found := false
+		for _, cd := range e.Cards {
+			if cd.ID == req.CardID {
+				card, found = cd, true
+			}
+		}
+		if !found {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "That card can't receive instant payouts"})
+			return
+		}
+	}
+	fee := ComputeFee(req.Amount, FeeSpeedInstant, FeeMethodPayout, FeePayerRecipient)
+	if fee.NetAmount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount doesn't cover the instant payout fee", "fee": fee})
+		return
+	}
+
+	now := time.Now()
+	ref := fs.Collection("payouts").NewDoc()
+	p := &AccountPayout{
+		ID:        ref.ID,
+		UserID:    uid,
+		AccountID: e.accountID,
+		Amount:    req.Amount,
+		Fee:       fee.Fee,
+		NetAmount: fee.NetAmount,
+		Currency:  payoutCurrency,
+		Method:    PayoutMethodInstant,
+		Trigger:   PayoutTriggerUser,
+		CardID:    card.ID,
+		CardBrand: card.Brand,
+		CardLast4: card.Last4,
+		Status:    PayoutPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := ref.Set(ctx, p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payout"})
+		return
+	}
+
+	meta := map[string]string{"user_id": uid, "payout_id": p.ID}
+	po, err := sc.CreateInstantPayout(ctx, e.accountID, card.ID, p.NetAmount, p.Currency, meta, "instant_payout_"+p.ID)
+	if err != nil {
+		sc.LogAPIError(ctx, "instant_payout", uid, err)
+		if _, serr := ref.Update(ctx, []firestore.Update{
+			{Path: "status", Value: PayoutFailed},
+			{Path: "failure_message", Value: err.Error()},
+			{Path: "updated_at", Value: time.Now()},
+		}); serr != nil {
+			slog.ErrorContext(ctx, "failed to record payout failure", "component", "payouts", "payout_id", p.ID, "error", serr)
+		}
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Instant payout failed; your funds were not moved", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "instant_payout", uid, true, fmt.Sprintf("Payout: %s", po.ID))
+	p.StripePayoutID = po.ID
+	if po.ArrivalDate > 0 {
+		p.ArrivalAt = time.Unix(po.ArrivalDate, 0)
+	}
+
+	// Taken after the payout so a failed debit never costs a payout; a failed
+	// fee is left for admins to collect
+	if p.Fee > 0 {
+		tr, err := sc.DebitConnectedAccount(ctx, e.accountID, p.Fee, p.Currency, meta, "instant_payout_fee_"+p.ID)
+		if err != nil {
+			sc.LogAPIError(ctx, "instant_payout_fee", uid, err)
+			p.FeeStatus = PayoutFeeFailed
+		} else {
+			p.FeeStatus, p.FeeTransferID = PayoutFeeCollected, tr.ID
+			postLedger(c, sc, uid, InstantPayoutFeeLedgerTransaction(tr.ID, p.Fee, p.Currency))
+		}
+	}
+	p.UpdatedAt = time.Now()
+	if _, err := ref.Set(ctx, p); err != nil {
+		slog.ErrorContext(ctx, "failed to record payout", "component", "payouts", "payout_id", p.ID, "error", err)
+	}
+	c.JSON(http.StatusCreated, p)
+}
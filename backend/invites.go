@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Invite kinds
+const (
+	InviteReferral = "referral"
+	InvitePayment  = "payment"
+)
+
+// Invite statuses, in the order an invite converts
+const (
+	InviteCreated  = "created"
+	InviteOpened   = "opened"
+	InviteAccepted = "accepted"
+)
+
+// NotificationInviteAccepted tells an inviter their invite converted
+const NotificationInviteAccepted = "invite_accepted"
+
+// inviteTTL is how long an invite link stays valid
+const inviteTTL = 30 * 24 * time.Hour
+
+// Invite is stored at invites/{id}
+type Invite struct {
+	ID            string    `json:"id" firestore:"-"`
+	InviterUserID string    `json:"inviter_user_id" firestore:"inviter_user_id"`
+	Kind          string    `json:"kind" firestore:"kind"`
+	Email         string    `json:"email,omitempty" firestore:"email,omitempty"`
+	Phone         string    `json:"phone,omitempty" firestore:"phone,omitempty"`
+	TransactionID string    `json:"transaction_id,omitempty" firestore:"transaction_id,omitempty"`
+	Status        string    `json:"status" firestore:"status"`
+	OpenCount     int       `json:"open_count" firestore:"open_count"`
+	InviteeUserID string    `json:"invitee_user_id,omitempty" firestore:"invitee_user_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at" firestore:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at" firestore:"expires_at"`
+	OpenedAt      time.Time `json:"opened_at,omitempty" firestore:"opened_at,omitempty"`
+	AcceptedAt    time.Time `json:"accepted_at,omitempty" firestore:"accepted_at,omitempty"`
+}
+
+// inviteSigningKey loads the HMAC key invite links are signed with
+func inviteSigningKey() ([]byte, error) {
+	key := os.Getenv("INVITE_SIGNING_SECRET")
+	if len(key) < 32 {
+		return nil, fmt.Errorf("INVITE_SIGNING_SECRET must be at least 32 bytes")
+	}
+	return []byte(key), nil
+}
+
+// signInvite returns a signed token naming the invite and its inviter
+func signInvite(inv *Invite) (string, error) {
+	key, err := inviteSigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ID:        inv.ID,
+		Subject:   inv.InviterUserID,
+		Audience:  jwt.ClaimStrings{"invite"},
+		IssuedAt:  jwt.NewNumericDate(inv.CreatedAt),
+		ExpiresAt: jwt.NewNumericDate(inv.ExpiresAt),
+	})
+	return token.SignedString(key)
+}
+
+// parseInviteToken verifies a token and returns the invite ID it names
+func parseInviteToken(tokenString string) (string, error) {
+	key, err := inviteSigningKey()
+	if err != nil {
+		return "", err
+	}
+	claims := &jwt.RegisteredClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience("invite"))
+	if err != nil {
+		return "", err
+	}
+	return claims.ID, nil
+}
+
+// inviteLinks builds the app deep link and the web fallback for a token
+func inviteLinks(token string) gin.H {
+	links := gin.H{"deep_link": "digitalpayments://invite?token=" + url.QueryEscape(token)}
+	if base := os.Getenv("INVITE_LINK_BASE_URL"); base != "" {
+		links["web_link"] = base + "?token=" + url.QueryEscape(token)
+	}
+	return links
+}
+
+// connectContacts adds each user to the other's contacts
+func connectContacts(ctx context.Context, fs *firestore.Client, a, b, source string) error {
+	now := time.Now()
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		_, err := UserDoc(ctx, fs, pair[0]).Collection("contacts").Doc(pair[1]).Set(ctx, map[string]interface{}{
+			"user_id":    pair[1],
+			"source":     source,
+			"created_at": now,
+			"updated_at": now,
+		}, firestore.MergeAll)
+		if err != nil {
+			return fmt.Errorf("failed to connect contacts %s and %s: %w", pair[0], pair[1], err)
+		}
+	}
+	return nil
+}
+
+// errInviteUnusable is returned when an invite cannot be accepted by the caller
+var errInviteUnusable = errors.New("invite is expired, already accepted, or the caller's own")
+
+// AcceptInvite marks an invite converted by uid and connects inviter and invitee as contacts
+func AcceptInvite(ctx context.Context, fs *firestore.Client, token, uid string) (*Invite, error) {
+	inviteID, err := parseInviteToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite token: %w", err)
+	}
+	ref := fs.Collection("invites").Doc(inviteID)
+	inv := &Invite{}
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(inv); err != nil {
+			return err
+		}
+		if inv.Status == InviteAccepted || inv.InviterUserID == uid || time.Now().After(inv.ExpiresAt) {
+			return errInviteUnusable
+		}
+		inv.Status = InviteAccepted
+		inv.InviteeUserID = uid
+		inv.AcceptedAt = time.Now()
+		return tx.Set(ref, map[string]interface{}{
+			"status":          inv.Status,
+			"invitee_user_id": uid,
+			"accepted_at":     inv.AcceptedAt,
+		}, firestore.MergeAll)
+	})
+	if err != nil {
+		return nil, err
+	}
+	inv.ID = inviteID
+
+	if err := connectContacts(ctx, fs, inv.InviterUserID, uid, "invite"); err != nil {
+		return inv, err
+	}
+	if inv.Kind == InvitePayment && inv.TransactionID != "" {
+		if err := ClaimEscrowedPayment(ctx, fs, inv.TransactionID, uid); err != nil {
+			return inv, err
+		}
+	}
+	NotifyUser(ctx, fs, inv.InviterUserID, NotificationInviteAccepted, "Your invite was accepted",
+		"Someone you invited just joined. They've been added to your contacts.",
+		map[string]interface{}{"invite_id": inviteID, "user_id": uid})
+	return inv, nil
+}
+
+// CreateInvite creates a signed invite link for a referral or a pending payment
+func CreateInvite(c *gin.Context) {
+	var req struct {
+		Kind          string `json:"kind" binding:"required,oneof=referral payment"`
+		Email         string `json:"email"`
+		Phone         string `json:"phone"`
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	if req.Kind == InvitePayment {
+		if req.TransactionID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "transaction_id is required for payment invites"})
+			return
+		}
+		doc, err := fs.Collection("transactions").Doc(req.TransactionID).Get(ctx)
+		if err != nil || !doc.Exists() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+			return
+		}
+		if sender, _ := doc.Data()["sender_user_id"].(string); sender != uid {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can invite for a payment"})
+			return
+		}
+	}
+
+	now := time.Now()
+	inv := &Invite{
+		ID:            uuid.NewString(),
+		InviterUserID: uid,
+		Kind:          req.Kind,
+		Email:         normalizeEmail(req.Email),
+		Phone:         normalizePhone(req.Phone),
+		TransactionID: req.TransactionID,
+		Status:        InviteCreated,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(inviteTTL),
+	}
+	token, err := signInvite(inv)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invites are not configured"})
+		return
+	}
+	if _, err := fs.Collection("invites").Doc(inv.ID).Set(ctx, inv); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+		return
+	}
+
+	resp := inviteLinks(token)
+	resp["invite"] = inv
+	resp["token"] = token
+	c.JSON(http.StatusCreated, resp)
+}
+
+// ListInvites returns the caller's invites and how many converted
+func ListInvites(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("invites").Where("inviter_user_id", "==", uid).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invites"})
+		return
+	}
+	invites := make([]Invite, 0, len(docs))
+	counts := map[string]int{InviteCreated: 0, InviteOpened: 0, InviteAccepted: 0}
+	for _, doc := range docs {
+		var inv Invite
+		if err := doc.DataTo(&inv); err != nil {
+			continue
+		}
+		inv.ID = doc.Ref.ID
+		invites = append(invites, inv)
+		counts[inv.Status]++
+	}
+	c.JSON(http.StatusOK, gin.H{"invites": invites, "counts": counts})
+}
+
+// OpenInvite resolves a public invite link, recording that it was opened
+func OpenInvite(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	inviteID, err := parseInviteToken(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found or expired"})
+		return
+	}
+	ref := fs.Collection("invites").Doc(inviteID)
+	doc, err := ref.Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found or expired"})
+		return
+	}
+	var inv Invite
+	if err := doc.DataTo(&inv); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read invite"})
+		return
+	}
+
+	update := map[string]interface{}{"open_count": firestore.Increment(1)}
+	if inv.Status == InviteCreated {
+		update["status"] = InviteOpened
+		update["opened_at"] = time.Now()
+	}
+	_, _ = ref.Set(ctx, update, firestore.MergeAll)
+
+	// Only what the landing screen needs; invitee contact details stay private
+	resp := gin.H{"kind": inv.Kind, "expires_at": inv.ExpiresAt}
+	if inviter, err := UserDoc(ctx, fs, inv.InviterUserID).Get(ctx); err == nil {
+		if name, _ := inviter.Data()["first_name"].(string); name != "" {
+			resp["inviter_name"] = name
+		}
+	}
+	if inv.Kind == InvitePayment {
+		if tx, err := fs.Collection("transactions").Doc(inv.TransactionID).Get(ctx); err == nil {
+			resp["amount"] = tx.Data()["amount"]
+			resp["currency"] = tx.Data()["currency"]
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// AcceptInviteHandler converts an invite for the signed-in user
+func AcceptInviteHandler(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	inv, err := AcceptInvite(c.Request.Context(), fs, req.Token, uid)
+	if errors.Is(err, errInviteUnusable) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Invite can no longer be accepted"})
+		return
+	}
+	if err != nil && inv == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect contacts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invite": inv})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// RunPeriodic runs fn every interval until ctx is cancelled, logging failures.
+// Runs in progress when ctx is cancelled finish and are waited for on shutdown.
+// Each run gets its own correlation ID for its log lines and Stripe calls.
+func RunPeriodic(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	slog.InfoContext(ctx, "job scheduled", "component", "jobs", "job", name, "interval", interval.String())
+	for {
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "job stopped", "component", "jobs", "job", name)
+			return
+		case <-ticker.C:
+			if ctx.Err() != nil || !inflightWork.start() {
+				continue
+			}
+			// A run isn't cancelled with ctx; shutdown waits for it instead of
+			// abandoning a transfer half done
+			runCtx, span := tracer.Start(withCorrelationID(context.WithoutCancel(ctx), name), "job "+name)
+			if err := fn(runCtx); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "job failed")
+				slog.ErrorContext(runCtx, "job failed", "component", "jobs", "job", name, "error", err)
+			}
+			span.End()
+			inflightWork.done()
+		}
+	}
+}
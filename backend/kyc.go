@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// KYC levels kept on users/{uid}.kyc_level, from least to most verified
+const (
+	KYCUnverified = "unverified"
+	KYCBasic      = "basic"
+	KYCVerified   = "verified"
+)
+
+// Where a KYC outcome came from
+const (
+	KYCSourceStripeIdentity = "stripe_identity"
+	KYCSourceSila           = ProcessorSila
+	KYCSourceAdmin          = "admin"
+)
+
+// kycLevels orders the levels; a level's index is its rank
+var kycLevels = []string{KYCUnverified, KYCBasic, KYCVerified}
+
+// kycRank returns a level's rank; unknown levels rank as unverified
+func kycRank(level string) int {
+	for i, l := range kycLevels {
+		if l == level {
+			return i
+		}
+	}
+	return 0
+}
+
+// kycMaxAmountDefaults are the largest single payment each level may send,
+// in limitCurrency minor units; 0 is no KYC cap. KYC_MAX_AMOUNT_UNVERIFIED and
+// KYC_MAX_AMOUNT_BASIC override them.
+var kycMaxAmountDefaults = map[string]int64{
+	KYCUnverified: 10000,
+	KYCBasic:      100000,
+	KYCVerified:   0,
+}
+
+// kycMaxAmount is the largest single payment a level may send, 0 for no cap
+func kycMaxAmount(level string) int64 {
+	if n, err := strconv.ParseInt(os.Getenv("KYC_MAX_AMOUNT_"+strings.ToUpper(level)), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	return kycMaxAmountDefaults[level]
+}
+
+// kycLevelFor returns the lowest level allowed to send amount
+func kycLevelFor(amount int64) string {
+	for _, level := range kycLevels {
+		if limit := kycMaxAmount(level); limit == 0 || amount <= limit {
+			return level
+		}
+	}
+	return KYCVerified
+}
+
+// KYCVerification is one verification outcome from a provider, kept at
+// kyc_verifications/{id}
+type KYCVerification struct {
+	UserID    string    `json:"user_id" firestore:"user_id"`
+	Source    string    `json:"source" firestore:"source"`
+	Reference string    `json:"reference,omitempty" firestore:"reference,omitempty"` // the provider's session or entity ID
+	Passed    bool      `json:"passed" firestore:"passed"`
+	Level     string    `json:"level,omitempty" firestore:"level,omitempty"` // level reached when passed
+	Reason    string    `json:"reason,omitempty" firestore:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// RecordKYCOutcome stores a verification outcome and, when it passed at a
+// higher level than the user has, raises their kyc_level. A failure from one
+// provider never lowers a level reached with another; support lowers levels
+// with SetUserKYCLevel. Returns the user's level afterwards.
+func RecordKYCOutcome(ctx context.Context, fs *firestore.Client, v *KYCVerification) (string, error) {
+	if v.CreatedAt.IsZero() {
+		v.CreatedAt = time.Now()
+	}
+	if _, _, err := fs.Collection("kyc_verifications").Add(ctx, v); err != nil {
+		return "", fmt.Errorf("failed to record kyc verification: %w", err)
+	}
+
+	level := KYCUnverified
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref := UserDoc(ctx, fs, v.UserID)
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		level = stringField(doc.Data(), "kyc_level")
+		if level == "" {
+			level = KYCUnverified
+		}
+		if !v.Passed || kycRank(v.Level) <= kycRank(level) {
+			return nil
+		}
+		level = v.Level
+		return tx.Set(ref, map[string]interface{}{
+			"kyc_level":       v.Level,
+			"kyc_source":      v.Source,
+			"kyc_verified_at": v.CreatedAt,
+		}, firestore.MergeAll)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update kyc level: %w", err)
+	}
+	if v.Passed {
+		if _, err := AdvanceOnboarding(ctx, fs, v.UserID); err != nil {
+			slog.WarnContext(ctx, "failed to advance onboarding", "component", "kyc", "user_id", v.UserID, "error", err)
+		}
+	}
+	return level, nil
+}
+
+// userKYCLevel reads a user's KYC level
+func userKYCLevel(ctx context.Context, fs *firestore.Client, uid string) (string, error) {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return "", err
+	}
+	if level := stringField(doc.Data(), "kyc_level"); level != "" {
+		return level, nil
+	}
+	return KYCUnverified, nil
+}
+
+// enforceKYCLevel responds and returns false when the caller's KYC level is
+// too low to send amount, in limitCurrency minor units. Without Firestore
+// there is nothing to check against.
+func enforceKYCLevel(c *gin.Context, uid string, amount int64) bool {
+	v, ok := c.Get("firestore")
+	if !ok {
+		return true
+	}
+	level, err := userKYCLevel(c.Request.Context(), v.(*firestore.Client), uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check verification level"})
+		return false
+	}
+	required := kycLevelFor(amount)
+	if kycRank(level) >= kycRank(required) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":          "Verify your identity to send this amount",
+		"code":           "kyc_required",
+		"kyc_level":      level,
+		"required_level": required,
+		"max_amount":     kycMaxAmount(level),
+	})
+	return false
+}
+
+// kycLevelLimits lists each level with the largest payment it may send
+func kycLevelLimits() []gin.H {
+	levels := make([]gin.H, 0, len(kycLevels))
+	for _, level := range kycLevels {
+		levels = append(levels, gin.H{"level": level, "max_amount": kycMaxAmount(level)})
+	}
+	return levels
+}
+
+// GetUserKYC returns the caller's KYC level and what each level may send
+func GetUserKYC(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	doc, err := getDocument(c.Request.Context(), UserDoc(c.Request.Context(), v.(*firestore.Client), uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	data := doc.Data()
+	level := stringField(data, "kyc_level")
+	if level == "" {
+		level = KYCUnverified
+	}
+	resp := gin.H{
+		"kyc_level":  level,
+		"max_amount": kycMaxAmount(level),
+		"levels":     kycLevelLimits(),
+	}
+	if source := stringField(data, "kyc_source"); source != "" {
+		resp["source"] = source
+		resp["verified_at"] = data["kyc_verified_at"]
+	}
+	if rank := kycRank(level); rank+1 < len(kycLevels) {
+		resp["next_level"] = kycLevels[rank+1]
+	}
+	respondWithETag(c, resp)
+}
+
+// SetUserKYCLevel lets support set a user's KYC level, e.g. after manual
+// document review or to withdraw a verification
+func SetUserKYCLevel(c *gin.Context) {
+	var req struct {
+		Level  string `json:"level" binding:"required"`
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if kycLevels[kycRank(req.Level)] != req.Level {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "level must be unverified, basic, or verified"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	uid := c.Param("uid")
+	adminID := c.GetString("userID")
+
+	if _, err := getDocument(ctx, UserDoc(ctx, fs, uid)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	now := time.Now()
+	if _, _, err := fs.Collection("kyc_verifications").Add(ctx, &KYCVerification{
+		UserID:    uid,
+		Source:    KYCSourceAdmin,
+		Reference: adminID,
+		Passed:    req.Level != KYCUnverified,
+		Level:     req.Level,
+		Reason:    req.Reason,
+		CreatedAt: now,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record verification"})
+		return
+	}
+	if _, err := UserDoc(ctx, fs, uid).Set(ctx, map[string]interface{}{
+		"kyc_level":       req.Level,
+		"kyc_source":      KYCSourceAdmin,
+		"kyc_verified_at": now,
+	}, firestore.MergeAll); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update verification level"})
+		return
+	}
+	if fa, ok := c.Get("firebaseAuth"); ok {
+		if err := setKYCClaim(ctx, fa.(*auth.Client), uid, req.Level); err != nil {
+			slog.ErrorContext(ctx, "failed to set kyc claim", "component", "kyc", "user_id", uid, "error", err)
+		}
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "user", SubjectID: uid, Query: "kyc_level=" + req.Level}); err != nil {
+		slog.ErrorContext(ctx, "failed to log kyc access", "component", "kyc", "user_id", uid, "error", err)
+	}
+	if _, err := AdvanceOnboarding(ctx, fs, uid); err != nil {
+		slog.WarnContext(ctx, "failed to advance onboarding", "component", "kyc", "user_id", uid, "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"kyc_level": req.Level})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ledger transaction kinds
+const (
+	LedgerCharge   = "charge"
+	LedgerTransfer = "transfer"
+	LedgerFee      = "fee"
+	// LedgerPlatformFee is the platform's fee on a payment, kept from what the recipient is owed
+	LedgerPlatformFee = "platform_fee"
+	LedgerRefund      = "refund"
+	// LedgerTip is the part of a charge the sender added as a tip
+	LedgerTip = "tip"
+	// LedgerEscrowAllocation assigns escrowed funds to the recipient who claimed them
+	LedgerEscrowAllocation = "escrow_allocation"
+	// LedgerTransferReversal pulls a transfer back from a recipient
+	LedgerTransferReversal = "transfer_reversal"
+	// LedgerReserveHold and LedgerReserveRelease move a business's payout
+	// into and out of its rolling reserve
+	LedgerReserveHold    = "reserve_hold"
+	LedgerReserveRelease = "reserve_release"
+	// LedgerInstantPayoutFee is the fee debited from a recipient's connected
+	// account for an instant payout, and LedgerInstantPayoutFeeRefund its
+	// return when the payout fails
+	LedgerInstantPayoutFee       = "instant_payout_fee"
+	LedgerInstantPayoutFeeRefund = "instant_payout_fee_refund"
+	// LedgerFXConversion converts what a recipient is owed into the currency
+	// they receive, one transaction per currency
+	LedgerFXConversion = "fx_conversion"
+)
+
+// Entry directions
+const (
+	Debit  = "debit"
+	Credit = "credit"
+)
+
+// Platform ledger accounts. Balances are debits minus credits, so asset and
+// expense accounts carry positive balances and liabilities negative ones.
+const (
+	LedgerAccountStripeBalance = "platform:stripe_balance"
+	LedgerAccountProcessorFees = "platform:processor_fees"
+	// LedgerAccountFeeRevenue is the platform's fees on payments
+	LedgerAccountFeeRevenue = "platform:fee_revenue"
+	// LedgerAccountUnallocated holds funds collected without a known recipient
+	LedgerAccountUnallocated = "platform:unallocated"
+	// LedgerAccountFXPosition takes in the source currency of cross-currency
+	// payments and pays out the target currency
+	LedgerAccountFXPosition = "platform:fx_position"
+)
+
+// LedgerAccountUserPayable is what the platform owes a recipient until it is
+// transferred out; funds without a recipient go to LedgerAccountUnallocated.
+func LedgerAccountUserPayable(uid string) string {
+	if uid == "" {
+		return LedgerAccountUnallocated
+	}
+	return "user:" + uid + ":payable"
+}
+
+// ErrLedgerUnbalanced is returned when a transaction's debits and credits differ
+var ErrLedgerUnbalanced = errors.New("ledger transaction is unbalanced")
+
+// LedgerEntry is one side of a ledger transaction
+type LedgerEntry struct {
+	Account   string `json:"account" firestore:"account"`
+	Direction string `json:"direction" firestore:"direction"`
+	Amount    int64  `json:"amount" firestore:"amount"`
+}
+
+// LedgerTransaction is a set of entries that are posted together or not at all.
+// ID is derived from the provider object it records, so replays are no-ops.
+type LedgerTransaction struct {
+	ID        string        `json:"id" firestore:"-"`
+	Kind      string        `json:"kind" firestore:"kind"`
+	Reference string        `json:"reference" firestore:"reference"`
+	Currency  string        `json:"currency" firestore:"currency"`
+	Entries   []LedgerEntry `json:"entries" firestore:"entries"`
+	Accounts  []string      `json:"accounts" firestore:"accounts"`
+	CreatedAt time.Time     `json:"created_at" firestore:"created_at"`
+}
+
+// Validate checks the transaction is well formed and balanced
+func (t *LedgerTransaction) Validate() error {
+	if t.ID == "" || t.Currency == "" {
+		return fmt.Errorf("ledger transaction requires an id and currency")
+	}
+	if _, ok := lookupCurrency(t.Currency); !ok {
+		return fmt.Errorf("ledger transaction %s has unsupported currency %q", t.ID, t.Currency)
+	}
+	if len(t.Entries) < 2 {
+		return fmt.Errorf("ledger transaction %s needs at least two entries", t.ID)
+	}
+	var debits, credits int64
+	for _, e := range t.Entries {
+		if e.Amount <= 0 || e.Account == "" {
+			return fmt.Errorf("ledger transaction %s has an invalid entry", t.ID)
+		}
+		switch e.Direction {
+		case Debit:
+			debits += e.Amount
+		case Credit:
+			credits += e.Amount
+		default:
+			return fmt.Errorf("ledger transaction %s has direction %q", t.ID, e.Direction)
+		}
+	}
+	if debits != credits {
+		return fmt.Errorf("%w: %s debits %d, credits %d", ErrLedgerUnbalanced, t.ID, debits, credits)
+	}
+	return nil
+}
+
+// LedgerStore persists ledger transactions and derived account balances
+type LedgerStore interface {
+	// Post records the transaction atomically. It reports false if a
+	// transaction with the same ID was already posted.
+	Post(ctx context.Context, txn *LedgerTransaction) (bool, error)
+	// Balance returns debits minus credits for an account in one currency
+	Balance(ctx context.Context, account, currency string) (int64, error)
+	// Transactions lists every transaction touching an account, oldest first
+	Transactions(ctx context.Context, account string) ([]LedgerTransaction, error)
+}
+
+// firestoreLedger stores transactions in ledger_transactions/{id} and running
+// balances in ledger_balances/{account}|{currency}.
+type firestoreLedger struct {
+	fs *firestore.Client
+}
+
+// NewFirestoreLedger returns a LedgerStore backed by Firestore
+func NewFirestoreLedger(fs *firestore.Client) LedgerStore {
+	return &firestoreLedger{fs: fs}
+}
+
+func ledgerBalanceID(account, currency string) string {
+	return account + "|" + strings.ToLower(currency)
+}
+
+func (l *firestoreLedger) Post(ctx context.Context, txn *LedgerTransaction) (bool, error) {
+	if err := txn.Validate(); err != nil {
+		return false, err
+	}
+	txn.Currency = strings.ToLower(txn.Currency)
+	if txn.CreatedAt.IsZero() {
+		txn.CreatedAt = time.Now()
+	}
+	deltas := map[string]int64{}
+	for _, e := range txn.Entries {
+		if e.Direction == Debit {
+			deltas[e.Account] += e.Amount
+		} else {
+			deltas[e.Account] -= e.Amount
+		}
+	}
+	txn.Accounts = make([]string, 0, len(deltas))
+	for account := range deltas {
+		txn.Accounts = append(txn.Accounts, account)
+	}
+
+	ref := l.fs.Collection("ledger_transactions").Doc(txn.ID)
+	posted := false
+	err := l.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		posted = false
+		existing, err := tx.Get(ref)
+		if err == nil && existing.Exists() {
+			return nil
+		}
+		if err := tx.Create(ref, txn); err != nil {
+			return err
+		}
+		for account, delta := range deltas {
+			balanceRef := l.fs.Collection("ledger_balances").Doc(ledgerBalanceID(account, txn.Currency))
+			if err := tx.Set(balanceRef, map[string]interface{}{
+				"account":    account,
+				"currency":   txn.Currency,
+				"balance":    firestore.Increment(delta),
+				"updated_at": txn.CreatedAt,
+			}, firestore.MergeAll); err != nil {
+				return err
+			}
+		}
+		posted = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to post ledger transaction %s: %w", txn.ID, err)
+	}
+	return posted, nil
+}
+
+func (l *firestoreLedger) Balance(ctx context.Context, account, currency string) (int64, error) {
+	doc, err := l.fs.Collection("ledger_balances").Doc(ledgerBalanceID(account, currency)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read balance for %s: %w", account, err)
+	}
+	balance, _ := doc.Data()["balance"].(int64)
+	return balance, nil
+}
+
+func (l *firestoreLedger) Transactions(ctx context.Context, account string) ([]LedgerTransaction, error) {
+	docs, err := l.fs.Collection("ledger_transactions").
+		Where("accounts", "array-contains", account).
+		OrderBy("created_at", firestore.Asc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ledger transactions for %s: %w", account, err)
+	}
+	txns := make([]LedgerTransaction, 0, len(docs))
+	for _, doc := range docs {
+		var t LedgerTransaction
+		if err := doc.DataTo(&t); err != nil {
+			continue
+		}
+		t.ID = doc.Ref.ID
+		txns = append(txns, t)
+	}
+	return txns, nil
+}
+
+// ChargeLedgerTransaction records funds collected from a sender: the platform's
+// Stripe balance grows and it now owes the recipient.
+func ChargeLedgerTransaction(paymentIntentID, recipientUID string, amount int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "charge_" + paymentIntentID,
+		Kind:      LedgerCharge,
+		Reference: paymentIntentID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountStripeBalance, Direction: Debit, Amount: amount},
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// TipLedgerTransaction records a tip collected with a charge. It is posted
+// apart from the charge so a recipient's tips can be told from their income.
+func TipLedgerTransaction(paymentIntentID, recipientUID string, tip int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "tip_" + paymentIntentID,
+		Kind:      LedgerTip,
+		Reference: paymentIntentID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountStripeBalance, Direction: Debit, Amount: tip},
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Credit, Amount: tip},
+		},
+	}
+}
+
+// chargeLedgerTransactions records a charge of amount cents, tip included
+func chargeLedgerTransactions(paymentIntentID, recipientUID string, amount, tip int64, currency string) []*LedgerTransaction {
+	if tip <= 0 {
+		return []*LedgerTransaction{ChargeLedgerTransaction(paymentIntentID, recipientUID, amount, currency)}
+	}
+	txns := []*LedgerTransaction{TipLedgerTransaction(paymentIntentID, recipientUID, tip, currency)}
+	if amount > tip {
+		txns = append(txns, ChargeLedgerTransaction(paymentIntentID, recipientUID, amount-tip, currency))
+	}
+	return txns
+}
+
+// TransferLedgerTransaction records paying a recipient out to their connected account
+func TransferLedgerTransaction(transferID, recipientUID string, amount int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "transfer_" + transferID,
+		Kind:      LedgerTransfer,
+		Reference: transferID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Debit, Amount: amount},
+			{Account: LedgerAccountStripeBalance, Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// FeeLedgerTransaction records the processor fee Stripe withheld on a charge
+func FeeLedgerTransaction(balanceTransactionID string, fee int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "fee_" + balanceTransactionID,
+		Kind:      LedgerFee,
+		Reference: balanceTransactionID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountProcessorFees, Direction: Debit, Amount: fee},
+			{Account: LedgerAccountStripeBalance, Direction: Credit, Amount: fee},
+		},
+	}
+}
+
+// PlatformFeeLedgerTransaction records the platform's fee on a payment, taken
+// from what the recipient is owed for it
+func PlatformFeeLedgerTransaction(paymentIntentID, recipientUID string, fee int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "platform_fee_" + paymentIntentID,
+		Kind:      LedgerPlatformFee,
+		Reference: paymentIntentID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Debit, Amount: fee},
+			{Account: LedgerAccountFeeRevenue, Direction: Credit, Amount: fee},
+		},
+	}
+}
+
+// RefundLedgerTransaction records money returned to a sender, reducing what the
+// platform owes the recipient.
+func RefundLedgerTransaction(refundID, recipientUID string, amount int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "refund_" + refundID,
+		Kind:      LedgerRefund,
+		Reference: refundID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Debit, Amount: amount},
+			{Account: LedgerAccountStripeBalance, Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// TransferReversalLedgerTransaction records a transfer pulled back from a
+// recipient's connected account: the funds return to the platform's Stripe
+// balance, owed to the recipient again until the payment is settled.
+func TransferReversalLedgerTransaction(reversalID, recipientUID string, amount int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "transfer_reversal_" + reversalID,
+		Kind:      LedgerTransferReversal,
+		Reference: reversalID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountStripeBalance, Direction: Debit, Amount: amount},
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// postLedger posts a transaction with the request's ledger, logging failures
+// through the Stripe client so they surface next to the API call they record.
+func postLedger(c *gin.Context, logger providerLogger, userID string, txn *LedgerTransaction) {
+	v, ok := c.Get("ledger")
+	if !ok {
+		return
+	}
+	if _, err := v.(LedgerStore).Post(c.Request.Context(), txn); err != nil {
+		logger.LogAPIError(c.Request.Context(), "ledger_post", userID, err)
+	}
+}
+
+// GetLedgerAccount returns an account's derived balance and the transactions behind it
+func GetLedgerAccount(c *gin.Context) {
+	account := c.Query("account")
+	currency := c.DefaultQuery("currency", DefaultCurrency)
+	if account == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "account is required"})
+		return
+	}
+
+	v, ok := c.Get("ledger")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ledger not available"})
+		return
+	}
+	store := v.(LedgerStore)
+	ctx := c.Request.Context()
+
+	balance, err := store.Balance(ctx, account, currency)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load balance"})
+		return
+	}
+	txns, err := store.Transactions(ctx, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ledger transactions"})
+		return
+	}
+
+	// Recompute from entries so the stored running balance can be audited
+	var derived int64
+	for _, t := range txns {
+		if t.Currency != strings.ToLower(currency) {
+			continue
+		}
+		for _, e := range t.Entries {
+			if e.Account != account {
+				continue
+			}
+			if e.Direction == Debit {
+				derived += e.Amount
+			} else {
+				derived -= e.Amount
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account":         account,
+		"currency":        strings.ToLower(currency),
+		"balance":         balance,
+		"derived_balance": derived,
+		"in_balance":      balance == derived,
+		"transactions":    txns,
+	})
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// MetricLimitRejectionsTotal counts payments refused for exceeding a send limit
+const MetricLimitRejectionsTotal = "send_limit_rejections_total"
+
+// errLimitUserNotFound is returned when the user has no profile to derive limits from
+var errLimitUserNotFound = errors.New("user not found")
+
+// riskLookback is the window in which disputes and returns count against a user
+const riskLookback = 90 * 24 * time.Hour
+
+// limitCurrency is the currency limits and usage are kept in. Sends in other
+// currencies count at their config/fx_rates value.
+const limitCurrency = DefaultCurrency
+
+// errLimitRateUnavailable is returned when a send's currency has no exchange
+// rate to limitCurrency
+var errLimitRateUnavailable = errors.New("no exchange rate to the limit currency")
+
+// LimitTier is a set of send limits, in limitCurrency minor units
+type LimitTier struct {
+	Name           string `json:"name" firestore:"name"`
+	Level          int    `json:"level" firestore:"level"`
+	PerTransaction int64  `json:"per_transaction" firestore:"per_transaction"`
+	Daily          int64  `json:"daily" firestore:"daily"`
+	Monthly        int64  `json:"monthly" firestore:"monthly"`
+	Custom         bool   `json:"custom,omitempty" firestore:"-"` // a per-user override applies
+}
+
+// limitTiers are the default tiers, ordered from most to least restrictive.
+// The tiers field of config/limits replaces them.
+var limitTiers = []LimitTier{
+	{Name: "starter", Level: 0, PerTransaction: 25000, Daily: 50000, Monthly: 100000},
+	{Name: "standard", Level: 1, PerTransaction: 100000, Daily: 250000, Monthly: 500000},
+	{Name: "trusted", Level: 2, PerTransaction: 500000, Daily: 1000000, Monthly: 2500000},
+	{Name: "premium", Level: 3, PerTransaction: 1000000, Daily: 2500000, Monthly: 10000000},
+}
+
+// LimitFactors are the risk signals a user's tier is derived from
+type LimitFactors struct {
+	KYCLevel               string    `json:"kyc_level"`
+	AccountCreatedAt       time.Time `json:"account_created_at"`
+	RecentDisputes         int       `json:"recent_disputes"`
+	RecentReturns          int       `json:"recent_returns"`
+	VerifiedFundingSources int       `json:"verified_funding_sources"`
+
+	// Overrides are per-user limits set by support, keyed by limit name
+	Overrides map[string]interface{} `json:"-"`
+}
+
+// loadLimitTiers reads the tiers configured at config/limits, falling back to the defaults
+func loadLimitTiers(ctx context.Context, fs *firestore.Client) []LimitTier {
+	doc, err := fs.Collection("config").Doc("limits").Get(ctx)
+	if err != nil || !doc.Exists() {
+		return limitTiers
+	}
+	var cfg struct {
+		Tiers []LimitTier `firestore:"tiers"`
+	}
+	if err := doc.DataTo(&cfg); err != nil || len(cfg.Tiers) == 0 {
+		return limitTiers
+	}
+	sort.Slice(cfg.Tiers, func(i, j int) bool { return cfg.Tiers[i].Level < cfg.Tiers[j].Level })
+	for i := range cfg.Tiers {
+		cfg.Tiers[i].Level = i
+	}
+	return cfg.Tiers
+}
+
+// applyLimitOverrides replaces tier limits with any set in users/{uid}.send_limits
+func applyLimitOverrides(tier LimitTier, overrides map[string]interface{}) LimitTier {
+	for field, limit := range map[string]*int64{
+		"per_transaction": &tier.PerTransaction,
+		"daily":           &tier.Daily,
+		"monthly":         &tier.Monthly,
+	} {
+		if n, ok := overrides[field].(int64); ok && n > 0 {
+			*limit = n
+			tier.Custom = true
+		}
+	}
+	return tier
+}
+
+// ComputeLimitTier derives a tier from risk factors and lists what would raise it
+func ComputeLimitTier(tiers []LimitTier, f LimitFactors, now time.Time) (LimitTier, []string) {
+	level := 0
+	suggestions := []string{}
+
+	switch f.KYCLevel {
+	case "verified":
+		level += 2
+	case "basic":
+		level++
+		suggestions = append(suggestions, "Complete full identity verification")
+	default:
+		suggestions = append(suggestions, "Verify your identity")
+	}
+
+	if f.VerifiedFundingSources > 0 {
+		level++
+	} else {
+		suggestions = append(suggestions, "Link and verify a bank account")
+	}
+
+	if !f.AccountCreatedAt.IsZero() && now.Sub(f.AccountCreatedAt) >= 30*24*time.Hour {
+		level++
+	} else {
+		suggestions = append(suggestions, "Limits increase automatically once your account is 30 days old")
+	}
+
+	incidents := f.RecentDisputes + f.RecentReturns
+	if incidents > 0 {
+		level -= incidents
+		suggestions = append(suggestions, "Avoid disputes and returned payments; they lower your limits for 90 days")
+	}
+	if incidents >= 2 {
+		level = 0
+	}
+
+	if level < 0 {
+		level = 0
+	}
+	if level >= len(tiers) {
+		level = len(tiers) - 1
+	}
+	if level == len(tiers)-1 {
+		suggestions = []string{}
+	}
+	return tiers[level], suggestions
+}
+
+// LoadLimitFactors gathers a user's risk signals from Firestore
+func LoadLimitFactors(ctx context.Context, fs *firestore.Client, uid string) (LimitFactors, error) {
+	var f LimitFactors
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil || !doc.Exists() {
+		return f, fmt.Errorf("user %s: %w", uid, errLimitUserNotFound)
+	}
+	data := doc.Data()
+	f.KYCLevel, _ = data["kyc_level"].(string)
+	f.Overrides, _ = data["send_limits"].(map[string]interface{})
+	f.AccountCreatedAt, _ = data["created_at"].(time.Time)
+	if methods, ok := data["verified_payment_methods"].([]interface{}); ok {
+		f.VerifiedFundingSources = len(methods)
+	}
+
+	cutoff := time.Now().Add(-riskLookback)
+	if returns, ok := data["ach_returns"].([]interface{}); ok {
+		for _, r := range returns {
+			if ts, ok := r.(time.Time); ok && ts.After(cutoff) {
+				f.RecentReturns++
+			}
+		}
+	}
+
+	disputes, err := fs.Collection("disputes").Where("sender_user_id", "==", uid).Documents(ctx).GetAll()
+	if err != nil {
+		return f, fmt.Errorf("failed to load disputes: %w", err)
+	}
+	for _, d := range disputes {
+		if created, ok := d.Data()["created_at"].(time.Time); ok && created.After(cutoff) {
+			f.RecentDisputes++
+		}
+	}
+	return f, nil
+}
+
+// currentLimitUsage reads today's and this month's sent totals from the user summary
+func currentLimitUsage(ctx context.Context, fs *firestore.Client, uid string, now time.Time) (LimitUsage, error) {
+	var summary *UserSummary
+	doc, err := getDocument(ctx, fs.Collection("user_summaries").Doc(uid))
+	if err == nil && doc.Exists() {
+		summary = &UserSummary{}
+		if err := doc.DataTo(summary); err != nil {
+			summary = nil
+		}
+	}
+	if summary == nil {
+		if summary, err = RefreshUserSummary(ctx, fs, uid); err != nil {
+			return LimitUsage{}, err
+		}
+	}
+
+	return summary.LimitUsage.rollOver(now), nil
+}
+
+// toLimitCurrency converts minor units of currency to limitCurrency minor
+// units at the mid-market rate, rounding up. An empty currency is
+// limitCurrency, as on transactions made before currencies were recorded.
+func toLimitCurrency(rates *FXRatesConfig, amount int64, currency string) (int64, bool) {
+	code := strings.ToLower(currency)
+	if code == "" || code == limitCurrency {
+		return amount, true
+	}
+	cur, ok := lookupCurrency(code)
+	if !ok || rates == nil {
+		return 0, false
+	}
+	rate, ok := fxRate(rates, code, limitCurrency)
+	if !ok {
+		return 0, false
+	}
+	converted := cur.FromMinor(amount) * rate * math.Pow10(currencies[limitCurrency].Exponent)
+	return int64(math.Ceil(converted - 1e-9)), true
+}
+
+// limitAmount converts a send to limitCurrency, reading exchange rates only
+// when it is in another currency
+func limitAmount(ctx context.Context, fs *firestore.Client, amount int64, currency string) (int64, error) {
+	var rates *FXRatesConfig
+	if code := strings.ToLower(currency); code != "" && code != limitCurrency {
+		rates = &FXRatesConfig{}
+		if err := readConfig(ctx, fs, ConfigFXRates, rates); err != nil {
+			return 0, err
+		}
+	}
+	converted, ok := toLimitCurrency(rates, amount, currency)
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", currency, errLimitRateUnavailable)
+	}
+	return converted, nil
+}
+
+// rollOver resets the daily and monthly totals once now is past their day or month
+func (u LimitUsage) rollOver(now time.Time) LimitUsage {
+	now = now.UTC()
+	if u.Day != now.Format("2006-01-02") {
+		u.Day = now.Format("2006-01-02")
+		u.DailySent = 0
+	}
+	if u.Month != now.Format("2006-01") {
+		u.Month = now.Format("2006-01")
+		u.MonthlySent = 0
+	}
+	return u
+}
+
+// walletSentUsage totals the wallet transfers a user has sent this UTC day and
+// month, read within tx. Wallet sends have no transactions document, only a
+// transfer_out entry.
+func walletSentUsage(tx *firestore.Transaction, fs *firestore.Client, uid string, now time.Time) (LimitUsage, error) {
+	usage := LimitUsage{}.rollOver(now)
+	utc := now.UTC()
+	monthStart := time.Date(utc.Year(), utc.Month(), 1, 0, 0, 0, 0, time.UTC)
+	docs, err := tx.Documents(fs.Collection("wallet_entries").
+		Where("user_id", "==", uid).
+		Where("created_at", ">=", monthStart)).GetAll()
+	if err != nil {
+		return usage, fmt.Errorf("failed to load wallet entries: %w", err)
+	}
+	for _, doc := range docs {
+		var entry WalletEntry
+		if err := doc.DataTo(&entry); err != nil || entry.Type != "transfer_out" || entry.Amount >= 0 {
+			continue
+		}
+		usage.MonthlySent -= entry.Amount
+		if entry.CreatedAt.UTC().Format("2006-01-02") == usage.Day {
+			usage.DailySent -= entry.Amount
+		}
+	}
+	return usage, nil
+}
+
+// sendLimits is a user's effective tier and what they have sent against it
+type sendLimits struct {
+	Tier        LimitTier
+	Tiers       []LimitTier
+	Factors     LimitFactors
+	Usage       LimitUsage
+	Suggestions []string
+}
+
+// remaining is what the user may still send, per limit
+func (l *sendLimits) remaining() LimitRemaining {
+	daily := max(l.Tier.Daily-l.Usage.DailySent, 0)
+	monthly := max(l.Tier.Monthly-l.Usage.MonthlySent, 0)
+	return LimitRemaining{
+		PerTransaction: min(l.Tier.PerTransaction, daily, monthly),
+		Daily:          daily,
+		Monthly:        monthly,
+	}
+}
+
+// loadSendLimits resolves a user's tier, overrides, and current usage
+func loadSendLimits(ctx context.Context, fs *firestore.Client, uid string, now time.Time) (*sendLimits, error) {
+	factors, err := LoadLimitFactors(ctx, fs, uid)
+	if err != nil {
+		return nil, err
+	}
+	tiers := loadLimitTiers(ctx, fs)
+	tier, suggestions := ComputeLimitTier(tiers, factors, now)
+	tier = applyLimitOverrides(tier, factors.Overrides)
+	usage, err := currentLimitUsage(ctx, fs, uid, now)
+	if err != nil {
+		return nil, err
+	}
+	return &sendLimits{Tier: tier, Tiers: tiers, Factors: factors, Usage: usage, Suggestions: suggestions}, nil
+}
+
+// LimitRemaining is how much more a user can send, in limitCurrency minor units
+type LimitRemaining struct {
+	PerTransaction int64 `json:"per_transaction"`
+	Daily          int64 `json:"daily"`
+	Monthly        int64 `json:"monthly"`
+}
+
+// LimitExceeded describes the send limit a payment would break. Amounts are
+// in Currency, the limit currency.
+type LimitExceeded struct {
+	Limit     string         `json:"limit"` // per_transaction, daily, or monthly
+	Currency  string         `json:"currency"`
+	Max       int64          `json:"max"`
+	Requested int64          `json:"requested"`
+	Remaining LimitRemaining `json:"remaining"`
+	Tier      string         `json:"tier"`
+	ResetsAt  *time.Time     `json:"resets_at,omitempty"`
+}
+
+// CheckSendLimits reports the first limit sending amount of currency would
+// exceed, or nil
+func CheckSendLimits(ctx context.Context, fs *firestore.Client, uid string, amount int64, currency string, now time.Time) (*LimitExceeded, error) {
+	amount, err := limitAmount(ctx, fs, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := loadSendLimits(ctx, fs, uid, now)
+	if err != nil {
+		return nil, err
+	}
+	return limits.exceeded(amount, now), nil
+}
+
+// exceeded reports the first limit sending amount would break, or nil
+func (l *sendLimits) exceeded(amount int64, now time.Time) *LimitExceeded {
+	exceeded := &LimitExceeded{Currency: limitCurrency, Requested: amount, Remaining: l.remaining(), Tier: l.Tier.Name}
+	utc := now.UTC()
+	switch {
+	case amount > l.Tier.PerTransaction:
+		exceeded.Limit, exceeded.Max = "per_transaction", l.Tier.PerTransaction
+	case l.Usage.DailySent+amount > l.Tier.Daily:
+		resets := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+		exceeded.Limit, exceeded.Max, exceeded.ResetsAt = "daily", l.Tier.Daily, &resets
+	case l.Usage.MonthlySent+amount > l.Tier.Monthly:
+		resets := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		exceeded.Limit, exceeded.Max, exceeded.ResetsAt = "monthly", l.Tier.Monthly, &resets
+	default:
+		return nil
+	}
+	return exceeded
+}
+
+// LimitReservation is send-limit usage taken by a payment that is in flight
+type LimitReservation struct {
+	UserID string
+	Amount int64
+	Day    string
+	Month  string
+}
+
+// ReserveSendLimits checks amount, in limitCurrency minor units, against the
+// user's limits and, if it fits,
+// adds it to their usage in the same transaction, so concurrent sends can't
+// each pass against the same remaining allowance. It reports the limit amount
+// would exceed, or the reservation taken.
+func ReserveSendLimits(ctx context.Context, fs *firestore.Client, uid string, amount int64, now time.Time) (*LimitExceeded, *LimitReservation, error) {
+	limits, err := loadSendLimits(ctx, fs, uid, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref := fs.Collection("user_summaries").Doc(uid)
+
+	var exceeded *LimitExceeded
+	var reservation *LimitReservation
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		exceeded, reservation = nil, nil
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var summary UserSummary
+		if err := snap.DataTo(&summary); err != nil {
+			return err
+		}
+		limits.Usage = summary.LimitUsage.rollOver(now)
+		if exceeded = limits.exceeded(amount, now); exceeded != nil {
+			return nil
+		}
+		usage := limits.Usage
+		usage.DailySent += amount
+		usage.MonthlySent += amount
+		reservation = &LimitReservation{UserID: uid, Amount: amount, Day: usage.Day, Month: usage.Month}
+		return tx.Set(ref, map[string]interface{}{"limit_usage": usage}, firestore.Merge([]string{"limit_usage"}))
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reserve send limits: %w", err)
+	}
+	return exceeded, reservation, nil
+}
+
+// ReleaseSendLimits returns a reservation's amount to the user's allowance.
+// Totals from an earlier day or month have already reset and are left alone.
+func ReleaseSendLimits(ctx context.Context, fs *firestore.Client, r *LimitReservation) error {
+	ref := fs.Collection("user_summaries").Doc(r.UserID)
+	return fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var summary UserSummary
+		if err := snap.DataTo(&summary); err != nil {
+			return err
+		}
+		usage := summary.LimitUsage
+		if usage.Day == r.Day {
+			usage.DailySent = max(usage.DailySent-r.Amount, 0)
+		}
+		if usage.Month == r.Month {
+			usage.MonthlySent = max(usage.MonthlySent-r.Amount, 0)
+		}
+		return tx.Set(ref, map[string]interface{}{"limit_usage": usage}, firestore.Merge([]string{"limit_usage"}))
+	})
+}
+
+// sendLimitReservationsKey is where enforceSendLimits keeps a request's reservations
+const sendLimitReservationsKey = "sendLimitReservations"
+
+// ReleaseFailedSendLimits gives back the send-limit usage a request reserved
+// when it fails. A payment that fails after the response has been sent still
+// counts until the day or month resets.
+func ReleaseFailedSendLimits() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		v, ok := c.Get(sendLimitReservationsKey)
+		if !ok || c.Writer.Status() < http.StatusBadRequest {
+			return
+		}
+		fs, ok := c.Get("firestore")
+		if !ok {
+			return
+		}
+		ctx := context.WithoutCancel(c.Request.Context())
+		for _, r := range v.([]*LimitReservation) {
+			if err := ReleaseSendLimits(ctx, fs.(*firestore.Client), r); err != nil {
+				slog.ErrorContext(ctx, "failed to release send limit reservation", "component", "limits", "user_id", r.UserID, "error", err)
+			}
+		}
+	}
+}
+
+// enforceSendLimits responds and returns false when the caller may not send
+// amount of currency, because their KYC level is too low or it breaks a send
+// limit. Otherwise amount is reserved against the limits until the request
+// fails. Without Firestore there is nothing to check against.
+func enforceSendLimits(c *gin.Context, uid string, amount int64, currency string) bool {
+	v, ok := c.Get("firestore")
+	if !ok {
+		return true
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	amount, err := limitAmount(ctx, fs, amount, currency)
+	if errors.Is(err, errLimitRateUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Exchange rates for this currency aren't available right now", "code": "fx_rate_unavailable"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check send limits"})
+		return false
+	}
+	if !enforceKYCLevel(c, uid, amount) {
+		return false
+	}
+	exceeded, reservation, err := ReserveSendLimits(ctx, fs, uid, amount, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check send limits"})
+		return false
+	}
+	if exceeded != nil {
+		metrics.IncCounter(MetricLimitRejectionsTotal, map[string]string{"limit": exceeded.Limit})
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("This payment exceeds your %s send limit", strings.ReplaceAll(exceeded.Limit, "_", "-")),
+			"code":  "send_limit_exceeded",
+			"limit": exceeded,
+		})
+		return false
+	}
+	reservations, _ := c.Get(sendLimitReservationsKey)
+	held, _ := reservations.([]*LimitReservation)
+	c.Set(sendLimitReservationsKey, append(held, reservation))
+	return true
+}
+
+// GetUserLimits returns the caller's tier, usage, and how to raise their limits
+func GetUserLimits(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	limits, err := loadSendLimits(ctx, fs, uid, time.Now())
+	if errors.Is(err, errLimitUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load limit usage"})
+		return
+	}
+
+	resp := gin.H{
+		"tier":         limits.Tier,
+		"usage":        limits.Usage,
+		"factors":      limits.Factors,
+		"remaining":    limits.remaining(),
+		"how_to_raise": limits.Suggestions,
+	}
+	if limits.Tier.Level+1 < len(limits.Tiers) {
+		resp["next_tier"] = limits.Tiers[limits.Tier.Level+1]
+	}
+	respondWithETag(c, resp)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// contextHandler adds the correlation ID, app client, and OpenTelemetry span
+// carried by the context to every record, so a request's log lines can be
+// joined with its trace and the X-Request-ID the caller saw
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if client := ClientFromContext(ctx); client.known() {
+		r.AddAttrs(slog.String("client_platform", client.Platform), slog.String("app_version", client.AppVersion))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// InitLogging makes a JSON slog logger the default at LOG_LEVEL (debug, info,
+// warn, error; default info). Calls through the log package go to it too, at
+// info level and without a correlation ID.
+func InitLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(os.Getenv("LOG_LEVEL")))); err != nil {
+		level = slog.LevelInfo
+	}
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// withCorrelationID gives work that doesn't start from an HTTP request, such
+// as a job run or a queued webhook, its own correlation ID unless ctx already
+// carries one
+func withCorrelationID(ctx context.Context, prefix string) context.Context {
+	if RequestIDFromContext(ctx) != "" {
+		return ctx
+	}
+	ctx, _ = withTrace(ctx, prefix+"-"+uuid.NewString())
+	return ctx
+}
@@ -2,8 +2,14 @@ package main
 
 import (
     "context"
+    "errors"
     "log"
+    "net/http"
     "os"
+    "os/signal"
+    "strconv"
+    "syscall"
+    "time"
 
     "cloud.google.com/go/firestore"
     firebase "firebase.google.com/go/v4"
@@ -19,6 +25,15 @@ func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found, using system environment variables")
 	}
+	// JSON logs with the request's correlation ID; log.Printf output goes through it too
+	InitLogging()
+
+	// OpenTelemetry spans, exported when OTEL_EXPORTER_OTLP_ENDPOINT is set
+	shutdownTelemetry, err := InitTelemetry(context.Background())
+	if err != nil {
+		log.Printf("Tracing disabled: %v", err)
+		shutdownTelemetry = func(context.Context) error { return nil }
+	}
 
     
 
@@ -31,6 +46,15 @@ func main() {
         log.Println("Stripe client initialized successfully")
     }
 
+    // Initialize Sila client (optional; wallet endpoints are unavailable without it)
+    silaClient, err := NewSilaClient()
+    if err != nil {
+        log.Printf("Sila client not configured: %v", err)
+    } else {
+        log.Println("Sila client initialized successfully")
+    }
+    plaidHTTPClient = newPlaidHTTPClient()
+
     // Initialize Firebase app, Auth, and Firestore
     var fbAuth *auth.Client
     var fsClient *firestore.Client
@@ -54,46 +78,219 @@ func main() {
                 log.Println("Firebase Auth initialized successfully")
             }
 
+            pushClient, err = app.Messaging(ctx)
+            if err != nil {
+                log.Printf("Failed to initialize Firebase Cloud Messaging; push notifications disabled: %v", err)
+            }
+
             projectID := os.Getenv("FIREBASE_PROJECT_ID")
             if projectID == "" {
                 log.Println("FIREBASE_PROJECT_ID not set; Firestore will be unavailable")
             } else {
-                fsClient, err = firestore.NewClient(ctx, projectID)
+                fsClient, err = NewRegionalFirestoreClient(ctx, projectID)
                 if err != nil {
                     log.Printf("Failed to initialize Firestore: %v", err)
                 } else {
-                    log.Println("Firestore client initialized successfully")
+                    log.Printf("Firestore client initialized (region %s, database %s)", currentRegion.Name, currentRegion.FirestoreDatabase)
+                }
+                if err := InitDataResidency(ctx, projectID); err != nil {
+                    log.Printf("Failed to initialize data residency: %v", err)
                 }
             }
         }
     }
 
+    if err := InitPageCursors(); err != nil {
+        log.Printf("Failed to initialize page cursors; listings won't page past the first page: %v", err)
+    }
+    if err := InitEmailSender(); err != nil {
+        log.Printf("Failed to initialize email; email notifications disabled: %v", err)
+    }
+    if err := InitExportStorage(context.Background()); err != nil {
+        log.Printf("Failed to initialize export storage; signed URL delivery disabled: %v", err)
+    }
+    if err := InitCheckDeposits(context.Background()); err != nil {
+        log.Printf("Failed to initialize check deposits; check deposits disabled: %v", err)
+    }
+
+    // Register event consumers before serving traffic
+    RegisterEventConsumer(EventTransactionCreated, UserSummaryConsumer)
+    RegisterEventConsumer(EventTransactionSucceeded, UserSummaryConsumer)
+    RegisterEventConsumer(EventTransactionFailed, UserSummaryConsumer)
+    RegisterEventConsumer(EventTransactionRefunded, UserSummaryConsumer)
+    RegisterEventConsumer(EventTransactionExpired, UserSummaryConsumer)
+    RegisterEventConsumer(EventTransactionReturned, UserSummaryConsumer)
+    RegisterEventConsumer(EventTransactionSucceeded, PaymentRequestConsumer)
+    RegisterEventConsumer(EventTransactionFailed, PaymentRequestConsumer)
+    RegisterEventConsumer(EventTransactionSucceeded, PaymentNotificationConsumer)
+    RegisterEventConsumer(EventTransactionFailed, PaymentNotificationConsumer)
+    for _, eventType := range partnerWebhookEvents {
+        RegisterEventConsumer(eventType, PartnerWebhookConsumer)
+    }
+
+    // Background jobs and webhook workers stop taking new work when this is cancelled on shutdown
+    backgroundCtx, stopBackground := context.WithCancel(context.Background())
+
+    // Background jobs
+    if fsClient != nil {
+        go RunPeriodic(backgroundCtx, "dispute_evidence_reminders", 6*time.Hour, func(ctx context.Context) error {
+            return SendDisputeEvidenceReminders(ctx, fsClient)
+        })
+        go RunPeriodic(backgroundCtx, "payment_request_expiry", time.Hour, func(ctx context.Context) error {
+            return ProcessPaymentRequestExpiry(ctx, fsClient)
+        })
+        go RunPeriodic(backgroundCtx, "wallet_hold_expiry", time.Minute, func(ctx context.Context) error {
+            return ReleaseExpiredWalletHolds(ctx, fsClient)
+        })
+        go RunPeriodic(backgroundCtx, "partner_webhook_delivery", 30*time.Second, func(ctx context.Context) error {
+            return DeliverPartnerWebhooks(ctx, fsClient)
+        })
+        go RunPeriodic(backgroundCtx, "schema_migrations", time.Minute, func(ctx context.Context) error {
+            return RunMigrations(ctx, fsClient)
+        })
+        // Fees and kill switches set by admins; loaded now so a switch that is
+        // on takes effect before the first request
+        if err := LoadRuntimeConfig(context.Background(), fsClient); err != nil {
+            log.Printf("Failed to load runtime config: %v", err)
+        }
+        go RunPeriodic(backgroundCtx, "runtime_config", time.Minute, func(ctx context.Context) error {
+            return LoadRuntimeConfig(ctx, fsClient)
+        })
+    }
+    if fsClient != nil && silaClient != nil {
+        interval := 1 * time.Hour
+        if d, err := time.ParseDuration(os.Getenv("SILA_DRIFT_CHECK_INTERVAL")); err == nil && d > 0 {
+            interval = d
+        }
+        go RunPeriodic(backgroundCtx, "sila_balance_drift", interval, func(ctx context.Context) error {
+            return CheckWalletDrift(ctx, fsClient, silaClient)
+        })
+    }
+
 	// Initialize Gin router
 	r := gin.Default()
+	r.Use(TracingMiddleware())
+	r.Use(ClientInfoMiddleware())
+	r.Use(RequestIDMiddleware())
+	r.Use(DependencyDeadlineMiddleware())
 
 	// Configure CORS
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"} // In production, specify exact origins
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "Stripe-Signature"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "Stripe-Signature", "Idempotency-Key", RequestIDHeader, "traceparent", "tracestate", HeaderAppVersion, HeaderPlatform}
+	config.ExposeHeaders = []string{RequestIDHeader, "Idempotent-Replayed", "Deprecation", "Sunset", "Link"}
 	r.Use(cors.New(config))
+    r.Use(MetricsMiddleware())
+    r.Use(ClientUsageMiddleware())
+
+    var ledgerStore LedgerStore
+    if fsClient != nil {
+        ledgerStore = NewFirestoreLedger(fsClient)
+    }
+
+    // Webhook side effects run on a persisted queue off the request path
+    var webhookQueue *WebhookQueue
+    if fsClient != nil && stripeClient != nil {
+        workers := 4
+        if n, err := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS")); err == nil && n > 0 {
+            workers = n
+        }
+        webhookQueue = NewWebhookQueue(fsClient, stripeClient, ledgerStore, fbAuth)
+        go webhookQueue.Run(backgroundCtx, workers)
+    }
+
+    // Transfers that failed after the sender was charged are retried, then refunded
+    if fsClient != nil && stripeClient != nil {
+        deps := &webhookDeps{fs: fsClient, sc: stripeClient, ledger: ledgerStore, auth: fbAuth}
+        go RunPeriodic(backgroundCtx, "transfer_compensation", time.Minute, func(ctx context.Context) error {
+            return RetryFailedTransfers(ctx, deps)
+        })
+        go RunPeriodic(backgroundCtx, "escrow_settlement", time.Minute, func(ctx context.Context) error {
+            return SettleEscrowedPayments(ctx, deps)
+        })
+        go RunPeriodic(backgroundCtx, "escrow_orders", time.Minute, func(ctx context.Context) error {
+            return SettleEscrowOrders(ctx, deps)
+        })
+        go RunPeriodic(backgroundCtx, "bulk_refunds", 10*time.Second, func(ctx context.Context) error {
+            return ProcessBulkRefunds(ctx, deps)
+        })
+        go RunPeriodic(backgroundCtx, "reserve_release", 15*time.Minute, func(ctx context.Context) error {
+            return ReleaseReserves(ctx, deps)
+        })
+        go RunPeriodic(backgroundCtx, "risk_tiering", 24*time.Hour, func(ctx context.Context) error {
+            return AssessRiskTiers(ctx, deps)
+        })
+        go RunPeriodic(backgroundCtx, "payment_intent_cleanup", 15*time.Minute, func(ctx context.Context) error {
+            return CancelStalePaymentIntents(ctx, deps)
+        })
+        orphanScanInterval := 24 * time.Hour
+        if d, err := time.ParseDuration(os.Getenv("STRIPE_ORPHAN_SCAN_INTERVAL")); err == nil && d > 0 {
+            orphanScanInterval = d
+        }
+        go RunPeriodic(backgroundCtx, "stripe_orphan_scan", orphanScanInterval, func(ctx context.Context) error {
+            return ScanStripeOrphans(ctx, deps)
+        })
+    }
+
+    // Webhook endpoints are checked at startup, then every few hours in case
+    // one is disabled or edited in the dashboard
+    if stripeClient != nil && stripeWebhookURL() != "" {
+        go func() {
+            ctx, cancel := context.WithTimeout(backgroundCtx, time.Minute)
+            defer cancel()
+            if err := VerifyWebhookEndpoints(ctx, stripeClient); err != nil {
+                log.Printf("Failed to verify Stripe webhook endpoints: %v", err)
+            }
+        }()
+        go RunPeriodic(backgroundCtx, "stripe_webhook_endpoints", 6*time.Hour, func(ctx context.Context) error {
+            return VerifyWebhookEndpoints(ctx, stripeClient)
+        })
+    }
+
+    // Providers behind the payment, bank link, and wallet handlers; a route can
+    // pin one with UseProvider and a user can choose one when several are configured
+    providers := NewProviders()
+    if stripeClient != nil {
+        providers.AddPayment(stripeClient)
+    }
+    if silaClient != nil {
+        providers.AddWallet(silaClient)
+    }
+    if stripeClient != nil {
+        // Added after Sila so Sila stays the default wallet when configured
+        providers.AddWallet(stripeClient)
+    }
 
     // Middleware to inject clients into context
     r.Use(func(c *gin.Context) {
+        c.Set("providers", providers)
         if stripeClient != nil {
             c.Set("stripeClient", stripeClient)
         }
+        if silaClient != nil {
+            c.Set("silaClient", silaClient)
+        }
         if fbAuth != nil {
             c.Set("firebaseAuth", fbAuth)
         }
         if fsClient != nil {
             c.Set("firestore", fsClient)
+            c.Set("ledger", ledgerStore)
+        }
+        if webhookQueue != nil {
+            c.Set("webhookQueue", webhookQueue)
         }
         c.Next()
     })
 
-    // Health check endpoint
+    // Health checks: liveness for restarts, readiness probes dependencies
     r.GET("/health", HealthCheck)
+    r.GET("/health/live", HealthLive)
+    r.GET("/health/ready", HealthReady)
+    r.GET("/metrics", MetricsHandler)
+    // Incident banners and disabled features for the app, before sign-in too
+    r.GET("/status", GetStatus)
     r.GET("/onboarding/refresh", OnboardingRefresh)
     r.GET("/onboarding/complete", OnboardingComplete)
 
@@ -106,12 +303,164 @@ func main() {
 
     // Protected routes group
     protected := r.Group("/")
-    protected.Use(AuthMiddleware())
+    protected.Use(AuthMiddleware(), ReleaseFailedSendLimits())
+
+    // Denormalized home-screen summary
+    protected.GET("/users/me/summary", GetUserSummary)
+    protected.GET("/users/me/limits", GetUserLimits)
+    protected.GET("/users/me/currencies", ListCurrencies)
+    protected.GET("/users/me/kyc", GetUserKYC)
+    protected.PUT("/users/me/service-provider", SetServiceProvider)
+    protected.GET("/users/:id/catalog", ListCatalog)
+    protected.POST("/catalog/items", CreateCatalogItem)
+    protected.PUT("/catalog/items/:id", UpdateCatalogItem)
+    protected.DELETE("/catalog/items/:id", DeleteCatalogItem)
+    protected.GET("/users/:id/refund-policy", GetRefundPolicy)
+    protected.PUT("/users/me/refund-policy", SetRefundPolicy)
+    protected.GET("/users/me/reserve", GetReserve)
+    protected.POST("/identity/session", CreateIdentitySession)
+    protected.GET("/onboarding/status", GetOnboardingStatus)
+
+    // Notification feed, delivery preferences, and push devices
+    protected.GET("/notifications", ListNotifications)
+    protected.GET("/users/me/notification-preferences", GetNotificationPreferences)
+    protected.PUT("/users/me/notification-preferences", SetNotificationPreferences)
+    protected.POST("/users/me/push-tokens", RegisterPushToken)
+    protected.DELETE("/users/me/push-tokens", UnregisterPushToken)
+
+    // Feature flags on for the calling app's platform and version
+    protected.GET("/features", GetFeatures)
+
+    // Payment history (sent and received)
+    protected.GET("/transactions", ListTransactions)
+    protected.GET("/transactions/export", ExportTransactions)
+    // Server-sent events as the caller's transactions change status
+    protected.GET("/stream/transactions", StreamTransactions)
+    protected.GET("/transactions/:id", GetTransaction)
+    protected.POST("/transactions/:id/refund-request", IdempotencyMiddleware(), RequestRefund)
+    protected.POST("/transactions/:id/report", IdempotencyMiddleware(), ReportTransaction)
+    protected.GET("/transactions/:id/report", GetTransactionReport)
+    protected.POST("/transactions/:id/report/evidence", UploadReportEvidence)
+    protected.GET("/refund-requests", ListRefundRequests)
+    protected.POST("/refund-requests/:id/approve", IdempotencyMiddleware(), ApproveRefundRequest)
+    protected.POST("/refund-requests/:id/decline", DeclineRefundRequest)
+    protected.GET("/statements", GetStatement)
+
+    // Read-only access tokens for accountants and auditors
+    protected.POST("/auditor-tokens", CreateAuditorToken)
+    protected.GET("/auditor-tokens", ListAuditorTokens)
+    protected.DELETE("/auditor-tokens/:id", RevokeAuditorToken)
+
+    // Restricted surface served to auditor tokens instead of Firebase ID tokens
+    auditor := r.Group("/auditor")
+    {
+        auditor.GET("/transactions", AuditorMiddleware(AuditorScopeTransactions), ListTransactions)
+        auditor.GET("/transactions/export", AuditorMiddleware(AuditorScopeTransactions), ExportTransactions)
+        auditor.GET("/statements", AuditorMiddleware(AuditorScopeStatements), GetStatement)
+    }
+
+    // API keys and payment links for business accounts
+    protected.POST("/developer/keys", CreateAPIKey)
+    protected.GET("/developer/keys", ListAPIKeys)
+    protected.POST("/developer/keys/:id/rotate", RotateAPIKey)
+    protected.DELETE("/developer/keys/:id", RevokeAPIKey)
+    protected.POST("/payment-links", IdempotencyMiddleware(), CreatePaymentLink)
+    protected.GET("/payment-links", ListPaymentLinks)
+    protected.DELETE("/payment-links/:id", DeactivatePaymentLink)
+
+    // Developer API served to business API keys instead of Firebase ID tokens
+    developer := r.Group("/developer/v1")
+    {
+        developer.POST("/payment-links", APIKeyMiddleware(APIKeyScopePaymentLinks), IdempotencyMiddleware(), CreatePaymentLink)
+        developer.GET("/payment-links", APIKeyMiddleware(APIKeyScopePaymentLinks), ListPaymentLinks)
+        developer.DELETE("/payment-links/:id", APIKeyMiddleware(APIKeyScopePaymentLinks), DeactivatePaymentLink)
+        developer.POST("/invoices", APIKeyMiddleware(APIKeyScopeInvoices), IdempotencyMiddleware(), CreatePaymentRequest)
+        developer.GET("/invoices", APIKeyMiddleware(APIKeyScopeInvoices), ListPaymentRequests)
+        developer.GET("/transactions", APIKeyMiddleware(APIKeyScopeTransactions), ListTransactions)
+        developer.GET("/transactions/:id", APIKeyMiddleware(APIKeyScopeTransactions), GetTransaction)
+    }
+
+    // Offline-cache delta sync for mobile clients
+    protected.GET("/sync", Sync)
+
+    // Contact import for the invite flow
+    protected.POST("/contacts/import", ImportContacts)
+
+    // Invites and referrals; the link itself resolves without auth
+    protected.POST("/invites", CreateInvite)
+    protected.GET("/invites", ListInvites)
+    protected.POST("/invites/accept", AcceptInviteHandler)
+    r.GET("/invites/open/:token", OpenInvite)
+
+    // Admin routes (require the "admin" custom claim)
+    admin := protected.Group("/admin")
+    admin.Use(AdminMiddleware())
+    {
+        admin.GET("/slo/rules", GetSLOAlertRules)
+        admin.GET("/captures", GetComplianceCaptures)
+        admin.GET("/ledger/account", GetLedgerAccount)
+        admin.GET("/overdraft/exposure", GetOverdraftExposure)
+        admin.POST("/events/test", FireTestEvent)
+        admin.GET("/events/test", ListTestEvents)
+        admin.GET("/webhooks/dead", ListDeadWebhookJobs)
+        admin.POST("/webhooks/jobs/:id/replay", ReplayWebhookJob)
+        admin.GET("/trace/:id", GetTrace)
+        admin.GET("/customer-conflicts", ListCustomerConflicts)
+        admin.POST("/customer-conflicts/:id/resolve", ResolveCustomerConflict)
+        admin.POST("/annotations", CreateAdminAnnotation)
+        admin.GET("/annotations/:subjectType/:subjectID", GetAdminAnnotations)
+        admin.DELETE("/annotations/:subjectType/:subjectID/tags/:tag", RemoveAdminTag)
+        admin.GET("/tags/search", SearchAdminTags)
+        admin.GET("/access-log", ListAdminAccessLog)
+        admin.GET("/transaction-reports", ListTransactionReports)
+        admin.POST("/transaction-reports/:id/resolve", ResolveTransactionReport)
+        admin.POST("/refunds/bulk/preview", PreviewBulkRefund)
+        admin.GET("/refunds/bulk/:id", GetBulkRefund)
+        admin.GET("/refunds/bulk/:id/report", GetBulkRefundReport)
+        admin.POST("/refunds/bulk/:id/execute", ExecuteBulkRefund)
+        admin.POST("/refunds/bulk/:id/cancel", CancelBulkRefund)
+        admin.GET("/stripe-orphans", ListStripeOrphans)
+        admin.GET("/stripe/webhook-endpoints", GetWebhookEndpoints)
+        admin.POST("/stripe/webhook-endpoints/sync", SyncWebhookEndpoints)
+        admin.POST("/stripe-orphans/:id/resolve", ResolveStripeOrphan)
+        admin.GET("/migrations", ListMigrations)
+        admin.POST("/migrations/:id/rerun", RerunMigration)
+        admin.GET("/deprecated-usage", ListDeprecatedRouteUsage)
+        admin.GET("/feature-flags", ListFeatureFlags)
+        admin.PUT("/feature-flags/:name", SetFeatureFlag)
+        admin.GET("/config", GetConfig)
+        admin.PUT("/config/limits", SetLimitTiers)
+        admin.PUT("/config/fees/:speed/:method", SetFeeRule)
+        admin.PUT("/config/kill-switches/:name", SetKillSwitch)
+        admin.PUT("/config/fx-rates", SetFXRates)
+        admin.GET("/config/changes", ListConfigChanges)
+        admin.GET("/incidents", ListIncidents)
+        admin.POST("/incidents", CreateIncident)
+        admin.PUT("/incidents/:id", UpdateIncident)
+        admin.POST("/incidents/:id/resolve", ResolveIncident)
+        admin.POST("/config/changes/:id/rollback", RollbackConfigChange)
+        admin.PUT("/users/:uid/kyc", SetUserKYCLevel)
+        admin.PUT("/users/:uid/reserve", SetUserReserve)
+        admin.GET("/users/:uid/risk", GetUserRisk)
+        admin.PUT("/users/:uid/risk-tier", SetUserRiskTier)
+        admin.POST("/users/:uid/payouts", IdempotencyMiddleware(), CreateManualPayout)
+        admin.POST("/users/:uid/hold", HoldUser)
+        admin.POST("/transactions/:id/hold", HoldTransaction)
+        admin.GET("/holds", ListHolds)
+        admin.POST("/holds/:id/release", ReleaseHold)
+        admin.GET("/risk/reviews", ListRiskReviews)
+        admin.POST("/risk/reviews/:id/approve", ApproveRiskReview)
+        admin.POST("/risk/reviews/:id/decline", DeclineRiskReview)
+        admin.GET("/escrow/orders", ListEscrowOrdersAdmin)
+        admin.POST("/escrow/orders/:id/resolve", ResolveEscrowOrder)
+    }
 
     // Stripe-powered customer management routes
     customers := protected.Group("/stripe/customers")
     {
         customers.POST("/", CreateStripeCustomer)
+        customers.GET("/:id/payment-methods", ListPaymentMethods)
+        customers.PUT("/:id/default-payment-method", SetDefaultPaymentMethod)
     }
 
     // Stripe Connect onboarding routes
@@ -120,28 +469,142 @@ func main() {
         connect.POST("/account", CreateConnectAccount)
         connect.POST("/account-link", CreateConnectAccountLink)
         connect.GET("/account/:accountID/status", GetConnectAccountStatus)
+        connect.GET("/requirements", GetConnectRequirements)
     }
 
+    // Plaid Link (bank account linking)
+    protected.POST("/plaid/link-token", RequireProcessor(ProcessorPlaid), RequireConsent(ConsentDataAccess), CreatePlaidLinkToken)
+    protected.POST("/plaid/exchange-token", RequireProcessor(ProcessorPlaid), RequireConsent(ConsentDataAccess), ExchangePlaidPublicToken)
+    // Balances, net worth, and spending across every linked bank
+    protected.GET("/plaid/dashboard", RequireProcessor(ProcessorPlaid), RequireConsent(ConsentDataAccess), GetBankDashboard)
+
+    // Consents (data access, ACH debits, recurring payments) and their history
+    protected.GET("/consents", ListConsents)
+    protected.POST("/consents", GrantConsent)
+    protected.DELETE("/consents/:type", RevokeConsent)
+    protected.GET("/consents/history", GetConsentHistory)
+
+    // Recurring ACH debit mandates
+    protected.GET("/mandates", ListMandates)
+    protected.POST("/mandates", RequireConsent(ConsentRecurringPayments), CreateMandate)
+    protected.PUT("/mandates/:id", RequireConsent(ConsentRecurringPayments), AmendMandate)
+    protected.DELETE("/mandates/:id", RevokeMandate)
+
+    // Outbound webhooks for partner integrations
+    protected.POST("/webhooks/subscriptions", CreateWebhookSubscription)
+    protected.GET("/webhooks/subscriptions", ListWebhookSubscriptions)
+    protected.DELETE("/webhooks/subscriptions/:id", DeleteWebhookSubscription)
+
     // Setup intent route (save payment methods)
     protected.POST("/stripe/setup-intent", CreateSetupIntentForCustomer)
+    protected.DELETE("/stripe/payment-methods/:id", DetachPaymentMethod)
 
     // Stripe-powered transfer routes
     stripeTransfers := protected.Group("/stripe/transfers")
+    stripeTransfers.Use(RequireClientVersion(), ComplianceCaptureMiddleware())
     {
-        stripeTransfers.POST("/", CreateTransferWithStripe)
-        stripeTransfers.POST("/p2p", CreateP2PTransferWithStripe)
-        stripeTransfers.POST("/confirm", ConfirmTransfer)
+        stripeTransfers.POST("/", KillSwitch(KillSwitchTransfers), RequireNoAccountHold(), RequireConsent(ConsentACHDebit), IdempotencyMiddleware(), CreateTransferWithStripe)
+        stripeTransfers.POST("/p2p", KillSwitch(KillSwitchTransfers), RequireNoAccountHold(), RequireConsent(ConsentACHDebit), IdempotencyMiddleware(), CreateP2PTransferWithStripe)
+        stripeTransfers.POST("/confirm", KillSwitch(KillSwitchTransfers), RequireNoAccountHold(), IdempotencyMiddleware(), ConfirmTransfer)
+        stripeTransfers.POST("/:id/finalize", KillSwitch(KillSwitchTransfers), RequireNoAccountHold(), IdempotencyMiddleware(), FinalizeTransfer)
         stripeTransfers.GET("/:id/status", GetTransferStatus)
     }
 
+    // Payouts from a recipient's connected account: history, schedule, and
+    // instant payouts to their debit card
+    stripePayouts := protected.Group("/stripe/payouts")
+    stripePayouts.Use(RequireClientVersion())
+    {
+        stripePayouts.GET("/", ListPayouts)
+        stripePayouts.GET("/schedule", GetPayoutSchedule)
+        stripePayouts.PUT("/schedule", UpdatePayoutSchedule)
+        stripePayouts.GET("/instant/eligibility", GetInstantPayoutEligibility)
+        stripePayouts.POST("/instant", KillSwitch(KillSwitchPayouts), RequireNoAccountHold(), IdempotencyMiddleware(), CreateInstantPayout)
+    }
+
     // Webhook routes (public)
     webhooks := r.Group("/webhooks")
     {
         webhooks.POST("/stripe", HandleStripeWebhook)
+        webhooks.POST("/stripe/:region", RegionalWebhookGuard(), HandleStripeWebhook)
+        webhooks.POST("/sila", HandleSilaWebhook)
+        webhooks.POST("/plaid", HandlePlaidWebhook)
+        webhooks.POST("/check-deposits", HandleCheckDepositWebhook)
+    }
+
+    // Wallet balance, top-up, and withdrawal with the caller's wallet provider
+    protected.GET("/wallet/balance", GetWalletBalance)
+    protected.POST("/wallet/topup", RequireClientVersion(), KillSwitch(KillSwitchWallet), RequireConsent(ConsentACHDebit), IdempotencyMiddleware(), TopUpWallet)
+    protected.POST("/wallet/withdraw", RequireClientVersion(), KillSwitch(KillSwitchWallet), RequireNoAccountHold(), IdempotencyMiddleware(), WithdrawFromWallet)
+
+    // Account and routing numbers for direct deposits into a Stripe-backed wallet
+    protected.POST("/wallet/direct-deposit", RequireClientVersion(), KillSwitch(KillSwitchWallet), CreateDirectDepositAccount)
+    protected.GET("/wallet/direct-deposit", GetDirectDepositAccount)
+
+    // Check deposits: images are uploaded to signed URLs, then submitted for capture
+    protected.POST("/wallet/check-deposits", RequireClientVersion(), KillSwitch(KillSwitchWallet), CreateCheckDeposit)
+    protected.GET("/wallet/check-deposits", ListCheckDeposits)
+    protected.GET("/wallet/check-deposits/:id", GetCheckDeposit)
+    protected.POST("/wallet/check-deposits/:id/submit", RequireClientVersion(), KillSwitch(KillSwitchWallet), SubmitCheckDeposit)
+
+    // Wallet-funded sends (funds are held until Sila confirms the transfer)
+    // Overdraft advances are funded from a Sila wallet, so sends stay on Sila
+    protected.POST("/wallet/transfers", RequireClientVersion(), KillSwitch(KillSwitchWallet), RequireNoAccountHold(), RequireProcessor(ProcessorSila), UseProvider(ProviderKindWallet, ProcessorSila), IdempotencyMiddleware(), ComplianceCaptureMiddleware(), SendWalletTransfer)
+    protected.GET("/wallet/overdraft", RequireProcessor(ProcessorSila), GetOverdraft)
+    protected.PUT("/wallet/overdraft", RequireProcessor(ProcessorSila), SetOverdraft)
+
+    // Sila wallet: KYC registration, bank linking, and cash in and out
+    silaWallet := protected.Group("/sila", RequireClientVersion(), RequireProcessor(ProcessorSila), UseProvider(ProviderKindWallet, ProcessorSila))
+    {
+        silaWallet.POST("/register", RequireConsent(ConsentDataAccess), RegisterSilaUser)
+        silaWallet.POST("/link-account", RequireConsent(ConsentDataAccess), LinkSilaBankAccount)
+        silaWallet.POST("/deposit", KillSwitch(KillSwitchWallet), RequireConsent(ConsentACHDebit), IdempotencyMiddleware(), DepositToSilaWallet)
+        silaWallet.POST("/withdraw", KillSwitch(KillSwitchWallet), RequireNoAccountHold(), IdempotencyMiddleware(), WithdrawFromSilaWallet)
+        silaWallet.POST("/p2p", KillSwitch(KillSwitchWallet), RequireNoAccountHold(), IdempotencyMiddleware(), ComplianceCaptureMiddleware(), SendWalletTransfer)
+        silaWallet.GET("/balance", GetSilaBalance)
     }
 
+    // Payroll and earned wage access: businesses pay employees from their
+    // wallet, and employees draw earned pay early, withheld on payday
+    protected.POST("/payroll/employees", UpsertEmployee)
+    protected.GET("/payroll/employees", ListEmployees)
+    protected.DELETE("/payroll/employees/:uid", RemoveEmployee)
+    protected.POST("/payroll/runs", RequireClientVersion(), KillSwitch(KillSwitchWallet), RequireNoAccountHold(), IdempotencyMiddleware(), RunPayroll)
+    protected.GET("/payroll/runs", ListPayrollRuns)
+    protected.GET("/earned-wages", GetEarnedWages)
+    protected.POST("/earned-wages/advances", RequireClientVersion(), KillSwitch(KillSwitchWallet), IdempotencyMiddleware(), DrawWageAdvance)
+    protected.GET("/earned-wages/advances", ListWageAdvances)
+    protected.POST("/escrow/orders", RequireClientVersion(), KillSwitch(KillSwitchPayments), RequireNoAccountHold(), IdempotencyMiddleware(), CreateEscrowOrder)
+    protected.GET("/escrow/orders", ListEscrowOrders)
+    protected.GET("/escrow/orders/:id", GetEscrowOrder)
+    protected.POST("/escrow/orders/:id/deliver", DeliverEscrowOrder)
+    protected.POST("/escrow/orders/:id/release", RequireClientVersion(), IdempotencyMiddleware(), ReleaseEscrowOrder)
+    protected.POST("/escrow/orders/:id/dispute", DisputeEscrowOrder)
+    protected.POST("/escrow/orders/:id/cancel", CancelEscrowOrder)
+
+    // Dispute evidence submission
+    protected.POST("/disputes/:id/evidence", SubmitDisputeEvidence)
+
     // P2P payments via Stripe (platform charge then transfer)
-    protected.POST("/payments/p2p/initiate", InitiateP2PPayment)
+    protected.GET("/payments/fees/quote", GetFeeQuote)
+    protected.GET("/fx/quote", GetFXQuote)
+    protected.POST("/payments/p2p/initiate", RequireClientVersion(), KillSwitch(KillSwitchPayments), RequireNoAccountHold(), IdempotencyMiddleware(), ComplianceCaptureMiddleware(), InitiateP2PPayment)
+    protected.POST("/payments/:id/retry", RequireClientVersion(), KillSwitch(KillSwitchPayments), RequireNoAccountHold(), IdempotencyMiddleware(), ComplianceCaptureMiddleware(), RetryPayment)
+    protected.GET("/payments/:id/attempts", GetPaymentAttempts)
+
+    // Requesting money from other users
+    protected.POST("/payments/requests", IdempotencyMiddleware(), CreatePaymentRequest)
+    protected.GET("/payments/requests", ListPaymentRequests)
+    protected.POST("/payments/requests/intent", SetRequestIntent)
+    protected.DELETE("/payments/requests/intent/:recipientID", ClearRequestIntent)
+    protected.POST("/payments/requests/:id/pay", RequireClientVersion(), KillSwitch(KillSwitchPayments), RequireNoAccountHold(), IdempotencyMiddleware(), ComplianceCaptureMiddleware(), PayPaymentRequest)
+    protected.POST("/payments/requests/:id/decline", DeclinePaymentRequest)
+    protected.POST("/payments/requests/:id/cancel", CancelPaymentRequest)
+
+    // Partial payments toward payment requests
+    protected.POST("/requests/:id/payments", RequireClientVersion(), KillSwitch(KillSwitchPayments), RequireNoAccountHold(), IdempotencyMiddleware(), ComplianceCaptureMiddleware(), PayPaymentRequest)
+    protected.GET("/requests/:id/payments", GetPaymentRequestPayments)
+    protected.PUT("/requests/:id/expiry", SetPaymentRequestExpiry)
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -149,8 +612,41 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	srv.RegisterOnShutdown(CloseTransactionStreams)
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	// Drain in-flight requests and background work on SIGTERM (or Ctrl-C)
+	// instead of dying part way through a transfer
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	case sig := <-signals:
+		log.Printf("Received %s, draining", sig)
+	}
+
+	hooks := []shutdownHook{}
+	if fsClient != nil {
+		hooks = append(hooks, shutdownHook{"firestore", func(context.Context) error { return fsClient.Close() }})
 	}
+	if euFirestore != nil {
+		hooks = append(hooks, shutdownHook{"firestore_eu", func(context.Context) error { return euFirestore.Close() }})
+	}
+	hooks = append(hooks, shutdownHook{"telemetry", shutdownTelemetry})
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	Shutdown(ctx, srv, stopBackground, hooks)
 }
\ No newline at end of file
@@ -0,0 +1,1048 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Escrow orders hold a marketplace buyer's payment until they have what they
+// paid for. The buyer funds the order with a card authorization or a wallet
+// hold; when the seller marks it delivered the funds are collected into
+// escrow, and the buyer then releases them to the seller or disputes within
+// the release window. Orders nobody disputes release on their own when the
+// window closes, orders never delivered are canceled, and admins settle
+// disputes by releasing to the seller or refunding the buyer.
+
+// Escrow order statuses
+const (
+	EscrowOrderPendingFunding = "pending_funding"
+	EscrowOrderFunded         = "funded"
+	EscrowOrderDelivered      = "delivered"
+	EscrowOrderDisputed       = "disputed"
+	EscrowOrderReleased       = "released"
+	EscrowOrderRefunded       = "refunded"
+	EscrowOrderCanceled       = "canceled"
+)
+
+// How an escrow order is funded
+const (
+	EscrowFundingCard   = "card"
+	EscrowFundingWallet = "wallet"
+)
+
+// escrowOrderFlow marks an order's PaymentIntent. It is booked when it's
+// captured, not by the payment_intent.succeeded webhook.
+const escrowOrderFlow = "escrow_order"
+
+// Wallet entries for wallet-funded orders
+const (
+	walletSourceEscrow       = "escrow"
+	walletEntryEscrowFunding = "escrow_funding"
+	walletEntryEscrowRelease = "escrow_release"
+	walletEntryEscrowRefund  = "escrow_refund"
+)
+
+// Ledger kinds for escrow orders
+const (
+	LedgerEscrowOrderFunding = "escrow_order_funding"
+	LedgerEscrowOrderRelease = "escrow_order_release"
+	LedgerEscrowOrderRefund  = "escrow_order_refund"
+)
+
+// LedgerAccountEscrow is what the platform holds for delivered orders that
+// haven't been released or refunded yet
+const LedgerAccountEscrow = "platform:escrow"
+
+// Notifications for escrow orders; refunded buyers get NotificationPaymentRefunded
+const (
+	NotificationEscrowOrderFunded    = "escrow_order_funded"
+	NotificationEscrowOrderDelivered = "escrow_order_delivered"
+	NotificationEscrowOrderDisputed  = "escrow_order_disputed"
+	NotificationEscrowOrderReleased  = "escrow_order_released"
+	NotificationEscrowOrderCanceled  = "escrow_order_canceled"
+)
+
+const (
+	// maxEscrowDeliveryDays keeps delivery inside a card authorization's
+	// seven-day lifetime
+	maxEscrowDeliveryDays = 6
+	// defaultEscrowReleaseDays is how long a buyer has to dispute a delivery
+	defaultEscrowReleaseDays = 3
+)
+
+var (
+	errEscrowOrderState         = errors.New("escrow order is not in a state that allows this")
+	errEscrowOrderBusy          = errors.New("escrow order is being settled")
+	errEscrowOrderUnfunded      = errors.New("escrow order's funding is no longer available")
+	errEscrowDisputeWindow      = errors.New("escrow order's dispute window has closed")
+	errEscrowSellerCannotAccept = errors.New("seller can't receive payouts")
+)
+
+// escrowDeliveryWindow reads ESCROW_DELIVERY_DAYS, capped at maxEscrowDeliveryDays
+func escrowDeliveryWindow() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ESCROW_DELIVERY_DAYS"))
+	if err != nil || days <= 0 || days > maxEscrowDeliveryDays {
+		days = maxEscrowDeliveryDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// escrowReleaseWindow reads ESCROW_RELEASE_DAYS
+func escrowReleaseWindow() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ESCROW_RELEASE_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultEscrowReleaseDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// EscrowOrder is a marketplace purchase paid through escrow, kept at
+// escrow_orders/{id}
+type EscrowOrder struct {
+	ID              string     `json:"id" firestore:"-"`
+	BuyerUserID     string     `json:"buyer_user_id" firestore:"buyer_user_id"`
+	SellerUserID    string     `json:"seller_user_id" firestore:"seller_user_id"`
+	Participants    []string   `json:"-" firestore:"participants"`
+	Amount          int64      `json:"amount" firestore:"amount"`
+	Currency        string     `json:"currency" firestore:"currency"`
+	Description     string     `json:"description" firestore:"description"`
+	Funding         string     `json:"funding" firestore:"funding"`
+	PaymentIntentID string     `json:"payment_intent_id,omitempty" firestore:"payment_intent_id,omitempty"`
+	HoldID          string     `json:"hold_id,omitempty" firestore:"hold_id,omitempty"`
+	Status          string     `json:"status" firestore:"status"`
+	DeliverBy       time.Time  `json:"deliver_by" firestore:"deliver_by"`
+	DeliveredAt     *time.Time `json:"delivered_at,omitempty" firestore:"delivered_at,omitempty"`
+	DeliveryNote    string     `json:"delivery_note,omitempty" firestore:"delivery_note,omitempty"`
+	ReleaseAt       *time.Time `json:"release_at,omitempty" firestore:"release_at,omitempty"`
+	DisputeReason   string     `json:"dispute_reason,omitempty" firestore:"dispute_reason,omitempty"`
+	DisputedAt      *time.Time `json:"disputed_at,omitempty" firestore:"disputed_at,omitempty"`
+	ResolvedBy      string     `json:"resolved_by,omitempty" firestore:"resolved_by,omitempty"` // admin ID, or "auto" when the window closed
+	ResolutionNote  string     `json:"resolution_note,omitempty" firestore:"resolution_note,omitempty"`
+	CancelReason    string     `json:"cancel_reason,omitempty" firestore:"cancel_reason,omitempty"`
+	TransferID      string     `json:"transfer_id,omitempty" firestore:"transfer_id,omitempty"`
+	RefundID        string     `json:"refund_id,omitempty" firestore:"refund_id,omitempty"`
+	CreatedAt       time.Time  `json:"created_at" firestore:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" firestore:"updated_at"`
+}
+
+// escrowOrderReference keys an order's hold, PaymentIntent, and wallet entries
+func escrowOrderReference(orderID string) string {
+	return "escrow_order_" + orderID
+}
+
+// EscrowOrderLedgerTransaction moves an order's funds into or out of
+// LedgerAccountEscrow. Funding credits escrow from account, releases and
+// refunds debit it to account.
+func EscrowOrderLedgerTransaction(id, kind, reference, account string, amount int64, currency string) *LedgerTransaction {
+	escrowSide, accountSide := Debit, Credit
+	if kind == LedgerEscrowOrderFunding {
+		escrowSide, accountSide = Credit, Debit
+	}
+	return &LedgerTransaction{
+		ID:        id,
+		Kind:      kind,
+		Reference: reference,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: account, Direction: accountSide, Amount: amount},
+			{Account: LedgerAccountEscrow, Direction: escrowSide, Amount: amount},
+		},
+	}
+}
+
+// escrowOrderDeps pulls the caller and the clients escrow order handlers
+// settle with, responding when one is missing
+func escrowOrderDeps(c *gin.Context) (string, *webhookDeps, bool) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return "", nil, false
+	}
+	d := &webhookDeps{fs: fs, sc: sc}
+	if v, ok := c.Get("ledger"); ok {
+		d.ledger = v.(LedgerStore)
+	}
+	return uid, d, true
+}
+
+// loadEscrowOrder reads an order
+func loadEscrowOrder(ctx context.Context, fs *firestore.Client, id string) (*EscrowOrder, error) {
+	doc, err := fs.Collection("escrow_orders").Doc(id).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var o EscrowOrder
+	if err := doc.DataTo(&o); err != nil {
+		return nil, fmt.Errorf("failed to decode escrow order %s: %w", id, err)
+	}
+	o.ID = doc.Ref.ID
+	return &o, nil
+}
+
+// callerEscrowOrder loads the order in the path, responding 404 unless the
+// caller is its buyer or seller
+func callerEscrowOrder(c *gin.Context, fs *firestore.Client, uid string) (*EscrowOrder, bool) {
+	o, err := loadEscrowOrder(c.Request.Context(), fs, c.Param("id"))
+	if err != nil || (o.BuyerUserID != uid && o.SellerUserID != uid) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return nil, false
+	}
+	return o, true
+}
+
+// settleEscrowOrder takes a lease on an order in one of the from states,
+// runs move, and records the updates move returns. The lease keeps the
+// buyer, seller, admins, and the settlement job from moving the same funds
+// twice; it is dropped if move fails, and every move is safe to repeat.
+func settleEscrowOrder(ctx context.Context, fs *firestore.Client, id string, from []string, move func(o *EscrowOrder) ([]firestore.Update, error)) (*EscrowOrder, error) {
+	ref := fs.Collection("escrow_orders").Doc(id)
+	var o EscrowOrder
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := snap.DataTo(&o); err != nil {
+			return err
+		}
+		if !slices.Contains(from, o.Status) {
+			return errEscrowOrderState
+		}
+		if lease, _ := snap.Data()["lease_until"].(time.Time); lease.After(time.Now()) {
+			return errEscrowOrderBusy
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "lease_until", Value: time.Now().Add(escrowLease)}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.ID = id
+
+	updates, err := move(&o)
+	if err != nil {
+		if _, dropErr := ref.Update(ctx, []firestore.Update{{Path: "lease_until", Value: firestore.Delete}}); dropErr != nil {
+			slog.ErrorContext(ctx, "failed to drop escrow order lease", "component", "escrow_orders", "order_id", id, "error", dropErr)
+		}
+		return nil, err
+	}
+	updates = append(updates,
+		firestore.Update{Path: "lease_until", Value: firestore.Delete},
+		firestore.Update{Path: "updated_at", Value: time.Now()},
+	)
+	if _, err := ref.Update(ctx, updates); err != nil {
+		return nil, fmt.Errorf("failed to record escrow order %s: %w", id, err)
+	}
+	return loadEscrowOrder(ctx, fs, id)
+}
+
+// escrowHoldStatus returns a wallet hold's status, or "" if it can't be read
+func escrowHoldStatus(ctx context.Context, fs *firestore.Client, holdID string) string {
+	doc, err := getDocument(ctx, fs.Collection("wallet_holds").Doc(holdID))
+	if err != nil {
+		return ""
+	}
+	return stringField(doc.Data(), "status")
+}
+
+// syncEscrowOrderFunding marks a card order funded once its authorization
+// completes, e.g. after the buyer authenticates the card
+func syncEscrowOrderFunding(ctx context.Context, d *webhookDeps, o *EscrowOrder) (*EscrowOrder, error) {
+	if o.Status != EscrowOrderPendingFunding || o.Funding != EscrowFundingCard || o.PaymentIntentID == "" {
+		return o, nil
+	}
+	pi, err := d.sc.GetPaymentIntent(ctx, o.PaymentIntentID)
+	if err != nil {
+		return nil, err
+	}
+	if pi.Status != string(stripe.PaymentIntentStatusRequiresCapture) {
+		return o, nil
+	}
+	ref := d.fs.Collection("escrow_orders").Doc(o.ID)
+	funded := false
+	err = d.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		funded = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if stringField(snap.Data(), "status") != EscrowOrderPendingFunding {
+			return nil
+		}
+		funded = true
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: EscrowOrderFunded},
+			{Path: "updated_at", Value: time.Now()},
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record escrow order %s funded: %w", o.ID, err)
+	}
+	if funded {
+		o.Status = EscrowOrderFunded
+		notifyEscrowOrderFunded(ctx, d.fs, o)
+	}
+	return o, nil
+}
+
+// collectEscrowOrder moves a funded order's money into escrow: the card
+// authorization is captured, or the wallet hold committed
+func collectEscrowOrder(ctx context.Context, d *webhookDeps, o *EscrowOrder) error {
+	reference := escrowOrderReference(o.ID)
+	if o.Funding == EscrowFundingWallet {
+		entry := &WalletEntry{Reference: reference, Source: walletSourceEscrow, Type: walletEntryEscrowFunding}
+		err := CommitWalletHold(ctx, d.fs, o.HoldID, entry)
+		// Already committed by an earlier attempt, or released when it expired
+		if errors.Is(err, ErrWalletHoldClosed) && escrowHoldStatus(ctx, d.fs, o.HoldID) == WalletHoldCommitted {
+			err = nil
+		}
+		if errors.Is(err, ErrWalletHoldClosed) {
+			return errEscrowOrderUnfunded
+		}
+		if err != nil {
+			return err
+		}
+		d.postLedger(ctx, o.BuyerUserID, EscrowOrderLedgerTransaction("wallet_"+reference, LedgerEscrowOrderFunding, o.ID,
+			LedgerAccountUserWallet(o.BuyerUserID), o.Amount, o.Currency))
+		return nil
+	}
+
+	pi, err := d.sc.GetPaymentIntent(ctx, o.PaymentIntentID)
+	if err != nil {
+		return err
+	}
+	switch stripe.PaymentIntentStatus(pi.Status) {
+	case stripe.PaymentIntentStatusRequiresCapture:
+		if _, err := d.sc.CapturePaymentIntent(ctx, o.PaymentIntentID, reference+"_capture"); err != nil {
+			d.sc.LogAPIError(ctx, "escrow_order_capture", o.BuyerUserID, err)
+			return err
+		}
+		d.sc.LogAPIInteraction(ctx, "escrow_order_capture", o.BuyerUserID, true, fmt.Sprintf("PaymentIntent: %s", o.PaymentIntentID))
+	case stripe.PaymentIntentStatusSucceeded:
+		// Captured by an earlier attempt
+	default:
+		return errEscrowOrderUnfunded
+	}
+	d.postLedger(ctx, o.BuyerUserID, EscrowOrderLedgerTransaction("charge_"+o.PaymentIntentID, LedgerEscrowOrderFunding, o.PaymentIntentID,
+		LedgerAccountStripeBalance, o.Amount, o.Currency))
+	return nil
+}
+
+// releaseEscrowOrder pays a collected order out to the seller: to their
+// wallet, or by transfer to their connected account
+func releaseEscrowOrder(ctx context.Context, d *webhookDeps, o *EscrowOrder) ([]firestore.Update, error) {
+	if o.Funding == EscrowFundingWallet {
+		entry := &WalletEntry{
+			UserID:    o.SellerUserID,
+			Reference: escrowOrderReference(o.ID) + "_release",
+			Source:    walletSourceEscrow,
+			Type:      walletEntryEscrowRelease,
+			Amount:    o.Amount,
+		}
+		if _, err := ApplyWalletEntry(ctx, d.fs, entry, ""); err != nil {
+			return nil, err
+		}
+		d.postLedger(ctx, o.SellerUserID, EscrowOrderLedgerTransaction("wallet_"+entry.Reference, LedgerEscrowOrderRelease, o.ID,
+			LedgerAccountUserWallet(o.SellerUserID), o.Amount, o.Currency))
+		return nil, nil
+	}
+
+	destination := escrowDestination(ctx, d.fs, o.SellerUserID)
+	if destination == "" {
+		return nil, errEscrowSellerCannotAccept
+	}
+	d.postLedger(ctx, o.SellerUserID, EscrowOrderLedgerTransaction("escrow_order_"+o.ID, LedgerEscrowOrderRelease, o.PaymentIntentID,
+		LedgerAccountUserPayable(o.SellerUserID), o.Amount, o.Currency))
+	tr, err := d.sc.ProcessTransferWithIdempotency(ctx, o.Amount, o.Currency, destination, o.PaymentIntentID, escrowOrderReference(o.ID)+"_transfer")
+	if err != nil {
+		d.sc.LogAPIError(ctx, "escrow_order_transfer", o.SellerUserID, err)
+		return nil, err
+	}
+	d.sc.LogAPIInteraction(ctx, "escrow_order_transfer", o.SellerUserID, true, fmt.Sprintf("Transfer: %s", tr.ID))
+	d.postLedger(ctx, o.SellerUserID, TransferLedgerTransaction(tr.ID, o.SellerUserID, tr.Amount, tr.Currency))
+	return []firestore.Update{{Path: "transfer_id", Value: tr.ID}}, nil
+}
+
+// refundEscrowOrder returns a collected order to the buyer: to their wallet,
+// or by refunding the card payment
+func refundEscrowOrder(ctx context.Context, d *webhookDeps, o *EscrowOrder) ([]firestore.Update, error) {
+	if o.Funding == EscrowFundingWallet {
+		entry := &WalletEntry{
+			UserID:    o.BuyerUserID,
+			Reference: escrowOrderReference(o.ID) + "_refund",
+			Source:    walletSourceEscrow,
+			Type:      walletEntryEscrowRefund,
+			Amount:    o.Amount,
+		}
+		if _, err := ApplyWalletEntry(ctx, d.fs, entry, ""); err != nil {
+			return nil, err
+		}
+		d.postLedger(ctx, o.BuyerUserID, EscrowOrderLedgerTransaction("wallet_"+entry.Reference, LedgerEscrowOrderRefund, o.ID,
+			LedgerAccountUserWallet(o.BuyerUserID), o.Amount, o.Currency))
+		return nil, nil
+	}
+
+	refund, err := d.sc.RefundPaymentIntent(ctx, o.PaymentIntentID, map[string]string{"reason": "escrow_order", "escrow_order_id": o.ID}, escrowOrderReference(o.ID)+"_refund")
+	if err != nil {
+		d.sc.LogAPIError(ctx, "escrow_order_refund", o.BuyerUserID, err)
+		return nil, err
+	}
+	d.sc.LogAPIInteraction(ctx, "escrow_order_refund", o.BuyerUserID, true, fmt.Sprintf("Refund: %s", refund.ID))
+	d.postLedger(ctx, o.BuyerUserID, EscrowOrderLedgerTransaction("refund_"+refund.ID, LedgerEscrowOrderRefund, o.PaymentIntentID,
+		LedgerAccountStripeBalance, refund.Amount, string(refund.Currency)))
+	return []firestore.Update{{Path: "refund_id", Value: refund.ID}}, nil
+}
+
+// voidEscrowOrder gives back an order's funding before delivery: the card
+// authorization is canceled, or the wallet hold released. Funds an earlier
+// delivery attempt already collected are refunded instead.
+func voidEscrowOrder(ctx context.Context, d *webhookDeps, o *EscrowOrder, reason stripe.PaymentIntentCancellationReason) ([]firestore.Update, error) {
+	if o.Funding == EscrowFundingWallet {
+		err := ReleaseWalletHold(ctx, d.fs, o.HoldID, "escrow_order_canceled")
+		if errors.Is(err, ErrWalletHoldClosed) {
+			if escrowHoldStatus(ctx, d.fs, o.HoldID) == WalletHoldCommitted {
+				return refundEscrowOrder(ctx, d, o)
+			}
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if o.PaymentIntentID == "" {
+		// The payment was never created
+		return nil, nil
+	}
+	pi, err := d.sc.GetPaymentIntent(ctx, o.PaymentIntentID)
+	if err != nil {
+		return nil, err
+	}
+	switch stripe.PaymentIntentStatus(pi.Status) {
+	case stripe.PaymentIntentStatusCanceled:
+		return nil, nil
+	case stripe.PaymentIntentStatusSucceeded:
+		if err := collectEscrowOrder(ctx, d, o); err != nil {
+			return nil, err
+		}
+		return refundEscrowOrder(ctx, d, o)
+	}
+	if err := d.sc.CancelPaymentIntent(ctx, o.PaymentIntentID, reason); err != nil {
+		d.sc.LogAPIError(ctx, "escrow_order_void", o.BuyerUserID, err)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// notifyEscrowOrderFunded tells the seller an order is paid and ready to deliver
+func notifyEscrowOrderFunded(ctx context.Context, fs *firestore.Client, o *EscrowOrder) {
+	NotifyUser(ctx, fs, o.SellerUserID, NotificationEscrowOrderFunded, "New order paid",
+		fmt.Sprintf("A buyer paid %s into escrow for %q. Deliver by %s to get paid.", currencyOrDefault(o.Currency).Format(o.Amount), o.Description, o.DeliverBy.Format("Jan 2")),
+		map[string]interface{}{"order_id": o.ID})
+}
+
+// notifyEscrowOrderReleased tells the seller an order's funds are on their way
+func notifyEscrowOrderReleased(ctx context.Context, fs *firestore.Client, o *EscrowOrder) {
+	NotifyUser(ctx, fs, o.SellerUserID, NotificationEscrowOrderReleased, "Payment released",
+		fmt.Sprintf("The %s escrow payment for %q was released to you", currencyOrDefault(o.Currency).Format(o.Amount), o.Description),
+		map[string]interface{}{"order_id": o.ID})
+}
+
+// notifyEscrowOrderRefunded tells the buyer they got their money back
+func notifyEscrowOrderRefunded(ctx context.Context, fs *firestore.Client, o *EscrowOrder) {
+	NotifyUser(ctx, fs, o.BuyerUserID, NotificationPaymentRefunded, "Payment refunded",
+		fmt.Sprintf("Your %s escrow payment for %q has been refunded", currencyOrDefault(o.Currency).Format(o.Amount), o.Description),
+		map[string]interface{}{"order_id": o.ID, "refund_id": o.RefundID})
+}
+
+// notifyEscrowOrderCanceled tells both parties an order was called off
+func notifyEscrowOrderCanceled(ctx context.Context, fs *firestore.Client, o *EscrowOrder) {
+	for _, uid := range []string{o.BuyerUserID, o.SellerUserID} {
+		NotifyUser(ctx, fs, uid, NotificationEscrowOrderCanceled, "Order canceled",
+			fmt.Sprintf("The %s order for %q was canceled and the buyer's payment returned", currencyOrDefault(o.Currency).Format(o.Amount), o.Description),
+			map[string]interface{}{"order_id": o.ID, "reason": o.CancelReason})
+	}
+}
+
+// SettleEscrowOrders picks up card orders whose authorization completed,
+// releases delivered orders whose dispute window has closed, and cancels
+// orders that weren't delivered in time
+func SettleEscrowOrders(ctx context.Context, d *webhookDeps) error {
+	orders := d.fs.Collection("escrow_orders")
+	pending, err := orders.
+		Where("status", "==", EscrowOrderPendingFunding).
+		Where("deliver_by", ">", time.Now()).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load unfunded escrow orders: %w", err)
+	}
+	for _, doc := range pending {
+		var o EscrowOrder
+		if err := doc.DataTo(&o); err != nil {
+			continue
+		}
+		o.ID = doc.Ref.ID
+		if _, err := syncEscrowOrderFunding(ctx, d, &o); err != nil {
+			slog.WarnContext(ctx, "failed to check escrow order funding", "component", "escrow_orders", "order_id", o.ID, "error", err)
+		}
+	}
+
+	due, err := orders.
+		Where("status", "==", EscrowOrderDelivered).
+		Where("release_at", "<=", time.Now()).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load escrow orders due for release: %w", err)
+	}
+	for _, doc := range due {
+		o, err := settleEscrowOrder(ctx, d.fs, doc.Ref.ID, []string{EscrowOrderDelivered}, func(o *EscrowOrder) ([]firestore.Update, error) {
+			updates, err := releaseEscrowOrder(ctx, d, o)
+			return append(updates,
+				firestore.Update{Path: "status", Value: EscrowOrderReleased},
+				firestore.Update{Path: "resolved_by", Value: "auto"},
+			), err
+		})
+		if err != nil {
+			// Still delivered, so the next run tries again
+			if !errors.Is(err, errEscrowOrderBusy) && !errors.Is(err, errEscrowOrderState) {
+				slog.WarnContext(ctx, "failed to release escrow order", "component", "escrow_orders", "order_id", doc.Ref.ID, "error", err)
+			}
+			continue
+		}
+		notifyEscrowOrderReleased(ctx, d.fs, o)
+	}
+
+	expired, err := orders.
+		Where("status", "in", []string{EscrowOrderPendingFunding, EscrowOrderFunded}).
+		Where("deliver_by", "<=", time.Now()).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load undelivered escrow orders: %w", err)
+	}
+	for _, doc := range expired {
+		o, err := settleEscrowOrder(ctx, d.fs, doc.Ref.ID, []string{EscrowOrderPendingFunding, EscrowOrderFunded}, func(o *EscrowOrder) ([]firestore.Update, error) {
+			updates, err := voidEscrowOrder(ctx, d, o, stripe.PaymentIntentCancellationReasonAbandoned)
+			return append(updates,
+				firestore.Update{Path: "status", Value: EscrowOrderCanceled},
+				firestore.Update{Path: "cancel_reason", Value: "not_delivered"},
+			), err
+		})
+		if err != nil {
+			if !errors.Is(err, errEscrowOrderBusy) && !errors.Is(err, errEscrowOrderState) {
+				slog.WarnContext(ctx, "failed to cancel undelivered escrow order", "component", "escrow_orders", "order_id", doc.Ref.ID, "error", err)
+			}
+			continue
+		}
+		notifyEscrowOrderCanceled(ctx, d.fs, o)
+	}
+	return nil
+}
+
+// respondEscrowOrderError maps a failed order step to a response
+func respondEscrowOrderError(c *gin.Context, orderID, action string, err error) {
+	switch {
+	case status.Code(err) == codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+	case errors.Is(err, errEscrowOrderState):
+		c.JSON(http.StatusConflict, gin.H{"error": "The order can't be " + action + " now", "code": "invalid_order_status"})
+	case errors.Is(err, errEscrowOrderBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": "The order is being updated; try again shortly", "code": "order_busy"})
+	case errors.Is(err, errEscrowOrderUnfunded):
+		c.JSON(http.StatusConflict, gin.H{"error": "The buyer's payment is no longer available", "code": "order_unfunded"})
+	case errors.Is(err, errEscrowDisputeWindow):
+		c.JSON(http.StatusConflict, gin.H{"error": "The window to report a problem has closed", "code": "dispute_window_closed"})
+	case errors.Is(err, errEscrowSellerCannotAccept):
+		c.JSON(http.StatusConflict, gin.H{"error": "The seller needs to finish payout setup first", "code": "seller_payouts_disabled"})
+	default:
+		slog.ErrorContext(c.Request.Context(), "escrow order step failed", "component", "escrow_orders", "order_id", orderID, "action", action, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to update order; no funds were lost and you can try again"})
+	}
+}
+
+// CreateEscrowOrder starts a purchase from a seller, paid into escrow by
+// card or from the caller's wallet. A card payment that needs
+// authentication leaves the order pending_funding until the buyer completes
+// it with the returned client secret.
+func CreateEscrowOrder(c *gin.Context) {
+	var req struct {
+		SellerUserID    string `json:"seller_user_id" binding:"required"`
+		Amount          int64  `json:"amount" binding:"required,min=100"` // cents
+		Currency        string `json:"currency"`
+		Description     string `json:"description" binding:"required,max=500"`
+		Funding         string `json:"funding" binding:"required,oneof=card wallet"`
+		PaymentMethodID string `json:"payment_method_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, d, ok := escrowOrderDeps(c)
+	if !ok {
+		return
+	}
+	if req.SellerUserID == uid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't buy from yourself"})
+		return
+	}
+	if !enforceSendLimits(c, uid, req.Amount, req.Currency) {
+		return
+	}
+	ctx := c.Request.Context()
+	fs := d.fs
+	if _, err := getDocument(ctx, UserDoc(ctx, fs, req.SellerUserID)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Seller not found"})
+		return
+	}
+
+	now := time.Now()
+	o := &EscrowOrder{
+		ID:           uuid.NewString(),
+		BuyerUserID:  uid,
+		SellerUserID: req.SellerUserID,
+		Participants: []string{uid, req.SellerUserID},
+		Amount:       req.Amount,
+		Currency:     req.Currency,
+		Description:  strings.TrimSpace(req.Description),
+		Funding:      req.Funding,
+		Status:       EscrowOrderPendingFunding,
+		DeliverBy:    now.Add(escrowDeliveryWindow()),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	ref := fs.Collection("escrow_orders").Doc(o.ID)
+
+	if o.Funding == EscrowFundingWallet {
+		if o.Currency != "" && !strings.EqualFold(o.Currency, walletCurrency) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wallet orders are paid in USD", "code": "unsupported_currency"})
+			return
+		}
+		o.Currency = walletCurrency
+		for _, party := range o.Participants {
+			if _, err := walletHandleForUser(ctx, fs, party, ProcessorStripe); err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "Both parties need a Stripe-backed wallet to pay from a wallet", "code": "wallet_unsupported"})
+				return
+			}
+		}
+		hold, err := PlaceWalletHold(ctx, fs, uid, escrowOrderReference(o.ID), o.Amount, time.Until(o.DeliverBy)+time.Hour)
+		if errors.Is(err, ErrInsufficientFunds) {
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient wallet balance", "code": "insufficient_funds"})
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to hold escrow order funds", "component", "escrow_orders", "user_id", uid, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve funds"})
+			return
+		}
+		o.HoldID, o.Status = hold.ID, EscrowOrderFunded
+		if _, err := ref.Create(ctx, o); err != nil {
+			if relErr := ReleaseWalletHold(ctx, fs, hold.ID, "escrow_order_failed"); relErr != nil {
+				slog.ErrorContext(ctx, "failed to release wallet hold", "component", "escrow_orders", "hold_id", hold.ID, "error", relErr)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+			return
+		}
+		notifyEscrowOrderFunded(ctx, fs, o)
+		c.JSON(http.StatusCreated, gin.H{"order": o})
+		return
+	}
+
+	if !validatePaymentCurrency(c, uid, &o.Currency, o.Amount) {
+		return
+	}
+	if escrowDestination(ctx, fs, o.SellerUserID) == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "The seller can't accept escrow payments yet", "code": "seller_payouts_disabled"})
+		return
+	}
+	buyer, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	customerID := stringField(buyer.Data(), providerUserField(ProcessorStripe, "customer_id"))
+	paymentMethodID := req.PaymentMethodID
+	if paymentMethodID == "" {
+		paymentMethodID = defaultPaymentMethod(ctx, fs, uid)
+	}
+	if customerID == "" || paymentMethodID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Add a card to pay into escrow", "code": "payment_method_required"})
+		return
+	}
+	sca, err := cardSCAPolicy(ctx, d.sc, paymentMethodID, o.Amount, o.Currency, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment method"})
+		return
+	}
+	// Recorded before the card is authorized, so an authorization that
+	// outlives a failed request is still canceled when the order expires
+	if _, err := ref.Create(ctx, o); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+		return
+	}
+
+	pi, err := d.sc.CreatePaymentIntentWithIdempotency(ctx, PaymentParams{
+		Amount:          o.Amount,
+		Currency:        o.Currency,
+		CustomerID:      customerID,
+		PaymentMethodID: paymentMethodID,
+		Metadata: map[string]string{
+			"flow":            escrowOrderFlow,
+			"escrow_order_id": o.ID,
+			"buyer_user_id":   o.BuyerUserID,
+			"seller_user_id":  o.SellerUserID,
+		},
+		IdempotencyKey:     escrowOrderReference(o.ID),
+		SCA:                sca,
+		PaymentMethodTypes: []string{"card"},
+		CaptureManual:      true,
+	})
+	if err != nil {
+		d.sc.LogAPIError(ctx, "escrow_order_authorize", uid, err)
+		updates := []firestore.Update{
+			{Path: "status", Value: EscrowOrderCanceled},
+			{Path: "cancel_reason", Value: "payment_failed"},
+			{Path: "updated_at", Value: time.Now()},
+		}
+		// A declined card still leaves a PaymentIntent behind
+		if se := stripeErrorDetails(err); se != nil && se.PaymentIntentID != "" {
+			updates = append(updates, firestore.Update{Path: "payment_intent_id", Value: se.PaymentIntentID})
+		}
+		if _, upErr := ref.Update(ctx, updates); upErr != nil {
+			slog.ErrorContext(ctx, "failed to record failed escrow order", "component", "escrow_orders", "order_id", o.ID, "error", upErr)
+		}
+		c.JSON(http.StatusPaymentRequired, stripeErrorBody(c, "Payment failed", err))
+		return
+	}
+	o.PaymentIntentID = pi.ID
+	updates := []firestore.Update{{Path: "payment_intent_id", Value: pi.ID}}
+	if pi.Status == string(stripe.PaymentIntentStatusRequiresCapture) {
+		o.Status = EscrowOrderFunded
+		updates = append(updates, firestore.Update{Path: "status", Value: EscrowOrderFunded})
+	}
+	if _, err := ref.Update(ctx, updates); err != nil {
+		slog.ErrorContext(ctx, "failed to record escrow order payment", "component", "escrow_orders", "order_id", o.ID, "payment_intent", pi.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+		return
+	}
+	if o.Status == EscrowOrderFunded {
+		notifyEscrowOrderFunded(ctx, fs, o)
+	}
+	c.JSON(http.StatusCreated, gin.H{"order": o, "client_secret": pi.ClientSecret, "next_action": pi.NextAction})
+}
+
+// ListEscrowOrders returns orders the caller is buying or selling, newest
+// first; role=buyer or role=seller narrows it to one side
+func ListEscrowOrders(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	role := c.Query("role")
+	if role != "" && role != "buyer" && role != "seller" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be buyer or seller"})
+		return
+	}
+	docs, err := fs.Collection("escrow_orders").
+		Where("participants", "array-contains", uid).
+		OrderBy("created_at", firestore.Desc).
+		Limit(100).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load orders"})
+		return
+	}
+	orders := make([]EscrowOrder, 0, len(docs))
+	for _, doc := range docs {
+		var o EscrowOrder
+		if err := doc.DataTo(&o); err != nil {
+			continue
+		}
+		if (role == "buyer" && o.BuyerUserID != uid) || (role == "seller" && o.SellerUserID != uid) {
+			continue
+		}
+		o.ID = doc.Ref.ID
+		orders = append(orders, o)
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": orders})
+}
+
+// GetEscrowOrder returns one of the caller's orders, first picking up a
+// card authorization the buyer has since completed
+func GetEscrowOrder(c *gin.Context) {
+	uid, d, ok := escrowOrderDeps(c)
+	if !ok {
+		return
+	}
+	o, ok := callerEscrowOrder(c, d.fs, uid)
+	if !ok {
+		return
+	}
+	if synced, err := syncEscrowOrderFunding(c.Request.Context(), d, o); err == nil {
+		o = synced
+	}
+	c.JSON(http.StatusOK, o)
+}
+
+// DeliverEscrowOrder lets the seller mark an order delivered. The buyer's
+// funds are collected into escrow and the release window starts.
+func DeliverEscrowOrder(c *gin.Context) {
+	var req struct {
+		Note string `json:"note" binding:"max=1000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, d, ok := escrowOrderDeps(c)
+	if !ok {
+		return
+	}
+	o, ok := callerEscrowOrder(c, d.fs, uid)
+	if !ok {
+		return
+	}
+	if o.SellerUserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the seller can mark an order delivered"})
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := syncEscrowOrderFunding(ctx, d, o); err != nil {
+		respondEscrowOrderError(c, o.ID, "delivered", err)
+		return
+	}
+
+	o, err := settleEscrowOrder(ctx, d.fs, o.ID, []string{EscrowOrderFunded}, func(o *EscrowOrder) ([]firestore.Update, error) {
+		if err := collectEscrowOrder(ctx, d, o); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		updates := []firestore.Update{
+			{Path: "status", Value: EscrowOrderDelivered},
+			{Path: "delivered_at", Value: now},
+			{Path: "release_at", Value: now.Add(escrowReleaseWindow())},
+		}
+		if req.Note != "" {
+			updates = append(updates, firestore.Update{Path: "delivery_note", Value: req.Note})
+		}
+		return updates, nil
+	})
+	if err != nil {
+		respondEscrowOrderError(c, c.Param("id"), "delivered", err)
+		return
+	}
+	NotifyUser(ctx, d.fs, o.BuyerUserID, NotificationEscrowOrderDelivered, "Your order was delivered",
+		fmt.Sprintf("Release your %s payment for %q, or report a problem by %s", currencyOrDefault(o.Currency).Format(o.Amount), o.Description, o.ReleaseAt.Format("Jan 2")),
+		map[string]interface{}{"order_id": o.ID})
+	c.JSON(http.StatusOK, o)
+}
+
+// ReleaseEscrowOrder lets the buyer release a delivered order to the seller,
+// including one they had disputed
+func ReleaseEscrowOrder(c *gin.Context) {
+	uid, d, ok := escrowOrderDeps(c)
+	if !ok {
+		return
+	}
+	o, ok := callerEscrowOrder(c, d.fs, uid)
+	if !ok {
+		return
+	}
+	if o.BuyerUserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the buyer can release an order"})
+		return
+	}
+	ctx := c.Request.Context()
+	o, err := settleEscrowOrder(ctx, d.fs, o.ID, []string{EscrowOrderDelivered, EscrowOrderDisputed}, func(o *EscrowOrder) ([]firestore.Update, error) {
+		updates, err := releaseEscrowOrder(ctx, d, o)
+		return append(updates,
+			firestore.Update{Path: "status", Value: EscrowOrderReleased},
+			firestore.Update{Path: "resolved_by", Value: uid},
+		), err
+	})
+	if err != nil {
+		respondEscrowOrderError(c, c.Param("id"), "released", err)
+		return
+	}
+	notifyEscrowOrderReleased(ctx, d.fs, o)
+	c.JSON(http.StatusOK, o)
+}
+
+// DisputeEscrowOrder lets the buyer report a problem with a delivery before
+// its release window closes. The funds stay in escrow until an admin
+// resolves it, or the buyer releases them.
+func DisputeEscrowOrder(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required,max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, d, ok := escrowOrderDeps(c)
+	if !ok {
+		return
+	}
+	o, ok := callerEscrowOrder(c, d.fs, uid)
+	if !ok {
+		return
+	}
+	if o.BuyerUserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the buyer can dispute an order"})
+		return
+	}
+	ctx := c.Request.Context()
+	o, err := settleEscrowOrder(ctx, d.fs, o.ID, []string{EscrowOrderDelivered}, func(o *EscrowOrder) ([]firestore.Update, error) {
+		if o.ReleaseAt != nil && !time.Now().Before(*o.ReleaseAt) {
+			return nil, errEscrowDisputeWindow
+		}
+		return []firestore.Update{
+			{Path: "status", Value: EscrowOrderDisputed},
+			{Path: "dispute_reason", Value: req.Reason},
+			{Path: "disputed_at", Value: time.Now()},
+		}, nil
+	})
+	if err != nil {
+		respondEscrowOrderError(c, c.Param("id"), "disputed", err)
+		return
+	}
+	NotifyUser(ctx, d.fs, o.SellerUserID, NotificationEscrowOrderDisputed, "Buyer reported a problem",
+		fmt.Sprintf("The buyer disputed your %s order for %q. The payment stays in escrow while we review it.", currencyOrDefault(o.Currency).Format(o.Amount), o.Description),
+		map[string]interface{}{"order_id": o.ID})
+	c.JSON(http.StatusOK, o)
+}
+
+// CancelEscrowOrder lets either party call off an order before it's
+// delivered; the buyer's card authorization or wallet hold is released
+func CancelEscrowOrder(c *gin.Context) {
+	uid, d, ok := escrowOrderDeps(c)
+	if !ok {
+		return
+	}
+	o, ok := callerEscrowOrder(c, d.fs, uid)
+	if !ok {
+		return
+	}
+	reason := "canceled_by_buyer"
+	if o.SellerUserID == uid {
+		reason = "canceled_by_seller"
+	}
+	ctx := c.Request.Context()
+	o, err := settleEscrowOrder(ctx, d.fs, o.ID, []string{EscrowOrderPendingFunding, EscrowOrderFunded}, func(o *EscrowOrder) ([]firestore.Update, error) {
+		updates, err := voidEscrowOrder(ctx, d, o, stripe.PaymentIntentCancellationReasonRequestedByCustomer)
+		return append(updates,
+			firestore.Update{Path: "status", Value: EscrowOrderCanceled},
+			firestore.Update{Path: "cancel_reason", Value: reason},
+		), err
+	})
+	if err != nil {
+		respondEscrowOrderError(c, c.Param("id"), "canceled", err)
+		return
+	}
+	notifyEscrowOrderCanceled(ctx, d.fs, o)
+	c.JSON(http.StatusOK, o)
+}
+
+// ListEscrowOrdersAdmin returns orders in a status, oldest first, for
+// arbitration; status defaults to disputed
+func ListEscrowOrdersAdmin(c *gin.Context) {
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	state := c.DefaultQuery("status", EscrowOrderDisputed)
+	ctx := c.Request.Context()
+	docs, err := fs.Collection("escrow_orders").
+		Where("status", "==", state).
+		OrderBy("created_at", firestore.Asc).
+		Limit(100).
+		Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load orders"})
+		return
+	}
+	orders := make([]EscrowOrder, 0, len(docs))
+	for _, doc := range docs {
+		var o EscrowOrder
+		if err := doc.DataTo(&o); err != nil {
+			continue
+		}
+		o.ID = doc.Ref.ID
+		orders = append(orders, o)
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessRead, SubjectType: "escrow_order", Query: "status=" + state}); err != nil {
+		slog.ErrorContext(ctx, "failed to log admin access", "component", "escrow_orders", "admin_id", adminID, "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": orders})
+}
+
+// ResolveEscrowOrder lets an admin settle a disputed order by releasing it
+// to the seller or refunding the buyer
+func ResolveEscrowOrder(c *gin.Context) {
+	var req struct {
+		Outcome string `json:"outcome" binding:"required,oneof=release refund"`
+		Note    string `json:"note" binding:"required,max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	sc, ok := c.Get("stripeClient")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+		return
+	}
+	d := &webhookDeps{fs: fs, sc: sc.(*StripeClient)}
+	if v, ok := c.Get("ledger"); ok {
+		d.ledger = v.(LedgerStore)
+	}
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	o, err := settleEscrowOrder(ctx, fs, id, []string{EscrowOrderDisputed}, func(o *EscrowOrder) ([]firestore.Update, error) {
+		var updates []firestore.Update
+		var err error
+		outcome := EscrowOrderReleased
+		if req.Outcome == "refund" {
+			outcome = EscrowOrderRefunded
+			updates, err = refundEscrowOrder(ctx, d, o)
+		} else {
+			updates, err = releaseEscrowOrder(ctx, d, o)
+		}
+		return append(updates,
+			firestore.Update{Path: "status", Value: outcome},
+			firestore.Update{Path: "resolved_by", Value: adminID},
+			firestore.Update{Path: "resolution_note", Value: req.Note},
+		), err
+	})
+	if err != nil {
+		respondEscrowOrderError(c, id, "resolved", err)
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "escrow_order", SubjectID: id}); err != nil {
+		slog.ErrorContext(ctx, "failed to log admin access", "component", "escrow_orders", "admin_id", adminID, "error", err)
+	}
+	slog.InfoContext(ctx, "escrow order resolved", "component", "escrow_orders", "order_id", id, "admin_id", adminID, "outcome", o.Status)
+	if o.Status == EscrowOrderRefunded {
+		notifyEscrowOrderRefunded(ctx, fs, o)
+	} else {
+		notifyEscrowOrderReleased(ctx, fs, o)
+	}
+	c.JSON(http.StatusOK, o)
+}
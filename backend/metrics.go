@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metric names referenced by the SLO alerting rules in slo.go
+const (
+	MetricHTTPRequestDuration = "http_request_duration_seconds"
+	MetricPaymentsTotal       = "payments_total"
+	MetricWebhookLag          = "webhook_processing_lag_seconds"
+	// MetricWebhookEndpointIssues counts misconfigured Stripe webhook
+	// endpoints found by VerifyWebhookEndpoints
+	MetricWebhookEndpointIssues = "stripe_webhook_endpoint_issues_total"
+)
+
+// defaultBuckets are the histogram upper bounds, in seconds
+var defaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricsRegistry is a minimal in-process store rendered in the Prometheus text format
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+var metrics = &metricsRegistry{
+	counters:   map[string]map[string]float64{},
+	histograms: map[string]map[string]*histogram{},
+}
+
+// labelKey renders labels in a stable order, e.g. `method="GET",route="/health"`
+func labelKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// IncCounter adds one to a labelled counter
+func (m *metricsRegistry) IncCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = map[string]float64{}
+	}
+	m.counters[name][labelKey(labels)]++
+}
+
+// Observe records a value in a labelled histogram
+func (m *metricsRegistry) Observe(name string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = map[string]*histogram{}
+	}
+	key := labelKey(labels)
+	h := m.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(defaultBuckets))}
+		m.histograms[name][key] = h
+	}
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// joinLabels appends an extra label to an already rendered label set
+func joinLabels(key, extra string) string {
+	if key == "" {
+		return extra
+	}
+	return key + "," + extra
+}
+
+// render writes all metrics in the Prometheus exposition format
+func (m *metricsRegistry) render() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		for key, v := range m.counters[name] {
+			fmt.Fprintf(&b, "%s{%s} %g\n", name, key, v)
+		}
+	}
+
+	names = names[:0]
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		for key, h := range m.histograms[name] {
+			for i, bound := range defaultBuckets {
+				fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, joinLabels(key, fmt.Sprintf("le=%q", fmt.Sprint(bound))), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, joinLabels(key, fmt.Sprintf("le=%q", fmt.Sprint(math.Inf(1)))), h.count)
+			fmt.Fprintf(&b, "%s_sum{%s} %g\n", name, key, h.sum)
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", name, key, h.count)
+		}
+	}
+	return b.String()
+}
+
+// MetricsMiddleware records request latency per route for the API latency SLO
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.Observe(MetricHTTPRequestDuration, map[string]string{
+			"method": c.Request.Method,
+			"route":  route,
+			"code":   fmt.Sprint(c.Writer.Status()),
+		}, time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler exposes collected metrics for Prometheus scraping
+func MetricsHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(metrics.render()))
+}
@@ -19,7 +19,8 @@ func CORSMiddleware() gin.HandlerFunc {
 
 		c.Header("Access-Control-Allow-Origin", allowedOrigins)
 		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, If-None-Match")
+		c.Header("Access-Control-Expose-Headers", "ETag")
 		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE, PATCH")
 
 		if c.Request.Method == "OPTIONS" {
@@ -56,6 +57,12 @@ func AuthMiddleware() gin.HandlerFunc {
                 if email, ok := idToken.Claims["email"].(string); ok {
                     c.Set("email", email)
                 }
+                if verified, ok := idToken.Claims["email_verified"].(bool); ok {
+                    c.Set("emailVerified", verified)
+                }
+                if admin, ok := idToken.Claims["admin"].(bool); ok && admin {
+                    c.Set("isAdmin", true)
+                }
                 c.Next()
                 return
             }
@@ -66,6 +73,19 @@ func AuthMiddleware() gin.HandlerFunc {
     }
 }
 
+// AdminMiddleware restricts a route group to users with the Firebase "admin" custom claim.
+// It must run after AuthMiddleware.
+func AdminMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if c.GetBool("isAdmin") {
+            c.Next()
+            return
+        }
+        c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+        c.Abort()
+    }
+}
+
 // GenerateJWT creates a new JWT token for a user
 func GenerateJWT(userID, email, userHandle string) (string, error) {
     return "", nil
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Migration statuses kept on schema_migrations/{id}
+const (
+	MigrationPending   = "pending"
+	MigrationRunning   = "running"
+	MigrationCompleted = "completed"
+	// MigrationFailed means the walk finished but some documents could not be
+	// migrated; they are listed under failures and the migration can be rerun
+	MigrationFailed = "failed"
+)
+
+const (
+	// migrationLease is how long an instance owns a migration run
+	migrationLease = 2 * time.Minute
+	// migrationRunBudget bounds one run so the lease never lapses mid-batch
+	migrationRunBudget = 45 * time.Second
+	// defaultMigrationBatchSize is how many documents are read per checkpoint
+	defaultMigrationBatchSize = 200
+)
+
+// Migration reshapes every document of a collection to schema version
+// Version. Migrate receives a document's data and returns the updates to
+// apply, or none if the document is already in the new shape; it must be safe
+// to run on a document more than once, because writes made between releases
+// can leave a document partly migrated. Migrations run in the order they are
+// listed in migrations, one at a time.
+type Migration struct {
+	ID          string
+	Collection  string
+	Version     int
+	Description string
+	Migrate     func(data map[string]interface{}) ([]firestore.Update, error)
+}
+
+// MigrationState is a migration's progress, stored at schema_migrations/{id}.
+// Cursors checkpoint the last document migrated in each database, so a run
+// cut short by a deploy picks up where it stopped.
+type MigrationState struct {
+	ID          string            `json:"id" firestore:"-"`
+	Collection  string            `json:"collection" firestore:"collection"`
+	Version     int               `json:"version" firestore:"version"`
+	Description string            `json:"description" firestore:"description"`
+	Status      string            `json:"status" firestore:"status"`
+	Cursors     map[string]string `json:"cursors,omitempty" firestore:"cursors,omitempty"`
+	Done        []string          `json:"done,omitempty" firestore:"done,omitempty"`
+	Scanned     int               `json:"scanned" firestore:"scanned"`
+	Migrated    int               `json:"migrated" firestore:"migrated"`
+	Failed      int               `json:"failed" firestore:"failed"`
+	LeaseUntil  time.Time         `json:"-" firestore:"lease_until,omitempty"`
+	StartedAt   time.Time         `json:"started_at,omitempty" firestore:"started_at,omitempty"`
+	CompletedAt time.Time         `json:"completed_at,omitempty" firestore:"completed_at,omitempty"`
+	UpdatedAt   time.Time         `json:"updated_at" firestore:"updated_at"`
+}
+
+// migrations is every schema migration in the order they run. Append new ones;
+// never reorder or remove one that has shipped.
+var migrations = []Migration{
+	{
+		ID:          "0001_transactions_participants",
+		Collection:  "transactions",
+		Version:     1,
+		Description: "Backfill participants and schema_version on transactions written before the schema contract",
+		Migrate:     migrateTransactionParticipants,
+	},
+	{
+		ID:          "0002_transactions_created_at",
+		Collection:  "transactions",
+		Version:     1,
+		Description: "Backfill created_at, the history ordering field, on transactions first recorded by a webhook",
+		Migrate:     migrateTransactionCreatedAt,
+	},
+}
+
+// migrateTransactionParticipants adds the participants array security rules
+// match against to transactions that predate it
+func migrateTransactionParticipants(data map[string]interface{}) ([]firestore.Update, error) {
+	if _, ok := data["participants"]; ok {
+		return nil, nil
+	}
+	var participants []interface{}
+	for _, key := range []string{"sender_user_id", "recipient_user_id"} {
+		if uid := stringField(data, key); uid != "" {
+			participants = append(participants, uid)
+		}
+	}
+	if len(participants) == 0 {
+		return nil, fmt.Errorf("transaction has no sender or recipient")
+	}
+	return []firestore.Update{{Path: "participants", Value: firestore.ArrayUnion(participants...)}}, nil
+}
+
+// migrateTransactionCreatedAt gives transactions without created_at their
+// first recorded write time, so history queries ordered by it include them
+func migrateTransactionCreatedAt(data map[string]interface{}) ([]firestore.Update, error) {
+	if _, ok := data["created_at"].(time.Time); ok {
+		return nil, nil
+	}
+	updatedAt, ok := data["updated_at"].(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("transaction has neither created_at nor updated_at")
+	}
+	return []firestore.Update{{Path: "created_at", Value: updatedAt}}, nil
+}
+
+// migrationBatchSize reads MIGRATION_BATCH_SIZE
+func migrationBatchSize() int {
+	if n, err := strconv.Atoi(os.Getenv("MIGRATION_BATCH_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMigrationBatchSize
+}
+
+// migrationDatabase is one database holding a migration's collection
+type migrationDatabase struct {
+	name string
+	fs   *firestore.Client
+}
+
+// migrationDatabases returns the databases a collection lives in: users are
+// split across the primary and EU databases when data residency is on
+func migrationDatabases(fs *firestore.Client, collection string) []migrationDatabase {
+	dbs := []migrationDatabase{{name: "primary", fs: fs}}
+	if collection == "users" && dataResidencyEnabled() && euFirestore != nil {
+		dbs = append(dbs, migrationDatabase{name: RegionEU, fs: euFirestore})
+	}
+	return dbs
+}
+
+// RunMigrations advances the first unfinished migration. A failed migration
+// holds back the ones after it until it is rerun, so migrations always
+// complete in order.
+func RunMigrations(ctx context.Context, fs *firestore.Client) error {
+	for _, m := range migrations {
+		ref := fs.Collection("schema_migrations").Doc(m.ID)
+		state, claimed, err := claimMigration(ctx, fs, ref, m)
+		if err != nil {
+			return fmt.Errorf("failed to claim migration %s: %w", m.ID, err)
+		}
+		switch {
+		case state.Status == MigrationCompleted:
+			continue
+		case claimed:
+			return runMigration(ctx, fs, ref, m, state)
+		default:
+			// Failed, or another instance holds the lease
+			return nil
+		}
+	}
+	return nil
+}
+
+// claimMigration registers a migration on first sight and takes its lease if
+// it has work left and no other instance holds it
+func claimMigration(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef, m Migration) (*MigrationState, bool, error) {
+	var state MigrationState
+	claimed := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		now := time.Now()
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err != nil {
+			state = MigrationState{Collection: m.Collection, Version: m.Version, Description: m.Description, Status: MigrationPending}
+		} else if err := snap.DataTo(&state); err != nil {
+			return err
+		}
+		if state.Status == MigrationCompleted || state.Status == MigrationFailed || state.LeaseUntil.After(now) {
+			return nil
+		}
+		claimed = true
+		if state.Status == MigrationPending {
+			state.Status = MigrationRunning
+			state.StartedAt = now
+		}
+		state.LeaseUntil = now.Add(migrationLease)
+		state.UpdatedAt = now
+		return tx.Set(ref, state)
+	})
+	state.ID = ref.ID
+	return &state, claimed, err
+}
+
+// runMigration walks the migration's collection from its checkpoints until the
+// run budget is spent, then completes it once every database is done
+func runMigration(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef, m Migration, state *MigrationState) error {
+	deadline := time.Now().Add(migrationRunBudget)
+	batchSize := migrationBatchSize()
+	if state.Cursors == nil {
+		state.Cursors = map[string]string{}
+	}
+	done := map[string]bool{}
+	for _, name := range state.Done {
+		done[name] = true
+	}
+
+	for _, db := range migrationDatabases(fs, m.Collection) {
+		for !done[db.name] && time.Now().Before(deadline) {
+			q := db.fs.Collection(m.Collection).OrderBy(firestore.DocumentID, firestore.Asc).Limit(batchSize)
+			if cursor := state.Cursors[db.name]; cursor != "" {
+				q = q.StartAfter(cursor)
+			}
+			docs, err := q.Documents(ctx).GetAll()
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", m.Collection, err)
+			}
+			for _, doc := range docs {
+				migrated, err := migrateDocument(ctx, doc, m)
+				state.Scanned++
+				switch {
+				case err != nil:
+					state.Failed++
+					recordMigrationFailure(ctx, ref, db.name, doc.Ref, err)
+				case migrated:
+					state.Migrated++
+				}
+			}
+			if len(docs) > 0 {
+				state.Cursors[db.name] = docs[len(docs)-1].Ref.ID
+			}
+			if len(docs) < batchSize {
+				done[db.name] = true
+				state.Done = append(state.Done, db.name)
+			}
+			if err := saveMigrationCheckpoint(ctx, ref, state); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, db := range migrationDatabases(fs, m.Collection) {
+		if !done[db.name] {
+			return nil
+		}
+	}
+	state.Status = MigrationCompleted
+	if state.Failed > 0 {
+		state.Status = MigrationFailed
+	}
+	now := time.Now()
+	_, err := ref.Update(ctx, []firestore.Update{
+		{Path: "status", Value: state.Status},
+		{Path: "completed_at", Value: now},
+		{Path: "updated_at", Value: now},
+		{Path: "lease_until", Value: firestore.Delete},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete migration %s: %w", m.ID, err)
+	}
+	slog.InfoContext(ctx, "schema migration finished", "component", "migrations", "migration", m.ID, "status", state.Status, "scanned", state.Scanned, "migrated", state.Migrated, "failed", state.Failed)
+	return nil
+}
+
+// migrateDocument applies a migration to one document, reporting whether it
+// changed anything. The write is conditioned on the document not having
+// changed since it was read; a concurrent write makes it re-read and retry.
+func migrateDocument(ctx context.Context, doc *firestore.DocumentSnapshot, m Migration) (bool, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		data := doc.Data()
+		updates, err := m.Migrate(data)
+		if err != nil {
+			return false, err
+		}
+		if version, _ := data["schema_version"].(int64); version < int64(m.Version) {
+			updates = append(updates, firestore.Update{Path: "schema_version", Value: m.Version})
+		}
+		if len(updates) == 0 {
+			return false, nil
+		}
+		_, err = doc.Ref.Update(ctx, updates, firestore.LastUpdateTime(doc.UpdateTime))
+		if status.Code(err) != codes.FailedPrecondition {
+			return err == nil, err
+		}
+		if doc, err = doc.Ref.Get(ctx); err != nil {
+			return false, err
+		}
+	}
+	return false, fmt.Errorf("document kept changing during migration")
+}
+
+// recordMigrationFailure keeps a document a migration couldn't apply to for review
+func recordMigrationFailure(ctx context.Context, ref *firestore.DocumentRef, database string, docRef *firestore.DocumentRef, cause error) {
+	slog.ErrorContext(ctx, "schema migration failed for document", "component", "migrations", "migration", ref.ID, "document", docRef.Path, "error", cause)
+	_, err := ref.Collection("failures").Doc(database+"_"+docRef.ID).Set(ctx, map[string]interface{}{
+		"database":  database,
+		"document":  docRef.Path,
+		"error":     cause.Error(),
+		"failed_at": time.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record migration failure", "component", "migrations", "migration", ref.ID, "error", err)
+	}
+}
+
+// saveMigrationCheckpoint records a migration's cursors and counts and extends its lease
+func saveMigrationCheckpoint(ctx context.Context, ref *firestore.DocumentRef, state *MigrationState) error {
+	now := time.Now()
+	_, err := ref.Update(ctx, []firestore.Update{
+		{Path: "cursors", Value: state.Cursors},
+		{Path: "done", Value: state.Done},
+		{Path: "scanned", Value: state.Scanned},
+		{Path: "migrated", Value: state.Migrated},
+		{Path: "failed", Value: state.Failed},
+		{Path: "lease_until", Value: now.Add(migrationLease)},
+		{Path: "updated_at", Value: now},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to checkpoint migration %s: %w", ref.ID, err)
+	}
+	return nil
+}
+
+// ListMigrations returns every registered migration with its progress
+func ListMigrations(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	refs := make([]*firestore.DocumentRef, len(migrations))
+	for i, m := range migrations {
+		refs[i] = fs.Collection("schema_migrations").Doc(m.ID)
+	}
+	docs, err := fs.GetAll(ctx, refs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load migrations"})
+		return
+	}
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{ID: m.ID, Collection: m.Collection, Version: m.Version, Description: m.Description, Status: MigrationPending}
+		if docs[i].Exists() {
+			if err := docs[i].DataTo(&states[i]); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read migration"})
+				return
+			}
+			states[i].ID = m.ID
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"migrations": states, "document_schema_version": DocumentSchemaVersion})
+}
+
+// RerunMigration restarts a failed migration from the beginning. Documents
+// already migrated are skipped by the migration itself.
+func RerunMigration(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := fs.Collection("schema_migrations").Doc(c.Param("id"))
+	rerun := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		rerun = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if stringField(snap.Data(), "status") != MigrationFailed {
+			return nil
+		}
+		rerun = true
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: MigrationPending},
+			{Path: "cursors", Value: firestore.Delete},
+			{Path: "done", Value: firestore.Delete},
+			{Path: "scanned", Value: 0},
+			{Path: "migrated", Value: 0},
+			{Path: "failed", Value: 0},
+			{Path: "completed_at", Value: firestore.Delete},
+			{Path: "updated_at", Value: time.Now()},
+		})
+	})
+	if status.Code(err) == codes.NotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Migration not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rerun migration"})
+		return
+	}
+	if !rerun {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only failed migrations can be rerun"})
+		return
+	}
+	// Failures from the last run are recorded again if they recur
+	if failures, err := ref.Collection("failures").Limit(500).Documents(ctx).GetAll(); err == nil && len(failures) > 0 {
+		batch := fs.Batch()
+		for _, doc := range failures {
+			batch.Delete(doc.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to clear migration failures", "component", "migrations", "migration", ref.ID, "error", err)
+		}
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: c.GetString("userID"), Action: AdminAccessWrite, SubjectType: "schema_migration", SubjectID: ref.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log migration access", "component", "migrations", "migration", ref.ID, "error", err)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"id": ref.ID, "status": MigrationPending})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Email receipts are sent through the provider EMAIL_PROVIDER names:
+//
+//   - sendgrid: SENDGRID_API_KEY, through the SendGrid v3 mail API;
+//   - ses: SES_SMTP_HOST, SES_SMTP_PORT (default 587), SES_SMTP_USERNAME and
+//     SES_SMTP_PASSWORD, through the Amazon SES SMTP interface.
+//
+// EMAIL_FROM is the sender address for both. Unset, no email is sent.
+
+// DependencySendGrid names SendGrid for egress settings
+const DependencySendGrid = "sendgrid"
+
+// sendGridMailURL is SendGrid's v3 send endpoint
+const sendGridMailURL = "https://api.sendgrid.com/v3/mail/send"
+
+// EmailMessage is one plain-text email
+type EmailMessage struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// EmailSender sends email through a provider
+type EmailSender interface {
+	Send(ctx context.Context, msg EmailMessage) error
+}
+
+// emailSender sends notification emails; nil when email isn't configured
+var emailSender EmailSender
+
+// InitEmailSender sets up the provider EMAIL_PROVIDER names
+func InitEmailSender() error {
+	provider := strings.ToLower(strings.TrimSpace(os.Getenv("EMAIL_PROVIDER")))
+	if provider == "" {
+		return nil
+	}
+	from := os.Getenv("EMAIL_FROM")
+	if _, err := mail.ParseAddress(from); err != nil {
+		return fmt.Errorf("EMAIL_FROM must be an email address")
+	}
+	switch provider {
+	case "sendgrid":
+		apiKey := os.Getenv("SENDGRID_API_KEY")
+		if apiKey == "" {
+			return fmt.Errorf("missing required SENDGRID_API_KEY environment variable")
+		}
+		base, err := providerTransport(DependencySendGrid)
+		if err != nil {
+			base = failedTransport{err: fmt.Errorf("sendgrid egress: %w", err)}
+		}
+		emailSender = &sendGridSender{
+			apiKey: apiKey,
+			from:   from,
+			httpClient: &http.Client{
+				Timeout:   15 * time.Second,
+				Transport: tracedTransport(DependencySendGrid, base),
+			},
+		}
+	case "ses":
+		host := os.Getenv("SES_SMTP_HOST")
+		username, password := os.Getenv("SES_SMTP_USERNAME"), os.Getenv("SES_SMTP_PASSWORD")
+		if host == "" || username == "" || password == "" {
+			return fmt.Errorf("SES_SMTP_HOST, SES_SMTP_USERNAME, and SES_SMTP_PASSWORD are required for ses")
+		}
+		port := os.Getenv("SES_SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		emailSender = &sesSender{
+			addr: net.JoinHostPort(host, port),
+			auth: smtp.PlainAuth("", username, password, host),
+			from: from,
+		}
+	default:
+		return fmt.Errorf("EMAIL_PROVIDER must be sendgrid or ses")
+	}
+	return nil
+}
+
+// sendGridSender sends through the SendGrid v3 mail API
+type sendGridSender struct {
+	apiKey     string
+	from       string
+	httpClient *http.Client
+}
+
+func (s *sendGridSender) Send(ctx context.Context, msg EmailMessage) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"personalizations": []map[string]interface{}{{"to": []map[string]string{{"email": msg.To}}}},
+		"from":             map[string]string{"email": s.from},
+		"subject":          msg.Subject,
+		"content":          []map[string]string{{"type": "text/plain", "value": msg.Text}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridMailURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sendgrid: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("sendgrid: status %d: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
+
+// sesSender sends through the Amazon SES SMTP interface
+type sesSender struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func (s *sesSender) Send(ctx context.Context, msg EmailMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mimeHeader(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+
+	// smtp.SendMail takes no context, so give up waiting on it instead
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, []byte(b.String()))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("ses: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mimeHeader encodes a header value that may hold non-ASCII text, such as a
+// currency symbol
+func mimeHeader(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// sendEmailNotification emails a notification as a receipt
+func sendEmailNotification(ctx context.Context, to string, n *NotificationDocument) error {
+	if emailSender == nil || to == "" {
+		return errDeliverySkipped
+	}
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return errDeliverySkipped
+	}
+	var b strings.Builder
+	b.WriteString(n.Body)
+	b.WriteString("\n\n")
+	if amount, ok := n.Data["amount"].(int64); ok {
+		currency, _ := n.Data["currency"].(string)
+		fmt.Fprintf(&b, "Amount: %s\n", currencyOrDefault(currency).Format(amount))
+	}
+	if txnID, ok := n.Data["transaction_id"].(string); ok && txnID != "" {
+		fmt.Fprintf(&b, "Transaction: %s\n", txnID)
+	}
+	fmt.Fprintf(&b, "Date: %s\n", n.CreatedAt.UTC().Format("January 2, 2006 15:04 MST"))
+	b.WriteString("\nYou can choose which emails you get in the app's notification settings.\n")
+	return emailSender.Send(ctx, EmailMessage{To: addr.Address, Subject: n.Title, Text: b.String()})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+// errDeliverySkipped is returned by a channel with nowhere to send a
+// notification, such as a user without push tokens or an email address
+var errDeliverySkipped = errors.New("no destination")
+
+// pushClient sends push notifications through Firebase Cloud Messaging; nil
+// when Firebase isn't configured, and push is skipped
+var pushClient *messaging.Client
+
+// maxPushTokens bounds the devices a user can register
+const maxPushTokens = 20
+
+// PushToken is a device's FCM registration token, stored at
+// users/{uid}/push_tokens/{sha256 of token}
+type PushToken struct {
+	Token     string    `json:"token" firestore:"token"`
+	Platform  string    `json:"platform" firestore:"platform"`
+	CreatedAt time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// pushTokens is a user's push token collection
+func pushTokens(ctx context.Context, fs *firestore.Client, uid string) *firestore.CollectionRef {
+	return UserDoc(ctx, fs, uid).Collection("push_tokens")
+}
+
+// pushTokenID keys a token's document without putting the token in its path
+func pushTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendPushNotification sends a notification to every device the user
+// registered, removing tokens FCM says are no longer valid
+func sendPushNotification(ctx context.Context, fs *firestore.Client, n *NotificationDocument) error {
+	if pushClient == nil {
+		return errDeliverySkipped
+	}
+	docs, err := pushTokens(ctx, fs, n.UserID).Limit(maxPushTokens).Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load push tokens: %w", err)
+	}
+	if len(docs) == 0 {
+		return errDeliverySkipped
+	}
+	tokens := make([]string, len(docs))
+	for i, doc := range docs {
+		tokens[i] = stringField(doc.Data(), "token")
+	}
+	// Data values must be strings; the app opens the notification by ID
+	data := map[string]string{"notification_id": n.ID, "type": n.Type}
+	for k, v := range n.Data {
+		data[k] = fmt.Sprint(v)
+	}
+	resp, err := pushClient.SendEachForMulticast(ctx, &messaging.MulticastMessage{
+		Tokens:       tokens,
+		Notification: &messaging.Notification{Title: n.Title, Body: n.Body},
+		Data:         data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send push notification: %w", err)
+	}
+	var lastErr error
+	for i, r := range resp.Responses {
+		if r.Success {
+			continue
+		}
+		if messaging.IsUnregistered(r.Error) || messaging.IsInvalidArgument(r.Error) {
+			if _, err := docs[i].Ref.Delete(ctx); err != nil {
+				slog.ErrorContext(ctx, "failed to remove push token", "component", "notify", "user_id", n.UserID, "error", err)
+			}
+			continue
+		}
+		lastErr = r.Error
+	}
+	if resp.SuccessCount == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
+
+// RegisterPushToken saves the calling device's FCM token so it gets push
+// notifications; registering it again just refreshes it
+func RegisterPushToken(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required,max=4096"`
+		Platform string `json:"platform" binding:"required,oneof=ios android web"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	ref := pushTokens(ctx, fs, uid).Doc(pushTokenID(req.Token))
+	now := time.Now()
+	token := PushToken{Token: req.Token, Platform: req.Platform, CreatedAt: now, UpdatedAt: now}
+	if doc, err := getDocument(ctx, ref); err == nil {
+		if created, ok := doc.Data()["created_at"].(time.Time); ok {
+			token.CreatedAt = created
+		}
+	} else {
+		existing, err := pushTokens(ctx, fs, uid).Limit(maxPushTokens).Documents(ctx).GetAll()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load devices"})
+			return
+		}
+		if len(existing) >= maxPushTokens {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("At most %d devices can get notifications; remove one first", maxPushTokens)})
+			return
+		}
+	}
+	if _, err := ref.Set(ctx, token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save device"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"registered": true, "platform": token.Platform})
+}
+
+// UnregisterPushToken stops push notifications to a device, e.g. on sign-out
+func UnregisterPushToken(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := pushTokens(ctx, fs, uid).Doc(pushTokenID(req.Token)).Delete(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove device"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"registered": false})
+}
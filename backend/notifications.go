@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Notification types shown in the in-app feed
+const (
+	NotificationWalletCredited = "wallet_credited"
+	NotificationWalletDebited  = "wallet_debited"
+	NotificationWalletVerified = "wallet_verification"
+
+	NotificationDisputeOpened      = "dispute_opened"
+	NotificationDisputeEvidenceDue = "dispute_evidence_due"
+
+	NotificationBankRelinkRequired = "bank_relink_required"
+
+	NotificationIdentityVerification = "identity_verification"
+
+	// NotificationPaymentReceived and NotificationPaymentFailed are sent from
+	// transaction events to the recipient and the sender
+	NotificationPaymentReceived = "payment_received"
+	NotificationPaymentFailed   = "payment_failed"
+)
+
+// Delivery channels besides the in-app feed
+const (
+	ChannelPush  = "push"
+	ChannelEmail = "email"
+)
+
+// MetricNotificationDeliveries counts push and email deliveries by channel,
+// type, and outcome
+const MetricNotificationDeliveries = "notification_deliveries_total"
+
+// notificationDeliveryTimeout bounds delivering one notification's push and email
+const notificationDeliveryTimeout = 30 * time.Second
+
+// Page sizes for GET /notifications
+const (
+	defaultNotificationPageSize = 25
+	maxNotificationPageSize     = 100
+)
+
+// notificationCursorList names notification feed cursors
+const notificationCursorList = "notifications"
+
+// deliveredNotifications are the notification types also sent by push and
+// email, with whether each channel is on until the user changes it. Every
+// other type only appears in the feed.
+var deliveredNotifications = map[string]map[string]bool{
+	NotificationPaymentReceived:   {ChannelPush: true, ChannelEmail: true},
+	NotificationPaymentFailed:     {ChannelPush: true, ChannelEmail: true},
+	NotificationRequestReceived:   {ChannelPush: true, ChannelEmail: true},
+	NotificationPayoutPaid:        {ChannelPush: true, ChannelEmail: true},
+	NotificationInstantPayoutPaid: {ChannelPush: true, ChannelEmail: true},
+}
+
+// NotificationPreferences are a user's choices of how to hear about each
+// delivered notification type, stored on their user document under
+// notification_preferences as channel then type. Types not set use
+// deliveredNotifications' defaults.
+type NotificationPreferences map[string]map[string]bool
+
+// wants reports whether the user gets notificationType on channel
+func (p NotificationPreferences) wants(channel, notificationType string) bool {
+	if on, ok := p[channel][notificationType]; ok {
+		return on
+	}
+	return deliveredNotifications[notificationType][channel]
+}
+
+// effective lists the setting of every channel for every delivered type
+func (p NotificationPreferences) effective() NotificationPreferences {
+	out := NotificationPreferences{ChannelPush: {}, ChannelEmail: {}}
+	for notificationType := range deliveredNotifications {
+		for channel := range out {
+			out[channel][notificationType] = p.wants(channel, notificationType)
+		}
+	}
+	return out
+}
+
+// NotifyUser records an in-app notification for the user and, for delivered
+// types, sends it by push and email in the background; failures are logged,
+// not returned
+func NotifyUser(ctx context.Context, fs *firestore.Client, uid, notificationType, title, body string, data map[string]interface{}) {
+	notify(ctx, fs, &NotificationDocument{UserID: uid, Type: notificationType, Title: title, Body: body, Data: data}, false)
+}
+
+// NotifyUserOnce is NotifyUser for notifications raised from redelivered
+// events: a second notification with the same id is dropped, so the user
+// isn't pushed or emailed twice
+func NotifyUserOnce(ctx context.Context, fs *firestore.Client, id, uid, notificationType, title, body string, data map[string]interface{}) {
+	notify(ctx, fs, &NotificationDocument{ID: id, UserID: uid, Type: notificationType, Title: title, Body: body, Data: data}, true)
+}
+
+func notify(ctx context.Context, fs *firestore.Client, n *NotificationDocument, once bool) {
+	if fs == nil || n.UserID == "" {
+		return
+	}
+	save := SaveNotification
+	if once {
+		save = CreateNotification
+	}
+	if err := save(ctx, fs, n); err != nil {
+		if status.Code(err) != codes.AlreadyExists {
+			slog.ErrorContext(ctx, "failed to notify user", "component", "notify", "user_id", n.UserID, "notification_type", n.Type, "error", err)
+		}
+		return
+	}
+	if _, ok := deliveredNotifications[n.Type]; !ok {
+		return
+	}
+	// Off the caller's path: push and email providers can be slow
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notificationDeliveryTimeout)
+		defer cancel()
+		deliverNotification(ctx, fs, n)
+	}()
+}
+
+// deliverNotification sends a notification on the channels its recipient
+// wants it on
+func deliverNotification(ctx context.Context, fs *firestore.Client, n *NotificationDocument) {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, n.UserID))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load user for notification", "component", "notify", "user_id", n.UserID, "error", err)
+		return
+	}
+	prefs := userNotificationPreferences(doc)
+	if prefs.wants(ChannelPush, n.Type) {
+		recordDelivery(ChannelPush, n.Type, sendPushNotification(ctx, fs, n))
+	}
+	if prefs.wants(ChannelEmail, n.Type) {
+		to := stringField(doc.Data(), "email_address")
+		if to == "" {
+			to = stringField(doc.Data(), "email")
+		}
+		recordDelivery(ChannelEmail, n.Type, sendEmailNotification(ctx, to, n))
+	}
+}
+
+// recordDelivery counts a delivery attempt; errDeliverySkipped means the
+// channel had nowhere to send to
+func recordDelivery(channel, notificationType string, err error) {
+	outcome := "sent"
+	switch {
+	case err == errDeliverySkipped:
+		outcome = "skipped"
+	case err != nil:
+		outcome = "failed"
+		slog.Error("failed to deliver notification", "component", "notify", "channel", channel, "notification_type", notificationType, "error", err)
+	}
+	metrics.IncCounter(MetricNotificationDeliveries, map[string]string{"channel": channel, "type": notificationType, "outcome": outcome})
+}
+
+// userNotificationPreferences reads notification_preferences from a user document
+func userNotificationPreferences(doc *firestore.DocumentSnapshot) NotificationPreferences {
+	var user struct {
+		Preferences NotificationPreferences `firestore:"notification_preferences"`
+	}
+	if err := doc.DataTo(&user); err != nil || user.Preferences == nil {
+		return NotificationPreferences{}
+	}
+	return user.Preferences
+}
+
+// PaymentNotificationConsumer tells a payment's recipient it arrived and its
+// sender that it failed. Each is sent once per transaction however often the
+// event is redelivered.
+func PaymentNotificationConsumer(ctx context.Context, fs *firestore.Client, evt Event) error {
+	if evt.TransactionID == "" || len(evt.UserIDs) < 2 {
+		return nil
+	}
+	senderUID, recipientUID := evt.UserIDs[0], evt.UserIDs[1]
+	amount, _ := evt.Data["amount"].(int64)
+	currency, _ := evt.Data["currency"].(string)
+	formatted := currencyOrDefault(currency).Format(amount)
+	data := map[string]interface{}{"transaction_id": evt.TransactionID, "amount": amount, "currency": currency}
+
+	switch evt.Type {
+	case EventTransactionSucceeded:
+		NotifyUserOnce(ctx, fs, NotificationPaymentReceived+"_"+evt.TransactionID, recipientUID, NotificationPaymentReceived,
+			"You received "+formatted, "A payment of "+formatted+" was sent to you.", data)
+	case EventTransactionFailed:
+		NotifyUserOnce(ctx, fs, NotificationPaymentFailed+"_"+evt.TransactionID, senderUID, NotificationPaymentFailed,
+			"Your payment didn't go through", "Your payment of "+formatted+" failed. You haven't been charged.", data)
+	}
+	return nil
+}
+
+// ListNotifications returns the caller's notification feed, newest first.
+// Query params: cursor (next_cursor from the previous page), limit, and
+// unread=true for unread notifications only.
+func ListNotifications(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	limit := defaultNotificationPageSize
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxNotificationPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxNotificationPageSize)})
+			return
+		}
+		limit = n
+	}
+	query := fs.Collection("notifications").Where("user_id", "==", uid)
+	unread := c.Query("unread") == "true"
+	if unread {
+		query = query.Where("read", "==", false)
+	}
+	query = query.OrderBy("created_at", firestore.Desc).OrderBy(firestore.DocumentID, firestore.Desc)
+
+	filters := "unread=" + strconv.FormatBool(unread)
+	if cursor := c.Query("cursor"); cursor != "" {
+		createdAt, id, err := parsePageCursor(cursor, notificationCursorList, uid, filters)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query = query.StartAfter(createdAt, id)
+	}
+
+	// Fetch one extra document to learn whether another page exists
+	docs, err := query.Limit(limit + 1).Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load notifications"})
+		return
+	}
+	hasMore := len(docs) > limit
+	if hasMore {
+		docs = docs[:limit]
+	}
+	notifications := make([]NotificationDocument, 0, len(docs))
+	for _, doc := range docs {
+		var n NotificationDocument
+		if err := doc.DataTo(&n); err != nil {
+			continue
+		}
+		n.ID = doc.Ref.ID
+		notifications = append(notifications, n)
+	}
+	resp := gin.H{"notifications": notifications, "has_more": hasMore}
+	if hasMore {
+		last := notifications[len(notifications)-1]
+		cursor, err := signPageCursor(notificationCursorList, uid, filters, last.CreatedAt, docs[len(docs)-1].Ref.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to sign page cursor", "component", "notify", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load notifications"})
+			return
+		}
+		resp["next_cursor"] = cursor
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetNotificationPreferences returns how the caller hears about each
+// delivered notification type
+func GetNotificationPreferences(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	prefs := NotificationPreferences{}
+	if doc, err := getDocument(c.Request.Context(), UserDoc(c.Request.Context(), fs, uid)); err == nil {
+		prefs = userNotificationPreferences(doc)
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": prefs.effective()})
+}
+
+// SetNotificationPreferences turns channels on or off per type, e.g.
+// {"email": {"payment_received": false}}; types left out keep their setting
+func SetNotificationPreferences(c *gin.Context) {
+	var req NotificationPreferences
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for channel, types := range req {
+		if channel != ChannelPush && channel != ChannelEmail {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Channels are push and email"})
+			return
+		}
+		for notificationType := range types {
+			if _, ok := deliveredNotifications[notificationType]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s notifications are only shown in the app", notificationType)})
+				return
+			}
+		}
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	// Merged, so types not in the request keep their setting
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"notification_preferences": map[string]map[string]bool(req),
+		"updated_at":               time.Now(),
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+		return
+	}
+	prefs := NotificationPreferences{}
+	if doc, err := getDocument(ctx, UserDoc(ctx, fs, uid)); err == nil {
+		prefs = userNotificationPreferences(doc)
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": prefs.effective()})
+}
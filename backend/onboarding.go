@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// EventOnboardingStepCompleted is published once for each onboarding step a user completes
+const EventOnboardingStepCompleted = "onboarding.step_completed"
+
+// OnboardingStep describes one step of progressive onboarding
+type OnboardingStep struct {
+	Name     string `json:"name"`
+	Title    string `json:"title"`
+	DeepLink string `json:"deep_link"`
+	// APIHint names the endpoint the client calls to make progress on the step
+	APIHint string `json:"api_hint,omitempty"`
+}
+
+// onboardingSteps are completed in order; later steps require earlier ones
+var onboardingSteps = []OnboardingStep{
+	{Name: "email_verified", Title: "Verify your email", DeepLink: "digitalpayments://onboarding/verify-email"},
+	{Name: "kyc", Title: "Verify your identity", DeepLink: "digitalpayments://onboarding/kyc"},
+	{Name: "bank_linked", Title: "Link a bank account", DeepLink: "digitalpayments://onboarding/link-bank", APIHint: "POST /stripe/setup-intent"},
+	{Name: "payouts_enabled", Title: "Enable payouts", DeepLink: "digitalpayments://onboarding/payouts", APIHint: "POST /stripe/connect/account-link"},
+}
+
+// OnboardingState is stored at onboarding/{uid}
+type OnboardingState struct {
+	UserID    string               `json:"user_id" firestore:"user_id"`
+	Completed map[string]time.Time `json:"completed" firestore:"completed"`
+	NextStep  string               `json:"next_step" firestore:"next_step"`
+	UpdatedAt time.Time            `json:"updated_at" firestore:"updated_at"`
+}
+
+// onboardingFacts reports which steps are satisfied according to the user document
+func onboardingFacts(data map[string]interface{}) map[string]bool {
+	facts := map[string]bool{}
+	facts["email_verified"], _ = data["email_verified"].(bool)
+	if level, _ := data["kyc_level"].(string); level != "" && level != "unverified" {
+		facts["kyc"] = true
+	}
+	if methods, ok := data["verified_payment_methods"].([]interface{}); ok && len(methods) > 0 {
+		facts["bank_linked"] = true
+	}
+	facts["payouts_enabled"], _ = data["payouts_enabled"].(bool)
+	return facts
+}
+
+// AdvanceOnboarding re-evaluates a user's onboarding state, persisting it and
+// emitting an event for every step that became complete since the last evaluation.
+func AdvanceOnboarding(ctx context.Context, fs *firestore.Client, uid string) (*OnboardingState, error) {
+	userDoc, err := UserDoc(ctx, fs, uid).Get(ctx)
+	if err != nil || !userDoc.Exists() {
+		return nil, fmt.Errorf("user %s not found", uid)
+	}
+	facts := onboardingFacts(userDoc.Data())
+
+	ref := fs.Collection("onboarding").Doc(uid)
+	state := &OnboardingState{UserID: uid, Completed: map[string]time.Time{}}
+	if doc, err := ref.Get(ctx); err == nil && doc.Exists() {
+		_ = doc.DataTo(state)
+		if state.Completed == nil {
+			state.Completed = map[string]time.Time{}
+		}
+	}
+
+	now := time.Now()
+	var newlyCompleted []string
+	state.NextStep = ""
+	for _, step := range onboardingSteps {
+		if _, done := state.Completed[step.Name]; !done && facts[step.Name] {
+			state.Completed[step.Name] = now
+			newlyCompleted = append(newlyCompleted, step.Name)
+		}
+		if _, done := state.Completed[step.Name]; !done && state.NextStep == "" {
+			state.NextStep = step.Name
+		}
+	}
+	if len(newlyCompleted) == 0 && !state.UpdatedAt.IsZero() {
+		return state, nil
+	}
+
+	state.UpdatedAt = now
+	if _, err := ref.Set(ctx, state); err != nil {
+		return nil, fmt.Errorf("failed to store onboarding state: %w", err)
+	}
+	for _, step := range newlyCompleted {
+		PublishEvent(ctx, fs, Event{
+			Type:    EventOnboardingStepCompleted,
+			UserIDs: []string{uid},
+			Data:    map[string]interface{}{"step": step, "next_step": state.NextStep},
+		})
+	}
+	return state, nil
+}
+
+// GetOnboardingStatus returns the user's progress and the next step to complete
+func GetOnboardingStatus(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	// Email verification is only known from the ID token, so record it when seen
+	if c.GetBool("emailVerified") {
+		_, _ = UserDoc(ctx, fs, uid).Set(ctx, map[string]interface{}{
+			"email_verified": true,
+		}, firestore.MergeAll)
+	}
+
+	state, err := AdvanceOnboarding(ctx, fs, uid)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	steps := make([]gin.H, 0, len(onboardingSteps))
+	var next *OnboardingStep
+	for i, step := range onboardingSteps {
+		completedAt, done := state.Completed[step.Name]
+		item := gin.H{"step": step, "completed": done}
+		if done {
+			item["completed_at"] = completedAt
+		}
+		steps = append(steps, item)
+		if step.Name == state.NextStep {
+			next = &onboardingSteps[i]
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"steps":     steps,
+		"next_step": next,
+		"complete":  next == nil,
+	})
+}
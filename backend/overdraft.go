@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ledger kinds for the wallet overdraft buffer
+const (
+	LedgerOverdraftDraw      = "overdraft_draw"
+	LedgerOverdraftRepayment = "overdraft_repayment"
+)
+
+// LedgerAccountOverdraftFunding is the platform's source of overdraft advances
+const LedgerAccountOverdraftFunding = "platform:overdraft_funding"
+
+// NotificationOverdraftRepaid tells a user incoming funds cleared their overdraft
+const NotificationOverdraftRepaid = "overdraft_repaid"
+
+// Overdraft eligibility is based on the wallet's settled history
+const (
+	defaultOverdraftLimit      = 2500 // cents
+	overdraftMinWalletAge      = 30 * 24 * time.Hour
+	overdraftMinRecentDeposits = 3
+	overdraftDepositLookback   = 90 * 24 * time.Hour
+)
+
+// LedgerAccountUserOverdraft is what a user owes the platform for overdraft
+// advances; its balance is the platform's exposure to that user.
+func LedgerAccountUserOverdraft(uid string) string {
+	return "user:" + uid + ":overdraft"
+}
+
+// overdraftLimitSetting is the buffer granted on opt-in, from WALLET_OVERDRAFT_LIMIT (cents)
+func overdraftLimitSetting() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("WALLET_OVERDRAFT_LIMIT"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return defaultOverdraftLimit
+}
+
+// OverdraftLedgerTransaction records the change in a user's overdraft between two
+// wallet balances: an advance when the balance goes further below zero, a
+// repayment when incoming funds bring it back up. It returns nil when the
+// overdraft is unchanged.
+func OverdraftLedgerTransaction(reference, uid string, balanceBefore, balanceAfter int64) *LedgerTransaction {
+	delta := max(-balanceAfter, 0) - max(-balanceBefore, 0)
+	switch {
+	case delta > 0:
+		return &LedgerTransaction{
+			ID:        "overdraft_draw_" + reference,
+			Kind:      LedgerOverdraftDraw,
+			Reference: reference,
+			Currency:  "usd",
+			Entries: []LedgerEntry{
+				{Account: LedgerAccountUserOverdraft(uid), Direction: Debit, Amount: delta},
+				{Account: LedgerAccountOverdraftFunding, Direction: Credit, Amount: delta},
+			},
+		}
+	case delta < 0:
+		return &LedgerTransaction{
+			ID:        "overdraft_repayment_" + reference,
+			Kind:      LedgerOverdraftRepayment,
+			Reference: reference,
+			Currency:  "usd",
+			Entries: []LedgerEntry{
+				{Account: LedgerAccountOverdraftFunding, Direction: Debit, Amount: -delta},
+				{Account: LedgerAccountUserOverdraft(uid), Direction: Credit, Amount: -delta},
+			},
+		}
+	}
+	return nil
+}
+
+// recordOverdraftMovement posts any overdraft advance or repayment caused by an
+// applied wallet entry and tells the user when incoming funds repaid it.
+func recordOverdraftMovement(c *gin.Context, fs *firestore.Client, entry *WalletEntry) {
+	txn := OverdraftLedgerTransaction(entry.Reference, entry.UserID, entry.BalanceAfter-entry.Amount, entry.BalanceAfter)
+	if txn == nil {
+		return
+	}
+	if v, ok := c.Get("ledger"); ok {
+		if _, err := v.(LedgerStore).Post(c.Request.Context(), txn); err != nil {
+			slog.ErrorContext(c.Request.Context(), "failed to post overdraft movement", "component", "wallet", "error", err)
+		}
+	}
+	if txn.Kind == LedgerOverdraftRepayment {
+		body := fmt.Sprintf("%s of incoming funds repaid your overdraft", currencyOrDefault(txn.Currency).Format(txn.Entries[0].Amount))
+		if entry.BalanceAfter >= 0 {
+			body = "Incoming funds fully repaid your overdraft"
+		}
+		NotifyUser(c.Request.Context(), fs, entry.UserID, NotificationOverdraftRepaid, "Overdraft repaid", body,
+			map[string]interface{}{"reference": entry.Reference, "balance": entry.BalanceAfter})
+	}
+}
+
+// OverdraftEligibility explains whether a user can opt into the buffer
+type OverdraftEligibility struct {
+	Eligible bool   `json:"eligible"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// CheckOverdraftEligibility requires a wallet in good standing with an established
+// deposit history: no negative balance or open drift, a first entry at least
+// overdraftMinWalletAge old, and regular recent deposits.
+func CheckOverdraftEligibility(ctx context.Context, fs *firestore.Client, uid string) (OverdraftEligibility, error) {
+	snap, err := fs.Collection("wallets").Doc(uid).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return OverdraftEligibility{Reason: "no_wallet"}, nil
+	}
+	if err != nil {
+		return OverdraftEligibility{}, fmt.Errorf("failed to load wallet: %w", err)
+	}
+	var wallet Wallet
+	if err := snap.DataTo(&wallet); err != nil {
+		return OverdraftEligibility{}, err
+	}
+	if wallet.Balance < 0 {
+		return OverdraftEligibility{Reason: "negative_balance"}, nil
+	}
+	if drift, err := fs.Collection("wallet_drift").Doc(uid).Get(ctx); err == nil && drift.Exists() {
+		return OverdraftEligibility{Reason: "under_review"}, nil
+	}
+
+	first, err := fs.Collection("wallet_entries").
+		Where("user_id", "==", uid).
+		OrderBy("created_at", firestore.Asc).
+		Limit(1).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return OverdraftEligibility{}, fmt.Errorf("failed to load wallet history: %w", err)
+	}
+	if len(first) == 0 {
+		return OverdraftEligibility{Reason: "insufficient_history"}, nil
+	}
+	if created, _ := first[0].Data()["created_at"].(time.Time); time.Since(created) < overdraftMinWalletAge {
+		return OverdraftEligibility{Reason: "insufficient_history"}, nil
+	}
+
+	recent, err := fs.Collection("wallet_entries").
+		Where("user_id", "==", uid).
+		Where("created_at", ">=", time.Now().Add(-overdraftDepositLookback)).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return OverdraftEligibility{}, fmt.Errorf("failed to load wallet history: %w", err)
+	}
+	deposits := 0
+	for _, doc := range recent {
+		if amount, _ := doc.Data()["amount"].(int64); amount > 0 {
+			deposits++
+		}
+	}
+	if deposits < overdraftMinRecentDeposits {
+		return OverdraftEligibility{Reason: "insufficient_deposits"}, nil
+	}
+	return OverdraftEligibility{Eligible: true}, nil
+}
+
+// GetOverdraft returns the caller's overdraft buffer, usage, and eligibility
+func GetOverdraft(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	var wallet Wallet
+	if snap, err := fs.Collection("wallets").Doc(uid).Get(ctx); err == nil {
+		_ = snap.DataTo(&wallet)
+	}
+	eligibility, err := CheckOverdraftEligibility(ctx, fs, uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check eligibility"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":     wallet.OverdraftLimit > 0,
+		"limit":       wallet.OverdraftLimit,
+		"used":        max(-wallet.Balance, 0),
+		"available":   wallet.Available(),
+		"eligibility": eligibility,
+	})
+}
+
+// SetOverdraft opts the caller into or out of the overdraft buffer. Opting out
+// removes the buffer for new sends; any overdraft already used is still repaid
+// from incoming funds.
+func SetOverdraft(c *gin.Context) {
+	var req struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	limit := int64(0)
+	if *req.Enabled {
+		eligibility, err := CheckOverdraftEligibility(ctx, fs, uid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check eligibility"})
+			return
+		}
+		if !eligibility.Eligible {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not eligible for an overdraft buffer", "reason": eligibility.Reason})
+			return
+		}
+		limit = overdraftLimitSetting()
+	}
+
+	if _, err := fs.Collection("wallets").Doc(uid).Set(ctx, map[string]interface{}{
+		"overdraft_limit":      limit,
+		"overdraft_updated_at": time.Now(),
+	}, firestore.MergeAll); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update overdraft"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": limit > 0, "limit": limit})
+}
+
+// GetOverdraftExposure reports outstanding overdrafts and granted buffers for admins
+func GetOverdraftExposure(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	overdrawn, err := fs.Collection("wallets").Where("balance", "<", 0).Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load overdrawn wallets"})
+		return
+	}
+	enabled, err := fs.Collection("wallets").Where("overdraft_limit", ">", 0).Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load overdraft wallets"})
+		return
+	}
+
+	type exposure struct {
+		UserID string `json:"user_id"`
+		Used   int64  `json:"used"`
+		Limit  int64  `json:"limit"`
+	}
+	accounts := make([]exposure, 0, len(overdrawn))
+	var outstanding, granted int64
+	for _, doc := range overdrawn {
+		var w Wallet
+		if err := doc.DataTo(&w); err != nil {
+			continue
+		}
+		accounts = append(accounts, exposure{UserID: doc.Ref.ID, Used: -w.Balance, Limit: w.OverdraftLimit})
+		outstanding += -w.Balance
+	}
+	for _, doc := range enabled {
+		if limit, _ := doc.Data()["overdraft_limit"].(int64); limit > 0 {
+			granted += limit
+		}
+	}
+
+	resp := gin.H{
+		"outstanding":       outstanding,
+		"granted":           granted,
+		"enabled_wallets":   len(enabled),
+		"overdrawn_wallets": accounts,
+	}
+	// The ledger carries the same exposure independently of wallet balances
+	if lv, ok := c.Get("ledger"); ok {
+		if funded, err := lv.(LedgerStore).Balance(ctx, LedgerAccountOverdraftFunding, "usd"); err == nil {
+			resp["ledger_outstanding"] = -funded
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Partner webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// PartnerWebhookSignatureHeader carries "t=<unix>,v1=<hex hmac>" where the HMAC
+// is SHA-256 over "<unix>.<body>" keyed with the subscription's secret
+const PartnerWebhookSignatureHeader = "X-Webhook-Signature"
+
+const (
+	// maxDeliveryAttempts is how many times an event is sent before it is marked failed
+	maxDeliveryAttempts = 8
+	// deliveryLease keeps other instances off a delivery while it is being sent
+	deliveryLease = time.Minute
+	// deliveryTimeout bounds a partner's response time
+	deliveryTimeout = 10 * time.Second
+)
+
+// partnerWebhookEvents are the events partners may subscribe to
+var partnerWebhookEvents = []string{
+	EventTransactionCreated,
+	EventTransactionSucceeded,
+	EventTransactionFailed,
+	EventTransactionRefunded,
+	EventTransactionExpired,
+	EventTransactionReturned,
+}
+
+// partnerWebhookClient sends deliveries. Partner URLs are user-supplied, so
+// it connects directly rather than through a proxy, refuses to dial internal
+// addresses (checked on the resolved IP, so DNS rebinding can't get around
+// it), and doesn't follow redirects.
+var partnerWebhookClient = &http.Client{
+	Timeout: deliveryTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || internalAddress(ip) {
+					return fmt.Errorf("webhook address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// carrierGradeNAT is the shared address space (RFC 6598), internal to
+// providers' networks
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// internalAddress reports whether ip is loopback, private, link-local (which
+// includes cloud metadata endpoints), or otherwise not a public unicast address
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || carrierGradeNAT.Contains(ip)
+}
+
+// validatePartnerWebhookURL checks a callback URL is https and its host
+// resolves only to public addresses
+func validatePartnerWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return errors.New("url must be an absolute https URL")
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return errors.New("url host could not be resolved")
+	}
+	for _, addr := range addrs {
+		if internalAddress(addr.IP) {
+			return errors.New("url must point to a public address")
+		}
+	}
+	return nil
+}
+
+// errSubscriptionInactive drops deliveries for deleted subscriptions without retrying
+var errSubscriptionInactive = errors.New("subscription is inactive")
+
+// WebhookSubscription is stored at webhook_subscriptions/{id}. The signing
+// secret is encrypted at rest and only returned when the subscription is created.
+type WebhookSubscription struct {
+	ID              string    `json:"id" firestore:"-"`
+	OwnerUserID     string    `json:"owner_user_id" firestore:"owner_user_id"`
+	URL             string    `json:"url" firestore:"url"`
+	Events          []string  `json:"events" firestore:"events"`
+	SecretEncrypted string    `json:"-" firestore:"secret_encrypted"`
+	Active          bool      `json:"active" firestore:"active"`
+	CreatedAt       time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one subscription, stored at
+// webhook_deliveries/{event id}_{subscription id} so an event is queued once
+type WebhookDelivery struct {
+	SubscriptionID string    `firestore:"subscription_id"`
+	EventID        string    `firestore:"event_id"`
+	EventType      string    `firestore:"event_type"`
+	Payload        []byte    `firestore:"payload"`
+	Status         string    `firestore:"status"`
+	Attempts       int       `firestore:"attempts"`
+	LastError      string    `firestore:"last_error,omitempty"`
+	NextAttemptAt  time.Time `firestore:"next_attempt_at"`
+	CreatedAt      time.Time `firestore:"created_at"`
+	DeliveredAt    time.Time `firestore:"delivered_at,omitempty"`
+}
+
+// deliveryBackoff is the delay after the given failed attempt: 30s, doubling
+func deliveryBackoff(attempt int) time.Duration {
+	return 30 * time.Second << min(attempt-1, 10)
+}
+
+// signPartnerWebhook returns the signature header value for a payload
+func signPartnerWebhook(secret string, ts time.Time, payload []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(payload)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// PartnerWebhookConsumer queues an event for every subscription of its
+// participants that asked for it; DeliverPartnerWebhooks sends them
+func PartnerWebhookConsumer(ctx context.Context, fs *firestore.Client, evt Event) error {
+	if fs == nil {
+		return nil
+	}
+	payload, err := json.Marshal(gin.H{
+		"id":         evt.ID,
+		"type":       evt.Type,
+		"created_at": evt.CreatedAt,
+		"data": gin.H{
+			"transaction_id": evt.TransactionID,
+			"object":         evt.Data,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, uid := range evt.UserIDs {
+		if uid == "" {
+			continue
+		}
+		docs, err := fs.Collection("webhook_subscriptions").
+			Where("owner_user_id", "==", uid).
+			Where("active", "==", true).
+			Documents(ctx).GetAll()
+		if err != nil {
+			return fmt.Errorf("load subscriptions for %s: %w", uid, err)
+		}
+		for _, doc := range docs {
+			var sub WebhookSubscription
+			if err := doc.DataTo(&sub); err != nil || !slices.Contains(sub.Events, evt.Type) {
+				continue
+			}
+			_, err := fs.Collection("webhook_deliveries").Doc(evt.ID+"_"+doc.Ref.ID).Create(ctx, WebhookDelivery{
+				SubscriptionID: doc.Ref.ID,
+				EventID:        evt.ID,
+				EventType:      evt.Type,
+				Payload:        payload,
+				Status:         DeliveryPending,
+				NextAttemptAt:  time.Now(),
+				CreatedAt:      time.Now(),
+			})
+			if err != nil && status.Code(err) != codes.AlreadyExists {
+				return fmt.Errorf("queue %s for %s: %w", evt.ID, doc.Ref.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DeliverPartnerWebhooks sends due deliveries, retrying failures with
+// exponential backoff until maxDeliveryAttempts
+func DeliverPartnerWebhooks(ctx context.Context, fs *firestore.Client) error {
+	docs, err := fs.Collection("webhook_deliveries").
+		Where("status", "==", DeliveryPending).
+		Where("next_attempt_at", "<=", time.Now()).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load webhook deliveries: %w", err)
+	}
+	for _, doc := range docs {
+		claimed, err := claimDelivery(ctx, fs, doc.Ref)
+		if err != nil || !claimed {
+			continue
+		}
+		var d WebhookDelivery
+		if err := doc.DataTo(&d); err != nil {
+			continue
+		}
+		sendDelivery(ctx, fs, doc.Ref, &d)
+	}
+	return nil
+}
+
+// claimDelivery pushes the next attempt out by the lease, reporting false if
+// another instance got there first
+func claimDelivery(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef) (bool, error) {
+	claimed := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		next, _ := snap.Data()["next_attempt_at"].(time.Time)
+		if stringField(snap.Data(), "status") != DeliveryPending || next.After(time.Now()) {
+			return nil
+		}
+		claimed = true
+		return tx.Update(ref, []firestore.Update{{Path: "next_attempt_at", Value: time.Now().Add(deliveryLease)}})
+	})
+	return claimed, err
+}
+
+// sendDelivery posts one delivery and records the outcome
+func sendDelivery(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef, d *WebhookDelivery) {
+	attempt := d.Attempts + 1
+	err := postPartnerWebhook(ctx, fs, d)
+	update := map[string]interface{}{"attempts": attempt}
+	switch {
+	case err == nil:
+		update["status"] = DeliveryDelivered
+		update["delivered_at"] = time.Now()
+		update["last_error"] = firestore.Delete
+	case errors.Is(err, errSubscriptionInactive):
+		update["status"] = DeliveryFailed
+		update["last_error"] = err.Error()
+	case attempt >= maxDeliveryAttempts:
+		slog.WarnContext(ctx, "partner webhook delivery failed permanently", "component", "partner_webhooks", "delivery_id", ref.ID, "attempts", attempt, "error", err)
+		update["status"] = DeliveryFailed
+		update["last_error"] = err.Error()
+	default:
+		update["last_error"] = err.Error()
+		update["next_attempt_at"] = time.Now().Add(deliveryBackoff(attempt))
+	}
+	if _, err := ref.Set(ctx, update, firestore.MergeAll); err != nil {
+		slog.ErrorContext(ctx, "failed to record partner webhook attempt", "component", "partner_webhooks", "delivery_id", ref.ID, "error", err)
+	}
+}
+
+// postPartnerWebhook signs and sends a delivery; any non-2xx response is a failure
+func postPartnerWebhook(ctx context.Context, fs *firestore.Client, d *WebhookDelivery) error {
+	snap, err := fs.Collection("webhook_subscriptions").Doc(d.SubscriptionID).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("load subscription: %w", err)
+	}
+	var sub WebhookSubscription
+	if err := snap.DataTo(&sub); err != nil {
+		return err
+	}
+	if !sub.Active {
+		return errSubscriptionInactive
+	}
+	secret, err := DecryptString(sub.SecretEncrypted)
+	if err != nil {
+		return fmt.Errorf("decrypt secret: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", d.EventID)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set(PartnerWebhookSignatureHeader, signPartnerWebhook(secret, time.Now(), d.Payload))
+	resp, err := partnerWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// CreateWebhookSubscription registers a partner callback URL. The signing
+// secret is returned once; partners verify X-Webhook-Signature with it.
+func CreateWebhookSubscription(c *gin.Context) {
+	var req struct {
+		URL    string   `json:"url" binding:"required"`
+		Events []string `json:"events" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePartnerWebhookURL(c.Request.Context(), req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, e := range req.Events {
+		if !slices.Contains(partnerWebhookEvents, e) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported event " + e, "supported": partnerWebhookEvents})
+			return
+		}
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+	secret := "whsec_" + hex.EncodeToString(raw)
+	encrypted, err := EncryptString(secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to secure webhook secret"})
+		return
+	}
+	sub := &WebhookSubscription{
+		ID:              uuid.NewString(),
+		OwnerUserID:     uid,
+		URL:             req.URL,
+		Events:          req.Events,
+		SecretEncrypted: encrypted,
+		Active:          true,
+		CreatedAt:       time.Now(),
+	}
+	if _, err := fs.Collection("webhook_subscriptions").Doc(sub.ID).Set(c.Request.Context(), sub); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"subscription": sub, "secret": secret})
+}
+
+// ListWebhookSubscriptions returns the caller's subscriptions
+func ListWebhookSubscriptions(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("webhook_subscriptions").Where("owner_user_id", "==", uid).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subscriptions"})
+		return
+	}
+	subs := make([]WebhookSubscription, 0, len(docs))
+	for _, doc := range docs {
+		var sub WebhookSubscription
+		if err := doc.DataTo(&sub); err != nil {
+			continue
+		}
+		sub.ID = doc.Ref.ID
+		subs = append(subs, sub)
+	}
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+// DeleteWebhookSubscription deactivates one of the caller's subscriptions;
+// queued deliveries for it are dropped as they come due
+func DeleteWebhookSubscription(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := fs.Collection("webhook_subscriptions").Doc(c.Param("id"))
+	doc, err := ref.Get(ctx)
+	if err != nil || !doc.Exists() || stringField(doc.Data(), "owner_user_id") != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+	if _, err := ref.Update(ctx, []firestore.Update{{Path: "active", Value: false}}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete subscription"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
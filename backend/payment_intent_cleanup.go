@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// TransactionStatusExpired marks a payment abandoned before it was confirmed
+const TransactionStatusExpired = "expired"
+
+// NotificationPaymentExpired tells a sender an unfinished payment was cancelled
+const NotificationPaymentExpired = "payment_expired"
+
+// defaultPaymentIntentTTL is how long a payment may wait for confirmation or a
+// payment method before it is cancelled
+const defaultPaymentIntentTTL = 24 * time.Hour
+
+// stalePaymentIntentStatuses are the statuses a payment can be abandoned in
+var stalePaymentIntentStatuses = []string{"requires_confirmation", "requires_payment_method"}
+
+// paymentIntentTTL reads PAYMENT_INTENT_TTL, e.g. "24h"
+func paymentIntentTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PAYMENT_INTENT_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultPaymentIntentTTL
+}
+
+// CancelStalePaymentIntents cancels payments left unconfirmed past the TTL so
+// they don't linger as open intents in Stripe, marks them expired, and tells
+// the sender. Stripe is checked first in case a webhook is still on its way.
+func CancelStalePaymentIntents(ctx context.Context, d *webhookDeps) error {
+	docs, err := d.fs.Collection("transactions").
+		Where("status", "in", stalePaymentIntentStatuses).
+		Where("created_at", "<=", time.Now().Add(-paymentIntentTTL())).
+		Limit(100).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load stale payments: %w", err)
+	}
+	for _, doc := range docs {
+		if err := expirePaymentIntent(ctx, d, doc); err != nil {
+			slog.ErrorContext(ctx, "failed to expire payment", "component", "payment_intent_cleanup", "payment_intent", doc.Ref.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// expirePaymentIntent cancels one stale payment in Stripe and records it
+func expirePaymentIntent(ctx context.Context, d *webhookDeps, doc *firestore.DocumentSnapshot) error {
+	piID := doc.Ref.ID
+	data := doc.Data()
+	senderUID := stringField(data, "sender_user_id")
+
+	pi, err := d.sc.GetPaymentIntent(ctx, piID)
+	if err != nil {
+		return err
+	}
+	switch stripe.PaymentIntentStatus(pi.Status) {
+	case stripe.PaymentIntentStatusRequiresConfirmation, stripe.PaymentIntentStatusRequiresPaymentMethod:
+		if err := d.sc.CancelPaymentIntent(ctx, piID, stripe.PaymentIntentCancellationReasonAbandoned); err != nil {
+			d.sc.LogAPIError(ctx, "cancel_stale_payment_intent", senderUID, err)
+			return err
+		}
+		d.sc.LogAPIInteraction(ctx, "cancel_stale_payment_intent", senderUID, true, fmt.Sprintf("Payment Intent ID: %s", piID))
+	case stripe.PaymentIntentStatusCanceled:
+		// Cancelled elsewhere; only the transaction is behind
+	default:
+		// It moved on in Stripe and its webhook will update the transaction
+		return nil
+	}
+
+	expired := false
+	ref := doc.Ref
+	err = d.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		expired = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		current := stringField(snap.Data(), "status")
+		if current != stalePaymentIntentStatuses[0] && current != stalePaymentIntentStatuses[1] {
+			return nil
+		}
+		expired = true
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: TransactionStatusExpired},
+			{Path: "updated_at", Value: time.Now()},
+		})
+	})
+	if err != nil || !expired {
+		return err
+	}
+
+	amount, _ := data["amount"].(int64)
+	recipientUID := stringField(data, "recipient_user_id")
+	metrics.IncCounter(MetricPaymentsTotal, map[string]string{"outcome": TransactionStatusExpired})
+	PublishEvent(ctx, d.fs, Event{
+		Type:          EventTransactionExpired,
+		UserIDs:       []string{senderUID, recipientUID},
+		TransactionID: piID,
+		Data:          map[string]interface{}{"amount": amount, "currency": stringField(data, "currency"), "status": TransactionStatusExpired},
+	})
+	if senderUID != "" {
+		NotifyUser(ctx, d.fs, senderUID, NotificationPaymentExpired, "Payment cancelled",
+			fmt.Sprintf("Your %s payment wasn't completed in time and has been cancelled. You haven't been charged.", currencyOrDefault(stringField(data, "currency")).Format(amount)),
+			map[string]interface{}{"transaction_id": piID})
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// PaymentLink is a hosted Stripe page that pays a business a fixed amount,
+// stored at payment_links/{id}. Payments through it carry the business in
+// their metadata, so the webhook records and transfers them like any other.
+type PaymentLink struct {
+	ID                  string    `json:"id" firestore:"-"`
+	UserID              string    `json:"user_id" firestore:"user_id"`
+	StripePaymentLinkID string    `json:"stripe_payment_link_id" firestore:"stripe_payment_link_id"`
+	URL                 string    `json:"url" firestore:"url"`
+	Description         string    `json:"description" firestore:"description"`
+	Amount              int64     `json:"amount" firestore:"amount"`
+	Currency            string    `json:"currency" firestore:"currency"`
+	Active              bool      `json:"active" firestore:"active"`
+	APIKeyID            string    `json:"api_key_id,omitempty" firestore:"api_key_id,omitempty"`
+	CreatedAt           time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// CreatePaymentLink creates a payment link for the calling business
+func CreatePaymentLink(c *gin.Context) {
+	var req struct {
+		Description string `json:"description" binding:"required,max=200"`
+		Amount      int64  `json:"amount" binding:"required,min=1"`
+		Currency    string `json:"currency"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if provider, _ := doc.Data()["service_provider"].(bool); !provider {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only business accounts can create payment links"})
+		return
+	}
+	accountID := stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id"))
+	if accountID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Finish setting up payouts before creating payment links"})
+		return
+	}
+	if terms := riskTierTerms[recipientRiskTier(ctx, fs, uid)]; terms.MaxPayment > 0 && req.Amount > terms.MaxPayment {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This account can't receive payments this large", "code": "recipient_limit_exceeded", "max": terms.MaxPayment})
+		return
+	}
+	currency := req.Currency
+	if !validatePaymentCurrency(c, uid, &currency, req.Amount) {
+		return
+	}
+
+	ref := fs.Collection("payment_links").NewDoc()
+	meta := map[string]string{
+		"recipient_account_id": accountID,
+		"recipient_user_id":    uid,
+		"flow":                 "scat",
+		"payment_link_id":      ref.ID,
+	}
+	// The reserve in force when the link is made applies to its payments
+	if reserve, days := reserveFor(ctx, fs, uid, req.Amount); reserve > 0 {
+		meta["reserve_amount"] = strconv.FormatInt(reserve, 10)
+		meta["reserve_hold_days"] = strconv.FormatInt(days, 10)
+	}
+	link, err := sc.CreatePaymentLink(ctx, req.Description, req.Amount, currency, meta, "payment_link_"+ref.ID)
+	if err != nil {
+		sc.LogAPIError(ctx, "create_payment_link", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to create payment link", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "create_payment_link", uid, true, "Payment link: "+link.ID)
+
+	now := time.Now()
+	pl := &PaymentLink{
+		ID:                  ref.ID,
+		UserID:              uid,
+		StripePaymentLinkID: link.ID,
+		URL:                 link.URL,
+		Description:         req.Description,
+		Amount:              req.Amount,
+		Currency:            currency,
+		Active:              true,
+		APIKeyID:            c.GetString("apiKeyID"),
+		CreatedAt:           now,
+		UpdatedAt:           now,
+	}
+	if _, err := ref.Set(ctx, pl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save payment link"})
+		return
+	}
+	c.JSON(http.StatusCreated, pl)
+}
+
+// ListPaymentLinks returns the caller's payment links, newest first
+func ListPaymentLinks(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("payment_links").Where("user_id", "==", uid).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load payment links"})
+		return
+	}
+	links := make([]PaymentLink, 0, len(docs))
+	for _, doc := range docs {
+		var pl PaymentLink
+		if err := doc.DataTo(&pl); err != nil {
+			continue
+		}
+		pl.ID = doc.Ref.ID
+		links = append(links, pl)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.After(links[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"payment_links": links})
+}
+
+// DeactivatePaymentLink stops one of the caller's payment links taking payments
+func DeactivatePaymentLink(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	ref := fs.Collection("payment_links").Doc(c.Param("id"))
+	doc, err := getDocument(ctx, ref)
+	if err != nil || stringField(doc.Data(), "user_id") != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment link not found"})
+		return
+	}
+	if err := sc.DeactivatePaymentLink(ctx, stringField(doc.Data(), "stripe_payment_link_id")); err != nil {
+		sc.LogAPIError(ctx, "deactivate_payment_link", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to deactivate payment link", err))
+		return
+	}
+	if _, err := ref.Update(ctx, []firestore.Update{
+		{Path: "active", Value: false},
+		{Path: "updated_at", Value: time.Now()},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save payment link"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": doc.Ref.ID, "active": false})
+}
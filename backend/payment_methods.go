@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// SavedPaymentMethod is the client's view of a saved card or bank account
+type SavedPaymentMethod struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"` // card or us_bank_account
+	Brand     string `json:"brand,omitempty"`
+	BankName  string `json:"bank_name,omitempty"`
+	Last4     string `json:"last4"`
+	ExpMonth  int64  `json:"exp_month,omitempty"`
+	ExpYear   int64  `json:"exp_year,omitempty"`
+	IsDefault bool   `json:"is_default"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// savedPaymentMethod summarizes a Stripe payment method for the client
+func savedPaymentMethod(pm *stripe.PaymentMethod, defaultID string) SavedPaymentMethod {
+	saved := SavedPaymentMethod{
+		ID:        pm.ID,
+		Type:      string(pm.Type),
+		IsDefault: pm.ID == defaultID,
+		CreatedAt: pm.Created,
+	}
+	switch {
+	case pm.Card != nil:
+		saved.Brand = string(pm.Card.Brand)
+		saved.Last4 = pm.Card.Last4
+		saved.ExpMonth = pm.Card.ExpMonth
+		saved.ExpYear = pm.Card.ExpYear
+	case pm.USBankAccount != nil:
+		saved.BankName = pm.USBankAccount.BankName
+		saved.Last4 = pm.USBankAccount.Last4
+	}
+	return saved
+}
+
+// callerStripeCustomer loads the caller's user document and responds 404
+// unless customerID is their Stripe customer
+func callerStripeCustomer(c *gin.Context, fs *firestore.Client, uid, customerID string) (map[string]interface{}, bool) {
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	data := doc.Data()
+	if customerID == "" || stringField(data, providerUserField(ProcessorStripe, "customer_id")) != customerID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Customer not found"})
+		return nil, false
+	}
+	return data, true
+}
+
+// paymentMethodDeps pulls the caller, Stripe client, and Firestore a payment
+// method handler needs, responding when one is missing
+func paymentMethodDeps(c *gin.Context) (string, *StripeClient, *firestore.Client, bool) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", nil, nil, false
+	}
+	stripeClient, exists := c.Get("stripeClient")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+		return "", nil, nil, false
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return "", nil, nil, false
+	}
+	return uidVal.(string), stripeClient.(*StripeClient), v.(*firestore.Client), true
+}
+
+// ListPaymentMethods returns the caller's saved cards and bank accounts,
+// marking their default
+func ListPaymentMethods(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	customerID := c.Param("id")
+	user, ok := callerStripeCustomer(c, fs, uid, customerID)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	methods, err := sc.ListCustomerPaymentMethods(ctx, customerID)
+	if err != nil {
+		sc.LogAPIError(ctx, "list_payment_methods", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to list payment methods", err))
+		return
+	}
+	defaultID := stringField(user, "default_payment_method_id")
+	saved := make([]SavedPaymentMethod, 0, len(methods))
+	for _, pm := range methods {
+		saved = append(saved, savedPaymentMethod(pm, defaultID))
+	}
+	c.JSON(http.StatusOK, gin.H{"payment_methods": saved, "default_payment_method_id": defaultID})
+}
+
+// ownedPaymentMethod fetches a payment method and responds 404 unless it is
+// saved to the caller's Stripe customer
+func ownedPaymentMethod(c *gin.Context, sc *StripeClient, user map[string]interface{}, uid, paymentMethodID string) (*stripe.PaymentMethod, bool) {
+	ctx := c.Request.Context()
+	pm, err := sc.GetPaymentMethod(ctx, paymentMethodID)
+	if err != nil {
+		if se := stripeErrorDetails(err); se != nil && se.HTTPStatus == http.StatusNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payment method not found"})
+			return nil, false
+		}
+		sc.LogAPIError(ctx, "get_payment_method", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to load payment method", err))
+		return nil, false
+	}
+	customerID := stringField(user, providerUserField(ProcessorStripe, "customer_id"))
+	if pm.Customer == nil || customerID == "" || pm.Customer.ID != customerID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment method not found"})
+		return nil, false
+	}
+	return pm, true
+}
+
+// DetachPaymentMethod removes one of the caller's saved payment methods. It
+// can no longer fund payments, so it is dropped from their verified methods
+// and stops being their default.
+func DetachPaymentMethod(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	pm, ok := ownedPaymentMethod(c, sc, doc.Data(), uid, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	if err := sc.DetachPaymentMethod(ctx, pm.ID); err != nil {
+		sc.LogAPIError(ctx, "detach_payment_method", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to remove payment method", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "detach_payment_method", uid, true, fmt.Sprintf("Payment method: %s", pm.ID))
+
+	err = UpdateUser(ctx, fs, uid, func(user *firestore.DocumentSnapshot) (map[string]interface{}, error) {
+		fields := map[string]interface{}{
+			"verified_payment_methods": firestore.ArrayRemove(pm.ID),
+			"updated_at":               time.Now(),
+		}
+		if stringField(user.Data(), "default_payment_method_id") == pm.ID {
+			fields["default_payment_method_id"] = firestore.Delete
+		}
+		return fields, nil
+	})
+	if err != nil {
+		sc.LogAPIError(ctx, "save_user", uid, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"payment_method_id": pm.ID, "detached": true})
+}
+
+// SetDefaultPaymentMethod makes one of the caller's saved payment methods the
+// default, on their Stripe customer and their user document
+func SetDefaultPaymentMethod(c *gin.Context) {
+	var req struct {
+		PaymentMethodID string `json:"payment_method_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	customerID := c.Param("id")
+	user, ok := callerStripeCustomer(c, fs, uid, customerID)
+	if !ok {
+		return
+	}
+	pm, ok := ownedPaymentMethod(c, sc, user, uid, req.PaymentMethodID)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if _, err := sc.SetDefaultPaymentMethod(ctx, customerID, pm.ID); err != nil {
+		sc.LogAPIError(ctx, "set_default_payment_method", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to set default payment method", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "set_default_payment_method", uid, true, fmt.Sprintf("Payment method: %s", pm.ID))
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"default_payment_method_id": pm.ID,
+		"updated_at":                time.Now(),
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save default payment method"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"payment_method": savedPaymentMethod(pm, pm.ID)})
+}
+
+// defaultPaymentMethod returns the user's default payment method, if any
+func defaultPaymentMethod(ctx context.Context, fs *firestore.Client, uid string) string {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return ""
+	}
+	return stringField(doc.Data(), "default_payment_method_id")
+}
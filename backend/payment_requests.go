@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Payment request statuses set by the backend; the app also uses
+// pending, accepted, rejected, and canceled.
+const (
+	PaymentRequestPartiallyPaid = "partially_paid"
+	PaymentRequestPaid          = "paid"
+)
+
+// Notification types for payment request activity
+const (
+	NotificationRequestPaymentReceived = "request_payment_received"
+	NotificationRequestPaid            = "request_paid"
+)
+
+// PaymentRequest mirrors requests/{id}. The app writes the camelCase fields in
+// major units; senderEmail is the requester and receiverEmail is the payer.
+type PaymentRequest struct {
+	ID              string  `json:"id" firestore:"-"`
+	SenderEmail     string  `json:"senderEmail" firestore:"senderEmail"`
+	ReceiverEmail   string  `json:"receiverEmail" firestore:"receiverEmail"`
+	Amount          float64 `json:"amount" firestore:"amount"`
+	Currency        string  `json:"currency" firestore:"currency"`
+	Status          string  `json:"status" firestore:"status"`
+	Notes           string  `json:"notes,omitempty" firestore:"notes"`
+	AmountPaid      float64 `json:"amountPaid" firestore:"amountPaid"`
+	AmountRemaining float64 `json:"amountRemaining" firestore:"amountRemaining"`
+	ExpiresAt       string  `json:"expiresAt,omitempty" firestore:"expiresAt"`
+
+	raw map[string]interface{}
+}
+
+// PaymentRequestPayment is one partial payment, stored at requests/{id}/payments/{paymentIntentId}
+type PaymentRequestPayment struct {
+	PaymentIntentID string    `json:"payment_intent_id" firestore:"payment_intent_id"`
+	PayerUserID     string    `json:"payer_user_id" firestore:"payer_user_id"`
+	Amount          int64     `json:"amount" firestore:"amount"`
+	Currency        string    `json:"currency" firestore:"currency"`
+	Status          string    `json:"status" firestore:"status"`
+	CreatedAt       time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// isPayable reports whether a request can still receive payments
+func (r *PaymentRequest) isPayable() bool {
+	switch r.Status {
+	case "pending", "accepted", PaymentRequestPartiallyPaid:
+		return true
+	}
+	return false
+}
+
+// remainingMinorUnits is the unpaid balance in minor units
+func (r *PaymentRequest) remainingMinorUnits() int64 {
+	cur := currencyOrDefault(r.Currency)
+	return max(cur.ToMinor(r.Amount)-cur.ToMinor(r.AmountPaid), 0)
+}
+
+// userIDForEmail resolves a Firebase UID from either email field the user document may carry
+func userIDForEmail(ctx context.Context, fs *firestore.Client, email string) (string, error) {
+	for _, field := range []string{"email_address", "email"} {
+		docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+			return users.Where(field, "==", email).Limit(1)
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to look up user by %s: %w", field, err)
+		}
+		if len(docs) > 0 {
+			return docs[0].Ref.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no user with email %s", email)
+}
+
+// loadPaymentRequest reads requests/{id} and checks the caller is one of its parties
+func loadPaymentRequest(c *gin.Context, fs *firestore.Client, id string) (*PaymentRequest, bool) {
+	doc, err := fs.Collection("requests").Doc(id).Get(c.Request.Context())
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment request not found"})
+		return nil, false
+	}
+	req := &PaymentRequest{}
+	if err := doc.DataTo(req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read payment request"})
+		return nil, false
+	}
+	req.ID = doc.Ref.ID
+	req.raw = doc.Data()
+	if req.AmountPaid == 0 && req.AmountRemaining == 0 {
+		req.AmountRemaining = req.Amount
+	}
+
+	email := c.GetString("email")
+	if email == "" || (!strings.EqualFold(email, req.SenderEmail) && !strings.EqualFold(email, req.ReceiverEmail)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment request not found"})
+		return nil, false
+	}
+	return req, true
+}
+
+// pendingRequestPayments sums partial payments that have not yet settled
+func pendingRequestPayments(ctx context.Context, fs *firestore.Client, requestID string) (int64, error) {
+	docs, err := fs.Collection("requests").Doc(requestID).Collection("payments").Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load request payments: %w", err)
+	}
+	var pending int64
+	for _, doc := range docs {
+		var p PaymentRequestPayment
+		if err := doc.DataTo(&p); err != nil {
+			continue
+		}
+		if p.Status != "succeeded" && p.Status != "failed" && p.Status != "canceled" {
+			pending += p.Amount
+		}
+	}
+	return pending, nil
+}
+
+// PayPaymentRequest pays all or part of a payment request on behalf of the payer
+func PayPaymentRequest(c *gin.Context) {
+	var body struct {
+		// Amount in cents; defaults to the whole outstanding balance
+		Amount          int64  `json:"amount" binding:"omitempty,min=50"`
+		PaymentMethodID string `json:"payment_method_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	pp, ok := paymentProviderFor(c)
+	if !ok {
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	pr, ok := loadPaymentRequest(c, fs, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(c.GetString("email"), pr.ReceiverEmail) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the requested payer can pay this request"})
+		return
+	}
+	if !pr.isPayable() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Payment request is %s", pr.Status)})
+		return
+	}
+	if expiresAt, ok := requestExpiry(pr.raw); ok && !time.Now().Before(expiresAt) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment request has expired"})
+		return
+	}
+	pending, err := pendingRequestPayments(ctx, fs, pr.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load request payments"})
+		return
+	}
+	outstanding := pr.remainingMinorUnits() - pending
+	if body.Amount == 0 {
+		body.Amount = outstanding
+	}
+	if body.Amount <= 0 || body.Amount > outstanding {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount exceeds the remaining balance", "remaining": max(outstanding, 0)})
+		return
+	}
+
+	// Requests made before currencies were validated may have none
+	currency := pr.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if !validatePaymentCurrency(c, uid, &currency, body.Amount) {
+		return
+	}
+	if !enforceSendLimits(c, uid, body.Amount, currency) {
+		return
+	}
+
+	requesterUID, err := userIDForEmail(ctx, fs, pr.SenderEmail)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requester not found"})
+		return
+	}
+	pi, _, err := createP2PPayment(c, pp, p2pPayment{
+		SenderUID:       uid,
+		RecipientUID:    requesterUID,
+		Amount:          body.Amount,
+		Currency:        currency,
+		PaymentMethodID: body.PaymentMethodID,
+		IdempotencyKey:  c.GetHeader("Idempotency-Key"),
+		Metadata:        map[string]string{"payment_request_id": pr.ID},
+		Fields:          map[string]interface{}{"payment_request_id": pr.ID},
+	})
+	if pi == nil {
+		respondP2PError(c, err)
+		return
+	}
+	pp.LogAPIInteraction(ctx, "pay_payment_request", uid, true, fmt.Sprintf("Request: %s, PaymentIntent: %s", pr.ID, pi.ID))
+
+	now := time.Now()
+	payment := PaymentRequestPayment{
+		PaymentIntentID: pi.ID,
+		PayerUserID:     uid,
+		Amount:          body.Amount,
+		Currency:        currency,
+		Status:          pi.Status,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if _, err := fs.Collection("requests").Doc(pr.ID).Collection("payments").Doc(pi.ID).Set(ctx, payment); err != nil {
+		pp.LogAPIError(ctx, "save_request_payment", uid, err)
+	}
+	if err != nil {
+		respondP2PError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, withBalanceCheck(c, gin.H{"payment_intent": pi, "payment": payment}))
+}
+
+// GetPaymentRequestPayments returns the payment breakdown of a request to either party
+func GetPaymentRequestPayments(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	pr, ok := loadPaymentRequest(c, fs, c.Param("id"))
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("requests").Doc(pr.ID).Collection("payments").Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load request payments"})
+		return
+	}
+	payments := make([]PaymentRequestPayment, 0, len(docs))
+	for _, doc := range docs {
+		var p PaymentRequestPayment
+		if err := doc.DataTo(&p); err == nil {
+			payments = append(payments, p)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"request":  pr,
+		"payments": payments,
+	})
+}
+
+// PaymentRequestConsumer settles partial payments when their transaction
+// succeeds or fails, closing the request once it is fully paid.
+func PaymentRequestConsumer(ctx context.Context, fs *firestore.Client, evt Event) error {
+	if evt.TransactionID == "" {
+		return nil
+	}
+	txDoc, err := fs.Collection("transactions").Doc(evt.TransactionID).Get(ctx)
+	if err != nil || !txDoc.Exists() {
+		return nil
+	}
+	requestID, _ := txDoc.Data()["payment_request_id"].(string)
+	if requestID == "" {
+		return nil
+	}
+	status := "failed"
+	if evt.Type == EventTransactionSucceeded {
+		status = "succeeded"
+	}
+
+	reqRef := fs.Collection("requests").Doc(requestID)
+	paymentRef := reqRef.Collection("payments").Doc(evt.TransactionID)
+	var settled *PaymentRequest
+	var payment PaymentRequestPayment
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		settled = nil
+		reqDoc, err := tx.Get(reqRef)
+		if err != nil {
+			return err
+		}
+		paymentDoc, err := tx.Get(paymentRef)
+		if err != nil {
+			return err
+		}
+		if err := paymentDoc.DataTo(&payment); err != nil {
+			return err
+		}
+		// Webhooks can be redelivered; only the first terminal status counts
+		if payment.Status == "succeeded" || payment.Status == "failed" {
+			return nil
+		}
+		pr := &PaymentRequest{}
+		if err := reqDoc.DataTo(pr); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := tx.Set(paymentRef, map[string]interface{}{"status": status, "updated_at": now}, firestore.MergeAll); err != nil {
+			return err
+		}
+		if status != "succeeded" {
+			return nil
+		}
+
+		cur := currencyOrDefault(pr.Currency)
+		paid := cur.ToMinor(pr.AmountPaid) + payment.Amount
+		pr.AmountPaid = cur.FromMinor(paid)
+		pr.AmountRemaining = cur.FromMinor(max(cur.ToMinor(pr.Amount)-paid, 0))
+		update := map[string]interface{}{
+			"amountPaid":      pr.AmountPaid,
+			"amountRemaining": pr.AmountRemaining,
+			"updatedAt":       now.Format(time.RFC3339),
+		}
+		pr.Status = PaymentRequestPartiallyPaid
+		if pr.AmountRemaining == 0 {
+			pr.Status = PaymentRequestPaid
+			update["paidAt"] = now.Format(time.RFC3339)
+		}
+		update["status"] = pr.Status
+		pr.ID = requestID
+		settled = pr
+		return tx.Set(reqRef, update, firestore.MergeAll)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to settle payment for request %s: %w", requestID, err)
+	}
+	if settled == nil {
+		return nil
+	}
+
+	requesterUID, _ := txDoc.Data()["recipient_user_id"].(string)
+	data := map[string]interface{}{"request_id": requestID, "payment_intent_id": evt.TransactionID}
+	if settled.Status == PaymentRequestPaid {
+		body := "Your payment request has been paid in full."
+		NotifyUser(ctx, fs, requesterUID, NotificationRequestPaid, "Request paid", body, data)
+		NotifyUser(ctx, fs, payment.PayerUserID, NotificationRequestPaid, "Request paid", body, data)
+		return nil
+	}
+	NotifyUser(ctx, fs, requesterUID, NotificationRequestPaymentReceived, "Partial payment received",
+		fmt.Sprintf("%s received; %s remaining.", currencyOrDefault(payment.Currency).Format(payment.Amount), currencyOrDefault(settled.Currency).Format(settled.remainingMinorUnits())),
+		data)
+	return nil
+}
+
+// NotificationRequestReceived tells a payer someone has requested money from them
+const NotificationRequestReceived = "request_received"
+
+// paymentRequestTransitions lists the statuses a request may move to from each
+// status through the API; payments and expiry move requests on their own.
+var paymentRequestTransitions = map[string][]string{
+	"pending":                   {"accepted", "rejected", "canceled"},
+	"accepted":                  {"rejected", "canceled"},
+	PaymentRequestPartiallyPaid: {"canceled"},
+}
+
+// canTransition reports whether a request in status from may be moved to to
+func canTransition(from, to string) bool {
+	for _, s := range paymentRequestTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatePaymentRequest requests money from another user by email
+func CreatePaymentRequest(c *gin.Context) {
+	var body struct {
+		ReceiverEmail string `json:"receiver_email" binding:"required,email"`
+		// Amount in minor units, at least the currency's minimum payment
+		Amount int64 `json:"amount" binding:"required,min=1"`
+		// The requester's default currency when empty
+		Currency       string `json:"currency"`
+		Notes          string `json:"notes" binding:"max=500"`
+		ExpiresInHours int    `json:"expires_in_hours" binding:"omitempty,min=1"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+	email := c.GetString("email")
+	if email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Your account has no email address"})
+		return
+	}
+	if strings.EqualFold(email, body.ReceiverEmail) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot request money from yourself"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	payerUID, err := userIDForEmail(ctx, fs, body.ReceiverEmail)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No user found with that email"})
+		return
+	}
+
+	currency := body.Currency
+	if !validatePaymentCurrency(c, uid, &currency, body.Amount) {
+		return
+	}
+	ttl := requestDurationSetting("PAYMENT_REQUEST_TTL", defaultPaymentRequestTTL)
+	if body.ExpiresInHours > 0 {
+		ttl = time.Duration(body.ExpiresInHours) * time.Hour
+	}
+	now := time.Now().UTC()
+	pr := &PaymentRequest{
+		SenderEmail:     email,
+		ReceiverEmail:   body.ReceiverEmail,
+		Amount:          currencies[currency].FromMinor(body.Amount),
+		Currency:        currency,
+		Status:          "pending",
+		Notes:           body.Notes,
+		AmountRemaining: currencies[currency].FromMinor(body.Amount),
+		ExpiresAt:       now.Add(ttl).Format(time.RFC3339),
+	}
+	ref := fs.Collection("requests").NewDoc()
+	if _, err := ref.Set(ctx, map[string]interface{}{
+		"senderEmail":     pr.SenderEmail,
+		"receiverEmail":   pr.ReceiverEmail,
+		"amount":          pr.Amount,
+		"currency":        pr.Currency,
+		"status":          pr.Status,
+		"notes":           pr.Notes,
+		"amountPaid":      0.0,
+		"amountRemaining": pr.AmountRemaining,
+		"requestedAt":     now.Format(time.RFC3339),
+		"expiresAt":       pr.ExpiresAt,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment request"})
+		return
+	}
+	pr.ID = ref.ID
+
+	NotifyUser(ctx, fs, payerUID, NotificationRequestReceived,
+		"Payment requested",
+		fmt.Sprintf("%s requested %.2f %s from you", email, pr.Amount, strings.ToUpper(currency)),
+		map[string]interface{}{"request_id": pr.ID, "requester_user_id": uid})
+
+	c.JSON(http.StatusCreated, pr)
+}
+
+// ListPaymentRequests returns requests the caller has received (?direction=incoming,
+// the default) or made (?direction=outgoing), newest first, optionally filtered by status.
+func ListPaymentRequests(c *gin.Context) {
+	email := c.GetString("email")
+	if email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	field := "receiverEmail"
+	switch c.DefaultQuery("direction", "incoming") {
+	case "incoming":
+	case "outgoing":
+		field = "senderEmail"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "direction must be incoming or outgoing"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	q := fs.Collection("requests").Where(field, "==", email)
+	if s := c.Query("status"); s != "" {
+		q = q.Where("status", "==", s)
+	}
+	docs, err := q.Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load payment requests"})
+		return
+	}
+
+	type listed struct {
+		PaymentRequest
+		RequestedAt string `json:"requestedAt,omitempty"`
+	}
+	requests := make([]listed, 0, len(docs))
+	for _, doc := range docs {
+		var r listed
+		if err := doc.DataTo(&r.PaymentRequest); err != nil {
+			continue
+		}
+		r.ID = doc.Ref.ID
+		r.RequestedAt = stringField(doc.Data(), "requestedAt")
+		if r.AmountPaid == 0 && r.AmountRemaining == 0 {
+			r.AmountRemaining = r.Amount
+		}
+		requests = append(requests, r)
+	}
+	// ISO 8601 strings in UTC sort chronologically
+	sort.Slice(requests, func(i, j int) bool { return requests[i].RequestedAt > requests[j].RequestedAt })
+
+	c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+// updatePaymentRequestStatus moves a request the caller is a party to into status,
+// after checking the caller's role allows it and the transition is valid.
+func updatePaymentRequestStatus(c *gin.Context, status string, requesterOnly bool) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	pr, ok := loadPaymentRequest(c, fs, c.Param("id"))
+	if !ok {
+		return
+	}
+	email := c.GetString("email")
+	if requesterOnly && !strings.EqualFold(email, pr.SenderEmail) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the requester can do this"})
+		return
+	}
+	if !requesterOnly && !strings.EqualFold(email, pr.ReceiverEmail) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the requested payer can do this"})
+		return
+	}
+	if !canTransition(pr.Status, status) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Payment request is %s", pr.Status)})
+		return
+	}
+
+	if _, err := fs.Collection("requests").Doc(pr.ID).Set(ctx, map[string]interface{}{
+		"status":    status,
+		"updatedAt": time.Now().UTC().Format(time.RFC3339),
+	}, firestore.MergeAll); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update payment request"})
+		return
+	}
+
+	// Let the other party know
+	other := pr.SenderEmail
+	if requesterOnly {
+		other = pr.ReceiverEmail
+	}
+	if otherUID, err := userIDForEmail(ctx, fs, other); err == nil {
+		NotifyUser(ctx, fs, otherUID, "request_"+status,
+			"Payment request "+status,
+			fmt.Sprintf("The request for %.2f %s was %s", pr.Amount, strings.ToUpper(pr.Currency), status),
+			map[string]interface{}{"request_id": pr.ID, "actor_user_id": uid})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"request_id": pr.ID, "status": status})
+}
+
+// DeclinePaymentRequest lets the payer reject a request
+func DeclinePaymentRequest(c *gin.Context) {
+	updatePaymentRequestStatus(c, "rejected", false)
+}
+
+// CancelPaymentRequest lets the requester withdraw a request
+func CancelPaymentRequest(c *gin.Context) {
+	updatePaymentRequestStatus(c, "canceled", true)
+}
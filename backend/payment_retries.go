@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// NotificationPaymentRetryAvailable prompts a sender to retry a failed payment
+const NotificationPaymentRetryAvailable = "payment_retry_available"
+
+// maxPaymentAttempts caps how many funding sources are tried for one payment
+const maxPaymentAttempts = 3
+
+// retryableFailureCodes are failures caused by the funding source rather than
+// the payment itself, so trying a different saved source can succeed. Returns
+// such as debit_not_authorized are deliberately excluded.
+var retryableFailureCodes = map[string]bool{
+	string(stripe.ErrorCodeInsufficientFunds):            true,
+	string(stripe.ErrorCodeBankAccountDeclined):          true,
+	string(stripe.ErrorCodeBankAccountRestricted):        true,
+	string(stripe.ErrorCodeBankAccountUnusable):          true,
+	string(stripe.ErrorCodeBankAccountUnverified):        true,
+	string(stripe.ErrorCodePaymentMethodProviderDecline): true,
+	"account_closed":         true,
+	"account_frozen":         true,
+	"no_account":             true,
+	"invalid_account_number": true,
+}
+
+// paymentFailureCode returns the most specific failure code Stripe reported
+func paymentFailureCode(pi *stripe.PaymentIntent) string {
+	if pi.LastPaymentError == nil {
+		return ""
+	}
+	if pi.LastPaymentError.DeclineCode != "" {
+		return string(pi.LastPaymentError.DeclineCode)
+	}
+	return string(pi.LastPaymentError.Code)
+}
+
+// failedPaymentMethodID returns the funding source the failed attempt used
+func failedPaymentMethodID(pi *stripe.PaymentIntent) string {
+	if pi.LastPaymentError != nil && pi.LastPaymentError.PaymentMethod != nil {
+		return pi.LastPaymentError.PaymentMethod.ID
+	}
+	if pi.PaymentMethod != nil {
+		return pi.PaymentMethod.ID
+	}
+	return ""
+}
+
+// attemptedPaymentMethods lists every funding source already tried for a payment
+func attemptedPaymentMethods(ctx context.Context, fs *firestore.Client, originalID string) (map[string]bool, error) {
+	docs, err := fs.Collection("transactions").Where("original_transaction_id", "==", originalID).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payment attempts: %w", err)
+	}
+	tried := map[string]bool{}
+	for _, doc := range docs {
+		if pm, _ := doc.Data()["payment_method_id"].(string); pm != "" {
+			tried[pm] = true
+		}
+	}
+	return tried, nil
+}
+
+// retryFundingSources returns the sender's verified funding sources not yet tried
+func retryFundingSources(ctx context.Context, fs *firestore.Client, senderUID, originalID string) ([]string, error) {
+	userDoc, err := UserDoc(ctx, fs, senderUID).Get(ctx)
+	if err != nil || !userDoc.Exists() {
+		return nil, fmt.Errorf("user %s not found", senderUID)
+	}
+	tried, err := attemptedPaymentMethods(ctx, fs, originalID)
+	if err != nil {
+		return nil, err
+	}
+	sources := []string{}
+	methods, _ := userDoc.Data()["verified_payment_methods"].([]interface{})
+	for _, m := range methods {
+		if pm, ok := m.(string); ok && pm != "" && !tried[pm] {
+			sources = append(sources, pm)
+		}
+	}
+	return sources, nil
+}
+
+// OfferPaymentRetry marks a failed payment as retryable and prompts the sender
+// to pick another funding source when the failure reason allows it.
+func OfferPaymentRetry(ctx context.Context, fs *firestore.Client, pi *stripe.PaymentIntent) error {
+	senderUID := pi.Metadata["sender_user_id"]
+	code := paymentFailureCode(pi)
+	if senderUID == "" {
+		return nil
+	}
+
+	originalID := pi.Metadata["original_transaction_id"]
+	if originalID == "" {
+		originalID = pi.ID
+	}
+	attempt, _ := strconv.Atoi(pi.Metadata["attempt"])
+	if attempt == 0 {
+		attempt = 1
+	}
+
+	fields := map[string]interface{}{
+		"failure_code":            code,
+		"original_transaction_id": originalID,
+		"attempt":                 attempt,
+		"retry_available":         false,
+	}
+	if pm := failedPaymentMethodID(pi); pm != "" {
+		fields["payment_method_id"] = pm
+	}
+	// Record the failed source first so it is excluded from the alternatives
+	if err := SaveTransaction(ctx, fs, pi.ID, fields); err != nil {
+		return err
+	}
+	// A cross-currency payment's rate was only locked for the first attempt;
+	// the sender gets a new quote instead
+	if !retryableFailureCodes[code] || attempt >= maxPaymentAttempts || pi.Metadata["fx_quote_id"] != "" {
+		return nil
+	}
+
+	sources, err := retryFundingSources(ctx, fs, senderUID, originalID)
+	if err != nil || len(sources) == 0 {
+		return err
+	}
+	if err := SaveTransaction(ctx, fs, pi.ID, map[string]interface{}{"retry_available": true}); err != nil {
+		return err
+	}
+
+	NotifyUser(ctx, fs, senderUID, NotificationPaymentRetryAvailable, "Your payment didn't go through",
+		"Your bank couldn't complete this payment. Try again with a different funding source.",
+		map[string]interface{}{
+			"transaction_id":          pi.ID,
+			"original_transaction_id": originalID,
+			"failure_code":            code,
+		})
+	return nil
+}
+
+// RetryPayment retries a failed payment with a different saved funding source.
+// The new attempt carries the original transaction reference so attempts stay linked.
+func RetryPayment(c *gin.Context) {
+	var req struct {
+		PaymentMethodID string `json:"payment_method_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	pp, ok := paymentProviderFor(c)
+	if !ok {
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	failedID := c.Param("id")
+	doc, err := fs.Collection("transactions").Doc(failedID).Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	var failed TransactionRecord
+	if err := doc.DataTo(&failed); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read transaction"})
+		return
+	}
+	if failed.SenderUserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can retry a payment"})
+		return
+	}
+	if failed.Status != "failed" || !failed.RetryAvailable {
+		c.JSON(http.StatusConflict, gin.H{"error": "This payment cannot be retried"})
+		return
+	}
+
+	originalID := failed.OriginalTransactionID
+	if originalID == "" {
+		originalID = failedID
+	}
+	sources, err := retryFundingSources(ctx, fs, uid, originalID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load funding sources"})
+		return
+	}
+	allowed := false
+	for _, pm := range sources {
+		if pm == req.PaymentMethodID {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "payment_method_id must be a verified funding source not already tried", "available": sources})
+		return
+	}
+
+	userDoc, err := UserDoc(ctx, fs, uid).Get(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sender customer not found"})
+		return
+	}
+	customerID, _ := userDoc.Data()[providerUserField(pp.Name(), "customer_id")].(string)
+	if customerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sender customer not found"})
+		return
+	}
+	var recipientAccountID string
+	if recipientDoc, err := UserDoc(ctx, fs, failed.RecipientUserID).Get(ctx); err == nil {
+		recipientAccountID, _ = recipientDoc.Data()[providerUserField(pp.Name(), "account_id")].(string)
+	}
+	if recipientAccountID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recipient_account_id required"})
+		return
+	}
+
+	attempt := failed.Attempt + 1
+	if failed.Attempt == 0 {
+		attempt = 2
+	}
+	// The transfer to the recipient happens on payment_intent.succeeded, as for the first attempt
+	meta := map[string]string{
+		"recipient_account_id":    recipientAccountID,
+		"sender_user_id":          uid,
+		"recipient_user_id":       failed.RecipientUserID,
+		"flow":                    "scat",
+		"original_transaction_id": originalID,
+		"previous_attempt_id":     failedID,
+		"attempt":                 strconv.Itoa(attempt),
+	}
+	idem := fmt.Sprintf("retry-%s-%s", failedID, req.PaymentMethodID)
+	sca, err := providerSCAPolicy(ctx, pp, req.PaymentMethodID, failed.Amount, failed.Currency, false)
+	if err != nil {
+		pp.LogAPIError(ctx, "get_payment_method", uid, err)
+		c.JSON(http.StatusBadRequest, stripeErrorBody(c, "Invalid payment method", err))
+		return
+	}
+	// The new method may be a card or a bank account whatever the failed one was
+	source, err := paymentFeeMethod(ctx, pp, req.PaymentMethodID)
+	if err != nil {
+		pp.LogAPIError(ctx, "get_payment_method", uid, err)
+		c.JSON(http.StatusBadRequest, stripeErrorBody(c, "Invalid payment method", err))
+		return
+	}
+	var achAuth *ACHAuthorization
+	if source == FeeMethodBank {
+		achAuth, err = AuthorizeACHDebit(ctx, fs, uid, failed.Amount, failed.Currency, c.ClientIP(), c.Request.UserAgent())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record authorization"})
+			return
+		}
+	}
+	pi, err := pp.CreatePayment(ctx, PaymentParams{
+		Amount:             failed.Amount,
+		Currency:           failed.Currency,
+		CustomerID:         customerID,
+		PaymentMethodID:    req.PaymentMethodID,
+		Metadata:           meta,
+		IdempotencyKey:     idem,
+		SCA:                sca,
+		PaymentMethodTypes: fundingPaymentMethodTypes(source),
+		ACHAuthorization:   achAuth,
+	})
+	if err != nil {
+		pp.LogAPIError(ctx, "retry_payment", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to retry payment", err))
+		return
+	}
+	pp.LogAPIInteraction(ctx, "retry_payment", uid, true, fmt.Sprintf("Original: %s, Attempt: %s", originalID, pi.ID))
+
+	fields := map[string]interface{}{
+		"sender_user_id":          uid,
+		"recipient_user_id":       failed.RecipientUserID,
+		"amount":                  failed.Amount,
+		"currency":                failed.Currency,
+		"payment_intent_id":       pi.ID,
+		"payment_method_id":       req.PaymentMethodID,
+		"status":                  pi.Status,
+		"original_transaction_id": originalID,
+		"previous_attempt_id":     failedID,
+		"attempt":                 attempt,
+		"sca_exemption":           sca.Exemption,
+		"created_at":              time.Now(),
+	}
+	if achAuth != nil {
+		fields["ach_authorization_id"] = achAuth.ID
+		if err := LinkACHAuthorization(ctx, fs, achAuth, pi.ID); err != nil {
+			pp.LogAPIError(ctx, "link_ach_authorization", uid, err)
+		}
+	}
+	if err := SaveTransaction(ctx, fs, pi.ID, fields); err != nil {
+		pp.LogAPIError(ctx, "save_transaction", uid, err)
+	}
+	_ = SaveTransaction(ctx, fs, failedID, map[string]interface{}{
+		"retry_available": false,
+		"retried_by":      pi.ID,
+	})
+	PublishEvent(ctx, fs, Event{
+		Type:          EventTransactionCreated,
+		UserIDs:       []string{uid, failed.RecipientUserID},
+		TransactionID: pi.ID,
+		Data:          map[string]interface{}{"amount": failed.Amount, "currency": failed.Currency, "status": pi.Status, "original_transaction_id": originalID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"payment_intent":          pi,
+		"original_transaction_id": originalID,
+		"attempt":                 attempt,
+	})
+}
+
+// GetPaymentAttempts lists every attempt linked to a payment, oldest first
+func GetPaymentAttempts(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	doc, err := fs.Collection("transactions").Doc(c.Param("id")).Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	var rec TransactionRecord
+	if err := doc.DataTo(&rec); err != nil || (rec.SenderUserID != uid && rec.RecipientUserID != uid) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	originalID := rec.OriginalTransactionID
+	if originalID == "" {
+		originalID = doc.Ref.ID
+	}
+
+	docs, err := fs.Collection("transactions").Where("original_transaction_id", "==", originalID).Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attempts"})
+		return
+	}
+	attempts := make([]TransactionRecord, 0, len(docs)+1)
+	seenOriginal := false
+	for _, d := range docs {
+		var a TransactionRecord
+		if err := d.DataTo(&a); err != nil {
+			continue
+		}
+		a.ID = d.Ref.ID
+		seenOriginal = seenOriginal || a.ID == originalID
+		attempts = append(attempts, a)
+	}
+	if !seenOriginal {
+		if d, err := fs.Collection("transactions").Doc(originalID).Get(ctx); err == nil {
+			var a TransactionRecord
+			if err := d.DataTo(&a); err == nil {
+				a.ID = d.Ref.ID
+				attempts = append(attempts, a)
+			}
+		}
+	}
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].CreatedAt.Before(attempts[j].CreatedAt)
+	})
+
+	c.JSON(http.StatusOK, gin.H{"original_transaction_id": originalID, "attempts": attempts})
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Payout statuses, following Stripe's payout once it is created
+const (
+	PayoutPending  = "pending"
+	PayoutPaid     = "paid"
+	PayoutFailed   = "failed"
+	PayoutCanceled = "canceled"
+)
+
+// How a payout reaches the recipient
+const (
+	PayoutMethodInstant  = "instant"  // to a debit card within minutes
+	PayoutMethodStandard = "standard" // to the bank account in a few days
+)
+
+// What started a payout
+const (
+	PayoutTriggerUser     = "user"     // an instant payout the recipient asked for
+	PayoutTriggerAdmin    = "admin"    // a manual payout an admin sent
+	PayoutTriggerSchedule = "schedule" // Stripe's automatic payout schedule
+)
+
+// Payout schedule intervals a recipient can choose
+const (
+	PayoutIntervalDaily  = "daily"
+	PayoutIntervalWeekly = "weekly"
+	PayoutIntervalManual = "manual"
+)
+
+// Notification types for payouts other than instant ones
+const (
+	NotificationPayoutPaid   = "payout_paid"
+	NotificationPayoutFailed = "payout_failed"
+)
+
+// payoutCurrency is the connected-account balance manual and instant payouts
+// are paid from
+const payoutCurrency = "usd"
+
+var payoutWeekdays = map[string]bool{
+	"monday": true, "tuesday": true, "wednesday": true, "thursday": true,
+	"friday": true, "saturday": true, "sunday": true,
+}
+
+// AccountPayout is a payout from a recipient's connected account, stored at
+// payouts/{id}. Instant and manual payouts are recorded when they are made
+// and keyed by our ID; scheduled ones are recorded from their webhook and
+// keyed by Stripe's. An instant payout's card gets NetAmount; its fee is
+// debited from the connected account once the payout is created, and
+// returned if it fails.
+type AccountPayout struct {
+	ID             string    `json:"id" firestore:"-"`
+	UserID         string    `json:"user_id" firestore:"user_id"`
+	AccountID      string    `json:"account_id" firestore:"account_id"`
+	Amount         int64     `json:"amount" firestore:"amount"`
+	Fee            int64     `json:"fee" firestore:"fee"`
+	NetAmount      int64     `json:"net_amount" firestore:"net_amount"`
+	Currency       string    `json:"currency" firestore:"currency"`
+	Method         string    `json:"method" firestore:"method"`
+	Trigger        string    `json:"trigger" firestore:"trigger"`
+	InitiatedBy    string    `json:"initiated_by,omitempty" firestore:"initiated_by,omitempty"`
+	CardID         string    `json:"card_id,omitempty" firestore:"card_id,omitempty"`
+	CardBrand      string    `json:"card_brand,omitempty" firestore:"card_brand,omitempty"`
+	CardLast4      string    `json:"card_last4,omitempty" firestore:"card_last4,omitempty"`
+	Status         string    `json:"status" firestore:"status"`
+	StripePayoutID string    `json:"stripe_payout_id,omitempty" firestore:"stripe_payout_id,omitempty"`
+	FeeStatus      string    `json:"fee_status,omitempty" firestore:"fee_status,omitempty"`
+	FeeTransferID  string    `json:"fee_transfer_id,omitempty" firestore:"fee_transfer_id,omitempty"`
+	FailureCode    string    `json:"failure_code,omitempty" firestore:"failure_code,omitempty"`
+	FailureMessage string    `json:"failure_message,omitempty" firestore:"failure_message,omitempty"`
+	ArrivalAt      time.Time `json:"arrival_at,omitempty" firestore:"arrival_at,omitempty"`
+	CreatedAt      time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// PayoutSchedule is a recipient's payout schedule preference, stored at
+// users/{uid}.payout_schedule. The delay before funds are paid out comes
+// from their risk tier, not from here.
+type PayoutSchedule struct {
+	Interval     string    `json:"interval" firestore:"interval"`
+	WeeklyAnchor string    `json:"weekly_anchor,omitempty" firestore:"weekly_anchor,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// storedPayoutSchedule is a user's schedule preference, daily if they never
+// chose one
+func storedPayoutSchedule(doc *firestore.DocumentSnapshot) PayoutSchedule {
+	var u struct {
+		PayoutSchedule *PayoutSchedule `firestore:"payout_schedule"`
+	}
+	if err := doc.DataTo(&u); err != nil || u.PayoutSchedule == nil || u.PayoutSchedule.Interval == "" {
+		return PayoutSchedule{Interval: PayoutIntervalDaily}
+	}
+	return *u.PayoutSchedule
+}
+
+// applyPayoutSchedule sets a recipient's connected account to their schedule
+// preference, with the payout delay of their risk tier
+func applyPayoutSchedule(ctx context.Context, sc *StripeClient, doc *firestore.DocumentSnapshot, schedule PayoutSchedule) error {
+	accountID := stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id"))
+	if accountID == "" {
+		return nil
+	}
+	tier := stringField(doc.Data(), "risk_tier")
+	if tier == "" {
+		tier = RiskTierLow
+	}
+	return sc.SetPayoutSchedule(ctx, accountID, schedule.Interval, schedule.WeeklyAnchor, riskTierTerms[tier].PayoutDelayDays)
+}
+
+// GetPayoutSchedule returns the caller's payout schedule preference and the
+// schedule their connected account is on
+func GetPayoutSchedule(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	accountID := stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id"))
+	if accountID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Finish setting up payouts first"})
+		return
+	}
+	live, err := sc.GetPayoutSchedule(ctx, accountID)
+	if err != nil {
+		sc.LogAPIError(ctx, "get_payout_schedule", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to load payout schedule", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"schedule": storedPayoutSchedule(doc), "account_schedule": live})
+}
+
+// UpdatePayoutSchedule sets how often the caller is paid out: daily, weekly
+// on a chosen day, or manual, where funds wait until support pays them out
+func UpdatePayoutSchedule(c *gin.Context) {
+	var req struct {
+		Interval     string `json:"interval" binding:"required,oneof=daily weekly manual"`
+		WeeklyAnchor string `json:"weekly_anchor"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Interval == PayoutIntervalWeekly && !payoutWeekdays[req.WeeklyAnchor] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weekly payouts need a weekly_anchor, e.g. monday"})
+		return
+	}
+	if req.Interval != PayoutIntervalWeekly {
+		req.WeeklyAnchor = ""
+	}
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id")) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Finish setting up payouts first"})
+		return
+	}
+
+	schedule := PayoutSchedule{Interval: req.Interval, WeeklyAnchor: req.WeeklyAnchor, UpdatedAt: time.Now()}
+	if err := applyPayoutSchedule(ctx, sc, doc, schedule); err != nil {
+		sc.LogAPIError(ctx, "set_payout_schedule", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to update payout schedule", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "set_payout_schedule", uid, true, "Interval: "+req.Interval)
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{"payout_schedule": schedule}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save payout schedule"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"schedule": schedule})
+}
+
+// ListPayouts returns the caller's payouts, newest first
+func ListPayouts(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	docs, err := fs.Collection("payouts").Where("user_id", "==", uid).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load payouts"})
+		return
+	}
+	payouts := make([]AccountPayout, 0, len(docs))
+	for _, doc := range docs {
+		var p AccountPayout
+		if err := doc.DataTo(&p); err != nil {
+			continue
+		}
+		p.ID = doc.Ref.ID
+		payouts = append(payouts, p)
+	}
+	sort.Slice(payouts, func(i, j int) bool { return payouts[i].CreatedAt.After(payouts[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"payouts": payouts})
+}
+
+// CreateManualPayout pays out a recipient on the manual schedule from their
+// connected account's available balance to their bank account
+func CreateManualPayout(c *gin.Context) {
+	var req struct {
+		Amount int64  `json:"amount" binding:"required,min=100"`
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	uid := c.Param("uid")
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	accountID := stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id"))
+	if accountID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has no connected account"})
+		return
+	}
+	if storedPayoutSchedule(doc).Interval != PayoutIntervalManual {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is paid out automatically; switch it to manual payouts first"})
+		return
+	}
+	available, err := sc.AvailableBalance(ctx, accountID, payoutCurrency)
+	if err != nil {
+		sc.LogAPIError(ctx, "manual_payout_balance", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to load account balance", err))
+		return
+	}
+	if req.Amount > available {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Only %s is available to pay out", currencyOrDefault(payoutCurrency).Format(available)), "available": available})
+		return
+	}
+
+	now := time.Now()
+	ref := fs.Collection("payouts").NewDoc()
+	p := &AccountPayout{
+		ID:          ref.ID,
+		UserID:      uid,
+		AccountID:   accountID,
+		Amount:      req.Amount,
+		NetAmount:   req.Amount,
+		Currency:    payoutCurrency,
+		Method:      PayoutMethodStandard,
+		Trigger:     PayoutTriggerAdmin,
+		InitiatedBy: adminID,
+		Status:      PayoutPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := ref.Set(ctx, p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payout"})
+		return
+	}
+	po, err := sc.CreateStandardPayout(ctx, accountID, p.Amount, p.Currency, map[string]string{"user_id": uid, "payout_id": p.ID}, "payout_"+p.ID)
+	if err != nil {
+		sc.LogAPIError(ctx, "manual_payout", uid, err)
+		if _, serr := ref.Update(ctx, []firestore.Update{
+			{Path: "status", Value: PayoutFailed},
+			{Path: "failure_message", Value: err.Error()},
+			{Path: "updated_at", Value: time.Now()},
+		}); serr != nil {
+			slog.ErrorContext(ctx, "failed to record payout failure", "component", "payouts", "payout_id", p.ID, "error", serr)
+		}
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Payout failed", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "manual_payout", uid, true, fmt.Sprintf("Payout: %s", po.ID))
+	p.StripePayoutID = po.ID
+	if po.ArrivalDate > 0 {
+		p.ArrivalAt = time.Unix(po.ArrivalDate, 0)
+	}
+	p.UpdatedAt = time.Now()
+	if _, err := ref.Set(ctx, p); err != nil {
+		slog.ErrorContext(ctx, "failed to record payout", "component", "payouts", "payout_id", p.ID, "error", err)
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "user", SubjectID: uid}); err != nil {
+		slog.ErrorContext(ctx, "failed to log payout access", "component", "payouts", "user_id", uid, "error", err)
+	}
+	slog.InfoContext(ctx, "manual payout sent", "component", "payouts", "user_id", uid, "payout_id", p.ID, "amount", p.Amount, "admin_id", adminID, "reason", req.Reason)
+	c.JSON(http.StatusCreated, p)
+}
+
+// connectAccountUser finds the user a connected account belongs to
+func connectAccountUser(ctx context.Context, fs *firestore.Client, accountID string) (string, error) {
+	docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+		return users.Where(providerUserField(ProcessorStripe, "account_id"), "==", accountID).Limit(1)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(docs) == 0 {
+		return "", nil
+	}
+	return docs[0].Ref.ID, nil
+}
+
+// recordPayoutOutcome applies a connected account's payout.paid,
+// payout.failed, or payout.canceled event. Payouts we made carry their
+// payout_id; a failed instant payout's fee is returned to the account.
+// Others came from the account's automatic schedule and are recorded here.
+func recordPayoutOutcome(ctx context.Context, d *webhookDeps, accountID string, po *stripe.Payout) error {
+	if d.fs == nil {
+		return nil
+	}
+	if po.Metadata["payout_id"] == "" {
+		return recordScheduledPayout(ctx, d, accountID, po)
+	}
+	ref := d.fs.Collection("payouts").Doc(po.Metadata["payout_id"])
+	doc, err := getDocument(ctx, ref)
+	if err != nil {
+		return nil
+	}
+	var p AccountPayout
+	if err := doc.DataTo(&p); err != nil {
+		return err
+	}
+	p.ID = doc.Ref.ID
+	if p.Status != PayoutPending {
+		return nil
+	}
+
+	destination := "your bank account"
+	paidType, failedType := NotificationPayoutPaid, NotificationPayoutFailed
+	if p.Method == PayoutMethodInstant {
+		destination = "your card ending " + p.CardLast4
+		paidType, failedType = NotificationInstantPayoutPaid, NotificationInstantPayoutFailed
+	}
+	updates := []firestore.Update{{Path: "updated_at", Value: time.Now()}}
+	switch po.Status {
+	case stripe.PayoutStatusPaid:
+		p.Status = PayoutPaid
+		NotifyUser(ctx, d.fs, p.UserID, paidType, "Payout sent",
+			fmt.Sprintf("%s was sent to %s", currencyOrDefault(p.Currency).Format(p.NetAmount), destination),
+			map[string]interface{}{"payout_id": p.ID})
+	case stripe.PayoutStatusFailed, stripe.PayoutStatusCanceled:
+		p.Status = PayoutFailed
+		if po.Status == stripe.PayoutStatusCanceled {
+			p.Status = PayoutCanceled
+		}
+		updates = append(updates,
+			firestore.Update{Path: "failure_code", Value: string(po.FailureCode)},
+			firestore.Update{Path: "failure_message", Value: po.FailureMessage})
+		if p.FeeStatus == PayoutFeeCollected {
+			tr, err := d.sc.ProcessTransferWithIdempotency(ctx, p.Fee, p.Currency, p.AccountID, "", "instant_payout_fee_refund_"+p.ID)
+			if err != nil {
+				d.sc.LogAPIError(ctx, "instant_payout_fee_refund", p.UserID, err)
+				return fmt.Errorf("fee refund for payout %s: %w", p.ID, err)
+			}
+			d.postLedger(ctx, p.UserID, InstantPayoutFeeRefundLedgerTransaction(tr.ID, p.Fee, p.Currency))
+			updates = append(updates, firestore.Update{Path: "fee_status", Value: PayoutFeeRefunded})
+		}
+		NotifyUser(ctx, d.fs, p.UserID, failedType, "Payout failed",
+			fmt.Sprintf("Your %s payout to %s didn't go through, so the funds are back in your balance", currencyOrDefault(p.Currency).Format(p.NetAmount), destination),
+			map[string]interface{}{"payout_id": p.ID, "failure_code": string(po.FailureCode)})
+	default:
+		return nil
+	}
+	updates = append(updates, firestore.Update{Path: "status", Value: p.Status})
+	if _, err := ref.Update(ctx, updates); err != nil {
+		return fmt.Errorf("failed to update payout %s: %w", p.ID, err)
+	}
+	return nil
+}
+
+// recordScheduledPayout records an automatic payout at payouts/{stripe ID}.
+// Recipients are only told about the ones that fail.
+func recordScheduledPayout(ctx context.Context, d *webhookDeps, accountID string, po *stripe.Payout) error {
+	if accountID == "" {
+		return nil
+	}
+	uid, err := connectAccountUser(ctx, d.fs, accountID)
+	if err != nil {
+		return fmt.Errorf("failed to find user for account %s: %w", accountID, err)
+	}
+	if uid == "" {
+		return nil
+	}
+	var status string
+	switch po.Status {
+	case stripe.PayoutStatusPaid:
+		status = PayoutPaid
+	case stripe.PayoutStatusFailed:
+		status = PayoutFailed
+	case stripe.PayoutStatusCanceled:
+		status = PayoutCanceled
+	default:
+		return nil
+	}
+	ref := d.fs.Collection("payouts").Doc(po.ID)
+	if doc, err := getDocument(ctx, ref); err == nil && stringField(doc.Data(), "status") == status {
+		return nil
+	}
+	p := &AccountPayout{
+		UserID:         uid,
+		AccountID:      accountID,
+		Amount:         po.Amount,
+		NetAmount:      po.Amount,
+		Currency:       string(po.Currency),
+		Method:         string(po.Method),
+		Trigger:        PayoutTriggerSchedule,
+		Status:         status,
+		StripePayoutID: po.ID,
+		FailureCode:    string(po.FailureCode),
+		FailureMessage: po.FailureMessage,
+		CreatedAt:      time.Unix(po.Created, 0),
+		UpdatedAt:      time.Now(),
+	}
+	if po.ArrivalDate > 0 {
+		p.ArrivalAt = time.Unix(po.ArrivalDate, 0)
+	}
+	if _, err := ref.Set(ctx, p); err != nil {
+		return fmt.Errorf("failed to record payout %s: %w", po.ID, err)
+	}
+	if status != PayoutPaid {
+		NotifyUser(ctx, d.fs, uid, NotificationPayoutFailed, "Payout failed",
+			fmt.Sprintf("Your %s payout to your bank account didn't go through, so the funds are back in your balance", currencyOrDefault(p.Currency).Format(p.Amount)),
+			map[string]interface{}{"payout_id": po.ID, "failure_code": string(po.FailureCode)})
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// PlaidItem is a linked bank item, stored under users/{uid}.{provider}_items.{item_id},
+// i.e. plaid_items for Plaid.
+// The access token is encrypted with EncryptString and never returned to clients.
+type PlaidItem struct {
+	ItemID               string    `json:"item_id" firestore:"item_id"`
+	AccessTokenEncrypted string    `json:"-" firestore:"access_token_encrypted"`
+	LinkedAt             time.Time `json:"linked_at" firestore:"linked_at"`
+	// Status, ErrorCode, and the update times are kept by HandlePlaidWebhook
+	Status                string     `json:"status,omitempty" firestore:"status,omitempty"`
+	ErrorCode             string     `json:"error_code,omitempty" firestore:"error_code,omitempty"`
+	StatusUpdatedAt       *time.Time `json:"status_updated_at,omitempty" firestore:"status_updated_at,omitempty"`
+	TransactionsUpdatedAt *time.Time `json:"transactions_updated_at,omitempty" firestore:"transactions_updated_at,omitempty"`
+}
+
+// CreatePlaidLinkToken returns a Link token the app uses to open the bank link
+// provider's flow, Plaid Link by default
+func CreatePlaidLinkToken(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	bp, ok := bankLinkProviderFor(c)
+	if !ok {
+		return
+	}
+
+	linkToken, err := bp.CreateLinkToken(c.Request.Context(), uid)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create link token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"link_token": linkToken})
+}
+
+// ExchangePlaidPublicToken completes the Link flow: it exchanges the public token
+// for an access token and stores it, encrypted, with the item ID on the user.
+func ExchangePlaidPublicToken(c *gin.Context) {
+	var req struct {
+		PublicToken string `json:"public_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	bp, ok := bankLinkProviderFor(c)
+	if !ok {
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	accessToken, itemID, err := bp.ExchangePublicToken(ctx, req.PublicToken)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to exchange public token"})
+		return
+	}
+	encrypted, err := EncryptString(accessToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to secure access token"})
+		return
+	}
+
+	item := PlaidItem{ItemID: itemID, AccessTokenEncrypted: encrypted, LinkedAt: time.Now()}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		providerUserField(bp.Name(), "items"): map[string]interface{}{itemID: map[string]interface{}{
+			"item_id":                item.ItemID,
+			"access_token_encrypted": item.AccessTokenEncrypted,
+			"linked_at":              item.LinkedAt,
+			"status":                 PlaidItemActive,
+			"error_code":             firestore.Delete,
+		}},
+	}); errors.Is(err, ErrProcessorRestricted) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This feature is not available in your region", "code": "processor_restricted"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save linked account"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item_id": itemID, "linked_at": item.LinkedAt})
+}
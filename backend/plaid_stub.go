@@ -2,7 +2,11 @@ package main
 
 import (
     "context"
+    "crypto/ecdsa"
     "fmt"
+    "log"
+    "net/http"
+    "time"
 )
 
 type PlaidClient struct{}
@@ -18,9 +22,131 @@ type PlaidAccount struct {
 }
 
 func (pc *PlaidClient) GetAccounts(ctx context.Context, accessToken string) ([]PlaidAccount, error) {
+    _, span := tracer.Start(ctx, "plaid.GetAccounts")
+    defer span.End()
     return nil, fmt.Errorf("not supported")
 }
 
 func (pc *PlaidClient) GetAuthData(ctx context.Context, accessToken string) ([]PlaidAccount, error) {
+    _, span := tracer.Start(ctx, "plaid.GetAuthData")
+    defer span.End()
     return nil, fmt.Errorf("not supported")
-}
\ No newline at end of file
+}
+func (pc *PlaidClient) CreateLinkToken(ctx context.Context, userID string) (string, error) {
+    _, span := tracer.Start(ctx, "plaid.CreateLinkToken")
+    defer span.End()
+    return "", fmt.Errorf("not supported")
+}
+
+func (pc *PlaidClient) ExchangePublicToken(ctx context.Context, publicToken string) (accessToken, itemID string, err error) {
+    _, span := tracer.Start(ctx, "plaid.ExchangePublicToken")
+    defer span.End()
+    return "", "", fmt.Errorf("not supported")
+}
+
+func (pc *PlaidClient) CreateStripeProcessorToken(ctx context.Context, accessToken, accountID string) (string, error) {
+    _, span := tracer.Start(ctx, "plaid.CreateStripeProcessorToken")
+    defer span.End()
+    return "", fmt.Errorf("not supported")
+}
+
+func (pc *PlaidClient) TestConnection(ctx context.Context) error {
+    _, span := tracer.Start(ctx, "plaid.TestConnection")
+    defer span.End()
+    return fmt.Errorf("not supported")
+}
+
+// GetWebhookVerificationKey returns the public key Plaid signed a webhook with
+func (pc *PlaidClient) GetWebhookVerificationKey(ctx context.Context, keyID string) (*ecdsa.PublicKey, error) {
+    _, span := tracer.Start(ctx, "plaid.GetWebhookVerificationKey")
+    defer span.End()
+    return nil, fmt.Errorf("not supported")
+}
+
+// PlaidBalance is an account's balances in minor units. Available is nil when
+// the institution doesn't report one.
+type PlaidBalance struct {
+    AccountID string
+    Available *int64
+    Current   int64
+    Currency  string
+}
+
+// GetBalances fetches real-time balances for accounts on an item
+func (pc *PlaidClient) GetBalances(ctx context.Context, accessToken string, accountIDs []string) ([]PlaidBalance, error) {
+    _, span := tracer.Start(ctx, "plaid.GetBalances")
+    defer span.End()
+    return nil, fmt.Errorf("not supported")
+}
+
+// PlaidAccountBalance is an account with the balance Plaid last refreshed,
+// which /accounts/get returns without the cost of a real-time balance call
+type PlaidAccountBalance struct {
+    PlaidAccount
+    Balance PlaidBalance
+}
+
+// GetAccountBalances lists an item's accounts with their cached balances
+func (pc *PlaidClient) GetAccountBalances(ctx context.Context, accessToken string) ([]PlaidAccountBalance, error) {
+    _, span := tracer.Start(ctx, "plaid.GetAccountBalances")
+    defer span.End()
+    return nil, fmt.Errorf("not supported")
+}
+
+// PlaidTransaction is a posted or pending bank transaction. Amount is in minor
+// units and, as Plaid reports it, positive for money leaving the account.
+type PlaidTransaction struct {
+    TransactionID string
+    AccountID     string
+    Amount        int64
+    Currency      string
+    Date          time.Time
+    Name          string
+    MerchantName  string
+    // Category is Plaid's personal finance category, e.g. FOOD_AND_DRINK
+    Category string
+    Pending  bool
+}
+
+// GetTransactions fetches an item's transactions dated from start to end,
+// following Plaid's pagination
+func (pc *PlaidClient) GetTransactions(ctx context.Context, accessToken string, start, end time.Time) ([]PlaidTransaction, error) {
+    _, span := tracer.Start(ctx, "plaid.GetTransactions")
+    defer span.End()
+    return nil, fmt.Errorf("not supported")
+}
+
+// PlaidSignalScores is Plaid Signal's assessment of an ACH debit: each score
+// runs from 1 to 99, higher meaning the debit is more likely to be returned
+type PlaidSignalScores struct {
+    // CustomerInitiatedReturnRisk covers returns the account holder asks
+    // for, e.g. R10 unauthorized
+    CustomerInitiatedReturnRisk int
+    // BankInitiatedReturnRisk covers returns the bank makes, e.g. R01
+    // insufficient funds
+    BankInitiatedReturnRisk int
+}
+
+// EvaluateSignal scores an ACH debit of amount from an account before it is
+// made. clientTransactionID identifies the debit to Plaid.
+func (pc *PlaidClient) EvaluateSignal(ctx context.Context, accessToken, accountID, clientTransactionID string, amount int64) (*PlaidSignalScores, error) {
+    _, span := tracer.Start(ctx, "plaid.EvaluateSignal")
+    defer span.End()
+    return nil, fmt.Errorf("not supported")
+}
+
+// plaidHTTPClient is the HTTP client for Plaid API calls, with the per-call
+// deadline applied while serving a request; main builds it once the
+// environment is loaded
+var plaidHTTPClient *http.Client
+
+// newPlaidHTTPClient sends Plaid calls through its egress settings; invalid
+// settings fail every call rather than bypass them
+func newPlaidHTTPClient() *http.Client {
+    base, err := providerTransport(DependencyPlaid)
+    if err != nil {
+        log.Printf("Plaid egress misconfigured: %v", err)
+        base = failedTransport{err: fmt.Errorf("plaid egress: %w", err)}
+    }
+    return &http.Client{Transport: &deadlineTransport{dependency: DependencyPlaid, base: tracedTransport("plaid", base)}}
+}
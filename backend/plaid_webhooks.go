@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Linked item statuses kept on users/{uid}.plaid_items.{item_id}.status
+const (
+	PlaidItemActive        = "active"
+	PlaidItemLoginRequired = "login_required"
+	PlaidItemError         = "error"
+	PlaidItemRevoked       = "revoked"
+)
+
+// plaidWebhookMaxAge is how old a webhook's signature may be before it is
+// treated as a replay
+const plaidWebhookMaxAge = 5 * time.Minute
+
+// PlaidWebhook is the body Plaid posts for item and transactions events
+type PlaidWebhook struct {
+	WebhookType         string   `json:"webhook_type"`
+	WebhookCode         string   `json:"webhook_code"`
+	ItemID              string   `json:"item_id"`
+	NewTransactions     int      `json:"new_transactions,omitempty"`
+	RemovedTransactions []string `json:"removed_transactions,omitempty"`
+	Error               *struct {
+		ErrorType    string `json:"error_type"`
+		ErrorCode    string `json:"error_code"`
+		ErrorMessage string `json:"error_message"`
+	} `json:"error,omitempty"`
+}
+
+// plaidVerificationClaims are the claims of the Plaid-Verification JWT
+type plaidVerificationClaims struct {
+	RequestBodySHA256 string `json:"request_body_sha256"`
+	jwt.RegisteredClaims
+}
+
+// plaidWebhookKeys caches verification keys by key ID; Plaid rotates keys
+// rarely and a key ID always names the same key
+var plaidWebhookKeys sync.Map
+
+// verifyPlaidWebhook checks the Plaid-Verification JWT: an ES256 signature
+// by one of Plaid's keys, issued in the last five minutes, over this body
+func verifyPlaidWebhook(ctx context.Context, pc *PlaidClient, payload []byte, token string) error {
+	claims := &plaidVerificationClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, fmt.Errorf("missing key ID")
+		}
+		if key, ok := plaidWebhookKeys.Load(kid); ok {
+			return key.(*ecdsa.PublicKey), nil
+		}
+		key, err := pc.GetWebhookVerificationKey(ctx, kid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get verification key: %w", err)
+		}
+		plaidWebhookKeys.Store(kid, key)
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}), jwt.WithIssuedAt())
+	if err != nil {
+		return err
+	}
+	if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > plaidWebhookMaxAge {
+		return fmt.Errorf("webhook signature is too old")
+	}
+	sum := sha256.Sum256(payload)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(claims.RequestBodySHA256)) != 1 {
+		return fmt.Errorf("webhook body does not match its signature")
+	}
+	return nil
+}
+
+// HandlePlaidWebhook keeps linked items' status in step with Plaid: items
+// needing the user to log in again are flagged for re-link and the user is
+// told, errors are recorded, and transactions updates are timestamped so the
+// app knows to refresh. Like the Stripe webhook, failures return non-2xx so
+// Plaid retries.
+func HandlePlaidWebhook(c *gin.Context) {
+	plaidClient, exists := c.Get("plaidClient")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Plaid client not available"})
+		return
+	}
+	pc := plaidClient.(*PlaidClient)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	ctx := c.Request.Context()
+	if err := verifyPlaidWebhook(ctx, pc, payload, c.GetHeader("Plaid-Verification")); err != nil {
+		slog.WarnContext(ctx, "plaid webhook validation failed", "component", "plaid", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+		return
+	}
+
+	var hook PlaidWebhook
+	if err := json.Unmarshal(payload, &hook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook payload"})
+		return
+	}
+	if hook.ItemID == "" {
+		c.JSON(http.StatusOK, gin.H{"received": true})
+		return
+	}
+
+	if err := processPlaidWebhook(ctx, fs, &hook); err != nil {
+		slog.ErrorContext(ctx, "failed to process plaid webhook", "component", "plaid", "webhook_type", hook.WebhookType, "webhook_code", hook.WebhookCode, "item_id", hook.ItemID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process webhook"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// userIDForPlaidItem resolves the user who linked an item
+func userIDForPlaidItem(ctx context.Context, fs *firestore.Client, itemID string) (string, error) {
+	field := providerUserField(ProcessorPlaid, "items")
+	docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+		return users.WherePath(firestore.FieldPath{field, itemID, "item_id"}, "==", itemID).Limit(1)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(docs) == 0 {
+		return "", fmt.Errorf("no user for plaid item %s", itemID)
+	}
+	return docs[0].Ref.ID, nil
+}
+
+// processPlaidWebhook applies one webhook to the item it names
+func processPlaidWebhook(ctx context.Context, fs *firestore.Client, hook *PlaidWebhook) error {
+	now := time.Now()
+	item := map[string]interface{}{}
+	notify := ""
+
+	switch hook.WebhookType {
+	case "ITEM":
+		switch hook.WebhookCode {
+		case "ERROR":
+			item["status"] = PlaidItemError
+			if hook.Error != nil {
+				item["error_code"] = hook.Error.ErrorCode
+				if hook.Error.ErrorCode == "ITEM_LOGIN_REQUIRED" {
+					item["status"] = PlaidItemLoginRequired
+				}
+			}
+		case "ITEM_LOGIN_REQUIRED", "PENDING_EXPIRATION", "PENDING_DISCONNECT":
+			item["status"] = PlaidItemLoginRequired
+			item["error_code"] = hook.WebhookCode
+		case "USER_PERMISSION_REVOKED", "USER_ACCOUNT_REVOKED":
+			item["status"] = PlaidItemRevoked
+			item["error_code"] = hook.WebhookCode
+		case "LOGIN_REPAIRED":
+			item["status"] = PlaidItemActive
+			item["error_code"] = firestore.Delete
+		default:
+			return nil
+		}
+		item["status_updated_at"] = now
+		switch item["status"] {
+		case PlaidItemLoginRequired:
+			notify = "Your bank connection needs you to log in again before it can be used for payments."
+		case PlaidItemRevoked:
+			notify = "Your bank connection was removed at your bank. Link it again to keep using it for payments."
+		case PlaidItemError:
+			notify = "We couldn't reach your bank. Reconnect it if payments from it keep failing."
+		}
+
+	case "TRANSACTIONS":
+		switch hook.WebhookCode {
+		case "SYNC_UPDATES_AVAILABLE", "INITIAL_UPDATE", "HISTORICAL_UPDATE", "DEFAULT_UPDATE", "TRANSACTIONS_REMOVED":
+			item["transactions_updated_at"] = now
+		default:
+			return nil
+		}
+
+	default:
+		return nil
+	}
+
+	uid, err := userIDForPlaidItem(ctx, fs, hook.ItemID)
+	if err != nil {
+		// Unlinked since, or linked in another region's deployment
+		slog.WarnContext(ctx, "unmatched plaid webhook", "component", "plaid", "item_id", hook.ItemID, "error", err)
+		return nil
+	}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		providerUserField(ProcessorPlaid, "items"): map[string]interface{}{hook.ItemID: item},
+	}); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "plaid item updated", "component", "plaid", "user_id", uid, "item_id", hook.ItemID, "webhook_type", hook.WebhookType, "webhook_code", hook.WebhookCode)
+
+	if notify != "" {
+		NotifyUser(ctx, fs, uid, NotificationBankRelinkRequired, "Reconnect your bank", notify,
+			map[string]interface{}{"item_id": hook.ItemID, "status": item["status"]})
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Payment is a charge against a sender's funding source. Its shape is
+// Stripe's PaymentIntent, which other payment providers map onto.
+type Payment = StripePaymentIntent
+
+// Payout moves collected funds on to a recipient's account
+type Payout = StripeTransfer
+
+// BankAccount is an account reached through a bank link
+type BankAccount = PlaidAccount
+
+// Provider kinds a route or user can choose between
+const (
+	ProviderKindPayment  = "payment"
+	ProviderKindBankLink = "bank_link"
+	ProviderKindWallet   = "wallet"
+)
+
+// PaymentParams describes a charge to create
+type PaymentParams struct {
+	Amount          int64
+	Currency        string
+	CustomerID      string
+	PaymentMethodID string
+	Metadata        map[string]string
+	IdempotencyKey  string
+	// SCA is the card authentication policy; providers without cards ignore it
+	SCA SCAPolicy
+	// PaymentMethodTypes limits what the payment may be confirmed with, e.g.
+	// card or us_bank_account; empty leaves the provider's default
+	PaymentMethodTypes []string
+	// ACHAuthorization is the sender's authorization for a bank debit, sent
+	// as its mandate and linked from its metadata; nil for other payments
+	ACHAuthorization *ACHAuthorization
+	// CaptureManual only authorizes the payment, leaving the funds to be
+	// captured or released later; cards only
+	CaptureManual bool
+}
+
+// providerLogger records provider calls in the API audit log
+type providerLogger interface {
+	LogAPIInteraction(ctx context.Context, operation, userID string, success bool, details string)
+	LogAPIError(ctx context.Context, operation, userID string, err error)
+}
+
+// PaymentProvider charges senders and pays the funds out to recipients. A
+// user's customer and payout account IDs are kept on their user document as
+// {name}_customer_id and {name}_account_id. Stripe-only features such as
+// Connect onboarding, setup intents, and disputes stay on StripeClient.
+type PaymentProvider interface {
+	providerLogger
+	Name() string
+	CreatePayment(ctx context.Context, p PaymentParams) (*Payment, error)
+	GetPayment(ctx context.Context, paymentID string) (*Payment, error)
+	// ConfirmPayment confirms a payment; auth is the customer's ACH
+	// authorization when it debits a bank account
+	ConfirmPayment(ctx context.Context, paymentID string, auth *ACHAuthorization) (*Payment, error)
+	// Payout sends funds to destination; group ties it to the payment it pays out
+	Payout(ctx context.Context, amount int64, currency, destination, group, idempotencyKey string) (*Payout, error)
+}
+
+// BankLinkProvider links a user's bank account. Linked items are kept on the
+// user document under {name}_items.
+type BankLinkProvider interface {
+	Name() string
+	CreateLinkToken(ctx context.Context, userID string) (string, error)
+	ExchangePublicToken(ctx context.Context, publicToken string) (accessToken, itemID string, err error)
+	GetAccounts(ctx context.Context, accessToken string) ([]BankAccount, error)
+}
+
+// WalletProvider moves stored-value funds between users' wallets. A user's
+// wallet handle is kept on their user document as {name}_user_handle.
+type WalletProvider interface {
+	Name() string
+	SendWalletFunds(ctx context.Context, fromHandle, toHandle string, amount int64, descriptor string) (string, error)
+}
+
+// Providers holds the configured provider of each kind and the default one
+// used when neither the route nor the user picks another
+type Providers struct {
+	payments  map[string]PaymentProvider
+	bankLinks map[string]BankLinkProvider
+	wallets   map[string]WalletProvider
+	defaults  map[string]string
+}
+
+// NewProviders returns an empty registry; PAYMENT_PROVIDER, BANK_LINK_PROVIDER,
+// and WALLET_PROVIDER name the defaults, otherwise the first added of a kind is
+func NewProviders() *Providers {
+	p := &Providers{
+		payments:  map[string]PaymentProvider{},
+		bankLinks: map[string]BankLinkProvider{},
+		wallets:   map[string]WalletProvider{},
+		defaults:  map[string]string{},
+	}
+	for kind, env := range map[string]string{
+		ProviderKindPayment:  "PAYMENT_PROVIDER",
+		ProviderKindBankLink: "BANK_LINK_PROVIDER",
+		ProviderKindWallet:   "WALLET_PROVIDER",
+	} {
+		if name := os.Getenv(env); name != "" {
+			p.defaults[kind] = name
+		}
+	}
+	return p
+}
+
+func (p *Providers) setDefault(kind, name string) {
+	if p.defaults[kind] == "" {
+		p.defaults[kind] = name
+	}
+}
+
+// AddPayment registers a payment provider
+func (p *Providers) AddPayment(pp PaymentProvider) {
+	p.payments[pp.Name()] = pp
+	p.setDefault(ProviderKindPayment, pp.Name())
+}
+
+// AddBankLink registers a bank link provider
+func (p *Providers) AddBankLink(bp BankLinkProvider) {
+	p.bankLinks[bp.Name()] = bp
+	p.setDefault(ProviderKindBankLink, bp.Name())
+}
+
+// AddWallet registers a wallet provider
+func (p *Providers) AddWallet(wp WalletProvider) {
+	p.wallets[wp.Name()] = wp
+	p.setDefault(ProviderKindWallet, wp.Name())
+}
+
+// UseProvider pins the routes it guards to the named provider of a kind
+func UseProvider(kind, name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("provider."+kind, name)
+		c.Next()
+	}
+}
+
+// providerName picks the provider of a kind for a request: the route's pin,
+// then the user's choice at users/{uid}.providers.{kind} if their region
+// allows it, then the default. The user document is only read when there is
+// more than one provider to choose from.
+func providerName(c *gin.Context, kind string, registered int, defaultName string) string {
+	if name := c.GetString("provider." + kind); name != "" {
+		return name
+	}
+	uid := c.GetString("userID")
+	v, ok := c.Get("firestore")
+	if registered < 2 || uid == "" || !ok {
+		return defaultName
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return defaultName
+	}
+	choices, _ := doc.Data()["providers"].(map[string]interface{})
+	name, _ := choices[kind].(string)
+	if name == "" || CheckProcessorAllowed(ctx, fs, uid, name) != nil {
+		return defaultName
+	}
+	return name
+}
+
+// lookupProvider finds the provider of a kind serving this request
+func lookupProvider[T any](c *gin.Context, kind string, registered func(*Providers) map[string]T) (T, error) {
+	var zero T
+	v, ok := c.Get("providers")
+	if !ok {
+		return zero, fmt.Errorf("no %s providers configured", kind)
+	}
+	p := v.(*Providers)
+	byName := registered(p)
+	name := providerName(c, kind, len(byName), p.defaults[kind])
+	provider, ok := byName[name]
+	if !ok {
+		return zero, fmt.Errorf("%s provider %q is not configured", kind, name)
+	}
+	return provider, nil
+}
+
+// paymentProviderFor returns the payment provider for the request, writing a
+// 500 and returning false if there is none
+func paymentProviderFor(c *gin.Context) (PaymentProvider, bool) {
+	pp, err := lookupProvider(c, ProviderKindPayment, func(p *Providers) map[string]PaymentProvider { return p.payments })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment provider not available"})
+		return nil, false
+	}
+	return pp, true
+}
+
+// bankLinkProviderFor returns the bank link provider for the request, writing
+// a 500 and returning false if there is none
+func bankLinkProviderFor(c *gin.Context) (BankLinkProvider, bool) {
+	bp, err := lookupProvider(c, ProviderKindBankLink, func(p *Providers) map[string]BankLinkProvider { return p.bankLinks })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Bank linking not available"})
+		return nil, false
+	}
+	return bp, true
+}
+
+// walletProviderFor returns the wallet provider for the request, writing a
+// 503 and returning false if there is none
+func walletProviderFor(c *gin.Context) (WalletProvider, bool) {
+	wp, err := lookupProvider(c, ProviderKindWallet, func(p *Providers) map[string]WalletProvider { return p.wallets })
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Wallet transfers are not available"})
+		return nil, false
+	}
+	return wp, true
+}
+
+// providerUserField names the user document field holding a provider's ID
+// for the user, e.g. stripe_customer_id or sila_user_handle
+func providerUserField(provider, suffix string) string {
+	return provider + "_" + suffix
+}
+
+// Name identifies Stripe as a payment provider
+func (sc *StripeClient) Name() string { return ProcessorStripe }
+
+// CreatePayment creates a Stripe PaymentIntent
+func (sc *StripeClient) CreatePayment(ctx context.Context, p PaymentParams) (*Payment, error) {
+	return sc.CreatePaymentIntentWithIdempotency(ctx, p)
+}
+
+// GetPayment retrieves a Stripe PaymentIntent
+func (sc *StripeClient) GetPayment(ctx context.Context, paymentID string) (*Payment, error) {
+	return sc.GetPaymentIntent(ctx, paymentID)
+}
+
+// ConfirmPayment confirms a Stripe PaymentIntent
+func (sc *StripeClient) ConfirmPayment(ctx context.Context, paymentID string, auth *ACHAuthorization) (*Payment, error) {
+	return sc.ConfirmPaymentIntent(ctx, paymentID, auth)
+}
+
+// Payout creates a Connect transfer
+func (sc *StripeClient) Payout(ctx context.Context, amount int64, currency, destination, group, idempotencyKey string) (*Payout, error) {
+	return sc.ProcessTransferWithIdempotency(ctx, amount, currency, destination, group, idempotencyKey)
+}
+
+// Name identifies Plaid as a bank link provider
+func (pc *PlaidClient) Name() string { return ProcessorPlaid }
+
+// Name identifies Sila as a wallet provider
+func (sc *SilaClient) Name() string { return ProcessorSila }
+
+// SendWalletFunds moves funds between two Stripe-backed wallets. Both are held
+// in the platform's Stripe balance, so nothing moves at Stripe; the returned
+// reference keys the wallet entries and their ledger transaction.
+func (sc *StripeClient) SendWalletFunds(ctx context.Context, fromHandle, toHandle string, amount int64, descriptor string) (string, error) {
+	return "wallet_transfer_" + uuid.NewString(), nil
+}
+
+// SendWalletFunds transfers between two Sila wallets; Sila amounts are in cents
+func (sc *SilaClient) SendWalletFunds(ctx context.Context, fromHandle, toHandle string, amount int64, descriptor string) (string, error) {
+	return sc.TransferSila(ctx, fromHandle, toHandle, float64(amount), descriptor)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Refund request statuses
+const (
+	RefundRequestPending  = "pending"
+	RefundRequestApproved = "approved" // refund in flight
+	RefundRequestRefunded = "refunded"
+	RefundRequestDeclined = "declined"
+)
+
+const (
+	NotificationRefundRequested = "refund_requested"
+	NotificationRefundDeclined  = "refund_declined"
+)
+
+// RefundPolicy is how a business handles refund requests, stored on its
+// user document under refund_policy. Requests made within WindowDays of the
+// payment for at most AutoApproveMax are refunded straight away; the rest
+// wait for the business to approve them.
+type RefundPolicy struct {
+	WindowDays     int64     `json:"window_days" firestore:"window_days"`
+	AutoApproveMax int64     `json:"auto_approve_max" firestore:"auto_approve_max"` // cents; 0 approves nothing automatically
+	UpdatedAt      time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// covers reports whether a refund of amount on a payment made at paidAt is
+// within the policy
+func (p *RefundPolicy) covers(amount int64, paidAt time.Time) bool {
+	if p == nil || p.AutoApproveMax <= 0 || amount > p.AutoApproveMax {
+		return false
+	}
+	return time.Since(paidAt) <= time.Duration(p.WindowDays)*24*time.Hour
+}
+
+// RefundRequest is a payer asking for their money back, stored at
+// refund_requests/{paymentIntentID}; a payment has at most one
+type RefundRequest struct {
+	ID              string    `json:"id" firestore:"-"`
+	SenderUserID    string    `json:"sender_user_id" firestore:"sender_user_id"`
+	RecipientUserID string    `json:"recipient_user_id" firestore:"recipient_user_id"`
+	Amount          int64     `json:"amount" firestore:"amount"`
+	Currency        string    `json:"currency" firestore:"currency"`
+	Reason          string    `json:"reason,omitempty" firestore:"reason,omitempty"`
+	Status          string    `json:"status" firestore:"status"`
+	AutoApproved    bool      `json:"auto_approved" firestore:"auto_approved"`
+	RefundID        string    `json:"refund_id,omitempty" firestore:"refund_id,omitempty"`
+	DeclineReason   string    `json:"decline_reason,omitempty" firestore:"decline_reason,omitempty"`
+	Error           string    `json:"error,omitempty" firestore:"error,omitempty"`
+	CreatedAt       time.Time `json:"created_at" firestore:"created_at"`
+	DecidedAt       time.Time `json:"decided_at,omitempty" firestore:"decided_at,omitempty"`
+}
+
+// refundPolicy loads a user's refund policy, or nil if they have none
+func refundPolicy(ctx context.Context, fs *firestore.Client, uid string) *RefundPolicy {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return nil
+	}
+	var user struct {
+		RefundPolicy *RefundPolicy `firestore:"refund_policy"`
+	}
+	if err := doc.DataTo(&user); err != nil {
+		return nil
+	}
+	return user.RefundPolicy
+}
+
+// GetRefundPolicy returns a user's refund policy, so payers can see it before
+// asking for a refund
+func GetRefundPolicy(c *gin.Context) {
+	if _, ok := c.Get("userID"); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"refund_policy": refundPolicy(c.Request.Context(), v.(*firestore.Client), c.Param("id"))})
+}
+
+// SetRefundPolicy sets the caller's refund window and auto-approve threshold.
+// Only business accounts have one.
+func SetRefundPolicy(c *gin.Context) {
+	var req struct {
+		WindowDays     int64 `json:"window_days" binding:"min=0,max=365"`
+		AutoApproveMax int64 `json:"auto_approve_max" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := catalogDeps(c)
+	if !ok {
+		return
+	}
+	policy := RefundPolicy{WindowDays: req.WindowDays, AutoApproveMax: req.AutoApproveMax, UpdatedAt: time.Now()}
+	if err := SaveUserFields(c.Request.Context(), fs, uid, map[string]interface{}{
+		"refund_policy": policy,
+		"updated_at":    policy.UpdatedAt,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save refund policy"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"refund_policy": policy})
+}
+
+// RequestRefund lets the sender of a succeeded payment ask for a refund. It is
+// refunded at once when the recipient's policy covers it; otherwise it joins
+// the recipient's approval queue and they are notified.
+func RequestRefund(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"max=500"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	piID := c.Param("id")
+
+	doc, err := getDocument(ctx, fs.Collection("transactions").Doc(piID))
+	if err != nil || stringField(doc.Data(), "sender_user_id") != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	var rec TransactionRecord
+	if err := doc.DataTo(&rec); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transaction"})
+		return
+	}
+	if why := bulkRefundIneligible(doc.Data()); why != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "This payment can't be refunded: " + why})
+		return
+	}
+
+	policy := refundPolicy(ctx, fs, rec.RecipientUserID)
+	rr := RefundRequest{
+		ID:              piID,
+		SenderUserID:    uid,
+		RecipientUserID: rec.RecipientUserID,
+		Amount:          rec.Amount,
+		Currency:        rec.Currency,
+		Reason:          req.Reason,
+		Status:          RefundRequestPending,
+		CreatedAt:       time.Now(),
+	}
+	if policy.covers(rec.Amount, rec.CreatedAt) {
+		rr.Status = RefundRequestApproved
+		rr.AutoApproved = true
+		rr.DecidedAt = rr.CreatedAt
+	}
+	if _, err := fs.Collection("refund_requests").Doc(piID).Create(ctx, rr); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "A refund has already been requested for this payment"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save refund request"})
+		return
+	}
+
+	if rr.AutoApproved {
+		executeRefundRequest(ctx, sc, fs, &rr)
+	}
+	// Queued, or auto-approved but the refund failed
+	if rr.Status == RefundRequestPending {
+		NotifyUser(ctx, fs, rr.RecipientUserID, NotificationRefundRequested, "Refund requested",
+			fmt.Sprintf("A refund of %s was requested and needs your approval", currencyOrDefault(rr.Currency).Format(rr.Amount)),
+			map[string]interface{}{"refund_request_id": rr.ID, "transaction_id": piID})
+	}
+	c.JSON(http.StatusCreated, gin.H{"refund_request": rr, "refund_policy": policy})
+}
+
+// executeRefundRequest refunds an approved request and records the outcome.
+// A failed refund goes back to pending with its error, so the business can
+// approve it again.
+func executeRefundRequest(ctx context.Context, sc *StripeClient, fs *firestore.Client, rr *RefundRequest) {
+	ref := fs.Collection("refund_requests").Doc(rr.ID)
+	refund, err := sc.RefundPaymentIntent(ctx, rr.ID,
+		map[string]string{"reason": "refund_request", "refund_request_id": rr.ID},
+		"refund_request_"+rr.ID)
+	var se *stripe.Error
+	if err != nil && !(errors.As(err, &se) && se.Code == stripe.ErrorCodeChargeAlreadyRefunded) {
+		sc.LogAPIError(ctx, "refund_request", rr.SenderUserID, err)
+		rr.Status, rr.Error = RefundRequestPending, err.Error()
+		if _, err := ref.Update(ctx, []firestore.Update{
+			{Path: "status", Value: rr.Status},
+			{Path: "error", Value: rr.Error},
+		}); err != nil {
+			slog.ErrorContext(ctx, "failed to record refund request", "component", "refund_requests", "refund_request_id", rr.ID, "error", err)
+		}
+		return
+	}
+
+	updates := []firestore.Update{
+		{Path: "status", Value: RefundRequestRefunded},
+		{Path: "error", Value: firestore.Delete},
+	}
+	rr.Status, rr.Error = RefundRequestRefunded, ""
+	if refund != nil {
+		sc.LogAPIInteraction(ctx, "refund_request", rr.SenderUserID, true, fmt.Sprintf("Refund: %s", refund.ID))
+		rr.RefundID = refund.ID
+		updates = append(updates, firestore.Update{Path: "refund_id", Value: refund.ID})
+	}
+	if _, err := ref.Update(ctx, updates); err != nil {
+		slog.ErrorContext(ctx, "failed to record refund request", "component", "refund_requests", "refund_request_id", rr.ID, "error", err)
+	}
+	if err := SaveTransaction(ctx, fs, rr.ID, map[string]interface{}{"refund_request_id": rr.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to mark refunded transaction", "component", "refund_requests", "payment_intent", rr.ID, "error", err)
+	}
+	NotifyUser(ctx, fs, rr.SenderUserID, NotificationPaymentRefunded, "Payment refunded",
+		fmt.Sprintf("Your %s payment has been refunded", currencyOrDefault(rr.Currency).Format(rr.Amount)),
+		map[string]interface{}{"transaction_id": rr.ID, "refund_request_id": rr.ID, "refund_id": rr.RefundID})
+}
+
+// ListRefundRequests returns the refund requests on payments to the caller,
+// newest first; ?status=pending is their approval queue
+func ListRefundRequests(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	q := fs.Collection("refund_requests").Where("recipient_user_id", "==", uidVal.(string))
+	if s := c.Query("status"); s != "" {
+		q = q.Where("status", "==", s)
+	}
+	docs, err := q.OrderBy("created_at", firestore.Desc).Limit(100).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load refund requests"})
+		return
+	}
+	requests := make([]RefundRequest, 0, len(docs))
+	for _, doc := range docs {
+		var rr RefundRequest
+		if err := doc.DataTo(&rr); err != nil {
+			continue
+		}
+		rr.ID = doc.Ref.ID
+		requests = append(requests, rr)
+	}
+	c.JSON(http.StatusOK, gin.H{"refund_requests": requests})
+}
+
+// claimRefundRequest moves a pending request on a payment to uid into status
+// and returns it, responding when it can't
+func claimRefundRequest(c *gin.Context, fs *firestore.Client, uid, newStatus string, fields []firestore.Update) (*RefundRequest, bool) {
+	ctx := c.Request.Context()
+	ref := fs.Collection("refund_requests").Doc(c.Param("id"))
+	var rr RefundRequest
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&rr); err != nil {
+			return err
+		}
+		rr.ID = doc.Ref.ID
+		if rr.RecipientUserID != uid {
+			return status.Error(codes.NotFound, "not the recipient")
+		}
+		if rr.Status != RefundRequestPending {
+			return status.Error(codes.FailedPrecondition, rr.Status)
+		}
+		rr.Status, rr.DecidedAt = newStatus, time.Now()
+		return tx.Update(ref, append([]firestore.Update{
+			{Path: "status", Value: rr.Status},
+			{Path: "decided_at", Value: rr.DecidedAt},
+		}, fields...))
+	})
+	switch status.Code(err) {
+	case codes.OK:
+		return &rr, true
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refund request not found"})
+	case codes.FailedPrecondition:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Refund request is %s", rr.Status)})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update refund request"})
+	}
+	return nil, false
+}
+
+// ApproveRefundRequest lets the recipient approve a queued refund request,
+// which is then refunded
+func ApproveRefundRequest(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	rr, ok := claimRefundRequest(c, fs, uid, RefundRequestApproved, nil)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	// The payment may have been refunded another way while it was queued
+	if doc, err := getDocument(ctx, fs.Collection("transactions").Doc(rr.ID)); err == nil {
+		if why := bulkRefundIneligible(doc.Data()); why != "" {
+			rr.Status = RefundRequestDeclined
+			rr.DeclineReason = why
+			_, _ = fs.Collection("refund_requests").Doc(rr.ID).Update(ctx, []firestore.Update{
+				{Path: "status", Value: rr.Status},
+				{Path: "decline_reason", Value: why},
+			})
+			c.JSON(http.StatusConflict, gin.H{"error": "This payment can't be refunded: " + why, "refund_request": rr})
+			return
+		}
+	}
+	executeRefundRequest(ctx, sc, fs, rr)
+	if rr.Status != RefundRequestRefunded {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to refund payment", "refund_request": rr})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"refund_request": rr})
+}
+
+// DeclineRefundRequest lets the recipient turn down a queued refund request;
+// the payer is notified
+func DeclineRefundRequest(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"max=500"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	var fields []firestore.Update
+	if req.Reason != "" {
+		fields = append(fields, firestore.Update{Path: "decline_reason", Value: req.Reason})
+	}
+	rr, ok := claimRefundRequest(c, fs, uidVal.(string), RefundRequestDeclined, fields)
+	if !ok {
+		return
+	}
+	rr.DeclineReason = req.Reason
+	NotifyUser(c.Request.Context(), fs, rr.SenderUserID, NotificationRefundDeclined, "Refund declined",
+		fmt.Sprintf("Your request for a %s refund was declined", currencyOrDefault(rr.Currency).Format(rr.Amount)),
+		map[string]interface{}{"refund_request_id": rr.ID, "transaction_id": rr.ID})
+	c.JSON(http.StatusOK, gin.H{"refund_request": rr})
+}
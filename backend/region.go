@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultFirestoreReadTimeout bounds one read attempt; deployments reading
+	// a database in another region should raise FIRESTORE_READ_TIMEOUT
+	defaultFirestoreReadTimeout = 5 * time.Second
+	// firestoreReadAttempts is how many times a read that timed out is tried
+	firestoreReadAttempts = 3
+)
+
+// RegionConfig describes where this deployment runs and which Firestore
+// database holds its data
+type RegionConfig struct {
+	Name              string        `json:"name"`
+	FirestoreDatabase string        `json:"firestore_database"`
+	FirestoreLocation string        `json:"firestore_location,omitempty"`
+	ReadTimeout       time.Duration `json:"-"`
+}
+
+// currentRegion is the deployment's region, loaded once at startup
+var currentRegion = loadRegionConfig()
+
+// loadRegionConfig reads DEPLOY_REGION, FIRESTORE_DATABASE_ID,
+// FIRESTORE_LOCATION, and FIRESTORE_READ_TIMEOUT
+func loadRegionConfig() RegionConfig {
+	cfg := RegionConfig{
+		Name:              os.Getenv("DEPLOY_REGION"),
+		FirestoreDatabase: os.Getenv("FIRESTORE_DATABASE_ID"),
+		FirestoreLocation: os.Getenv("FIRESTORE_LOCATION"),
+		ReadTimeout:       defaultFirestoreReadTimeout,
+	}
+	if cfg.Name == "" {
+		cfg.Name = "us"
+	}
+	if cfg.FirestoreDatabase == "" {
+		cfg.FirestoreDatabase = firestore.DefaultDatabaseID
+	}
+	if d, err := time.ParseDuration(os.Getenv("FIRESTORE_READ_TIMEOUT")); err == nil && d > 0 {
+		cfg.ReadTimeout = d
+	}
+	return cfg
+}
+
+// NewRegionalFirestoreClient connects to the database configured for this region
+func NewRegionalFirestoreClient(ctx context.Context, projectID string) (*firestore.Client, error) {
+	return firestore.NewClientWithDatabase(ctx, projectID, currentRegion.FirestoreDatabase, firestoreDeadlineOptions()...)
+}
+
+// readWithRetry runs a Firestore read with a per-attempt timeout, retrying
+// attempts that timed out or found the backend unavailable. Cross-region reads
+// are slow rather than failing, so a timeout alone is not treated as final.
+func readWithRetry(ctx context.Context, read func(context.Context) error) error {
+	var err error
+	for attempt := 1; attempt <= firestoreReadAttempts; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, currentRegion.ReadTimeout)
+		err = read(attemptCtx)
+		cancel()
+		code := status.Code(err)
+		if err == nil || (code != codes.DeadlineExceeded && code != codes.Unavailable) || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		}
+	}
+	return err
+}
+
+// getDocument reads a document with readWithRetry
+func getDocument(ctx context.Context, ref *firestore.DocumentRef) (*firestore.DocumentSnapshot, error) {
+	var snap *firestore.DocumentSnapshot
+	err := readWithRetry(ctx, func(ctx context.Context) error {
+		var err error
+		snap, err = ref.Get(ctx)
+		return err
+	})
+	return snap, err
+}
+
+// stripeObjectRegion returns the region recorded in a Stripe object's metadata, if any
+func stripeObjectRegion(object map[string]interface{}) string {
+	meta, _ := object["metadata"].(map[string]interface{})
+	region, _ := meta["region"].(string)
+	return region
+}
+
+// RegionalWebhookGuard rejects webhooks sent to another region's endpoint
+// (e.g. /webhooks/stripe/eu reaching the us deployment) so the provider
+// retries them against the right one.
+func RegionalWebhookGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if region := c.Param("region"); region != "" && region != currentRegion.Name {
+			c.AbortWithStatusJSON(http.StatusMisdirectedRequest, gin.H{"error": "Webhook is for region " + region, "region": currentRegion.Name})
+			return
+		}
+		c.Next()
+	}
+}
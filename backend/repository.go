@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+)
+
+// SaveTransaction merges fields into transactions/{id}, rejecting fields outside
+// the schema contract and stamping the version, ownership, and update fields
+// that client-side listeners and security rules rely on. A write that sets
+// created_at also records the app platform and version it came from.
+func SaveTransaction(ctx context.Context, fs *firestore.Client, id string, fields map[string]interface{}) error {
+	data, err := transactionData(ctx, fields)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.Collection("transactions").Doc(id).Set(ctx, data, firestore.MergeAll); err != nil {
+		return fmt.Errorf("failed to save transaction %s: %w", id, err)
+	}
+	return nil
+}
+
+// transactionData checks fields against the schema and adds the stamped
+// fields SaveTransaction describes, for a merge into a transaction document
+func transactionData(ctx context.Context, fields map[string]interface{}) (map[string]interface{}, error) {
+	for key := range fields {
+		if !transactionFields[key] {
+			return nil, fmt.Errorf("field %q is not part of the transaction schema", key)
+		}
+	}
+
+	data := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		data[k] = v
+	}
+	data["schema_version"] = DocumentSchemaVersion
+	data["region"] = currentRegion.Name
+	data["updated_at"] = time.Now()
+	if _, creating := fields["created_at"]; creating {
+		if client := ClientFromContext(ctx); client.known() {
+			data["client_platform"] = client.Platform
+			data["client_version"] = client.AppVersion
+		}
+	}
+
+	var participants []interface{}
+	for _, key := range []string{"sender_user_id", "recipient_user_id"} {
+		if uid, ok := fields[key].(string); ok && uid != "" {
+			participants = append(participants, uid)
+		}
+	}
+	if len(participants) > 0 {
+		data["participants"] = firestore.ArrayUnion(participants...)
+	}
+	return data, nil
+}
+
+// SaveNotification writes a notification document for its owner
+func SaveNotification(ctx context.Context, fs *firestore.Client, n *NotificationDocument) error {
+	return writeNotification(ctx, fs, n, false)
+}
+
+// CreateNotification is SaveNotification for a notification that must be
+// written once; an existing one with the same ID fails with AlreadyExists
+func CreateNotification(ctx context.Context, fs *firestore.Client, n *NotificationDocument) error {
+	return writeNotification(ctx, fs, n, true)
+}
+
+func writeNotification(ctx context.Context, fs *firestore.Client, n *NotificationDocument, create bool) error {
+	if n.UserID == "" {
+		return fmt.Errorf("notification requires a user_id")
+	}
+	if n.ID == "" {
+		n.ID = uuid.NewString()
+	}
+	now := time.Now()
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = now
+	}
+	n.UpdatedAt = now
+	n.SchemaVersion = DocumentSchemaVersion
+	n.Region = currentRegion.Name
+
+	ref := fs.Collection("notifications").Doc(n.ID)
+	if create {
+		// Not wrapped, so callers can check for AlreadyExists
+		_, err := ref.Create(ctx, n)
+		return err
+	}
+	if _, err := ref.Set(ctx, n); err != nil {
+		return fmt.Errorf("failed to save notification: %w", err)
+	}
+	return nil
+}
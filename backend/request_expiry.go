@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// PaymentRequestExpired is the status of a request that lapsed unpaid
+const PaymentRequestExpired = "expired"
+
+// Notification types for payment request reminders and expiry
+const (
+	NotificationRequestReminder = "request_reminder"
+	NotificationRequestExpired  = "request_expired"
+)
+
+// Defaults used when PAYMENT_REQUEST_TTL / PAYMENT_REQUEST_REMINDER_CADENCE are unset
+const (
+	defaultPaymentRequestTTL      = 14 * 24 * time.Hour
+	defaultRequestReminderCadence = 72 * time.Hour
+)
+
+// openRequestStatuses are the statuses a request can expire from
+var openRequestStatuses = []string{"pending", "accepted", PaymentRequestPartiallyPaid}
+
+// requestDurationSetting reads a duration from the environment, falling back to def
+func requestDurationSetting(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// parseAppTimestamp parses the ISO 8601 strings the app writes, with or without a zone
+func parseAppTimestamp(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// requestExpiry returns when a request expires: its expiresAt field, or the
+// configured TTL after it was requested.
+func requestExpiry(data map[string]interface{}) (time.Time, bool) {
+	if s, _ := data["expiresAt"].(string); s != "" {
+		return parseAppTimestamp(s)
+	}
+	requestedAt, _ := data["requestedAt"].(string)
+	t, ok := parseAppTimestamp(requestedAt)
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.Add(requestDurationSetting("PAYMENT_REQUEST_TTL", defaultPaymentRequestTTL)), true
+}
+
+// ProcessPaymentRequestExpiry sends reminders to payers of open requests on the
+// configured cadence and cancels requests that reach their expiry unpaid.
+func ProcessPaymentRequestExpiry(ctx context.Context, fs *firestore.Client) error {
+	docs, err := fs.Collection("requests").Where("status", "in", openRequestStatuses).Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to query open payment requests: %w", err)
+	}
+	cadence := requestDurationSetting("PAYMENT_REQUEST_REMINDER_CADENCE", defaultRequestReminderCadence)
+	now := time.Now()
+
+	for _, doc := range docs {
+		data := doc.Data()
+		expiresAt, ok := requestExpiry(data)
+		if !ok {
+			continue
+		}
+		requesterEmail, _ := data["senderEmail"].(string)
+		payerEmail, _ := data["receiverEmail"].(string)
+		notifyData := map[string]interface{}{"request_id": doc.Ref.ID}
+
+		if !now.Before(expiresAt) {
+			_, err := doc.Ref.Update(ctx, []firestore.Update{
+				{Path: "status", Value: PaymentRequestExpired},
+				{Path: "expiredAt", Value: now.Format(time.RFC3339)},
+			}, firestore.LastUpdateTime(doc.UpdateTime))
+			if err != nil {
+				// A concurrent payment or cancellation won; re-evaluate next run
+				continue
+			}
+			for _, email := range []string{requesterEmail, payerEmail} {
+				if uid, err := userIDForEmail(ctx, fs, email); err == nil {
+					NotifyUser(ctx, fs, uid, NotificationRequestExpired, "Payment request expired",
+						"A payment request expired before it was paid and has been canceled.", notifyData)
+				}
+			}
+			continue
+		}
+
+		// The first reminder is due one cadence after the request was made
+		last, ok := parseAppTimestamp(stringField(data, "lastReminderAt"))
+		if !ok {
+			last, _ = parseAppTimestamp(stringField(data, "requestedAt"))
+		}
+		if now.Sub(last) < cadence {
+			continue
+		}
+		if uid, err := userIDForEmail(ctx, fs, payerEmail); err == nil {
+			NotifyUser(ctx, fs, uid, NotificationRequestReminder, "Payment request reminder",
+				fmt.Sprintf("%s is waiting on your payment. This request expires %s.", requesterEmail, expiresAt.UTC().Format("Jan 2 15:04 MST")),
+				notifyData)
+		}
+		_, _ = doc.Ref.Set(ctx, map[string]interface{}{"lastReminderAt": now.Format(time.RFC3339)}, firestore.MergeAll)
+	}
+	return nil
+}
+
+// stringField returns a string field from document data, or "" when absent
+func stringField(data map[string]interface{}, key string) string {
+	s, _ := data[key].(string)
+	return s
+}
+
+// SetPaymentRequestExpiry lets the requester set or change when their request expires
+func SetPaymentRequestExpiry(c *gin.Context) {
+	var body struct {
+		ExpiresAt time.Time `json:"expires_at" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !body.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	pr, ok := loadPaymentRequest(c, fs, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(c.GetString("email"), pr.SenderEmail) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the requester can change the expiry"})
+		return
+	}
+	if !pr.isPayable() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Payment request is %s", pr.Status)})
+		return
+	}
+
+	expiresAt := body.ExpiresAt.UTC().Format(time.RFC3339)
+	if _, err := fs.Collection("requests").Doc(pr.ID).Set(c.Request.Context(), map[string]interface{}{
+		"expiresAt": expiresAt,
+	}, firestore.MergeAll); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update payment request"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"request_id": pr.ID, "expires_at": expiresAt})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// What a sender is composing
+const (
+	IntentRequest = "request"
+	IntentPayment = "payment"
+)
+
+const (
+	// requestIntentTTL is how long an intent shows without a refresh
+	requestIntentTTL = 30 * time.Second
+	// requestIntentRefresh is how often a composing client's heartbeat is
+	// written; heartbeats in between are acknowledged without a write
+	requestIntentRefresh = 10 * time.Second
+)
+
+// RequestIntent tells a recipient that a contact is composing a request or
+// payment to them, stored at request_intents/{sender}_{recipient}. The
+// recipient's app listens for these to prefetch the sender's profile and show
+// that a request is on its way. Firestore's TTL policy deletes them after
+// expires_at, but not promptly, so listeners must filter on it too.
+type RequestIntent struct {
+	SenderUserID    string    `json:"sender_user_id" firestore:"sender_user_id"`
+	RecipientUserID string    `json:"recipient_user_id" firestore:"recipient_user_id"`
+	Kind            string    `json:"kind" firestore:"kind"`
+	ExpiresAt       time.Time `json:"expires_at" firestore:"expires_at"`
+	UpdatedAt       time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+func requestIntentDoc(fs *firestore.Client, senderUID, recipientUID string) *firestore.DocumentRef {
+	return fs.Collection("request_intents").Doc(senderUID + "_" + recipientUID)
+}
+
+// SetRequestIntent records that the caller is composing a request or payment
+// to one of their contacts. The app calls it when composing starts and as a
+// heartbeat while it continues; it is cheap to call often.
+func SetRequestIntent(c *gin.Context) {
+	var req struct {
+		RecipientUserID string `json:"recipient_user_id" binding:"required"`
+		Kind            string `json:"kind"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = IntentRequest
+	}
+	if req.Kind != IntentRequest && req.Kind != IntentPayment {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be request or payment"})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	// Only contacts see intents, so they can't be used to ping strangers
+	if _, err := getDocument(ctx, UserDoc(ctx, fs, uid).Collection("contacts").Doc(req.RecipientUserID)); err != nil {
+		if status.Code(err) == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up contact"})
+		return
+	}
+
+	now := time.Now()
+	ref := requestIntentDoc(fs, uid, req.RecipientUserID)
+	if doc, err := ref.Get(ctx); err == nil {
+		var existing RequestIntent
+		if doc.DataTo(&existing) == nil && existing.Kind == req.Kind && existing.ExpiresAt.After(now.Add(requestIntentTTL-requestIntentRefresh)) {
+			c.JSON(http.StatusOK, gin.H{"intent": existing})
+			return
+		}
+	}
+	intent := RequestIntent{
+		SenderUserID:    uid,
+		RecipientUserID: req.RecipientUserID,
+		Kind:            req.Kind,
+		ExpiresAt:       now.Add(requestIntentTTL),
+		UpdatedAt:       now,
+	}
+	if _, err := ref.Set(ctx, intent); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save intent"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"intent": intent})
+}
+
+// ClearRequestIntent withdraws the caller's intent toward a recipient, once
+// the request is sent or composing is abandoned
+func ClearRequestIntent(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := requestIntentDoc(v.(*firestore.Client), uidVal.(string), c.Param("recipientID")).Delete(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear intent"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reserve statuses
+const (
+	ReserveHeld     = "held"
+	ReserveReleased = "released"
+	// ReserveApplied means the payment was refunded, returned, or otherwise
+	// reversed while held, so the reserve covered it instead of being paid out
+	ReserveApplied = "applied"
+	// ReserveFrozen is a held reserve on a reported payment, not released
+	// until the report is resolved
+	ReserveFrozen = "frozen"
+)
+
+const (
+	// reserveReleaseRetry is how long a failed release waits before it is tried again
+	reserveReleaseRetry = time.Hour
+	// maxReserveHoldDays bounds how long a reserve can hold funds
+	maxReserveHoldDays = 180
+)
+
+// ReservePolicy holds back part of what a business receives, stored on its
+// user document under reserve. PercentBps of each payment's payout is kept
+// for HoldDays before it is transferred, so chargebacks and returns on
+// recent volume can be covered.
+type ReservePolicy struct {
+	PercentBps int64     `json:"percent_bps" firestore:"percent_bps"`
+	HoldDays   int64     `json:"hold_days" firestore:"hold_days"`
+	UpdatedBy  string    `json:"updated_by,omitempty" firestore:"updated_by,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// Reserve is the part of one payment's payout held back, stored at
+// reserves/{paymentIntentID}
+type Reserve struct {
+	PaymentIntentID string    `json:"payment_intent_id" firestore:"-"`
+	RecipientUserID string    `json:"recipient_user_id" firestore:"recipient_user_id"`
+	Amount          int64     `json:"amount" firestore:"amount"`
+	Currency        string    `json:"currency" firestore:"currency"`
+	Status          string    `json:"status" firestore:"status"`
+	ReleaseAt       time.Time `json:"release_at" firestore:"release_at"`
+	TransferID      string    `json:"transfer_id,omitempty" firestore:"transfer_id,omitempty"`
+	Error           string    `json:"error,omitempty" firestore:"error,omitempty"`
+	CreatedAt       time.Time `json:"created_at" firestore:"created_at"`
+	ReleasedAt      time.Time `json:"released_at,omitempty" firestore:"released_at,omitempty"`
+}
+
+// LedgerAccountUserReserve is what the platform owes a recipient but is
+// holding in reserve
+func LedgerAccountUserReserve(uid string) string {
+	return "user:" + uid + ":reserve"
+}
+
+// ReserveHoldLedgerTransaction moves part of what a recipient is owed for a
+// payment into their reserve
+func ReserveHoldLedgerTransaction(paymentIntentID, recipientUID string, amount int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "reserve_hold_" + paymentIntentID,
+		Kind:      LedgerReserveHold,
+		Reference: paymentIntentID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Debit, Amount: amount},
+			{Account: LedgerAccountUserReserve(recipientUID), Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// ReserveReleaseLedgerTransaction returns a payment's reserve to what the
+// recipient is owed, to be transferred or to cover a reversal
+func ReserveReleaseLedgerTransaction(paymentIntentID, recipientUID string, amount int64, currency string) *LedgerTransaction {
+	return &LedgerTransaction{
+		ID:        "reserve_release_" + paymentIntentID,
+		Kind:      LedgerReserveRelease,
+		Reference: paymentIntentID,
+		Currency:  currency,
+		Entries: []LedgerEntry{
+			{Account: LedgerAccountUserReserve(recipientUID), Direction: Debit, Amount: amount},
+			{Account: LedgerAccountUserPayable(recipientUID), Direction: Credit, Amount: amount},
+		},
+	}
+}
+
+// reservePolicy loads a user's reserve policy, or nil if they have none
+func reservePolicy(ctx context.Context, fs *firestore.Client, uid string) *ReservePolicy {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return nil
+	}
+	var user struct {
+		Reserve *ReservePolicy `firestore:"reserve"`
+	}
+	if err := doc.DataTo(&user); err != nil || user.Reserve == nil || user.Reserve.PercentBps <= 0 {
+		return nil
+	}
+	return user.Reserve
+}
+
+// reserveFor is how much of a payout of net cents the recipient's policy
+// holds back, rounded down, and for how many days
+func reserveFor(ctx context.Context, fs *firestore.Client, recipientUID string, net int64) (int64, int64) {
+	policy := reservePolicy(ctx, fs, recipientUID)
+	if policy == nil || net <= 0 {
+		return 0, 0
+	}
+	return net * policy.PercentBps / 10000, policy.HoldDays
+}
+
+// reserveMetadata reads the reserve recorded in a PaymentIntent's metadata
+func reserveMetadata(meta map[string]string) (int64, int64) {
+	amount, _ := strconv.ParseInt(meta["reserve_amount"], 10, 64)
+	days, _ := strconv.ParseInt(meta["reserve_hold_days"], 10, 64)
+	return amount, days
+}
+
+// holdReserve records a payment's reserve once its charge has succeeded.
+// Repeats are no-ops, so the inline and webhook paths can both call it.
+func holdReserve(ctx context.Context, fs *firestore.Client, paymentIntentID, recipientUID string, amount, holdDays int64, currency string) error {
+	now := time.Now()
+	_, err := fs.Collection("reserves").Doc(paymentIntentID).Create(ctx, Reserve{
+		RecipientUserID: recipientUID,
+		Amount:          amount,
+		Currency:        currency,
+		Status:          ReserveHeld,
+		ReleaseAt:       now.Add(time.Duration(holdDays) * 24 * time.Hour),
+		CreatedAt:       now,
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// ReleaseReserves pays out reserves whose hold has ended. A reserve on a
+// payment that was reversed while held is applied to the reversal instead.
+func ReleaseReserves(ctx context.Context, d *webhookDeps) error {
+	docs, err := d.fs.Collection("reserves").
+		Where("status", "==", ReserveHeld).
+		Where("release_at", "<=", time.Now()).
+		OrderBy("release_at", firestore.Asc).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load due reserves: %w", err)
+	}
+	for _, doc := range docs {
+		claimed, err := claimReserve(ctx, d.fs, doc.Ref)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to claim reserve", "component", "reserves", "payment_intent", doc.Ref.ID, "error", err)
+			continue
+		}
+		if claimed {
+			releaseReserve(ctx, d, doc)
+		}
+	}
+	return nil
+}
+
+// claimReserve pushes a due reserve's release_at out so other instances
+// leave it alone while it is released; a release that fails is retried then
+func claimReserve(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef) (bool, error) {
+	claimed := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		releaseAt, _ := doc.Data()["release_at"].(time.Time)
+		if stringField(doc.Data(), "status") != ReserveHeld || releaseAt.After(time.Now()) {
+			return nil
+		}
+		claimed = true
+		return tx.Update(ref, []firestore.Update{{Path: "release_at", Value: time.Now().Add(reserveReleaseRetry)}})
+	})
+	return claimed, err
+}
+
+// releaseReserve transfers one reserve to its recipient
+func releaseReserve(ctx context.Context, d *webhookDeps, doc *firestore.DocumentSnapshot) {
+	var r Reserve
+	if err := doc.DataTo(&r); err != nil {
+		return
+	}
+	piID := doc.Ref.ID
+	d.postLedger(ctx, r.RecipientUserID, ReserveReleaseLedgerTransaction(piID, r.RecipientUserID, r.Amount, r.Currency))
+
+	if tx, err := getDocument(ctx, d.fs.Collection("transactions").Doc(piID)); err == nil {
+		if why := bulkRefundIneligible(tx.Data()); why != "" {
+			if _, err := doc.Ref.Update(ctx, []firestore.Update{
+				{Path: "status", Value: ReserveApplied},
+				{Path: "error", Value: why},
+				{Path: "released_at", Value: time.Now()},
+			}); err != nil {
+				slog.ErrorContext(ctx, "failed to record applied reserve", "component", "reserves", "payment_intent", piID, "error", err)
+			}
+			return
+		}
+	}
+
+	var destination string
+	if user, err := getDocument(ctx, UserDoc(ctx, d.fs, r.RecipientUserID)); err == nil {
+		destination = stringField(user.Data(), "stripe_account_id")
+	}
+	if destination == "" {
+		recordReserveError(ctx, doc.Ref, fmt.Errorf("recipient %s has no connected account", r.RecipientUserID))
+		return
+	}
+	tr, err := d.sc.ProcessTransferWithIdempotency(ctx, r.Amount, r.Currency, destination, piID, "reserve_release_"+piID)
+	if err != nil {
+		d.sc.LogAPIError(ctx, "reserve_release", r.RecipientUserID, err)
+		recordReserveError(ctx, doc.Ref, err)
+		return
+	}
+	d.sc.LogAPIInteraction(ctx, "reserve_release", r.RecipientUserID, true, fmt.Sprintf("Transfer: %s", tr.ID))
+	d.postLedger(ctx, r.RecipientUserID, TransferLedgerTransaction(tr.ID, r.RecipientUserID, tr.Amount, tr.Currency))
+	if _, err := doc.Ref.Update(ctx, []firestore.Update{
+		{Path: "status", Value: ReserveReleased},
+		{Path: "transfer_id", Value: tr.ID},
+		{Path: "error", Value: firestore.Delete},
+		{Path: "released_at", Value: time.Now()},
+	}); err != nil {
+		slog.ErrorContext(ctx, "failed to record reserve release", "component", "reserves", "payment_intent", piID, "error", err)
+	}
+}
+
+func recordReserveError(ctx context.Context, ref *firestore.DocumentRef, cause error) {
+	if _, err := ref.Update(ctx, []firestore.Update{{Path: "error", Value: cause.Error()}}); err != nil {
+		slog.ErrorContext(ctx, "failed to record reserve error", "component", "reserves", "payment_intent", ref.ID, "error", err)
+	}
+}
+
+// GetReserve returns the caller's reserve policy, how much is held, and when
+// each held amount is released
+func GetReserve(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	docs, err := fs.Collection("reserves").
+		Where("recipient_user_id", "==", uid).
+		Where("status", "in", []string{ReserveHeld, ReserveFrozen}).
+		OrderBy("release_at", firestore.Asc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load reserve"})
+		return
+	}
+	held := map[string]int64{}
+	releases := make([]Reserve, 0, len(docs))
+	for _, doc := range docs {
+		var r Reserve
+		if err := doc.DataTo(&r); err != nil {
+			continue
+		}
+		r.PaymentIntentID = doc.Ref.ID
+		held[r.Currency] += r.Amount
+		releases = append(releases, r)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"policy":   reservePolicy(ctx, fs, uid),
+		"held":     held,
+		"releases": releases,
+	})
+}
+
+// SetUserReserve sets or clears (percent_bps 0) a business's rolling reserve.
+// It applies to payments made from now on; amounts already held keep their
+// release dates.
+func SetUserReserve(c *gin.Context) {
+	var req struct {
+		PercentBps int64 `json:"percent_bps" binding:"min=0,max=10000"`
+		HoldDays   int64 `json:"hold_days" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.HoldDays > maxReserveHoldDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("hold_days can be at most %d", maxReserveHoldDays)})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	uid := c.Param("uid")
+
+	if _, err := getDocument(ctx, UserDoc(ctx, fs, uid)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if req.PercentBps > 0 && !acceptsTips(ctx, fs, uid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reserves apply to business accounts only"})
+		return
+	}
+	policy := ReservePolicy{PercentBps: req.PercentBps, HoldDays: req.HoldDays, UpdatedBy: c.GetString("userID"), UpdatedAt: time.Now()}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"reserve":    policy,
+		"updated_at": policy.UpdatedAt,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save reserve"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reserve": policy})
+}
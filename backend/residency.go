@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RegionEU is the residency region for users in the EU/EEA
+const RegionEU = "eu"
+
+// Payment processors a user's data may be shared with
+const (
+	ProcessorStripe = "stripe"
+	ProcessorSila   = "sila"
+	ProcessorPlaid  = "plaid"
+)
+
+// ErrProcessorRestricted is returned when a user's residency region does not allow a processor
+var ErrProcessorRestricted = errors.New("processor is not available in the user's region")
+
+// euCountries are the EU and EEA member states, as ISO 3166-1 alpha-2 codes
+var euCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "HR": true, "CY": true, "CZ": true, "DK": true,
+	"EE": true, "FI": true, "FR": true, "DE": true, "GR": true, "HU": true, "IE": true,
+	"IT": true, "LV": true, "LT": true, "LU": true, "MT": true, "NL": true, "PL": true,
+	"PT": true, "RO": true, "SK": true, "SI": true, "ES": true, "SE": true,
+	"IS": true, "LI": true, "NO": true,
+}
+
+// regionProcessors lists the processors each residency region may use.
+// Sila and Plaid hold data in the US only.
+var regionProcessors = map[string]map[string]bool{
+	RegionEU: {ProcessorStripe: true},
+}
+
+// processorUserFields are users/{uid} fields that only exist for a processor
+var processorUserFields = map[string]string{
+	"sila_user_handle":    ProcessorSila,
+	"sila_status":         ProcessorSila,
+	"sila_registered_at":  ProcessorSila,
+	"sila_bank_accounts":  ProcessorSila,
+	"sila_kyc_level":      ProcessorSila,
+	"sila_kyc_updated_at": ProcessorSila,
+	"plaid_items":         ProcessorPlaid,
+}
+
+// euFirestore holds EU users' PII when data residency mode is on
+var euFirestore *firestore.Client
+
+// userRegions caches users' residency regions, which never change once set
+var userRegions sync.Map
+
+// dataResidencyEnabled reports whether EU users' PII is routed to the EU database
+func dataResidencyEnabled() bool {
+	return os.Getenv("DATA_RESIDENCY_MODE") == "true"
+}
+
+// InitDataResidency connects to the EU database named by EU_FIRESTORE_DATABASE_ID
+func InitDataResidency(ctx context.Context, projectID string) error {
+	if !dataResidencyEnabled() {
+		return nil
+	}
+	databaseID := os.Getenv("EU_FIRESTORE_DATABASE_ID")
+	if databaseID == "" {
+		return fmt.Errorf("EU_FIRESTORE_DATABASE_ID is required when DATA_RESIDENCY_MODE is on")
+	}
+	client, err := firestore.NewClientWithDatabase(ctx, projectID, databaseID, firestoreDeadlineOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to EU database: %w", err)
+	}
+	euFirestore = client
+	return nil
+}
+
+// residencyRegionForCountry maps a country code to the residency region its users belong to
+func residencyRegionForCountry(country string) string {
+	if euCountries[strings.ToUpper(country)] {
+		return RegionEU
+	}
+	return currentRegion.Name
+}
+
+// AssignUserRegion records a new user's residency region in the user_regions
+// directory, which stays in the primary database so any instance can route the
+// user's reads. An existing assignment is never changed.
+func AssignUserRegion(ctx context.Context, fs *firestore.Client, uid, country string) (string, error) {
+	region := residencyRegionForCountry(country)
+	_, err := fs.Collection("user_regions").Doc(uid).Create(ctx, map[string]interface{}{
+		"region":     region,
+		"country":    strings.ToUpper(country),
+		"created_at": time.Now(),
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return userRegion(ctx, fs, uid)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to assign region: %w", err)
+	}
+	userRegions.Store(uid, region)
+	return region, nil
+}
+
+// userRegion returns the user's residency region; users registered before
+// residency mode belong to the deployment's region
+func userRegion(ctx context.Context, fs *firestore.Client, uid string) (string, error) {
+	if region, ok := userRegions.Load(uid); ok {
+		return region.(string), nil
+	}
+	snap, err := getDocument(ctx, fs.Collection("user_regions").Doc(uid))
+	if status.Code(err) == codes.NotFound {
+		return currentRegion.Name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load region for %s: %w", uid, err)
+	}
+	region := stringField(snap.Data(), "region")
+	if region == "" {
+		region = currentRegion.Name
+	}
+	userRegions.Store(uid, region)
+	return region, nil
+}
+
+// userDatabase returns the database holding the user's PII
+func userDatabase(ctx context.Context, fs *firestore.Client, uid string) *firestore.Client {
+	if !dataResidencyEnabled() || euFirestore == nil {
+		return fs
+	}
+	if region, err := userRegion(ctx, fs, uid); err == nil && region == RegionEU {
+		return euFirestore
+	}
+	return fs
+}
+
+// UserDoc returns users/{uid} in the database the user's residency region
+// requires. All access to user profiles and their subcollections goes through it.
+func UserDoc(ctx context.Context, fs *firestore.Client, uid string) *firestore.DocumentRef {
+	return userDatabase(ctx, fs, uid).Collection("users").Doc(uid)
+}
+
+// SaveUserFields merges fields into the user's profile, refusing fields that
+// would share the user's data with a processor their region does not allow
+func SaveUserFields(ctx context.Context, fs *firestore.Client, uid string, fields map[string]interface{}) error {
+	if err := checkUserFieldsAllowed(ctx, fs, uid, fields); err != nil {
+		return err
+	}
+	if _, err := UserDoc(ctx, fs, uid).Set(ctx, fields, firestore.MergeAll); err != nil {
+		return fmt.Errorf("failed to save user %s: %w", uid, err)
+	}
+	return nil
+}
+
+// checkUserFieldsAllowed refuses processor fields the user's region doesn't allow
+func checkUserFieldsAllowed(ctx context.Context, fs *firestore.Client, uid string, fields map[string]interface{}) error {
+	for field := range fields {
+		if processor, ok := processorUserFields[field]; ok {
+			if err := CheckProcessorAllowed(ctx, fs, uid, processor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// userUpdateAttempts bounds how many times UpdateUser re-reads after losing a race
+const userUpdateAttempts = 5
+
+// UpdateUser is SaveUserFields for changes that depend on what the profile
+// holds now. mutate sees the current document (which may not exist) and
+// returns the fields to merge, or none to leave it alone; they are written
+// only if the document hasn't changed since it was read. When a webhook,
+// onboarding, or a profile edit wrote in between, the document is read again
+// and mutate called on the new version, so neither write is lost.
+func UpdateUser(ctx context.Context, fs *firestore.Client, uid string, mutate func(*firestore.DocumentSnapshot) (map[string]interface{}, error)) error {
+	ref := UserDoc(ctx, fs, uid)
+	for attempt := 1; ; attempt++ {
+		snap, err := getDocument(ctx, ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("failed to load user %s: %w", uid, err)
+		}
+		fields, err := mutate(snap)
+		if err != nil || len(fields) == 0 {
+			return err
+		}
+		if err := checkUserFieldsAllowed(ctx, fs, uid, fields); err != nil {
+			return err
+		}
+		if snap.Exists() {
+			_, err = ref.Update(ctx, mergeUpdates(nil, fields), firestore.LastUpdateTime(snap.UpdateTime))
+		} else {
+			_, err = ref.Create(ctx, withoutDeletes(fields))
+		}
+		code := status.Code(err)
+		if err == nil || (code != codes.FailedPrecondition && code != codes.AlreadyExists) || attempt == userUpdateAttempts {
+			if err != nil {
+				return fmt.Errorf("failed to save user %s: %w", uid, err)
+			}
+			return nil
+		}
+		slog.DebugContext(ctx, "user document changed, retrying", "component", "users", "user_id", uid, "attempt", attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 25 * time.Millisecond):
+		}
+	}
+}
+
+// mergeUpdates turns fields into updates with MergeAll's meaning: nested maps
+// set the fields they name rather than replacing the whole map
+func mergeUpdates(prefix firestore.FieldPath, fields map[string]interface{}) []firestore.Update {
+	var updates []firestore.Update
+	for k, v := range fields {
+		path := append(append(firestore.FieldPath{}, prefix...), k)
+		if nested, ok := v.(map[string]interface{}); ok && len(nested) > 0 {
+			updates = append(updates, mergeUpdates(path, nested)...)
+			continue
+		}
+		updates = append(updates, firestore.Update{FieldPath: path, Value: v})
+	}
+	return updates
+}
+
+// withoutDeletes drops firestore.Delete from fields for creating a document,
+// where there is nothing to delete
+func withoutDeletes(fields map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if v == firestore.Delete {
+			continue
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			v = withoutDeletes(nested)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// QueryUsers runs a users query against every database user profiles live in
+func QueryUsers(ctx context.Context, fs *firestore.Client, build func(users *firestore.CollectionRef) firestore.Query) ([]*firestore.DocumentSnapshot, error) {
+	dbs := []*firestore.Client{fs}
+	if dataResidencyEnabled() && euFirestore != nil {
+		dbs = append(dbs, euFirestore)
+	}
+	var docs []*firestore.DocumentSnapshot
+	for _, db := range dbs {
+		found, err := build(db.Collection("users")).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, found...)
+	}
+	return docs, nil
+}
+
+// CheckProcessorAllowed returns ErrProcessorRestricted if the user's residency
+// region may not use the processor
+func CheckProcessorAllowed(ctx context.Context, fs *firestore.Client, uid, processor string) error {
+	if !dataResidencyEnabled() {
+		return nil
+	}
+	region, err := userRegion(ctx, fs, uid)
+	if err != nil {
+		return err
+	}
+	if allowed, restricted := regionProcessors[region]; restricted && !allowed[processor] {
+		return fmt.Errorf("%s for region %s: %w", processor, region, ErrProcessorRestricted)
+	}
+	return nil
+}
+
+// RequireProcessor rejects requests from users whose residency region may not use the processor
+func RequireProcessor(processor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, ok := c.Get("firestore")
+		if !ok {
+			c.Next()
+			return
+		}
+		err := CheckProcessorAllowed(c.Request.Context(), v.(*firestore.Client), c.GetString("userID"), processor)
+		if errors.Is(err, ErrProcessorRestricted) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This feature is not available in your region", "code": "processor_restricted"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check region"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Outgoing payments are scored before they are charged. Each RiskSignal
+// scores one aspect of a payment from 0 to 100, and the payment's score is
+// their sum. A payment scoring at least RISK_REVIEW_SCORE (default 50) is
+// charged, but its transfer is held until an admin reviews it; one scoring
+// at least RISK_DENY_SCORE (default 90) is refused. A signal that fails is
+// left out of the score rather than blocking the payment.
+//
+// RISK_SCORING_MODE is enforce (default); shadow, which records assessments
+// without acting on them; or off. RISK_SIGNALS_DISABLED lists signals to
+// leave out, comma separated.
+
+// Risk outcomes
+const (
+	RiskAllow  = "allow"
+	RiskReview = "review"
+	RiskDeny   = "deny"
+)
+
+// Review statuses of payments held for risk review
+const (
+	RiskReviewPending  = "pending"
+	RiskReviewApproved = "approved"
+	RiskReviewDeclined = "declined"
+	// RiskReviewCanceled closes a review whose payment was never charged
+	RiskReviewCanceled = "canceled"
+)
+
+// Risk scoring modes, from RISK_SCORING_MODE
+const (
+	RiskModeEnforce = "enforce"
+	RiskModeShadow  = "shadow"
+	RiskModeOff     = "off"
+)
+
+// MetricRiskAssessmentsTotal counts payment risk assessments by outcome
+const MetricRiskAssessmentsTotal = "risk_assessments_total"
+
+const (
+	defaultRiskReviewScore = 50
+	defaultRiskDenyScore   = 90
+	// riskScoringTimeout bounds all the signals together; Plaid Signal is
+	// the slowest
+	riskScoringTimeout = 5 * time.Second
+	// riskHistoryWindow is how far back a sender's payments are compared
+	riskHistoryWindow = 30 * 24 * time.Hour
+	riskHistoryLimit  = 200
+	// riskAnomalyMinAmount is the smallest payment, in minor units, that can
+	// be out of line with the sender's usual payments
+	riskAnomalyMinAmount = 10000
+)
+
+var errRiskReviewClosed = errors.New("risk review already closed")
+
+// errRiskPaymentProcessing is returned when declining a payment whose charge
+// hasn't settled, so it can be neither refunded nor canceled yet
+var errRiskPaymentProcessing = errors.New("payment is still processing")
+
+// RiskPayment is an outgoing payment being scored
+type RiskPayment struct {
+	// AssessmentID identifies the payment to providers scoring it
+	AssessmentID    string
+	SenderUID       string
+	RecipientUID    string // empty for a contact without an account yet
+	Amount          int64
+	Currency        string
+	FundingSource   string
+	PaymentMethodID string
+	IPAddress       string
+	UserAgent       string
+	DeviceID        string // the app's X-Device-ID
+
+	fs       *firestore.Client
+	provider PaymentProvider
+	plaid    *PlaidClient // nil without a Plaid client
+	history  []map[string]interface{}
+	loaded   bool
+}
+
+// History returns the sender's payments from the last riskHistoryWindow,
+// newest first, loading them once for all the signals
+func (p *RiskPayment) History(ctx context.Context) ([]map[string]interface{}, error) {
+	if p.loaded {
+		return p.history, nil
+	}
+	docs, err := p.fs.Collection("transactions").
+		Where("sender_user_id", "==", p.SenderUID).
+		Where("created_at", ">=", time.Now().Add(-riskHistoryWindow)).
+		OrderBy("created_at", firestore.Desc).
+		Limit(riskHistoryLimit).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payment history: %w", err)
+	}
+	for _, doc := range docs {
+		p.history = append(p.history, doc.Data())
+	}
+	p.loaded = true
+	return p.history, nil
+}
+
+// RiskScore is one signal's score of a payment
+type RiskScore struct {
+	Signal string `json:"signal" firestore:"signal"`
+	Score  int    `json:"score" firestore:"score"`
+	Reason string `json:"reason" firestore:"reason"`
+}
+
+// RiskSignal scores one aspect of an outgoing payment. Score returns nil
+// when the signal finds nothing risky.
+type RiskSignal interface {
+	Name() string
+	Score(ctx context.Context, p *RiskPayment) (*RiskScore, error)
+}
+
+// riskSignals are what payments are scored with, in order
+var riskSignals = []RiskSignal{
+	velocitySignal{},
+	newRecipientSignal{},
+	amountAnomalySignal{},
+	deviceSignal{},
+	plaidSignal{},
+}
+
+// RegisterRiskSignal adds a signal payments are scored with. Call it before
+// the server starts.
+func RegisterRiskSignal(s RiskSignal) {
+	riskSignals = append(riskSignals, s)
+}
+
+// riskScoringMode is RISK_SCORING_MODE: enforce (default), shadow, or off
+func riskScoringMode() string {
+	switch mode := os.Getenv("RISK_SCORING_MODE"); mode {
+	case RiskModeShadow, RiskModeOff:
+		return mode
+	default:
+		return RiskModeEnforce
+	}
+}
+
+// riskThreshold reads a score threshold from the environment
+func riskThreshold(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// riskSignalEnabled reports whether name isn't in RISK_SIGNALS_DISABLED
+func riskSignalEnabled(name string) bool {
+	for _, disabled := range strings.Split(os.Getenv("RISK_SIGNALS_DISABLED"), ",") {
+		if strings.TrimSpace(disabled) == name {
+			return false
+		}
+	}
+	return true
+}
+
+// riskOutcome is what a payment's score means
+func riskOutcome(score int) string {
+	switch {
+	case score >= riskThreshold("RISK_DENY_SCORE", defaultRiskDenyScore):
+		return RiskDeny
+	case score >= riskThreshold("RISK_REVIEW_SCORE", defaultRiskReviewScore):
+		return RiskReview
+	}
+	return RiskAllow
+}
+
+// PaymentRiskAssessment is a payment's score, stored at
+// payment_risk_assessments/{id}. Enforced assessments with the review
+// outcome are the admin review queue.
+type PaymentRiskAssessment struct {
+	ID              string      `json:"id" firestore:"-"`
+	SenderUserID    string      `json:"sender_user_id" firestore:"sender_user_id"`
+	RecipientUserID string      `json:"recipient_user_id,omitempty" firestore:"recipient_user_id,omitempty"`
+	Amount          int64       `json:"amount" firestore:"amount"`
+	Currency        string      `json:"currency" firestore:"currency"`
+	FundingSource   string      `json:"funding_source,omitempty" firestore:"funding_source,omitempty"`
+	IPAddress       string      `json:"ip_address,omitempty" firestore:"ip_address,omitempty"`
+	UserAgent       string      `json:"user_agent,omitempty" firestore:"user_agent,omitempty"`
+	DeviceID        string      `json:"device_id,omitempty" firestore:"device_id,omitempty"`
+	Scores          []RiskScore `json:"scores" firestore:"scores"`
+	Score           int         `json:"score" firestore:"score"`
+	Outcome         string      `json:"outcome" firestore:"outcome"`
+	// Enforced is false in shadow mode, when the outcome wasn't acted on
+	Enforced bool `json:"enforced" firestore:"enforced"`
+	// TransactionID and HoldID are set once a reviewed payment is charged
+	// and its transfer held
+	TransactionID string     `json:"transaction_id,omitempty" firestore:"transaction_id,omitempty"`
+	HoldID        string     `json:"hold_id,omitempty" firestore:"hold_id,omitempty"`
+	ReviewStatus  string     `json:"review_status,omitempty" firestore:"review_status,omitempty"`
+	ReviewedBy    string     `json:"reviewed_by,omitempty" firestore:"reviewed_by,omitempty"`
+	ReviewedAt    *time.Time `json:"reviewed_at,omitempty" firestore:"reviewed_at,omitempty"`
+	ReviewNote    string     `json:"review_note,omitempty" firestore:"review_note,omitempty"`
+	CreatedAt     time.Time  `json:"created_at" firestore:"created_at"`
+}
+
+// reviewID is the assessment's ID when its payment is held for review, and
+// empty otherwise
+func (a *PaymentRiskAssessment) reviewID() string {
+	if a == nil || a.ReviewStatus != RiskReviewPending {
+		return ""
+	}
+	return a.ID
+}
+
+// EvaluatePaymentRisk scores a payment with every enabled signal and records
+// the assessment. It returns nil when scoring is off.
+func EvaluatePaymentRisk(ctx context.Context, p *RiskPayment) (*PaymentRiskAssessment, error) {
+	mode := riskScoringMode()
+	if mode == RiskModeOff {
+		return nil, nil
+	}
+	ref := p.fs.Collection("payment_risk_assessments").NewDoc()
+	p.AssessmentID = ref.ID
+	scoreCtx, cancel := context.WithTimeout(ctx, riskScoringTimeout)
+	defer cancel()
+
+	a := &PaymentRiskAssessment{
+		SenderUserID:    p.SenderUID,
+		RecipientUserID: p.RecipientUID,
+		Amount:          p.Amount,
+		Currency:        p.Currency,
+		FundingSource:   p.FundingSource,
+		IPAddress:       p.IPAddress,
+		UserAgent:       p.UserAgent,
+		DeviceID:        p.DeviceID,
+		Scores:          []RiskScore{},
+		Enforced:        mode == RiskModeEnforce,
+		CreatedAt:       time.Now(),
+	}
+	for _, signal := range riskSignals {
+		if !riskSignalEnabled(signal.Name()) {
+			continue
+		}
+		s, err := signal.Score(scoreCtx, p)
+		if err != nil {
+			slog.WarnContext(ctx, "risk signal failed", "component", "risk", "signal", signal.Name(), "user_id", p.SenderUID, "error", err)
+			continue
+		}
+		if s == nil || s.Score <= 0 {
+			continue
+		}
+		s.Signal = signal.Name()
+		a.Scores = append(a.Scores, *s)
+		a.Score += s.Score
+	}
+	a.Outcome = riskOutcome(a.Score)
+	if a.Enforced && a.Outcome == RiskReview {
+		a.ReviewStatus = RiskReviewPending
+	}
+	if _, err := ref.Create(ctx, a); err != nil {
+		return nil, fmt.Errorf("failed to save risk assessment: %w", err)
+	}
+	a.ID = ref.ID
+	metrics.IncCounter(MetricRiskAssessmentsTotal, map[string]string{"outcome": a.Outcome, "mode": mode})
+	if a.Outcome != RiskAllow {
+		slog.InfoContext(ctx, "payment risk assessed", "component", "risk", "assessment_id", a.ID, "user_id", p.SenderUID,
+			"score", a.Score, "outcome", a.Outcome, "enforced", a.Enforced)
+	}
+	return a, nil
+}
+
+// assessPaymentRisk scores a payment about to be charged. It responds and
+// returns false when the payment is refused or can't be scored.
+func assessPaymentRisk(c *gin.Context, pp PaymentProvider, p RiskPayment) (*PaymentRiskAssessment, bool) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		// Without Firestore there is no history to score against
+		return nil, true
+	}
+	p.fs, p.provider = v.(*firestore.Client), pp
+	p.IPAddress, p.UserAgent, p.DeviceID = c.ClientIP(), c.Request.UserAgent(), c.GetHeader("X-Device-ID")
+	if pc, ok := c.Get("plaidClient"); ok {
+		p.plaid = pc.(*PlaidClient)
+	}
+	a, err := EvaluatePaymentRisk(c.Request.Context(), &p)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to assess payment risk", "component", "risk", "user_id", p.SenderUID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment"})
+		return nil, false
+	}
+	if a != nil && a.Enforced && a.Outcome == RiskDeny {
+		// Which signals fired isn't shared with the sender
+		c.JSON(http.StatusForbidden, gin.H{"error": "This payment can't be sent", "code": "payment_declined"})
+		return nil, false
+	}
+	return a, true
+}
+
+// linkRiskReview records the transaction, and the hold on its transfer, a
+// payment in review was charged as
+func linkRiskReview(ctx context.Context, fs *firestore.Client, assessmentID, transactionID, holdID string) {
+	updates := []firestore.Update{{Path: "transaction_id", Value: transactionID}}
+	if holdID != "" {
+		updates = append(updates, firestore.Update{Path: "hold_id", Value: holdID})
+	}
+	if _, err := fs.Collection("payment_risk_assessments").Doc(assessmentID).Update(ctx, updates); err != nil {
+		slog.ErrorContext(ctx, "failed to link risk review", "component", "risk", "assessment_id", assessmentID, "transaction_id", transactionID, "error", err)
+	}
+}
+
+// cancelUnchargedRiskReview closes a pending review once its payment has
+// failed to be created, so the queue doesn't keep a review with nothing to
+// act on. A review linked to a charged transaction is left alone.
+func cancelUnchargedRiskReview(ctx context.Context, fs *firestore.Client, a *PaymentRiskAssessment) {
+	if a.reviewID() == "" {
+		return
+	}
+	ref := fs.Collection("payment_risk_assessments").Doc(a.ID)
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if stringField(doc.Data(), "review_status") != RiskReviewPending || stringField(doc.Data(), "transaction_id") != "" {
+			return nil
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "review_status", Value: RiskReviewCanceled},
+			{Path: "reviewed_at", Value: time.Now()},
+			{Path: "review_note", Value: "Payment was not charged"},
+		})
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to cancel risk review", "component", "risk", "assessment_id", a.ID, "error", err)
+	}
+}
+
+// velocitySignal scores how many payments the sender has tried recently.
+// Failed attempts count too; a burst of them is how stolen cards are tested.
+type velocitySignal struct{}
+
+func (velocitySignal) Name() string { return "velocity" }
+
+func (velocitySignal) Score(ctx context.Context, p *RiskPayment) (*RiskScore, error) {
+	history, err := p.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var hour, day int
+	for _, t := range history {
+		created, _ := t["created_at"].(time.Time)
+		if now.Sub(created) < time.Hour {
+			hour++
+		}
+		if now.Sub(created) < 24*time.Hour {
+			day++
+		}
+	}
+	reason := fmt.Sprintf("%d payments in the last hour and %d in the last day", hour, day)
+	switch {
+	case hour >= 10 || day >= 30:
+		return &RiskScore{Score: 60, Reason: reason}, nil
+	case hour >= 5 || day >= 15:
+		return &RiskScore{Score: 30, Reason: reason}, nil
+	}
+	return nil, nil
+}
+
+// newRecipientSignal scores paying someone the sender never has before,
+// more so when their account is new
+type newRecipientSignal struct{}
+
+func (newRecipientSignal) Name() string { return "new_recipient" }
+
+func (newRecipientSignal) Score(ctx context.Context, p *RiskPayment) (*RiskScore, error) {
+	if p.RecipientUID == "" {
+		return &RiskScore{Score: 25, Reason: "Recipient has no account yet"}, nil
+	}
+	paid, err := p.fs.Collection("transactions").
+		Where("sender_user_id", "==", p.SenderUID).
+		Where("recipient_user_id", "==", p.RecipientUID).
+		Where("status", "==", "succeeded").
+		Limit(1).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payments to recipient: %w", err)
+	}
+	if len(paid) > 0 {
+		return nil, nil
+	}
+	if doc, err := getDocument(ctx, UserDoc(ctx, p.fs, p.RecipientUID)); err == nil {
+		if created, ok := doc.Data()["created_at"].(time.Time); ok && time.Since(created) < 7*24*time.Hour {
+			return &RiskScore{Score: 35, Reason: "First payment to an account opened this week"}, nil
+		}
+	}
+	return &RiskScore{Score: 15, Reason: "First payment to this recipient"}, nil
+}
+
+// amountAnomalySignal scores payments far larger than the sender's usual ones
+type amountAnomalySignal struct{}
+
+func (amountAnomalySignal) Name() string { return "amount_anomaly" }
+
+func (amountAnomalySignal) Score(ctx context.Context, p *RiskPayment) (*RiskScore, error) {
+	history, err := p.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var total, count int64
+	for _, t := range history {
+		amount, _ := t["amount"].(int64)
+		if stringField(t, "status") != "succeeded" || stringField(t, "currency") != p.Currency || amount <= 0 {
+			continue
+		}
+		total += amount
+		count++
+	}
+	if count < 3 {
+		if p.Amount >= riskHoldAmount() {
+			return &RiskScore{Score: 20, Reason: "Large payment from a sender with little history"}, nil
+		}
+		return nil, nil
+	}
+	if p.Amount < riskAnomalyMinAmount {
+		return nil, nil
+	}
+	average := total / count
+	switch {
+	case p.Amount >= 10*average:
+		return &RiskScore{Score: 40, Reason: fmt.Sprintf("At least 10 times the sender's average payment of %d", average)}, nil
+	case p.Amount >= 5*average:
+		return &RiskScore{Score: 20, Reason: fmt.Sprintf("At least 5 times the sender's average payment of %d", average)}, nil
+	}
+	return nil, nil
+}
+
+// deviceSignal scores payments from a device and IP address the sender
+// hasn't paid from before. A sender's first payment scores nothing here;
+// newRecipientSignal already covers it.
+type deviceSignal struct{}
+
+func (deviceSignal) Name() string { return "device" }
+
+func (deviceSignal) Score(ctx context.Context, p *RiskPayment) (*RiskScore, error) {
+	docs, err := p.fs.Collection("payment_risk_assessments").
+		Where("sender_user_id", "==", p.SenderUID).
+		OrderBy("created_at", firestore.Desc).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load past assessments: %w", err)
+	}
+	var devices, ips []string
+	for _, doc := range docs {
+		data := doc.Data()
+		if stringField(data, "outcome") == RiskDeny {
+			// Denied payments don't make a device familiar
+			continue
+		}
+		devices = append(devices, stringField(data, "device_id"))
+		ips = append(ips, stringField(data, "ip_address"))
+	}
+	if len(devices) == 0 {
+		return nil, nil
+	}
+	newDevice := p.DeviceID != "" && !slices.Contains(devices, p.DeviceID)
+	newIP := p.IPAddress != "" && !slices.Contains(ips, p.IPAddress)
+	switch {
+	case newDevice && newIP:
+		return &RiskScore{Score: 25, Reason: "New device and IP address"}, nil
+	case newDevice:
+		return &RiskScore{Score: 10, Reason: "New device"}, nil
+	case newIP:
+		return &RiskScore{Score: 10, Reason: "New IP address"}, nil
+	}
+	return nil, nil
+}
+
+// plaidSignal scores an ACH debit of a Plaid-linked account with Plaid
+// Signal's return risk
+type plaidSignal struct{}
+
+func (plaidSignal) Name() string { return "plaid_signal" }
+
+func (plaidSignal) Score(ctx context.Context, p *RiskPayment) (*RiskScore, error) {
+	sc, ok := p.provider.(*StripeClient)
+	if !ok || p.plaid == nil || p.PaymentMethodID == "" || p.FundingSource != FeeMethodBank {
+		return nil, nil
+	}
+	pm, err := sc.GetPaymentMethod(ctx, p.PaymentMethodID)
+	if err != nil || pm.Type != stripe.PaymentMethodTypeUSBankAccount {
+		return nil, nil
+	}
+	accountID := pm.Metadata["plaid_account_id"]
+	if accountID == "" {
+		return nil, nil
+	}
+	scores, err := plaidSignalScores(ctx, p.plaid, p.fs, p.SenderUID, accountID, p.AssessmentID, p.Amount)
+	if err != nil {
+		return nil, err
+	}
+	risk := max(scores.CustomerInitiatedReturnRisk, scores.BankInitiatedReturnRisk)
+	reason := fmt.Sprintf("Plaid Signal return risk %d", risk)
+	switch {
+	case risk >= 80:
+		return &RiskScore{Score: 50, Reason: reason}, nil
+	case risk >= 60:
+		return &RiskScore{Score: 25, Reason: reason}, nil
+	}
+	return nil, nil
+}
+
+// plaidSignalScores finds the sender's item holding accountID and scores
+// the debit with it, like plaidAvailableBalance
+func plaidSignalScores(ctx context.Context, pc *PlaidClient, fs *firestore.Client, uid, accountID, clientTransactionID string, amount int64) (*PlaidSignalScores, error) {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
+	items, _ := doc.Data()[providerUserField(ProcessorPlaid, "items")].(map[string]interface{})
+	var lastErr error
+	for itemID, raw := range items {
+		item, _ := raw.(map[string]interface{})
+		if s := stringField(item, "status"); s != "" && s != PlaidItemActive {
+			continue
+		}
+		accessToken, err := DecryptString(stringField(item, "access_token_encrypted"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt access token for item %s: %w", itemID, err)
+		}
+		scores, err := pc.EvaluateSignal(ctx, accessToken, accountID, clientTransactionID, amount)
+		if err != nil {
+			// Plaid rejects account IDs from another item; try the next one
+			lastErr = err
+			continue
+		}
+		return scores, nil
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("failed to evaluate account %s: %w", accountID, lastErr)
+	}
+	return nil, fmt.Errorf("no linked item has account %s", accountID)
+}
+
+// ListRiskReviews returns payments held for risk review, oldest first, so
+// the queue is worked in order; ?status= is pending (default), approved,
+// declined, or canceled
+func ListRiskReviews(c *gin.Context) {
+	_, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	reviewStatus := c.DefaultQuery("status", RiskReviewPending)
+	if !slices.Contains([]string{RiskReviewPending, RiskReviewApproved, RiskReviewDeclined, RiskReviewCanceled}, reviewStatus) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, approved, declined, or canceled"})
+		return
+	}
+	docs, err := fs.Collection("payment_risk_assessments").
+		Where("review_status", "==", reviewStatus).
+		OrderBy("created_at", firestore.Asc).
+		Limit(100).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load risk reviews"})
+		return
+	}
+	reviews := make([]PaymentRiskAssessment, 0, len(docs))
+	for _, doc := range docs {
+		var a PaymentRiskAssessment
+		if err := doc.DataTo(&a); err != nil {
+			continue
+		}
+		a.ID = doc.Ref.ID
+		reviews = append(reviews, a)
+	}
+	c.JSON(http.StatusOK, gin.H{"reviews": reviews})
+}
+
+// loadRiskReview reads the pending review the request names, responding
+// when there isn't one
+func loadRiskReview(c *gin.Context, fs *firestore.Client) (*PaymentRiskAssessment, bool) {
+	doc, err := getDocument(c.Request.Context(), fs.Collection("payment_risk_assessments").Doc(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Risk review not found"})
+		return nil, false
+	}
+	var a PaymentRiskAssessment
+	if err := doc.DataTo(&a); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load risk review"})
+		return nil, false
+	}
+	a.ID = doc.Ref.ID
+	if a.ReviewStatus == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Risk review not found"})
+		return nil, false
+	}
+	if a.ReviewStatus != RiskReviewPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "This review has already been closed"})
+		return nil, false
+	}
+	return &a, true
+}
+
+// closeRiskReview records an admin's decision on a pending review
+func closeRiskReview(ctx context.Context, fs *firestore.Client, a *PaymentRiskAssessment, reviewStatus, adminID, note string) error {
+	ref := fs.Collection("payment_risk_assessments").Doc(a.ID)
+	return fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if stringField(doc.Data(), "review_status") != RiskReviewPending {
+			return errRiskReviewClosed
+		}
+		now := time.Now()
+		a.ReviewStatus, a.ReviewedBy, a.ReviewedAt, a.ReviewNote = reviewStatus, adminID, &now, note
+		return tx.Update(ref, []firestore.Update{
+			{Path: "review_status", Value: reviewStatus},
+			{Path: "reviewed_by", Value: adminID},
+			{Path: "reviewed_at", Value: now},
+			{Path: "review_note", Value: note},
+		})
+	})
+}
+
+// respondRiskReviewClosed writes the response for closeRiskReview's outcome
+func respondRiskReviewClosed(c *gin.Context, fs *firestore.Client, adminID string, a *PaymentRiskAssessment, err error) {
+	ctx := c.Request.Context()
+	switch {
+	case errors.Is(err, errRiskReviewClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": "This review has already been closed"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close risk review"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "risk_assessment", SubjectID: a.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log risk review access", "component", "risk", "assessment_id", a.ID, "error", err)
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// ApproveRiskReview lets an admin clear a payment held for review; its
+// transfer goes out as a released hold's does
+func ApproveRiskReview(c *gin.Context) {
+	var req struct {
+		Note string `json:"note" binding:"max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	a, ok := loadRiskReview(c, fs)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	// Released before the review is closed, so a failed release can be retried
+	if a.HoldID != "" {
+		note := "Risk review approved"
+		if req.Note != "" {
+			note += ": " + req.Note
+		}
+		if _, err := releaseHold(ctx, fs, a.HoldID, adminID, note); err != nil && !errors.Is(err, errHoldReleased) {
+			slog.ErrorContext(ctx, "failed to release reviewed payment", "component", "risk", "assessment_id", a.ID, "hold_id", a.HoldID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release payment"})
+			return
+		}
+	}
+	respondRiskReviewClosed(c, fs, adminID, a, closeRiskReview(ctx, fs, a, RiskReviewApproved, adminID, req.Note))
+}
+
+// refundDeclinedPayment gives the sender back a declined payment and cancels
+// its held transfer: a charge that succeeded is refunded and one never
+// confirmed is canceled. A charge still processing returns
+// errRiskPaymentProcessing, and the decline can be retried once it settles.
+func refundDeclinedPayment(ctx context.Context, sc *StripeClient, fs *firestore.Client, a *PaymentRiskAssessment) error {
+	doc, err := getDocument(ctx, fs.Collection("transactions").Doc(a.TransactionID))
+	if err != nil {
+		return err
+	}
+	data := doc.Data()
+	if transferStatus := stringField(data, "transfer_status"); transferStatus == TransferStatusRefunded || transferStatus == TransferStatusCanceled {
+		return nil
+	}
+	pi, err := sc.GetPaymentIntent(ctx, a.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]interface{}{
+		"transfer_status":   TransferStatusCanceled,
+		"transfer_retry_at": firestore.Delete,
+	}
+	if escrow := stringField(data, "escrow_status"); escrow == EscrowHeld || escrow == EscrowClaimed {
+		fields["escrow_status"] = EscrowExpired
+		fields["escrow_lease_until"] = firestore.Delete
+	}
+	var refund *stripe.Refund
+	switch pi.Status {
+	case "succeeded":
+		refund, err = sc.RefundPaymentIntent(ctx, pi.ID, map[string]string{"reason": "risk_review_declined", "risk_assessment_id": a.ID}, "risk_review_refund_"+a.ID)
+		var se *stripe.Error
+		if err != nil && !(errors.As(err, &se) && se.Code == stripe.ErrorCodeChargeAlreadyRefunded) {
+			sc.LogAPIError(ctx, "risk_review_refund", a.SenderUserID, err)
+			return err
+		}
+		fields["transfer_status"] = TransferStatusRefunded
+		if _, ok := fields["escrow_status"]; ok {
+			fields["escrow_status"] = EscrowRefunded
+		}
+		if refund != nil {
+			sc.LogAPIInteraction(ctx, "risk_review_refund", a.SenderUserID, true, fmt.Sprintf("Refund: %s", refund.ID))
+			fields["compensation_refund_id"] = refund.ID
+		}
+	case "processing":
+		return errRiskPaymentProcessing
+	case "canceled":
+	default:
+		if err := sc.CancelPaymentIntent(ctx, pi.ID, stripe.PaymentIntentCancellationReasonFraudulent); err != nil {
+			sc.LogAPIError(ctx, "risk_review_cancel", a.SenderUserID, err)
+			return err
+		}
+	}
+	if err := SaveTransaction(ctx, fs, pi.ID, fields); err != nil {
+		return err
+	}
+	if refund != nil {
+		NotifyUser(ctx, fs, a.SenderUserID, NotificationPaymentRefunded, "Payment refunded",
+			fmt.Sprintf("Your %s payment couldn't be sent, so it has been refunded", currencyOrDefault(a.Currency).Format(a.Amount)),
+			map[string]interface{}{"transaction_id": pi.ID, "refund_id": refund.ID})
+	}
+	return nil
+}
+
+// DeclineRiskReview lets an admin reject a payment held for review. The
+// payment is refunded (or canceled, if it was never confirmed) and its hold
+// closed without the transfer going out; hold_sender also holds the sender's
+// account.
+func DeclineRiskReview(c *gin.Context) {
+	var req struct {
+		Note       string `json:"note" binding:"required,max=2000"`
+		HoldSender bool   `json:"hold_sender"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	a, ok := loadRiskReview(c, fs)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	// Refunded before the review is closed, so a failed refund can be retried
+	if a.TransactionID != "" {
+		v, ok := c.Get("stripeClient")
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+			return
+		}
+		err := refundDeclinedPayment(ctx, v.(*StripeClient), fs, a)
+		if errors.Is(err, errRiskPaymentProcessing) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The payment is still processing; decline it once it settles", "code": "payment_processing"})
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to refund declined payment", "component", "risk", "assessment_id", a.ID, "transaction_id", a.TransactionID, "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to refund payment"})
+			return
+		}
+	}
+	if a.HoldID != "" {
+		if _, err := releaseHold(ctx, fs, a.HoldID, adminID, "Risk review declined; payment refunded"); err != nil && !errors.Is(err, errHoldReleased) {
+			slog.ErrorContext(ctx, "failed to close declined payment's hold", "component", "risk", "assessment_id", a.ID, "hold_id", a.HoldID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close hold"})
+			return
+		}
+	}
+	if req.HoldSender {
+		if _, err := PlaceAccountHold(ctx, fs, a.SenderUserID, "Declined risk review: "+req.Note, "", adminID); err != nil && !errors.Is(err, errHoldExists) {
+			slog.ErrorContext(ctx, "failed to hold sender", "component", "risk", "assessment_id", a.ID, "user_id", a.SenderUserID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hold sender"})
+			return
+		}
+	}
+	respondRiskReviewClosed(c, fs, adminID, a, closeRiskReview(ctx, fs, a, RiskReviewDeclined, adminID, req.Note))
+}
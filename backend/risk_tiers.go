@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Recipient risk tiers, from least to most restrictive
+const (
+	RiskTierLow      = "low"
+	RiskTierElevated = "elevated"
+	RiskTierHigh     = "high"
+)
+
+// NotificationRiskTierChanged tells a business its risk tier and the terms
+// that come with it changed
+const NotificationRiskTierChanged = "risk_tier_changed"
+
+const (
+	// minRiskSample is the fewest payments dispute and return rates are taken
+	// over, so one incident on a new account isn't a 100% rate
+	minRiskSample = 20
+	// riskGrowthWindow is the recent period whose volume is compared with the
+	// rest of riskLookback
+	riskGrowthWindow = 30 * 24 * time.Hour
+)
+
+// RiskTierTerms are what a tier imposes on a recipient
+type RiskTierTerms struct {
+	Tier            string `json:"tier"`
+	ReserveBps      int64  `json:"reserve_bps"`
+	ReserveHoldDays int64  `json:"reserve_hold_days"`
+	PayoutDelayDays int64  `json:"payout_delay_days"` // 0 is Stripe's minimum
+	MaxPayment      int64  `json:"max_payment"`       // largest payment they may receive, DefaultCurrency minor units; 0 for no cap
+}
+
+var riskTierTerms = map[string]RiskTierTerms{
+	RiskTierLow:      {Tier: RiskTierLow},
+	RiskTierElevated: {Tier: RiskTierElevated, ReserveBps: 500, ReserveHoldDays: 30, PayoutDelayDays: 7, MaxPayment: 500000},
+	RiskTierHigh:     {Tier: RiskTierHigh, ReserveBps: 1000, ReserveHoldDays: 90, PayoutDelayDays: 14, MaxPayment: 100000},
+}
+
+// RiskMetrics are a recipient's risk signals over riskLookback
+type RiskMetrics struct {
+	Payments    int     `json:"payments" firestore:"payments"`
+	Volume      int64   `json:"volume" firestore:"volume"`
+	Disputes    int     `json:"disputes" firestore:"disputes"`
+	Returns     int     `json:"returns" firestore:"returns"`
+	DisputeRate float64 `json:"dispute_rate" firestore:"dispute_rate"`
+	ReturnRate  float64 `json:"return_rate" firestore:"return_rate"`
+	// Growth is the last riskGrowthWindow's volume over the monthly average
+	// before it; 0 without earlier volume
+	Growth float64 `json:"growth" firestore:"growth"`
+}
+
+// RiskAssessment is the latest scoring of a recipient, stored on their user
+// document under risk_assessment. Their effective tier is risk_tier, which an
+// admin can pin with risk_override.
+type RiskAssessment struct {
+	Tier       string      `json:"tier" firestore:"tier"`
+	Metrics    RiskMetrics `json:"metrics" firestore:"metrics"`
+	AssessedAt time.Time   `json:"assessed_at" firestore:"assessed_at"`
+}
+
+// RiskOverride pins a recipient's tier regardless of their metrics
+type RiskOverride struct {
+	Tier   string    `json:"tier" firestore:"tier"`
+	Reason string    `json:"reason" firestore:"reason"`
+	SetBy  string    `json:"set_by" firestore:"set_by"`
+	SetAt  time.Time `json:"set_at" firestore:"set_at"`
+}
+
+// scoreRiskTier places a recipient in a tier by their metrics
+func scoreRiskTier(m RiskMetrics) string {
+	switch {
+	case m.DisputeRate >= 0.01 || m.ReturnRate >= 0.05 || m.Growth >= 5:
+		return RiskTierHigh
+	case m.DisputeRate >= 0.005 || m.ReturnRate >= 0.02 || m.Growth >= 3:
+		return RiskTierElevated
+	}
+	return RiskTierLow
+}
+
+// LoadRiskMetrics gathers a recipient's payments, disputes, and returns over
+// riskLookback
+func LoadRiskMetrics(ctx context.Context, fs *firestore.Client, uid string, now time.Time) (RiskMetrics, error) {
+	var m RiskMetrics
+	cutoff := now.Add(-riskLookback)
+	recent := now.Add(-riskGrowthWindow)
+
+	txns, err := fs.Collection("transactions").
+		Where("recipient_user_id", "==", uid).
+		Where("created_at", ">=", cutoff).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return m, fmt.Errorf("failed to load payments: %w", err)
+	}
+	var recentVolume, earlierVolume int64
+	for _, doc := range txns {
+		var rec TransactionRecord
+		if err := doc.DataTo(&rec); err != nil {
+			continue
+		}
+		if rec.Status != TransactionStatusSucceeded && rec.Status != TransactionStatusReturned {
+			continue
+		}
+		m.Payments++
+		m.Volume += rec.Amount
+		if stringField(doc.Data(), "ach_return_code") != "" {
+			m.Returns++
+		}
+		if rec.CreatedAt.After(recent) {
+			recentVolume += rec.Amount
+		} else {
+			earlierVolume += rec.Amount
+		}
+	}
+
+	disputes, err := fs.Collection("disputes").
+		Where("recipient_user_id", "==", uid).
+		Where("created_at", ">=", cutoff).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return m, fmt.Errorf("failed to load disputes: %w", err)
+	}
+	m.Disputes = len(disputes)
+
+	sample := float64(max(m.Payments, minRiskSample))
+	m.DisputeRate = float64(m.Disputes) / sample
+	m.ReturnRate = float64(m.Returns) / sample
+	if earlierVolume > 0 {
+		earlierMonths := float64(riskLookback-riskGrowthWindow) / float64(riskGrowthWindow)
+		m.Growth = float64(recentVolume) / (float64(earlierVolume) / earlierMonths)
+	}
+	return m, nil
+}
+
+// recipientRiskTier is a user's effective risk tier
+func recipientRiskTier(ctx context.Context, fs *firestore.Client, uid string) string {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return RiskTierLow
+	}
+	if tier := stringField(doc.Data(), "risk_tier"); tier != "" {
+		return tier
+	}
+	return RiskTierLow
+}
+
+// applyRiskTier moves a recipient to tier: their reserve and payout delay
+// are set to its terms and they are told what changed. The payout delay is
+// best effort; the next change or an override sets it again.
+func applyRiskTier(ctx context.Context, fs *firestore.Client, sc *StripeClient, uid, from, tier string) error {
+	terms := riskTierTerms[tier]
+	now := time.Now()
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"risk_tier": tier,
+		"reserve": ReservePolicy{
+			PercentBps: terms.ReserveBps,
+			HoldDays:   terms.ReserveHoldDays,
+			UpdatedBy:  "risk_tier:" + tier,
+			UpdatedAt:  now,
+		},
+		"updated_at": now,
+	}); err != nil {
+		return err
+	}
+	if sc != nil {
+		// Keeps the recipient's chosen interval; only the delay changes
+		if doc, err := getDocument(ctx, UserDoc(ctx, fs, uid)); err == nil {
+			if err := applyPayoutSchedule(ctx, sc, doc, storedPayoutSchedule(doc)); err != nil {
+				sc.LogAPIError(ctx, "set_payout_delay", uid, err)
+			}
+		}
+	}
+	slog.InfoContext(ctx, "risk tier changed", "component", "risk_tiers", "user_id", uid, "from", from, "to", tier)
+
+	body := "Your account's payment terms are back to standard."
+	if tier != RiskTierLow {
+		body = fmt.Sprintf("%.0f%% of each payment you receive is now held for %d days, payouts are delayed %d days, and payments to you are capped at %s.",
+			float64(terms.ReserveBps)/100, terms.ReserveHoldDays, terms.PayoutDelayDays, currencyOrDefault(DefaultCurrency).Format(terms.MaxPayment))
+	}
+	NotifyUser(ctx, fs, uid, NotificationRiskTierChanged, "Your account terms changed", body,
+		map[string]interface{}{"from": from, "tier": tier})
+	return nil
+}
+
+// AssessRiskTiers rescores every business and moves those whose tier
+// changed, unless an admin has pinned it. A business whose dispute rate
+// reaches accountHoldDisputeRate is also put on hold.
+func AssessRiskTiers(ctx context.Context, d *webhookDeps) error {
+	docs, err := QueryUsers(ctx, d.fs, func(users *firestore.CollectionRef) firestore.Query {
+		return users.Where("service_provider", "==", true)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load businesses: %w", err)
+	}
+	now := time.Now()
+	for _, doc := range docs {
+		uid := doc.Ref.ID
+		metrics, err := LoadRiskMetrics(ctx, d.fs, uid, now)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to score risk", "component", "risk_tiers", "user_id", uid, "error", err)
+			continue
+		}
+		assessment := RiskAssessment{Tier: scoreRiskTier(metrics), Metrics: metrics, AssessedAt: now}
+		if err := SaveUserFields(ctx, d.fs, uid, map[string]interface{}{"risk_assessment": assessment}); err != nil {
+			slog.ErrorContext(ctx, "failed to save risk assessment", "component", "risk_tiers", "user_id", uid, "error", err)
+			continue
+		}
+		if metrics.DisputeRate >= accountHoldDisputeRate && stringField(doc.Data(), "hold_id") == "" {
+			reason := fmt.Sprintf("Dispute rate of %.1f%% over %d payments", metrics.DisputeRate*100, metrics.Payments)
+			if _, err := PlaceAccountHold(ctx, d.fs, uid, reason, HoldRuleDisputeRate, ""); err != nil && !errors.Is(err, errHoldExists) {
+				slog.ErrorContext(ctx, "failed to hold account", "component", "risk_tiers", "user_id", uid, "error", err)
+			}
+		}
+		if _, pinned := doc.Data()["risk_override"].(map[string]interface{}); pinned {
+			continue
+		}
+		current := stringField(doc.Data(), "risk_tier")
+		if current == "" {
+			current = RiskTierLow
+		}
+		if assessment.Tier != current {
+			if err := applyRiskTier(ctx, d.fs, d.sc, uid, current, assessment.Tier); err != nil {
+				slog.ErrorContext(ctx, "failed to apply risk tier", "component", "risk_tiers", "user_id", uid, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// GetUserRisk shows admins a recipient's tier, override, stored assessment,
+// and metrics as of now
+func GetUserRisk(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	uid := c.Param("uid")
+
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	metrics, err := LoadRiskMetrics(ctx, fs, uid, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to score risk"})
+		return
+	}
+	tier := recipientRiskTier(ctx, fs, uid)
+	c.JSON(http.StatusOK, gin.H{
+		"tier":            tier,
+		"terms":           riskTierTerms[tier],
+		"override":        doc.Data()["risk_override"],
+		"assessment":      doc.Data()["risk_assessment"],
+		"metrics":         metrics,
+		"scored_tier_now": scoreRiskTier(metrics),
+	})
+}
+
+// SetUserRiskTier lets an admin pin a recipient's tier, or with an empty
+// tier return them to their scored one. The change applies at once.
+func SetUserRiskTier(c *gin.Context) {
+	var req struct {
+		Tier   string `json:"tier"`
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := riskTierTerms[req.Tier]; req.Tier != "" && !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tier must be low, elevated, or high"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	var sc *StripeClient
+	if s, ok := c.Get("stripeClient"); ok {
+		sc = s.(*StripeClient)
+	}
+	ctx := c.Request.Context()
+	uid := c.Param("uid")
+
+	if _, err := getDocument(ctx, UserDoc(ctx, fs, uid)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	tier := req.Tier
+	var override interface{} = firestore.Delete
+	if tier != "" {
+		override = RiskOverride{Tier: tier, Reason: req.Reason, SetBy: c.GetString("userID"), SetAt: time.Now()}
+	} else {
+		metrics, err := LoadRiskMetrics(ctx, fs, uid, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to score risk"})
+			return
+		}
+		tier = scoreRiskTier(metrics)
+	}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{"risk_override": override}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save risk tier"})
+		return
+	}
+	if from := recipientRiskTier(ctx, fs, uid); from != tier {
+		if err := applyRiskTier(ctx, fs, sc, uid, from, tier); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply risk tier"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"tier": tier, "terms": riskTierTerms[tier], "pinned": req.Tier != ""})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// SCA exemptions a card payment may be sent under
+const (
+	SCAExemptionNone              = "none"
+	SCAExemptionLowValue          = "low_value"
+	SCAExemptionMerchantInitiated = "merchant_initiated"
+)
+
+// scaLowValueLimit is the PSD2 low-value exemption ceiling (EUR 30) in cents.
+// Issuers count exempted payments and may still challenge, so it only lets
+// Stripe try the exemption.
+const scaLowValueLimit = 3000
+
+// errOffSessionNotSetUp is returned for a merchant-initiated charge on a card
+// the customer never authorized for off-session use with a SetupIntent
+var errOffSessionNotSetUp = errors.New("payment method was not set up for off-session use")
+
+// SCAPolicy is how a card payment is authenticated under PSD2
+type SCAPolicy struct {
+	Exemption string
+	// RequestThreeDSecure is Stripe's request_three_d_secure: "any" always
+	// authenticates, "automatic" leaves it to Stripe's and the issuer's rules
+	RequestThreeDSecure string
+	OffSession          bool
+}
+
+// PaymentNextAction is what the client must do before a payment can proceed,
+// typically completing 3D Secure with stripe.handleCardAction(client_secret)
+// and then calling /stripe/transfers/{id}/finalize
+type PaymentNextAction struct {
+	Type        string `json:"type"`
+	RedirectURL string `json:"redirect_url,omitempty"`
+}
+
+// scaPolicyFor decides how a card payment is authenticated. Only cards issued
+// in the EU/EEA are in scope for SCA; they authenticate unless the payment is
+// merchant-initiated or qualifies for the low-value exemption. Stripe's test
+// cards 4000002760003184 (always authenticates) and 4000002500003155
+// (authenticates on-session, then exempt off-session) exercise both paths.
+func scaPolicyFor(pm *stripe.PaymentMethod, amount int64, currency string, offSession bool) SCAPolicy {
+	if pm == nil || pm.Card == nil || !euCountries[strings.ToUpper(pm.Card.Country)] {
+		return SCAPolicy{Exemption: SCAExemptionNone, RequestThreeDSecure: "automatic", OffSession: offSession}
+	}
+	switch {
+	case offSession:
+		return SCAPolicy{Exemption: SCAExemptionMerchantInitiated, OffSession: true}
+	case strings.EqualFold(currency, "eur") && amount <= scaLowValueLimit:
+		return SCAPolicy{Exemption: SCAExemptionLowValue, RequestThreeDSecure: "automatic"}
+	default:
+		return SCAPolicy{Exemption: SCAExemptionNone, RequestThreeDSecure: "any"}
+	}
+}
+
+// cardSCAPolicy loads the payment method and returns its SCA policy
+func cardSCAPolicy(ctx context.Context, sc *StripeClient, paymentMethodID string, amount int64, currency string, offSession bool) (SCAPolicy, error) {
+	if paymentMethodID == "" {
+		return scaPolicyFor(nil, amount, currency, offSession), nil
+	}
+	pm, err := sc.GetPaymentMethod(ctx, paymentMethodID)
+	if err != nil {
+		return SCAPolicy{}, err
+	}
+	return scaPolicyFor(pm, amount, currency, offSession), nil
+}
+
+// providerSCAPolicy returns the SCA policy for a charge through pp. Only Stripe
+// takes cards, so other providers charge with the zero policy.
+func providerSCAPolicy(ctx context.Context, pp PaymentProvider, paymentMethodID string, amount int64, currency string, offSession bool) (SCAPolicy, error) {
+	sc, ok := pp.(*StripeClient)
+	if !ok {
+		return SCAPolicy{}, nil
+	}
+	return cardSCAPolicy(ctx, sc, paymentMethodID, amount, currency, offSession)
+}
+
+// requireOffSessionSetup checks that the user saved the payment method through a
+// SetupIntent with usage off_session, which is where the customer authenticated
+// and agreed to merchant-initiated charges
+func requireOffSessionSetup(ctx context.Context, fs *firestore.Client, uid, paymentMethodID string) error {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return fmt.Errorf("failed to load user %s: %w", uid, err)
+	}
+	verified, _ := doc.Data()["verified_payment_methods"].([]interface{})
+	if !slices.Contains(verified, interface{}(paymentMethodID)) {
+		return errOffSessionNotSetUp
+	}
+	return nil
+}
+
+// paymentNextAction extracts the client action a PaymentIntent is waiting on
+func paymentNextAction(pi *stripe.PaymentIntent) *PaymentNextAction {
+	if pi.Status != stripe.PaymentIntentStatusRequiresAction || pi.NextAction == nil {
+		return nil
+	}
+	action := &PaymentNextAction{Type: string(pi.NextAction.Type)}
+	if pi.NextAction.RedirectToURL != nil {
+		action.RedirectURL = pi.NextAction.RedirectToURL.URL
+	}
+	return action
+}
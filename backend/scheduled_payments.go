@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Event types emitted when a scheduled or recurring payment runs
+const (
+	EventScheduledPaymentExecuted = "scheduled_payment.executed"
+	EventScheduledPaymentFailed   = "scheduled_payment.failed"
+	EventScheduledPaymentSkipped  = "scheduled_payment.skipped"
+)
+
+// Notification types for scheduled payment outcomes
+const (
+	NotificationScheduledPaymentExecuted = "scheduled_payment_executed"
+	NotificationScheduledPaymentFailed   = "scheduled_payment_failed"
+	NotificationScheduledPaymentSkipped  = "scheduled_payment_skipped"
+)
+
+// Reasons a scheduled payment was skipped without being attempted
+const (
+	SkipReasonInsufficientBalance = "insufficient_balance"
+	// SkipReasonMandateInvalid means CheckRecurringMandate refused the run
+	SkipReasonMandateInvalid = "mandate_invalid"
+)
+
+// ScheduledPaymentOutcome describes one run of a scheduled or recurring payment.
+// TransactionID is empty when the run was skipped before a payment was created.
+type ScheduledPaymentOutcome struct {
+	ScheduleID      string
+	SenderUserID    string
+	RecipientUserID string
+	TransactionID   string
+	Amount          int64
+	Currency        string
+	// Status is "executed", "failed", or "skipped"
+	Status string
+	Reason string
+	RunAt  time.Time
+}
+
+// retryAction is the one-tap action the app offers alongside a failed or
+// skipped run: failed payments retry through POST /payments/:id/retry, skipped
+// runs have no payment yet and are retried against their schedule.
+func (o ScheduledPaymentOutcome) retryAction() map[string]interface{} {
+	if o.TransactionID != "" {
+		return map[string]interface{}{
+			"type":           "retry_payment",
+			"method":         "POST",
+			"path":           "/payments/" + o.TransactionID + "/retry",
+			"transaction_id": o.TransactionID,
+		}
+	}
+	return map[string]interface{}{
+		"type":        "retry_scheduled_payment",
+		"schedule_id": o.ScheduleID,
+	}
+}
+
+// ReportScheduledPaymentOutcome publishes a feed event for a scheduled payment
+// run and notifies the sender, including the reason and a retry action when the
+// run did not go through. The scheduler calls this after every run.
+func ReportScheduledPaymentOutcome(ctx context.Context, fs *firestore.Client, o ScheduledPaymentOutcome) error {
+	if o.ScheduleID == "" || o.SenderUserID == "" {
+		return fmt.Errorf("scheduled payment outcome requires a schedule and sender")
+	}
+	if o.RunAt.IsZero() {
+		o.RunAt = time.Now()
+	}
+	currency := strings.ToUpper(o.Currency)
+	if currency == "" {
+		currency = strings.ToUpper(DefaultCurrency)
+	}
+	amount := currencyOrDefault(currency).Format(o.Amount)
+
+	var eventType, notificationType, title, body string
+	switch o.Status {
+	case "executed":
+		eventType, notificationType = EventScheduledPaymentExecuted, NotificationScheduledPaymentExecuted
+		title = "Scheduled payment sent"
+		body = fmt.Sprintf("Your scheduled payment of %s was sent.", amount)
+	case "failed":
+		eventType, notificationType = EventScheduledPaymentFailed, NotificationScheduledPaymentFailed
+		title = "Scheduled payment failed"
+		body = fmt.Sprintf("Your scheduled payment of %s didn't go through.", amount)
+	case "skipped":
+		eventType, notificationType = EventScheduledPaymentSkipped, NotificationScheduledPaymentSkipped
+		title = "Scheduled payment skipped"
+		body = fmt.Sprintf("Your scheduled payment of %s was skipped.", amount)
+		switch o.Reason {
+		case SkipReasonInsufficientBalance:
+			body = fmt.Sprintf("Your scheduled payment of %s was skipped because your balance was too low.", amount)
+		case SkipReasonMandateInvalid:
+			body = fmt.Sprintf("Your scheduled payment of %s was skipped because your recurring debit authorization is revoked or doesn't cover it.", amount)
+		}
+	default:
+		return fmt.Errorf("unknown scheduled payment status %q", o.Status)
+	}
+
+	data := map[string]interface{}{
+		"schedule_id": o.ScheduleID,
+		"status":      o.Status,
+		"amount":      o.Amount,
+		"currency":    strings.ToLower(currency),
+		"run_at":      o.RunAt,
+	}
+	if o.TransactionID != "" {
+		data["transaction_id"] = o.TransactionID
+	}
+	if o.Reason != "" {
+		data["reason"] = o.Reason
+	}
+	if o.Status != "executed" {
+		data["action"] = o.retryAction()
+	}
+
+	userIDs := []string{o.SenderUserID}
+	if o.Status == "executed" && o.RecipientUserID != "" {
+		userIDs = append(userIDs, o.RecipientUserID)
+	}
+	PublishEvent(ctx, fs, Event{
+		Type:          eventType,
+		UserIDs:       userIDs,
+		TransactionID: o.TransactionID,
+		Data:          data,
+		CreatedAt:     o.RunAt,
+	})
+	NotifyUser(ctx, fs, o.SenderUserID, notificationType, title, body, data)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import "time"
+
+// DocumentSchemaVersion is the version of the client-facing document contract
+// described in FIRESTORE_SCHEMA.md. Bump it whenever a field is renamed or its
+// meaning changes, and register a Migration in migrations.go that brings
+// existing documents to the new version; adding optional fields does not
+// require a bump.
+const DocumentSchemaVersion = 1
+
+// transactionFields lists every field a transactions/{id} document may contain
+var transactionFields = map[string]bool{
+	"schema_version":    true,
+	"region":            true,
+	"participants":      true,
+	"sender_user_id":    true,
+	"recipient_user_id": true,
+	"amount":            true,
+	"currency":          true,
+	"payment_intent_id": true,
+	"transfer_id":       true,
+	"status":            true,
+	"created_at":        true,
+
+	"payment_method_id":       true,
+	"failure_code":            true,
+	"original_transaction_id": true,
+	"previous_attempt_id":     true,
+	"attempt":                 true,
+	"retry_available":         true,
+	"retried_by":              true,
+	"payment_request_id":      true,
+	"updated_at":              true,
+
+	"transfer_status":          true,
+	"transfer_attempts":        true,
+	"transfer_error":           true,
+	"transfer_retry_at":        true,
+	"compensation_refund_id":   true,
+	"stripe_error":             true,
+	"sca_exemption":            true,
+	"escrow_status":            true,
+	"fee":                      true,
+	"fee_amount":               true,
+	"tip_amount":               true,
+	"line_items":               true,
+	"escrow_expires_at":        true,
+	"escrow_lease_until":       true,
+	"ach_authorization_id":     true,
+	"bulk_refund_id":           true,
+	"refund_request_id":        true,
+	"amount_refunded":          true,
+	"ach_return_code":          true,
+	"failure_reason":           true,
+	"returned_at":              true,
+	"clawback_status":          true,
+	"clawback_reversal_id":     true,
+	"clawback_error":           true,
+	"transfer_reversed_amount": true,
+	"transfer_reversed_at":     true,
+	"reserve_amount":           true,
+	"fx_quote_id":              true,
+	"fx_rate":                  true,
+	"fx_target_amount":         true,
+	"fx_target_currency":       true,
+	"report_id":                true,
+	"hold_id":                  true,
+	"risk_assessment_id":       true,
+	"client_platform":          true,
+	"client_version":           true,
+}
+
+// NotificationDocument is the contract for notifications/{id} documents.
+// user_id is the owner and the field security rules match against.
+type NotificationDocument struct {
+	ID            string                 `json:"id" firestore:"-"`
+	SchemaVersion int                    `json:"schema_version" firestore:"schema_version"`
+	Region        string                 `json:"region,omitempty" firestore:"region,omitempty"`
+	UserID        string                 `json:"user_id" firestore:"user_id"`
+	Type          string                 `json:"type" firestore:"type"`
+	Title         string                 `json:"title" firestore:"title"`
+	Body          string                 `json:"body" firestore:"body"`
+	Data          map[string]interface{} `json:"data,omitempty" firestore:"data,omitempty"`
+	Read          bool                   `json:"read" firestore:"read"`
+	CreatedAt     time.Time              `json:"created_at" firestore:"created_at"`
+	UpdatedAt     time.Time              `json:"updated_at" firestore:"updated_at"`
+}
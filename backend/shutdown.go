@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout bounds draining on SIGTERM; Cloud Run and Kubernetes
+// allow 10 and 30 seconds before SIGKILL
+const defaultShutdownTimeout = 25 * time.Second
+
+// shutdownTimeout is how long in-flight requests and background work get to
+// finish once shutdown starts (SHUTDOWN_TIMEOUT, default 25s)
+func shutdownTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultShutdownTimeout
+}
+
+// drainGroup tracks background work that must finish before the process
+// exits, such as a job run part way through a transfer. Once closed it
+// accepts no new work.
+type drainGroup struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// inflightWork is the background work shutdown waits for: job runs, webhook
+// jobs, and the audit writes requests leave behind
+var inflightWork drainGroup
+
+// start registers one piece of work, reporting false once shutdown has begun
+func (g *drainGroup) start() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+// done marks work registered with start as finished
+func (g *drainGroup) done() {
+	g.wg.Done()
+}
+
+// close stops new work and waits for what is running, up to ctx's deadline
+func (g *drainGroup) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdownHook releases a resource once requests and background work have drained
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Shutdown drains srv, then stops background work, then runs hooks in order.
+// Requests are drained first so nothing they queue is dropped; work that
+// doesn't finish in time is picked up by another instance when its lease lapses.
+func Shutdown(ctx context.Context, srv *http.Server, stopBackground context.CancelFunc, hooks []shutdownHook) {
+	slog.InfoContext(ctx, "shutting down", "component", "server")
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.ErrorContext(ctx, "requests did not drain", "component", "server", "error", err)
+	}
+	stopBackground()
+	if err := inflightWork.close(ctx); err != nil {
+		slog.ErrorContext(ctx, "background work did not drain", "component", "server", "error", err)
+	}
+	for _, hook := range hooks {
+		if err := hook.fn(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			slog.ErrorContext(ctx, "shutdown hook failed", "component", "server", "hook", hook.name, "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "shutdown complete", "component", "server")
+}
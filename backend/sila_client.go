@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -97,6 +100,11 @@ func NewSilaClient() (*SilaClient, error) {
 		baseURL = "https://sandbox.silamoney.com" // Default to sandbox
 	}
 
+	base, err := providerTransport(DependencySila)
+	if err != nil {
+		return nil, fmt.Errorf("sila egress: %w", err)
+	}
+
 	return &SilaClient{
 		baseURL:      baseURL,
 		appHandle:    appHandle,
@@ -104,7 +112,8 @@ func NewSilaClient() (*SilaClient, error) {
 		clientSecret: clientSecret,
 		privateKey:   privateKey,
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: &deadlineTransport{dependency: DependencySila, base: tracedTransport("sila", base)},
 		},
 	}, nil
 }
@@ -129,6 +138,9 @@ func (sc *SilaClient) makeRequest(ctx context.Context, method, endpoint string,
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("authsignature", sc.generateAuthSignature(payload))
 	req.Header.Set("usersignature", sc.generateUserSignature(payload))
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
 
 	return sc.httpClient.Do(req)
 }
@@ -421,4 +433,39 @@ func (sc *SilaClient) TestConnection(ctx context.Context) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// SilaWebhookEvent is the callback payload Sila posts for transaction and KYC events
+type SilaWebhookEvent struct {
+	EventType    string `json:"event_type"` // "transaction", "kyc"
+	EventUUID    string `json:"event_uuid"`
+	EventDetails struct {
+		Transaction     string  `json:"transaction"`
+		TransactionType string  `json:"transaction_type"` // "issue", "redeem", "transfer"
+		SilaAmount      float64 `json:"sila_amount"`
+		Entity          string  `json:"entity"`  // user handle
+		Outcome         string  `json:"outcome"` // transactions: "success", "failed", "returned"; kyc: "passed", "failed", "review"
+		KYCLevel        string  `json:"kyc_level,omitempty"`
+	} `json:"event_details"`
+}
+
+// ValidateWebhook verifies the HMAC-SHA256 signature Sila attaches to callbacks
+func (sc *SilaClient) ValidateWebhook(payload []byte, signature string) (*SilaWebhookEvent, error) {
+	webhookSecret := os.Getenv("SILA_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		return nil, fmt.Errorf("SILA_WEBHOOK_SECRET not configured")
+	}
+
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(payload)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, fmt.Errorf("invalid webhook signature")
+	}
+
+	var event SilaWebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook payload: %w", err)
+	}
+	return &event, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Sila transaction outcomes reported by webhook
+const (
+	SilaOutcomeSuccess = "success"
+	SilaOutcomeFailed  = "failed"
+	// SilaOutcomeReturned is an ACH return after the transaction settled
+	SilaOutcomeReturned = "returned"
+)
+
+// Sila KYC outcomes reported by webhook
+const (
+	SilaKYCPassed = "passed"
+	SilaKYCFailed = "failed"
+)
+
+// userIDForSilaHandle resolves the Firebase UID that owns a Sila user handle
+func userIDForSilaHandle(ctx context.Context, fs *firestore.Client, handle string) (string, error) {
+	docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+		return users.Where("sila_user_handle", "==", handle).Limit(1)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(docs) == 0 {
+		return "", fmt.Errorf("no user for sila handle %s", handle)
+	}
+	return docs[0].Ref.ID, nil
+}
+
+// HandleSilaWebhook reflects Sila transaction and KYC outcomes into Firestore.
+// Settled deposits and withdrawals move the wallet; failed and returned ones
+// reverse whatever the wallet already recorded for them. Like the Stripe
+// webhook, each event is processed once, and a non-2xx makes Sila redeliver.
+func HandleSilaWebhook(c *gin.Context) {
+	silaClient, exists := c.Get("silaClient")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Sila client not available"})
+		return
+	}
+	sila := silaClient.(*SilaClient)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	event, err := sila.ValidateWebhook(payload, c.GetHeader("X-Sila-Signature"))
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "sila webhook validation failed", "component", "sila", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var eventRef *firestore.DocumentRef
+	if event.EventUUID != "" {
+		eventRef = fs.Collection("sila_webhook_events").Doc(event.EventUUID)
+		if snap, err := eventRef.Get(ctx); err == nil && snap.Exists() {
+			c.JSON(http.StatusOK, gin.H{"received": true})
+			return
+		} else if err != nil && status.Code(err) != codes.NotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check event"})
+			return
+		}
+	}
+
+	switch event.EventType {
+	case "transaction":
+		err = processSilaTransaction(c, fs, event)
+	case "kyc":
+		err = processSilaKYC(ctx, fs, event)
+	}
+	if err != nil {
+		// The entry references keep the redelivery idempotent
+		slog.ErrorContext(ctx, "failed to process sila webhook", "component", "sila", "event_uuid", event.EventUUID, "event_type", event.EventType, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event"})
+		return
+	}
+
+	if eventRef != nil {
+		details := event.EventDetails
+		if _, err := eventRef.Set(ctx, map[string]interface{}{
+			"event_type":   event.EventType,
+			"transaction":  details.Transaction,
+			"entity":       details.Entity,
+			"outcome":      details.Outcome,
+			"processed_at": time.Now(),
+		}); err != nil {
+			slog.WarnContext(ctx, "failed to record sila webhook", "component", "sila", "event_uuid", event.EventUUID, "error", err)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// processSilaTransaction applies a transaction outcome to the wallet and the
+// deposit or withdrawal record
+func processSilaTransaction(c *gin.Context, fs *firestore.Client, event *SilaWebhookEvent) error {
+	ctx := c.Request.Context()
+	details := event.EventDetails
+	switch details.Outcome {
+	case SilaOutcomeSuccess:
+	case SilaOutcomeFailed, SilaOutcomeReturned:
+		if err := reverseSilaTransaction(c, fs, details.Transaction, details.TransactionType, details.Entity); err != nil {
+			return err
+		}
+		transferStatus := SilaTransferFailed
+		if details.Outcome == SilaOutcomeReturned {
+			transferStatus = SilaTransferReturned
+		}
+		setSilaTransferStatus(ctx, fs, details.Transaction, transferStatus)
+		return nil
+	default:
+		return nil
+	}
+
+	var amount int64
+	var notificationType, title string
+	switch details.TransactionType {
+	case "issue":
+		amount = int64(details.SilaAmount)
+		notificationType, title = NotificationWalletCredited, "Deposit completed"
+	case "redeem":
+		amount = -int64(details.SilaAmount)
+		notificationType, title = NotificationWalletDebited, "Withdrawal completed"
+	default:
+		// Wallet-to-wallet transfers are recorded when they are sent
+		return nil
+	}
+
+	uid, err := userIDForSilaHandle(ctx, fs, details.Entity)
+	if err != nil {
+		slog.WarnContext(ctx, "unmatched sila webhook", "component", "sila", "event_uuid", event.EventUUID, "error", err)
+		return nil
+	}
+
+	entry := &WalletEntry{
+		UserID:    uid,
+		Reference: details.Transaction,
+		Source:    "sila",
+		Type:      details.TransactionType,
+		Amount:    amount,
+	}
+	applied, err := ApplyWalletEntry(ctx, fs, entry, details.Entity)
+	if err != nil {
+		return fmt.Errorf("failed to apply sila settlement: %w", err)
+	}
+	setSilaTransferStatus(ctx, fs, details.Transaction, SilaTransferSuccess)
+
+	if applied {
+		recordWalletMovement(c, fs, entry)
+		NotifyUser(ctx, fs, uid, notificationType, title,
+			fmt.Sprintf("%s has settled in your wallet", currencyOrDefault(walletCurrency).Format(abs64(amount))),
+			map[string]interface{}{"sila_transaction_id": details.Transaction})
+	}
+	return nil
+}
+
+// silaReversalMessages are the notification title and body for reversing each
+// kind of wallet entry
+var silaReversalMessages = map[string][2]string{
+	"issue":        {"Deposit returned", "Your bank returned a %s deposit, so it has been taken back out of your wallet"},
+	"redeem":       {"Withdrawal failed", "Your %s withdrawal couldn't be completed and has been returned to your wallet"},
+	"transfer_out": {"Transfer failed", "Your %s transfer couldn't be completed and has been returned to your wallet"},
+	"transfer_in":  {"Transfer reversed", "A %s transfer to your wallet was reversed"},
+}
+
+// reverseSilaTransaction undoes the wallet entries recorded for a failed or
+// returned Sila transaction, referencing each as {reference}_reversal so a
+// redelivery reverses once. A deposit or withdrawal the wallet hasn't recorded
+// yet is voided instead, so its success arriving late changes nothing.
+func reverseSilaTransaction(c *gin.Context, fs *firestore.Client, txID, transactionType, handle string) error {
+	ctx := c.Request.Context()
+	references := []string{txID}
+	if transactionType == "transfer" {
+		references = append(references, txID+"_in")
+	}
+	for _, reference := range references {
+		snap, err := fs.Collection("wallet_entries").Doc(reference).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			if reference != txID {
+				continue
+			}
+			uid, err := userIDForSilaHandle(ctx, fs, handle)
+			if err != nil {
+				slog.WarnContext(ctx, "unmatched sila webhook", "component", "sila", "sila_transaction", txID, "error", err)
+				return nil
+			}
+			void := &WalletEntry{UserID: uid, Reference: reference, Source: ProcessorSila, Type: transactionType + "_void"}
+			if _, err := ApplyWalletEntry(ctx, fs, void, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var original WalletEntry
+		if err := snap.DataTo(&original); err != nil {
+			return err
+		}
+		if original.Amount == 0 {
+			continue
+		}
+		reversal := &WalletEntry{
+			UserID:    original.UserID,
+			Reference: reference + "_reversal",
+			Source:    ProcessorSila,
+			Type:      original.Type + "_reversal",
+			Amount:    -original.Amount,
+		}
+		applied, err := ApplyWalletEntry(ctx, fs, reversal, "")
+		if err != nil {
+			return err
+		}
+		if !applied {
+			continue
+		}
+		recordWalletMovement(c, fs, reversal)
+		notificationType := NotificationWalletCredited
+		if reversal.Amount < 0 {
+			notificationType = NotificationWalletDebited
+		}
+		message, ok := silaReversalMessages[original.Type]
+		if !ok {
+			message = [2]string{"Wallet adjusted", "A %s wallet transaction was reversed"}
+		}
+		NotifyUser(ctx, fs, original.UserID, notificationType, message[0],
+			fmt.Sprintf(message[1], currencyOrDefault(walletCurrency).Format(abs64(original.Amount))),
+			map[string]interface{}{"sila_transaction_id": txID})
+	}
+	return nil
+}
+
+// processSilaKYC records a user's identity verification outcome and tells
+// them once it passes or fails
+func processSilaKYC(ctx context.Context, fs *firestore.Client, event *SilaWebhookEvent) error {
+	details := event.EventDetails
+	uid, err := userIDForSilaHandle(ctx, fs, details.Entity)
+	if err != nil {
+		slog.WarnContext(ctx, "unmatched sila webhook", "component", "sila", "event_uuid", event.EventUUID, "error", err)
+		return nil
+	}
+	fields := map[string]interface{}{
+		"sila_status":         details.Outcome,
+		"sila_kyc_updated_at": time.Now(),
+	}
+	if details.KYCLevel != "" {
+		fields["sila_kyc_level"] = details.KYCLevel
+	}
+	if err := SaveUserFields(ctx, fs, uid, fields); err != nil {
+		return err
+	}
+	if details.Outcome == SilaKYCPassed || details.Outcome == SilaKYCFailed {
+		if _, err := RecordKYCOutcome(ctx, fs, &KYCVerification{
+			UserID:    uid,
+			Source:    KYCSourceSila,
+			Reference: details.Entity,
+			Passed:    details.Outcome == SilaKYCPassed,
+			Level:     silaKYCLevel(details.KYCLevel),
+		}); err != nil {
+			return err
+		}
+	}
+
+	switch details.Outcome {
+	case SilaKYCPassed:
+		NotifyUser(ctx, fs, uid, NotificationWalletVerified, "Wallet verified",
+			"Your identity is verified and your wallet is ready to use", nil)
+	case SilaKYCFailed:
+		NotifyUser(ctx, fs, uid, NotificationWalletVerified, "Verification unsuccessful",
+			"We couldn't verify your identity. Check your details and try again.", nil)
+	}
+	return nil
+}
+
+// silaKYCLevel maps the Sila KYC level a user passed to a KYC level. Sila's
+// lighter levels check identity without documents.
+func silaKYCLevel(level string) string {
+	switch level {
+	case "KYC-LITE", "RECEIVE_ONLY":
+		return KYCBasic
+	default:
+		return KYCVerified
+	}
+}
+
+// abs64 returns the absolute value of n
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
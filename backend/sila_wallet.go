@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Sila transfer statuses kept on sila_transfers/{transactionID}
+const (
+	SilaTransferPending = "pending"
+	SilaTransferSuccess = "success"
+	SilaTransferFailed  = "failed"
+	// SilaTransferReturned is a deposit or withdrawal the bank returned after it settled
+	SilaTransferReturned = "returned"
+)
+
+// silaAccountNamePattern is what Sila accepts as a linked account's name
+var silaAccountNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,40}$`)
+
+// SilaBankAccount is a bank account linked to a user's Sila wallet, kept at
+// users/{uid}.sila_bank_accounts.{name}. Only the last four digits are stored.
+type SilaBankAccount struct {
+	Name     string    `json:"name" firestore:"name"`
+	Mask     string    `json:"mask" firestore:"mask"`
+	LinkedAt time.Time `json:"linked_at" firestore:"linked_at"`
+}
+
+// SilaTransferRecord tracks a deposit or withdrawal until Sila settles it,
+// kept at sila_transfers/{transactionID}. The wallet balance itself moves
+// through wallet_entries.
+type SilaTransferRecord struct {
+	UserID      string    `json:"user_id" firestore:"user_id"`
+	Type        string    `json:"type" firestore:"type"` // issue (deposit) or redeem (withdrawal)
+	Amount      int64     `json:"amount" firestore:"amount"`
+	AccountName string    `json:"account_name" firestore:"account_name"`
+	Status      string    `json:"status" firestore:"status"`
+	CreatedAt   time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// silaRequestClients returns the Sila client, Firestore, and the caller's UID,
+// writing the error response if any is missing
+func silaRequestClients(c *gin.Context) (*SilaClient, *firestore.Client, string, bool) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, nil, "", false
+	}
+	silaClient, exists := c.Get("silaClient")
+	if !exists {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Wallet is not available"})
+		return nil, nil, "", false
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return nil, nil, "", false
+	}
+	return silaClient.(*SilaClient), v.(*firestore.Client), uidVal.(string), true
+}
+
+// RegisterSilaUser creates the caller's Sila entity and wallet. The identity
+// number is passed to Sila for KYC and not stored.
+func RegisterSilaUser(c *gin.Context) {
+	var req struct {
+		FirstName string `json:"first_name" binding:"required,max=100"`
+		LastName  string `json:"last_name" binding:"required,max=100"`
+		Phone     string `json:"phone" binding:"required"`
+		Address   struct {
+			StreetAddress1 string `json:"street_address_1" binding:"required"`
+			StreetAddress2 string `json:"street_address_2"`
+			City           string `json:"city" binding:"required"`
+			State          string `json:"state" binding:"required,len=2"`
+			PostalCode     string `json:"postal_code" binding:"required"`
+		} `json:"address" binding:"required"`
+		SSN string `json:"ssn" binding:"required,len=9,numeric"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sila, fs, uid, ok := silaRequestClients(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if handle, err := walletHandleForUser(ctx, fs, uid, ProcessorSila); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already have a wallet", "user_handle": handle})
+		return
+	}
+
+	account, err := sila.RegisterUser(ctx, &SilaAccount{
+		UserHandle: "dp-" + uuid.NewString(),
+		FirstName:  req.FirstName,
+		LastName:   req.LastName,
+		Email:      c.GetString("email"),
+		Phone:      normalizePhone(req.Phone),
+		Address: &SilaAddress{
+			AddressAlias:   "home",
+			StreetAddress1: req.Address.StreetAddress1,
+			StreetAddress2: req.Address.StreetAddress2,
+			City:           req.Address.City,
+			State:          req.Address.State,
+			PostalCode:     req.Address.PostalCode,
+			Country:        "US",
+		},
+		Identity: &SilaIdentity{IdentityAlias: "SSN", IdentityValue: req.SSN, IdentityType: "SSN"},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "sila registration failed", "component", "sila", "user_id", uid, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create wallet"})
+		return
+	}
+
+	now := time.Now()
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"sila_user_handle":   account.UserHandle,
+		"sila_status":        account.Status,
+		"sila_registered_at": now,
+	}); errors.Is(err, ErrProcessorRestricted) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This feature is not available in your region", "code": "processor_restricted"})
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "failed to save sila handle", "component", "sila", "user_id", uid, "user_handle", account.UserHandle, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save wallet"})
+		return
+	}
+	// The wallet document is what the drift check and holds work from
+	if _, err := fs.Collection("wallets").Doc(uid).Set(ctx, map[string]interface{}{
+		"user_id":          uid,
+		"sila_user_handle": account.UserHandle,
+		"currency":         walletCurrency,
+		"updated_at":       now,
+	}, firestore.MergeAll); err != nil {
+		slog.ErrorContext(ctx, "failed to create wallet", "component", "sila", "user_id", uid, "error", err)
+	}
+	c.JSON(http.StatusCreated, gin.H{"user_handle": account.UserHandle, "status": account.Status})
+}
+
+// LinkSilaBankAccount links a checking account to the caller's wallet for
+// deposits and withdrawals
+func LinkSilaBankAccount(c *gin.Context) {
+	var req struct {
+		AccountName   string `json:"account_name"`
+		AccountNumber string `json:"account_number" binding:"required,min=4,max=17,numeric"`
+		RoutingNumber string `json:"routing_number" binding:"required,len=9,numeric"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.AccountName == "" {
+		req.AccountName = "default"
+	}
+	if !silaAccountNamePattern.MatchString(req.AccountName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "account_name may only contain letters, digits, - and _"})
+		return
+	}
+	sila, fs, uid, ok := silaRequestClients(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	handle, err := walletHandleForUser(ctx, fs, uid, ProcessorSila)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You don't have a wallet yet"})
+		return
+	}
+	if err := sila.LinkBankAccount(ctx, handle, req.AccountNumber, req.RoutingNumber, req.AccountName); err != nil {
+		slog.ErrorContext(ctx, "sila link account failed", "component", "sila", "user_id", uid, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to link bank account"})
+		return
+	}
+
+	account := SilaBankAccount{Name: req.AccountName, Mask: req.AccountNumber[len(req.AccountNumber)-4:], LinkedAt: time.Now()}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"sila_bank_accounts": map[string]interface{}{account.Name: account},
+	}); err != nil {
+		slog.ErrorContext(ctx, "failed to save linked account", "component", "sila", "user_id", uid, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save linked account"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"account": account})
+}
+
+// silaTransferRequest is the body of a deposit or withdrawal
+type silaTransferRequest struct {
+	Amount         int64  `json:"amount" binding:"required,min=100"` // cents
+	AccountName    string `json:"account_name"`
+	ProcessingType string `json:"processing_type" binding:"omitempty,oneof=STANDARD_ACH SAME_DAY_ACH"`
+}
+
+// bindSilaTransfer reads a deposit or withdrawal and resolves the caller's
+// handle and linked account, writing the error response on failure
+func bindSilaTransfer(c *gin.Context, fs *firestore.Client, uid string) (*silaTransferRequest, string, bool) {
+	var req silaTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	if req.AccountName == "" {
+		req.AccountName = "default"
+	}
+	if req.ProcessingType == "" {
+		req.ProcessingType = "STANDARD_ACH"
+	}
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You don't have a wallet yet"})
+		return nil, "", false
+	}
+	handle := stringField(doc.Data(), "sila_user_handle")
+	if handle == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You don't have a wallet yet"})
+		return nil, "", false
+	}
+	accounts, _ := doc.Data()["sila_bank_accounts"].(map[string]interface{})
+	if _, linked := accounts[req.AccountName]; !linked {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Link a bank account first"})
+		return nil, "", false
+	}
+	return &req, handle, true
+}
+
+// recordSilaTransfer saves a pending deposit or withdrawal
+func recordSilaTransfer(c *gin.Context, fs *firestore.Client, txID string, record SilaTransferRecord) {
+	ctx := c.Request.Context()
+	record.Status = SilaTransferPending
+	record.CreatedAt = time.Now()
+	record.UpdatedAt = record.CreatedAt
+	if _, err := fs.Collection("sila_transfers").Doc(txID).Set(ctx, record); err != nil {
+		slog.ErrorContext(ctx, "failed to record sila transfer", "component", "sila", "sila_transaction", txID, "error", err)
+	}
+}
+
+// DepositToSilaWallet pulls funds from a linked bank account into the wallet.
+// The wallet is credited when Sila's webhook reports the ACH settled.
+func DepositToSilaWallet(c *gin.Context) {
+	sila, fs, uid, ok := silaRequestClients(c)
+	if !ok {
+		return
+	}
+	req, handle, ok := bindSilaTransfer(c, fs, uid)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	txID, err := sila.IssueTransfer(ctx, &SilaTransfer{
+		UserHandle:     handle,
+		Amount:         float64(req.Amount),
+		AccountName:    req.AccountName,
+		Descriptor:     "Wallet deposit",
+		ProcessingType: req.ProcessingType,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "sila deposit failed", "component", "sila", "user_id", uid, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Deposit failed"})
+		return
+	}
+	recordSilaTransfer(c, fs, txID, SilaTransferRecord{UserID: uid, Type: "issue", Amount: req.Amount, AccountName: req.AccountName})
+	c.JSON(http.StatusAccepted, gin.H{"transaction_id": txID, "status": SilaTransferPending})
+}
+
+// WithdrawFromSilaWallet sends wallet funds to a linked bank account. The
+// amount is held before Sila is called and debited once Sila accepts the
+// withdrawal; the settlement webhook for it is then a no-op.
+func WithdrawFromSilaWallet(c *gin.Context) {
+	sila, fs, uid, ok := silaRequestClients(c)
+	if !ok {
+		return
+	}
+	req, handle, ok := bindSilaTransfer(c, fs, uid)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	holdID := "hold_" + uuid.NewString()
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		holdID = "hold_" + uid + "_" + key
+	}
+	hold, err := PlaceWalletHold(ctx, fs, uid, holdID, req.Amount, requestDurationSetting("WALLET_HOLD_TTL", defaultWalletHoldTTL))
+	if errors.Is(err, ErrInsufficientFunds) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient wallet balance"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to place wallet hold", "component", "wallet", "user_id", uid, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve funds"})
+		return
+	}
+	if hold.Status != WalletHoldActive {
+		c.JSON(http.StatusOK, gin.H{"transaction_id": hold.Reference, "status": SilaTransferPending})
+		return
+	}
+	if hold.Advance > 0 {
+		// The overdraft buffer covers sends, not cash-outs
+		if err := ReleaseWalletHold(ctx, fs, hold.ID, "overdraft_withdrawal"); err != nil {
+			slog.ErrorContext(ctx, "failed to release wallet hold", "component", "wallet", "hold_id", hold.ID, "error", err)
+		}
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient wallet balance"})
+		return
+	}
+
+	txID, err := sila.RedeemTransfer(ctx, &SilaTransfer{
+		UserHandle:     handle,
+		Amount:         float64(req.Amount),
+		AccountName:    req.AccountName,
+		Descriptor:     "Wallet withdrawal",
+		ProcessingType: req.ProcessingType,
+	})
+	if err != nil {
+		if relErr := ReleaseWalletHold(ctx, fs, hold.ID, "withdrawal_failed"); relErr != nil {
+			slog.ErrorContext(ctx, "failed to release wallet hold", "component", "wallet", "hold_id", hold.ID, "error", relErr)
+		}
+		slog.ErrorContext(ctx, "sila withdrawal failed", "component", "sila", "user_id", uid, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Withdrawal failed; your funds were not moved"})
+		return
+	}
+
+	// Keyed by the Sila transaction so the settlement webhook doesn't debit again
+	debit := &WalletEntry{Reference: txID, Source: ProcessorSila, Type: "redeem"}
+	if err := CommitWalletHold(ctx, fs, hold.ID, debit); err != nil {
+		slog.ErrorContext(ctx, "withdrawal accepted but hold commit failed", "component", "wallet", "sila_transaction", txID, "error", err)
+	} else {
+		recordWalletMovement(c, fs, debit)
+	}
+	recordSilaTransfer(c, fs, txID, SilaTransferRecord{UserID: uid, Type: "redeem", Amount: req.Amount, AccountName: req.AccountName})
+	c.JSON(http.StatusAccepted, gin.H{"transaction_id": txID, "status": SilaTransferPending})
+}
+
+// GetSilaBalance returns the caller's wallet as the app tracks it alongside
+// the balance Sila reports, which lags while transfers settle
+func GetSilaBalance(c *gin.Context) {
+	sila, fs, uid, ok := silaRequestClients(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	handle, err := walletHandleForUser(ctx, fs, uid, ProcessorSila)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You don't have a wallet yet"})
+		return
+	}
+	wallet := Wallet{UserID: uid, SilaUserHandle: handle, Currency: walletCurrency}
+	snap, err := fs.Collection("wallets").Doc(uid).Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wallet"})
+		return
+	}
+	if err == nil {
+		if err := snap.DataTo(&wallet); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read wallet"})
+			return
+		}
+	}
+
+	resp := gin.H{
+		"balance":   wallet.Balance,
+		"held":      wallet.Held,
+		"available": wallet.Available(),
+		"currency":  wallet.Currency,
+	}
+	if reported, err := sila.GetBalance(ctx, handle); err != nil {
+		slog.WarnContext(ctx, "sila balance unavailable", "component", "sila", "user_id", uid, "error", err)
+	} else {
+		resp["provider_balance"] = int64(reported.Balance)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// setSilaTransferStatus records a deposit or withdrawal's outcome; transfers
+// made outside /sila have no record and are skipped
+func setSilaTransferStatus(ctx context.Context, fs *firestore.Client, txID, transferStatus string) {
+	_, err := fs.Collection("sila_transfers").Doc(txID).Update(ctx, []firestore.Update{
+		{Path: "status", Value: transferStatus},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil && status.Code(err) != codes.NotFound {
+		slog.ErrorContext(ctx, "failed to update sila transfer", "component", "sila", "sila_transaction", txID, "error", err)
+	}
+}
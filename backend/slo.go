@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SLO is a service level objective whose alerting rules are generated from code,
+// so thresholds are versioned with the service and identical across environments.
+type SLO struct {
+	Name        string
+	Description string
+	// Objective is the target fraction of good events (ratio SLOs) or the
+	// maximum value of ValueExpr (threshold SLOs).
+	Objective float64
+	// ErrorRatioExpr is a PromQL template with a %s placeholder for the rate window.
+	ErrorRatioExpr string
+	// ValueExpr is a PromQL expression compared directly against Objective.
+	ValueExpr string
+	For       string
+	Severity  string
+}
+
+// burnRateWindows are the multi-window burn-rate alerts generated for ratio SLOs
+var burnRateWindows = []struct {
+	Suffix   string
+	Window   string
+	BurnRate float64
+	For      string
+	Severity string
+}{
+	{"FastBurn", "1h", 14.4, "2m", "page"},
+	{"SlowBurn", "6h", 6, "15m", "ticket"},
+}
+
+// ServiceSLOs are the objectives this service is held to
+var ServiceSLOs = []SLO{
+	{
+		Name:           "PaymentSuccessRate",
+		Description:    "At least 99.5% of payments succeed",
+		Objective:      0.995,
+		ErrorRatioExpr: `sum(rate(` + MetricPaymentsTotal + `{outcome="failed"}[%s])) / sum(rate(` + MetricPaymentsTotal + `[%s]))`,
+	},
+	{
+		Name:        "WebhookLag",
+		Description: "95% of provider webhooks are processed within 60 seconds of the event",
+		Objective:   60,
+		ValueExpr:   `histogram_quantile(0.95, sum(rate(` + MetricWebhookLag + `_bucket[10m])) by (le))`,
+		For:         "10m",
+		Severity:    "page",
+	},
+	{
+		Name:        "APILatencyP99",
+		Description: "API p99 latency stays under 1 second",
+		Objective:   1,
+		ValueExpr:   `histogram_quantile(0.99, sum(rate(` + MetricHTTPRequestDuration + `_bucket{route!="unmatched"}[5m])) by (le))`,
+		For:         "10m",
+		Severity:    "ticket",
+	},
+	{
+		Name:        "StripeWebhookEndpoint",
+		Description: "Stripe webhook endpoints are registered with every event the service handles",
+		Objective:   0,
+		ValueExpr:   `sum(increase(` + MetricWebhookEndpointIssues + `[12h]))`,
+		For:         "0m",
+		Severity:    "ticket",
+	},
+}
+
+// RenderPrometheusRules renders the SLOs as a Prometheus alerting rules file
+func RenderPrometheusRules(slos []SLO, environment string) string {
+	var b strings.Builder
+	b.WriteString("groups:\n")
+	b.WriteString("  - name: digital-payments-backend-slos\n")
+	b.WriteString("    rules:\n")
+
+	writeRule := func(alert, expr, forDuration, severity, summary string) {
+		fmt.Fprintf(&b, "      - alert: %s\n", alert)
+		fmt.Fprintf(&b, "        expr: %q\n", expr)
+		fmt.Fprintf(&b, "        for: %s\n", forDuration)
+		b.WriteString("        labels:\n")
+		fmt.Fprintf(&b, "          severity: %s\n", severity)
+		b.WriteString("          service: digital-payments-backend\n")
+		fmt.Fprintf(&b, "          environment: %s\n", environment)
+		b.WriteString("        annotations:\n")
+		fmt.Fprintf(&b, "          summary: %q\n", summary)
+	}
+
+	for _, slo := range slos {
+		if slo.ErrorRatioExpr != "" {
+			budget := 1 - slo.Objective
+			for _, w := range burnRateWindows {
+				expr := fmt.Sprintf("(%s) > %g", fmt.Sprintf(slo.ErrorRatioExpr, w.Window, w.Window), w.BurnRate*budget)
+				writeRule(slo.Name+w.Suffix, expr, w.For, w.Severity,
+					fmt.Sprintf("%s: error budget burning %gx too fast over %s", slo.Description, w.BurnRate, w.Window))
+			}
+			continue
+		}
+		writeRule(slo.Name, fmt.Sprintf("(%s) > %g", slo.ValueExpr, slo.Objective), slo.For, slo.Severity, slo.Description+" (violated)")
+	}
+	return b.String()
+}
+
+// GetSLOAlertRules serves the generated Prometheus alerting rules
+func GetSLOAlertRules(c *gin.Context) {
+	environment := os.Getenv("DEPLOY_ENVIRONMENT")
+	if environment == "" {
+		environment = "development"
+	}
+	c.Data(http.StatusOK, "application/yaml", []byte(RenderPrometheusRules(ServiceSLOs, environment)))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Statement PDFs are drawn with the standard Type 1 fonts every PDF reader
+// has, so no font is embedded; text outside what WinAnsiEncoding covers is
+// shown as '?'.
+
+// US Letter page layout, in points
+const (
+	pdfPageWidth   = 612
+	pdfPageHeight  = 792
+	pdfMargin      = 54
+	pdfLineHeight  = 14
+	pdfFooterY     = 36
+	pdfTableBottom = 72
+)
+
+// Fonts in each page's resources: F1 Helvetica, F2 Helvetica-Bold, F3
+// Courier. Amounts are set in Courier so they can be right-aligned without
+// glyph widths.
+var pdfFonts = []string{"Helvetica", "Helvetica-Bold", "Courier"}
+
+// pdfWinAnsi maps characters outside ASCII that WinAnsiEncoding covers and
+// statements use, such as currency symbols
+var pdfWinAnsi = map[rune]byte{'€': 0x80, '–': 0x96, '—': 0x97, '£': 0xa3, '¥': 0xa5, '·': 0xb7}
+
+// pdfPage is one page's content stream
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+// text draws s with its baseline starting at x, y
+func (p *pdfPage) text(font string, size, x, y float64, s string) {
+	fmt.Fprintf(&p.content, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfString(s))
+}
+
+// amount draws s in Courier ending at right
+func (p *pdfPage) amount(size, right, y float64, s string) {
+	width := float64(len([]rune(s))) * 0.6 * size
+	p.text("F3", size, right-width, y, s)
+}
+
+// rule draws a horizontal line across the text area
+func (p *pdfPage) rule(y float64) {
+	fmt.Fprintf(&p.content, "0.5 w %d %.2f m %d %.2f l S\n", pdfMargin, y, pdfPageWidth-pdfMargin, y)
+}
+
+// pdfString encodes s as the body of a PDF literal string
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		default:
+			if c, ok := pdfWinAnsi[r]; ok {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// writePDF lays pages out as a PDF file
+func writePDF(title string, pages []*pdfPage) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects: 1 catalog, 2 page tree, 3 info, then the fonts, then each
+	// page followed by its content stream
+	firstFont := 4
+	firstPage := firstFont + len(pdfFonts)
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	fonts := make([]string, len(pdfFonts))
+	for i := range pdfFonts {
+		fonts[i] = fmt.Sprintf("/F%d %d 0 R", i+1, firstFont+i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	obj(fmt.Sprintf("<< /Title (%s) >>", pdfString(title)))
+	for _, font := range pdfFonts {
+		obj(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", font))
+	}
+	for i, page := range pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, strings.Join(fonts, " "), firstPage+2*i+1))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", page.content.Len(), page.content.Bytes()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// Statement table columns: left edges, and the amount column's right edge
+const (
+	pdfColDate        = pdfMargin
+	pdfColDescription = pdfMargin + 56
+	pdfColReference   = 370
+	pdfColAmountRight = pdfPageWidth - pdfMargin
+)
+
+// maxPDFDescription bounds a description so it stays clear of the reference
+// column
+const maxPDFDescription = 44
+
+// RenderStatementPDF draws a statement: its period and totals, then its
+// transactions oldest first, continuing over as many pages as they need
+func RenderStatementPDF(st *Statement) []byte {
+	cur := currencyOrDefault(st.Currency)
+	var pages []*pdfPage
+	var page *pdfPage
+	var y float64
+	newPage := func() {
+		page = &pdfPage{}
+		pages = append(pages, page)
+		y = pdfPageHeight - pdfMargin
+	}
+	tableHeader := func() {
+		page.text("F2", 9, pdfColDate, y, "Date")
+		page.text("F2", 9, pdfColDescription, y, "Description")
+		page.text("F2", 9, pdfColReference, y, "Reference")
+		page.text("F2", 9, pdfColAmountRight-36, y, "Amount")
+		page.rule(y - 4)
+		y -= pdfLineHeight + 4
+	}
+
+	newPage()
+	page.text("F2", 18, pdfMargin, y, "Account statement")
+	y -= 24
+	page.text("F1", 11, pdfMargin, y, st.PeriodStart.Format("January 2006"))
+	y -= pdfLineHeight
+	page.text("F1", 9, pdfMargin, y, "Account "+st.UserID)
+	y -= pdfLineHeight
+	page.text("F1", 9, pdfMargin, y, fmt.Sprintf("%s to %s (UTC)",
+		st.PeriodStart.Format("January 2, 2006"), st.PeriodEnd.AddDate(0, 0, -1).Format("January 2, 2006")))
+	y -= 2 * pdfLineHeight
+
+	page.text("F2", 11, pdfMargin, y, "Summary")
+	y -= pdfLineHeight + 2
+	for _, line := range []struct {
+		label  string
+		amount int64
+	}{
+		{"Received", st.TotalReceived},
+		{"    Payments", st.IncomeReceived},
+		{"    Tips", st.TipsReceived},
+		{"Sent", -st.TotalSent},
+		{"Net", st.Net},
+	} {
+		font := "F1"
+		if line.label == "Net" {
+			page.rule(y + pdfLineHeight - 4)
+			font = "F2"
+		}
+		page.text(font, 10, pdfMargin, y, line.label)
+		page.amount(10, 300, y, signedAmount(cur, line.amount))
+		y -= pdfLineHeight
+	}
+	y -= pdfLineHeight
+
+	page.text("F2", 11, pdfMargin, y, "Transactions")
+	y -= pdfLineHeight + 2
+	if len(st.Transactions) == 0 {
+		page.text("F1", 9, pdfMargin, y, "No settled transactions this month.")
+	} else {
+		tableHeader()
+	}
+	for _, rec := range st.Transactions {
+		if y < pdfTableBottom {
+			newPage()
+			tableHeader()
+		}
+		description, amount := "Payment from "+rec.SenderUserID, rec.Amount
+		if rec.SenderUserID == st.UserID {
+			description, amount = "Payment to "+rec.RecipientUserID, -rec.Amount
+		} else if rec.TipAmount > 0 {
+			description += " (tip " + currencyOrDefault(rec.Currency).Format(rec.TipAmount) + ")"
+		}
+		if r := []rune(description); len(r) > maxPDFDescription {
+			description = string(r[:maxPDFDescription-3]) + "..."
+		}
+		page.text("F1", 9, pdfColDate, y, rec.CreatedAt.UTC().Format("Jan 02"))
+		page.text("F1", 9, pdfColDescription, y, description)
+		page.text("F3", 8, pdfColReference, y, rec.ID)
+		page.amount(9, pdfColAmountRight, y, signedAmount(currencyOrDefault(rec.Currency), amount))
+		y -= pdfLineHeight
+	}
+
+	generated := "Generated " + st.GeneratedAt.UTC().Format(time.RFC1123)
+	for i, p := range pages {
+		p.text("F1", 8, pdfMargin, pdfFooterY, generated)
+		p.text("F1", 8, pdfPageWidth-pdfMargin-48, pdfFooterY, fmt.Sprintf("Page %d of %d", i+1, len(pages)))
+	}
+	return writePDF("Statement "+st.Month, pages)
+}
+
+// signedAmount formats minor units with a leading minus for money out
+func signedAmount(cur Currency, amount int64) string {
+	if amount < 0 {
+		return "-" + cur.Format(-amount)
+	}
+	return cur.Format(amount)
+}
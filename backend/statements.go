@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Statement summarizes a user's settled activity for one calendar month (UTC)
+// TotalReceived is split into IncomeReceived and TipsReceived, so service
+// providers can see their tips apart from what they were paid.
+type Statement struct {
+	UserID         string              `json:"user_id"`
+	Month          string              `json:"month"`
+	PeriodStart    time.Time           `json:"period_start"`
+	PeriodEnd      time.Time           `json:"period_end"`
+	Currency       string              `json:"currency"`
+	TotalSent      int64               `json:"total_sent"`
+	TotalReceived  int64               `json:"total_received"`
+	IncomeReceived int64               `json:"income_received"`
+	TipsReceived   int64               `json:"tips_received"`
+	Net            int64               `json:"net"`
+	Transactions   []TransactionRecord `json:"transactions"`
+	GeneratedAt    time.Time           `json:"generated_at"`
+}
+
+// BuildStatement collects the month's succeeded transactions and their totals
+func BuildStatement(ctx context.Context, fs *firestore.Client, uid, month string) (*Statement, error) {
+	start, err := time.Parse("2006-01", month)
+	if err != nil {
+		return nil, fmt.Errorf("month must be YYYY-MM")
+	}
+	end := start.AddDate(0, 1, 0)
+
+	docs, err := fs.Collection("transactions").
+		Where("participants", "array-contains", uid).
+		Where("created_at", ">=", start).
+		Where("created_at", "<", end).
+		OrderBy("created_at", firestore.Asc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transactions for %s: %w", month, err)
+	}
+
+	st := &Statement{
+		UserID:       uid,
+		Month:        month,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+		Currency:     "usd",
+		Transactions: []TransactionRecord{},
+		GeneratedAt:  time.Now(),
+	}
+	for _, doc := range docs {
+		var rec TransactionRecord
+		if err := doc.DataTo(&rec); err != nil || rec.Status != "succeeded" {
+			continue
+		}
+		rec.ID = doc.Ref.ID
+		if rec.SenderUserID == uid {
+			st.TotalSent += rec.Amount
+		}
+		if rec.RecipientUserID == uid {
+			st.TotalReceived += rec.Amount
+			st.TipsReceived += rec.TipAmount
+		}
+		st.Transactions = append(st.Transactions, rec)
+	}
+	st.IncomeReceived = st.TotalReceived - st.TipsReceived
+	st.Net = st.TotalReceived - st.TotalSent
+	return st, nil
+}
+
+// GetStatement returns the caller's statement for ?month=YYYY-MM (default:
+// last month) as JSON, or with ?format=pdf as a PDF, inline or, with
+// ?delivery=url, as a signed download URL
+func GetStatement(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	month := c.Query("month")
+	if month == "" {
+		month = time.Now().UTC().AddDate(0, -1, 0).Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "month must be YYYY-MM"})
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != ExportPDF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or pdf"})
+		return
+	}
+	delivery, ok := exportDelivery(c)
+	if !ok {
+		return
+	}
+	st, err := BuildStatement(c.Request.Context(), fs, uid, month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
+		return
+	}
+	if format == "json" {
+		c.JSON(http.StatusOK, st)
+		return
+	}
+
+	pdf := RenderStatementPDF(st)
+	filename := "statement_" + month + ".pdf"
+	if delivery == DeliveryURL {
+		deliverExportURL(c, c.Request.Context(), uid, filename, func(w io.Writer) error {
+			_, err := w.Write(pdf)
+			return err
+		})
+		return
+	}
+	setExportHeaders(c, filename)
+	c.Data(http.StatusOK, exportContentTypes[ExportPDF], pdf)
+}
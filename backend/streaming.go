@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Export formats, chosen with ?format=
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+	ExportOFX    = "ofx"
+	ExportPDF    = "pdf"
+)
+
+const (
+	// exportPageSize is how many documents an export reads per query; each
+	// page is written and flushed before the next is read
+	exportPageSize = 500
+	// exportMaxDuration bounds an export so a stalled client can't hold it open
+	exportMaxDuration = 10 * time.Minute
+)
+
+// exportFormat reads ?format=, csv by default, and responds 400 for formats
+// other than those listed
+func exportFormat(c *gin.Context, formats ...string) (string, bool) {
+	format := c.DefaultQuery("format", ExportCSV)
+	if !slices.Contains(formats, format) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of " + strings.Join(formats, ", ")})
+		return "", false
+	}
+	return format, true
+}
+
+// csvCell keeps a spreadsheet from running a cell as a formula: text
+// starting with =, +, -, @, a tab, or a carriage return gets a leading '.
+// Numbers such as -12.50 are left as they are.
+func csvCell(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return s
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	return "'" + s
+}
+
+// csvRow applies csvCell to every cell of a row
+func csvRow(row []string) []string {
+	safe := make([]string, len(row))
+	for i, cell := range row {
+		safe[i] = csvCell(cell)
+	}
+	return safe
+}
+
+// ExportStream writes an export to the response as it is read, as chunked
+// CSV or NDJSON, instead of building it in memory. Writes block while the
+// client is behind, and the next page isn't read until the last one is
+// flushed, so a slow client slows the export rather than growing it in
+// memory. Once the headers are out errors can't change the status, so a
+// truncated export ends with an error line.
+type ExportStream struct {
+	c      *gin.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	format string
+	csv    *csv.Writer
+	json   *json.Encoder
+	rows   int
+}
+
+// NewExportStream starts an export response. columns is the CSV header row.
+func NewExportStream(c *gin.Context, format, filename string, columns []string) *ExportStream {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), exportMaxDuration)
+	s := &ExportStream{c: c, ctx: ctx, cancel: cancel, format: format}
+	setExportHeaders(c, filename+"."+format)
+	if format == ExportNDJSON {
+		s.json = json.NewEncoder(c.Writer)
+	} else {
+		s.csv = csv.NewWriter(c.Writer)
+		_ = s.csv.Write(columns)
+	}
+	c.Status(http.StatusOK)
+	return s
+}
+
+// Context is cancelled when the client goes away or the export runs too long
+func (s *ExportStream) Context() context.Context {
+	return s.ctx
+}
+
+// Write adds one record: row, guarded by csvCell, in CSV exports, record
+// itself in NDJSON ones
+func (s *ExportStream) Write(record interface{}, row []string) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.rows++
+	if s.json != nil {
+		return s.json.Encode(record)
+	}
+	return s.csv.Write(csvRow(row))
+}
+
+// Flush sends what has been written so far to the client
+func (s *ExportStream) Flush() error {
+	if s.csv != nil {
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return err
+		}
+	}
+	s.c.Writer.Flush()
+	return s.ctx.Err()
+}
+
+// Query writes every document q matches, a page at a time. q must be
+// ordered, ending with the document ID, so pages resume where the last one
+// ended. Each page is its own short query, so no read stays open for the
+// length of the export.
+func (s *ExportStream) Query(q firestore.Query, write func(*firestore.DocumentSnapshot) error) error {
+	return queryPages(s.ctx, q, write, s.Flush)
+}
+
+// queryPages calls write with every document q matches, a page at a time,
+// and afterPage, if set, once each page is written. q must be ordered as
+// ExportStream.Query requires.
+func queryPages(ctx context.Context, q firestore.Query, write func(*firestore.DocumentSnapshot) error, afterPage func() error) error {
+	var last *firestore.DocumentSnapshot
+	for {
+		page := q.Limit(exportPageSize)
+		if last != nil {
+			page = page.StartAfter(last)
+		}
+		docs, err := page.Documents(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := write(doc); err != nil {
+				return err
+			}
+		}
+		if afterPage != nil {
+			if err := afterPage(); err != nil {
+				return err
+			}
+		}
+		if len(docs) < exportPageSize {
+			return nil
+		}
+		last = docs[len(docs)-1]
+	}
+}
+
+// Close finishes the export. If err stopped it early, an error line marks the
+// export as incomplete, unless the client is already gone.
+func (s *ExportStream) Close(err error) {
+	defer s.cancel()
+	if err != nil {
+		slog.WarnContext(s.c.Request.Context(), "export incomplete", "component", "exports", "path", s.c.FullPath(), "rows", s.rows, "error", err)
+		if s.c.Request.Context().Err() != nil {
+			return
+		}
+		if s.json != nil {
+			_ = s.json.Encode(gin.H{"error": "export incomplete"})
+		} else {
+			_ = s.csv.Write([]string{"error: export incomplete"})
+		}
+	}
+	if s.csv != nil {
+		s.csv.Flush()
+	}
+	s.c.Writer.Flush()
+}
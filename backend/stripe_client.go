@@ -2,19 +2,38 @@ package main
 
 import (
     "context"
+    "errors"
     "fmt"
-    "log"
+    "io"
+    "log/slog"
+    "net/http"
     "os"
+    "slices"
+    "time"
 
     "github.com/stripe/stripe-go/v76"
     "github.com/stripe/stripe-go/v76/account"
     "github.com/stripe/stripe-go/v76/accountlink"
+    "github.com/stripe/stripe-go/v76/balance"
+    "github.com/stripe/stripe-go/v76/balancetransaction"
     "github.com/stripe/stripe-go/v76/customer"
+    "github.com/stripe/stripe-go/v76/dispute"
+    "github.com/stripe/stripe-go/v76/ephemeralkey"
+    "github.com/stripe/stripe-go/v76/file"
+    "github.com/stripe/stripe-go/v76/identity/verificationsession"
     "github.com/stripe/stripe-go/v76/paymentintent"
+    "github.com/stripe/stripe-go/v76/paymentlink"
     "github.com/stripe/stripe-go/v76/paymentmethod"
+    "github.com/stripe/stripe-go/v76/paymentsource"
+    "github.com/stripe/stripe-go/v76/payout"
+    "github.com/stripe/stripe-go/v76/price"
+    "github.com/stripe/stripe-go/v76/refund"
     "github.com/stripe/stripe-go/v76/setupintent"
     "github.com/stripe/stripe-go/v76/transfer"
+    "github.com/stripe/stripe-go/v76/transferreversal"
+    "github.com/stripe/stripe-go/v76/treasury/financialaccount"
     "github.com/stripe/stripe-go/v76/webhook"
+    "github.com/stripe/stripe-go/v76/webhookendpoint"
 )
 
 type StripeClient struct {
@@ -37,6 +56,8 @@ type StripePaymentIntent struct {
 	ClientSecret     string `json:"client_secret"`
 	PaymentMethodID  string `json:"payment_method_id"`
 	CustomerID       string `json:"customer_id"`
+	NextAction       *PaymentNextAction `json:"next_action,omitempty"`
+	PaymentMethodTypes []string         `json:"payment_method_types,omitempty"`
 }
 
 type StripeTransfer struct {
@@ -51,6 +72,7 @@ type StripeConnectAccountStatus struct {
     ID              string `json:"id"`
     ChargesEnabled  bool   `json:"charges_enabled"`
     PayoutsEnabled  bool   `json:"payouts_enabled"`
+    Requirements    *ConnectRequirements `json:"requirements"`
 }
 
 // NewStripeClient creates a new Stripe client
@@ -65,9 +87,21 @@ func NewStripeClient() (*StripeClient, error) {
 		environment = "test"
 	}
 
+	// Through the configured egress proxy, with any key pins
+	base, err := providerTransport(DependencyStripe)
+	if err != nil {
+		return nil, fmt.Errorf("stripe egress: %w", err)
+	}
+
 	// Set the Stripe API key
 	stripe.Key = secretKey
 
+	// Record Stripe request IDs against the trace of the request making each
+	// call, and each call as an OpenTelemetry span
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		HTTPClient: &http.Client{Timeout: 80 * time.Second, Transport: &stripeTraceTransport{base: &deadlineTransport{dependency: DependencyStripe, base: tracedTransport("stripe", base)}}},
+	}))
+
 	client := &StripeClient{
 		SecretKey:   secretKey,
 		Environment: environment,
@@ -83,9 +117,11 @@ func (sc *StripeClient) CreateCustomer(ctx context.Context, email, name, userID
 		Name:  stripe.String(name),
 		Metadata: map[string]string{
 			"user_id": userID,
+			"region":  currentRegion.Name,
 		},
 	}
 
+	params.Context = ctx
 	c, err := customer.New(params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create customer: %w", err)
@@ -99,6 +135,24 @@ func (sc *StripeClient) CreateCustomer(ctx context.Context, email, name, userID
 	}, nil
 }
 
+// CheckAPIKey makes a cheap authenticated call to confirm the secret key is accepted
+func (sc *StripeClient) CheckAPIKey(ctx context.Context) error {
+	if _, err := balance.Get(&stripe.BalanceParams{Params: stripe.Params{Context: ctx}}); err != nil {
+		return fmt.Errorf("stripe key check failed: %w", err)
+	}
+	return nil
+}
+
+// UpdateCustomerEmail sets a customer's email, e.g. to undo a change made in the Dashboard
+func (sc *StripeClient) UpdateCustomerEmail(ctx context.Context, customerID, email string) error {
+	params := &stripe.CustomerParams{Email: stripe.String(email)}
+	params.Context = ctx
+	if _, err := customer.Update(customerID, params); err != nil {
+		return fmt.Errorf("failed to update customer: %w", err)
+	}
+	return nil
+}
+
 // CreateConnectAccount creates a Stripe Express connected account for a user
 func (sc *StripeClient) CreateConnectAccount(ctx context.Context, email, userID, country string) (string, error) {
     if country == "" {
@@ -112,6 +166,7 @@ func (sc *StripeClient) CreateConnectAccount(ctx context.Context, email, userID,
         BusinessType: stripe.String(string(stripe.AccountBusinessTypeIndividual)),
         Metadata: map[string]string{
             "user_id": userID,
+            "region":  currentRegion.Name,
         },
     }
 
@@ -121,6 +176,7 @@ func (sc *StripeClient) CreateConnectAccount(ctx context.Context, email, userID,
         Transfers:    &stripe.AccountCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
     }
 
+    params.Context = ctx
     acc, err := account.New(params)
     if err != nil {
         return "", fmt.Errorf("failed to create connect account: %w", err)
@@ -144,6 +200,7 @@ func (sc *StripeClient) CreateAccountLink(ctx context.Context, accountID string)
         Type:       stripe.String("account_onboarding"),
     }
 
+    params.Context = ctx
     link, err := accountlink.New(params)
     if err != nil {
         return "", fmt.Errorf("failed to create account link: %w", err)
@@ -151,30 +208,30 @@ func (sc *StripeClient) CreateAccountLink(ctx context.Context, accountID string)
     return link.URL, nil
 }
 
-// GetConnectAccountStatus fetches charges/payouts status
+// GetConnectAccountStatus fetches charges/payouts status and what Stripe
+// still needs from the account holder
 func (sc *StripeClient) GetConnectAccountStatus(ctx context.Context, accountID string) (*StripeConnectAccountStatus, error) {
-    acc, err := account.GetByID(accountID, nil)
+    acc, err := account.GetByID(accountID, &stripe.AccountParams{Params: stripe.Params{Context: ctx}})
     if err != nil {
         return nil, fmt.Errorf("failed to get account: %w", err)
     }
-    return &StripeConnectAccountStatus{
-        ID:             acc.ID,
-        ChargesEnabled: acc.ChargesEnabled,
-        PayoutsEnabled: acc.PayoutsEnabled,
-    }, nil
+    return connectAccountStatus(acc), nil
 }
 
-// CreatePaymentIntent creates a payment intent for ACH transfers
-func (sc *StripeClient) CreatePaymentIntent(ctx context.Context, amount int64, currency, customerID, paymentMethodID string, metadata map[string]string) (*StripePaymentIntent, error) {
+// CreatePaymentIntent creates a payment intent for transfers, payable with
+// paymentMethodTypes (ACH only when empty)
+func (sc *StripeClient) CreatePaymentIntent(ctx context.Context, amount int64, currency, customerID, paymentMethodID string, metadata map[string]string, paymentMethodTypes []string) (*StripePaymentIntent, error) {
+    if len(paymentMethodTypes) == 0 {
+        paymentMethodTypes = []string{"us_bank_account"}
+    }
     params := &stripe.PaymentIntentParams{
         Amount:   stripe.Int64(amount),
         Currency: stripe.String(currency),
         Customer: stripe.String(customerID),
-        PaymentMethodTypes: stripe.StringSlice([]string{
-            "us_bank_account",
-        }),
+        PaymentMethodTypes: stripe.StringSlice(paymentMethodTypes),
         Metadata: map[string]string{
             "integration": "stripe_only",
+            "region":      currentRegion.Name,
         },
     }
     // Merge additional metadata
@@ -190,6 +247,7 @@ func (sc *StripeClient) CreatePaymentIntent(ctx context.Context, amount int64, c
 		params.Confirm = stripe.Bool(true)
 	}
 
+    params.Context = ctx
     pi, err := paymentintent.New(params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create payment intent: %w", err)
@@ -203,6 +261,7 @@ func (sc *StripeClient) CreatePaymentIntent(ctx context.Context, amount int64, c
 		ClientSecret:    pi.ClientSecret,
 		PaymentMethodID: paymentMethodID,
 		CustomerID:      customerID,
+		NextAction:      paymentNextAction(pi),
 	}, nil
 }
 
@@ -210,12 +269,21 @@ func (sc *StripeClient) CreatePaymentIntent(ctx context.Context, amount int64, c
 func (sc *StripeClient) CreateSetupIntent(ctx context.Context, customerID string) (*stripe.SetupIntent, error) {
 	params := &stripe.SetupIntentParams{
 		Customer: stripe.String(customerID),
+		Metadata: map[string]string{"region": currentRegion.Name},
 		PaymentMethodTypes: stripe.StringSlice([]string{
 			"us_bank_account",
+			"card",
 		}),
+		// Cards are authenticated here so later merchant-initiated charges can be exempt
+		PaymentMethodOptions: &stripe.SetupIntentPaymentMethodOptionsParams{
+			Card: &stripe.SetupIntentPaymentMethodOptionsCardParams{
+				RequestThreeDSecure: stripe.String("automatic"),
+			},
+		},
 		Usage: stripe.String("off_session"),
 	}
 
+	params.Context = ctx
 	si, err := setupintent.New(params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create setup intent: %w", err)
@@ -239,6 +307,7 @@ func (sc *StripeClient) CreatePaymentMethodFromPlaid(ctx context.Context, accoun
 		},
 	}
 
+	params.Context = ctx
 	pm, err := paymentmethod.New(params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create payment method: %w", err)
@@ -247,6 +316,29 @@ func (sc *StripeClient) CreatePaymentMethodFromPlaid(ctx context.Context, accoun
 	return pm, nil
 }
 
+// AttachBankAccountToken attaches a bank account to a customer from a Stripe bank
+// account token (btok_) minted by Plaid's processor token flow
+func (sc *StripeClient) AttachBankAccountToken(ctx context.Context, customerID, bankAccountToken, plaidAccountID string) (*stripe.PaymentSource, error) {
+	params := &stripe.PaymentSourceParams{
+		Customer: stripe.String(customerID),
+		Source: &stripe.PaymentSourceSourceParams{
+			Token: stripe.String(bankAccountToken),
+		},
+		Metadata: map[string]string{
+			"plaid_account_id": plaidAccountID,
+			"verification":     "plaid_processor_token",
+		},
+	}
+
+	params.Context = ctx
+	source, err := paymentsource.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach bank account: %w", err)
+	}
+
+	return source, nil
+}
+
 // ProcessTransfer processes a transfer between accounts (optionally grouped)
 func (sc *StripeClient) ProcessTransfer(ctx context.Context, amount int64, currency, destination, transferGroup string) (*StripeTransfer, error) {
     params := &stripe.TransferParams{
@@ -258,6 +350,7 @@ func (sc *StripeClient) ProcessTransfer(ctx context.Context, amount int64, curre
         params.TransferGroup = stripe.String(transferGroup)
     }
 
+    params.Context = ctx
     t, err := transfer.New(params)
     if err != nil {
         return nil, fmt.Errorf("failed to process transfer: %w", err)
@@ -272,10 +365,15 @@ func (sc *StripeClient) ProcessTransfer(ctx context.Context, amount int64, curre
     }, nil
 }
 
-// ConfirmPaymentIntent confirms a payment intent
-func (sc *StripeClient) ConfirmPaymentIntent(ctx context.Context, paymentIntentID string) (*StripePaymentIntent, error) {
+// ConfirmPaymentIntent confirms a payment intent. For bank debits, auth is the
+// customer's ACH authorization, sent to Stripe as the mandate's online acceptance.
+func (sc *StripeClient) ConfirmPaymentIntent(ctx context.Context, paymentIntentID string, auth *ACHAuthorization) (*StripePaymentIntent, error) {
 	params := &stripe.PaymentIntentConfirmParams{}
-	
+	if auth != nil {
+		params.MandateData = achMandateData(auth)
+	}
+
+	params.Context = ctx
 	pi, err := paymentintent.Confirm(paymentIntentID, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to confirm payment intent: %w", err)
@@ -287,72 +385,127 @@ func (sc *StripeClient) ConfirmPaymentIntent(ctx context.Context, paymentIntentI
 		Currency:     string(pi.Currency),
 		Status:       string(pi.Status),
 		ClientSecret: pi.ClientSecret,
+		NextAction:   paymentNextAction(pi),
 	}, nil
 }
 
 // GetPaymentIntent retrieves a payment intent
 func (sc *StripeClient) GetPaymentIntent(ctx context.Context, paymentIntentID string) (*StripePaymentIntent, error) {
-	pi, err := paymentintent.Get(paymentIntentID, nil)
+	pi, err := paymentintent.Get(paymentIntentID, &stripe.PaymentIntentParams{Params: stripe.Params{Context: ctx}})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get payment intent: %w", err)
 	}
 
 	return &StripePaymentIntent{
-		ID:           pi.ID,
-		Amount:       pi.Amount,
-		Currency:     string(pi.Currency),
-		Status:       string(pi.Status),
-		ClientSecret: pi.ClientSecret,
+		ID:                 pi.ID,
+		Amount:             pi.Amount,
+		Currency:           string(pi.Currency),
+		Status:             string(pi.Status),
+		ClientSecret:       pi.ClientSecret,
+		NextAction:         paymentNextAction(pi),
+		PaymentMethodTypes: pi.PaymentMethodTypes,
 	}, nil
 }
 
-// ValidateWebhook validates a Stripe webhook signature
-func (sc *StripeClient) ValidateWebhook(payload []byte, signature string) (stripe.Event, error) {
-	webhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	if webhookSecret == "" {
-		return stripe.Event{}, fmt.Errorf("STRIPE_WEBHOOK_SECRET not configured")
+// GetPaymentMethod retrieves a payment method, e.g. to read a card's issuing country
+func (sc *StripeClient) GetPaymentMethod(ctx context.Context, paymentMethodID string) (*stripe.PaymentMethod, error) {
+	pm, err := paymentmethod.Get(paymentMethodID, &stripe.PaymentMethodParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment method: %w", err)
 	}
+	return pm, nil
+}
 
-	event, err := webhook.ConstructEvent(payload, signature, webhookSecret)
+// ValidateWebhook validates a Stripe webhook signature against each active
+// signing secret (see webhook_secrets.go), so events keep verifying while a
+// secret is rotated and Connect endpoint events verify with their own secret
+func (sc *StripeClient) ValidateWebhook(payload []byte, signature string) (stripe.Event, error) {
+	secrets, err := stripeWebhookSecrets()
 	if err != nil {
-		return stripe.Event{}, fmt.Errorf("failed to validate webhook: %w", err)
+		return stripe.Event{}, err
 	}
 
-	return event, nil
+	for i, secret := range secrets {
+		event, err := webhook.ConstructEvent(payload, signature, secret)
+		if errors.Is(err, webhook.ErrNoValidSignature) {
+			continue
+		}
+		if err != nil {
+			return stripe.Event{}, fmt.Errorf("failed to validate webhook: %w", err)
+		}
+		recordWebhookSecretMatch(i)
+		return event, nil
+	}
+	return stripe.Event{}, fmt.Errorf("failed to validate webhook: %w", webhook.ErrNoValidSignature)
 }
 
 // LogAPIInteraction logs Stripe API interactions for debugging
 func (sc *StripeClient) LogAPIInteraction(ctx context.Context, operation, userID string, success bool, details string) {
-	status := "success"
+	status, level := "success", slog.LevelInfo
 	if !success {
-		status = "error"
+		status, level = "error", slog.LevelError
 	}
 	
-	log.Printf("[STRIPE] %s - User: %s, Status: %s, Details: %s", 
-		operation, userID, status, details)
+	if trace := traceFromContext(ctx); trace != nil {
+		trace.recordAudit(operation, userID, success, details, nil)
+	}
+	slog.Log(ctx, level, operation, "component", "stripe", "user_id", userID, "status", status, "details", details)
 }
-// CreatePaymentIntentWithIdempotency creates a payment intent with optional idempotency key
-func (sc *StripeClient) CreatePaymentIntentWithIdempotency(ctx context.Context, amount int64, currency, customerID, paymentMethodID string, metadata map[string]string, idempotencyKey string) (*StripePaymentIntent, error) {
+
+// LogAPIError logs a failed operation, keeping the Stripe request ID, codes and
+// doc URL when err came from the Stripe API
+func (sc *StripeClient) LogAPIError(ctx context.Context, operation, userID string, err error) {
+	se := stripeErrorDetails(err)
+	if trace := traceFromContext(ctx); trace != nil {
+		trace.recordAudit(operation, userID, false, err.Error(), se)
+	}
+	attrs := []any{"component", "stripe", "user_id", userID, "status", "error", "error", err.Error()}
+	if se != nil {
+		attrs = append(attrs, "stripe_request_id", se.RequestID, "code", se.Code, "decline_code", se.DeclineCode, "doc_url", se.DocURL)
+	}
+	slog.ErrorContext(ctx, operation, attrs...)
+}
+// CreatePaymentIntentWithIdempotency creates a payment intent with optional
+// idempotency key, authenticated according to the SCA policy and payable with
+// p.PaymentMethodTypes (card only when empty). A bank debit confirmed here
+// carries p.ACHAuthorization as its mandate.
+func (sc *StripeClient) CreatePaymentIntentWithIdempotency(ctx context.Context, p PaymentParams) (*StripePaymentIntent, error) {
+    paymentMethodTypes := p.PaymentMethodTypes
+    if len(paymentMethodTypes) == 0 { paymentMethodTypes = []string{"card"} }
     params := &stripe.PaymentIntentParams{
-        Amount:   stripe.Int64(amount),
-        Currency: stripe.String(currency),
-        Customer: stripe.String(customerID),
-        PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
-        Metadata: map[string]string{"integration": "stripe_only"},
+        Amount:   stripe.Int64(p.Amount),
+        Currency: stripe.String(p.Currency),
+        Customer: stripe.String(p.CustomerID),
+        PaymentMethodTypes: stripe.StringSlice(paymentMethodTypes),
+        Metadata: map[string]string{"integration": "stripe_only", "region": currentRegion.Name},
     }
-    if metadata != nil {
-        for k, v := range metadata { params.Metadata[k] = v }
-    }
-    if paymentMethodID != "" {
-        params.PaymentMethod = stripe.String(paymentMethodID)
+    for k, v := range p.Metadata { params.Metadata[k] = v }
+    if p.PaymentMethodID != "" {
+        params.PaymentMethod = stripe.String(p.PaymentMethodID)
         params.ConfirmationMethod = stripe.String("manual")
         params.Confirm = stripe.Bool(true)
+        if p.ACHAuthorization != nil {
+            params.MandateData = achMandateData(p.ACHAuthorization)
+        }
     }
-    if idempotencyKey != "" { params.SetIdempotencyKey(idempotencyKey) }
+    if p.ACHAuthorization != nil { params.Metadata["ach_authorization_id"] = p.ACHAuthorization.ID }
+    if p.CaptureManual { params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual)) }
+    sca := p.SCA
+    if sca.Exemption != "" { params.Metadata["sca_exemption"] = sca.Exemption }
+    if sca.OffSession {
+        // Merchant-initiated: Stripe flags it as an MIT against the card's setup
+        params.OffSession = stripe.Bool(true)
+    } else if sca.RequestThreeDSecure != "" && slices.Contains(paymentMethodTypes, "card") {
+        params.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptionsParams{
+            Card: &stripe.PaymentIntentPaymentMethodOptionsCardParams{RequestThreeDSecure: stripe.String(sca.RequestThreeDSecure)},
+        }
+    }
+    if p.IdempotencyKey != "" { params.SetIdempotencyKey(p.IdempotencyKey) }
 
+    params.Context = ctx
     pi, err := paymentintent.New(params)
     if err != nil { return nil, fmt.Errorf("failed to create payment intent: %w", err) }
-    return &StripePaymentIntent{ ID: pi.ID, Amount: pi.Amount, Currency: string(pi.Currency), Status: string(pi.Status), ClientSecret: pi.ClientSecret, PaymentMethodID: paymentMethodID, CustomerID: customerID }, nil
+    return &StripePaymentIntent{ ID: pi.ID, Amount: pi.Amount, Currency: string(pi.Currency), Status: string(pi.Status), ClientSecret: pi.ClientSecret, PaymentMethodID: p.PaymentMethodID, CustomerID: p.CustomerID, NextAction: paymentNextAction(pi) }, nil
 }
 
 // ProcessTransferWithIdempotency creates a transfer with idempotency key
@@ -360,7 +513,614 @@ func (sc *StripeClient) ProcessTransferWithIdempotency(ctx context.Context, amou
     params := &stripe.TransferParams{ Amount: stripe.Int64(amount), Currency: stripe.String(currency), Destination: stripe.String(destination) }
     if transferGroup != "" { params.TransferGroup = stripe.String(transferGroup) }
     if idempotencyKey != "" { params.SetIdempotencyKey(idempotencyKey) }
+    params.Context = ctx
     t, err := transfer.New(params)
     if err != nil { return nil, fmt.Errorf("failed to process transfer: %w", err) }
     return &StripeTransfer{ ID: t.ID, Amount: t.Amount, Currency: string(t.Currency), Destination: t.Destination.ID, Status: string(t.Object) }, nil
-}
\ No newline at end of file
+}
+
+// UploadDisputeEvidenceFile uploads a file to Stripe for use as dispute evidence
+func (sc *StripeClient) UploadDisputeEvidenceFile(ctx context.Context, filename string, r io.Reader) (string, error) {
+	params := &stripe.FileParams{
+		FileReader: r,
+		Filename:   stripe.String(filename),
+		Purpose:    stripe.String(string(stripe.FilePurposeDisputeEvidence)),
+	}
+
+	params.Context = ctx
+	f, err := file.New(params)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload evidence file: %w", err)
+	}
+	return f.ID, nil
+}
+
+// SubmitDisputeEvidence attaches evidence to a dispute, submitting it to the bank unless staged
+func (sc *StripeClient) SubmitDisputeEvidence(ctx context.Context, disputeID string, evidence *stripe.DisputeEvidenceParams, submit bool) (*stripe.Dispute, error) {
+	params := &stripe.DisputeParams{
+		Evidence: evidence,
+		Submit:   stripe.Bool(submit),
+	}
+
+	params.Context = ctx
+	d, err := dispute.Update(disputeID, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to submit dispute evidence: %w", err)
+	}
+	return d, nil
+}
+
+// GetBalanceTransaction retrieves a balance transaction, which carries the fee Stripe withheld
+func (sc *StripeClient) GetBalanceTransaction(ctx context.Context, id string) (*stripe.BalanceTransaction, error) {
+	bt, err := balancetransaction.Get(id, &stripe.BalanceTransactionParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance transaction: %w", err)
+	}
+	return bt, nil
+}
+
+// ListChargeRefunds lists every refund issued against a charge
+func (sc *StripeClient) ListChargeRefunds(ctx context.Context, chargeID string) ([]*stripe.Refund, error) {
+	params := &stripe.RefundListParams{Charge: stripe.String(chargeID)}
+	var refunds []*stripe.Refund
+	params.Context = ctx
+	iter := refund.List(params)
+	for iter.Next() {
+		refunds = append(refunds, iter.Refund())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list refunds: %w", err)
+	}
+	return refunds, nil
+}
+
+// RefundPaymentIntent fully refunds a payment intent's charge
+func (sc *StripeClient) RefundPaymentIntent(ctx context.Context, paymentIntentID string, metadata map[string]string, idempotencyKey string) (*stripe.Refund, error) {
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(paymentIntentID)}
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	params.Context = ctx
+	r, err := refund.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refund payment intent: %w", err)
+	}
+	return r, nil
+}
+
+// ReverseTransfer pulls a transfer back from the connected account in full
+func (sc *StripeClient) ReverseTransfer(ctx context.Context, transferID string, metadata map[string]string, idempotencyKey string) (*stripe.TransferReversal, error) {
+	params := &stripe.TransferReversalParams{ID: stripe.String(transferID)}
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	params.Context = ctx
+	r, err := transferreversal.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reverse transfer: %w", err)
+	}
+	return r, nil
+}
+
+// FindTransferInGroup returns the first transfer in a transfer group, or nil if there is none
+func (sc *StripeClient) FindTransferInGroup(ctx context.Context, transferGroup string) (*StripeTransfer, error) {
+	params := &stripe.TransferListParams{TransferGroup: stripe.String(transferGroup)}
+	params.Context = ctx
+	iter := transfer.List(params)
+	for iter.Next() {
+		t := iter.Transfer()
+		destination := ""
+		if t.Destination != nil {
+			destination = t.Destination.ID
+		}
+		return &StripeTransfer{ID: t.ID, Amount: t.Amount, Currency: string(t.Currency), Destination: destination, Status: string(t.Object)}, nil
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list transfers: %w", err)
+	}
+	return nil, nil
+}
+
+// CancelPaymentIntent cancels a payment intent that can no longer be completed
+func (sc *StripeClient) CancelPaymentIntent(ctx context.Context, paymentIntentID string, reason stripe.PaymentIntentCancellationReason) error {
+	params := &stripe.PaymentIntentCancelParams{CancellationReason: stripe.String(string(reason))}
+	params.Context = ctx
+	if _, err := paymentintent.Cancel(paymentIntentID, params); err != nil {
+		return fmt.Errorf("failed to cancel payment intent: %w", err)
+	}
+	return nil
+}
+
+// CapturePaymentIntent collects an authorized manual-capture payment in full
+func (sc *StripeClient) CapturePaymentIntent(ctx context.Context, paymentIntentID, idempotencyKey string) (*StripePaymentIntent, error) {
+	params := &stripe.PaymentIntentCaptureParams{}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	params.Context = ctx
+	pi, err := paymentintent.Capture(paymentIntentID, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture payment intent: %w", err)
+	}
+	return &StripePaymentIntent{ID: pi.ID, Amount: pi.Amount, Currency: string(pi.Currency), Status: string(pi.Status)}, nil
+}
+
+// ListCustomers returns every customer on the account
+func (sc *StripeClient) ListCustomers(ctx context.Context) ([]*stripe.Customer, error) {
+	params := &stripe.CustomerListParams{}
+	params.Context = ctx
+	params.Limit = stripe.Int64(100)
+	var customers []*stripe.Customer
+	iter := customer.List(params)
+	for iter.Next() {
+		customers = append(customers, iter.Customer())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list customers: %w", err)
+	}
+	return customers, nil
+}
+
+// ListConnectAccounts returns every connected account on the platform
+func (sc *StripeClient) ListConnectAccounts(ctx context.Context) ([]*stripe.Account, error) {
+	params := &stripe.AccountListParams{}
+	params.Context = ctx
+	params.Limit = stripe.Int64(100)
+	var accounts []*stripe.Account
+	iter := account.List(params)
+	for iter.Next() {
+		accounts = append(accounts, iter.Account())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list connected accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+// DeleteCustomer deletes a customer and its saved payment methods
+func (sc *StripeClient) DeleteCustomer(ctx context.Context, customerID string) error {
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	if _, err := customer.Del(customerID, params); err != nil {
+		return fmt.Errorf("failed to delete customer: %w", err)
+	}
+	return nil
+}
+
+// DeleteConnectAccount deletes a connected account; Stripe refuses while it holds a balance
+func (sc *StripeClient) DeleteConnectAccount(ctx context.Context, accountID string) error {
+	params := &stripe.AccountParams{}
+	params.Context = ctx
+	if _, err := account.Del(accountID, params); err != nil {
+		return fmt.Errorf("failed to delete connected account: %w", err)
+	}
+	return nil
+}
+
+// SetPayoutSchedule sets when a connected account is paid out: interval is
+// daily, weekly (on weeklyAnchor, e.g. "monday"), or manual. Automatic
+// payouts hold funds delayDays; 0 restores the minimum delay for the
+// account's country.
+func (sc *StripeClient) SetPayoutSchedule(ctx context.Context, accountID, interval, weeklyAnchor string, delayDays int64) error {
+	schedule := &stripe.AccountSettingsPayoutsScheduleParams{Interval: stripe.String(interval)}
+	if interval == "weekly" {
+		schedule.WeeklyAnchor = stripe.String(weeklyAnchor)
+	}
+	if interval != "manual" {
+		if delayDays > 0 {
+			schedule.DelayDays = stripe.Int64(delayDays)
+		} else {
+			schedule.DelayDaysMinimum = stripe.Bool(true)
+		}
+	}
+	params := &stripe.AccountParams{
+		Settings: &stripe.AccountSettingsParams{
+			Payouts: &stripe.AccountSettingsPayoutsParams{Schedule: schedule},
+		},
+	}
+	params.Context = ctx
+	if _, err := account.Update(accountID, params); err != nil {
+		return fmt.Errorf("failed to set payout schedule: %w", err)
+	}
+	return nil
+}
+
+// GetPayoutSchedule returns a connected account's payout schedule as Stripe
+// has it
+func (sc *StripeClient) GetPayoutSchedule(ctx context.Context, accountID string) (*stripe.AccountSettingsPayoutsSchedule, error) {
+	acc, err := account.GetByID(accountID, &stripe.AccountParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	if acc.Settings == nil || acc.Settings.Payouts == nil {
+		return nil, nil
+	}
+	return acc.Settings.Payouts.Schedule, nil
+}
+
+// InstantPayoutCards lists a connected account's debit cards that can
+// receive instant payouts
+func (sc *StripeClient) InstantPayoutCards(ctx context.Context, accountID string) ([]*stripe.Card, error) {
+	acc, err := account.GetByID(accountID, &stripe.AccountParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	var cards []*stripe.Card
+	if acc.ExternalAccounts == nil {
+		return cards, nil
+	}
+	for _, ea := range acc.ExternalAccounts.Data {
+		if ea.Card != nil && slices.Contains(ea.Card.AvailablePayoutMethods, stripe.CardAvailablePayoutMethodInstant) {
+			cards = append(cards, ea.Card)
+		}
+	}
+	return cards, nil
+}
+
+// InstantAvailableBalance returns what a connected account can pay out
+// instantly in currency
+func (sc *StripeClient) InstantAvailableBalance(ctx context.Context, accountID, currency string) (int64, error) {
+	b, err := connectedAccountBalance(ctx, accountID)
+	if err != nil {
+		return 0, err
+	}
+	return balanceAmount(b.InstantAvailable, currency), nil
+}
+
+// AvailableBalance returns what a connected account can pay out in currency
+func (sc *StripeClient) AvailableBalance(ctx context.Context, accountID, currency string) (int64, error) {
+	b, err := connectedAccountBalance(ctx, accountID)
+	if err != nil {
+		return 0, err
+	}
+	return balanceAmount(b.Available, currency), nil
+}
+
+func connectedAccountBalance(ctx context.Context, accountID string) (*stripe.Balance, error) {
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
+	params.SetStripeAccount(accountID)
+	b, err := balance.Get(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account balance: %w", err)
+	}
+	return b, nil
+}
+
+func balanceAmount(amounts []*stripe.Amount, currency string) int64 {
+	for _, a := range amounts {
+		if string(a.Currency) == currency {
+			return a.Amount
+		}
+	}
+	return 0
+}
+
+// CreateInstantPayout pays a connected account's balance out to one of its
+// debit cards within minutes
+func (sc *StripeClient) CreateInstantPayout(ctx context.Context, accountID, cardID string, amount int64, currency string, metadata map[string]string, idempotencyKey string) (*stripe.Payout, error) {
+	params := &stripe.PayoutParams{
+		Amount:      stripe.Int64(amount),
+		Currency:    stripe.String(currency),
+		Destination: stripe.String(cardID),
+		Method:      stripe.String(string(stripe.PayoutMethodInstant)),
+	}
+	params.Metadata = metadata
+	params.Context = ctx
+	params.SetStripeAccount(accountID)
+	params.SetIdempotencyKey(idempotencyKey)
+	p, err := payout.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payout: %w", err)
+	}
+	return p, nil
+}
+
+// CreateStandardPayout pays a connected account's balance out to its default
+// bank account. Stripe only accepts this on accounts paid out manually.
+func (sc *StripeClient) CreateStandardPayout(ctx context.Context, accountID string, amount int64, currency string, metadata map[string]string, idempotencyKey string) (*stripe.Payout, error) {
+	params := &stripe.PayoutParams{
+		Amount:   stripe.Int64(amount),
+		Currency: stripe.String(currency),
+		Method:   stripe.String(string(stripe.PayoutMethodStandard)),
+	}
+	params.Metadata = metadata
+	params.Context = ctx
+	params.SetStripeAccount(accountID)
+	params.SetIdempotencyKey(idempotencyKey)
+	p, err := payout.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payout: %w", err)
+	}
+	return p, nil
+}
+
+// DebitConnectedAccount moves amount from a connected account's balance to
+// the platform's
+func (sc *StripeClient) DebitConnectedAccount(ctx context.Context, accountID string, amount int64, currency string, metadata map[string]string, idempotencyKey string) (*stripe.Transfer, error) {
+	platform, err := account.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get platform account: %w", err)
+	}
+	params := &stripe.TransferParams{
+		Amount:      stripe.Int64(amount),
+		Currency:    stripe.String(currency),
+		Destination: stripe.String(platform.ID),
+	}
+	params.Metadata = metadata
+	params.Context = ctx
+	params.SetStripeAccount(accountID)
+	params.SetIdempotencyKey(idempotencyKey)
+	t, err := transfer.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to debit account: %w", err)
+	}
+	return t, nil
+}
+
+// CreatePaymentLink creates a hosted page that charges a fixed amount for
+// name. metadata is copied onto each PaymentIntent the link creates, which is
+// how the webhook knows whom to pay.
+func (sc *StripeClient) CreatePaymentLink(ctx context.Context, name string, amount int64, currency string, metadata map[string]string, idempotencyKey string) (*stripe.PaymentLink, error) {
+	priceParams := &stripe.PriceParams{
+		Currency:    stripe.String(currency),
+		UnitAmount:  stripe.Int64(amount),
+		ProductData: &stripe.PriceProductDataParams{Name: stripe.String(name)},
+	}
+	priceParams.Context = ctx
+	priceParams.SetIdempotencyKey(idempotencyKey + "_price")
+	p, err := price.New(priceParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create price: %w", err)
+	}
+
+	params := &stripe.PaymentLinkParams{
+		LineItems:         []*stripe.PaymentLinkLineItemParams{{Price: stripe.String(p.ID), Quantity: stripe.Int64(1)}},
+		PaymentIntentData: &stripe.PaymentLinkPaymentIntentDataParams{Metadata: metadata},
+	}
+	params.Metadata = metadata
+	params.Context = ctx
+	params.SetIdempotencyKey(idempotencyKey)
+	link, err := paymentlink.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payment link: %w", err)
+	}
+	return link, nil
+}
+
+// DeactivatePaymentLink stops a payment link from taking payments
+func (sc *StripeClient) DeactivatePaymentLink(ctx context.Context, linkID string) error {
+	params := &stripe.PaymentLinkParams{Active: stripe.Bool(false)}
+	params.Context = ctx
+	if _, err := paymentlink.Update(linkID, params); err != nil {
+		return fmt.Errorf("failed to deactivate payment link: %w", err)
+	}
+	return nil
+}
+
+// GetCustomer retrieves a customer; a deleted customer comes back with Deleted set
+func (sc *StripeClient) GetCustomer(ctx context.Context, customerID string) (*stripe.Customer, error) {
+	c, err := customer.Get(customerID, &stripe.CustomerParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get customer: %w", err)
+	}
+	return c, nil
+}
+
+// CreateVerificationSession starts a Stripe Identity document and selfie check
+// for a user
+func (sc *StripeClient) CreateVerificationSession(ctx context.Context, userID, returnURL string) (*stripe.IdentityVerificationSession, error) {
+	params := &stripe.IdentityVerificationSessionParams{
+		Type:              stripe.String(string(stripe.IdentityVerificationSessionTypeDocument)),
+		ClientReferenceID: stripe.String(userID),
+		Options: &stripe.IdentityVerificationSessionOptionsParams{
+			Document: &stripe.IdentityVerificationSessionOptionsDocumentParams{
+				RequireMatchingSelfie: stripe.Bool(true),
+			},
+		},
+		Metadata: map[string]string{
+			"user_id": userID,
+			"region":  currentRegion.Name,
+		},
+	}
+	if returnURL != "" {
+		params.ReturnURL = stripe.String(returnURL)
+	}
+	params.Context = ctx
+	vs, err := verificationsession.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create verification session: %w", err)
+	}
+	return vs, nil
+}
+
+// GetVerificationSession retrieves a Stripe Identity verification session
+func (sc *StripeClient) GetVerificationSession(ctx context.Context, sessionID string) (*stripe.IdentityVerificationSession, error) {
+	vs, err := verificationsession.Get(sessionID, &stripe.IdentityVerificationSessionParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get verification session: %w", err)
+	}
+	return vs, nil
+}
+
+// CreateVerificationSessionKey creates the ephemeral key the Stripe Identity
+// mobile SDKs open a verification session with; apiVersion is the SDK's
+func (sc *StripeClient) CreateVerificationSessionKey(ctx context.Context, sessionID, apiVersion string) (*stripe.EphemeralKey, error) {
+	params := &stripe.EphemeralKeyParams{
+		VerificationSession: stripe.String(sessionID),
+		StripeVersion:       stripe.String(apiVersion),
+	}
+	params.Context = ctx
+	key, err := ephemeralkey.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ephemeral key: %w", err)
+	}
+	return key, nil
+}
+
+// ListCustomerPaymentMethods returns a customer's saved cards and bank accounts
+func (sc *StripeClient) ListCustomerPaymentMethods(ctx context.Context, customerID string) ([]*stripe.PaymentMethod, error) {
+	params := &stripe.CustomerListPaymentMethodsParams{Customer: stripe.String(customerID)}
+	params.Context = ctx
+	params.Limit = stripe.Int64(100)
+	var methods []*stripe.PaymentMethod
+	iter := customer.ListPaymentMethods(params)
+	for iter.Next() {
+		pm := iter.PaymentMethod()
+		if pm.Type == stripe.PaymentMethodTypeCard || pm.Type == stripe.PaymentMethodTypeUSBankAccount {
+			methods = append(methods, pm)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list payment methods: %w", err)
+	}
+	return methods, nil
+}
+
+// DetachPaymentMethod removes a saved payment method from its customer
+func (sc *StripeClient) DetachPaymentMethod(ctx context.Context, paymentMethodID string) error {
+	params := &stripe.PaymentMethodDetachParams{}
+	params.Context = ctx
+	if _, err := paymentmethod.Detach(paymentMethodID, params); err != nil {
+		return fmt.Errorf("failed to detach payment method: %w", err)
+	}
+	return nil
+}
+
+// SetDefaultPaymentMethod makes a saved payment method the customer's default
+func (sc *StripeClient) SetDefaultPaymentMethod(ctx context.Context, customerID, paymentMethodID string) (*stripe.Customer, error) {
+	params := &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(paymentMethodID),
+		},
+	}
+	params.Context = ctx
+	c, err := customer.Update(customerID, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set default payment method: %w", err)
+	}
+	return c, nil
+}
+
+// ListWebhookEndpoints returns the webhook endpoints registered on the platform account
+func (sc *StripeClient) ListWebhookEndpoints(ctx context.Context) ([]*stripe.WebhookEndpoint, error) {
+	params := &stripe.WebhookEndpointListParams{}
+	params.Context = ctx
+	var endpoints []*stripe.WebhookEndpoint
+	iter := webhookendpoint.List(params)
+	for iter.Next() {
+		endpoints = append(endpoints, iter.WebhookEndpoint())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list webhook endpoints: %w", err)
+	}
+	return endpoints, nil
+}
+
+// CreateWebhookEndpoint registers a webhook endpoint on the API version this
+// client parses, so its events pass ValidateWebhook. connect endpoints receive
+// events from connected accounts. The signing secret is only returned here.
+func (sc *StripeClient) CreateWebhookEndpoint(ctx context.Context, url string, connect bool, events []string, metadata map[string]string) (*stripe.WebhookEndpoint, error) {
+	params := &stripe.WebhookEndpointParams{
+		URL:           stripe.String(url),
+		Connect:       stripe.Bool(connect),
+		EnabledEvents: stripe.StringSlice(events),
+		APIVersion:    stripe.String(stripe.APIVersion),
+	}
+	params.Context = ctx
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
+	ep, err := webhookendpoint.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook endpoint: %w", err)
+	}
+	return ep, nil
+}
+
+// UpdateWebhookEndpoint enables a webhook endpoint and sets its events
+func (sc *StripeClient) UpdateWebhookEndpoint(ctx context.Context, endpointID string, events []string, metadata map[string]string) (*stripe.WebhookEndpoint, error) {
+	params := &stripe.WebhookEndpointParams{
+		Disabled:      stripe.Bool(false),
+		EnabledEvents: stripe.StringSlice(events),
+	}
+	params.Context = ctx
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
+	ep, err := webhookendpoint.Update(endpointID, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update webhook endpoint: %w", err)
+	}
+	return ep, nil
+}
+
+// EnableTreasury requests the Treasury capability on a connected account,
+// recording the user's acceptance of the Treasury services agreement
+func (sc *StripeClient) EnableTreasury(ctx context.Context, accountID, ip, userAgent string) error {
+	params := &stripe.AccountParams{
+		Capabilities: &stripe.AccountCapabilitiesParams{
+			Treasury: &stripe.AccountCapabilitiesTreasuryParams{Requested: stripe.Bool(true)},
+		},
+		Settings: &stripe.AccountSettingsParams{
+			Treasury: &stripe.AccountSettingsTreasuryParams{
+				TOSAcceptance: &stripe.AccountSettingsTreasuryTOSAcceptanceParams{
+					Date:      stripe.Int64(time.Now().Unix()),
+					IP:        stripe.String(ip),
+					UserAgent: stripe.String(userAgent),
+				},
+			},
+		},
+	}
+	params.Context = ctx
+	if _, err := account.Update(accountID, params); err != nil {
+		return fmt.Errorf("failed to enable treasury: %w", err)
+	}
+	return nil
+}
+
+// CreateFinancialAccount opens a USD Treasury financial account on a
+// connected account with an ABA address, so it has account and routing
+// numbers that can receive ACH credits such as direct deposits
+func (sc *StripeClient) CreateFinancialAccount(ctx context.Context, accountID string, metadata map[string]string, idempotencyKey string) (*stripe.TreasuryFinancialAccount, error) {
+	params := &stripe.TreasuryFinancialAccountParams{
+		SupportedCurrencies: stripe.StringSlice([]string{"usd"}),
+		Features: &stripe.TreasuryFinancialAccountFeaturesParams{
+			FinancialAddresses: &stripe.TreasuryFinancialAccountFeaturesFinancialAddressesParams{
+				ABA: &stripe.TreasuryFinancialAccountFeaturesFinancialAddressesABAParams{Requested: stripe.Bool(true)},
+			},
+			DepositInsurance: &stripe.TreasuryFinancialAccountFeaturesDepositInsuranceParams{Requested: stripe.Bool(true)},
+		},
+		Metadata: metadata,
+	}
+	params.Context = ctx
+	params.SetStripeAccount(accountID)
+	params.SetIdempotencyKey(idempotencyKey)
+	fa, err := financialaccount.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create financial account: %w", err)
+	}
+	return fa, nil
+}
+
+// GetFinancialAccount fetches a connected account's financial account. The
+// full account number is only returned when withAccountNumber is set.
+func (sc *StripeClient) GetFinancialAccount(ctx context.Context, accountID, financialAccountID string, withAccountNumber bool) (*stripe.TreasuryFinancialAccount, error) {
+	params := &stripe.TreasuryFinancialAccountParams{}
+	params.Context = ctx
+	params.SetStripeAccount(accountID)
+	if withAccountNumber {
+		params.AddExpand("financial_addresses.aba.account_number")
+	}
+	fa, err := financialaccount.Get(financialAccountID, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get financial account: %w", err)
+	}
+	return fa, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// StripeErrorDetails are the fields of a Stripe API error worth keeping: enough
+// to find the request in the Stripe dashboard and to handle the failure
+// precisely without parsing its message.
+type StripeErrorDetails struct {
+	Type            string `json:"type,omitempty" firestore:"type,omitempty"`
+	Code            string `json:"code,omitempty" firestore:"code,omitempty"`
+	DeclineCode     string `json:"decline_code,omitempty" firestore:"decline_code,omitempty"`
+	Param           string `json:"param,omitempty" firestore:"param,omitempty"`
+	RequestID       string `json:"request_id,omitempty" firestore:"request_id,omitempty"`
+	DocURL          string `json:"doc_url,omitempty" firestore:"doc_url,omitempty"`
+	HTTPStatus      int    `json:"http_status,omitempty" firestore:"http_status,omitempty"`
+	PaymentIntentID string `json:"payment_intent_id,omitempty" firestore:"payment_intent_id,omitempty"`
+}
+
+// stripeErrorDetails extracts the Stripe error wrapped in err, or returns nil
+// if err did not come from the Stripe API
+func stripeErrorDetails(err error) *StripeErrorDetails {
+	var se *stripe.Error
+	if !errors.As(err, &se) {
+		return nil
+	}
+	d := &StripeErrorDetails{
+		Type:        string(se.Type),
+		Code:        string(se.Code),
+		DeclineCode: string(se.DeclineCode),
+		Param:       se.Param,
+		RequestID:   se.RequestID,
+		DocURL:      se.DocURL,
+		HTTPStatus:  se.HTTPStatusCode,
+	}
+	if se.PaymentIntent != nil {
+		d.PaymentIntentID = se.PaymentIntent.ID
+	}
+	return d
+}
+
+// failureCode is the most specific code to show a client: the decline code
+// when the bank gave one, otherwise the Stripe error code
+func (d *StripeErrorDetails) failureCode() string {
+	if d.DeclineCode != "" {
+		return d.DeclineCode
+	}
+	return d.Code
+}
+
+// stripeErrorBody is an error response carrying the Stripe error code and
+// decline code behind err, if any, with a localized message and recovery
+// actions for the user. The Stripe message itself is not returned.
+func stripeErrorBody(c *gin.Context, message string, err error) gin.H {
+	body := gin.H{"error": message}
+	d := stripeErrorDetails(err)
+	if d == nil {
+		return body
+	}
+	if d.Code != "" {
+		body["code"] = d.Code
+	}
+	if d.DeclineCode != "" {
+		body["decline_code"] = d.DeclineCode
+	}
+	if code := d.failureCode(); code != "" {
+		fm := failureMessageFor(code, requestLocale(c))
+		body["user_message"] = fm.Message
+		body["reason"] = fm.Reason
+		body["actions"] = fm.Actions
+	}
+	return body
+}
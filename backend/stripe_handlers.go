@@ -1,13 +1,19 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "net/http"
+    "slices"
+    "strconv"
+    "strings"
     "time"
     
     "cloud.google.com/go/firestore"
+    "firebase.google.com/go/v4/auth"
     "github.com/gin-gonic/gin"
     "github.com/stripe/stripe-go/v76"
 )
@@ -34,6 +40,41 @@ type CreateTransferRequest struct {
 	DestinationAccountID string `json:"destination_account_id" binding:"required"`
 	Description         string `json:"description"`
 	UserID              string `json:"user_id" binding:"required"`
+	// bank (default) or card; wallet funds move with /wallet/transfers
+	FundingSource       string `json:"funding_source"`
+	// recipient (default) or sender; the sender's fee is added to the charge
+	FeePayer            string `json:"fee_payer"`
+}
+
+// transferFunding validates a transfer's funding source and fee payer,
+// defaulting them to bank and recipient, and prices it. It writes a 400 and
+// returns nil when they are invalid.
+func transferFunding(c *gin.Context, req *CreateTransferRequest) *FeeBreakdown {
+	if req.FundingSource == "" {
+		req.FundingSource = FeeMethodBank
+	}
+	if req.FeePayer == "" {
+		req.FeePayer = FeePayerRecipient
+	}
+	if !validFeePayer(req.FeePayer) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fee_payer must be sender or recipient"})
+		return nil
+	}
+	switch req.FundingSource {
+	case FeeMethodBank, FeeMethodCard:
+	case FeeMethodWallet:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wallet funds are sent with /wallet/transfers"})
+		return nil
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "funding_source must be bank or card"})
+		return nil
+	}
+	fee := ComputeFee(req.Amount, FeeSpeedStandard, req.FundingSource, req.FeePayer)
+	if fee.NetAmount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount is too small to cover the fee", "fee": fee})
+		return nil
+	}
+	return fee
 }
 
 // ConfirmTransferRequest represents the request to confirm a transfer
@@ -62,8 +103,8 @@ func CreateStripeCustomer(c *gin.Context) {
 	// Create customer
 	customer, err := sc.CreateCustomer(c.Request.Context(), req.Email, req.Name, req.UserID)
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "create_customer", req.UserID, false, err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create customer"})
+		sc.LogAPIError(c.Request.Context(), "create_customer", req.UserID, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create customer", err))
 		return
 	}
 
@@ -102,7 +143,7 @@ func CreatePaymentMethodFromPlaid(c *gin.Context) {
 	// Get account details from Plaid
 	accounts, err := pc.GetAccounts(c.Request.Context(), req.AccessToken)
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "get_plaid_accounts", "", false, err.Error())
+		sc.LogAPIError(c.Request.Context(), "get_plaid_accounts", "", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get account details from Plaid"})
 		return
 	}
@@ -121,10 +162,42 @@ func CreatePaymentMethodFromPlaid(c *gin.Context) {
 		return
 	}
 
+	// Determine account type
+	accountType := "checking"
+	if targetAccount.Type == "depository" && targetAccount.Subtype == "savings" {
+		accountType = "savings"
+	}
+	accountInfo := gin.H{
+		"account_id":   targetAccount.AccountID,
+		"account_name": targetAccount.Name,
+		"account_type": accountType,
+		"mask":         targetAccount.Mask,
+	}
+
+	// Prefer a Plaid processor token so raw bank numbers never transit this service
+	bankAccountToken, err := pc.CreateStripeProcessorToken(c.Request.Context(), req.AccessToken, req.PlaidAccountID)
+	if err == nil {
+		source, err := sc.AttachBankAccountToken(c.Request.Context(), req.CustomerID, bankAccountToken, req.PlaidAccountID)
+		if err != nil {
+			sc.LogAPIError(c.Request.Context(), "attach_bank_account", "", err)
+			c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to attach bank account", err))
+			return
+		}
+		sc.LogAPIInteraction(c.Request.Context(), "attach_bank_account", "", true, fmt.Sprintf("Source ID: %s", source.ID))
+		c.JSON(http.StatusOK, gin.H{
+			"bank_account": source,
+			"account_info": accountInfo,
+			"message":      "Bank account linked successfully",
+		})
+		return
+	}
+	sc.LogAPIError(c.Request.Context(), "create_processor_token", "", err)
+
+	// Fall back to /auth account and routing numbers
 	// Get auth data for routing and account numbers
 	authData, err := pc.GetAuthData(c.Request.Context(), req.AccessToken)
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "get_plaid_auth", "", false, err.Error())
+		sc.LogAPIError(c.Request.Context(), "get_plaid_auth", "", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get account auth data"})
 		return
 	}
@@ -145,12 +218,6 @@ func CreatePaymentMethodFromPlaid(c *gin.Context) {
 		return
 	}
 
-	// Determine account type
-	accountType := "checking"
-	if targetAccount.Type == "depository" && targetAccount.Subtype == "savings" {
-		accountType = "savings"
-	}
-
 	// Create Stripe payment method
 	paymentMethod, err := sc.CreatePaymentMethodFromPlaid(
 		c.Request.Context(),
@@ -160,8 +227,8 @@ func CreatePaymentMethodFromPlaid(c *gin.Context) {
 		accountType,
 	)
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "create_payment_method", "", false, err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment method"})
+		sc.LogAPIError(c.Request.Context(), "create_payment_method", "", err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create payment method", err))
 		return
 	}
 
@@ -169,12 +236,7 @@ func CreatePaymentMethodFromPlaid(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"payment_method": paymentMethod,
-		"account_info": gin.H{
-			"account_id":   targetAccount.AccountID,
-			"account_name": targetAccount.Name,
-			"account_type": accountType,
-			"mask":         targetAccount.Mask,
-		},
+		"account_info":   accountInfo,
 		"message": "Payment method created successfully",
 	})
 }
@@ -196,15 +258,22 @@ func CreateTransferWithStripe(c *gin.Context) {
 
 	sc := stripeClient.(*StripeClient)
 
-	// Validate minimum transfer amount (e.g., $1.00)
-	if req.Amount < 100 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Minimum transfer amount is $1.00"})
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
-
-	// Set default currency if not provided
-	if req.Currency == "" {
-		req.Currency = "usd"
+	// Checks the currency and its minimum amount
+	if !validateTransferCurrency(c, uidVal.(string), &req.Currency, req.Amount) {
+		return
+	}
+	fee := transferFunding(c, &req)
+	if fee == nil {
+		return
+	}
+	// A sender paying the fee is charged it too
+	if !enforceSendLimits(c, uidVal.(string), fee.Amount, req.Currency) {
+		return
 	}
 
 	// TODO: In a real implementation, you would:
@@ -216,27 +285,36 @@ func CreateTransferWithStripe(c *gin.Context) {
 	// For now, we'll create a payment intent that requires confirmation
     paymentIntent, err := sc.CreatePaymentIntent(
         c.Request.Context(),
-        req.Amount,
+        fee.Amount,
         req.Currency,
         "", // Customer ID would come from database
         "", // Payment method ID would come from database
-        nil,
+        map[string]string{"fee_amount": strconv.FormatInt(fee.Fee, 10)},
+        fundingPaymentMethodTypes(req.FundingSource),
     )
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "create_transfer", req.UserID, false, err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transfer"})
+		sc.LogAPIError(c.Request.Context(), "create_transfer", req.UserID, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create transfer", err))
 		return
 	}
 
 	sc.LogAPIInteraction(c.Request.Context(), "create_transfer", req.UserID, true, fmt.Sprintf("Payment Intent ID: %s", paymentIntent.ID))
+	if !recordPendingTransfer(c, sc, uidVal.(string), paymentIntent, req.Currency) {
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"transfer_id":       paymentIntent.ID,
-		"amount":           req.Amount,
+		"amount":           fee.Amount,
+		"net_amount":       fee.NetAmount,
 		"currency":         req.Currency,
 		"status":           paymentIntent.Status,
 		"client_secret":    paymentIntent.ClientSecret,
+		"funding_source":   req.FundingSource,
+		"fee":              fee,
 		"requires_confirmation": true,
+		"requires_action":  paymentIntent.NextAction != nil,
+		"next_action":      paymentIntent.NextAction,
 		"message":          "Transfer initiated, requires confirmation",
 	})
 }
@@ -258,15 +336,22 @@ func CreateP2PTransferWithStripe(c *gin.Context) {
 
 	sc := stripeClient.(*StripeClient)
 
-	// Validate minimum transfer amount
-	if req.Amount < 100 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Minimum transfer amount is $1.00"})
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
-
-	// Set default currency if not provided
-	if req.Currency == "" {
-		req.Currency = "usd"
+	// Checks the currency and its minimum amount
+	if !validateTransferCurrency(c, uidVal.(string), &req.Currency, req.Amount) {
+		return
+	}
+	fee := transferFunding(c, &req)
+	if fee == nil {
+		return
+	}
+	// A sender paying the fee is charged it too
+	if !enforceSendLimits(c, uidVal.(string), fee.Amount, req.Currency) {
+		return
 	}
 
 	// TODO: In a real implementation, you would:
@@ -278,32 +363,66 @@ func CreateP2PTransferWithStripe(c *gin.Context) {
 	// Create payment intent for P2P transfer
     paymentIntent, err := sc.CreatePaymentIntent(
         c.Request.Context(),
-        req.Amount,
+        fee.Amount,
         req.Currency,
         "", // Sender's customer ID
         "", // Sender's payment method ID
-        nil,
+        map[string]string{"fee_amount": strconv.FormatInt(fee.Fee, 10)},
+        fundingPaymentMethodTypes(req.FundingSource),
     )
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "create_p2p_transfer", req.UserID, false, err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create P2P transfer"})
+		sc.LogAPIError(c.Request.Context(), "create_p2p_transfer", req.UserID, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create P2P transfer", err))
 		return
 	}
 
 	sc.LogAPIInteraction(c.Request.Context(), "create_p2p_transfer", req.UserID, true, fmt.Sprintf("P2P Transfer ID: %s", paymentIntent.ID))
+	if !recordPendingTransfer(c, sc, uidVal.(string), paymentIntent, req.Currency) {
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"transfer_id":       paymentIntent.ID,
-		"amount":           req.Amount,
+		"amount":           fee.Amount,
+		"net_amount":       fee.NetAmount,
 		"currency":         req.Currency,
 		"status":           paymentIntent.Status,
 		"client_secret":    paymentIntent.ClientSecret,
 		"type":             "p2p",
+		"funding_source":   req.FundingSource,
+		"fee":              fee,
 		"requires_confirmation": true,
+		"requires_action":  paymentIntent.NextAction != nil,
+		"next_action":      paymentIntent.NextAction,
 		"message":          "P2P transfer initiated, requires confirmation",
 	})
 }
 
+// recordPendingTransfer saves a transfer created for confirmation later,
+// owned by its sender so only they can confirm it. It responds and reports
+// false when the transfer can't be saved.
+func recordPendingTransfer(c *gin.Context, sc *StripeClient, uid string, pi *StripePaymentIntent, currency string) bool {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return false
+	}
+	ctx := c.Request.Context()
+	if _, err := SetTransactionStatus(ctx, v.(*firestore.Client), pi.ID, pi.Status, map[string]interface{}{
+		"sender_user_id":    uid,
+		"participants":      []string{uid},
+		"amount":            pi.Amount,
+		"currency":          currency,
+		"payment_intent_id": pi.ID,
+		"created_at":        time.Now(),
+	}); err != nil {
+		sc.LogAPIError(ctx, "save_transaction", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save transfer"})
+		return false
+	}
+	return true
+}
+
 // ConfirmTransfer confirms a pending transfer
 func ConfirmTransfer(c *gin.Context) {
 	var req ConfirmTransferRequest
@@ -317,24 +436,70 @@ func ConfirmTransfer(c *gin.Context) {
 		return
 	}
 
-	// Get Stripe client from context
-	stripeClient, exists := c.Get("stripeClient")
-	if !exists {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+	pp, ok := paymentProviderFor(c)
+	if !ok {
 		return
 	}
+	uid := c.GetString("userID")
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
 
-	sc := stripeClient.(*StripeClient)
+	// Only the sender may confirm, and so authorize, their own payment
+	if !callerSentTransfer(c, fs, uid, req.PaymentIntentID) {
+		return
+	}
+
+	existing, err := pp.GetPayment(ctx, req.PaymentIntentID)
+	if err != nil {
+		pp.LogAPIError(ctx, "confirm_transfer", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to confirm transfer", err))
+		return
+	}
+	if existing.NextAction != nil {
+		// Already confirmed and waiting on the customer; confirming again
+		// would restart authentication
+		respondRequiresAction(c, existing)
+		return
+	}
+
+	// Bank debits need the customer's authorization on record before they run
+	var auth *ACHAuthorization
+	if slices.Contains(existing.PaymentMethodTypes, "us_bank_account") {
+		auth, err = RecordACHAuthorization(ctx, fs, uid, existing, c.ClientIP(), c.Request.UserAgent())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record authorization"})
+			return
+		}
+	}
 
 	// Confirm the payment intent
-	paymentIntent, err := sc.ConfirmPaymentIntent(c.Request.Context(), req.PaymentIntentID)
+	paymentIntent, err := pp.ConfirmPayment(ctx, req.PaymentIntentID, auth)
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "confirm_transfer", "", false, err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm transfer"})
+		pp.LogAPIError(ctx, "confirm_transfer", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to confirm transfer", err))
 		return
 	}
 
-	sc.LogAPIInteraction(c.Request.Context(), "confirm_transfer", "", true, fmt.Sprintf("Confirmed Payment Intent: %s", paymentIntent.ID))
+	pp.LogAPIInteraction(ctx, "confirm_transfer", uid, true, fmt.Sprintf("Confirmed Payment Intent: %s", paymentIntent.ID))
+
+	var fields map[string]interface{}
+	if auth != nil {
+		fields = map[string]interface{}{"ach_authorization_id": auth.ID}
+	}
+	if _, err := SetTransactionStatus(ctx, fs, paymentIntent.ID, paymentIntent.Status, fields); err != nil {
+		pp.LogAPIError(ctx, "save_transaction", uid, err)
+	}
+
+	if paymentIntent.NextAction != nil {
+		// The issuer still wants the customer to authenticate (e.g. 3D Secure)
+		respondRequiresAction(c, paymentIntent)
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"transfer_id": paymentIntent.ID,
@@ -345,6 +510,103 @@ func ConfirmTransfer(c *gin.Context) {
 	})
 }
 
+// callerSentTransfer responds 404 unless the caller is the transfer's sender.
+// It must pass before anything about the payment, such as its client secret,
+// goes back to the caller.
+func callerSentTransfer(c *gin.Context, fs *firestore.Client, uid, id string) bool {
+	doc, err := getDocument(c.Request.Context(), fs.Collection("transactions").Doc(id))
+	if err != nil || uid == "" || stringField(doc.Data(), "sender_user_id") != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		return false
+	}
+	return true
+}
+
+// respondRequiresAction tells the client to authenticate a payment, e.g. with
+// stripe.handleCardAction(client_secret), and then call /finalize. The client
+// secret lets whoever holds it complete the payment, so callers check
+// callerSentTransfer first.
+func respondRequiresAction(c *gin.Context, pi *Payment) {
+	c.JSON(http.StatusOK, gin.H{
+		"transfer_id":     pi.ID,
+		"status":          pi.Status,
+		"requires_action": true,
+		"next_action":     pi.NextAction,
+		"client_secret":   pi.ClientSecret,
+		"finalize_url":    "/stripe/transfers/" + pi.ID + "/finalize",
+		"message":         "Authentication required",
+	})
+}
+
+// FinalizeTransfer completes a payment after the client has handled its 3D
+// Secure challenge. PaymentIntents confirmed manually come back to
+// requires_confirmation and are confirmed again here; the transfer to the
+// recipient then follows from the payment_intent.succeeded webhook as usual.
+func FinalizeTransfer(c *gin.Context) {
+	pp, ok := paymentProviderFor(c)
+	if !ok {
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	if !callerSentTransfer(c, fs, uid, id) {
+		return
+	}
+
+	pi, err := pp.GetPayment(ctx, id)
+	if err != nil {
+		pp.LogAPIError(ctx, "finalize_transfer", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to finalize transfer", err))
+		return
+	}
+	if pi.Status == TransactionStatusRequiresConfirmation {
+		pi, err = pp.ConfirmPayment(ctx, id, nil)
+		if err != nil {
+			pp.LogAPIError(ctx, "finalize_transfer", uid, err)
+			c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to finalize transfer", err))
+			return
+		}
+		pp.LogAPIInteraction(ctx, "finalize_transfer", uid, true, fmt.Sprintf("Confirmed Payment Intent: %s", pi.ID))
+	}
+	if _, err := SetTransactionStatus(ctx, fs, id, pi.Status, nil); err != nil {
+		pp.LogAPIError(ctx, "save_transaction", uid, err)
+	}
+
+	switch pi.Status {
+	case TransactionStatusRequiresAction:
+		respondRequiresAction(c, pi)
+	case TransactionStatusRequiresPaymentMethod:
+		// The customer failed or abandoned authentication
+		c.JSON(http.StatusPaymentRequired, gin.H{
+			"transfer_id": pi.ID,
+			"status":      pi.Status,
+			"code":        "authentication_failed",
+			"error":       "Authentication failed; try again or use another payment method",
+		})
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"transfer_id": pi.ID,
+			"status":      pi.Status,
+			"amount":      pi.Amount,
+			"currency":    pi.Currency,
+			"message":     "Transfer finalized",
+		})
+	}
+}
+
 // GetTransferStatus gets the status of a transfer
 func GetTransferStatus(c *gin.Context) {
 	transferID := c.Param("id")
@@ -353,20 +615,25 @@ func GetTransferStatus(c *gin.Context) {
 		return
 	}
 
-	// Get Stripe client from context
-	stripeClient, exists := c.Get("stripeClient")
-	if !exists {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+	pp, ok := paymentProviderFor(c)
+	if !ok {
+		return
+	}
+	uid := c.GetString("userID")
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	if !callerSentTransfer(c, v.(*firestore.Client), uid, transferID) {
 		return
 	}
-
-	sc := stripeClient.(*StripeClient)
 
 	// Get payment intent status
-	paymentIntent, err := sc.GetPaymentIntent(c.Request.Context(), transferID)
+	paymentIntent, err := pp.GetPayment(c.Request.Context(), transferID)
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "get_transfer_status", "", false, err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transfer status"})
+		pp.LogAPIError(c.Request.Context(), "get_transfer_status", uid, err)
+		c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to get transfer status", err))
 		return
 	}
 
@@ -406,42 +673,380 @@ func HandleStripeWebhook(c *gin.Context) {
 	// Validate the webhook
 	event, err := sc.ValidateWebhook(payload, signature)
 	if err != nil {
-		sc.LogAPIInteraction(c.Request.Context(), "webhook_validation", "", false, err.Error())
+		sc.LogAPIError(c.Request.Context(), "webhook_validation", "", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
 		return
 	}
 
-	// Handle different event types
+	// Every regional deployment receives the account's events; leave objects
+	// created in another region to that region's deployment
+	if region := stripeObjectRegion(event.Data.Object); region != "" && region != currentRegion.Name {
+		sc.LogAPIInteraction(c.Request.Context(), "webhook_other_region", "", true, fmt.Sprintf("Event ID: %s, Region: %s", event.ID, region))
+		c.JSON(http.StatusOK, gin.H{"received": true})
+		return
+	}
+
+	// Side effects run on the webhook queue; without Firestore to persist it,
+	// fall back to processing in the request.
+	if v, ok := c.Get("webhookQueue"); ok {
+		if err := v.(*WebhookQueue).Enqueue(c.Request.Context(), event, payload); err != nil {
+			sc.LogAPIError(c.Request.Context(), "webhook_enqueue", "", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue event"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"received": true})
+		return
+	}
+
+	d := &webhookDeps{sc: sc}
+	if v, ok := c.Get("firestore"); ok {
+		d.fs = v.(*firestore.Client)
+	}
+	if v, ok := c.Get("ledger"); ok {
+		d.ledger = v.(LedgerStore)
+	}
+	if v, ok := c.Get("firebaseAuth"); ok {
+		d.auth = v.(*auth.Client)
+	}
+	if err := processStripeEvent(c.Request.Context(), d, event); err != nil {
+		sc.LogAPIError(c.Request.Context(), "webhook_process", "", err)
+	}
+	metrics.Observe(MetricWebhookLag, map[string]string{"provider": "stripe"}, time.Since(time.Unix(event.Created, 0)).Seconds())
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// webhookDeps are the clients webhook side effects run with, outside any request
+type webhookDeps struct {
+	fs     *firestore.Client
+	sc     *StripeClient
+	ledger LedgerStore
+	auth   *auth.Client // for custom claims; nil without Firebase Auth
+}
+
+// postLedger posts a transaction, logging failures like the request-scoped postLedger
+func (d *webhookDeps) postLedger(ctx context.Context, userID string, txn *LedgerTransaction) {
+	if d.ledger == nil {
+		return
+	}
+	if _, err := d.ledger.Post(ctx, txn); err != nil {
+		d.sc.LogAPIError(ctx, "ledger_post", userID, err)
+	}
+}
+
+// processStripeEvent applies a webhook event's side effects. A returned error
+// means the event should be retried; every step is safe to repeat.
+func processStripeEvent(ctx context.Context, d *webhookDeps, event stripe.Event) error {
+	sc := d.sc
 	switch event.Type {
-    case "payment_intent.succeeded":
-        // Attempt transfer orchestration for SCaT using metadata
-        var pi stripe.PaymentIntent
-        if err := json.Unmarshal(event.Data.Raw, &pi); err == nil {
-            recipientAcc := pi.Metadata["recipient_account_id"]
-            if recipientAcc != "" {
-                _, _ = sc.ProcessTransfer(c.Request.Context(), pi.Amount, string(pi.Currency), recipientAcc, pi.ID)
-            }
-        }
-        sc.LogAPIInteraction(c.Request.Context(), "webhook_payment_succeeded", "", true, fmt.Sprintf("Event ID: %s", event.ID))
-        
+	case "payment_intent.succeeded":
+		// Attempt transfer orchestration for SCaT using metadata
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err == nil {
+			if pi.Metadata["flow"] == walletTopUpFlow {
+				if d.fs == nil {
+					return nil
+				}
+				return creditWalletTopUp(ctx, d.fs, d.ledger, pi.Metadata["wallet_user_id"], pi.ID, pi.Amount)
+			}
+			if pi.Metadata["flow"] == escrowOrderFlow {
+				// Booked when the order is captured, and paid out when it's released
+				return nil
+			}
+			recipientUID := pi.Metadata["recipient_user_id"]
+			for _, txn := range chargeLedgerTransactions(pi.ID, recipientUID, pi.Amount, tipAmount(pi.Metadata), string(pi.Currency)) {
+				d.postLedger(ctx, recipientUID, txn)
+			}
+			net := transferAmount(pi.Amount, pi.Metadata)
+			if net < pi.Amount {
+				d.postLedger(ctx, recipientUID, PlatformFeeLedgerTransaction(pi.ID, recipientUID, pi.Amount-net, string(pi.Currency)))
+			}
+			if reserve, days := reserveMetadata(pi.Metadata); reserve > 0 && d.fs != nil {
+				d.postLedger(ctx, recipientUID, ReserveHoldLedgerTransaction(pi.ID, recipientUID, reserve, string(pi.Currency)))
+				if err := holdReserve(ctx, d.fs, pi.ID, recipientUID, reserve, days, string(pi.Currency)); err != nil {
+					return fmt.Errorf("reserve for %s: %w", pi.ID, err)
+				}
+				net -= reserve
+			}
+			currency := string(pi.Currency)
+			if target, targetCurrency, ok := fxTransferLeg(pi.Metadata); ok {
+				for _, txn := range FXConversionLedgerTransactions(pi.ID, recipientUID, net, currency, target, targetCurrency) {
+					d.postLedger(ctx, recipientUID, txn)
+				}
+				net, currency = target, targetCurrency
+			}
+			recipientAcc := pi.Metadata["recipient_account_id"]
+			if recipientAcc != "" && !transferredInline(ctx, d.fs, pi.ID) {
+				// A payment a risk rule holds is transferred once the hold is released
+				held, err := holdRiskyPayment(ctx, d.fs, pi.ID, recipientUID, pi.Amount)
+				if err != nil {
+					return err
+				}
+				if !held {
+					// Keyed by PaymentIntent so retried jobs can't transfer twice
+					tr, err := sc.ProcessTransferWithIdempotency(ctx, net, currency, recipientAcc, pi.ID, "webhook_transfer_"+pi.ID)
+					if err != nil {
+						sc.LogAPIError(ctx, "webhook_transfer", recipientUID, err)
+						return fmt.Errorf("transfer for %s: %w", pi.ID, err)
+					}
+					d.postLedger(ctx, recipientUID, TransferLedgerTransaction(tr.ID, recipientUID, tr.Amount, tr.Currency))
+					if d.fs != nil {
+						_ = SaveTransaction(ctx, d.fs, pi.ID, map[string]interface{}{"transfer_id": tr.ID})
+					}
+				}
+			}
+			recordTransactionOutcome(ctx, d.fs, &pi, "succeeded", EventTransactionSucceeded)
+		}
+		sc.LogAPIInteraction(ctx, "webhook_payment_succeeded", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
 	case "payment_intent.payment_failed":
 		// Handle failed payment
-		sc.LogAPIInteraction(c.Request.Context(), "webhook_payment_failed", "", true, fmt.Sprintf("Event ID: %s", event.ID))
-		
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err == nil {
+			recordTransactionOutcome(ctx, d.fs, &pi, "failed", EventTransactionFailed)
+			if d.fs != nil {
+				if err := OfferPaymentRetry(ctx, d.fs, &pi); err != nil {
+					sc.LogAPIError(ctx, "webhook_payment_retry", pi.Metadata["sender_user_id"], err)
+				}
+				// A bank debit returned before it succeeded
+				if code := paymentFailureCode(&pi); isBankDebit(&pi) && achReturnCode(code) != "" {
+					if err := recordACHReturn(ctx, d, pi.ID, code, false); err != nil {
+						return fmt.Errorf("ach return for %s: %w", pi.ID, err)
+					}
+				}
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_payment_failed", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
+	case "charge.succeeded":
+		// Record the processor fee Stripe withheld from the charge
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err == nil && ch.BalanceTransaction != nil {
+			bt, err := sc.GetBalanceTransaction(ctx, ch.BalanceTransaction.ID)
+			if err != nil {
+				return fmt.Errorf("balance transaction for %s: %w", ch.ID, err)
+			}
+			if bt.Fee > 0 {
+				d.postLedger(ctx, "", FeeLedgerTransaction(bt.ID, bt.Fee, string(bt.Currency)))
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_charge_succeeded", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
+	case "charge.refunded":
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err == nil {
+			if err := recordRefunds(ctx, d, &ch); err != nil {
+				return err
+			}
+			// A bank debit returned after it succeeded comes back as a refund
+			if chargeReturnCode(&ch) != "" && d.fs != nil && ch.PaymentIntent != nil {
+				if err := recordACHReturn(ctx, d, ch.PaymentIntent.ID, ch.FailureCode, true); err != nil {
+					return fmt.Errorf("ach return for %s: %w", ch.PaymentIntent.ID, err)
+				}
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_charge_refunded", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
+	case "charge.dispute.created", "charge.dispute.updated", "charge.dispute.closed":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err == nil && d.fs != nil {
+			if err := RecordDispute(ctx, d.fs, &dispute); err != nil {
+				sc.LogAPIError(ctx, "webhook_dispute", "", err)
+				return fmt.Errorf("dispute %s: %w", dispute.ID, err)
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_dispute", "", true, fmt.Sprintf("Event: %s, ID: %s", event.Type, event.ID))
+
+	case "customer.updated", "customer.deleted":
+		// Dashboard edits and deletions; drift is flagged for admin review
+		if d.fs != nil {
+			if err := SyncStripeCustomer(ctx, d.fs, event); err != nil {
+				sc.LogAPIError(ctx, "webhook_customer_sync", "", err)
+				return fmt.Errorf("customer sync for %s: %w", event.ID, err)
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_customer_sync", "", true, fmt.Sprintf("Event: %s, ID: %s", event.Type, event.ID))
+
+	case "account.updated":
+		// Connected account requirements and capabilities; only arrives when
+		// the Connect webhook endpoint subscribes to it
+		var acc stripe.Account
+		if err := json.Unmarshal(event.Data.Raw, &acc); err == nil && d.fs != nil {
+			if err := syncConnectAccount(ctx, d.fs, &acc); err != nil {
+				sc.LogAPIError(ctx, "webhook_account_updated", "", err)
+				return fmt.Errorf("account %s: %w", acc.ID, err)
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_account_updated", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
+	case "payout.paid", "payout.failed", "payout.canceled":
+		// Payouts from connected accounts; only arrives when the Connect
+		// webhook endpoint subscribes to payout events
+		var po stripe.Payout
+		if err := json.Unmarshal(event.Data.Raw, &po); err == nil {
+			if err := recordPayoutOutcome(ctx, d, event.Account, &po); err != nil {
+				sc.LogAPIError(ctx, "webhook_payout", "", err)
+				return fmt.Errorf("payout %s: %w", po.ID, err)
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_payout", "", true, fmt.Sprintf("Event: %s, ID: %s", event.Type, event.ID))
+
+	case "treasury.financial_account.features_status_updated", "treasury.financial_account.closed",
+		"treasury.received_credit.succeeded", "treasury.received_debit.created", "treasury.credit_reversal.posted":
+		// Direct deposit accounts; only arrive when the Connect webhook
+		// endpoint subscribes to Treasury events
+		if err := processTreasuryEvent(ctx, d, event); err != nil {
+			sc.LogAPIError(ctx, "webhook_treasury", "", err)
+			return fmt.Errorf("treasury event %s: %w", event.ID, err)
+		}
+		sc.LogAPIInteraction(ctx, "webhook_treasury", "", true, fmt.Sprintf("Event: %s, ID: %s", event.Type, event.ID))
+
+	case "transfer.reversed":
+		var tr stripe.Transfer
+		if err := json.Unmarshal(event.Data.Raw, &tr); err == nil {
+			if err := recordTransferReversal(ctx, d, &tr); err != nil {
+				sc.LogAPIError(ctx, "webhook_transfer_reversed", "", err)
+				return fmt.Errorf("transfer %s: %w", tr.ID, err)
+			}
+		}
+		sc.LogAPIInteraction(ctx, "webhook_transfer_reversed", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
 	case "setup_intent.succeeded":
 		// Handle successful setup intent (payment method saved)
-		sc.LogAPIInteraction(c.Request.Context(), "webhook_setup_succeeded", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+		var si stripe.SetupIntent
+		if err := json.Unmarshal(event.Data.Raw, &si); err == nil {
+			recordVerifiedPaymentMethod(ctx, d.fs, &si)
+		}
+		sc.LogAPIInteraction(ctx, "webhook_setup_succeeded", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
+	case "identity.verification_session.verified", "identity.verification_session.requires_input":
+		if err := processIdentityEvent(ctx, d, event); err != nil {
+			sc.LogAPIError(ctx, "webhook_identity", "", err)
+			return fmt.Errorf("identity event %s: %w", event.ID, err)
+		}
+		sc.LogAPIInteraction(ctx, "webhook_identity", "", true, fmt.Sprintf("Event: %s, ID: %s", event.Type, event.ID))
 
 	case "setup_intent.created":
 		// Log creation of setup intent (used to save payment method)
-		sc.LogAPIInteraction(c.Request.Context(), "webhook_setup_created", "", true, fmt.Sprintf("Event ID: %s", event.ID))
-		
+		sc.LogAPIInteraction(ctx, "webhook_setup_created", "", true, fmt.Sprintf("Event ID: %s", event.ID))
+
 	default:
 		// Log unhandled event types
-		sc.LogAPIInteraction(c.Request.Context(), "webhook_unhandled", "", true, fmt.Sprintf("Event Type: %s, ID: %s", event.Type, event.ID))
+		sc.LogAPIInteraction(ctx, "webhook_unhandled", "", true, fmt.Sprintf("Event Type: %s, ID: %s", event.Type, event.ID))
 	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"received": true})
+// transferredInline reports whether the payment was already transferred when it
+// was created (createP2PPayment records the transfer ID on the transaction), or
+// its failed transfer is being retried by RetryFailedTransfers
+func transferredInline(ctx context.Context, fs *firestore.Client, paymentIntentID string) bool {
+	if fs == nil {
+		return false
+	}
+	doc, err := fs.Collection("transactions").Doc(paymentIntentID).Get(ctx)
+	if err != nil {
+		return false
+	}
+	transferID, _ := doc.Data()["transfer_id"].(string)
+	return strings.HasPrefix(transferID, "tr_") || stringField(doc.Data(), "transfer_status") != ""
+}
+
+// recordTransactionOutcome stores a webhook-driven status change and publishes the matching event
+func recordTransactionOutcome(ctx context.Context, fs *firestore.Client, pi *stripe.PaymentIntent, status, eventType string) {
+    if fs == nil {
+        return
+    }
+    metrics.IncCounter(MetricPaymentsTotal, map[string]string{"outcome": status})
+    senderUID := pi.Metadata["sender_user_id"]
+    recipientUID := pi.Metadata["recipient_user_id"]
+    if senderUID == "" && recipientUID == "" {
+        return
+    }
+    fields := map[string]interface{}{
+        "sender_user_id": senderUID,
+    }
+    // Escrowed payments get their recipient when claimed, not from metadata
+    if recipientUID != "" {
+        fields["recipient_user_id"] = recipientUID
+    }
+    // Webhooks can arrive before the payment is recorded; history is ordered
+    // by created_at, so a transaction must never be written without it
+    if doc, _ := fs.Collection("transactions").Doc(pi.ID).Get(ctx); doc != nil && (!doc.Exists() || doc.Data()["created_at"] == nil) {
+        fields["created_at"] = time.Unix(pi.Created, 0)
+        fields["amount"] = pi.Amount
+        fields["currency"] = string(pi.Currency)
+        fields["payment_intent_id"] = pi.ID
+    }
+    if applied, err := SetTransactionStatus(ctx, fs, pi.ID, status, fields); err == nil && !applied {
+        // Out of order, e.g. a failure delivered after the payment succeeded
+        return
+    }
+    PublishEvent(ctx, fs, Event{
+        Type:          eventType,
+        UserIDs:       []string{senderUID, recipientUID},
+        TransactionID: pi.ID,
+        Data:          map[string]interface{}{"amount": pi.Amount, "currency": string(pi.Currency), "status": status},
+    })
+}
+
+// recordRefunds posts every refund on a charge to the ledger against the
+// payment's recipient and publishes a refunded event for each
+func recordRefunds(ctx context.Context, d *webhookDeps, ch *stripe.Charge) error {
+    if ch.Metadata["flow"] == escrowOrderFlow {
+        // Escrow order refunds are booked when they're issued
+        return nil
+    }
+    var senderUID, recipientUID string
+    if d.fs != nil && ch.PaymentIntent != nil {
+        if doc, err := d.fs.Collection("transactions").Doc(ch.PaymentIntent.ID).Get(ctx); err == nil {
+            senderUID, _ = doc.Data()["sender_user_id"].(string)
+            recipientUID, _ = doc.Data()["recipient_user_id"].(string)
+            // Before the events below, so summaries read the refunded amount
+            if err := SaveTransaction(ctx, d.fs, doc.Ref.ID, map[string]interface{}{"amount_refunded": ch.AmountRefunded}); err != nil {
+                return err
+            }
+        }
+    }
+    refunds, err := d.sc.ListChargeRefunds(ctx, ch.ID)
+    if err != nil {
+        d.sc.LogAPIError(ctx, "list_refunds", "", err)
+        return fmt.Errorf("refunds for %s: %w", ch.ID, err)
+    }
+    for _, r := range refunds {
+        if r.Status == stripe.RefundStatusSucceeded || r.Status == stripe.RefundStatusPending {
+            d.postLedger(ctx, recipientUID, RefundLedgerTransaction(r.ID, recipientUID, r.Amount, string(r.Currency)))
+            if d.fs != nil && ch.PaymentIntent != nil {
+                // Keyed by refund so redelivered webhooks publish it once
+                PublishEvent(ctx, d.fs, Event{
+                    ID:            "refund_" + r.ID,
+                    Type:          EventTransactionRefunded,
+                    UserIDs:       []string{senderUID, recipientUID},
+                    TransactionID: ch.PaymentIntent.ID,
+                    Data:          map[string]interface{}{"refund_id": r.ID, "amount": r.Amount, "currency": string(r.Currency), "status": string(r.Status)},
+                })
+            }
+        }
+    }
+    return nil
+}
+
+// recordVerifiedPaymentMethod adds a saved payment method to the owning user's verified funding sources
+func recordVerifiedPaymentMethod(ctx context.Context, fs *firestore.Client, si *stripe.SetupIntent) {
+    if fs == nil || si.Customer == nil || si.PaymentMethod == nil {
+        return
+    }
+    docs, err := QueryUsers(ctx, fs, func(users *firestore.CollectionRef) firestore.Query {
+        return users.Where("stripe_customer_id", "==", si.Customer.ID).Limit(1)
+    })
+    if err != nil || len(docs) == 0 {
+        return
+    }
+    _, _ = docs[0].Ref.Set(ctx, map[string]interface{}{
+        "verified_payment_methods": firestore.ArrayUnion(si.PaymentMethod.ID),
+        "updated_at":               time.Now(),
+    }, firestore.MergeAll)
+    _, _ = AdvanceOnboarding(ctx, fs, docs[0].Ref.ID)
 }
 
 // CreateConnectAccount creates a Stripe Express connected account for the user
@@ -470,8 +1075,8 @@ func CreateConnectAccount(c *gin.Context) {
 
     accID, err := sc.CreateConnectAccount(c.Request.Context(), req.Email, userID, req.Country)
     if err != nil {
-        sc.LogAPIInteraction(c.Request.Context(), "create_connect_account", userID, false, err.Error())
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create connect account"})
+        sc.LogAPIError(c.Request.Context(), "create_connect_account", userID, err)
+        c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create connect account", err))
         return
     }
     sc.LogAPIInteraction(c.Request.Context(), "create_connect_account", userID, true, fmt.Sprintf("Account ID: %s", accID))
@@ -479,7 +1084,7 @@ func CreateConnectAccount(c *gin.Context) {
     // Persist to Firestore if available
     if v, ok := c.Get("firestore"); ok {
         fs := v.(*firestore.Client)
-        _, _ = fs.Collection("users").Doc(userID).Set(c.Request.Context(), map[string]interface{}{
+        _, _ = UserDoc(c.Request.Context(), fs, userID).Set(c.Request.Context(), map[string]interface{}{
             "stripe_account_id": accID,
             "updated_at":       time.Now(),
         }, firestore.MergeAll)
@@ -504,8 +1109,8 @@ func CreateConnectAccountLink(c *gin.Context) {
 
     url, err := sc.CreateAccountLink(c.Request.Context(), req.AccountID)
     if err != nil {
-        sc.LogAPIInteraction(c.Request.Context(), "create_account_link", "", false, err.Error())
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create account link"})
+        sc.LogAPIError(c.Request.Context(), "create_account_link", "", err)
+        c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create account link", err))
         return
     }
     c.JSON(http.StatusOK, gin.H{"url": url})
@@ -536,7 +1141,7 @@ func EnsureOnboarding(c *gin.Context) {
 
     if v, ok := c.Get("firestore"); ok {
         fs := v.(*firestore.Client)
-        docRef := fs.Collection("users").Doc(uid)
+        docRef := UserDoc(c.Request.Context(), fs, uid)
         doc, _ := docRef.Get(c.Request.Context())
         if doc.Exists() {
             if val, err := doc.DataAt("stripe_account_id"); err == nil {
@@ -550,8 +1155,8 @@ func EnsureOnboarding(c *gin.Context) {
             var err error
             accID, err = sc.CreateConnectAccount(c.Request.Context(), email, uid, "US")
             if err != nil {
-                sc.LogAPIInteraction(c.Request.Context(), "ensure_onboarding_account", uid, false, err.Error())
-                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create connect account"})
+                sc.LogAPIError(c.Request.Context(), "ensure_onboarding_account", uid, err)
+                c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create connect account", err))
                 return
             }
             _, _ = docRef.Set(c.Request.Context(), map[string]interface{}{
@@ -563,8 +1168,8 @@ func EnsureOnboarding(c *gin.Context) {
             var err error
             customer, err := sc.CreateCustomer(c.Request.Context(), email, uid, uid)
             if err != nil {
-                sc.LogAPIInteraction(c.Request.Context(), "ensure_onboarding_customer", uid, false, err.Error())
-                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create customer"})
+                sc.LogAPIError(c.Request.Context(), "ensure_onboarding_customer", uid, err)
+                c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create customer", err))
                 return
             }
             custID = customer.ID
@@ -597,8 +1202,8 @@ func GetConnectAccountStatus(c *gin.Context) {
 
     status, err := sc.GetConnectAccountStatus(c.Request.Context(), accID)
     if err != nil {
-        sc.LogAPIInteraction(c.Request.Context(), "get_account_status", "", false, err.Error())
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get account status"})
+        sc.LogAPIError(c.Request.Context(), "get_account_status", "", err)
+        c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to get account status", err))
         return
     }
     // Update Firestore if user mapping known (requires lookup by account id)
@@ -607,126 +1212,582 @@ func GetConnectAccountStatus(c *gin.Context) {
         // If request includes user_id query, store status
         uid := c.Query("user_id")
         if uid != "" {
-            _, _ = fs.Collection("users").Doc(uid).Set(c.Request.Context(), map[string]interface{}{
-                "charges_enabled": status.ChargesEnabled,
-                "payouts_enabled": status.PayoutsEnabled,
-                "updated_at":      time.Now(),
-            }, firestore.MergeAll)
+            _, _ = saveConnectStatus(c.Request.Context(), fs, uid, status)
         }
     }
     c.JSON(http.StatusOK, gin.H{"status": status})
 }
 
+// p2pPayment describes a platform charge whose funds are transferred on to a recipient
+type p2pPayment struct {
+    SenderUID          string
+    RecipientUID       string
+    Amount             int64
+    Currency           string
+    PaymentMethodID    string
+    FundingSource      string                 // bank or card; selects the payment method types, provider default when empty
+    RecipientAccountID string                 // looked up from the recipient's user document when empty
+    IdempotencyKey     string
+    OffSession         bool                   // merchant-initiated; the card must have been set up for off-session use
+    Escrow             bool                   // recipient has no account yet; funds are held until they claim them
+    Fee                *FeeBreakdown          // platform fee withheld from the transfer; nil for none
+    Tip                int64                  // part of Amount the sender added as a tip
+    FX                 *FXQuote               // claimed quote converting the net amount for the recipient; nil for one currency
+    Metadata           map[string]string      // extra PaymentIntent metadata
+    Fields             map[string]interface{} // extra transaction document fields
+    RiskReviewID       string                 // payment risk assessment holding the transfer for review; empty when not in review
+}
+
+// p2pPaymentError carries the status and message a handler should return
+type p2pPaymentError struct {
+    Status  int
+    Message string
+    Cause   error // Stripe error behind the failure, if any
+    Extra   gin.H // added to the response body
+}
+
+func (e *p2pPaymentError) Error() string { return e.Message }
+
+// createP2PPayment charges the sender on the platform, transfers to the recipient
+// when the charge succeeds immediately, and records the transaction. It is the
+// shared flow behind direct P2P payments, retries, and payment requests.
+func createP2PPayment(c *gin.Context, pp PaymentProvider, p p2pPayment) (*Payment, *Payout, error) {
+    ctx := c.Request.Context()
+    if p.Currency == "" { p.Currency = DefaultCurrency }
+
+    var fs *firestore.Client
+    if v, ok := c.Get("firestore"); ok {
+        fs = v.(*firestore.Client)
+    }
+    if p.RecipientAccountID == "" && fs != nil && !p.Escrow {
+        doc, err := getDocument(ctx, UserDoc(ctx, fs, p.RecipientUID))
+        if err == nil {
+            if val, err2 := doc.DataAt(providerUserField(pp.Name(), "account_id")); err2 == nil {
+                if s, ok2 := val.(string); ok2 {
+                    p.RecipientAccountID = s
+                }
+            }
+        }
+    }
+    if p.RecipientAccountID == "" && !p.Escrow {
+        return nil, nil, &p2pPaymentError{Status: http.StatusBadRequest, Message: "recipient_account_id required"}
+    }
+
+    // Riskier recipients may only receive payments up to their tier's cap
+    if fs != nil && !p.Escrow && p.RecipientUID != "" {
+        if terms := riskTierTerms[recipientRiskTier(ctx, fs, p.RecipientUID)]; terms.MaxPayment > 0 && p.Amount > terms.MaxPayment {
+            return nil, nil, &p2pPaymentError{Status: http.StatusForbidden, Message: "This recipient can't receive payments this large", Extra: gin.H{"code": "recipient_limit_exceeded", "max": terms.MaxPayment}}
+        }
+    }
+
+    // Create platform PaymentIntent with recipient metadata
+    meta := map[string]string{
+        "recipient_account_id": p.RecipientAccountID,
+        "sender_user_id":       p.SenderUID,
+        "recipient_user_id":    p.RecipientUID,
+        "flow":                 "scat",
+    }
+    if p.Escrow { meta["escrow"] = "true" }
+    if p.Fee != nil {
+        // Read back by transferAmount wherever the transfer is made
+        meta["fee_amount"] = strconv.FormatInt(p.Fee.Fee, 10)
+        meta["speed"] = p.Fee.Speed
+        meta["fee_payer"] = p.Fee.Payer
+    }
+    if p.Tip > 0 { meta["tip_amount"] = strconv.FormatInt(p.Tip, 10) }
+    // Part of a business's payout may be held in its rolling reserve
+    var reserve, reserveDays int64
+    if fs != nil && !p.Escrow && p.RecipientUID != "" {
+        net := p.Amount
+        if p.Fee != nil { net = p.Fee.NetAmount }
+        reserve, reserveDays = reserveFor(ctx, fs, p.RecipientUID, net)
+    }
+    if reserve > 0 && p.FX != nil {
+        // A reserve is held in the currency charged, which the recipient doesn't receive
+        return nil, nil, &p2pPaymentError{Status: http.StatusBadRequest, Message: "This recipient can't receive payments in another currency", Extra: gin.H{"code": "fx_not_available"}}
+    }
+    if p.FX != nil {
+        for k, v := range fxPaymentMetadata(p.FX) { meta[k] = v }
+    }
+    if reserve > 0 {
+        meta["reserve_amount"] = strconv.FormatInt(reserve, 10)
+        meta["reserve_hold_days"] = strconv.FormatInt(reserveDays, 10)
+    }
+    for k, v := range p.Metadata { meta[k] = v }
+    // Lookup sender customer
+    var senderCustomerID string
+    if fs != nil {
+        doc, err := getDocument(ctx, UserDoc(ctx, fs, p.SenderUID))
+        if err == nil {
+            if val, err2 := doc.DataAt(providerUserField(pp.Name(), "customer_id")); err2 == nil {
+                if s, ok2 := val.(string); ok2 { senderCustomerID = s }
+            }
+        }
+    }
+    if senderCustomerID == "" {
+        return nil, nil, &p2pPaymentError{Status: http.StatusBadRequest, Message: "sender customer not found"}
+    }
+    if p.OffSession && fs != nil {
+        if err := requireOffSessionSetup(ctx, fs, p.SenderUID, p.PaymentMethodID); err != nil {
+            return nil, nil, &p2pPaymentError{Status: http.StatusBadRequest, Message: "Payment method is not set up for off-session payments"}
+        }
+    }
+    sca, err := providerSCAPolicy(ctx, pp, p.PaymentMethodID, p.Amount, p.Currency, p.OffSession)
+    if err != nil {
+        pp.LogAPIError(ctx, "get_payment_method", p.SenderUID, err)
+        return nil, nil, &p2pPaymentError{Status: http.StatusBadRequest, Message: "Invalid payment method", Cause: err}
+    }
+    // Check the sender's bank can cover an ACH debit before it's created, so
+    // it isn't returned NSF days later
+    if check := checkACHBalance(c, pp, fs, p.SenderUID, p.PaymentMethodID, p.Amount); check != nil {
+        c.Set("balanceCheck", check)
+        if check.Status == BalanceInsufficient && balanceCheckMode() == "reject" {
+            return nil, nil, &p2pPaymentError{Status: http.StatusPaymentRequired, Message: "Insufficient funds in your bank account", Extra: gin.H{"code": "insufficient_funds", "balance_check": check}}
+        }
+    }
+    if p.FundingSource == "" && p.PaymentMethodID != "" {
+        // Funded however the payment method is; sca above already loaded it
+        if p.FundingSource, err = paymentFeeMethod(ctx, pp, p.PaymentMethodID); err != nil {
+            return nil, nil, &p2pPaymentError{Status: http.StatusBadRequest, Message: "Invalid payment method", Cause: err}
+        }
+    }
+    // A bank debit confirmed on creation needs the sender's authorization
+    // on record first (NACHA); it is sent with the debit as its mandate
+    var achAuth *ACHAuthorization
+    if p.FundingSource == FeeMethodBank && p.PaymentMethodID != "" && fs != nil {
+        achAuth, err = AuthorizeACHDebit(ctx, fs, p.SenderUID, p.Amount, p.Currency, c.ClientIP(), c.Request.UserAgent())
+        if err != nil {
+            return nil, nil, &p2pPaymentError{Status: http.StatusInternalServerError, Message: "Failed to record authorization"}
+        }
+    }
+    pi, err := pp.CreatePayment(ctx, PaymentParams{
+        Amount:             p.Amount,
+        Currency:           p.Currency,
+        CustomerID:         senderCustomerID,
+        PaymentMethodID:    p.PaymentMethodID,
+        Metadata:           meta,
+        IdempotencyKey:     p.IdempotencyKey,
+        SCA:                sca,
+        PaymentMethodTypes: fundingPaymentMethodTypes(p.FundingSource),
+        ACHAuthorization:   achAuth,
+    })
+    if err != nil {
+        pp.LogAPIError(ctx, "create_payment_intent", p.SenderUID, err)
+        // A declined confirmation still creates a PaymentIntent; record it as failed
+        if se := stripeErrorDetails(err); se != nil && se.PaymentIntentID != "" && fs != nil {
+            data := map[string]interface{}{
+                "sender_user_id":          p.SenderUID,
+                "recipient_user_id":       p.RecipientUID,
+                "amount":                  p.Amount,
+                "currency":                p.Currency,
+                "payment_intent_id":       se.PaymentIntentID,
+                "payment_method_id":       p.PaymentMethodID,
+                "original_transaction_id": se.PaymentIntentID,
+                "attempt":                 1,
+                "status":                  "failed",
+                "failure_code":            se.failureCode(),
+                "stripe_error":            se,
+                "sca_exemption":           sca.Exemption,
+                "created_at":              time.Now(),
+            }
+            for k, v := range p.Fields { data[k] = v }
+            if achAuth != nil {
+                data["ach_authorization_id"] = achAuth.ID
+                if err := LinkACHAuthorization(ctx, fs, achAuth, se.PaymentIntentID); err != nil {
+                    pp.LogAPIError(ctx, "link_ach_authorization", p.SenderUID, err)
+                }
+            }
+            if err := SaveTransaction(ctx, fs, se.PaymentIntentID, data); err != nil {
+                pp.LogAPIError(ctx, "save_transaction", p.SenderUID, err)
+            }
+        }
+        return nil, nil, &p2pPaymentError{Status: http.StatusInternalServerError, Message: "Failed to create payment", Cause: err}
+    }
+
+    // Create transfer if charge succeeded
+    var tr *Payout
+    var transferFailure map[string]interface{}
+    net := p.Amount
+    if p.Fee != nil { net = p.Fee.NetAmount }
+    if pi.Status == "succeeded" {
+        for _, txn := range chargeLedgerTransactions(pi.ID, p.RecipientUID, p.Amount, p.Tip, p.Currency) {
+            postLedger(c, pp, p.RecipientUID, txn)
+        }
+        if net < p.Amount {
+            postLedger(c, pp, p.RecipientUID, PlatformFeeLedgerTransaction(pi.ID, p.RecipientUID, p.Amount-net, p.Currency))
+        }
+        if reserve > 0 {
+            postLedger(c, pp, p.RecipientUID, ReserveHoldLedgerTransaction(pi.ID, p.RecipientUID, reserve, p.Currency))
+            if err := holdReserve(ctx, fs, pi.ID, p.RecipientUID, reserve, reserveDays, p.Currency); err != nil {
+                pp.LogAPIError(ctx, "hold_reserve", p.RecipientUID, err)
+            }
+        }
+        if p.FX != nil {
+            for _, txn := range FXConversionLedgerTransactions(pi.ID, p.RecipientUID, net, p.Currency, p.FX.TargetAmount, p.FX.TargetCurrency) {
+                postLedger(c, pp, p.RecipientUID, txn)
+            }
+        }
+    }
+    // A payment a risk rule catches is held instead of transferred
+    var holdRule string
+    if fs != nil && !p.Escrow && p.RecipientUID != "" {
+        holdRule = paymentHoldRule(ctx, fs, p.RecipientUID, p.Amount)
+    }
+    if holdRule == "" && p.RiskReviewID != "" && fs != nil { holdRule = HoldRuleRiskReview }
+    if pi.Status == "succeeded" && !p.Escrow && holdRule == "" {
+        payoutAmount, payoutCurrency := net-reserve, p.Currency
+        if p.FX != nil { payoutAmount, payoutCurrency = p.FX.TargetAmount, p.FX.TargetCurrency }
+        tr, err = pp.Payout(ctx, payoutAmount, payoutCurrency, p.RecipientAccountID, pi.ID, p.IdempotencyKey)
+        if err != nil {
+            // The sender has been charged: RetryFailedTransfers retries the
+            // transfer with backoff and refunds the charge if it never lands
+            pp.LogAPIError(ctx, "create_transfer", p.RecipientUID, err)
+            if fs == nil {
+                return pi, nil, &p2pPaymentError{Status: http.StatusInternalServerError, Message: "Failed to transfer funds", Cause: err}
+            }
+            transferFailure = transferFailureFields(1, err)
+        } else {
+            pp.LogAPIInteraction(ctx, "create_transfer", p.RecipientUID, true, fmt.Sprintf("Transfer: %s", tr.ID))
+            postLedger(c, pp, p.RecipientUID, TransferLedgerTransaction(tr.ID, p.RecipientUID, tr.Amount, tr.Currency))
+        }
+    }
+
+    // Persist transaction to Firestore if available
+    if fs != nil {
+        data := map[string]interface{}{
+            "sender_user_id":          p.SenderUID,
+            "recipient_user_id":       p.RecipientUID,
+            "amount":                  p.Amount,
+            "currency":                p.Currency,
+            "payment_intent_id":       pi.ID,
+            "payment_method_id":       p.PaymentMethodID,
+            "original_transaction_id": pi.ID,
+            "attempt":                 1,
+            "status":                  pi.Status,
+            "transfer_id":             func() string { if tr != nil { return tr.ID }; return "" }(),
+            "sca_exemption":           sca.Exemption,
+            "created_at":              time.Now(),
+        }
+        if p.Fee != nil {
+            data["fee"] = p.Fee
+            data["fee_amount"] = p.Fee.Fee
+        }
+        if p.Tip > 0 { data["tip_amount"] = p.Tip }
+        if reserve > 0 { data["reserve_amount"] = reserve }
+        if p.FX != nil {
+            for k, v := range fxPaymentFields(p.FX) { data[k] = v }
+        }
+        if achAuth != nil {
+            data["ach_authorization_id"] = achAuth.ID
+            if err := LinkACHAuthorization(ctx, fs, achAuth, pi.ID); err != nil {
+                pp.LogAPIError(ctx, "link_ach_authorization", p.SenderUID, err)
+            }
+        }
+        for k, v := range p.Fields { data[k] = v }
+        for k, v := range transferFailure { data[k] = v }
+        // Frozen as it is saved so the webhook can't transfer it first
+        if holdRule != "" { data["transfer_status"] = TransferStatusFrozen }
+        if p.RiskReviewID != "" { data["risk_assessment_id"] = p.RiskReviewID }
+        if err := SaveTransaction(ctx, fs, pi.ID, data); err != nil {
+            pp.LogAPIError(ctx, "save_transaction", p.SenderUID, err)
+        } else if holdRule != "" {
+            hold, err := placeTransactionHold(ctx, fs, pi.ID, holdRuleReasons[holdRule], holdRule, "")
+            if err != nil {
+                pp.LogAPIError(ctx, "hold_transaction", p.RecipientUID, err)
+            }
+            if p.RiskReviewID != "" {
+                holdID := ""
+                if hold != nil { holdID = hold.ID }
+                linkRiskReview(ctx, fs, p.RiskReviewID, pi.ID, holdID)
+            }
+        }
+        eventData := map[string]interface{}{"amount": p.Amount, "currency": p.Currency, "status": pi.Status}
+        for k, v := range p.Metadata { eventData[k] = v }
+        PublishEvent(ctx, fs, Event{
+            Type:          EventTransactionCreated,
+            UserIDs:       []string{p.SenderUID, p.RecipientUID},
+            TransactionID: pi.ID,
+            Data:          eventData,
+        })
+    }
+    return pi, tr, nil
+}
+
+// respondP2PError writes the response for an error from createP2PPayment
+func respondP2PError(c *gin.Context, err error) {
+    var perr *p2pPaymentError
+    if errors.As(err, &perr) {
+        body := stripeErrorBody(c, perr.Message, perr.Cause)
+        for k, v := range perr.Extra { body[k] = v }
+        c.JSON(perr.Status, body)
+        return
+    }
+    c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment"})
+}
+
 // InitiateP2PPayment creates a PaymentIntent on platform and a Transfer to recipient
 func InitiateP2PPayment(c *gin.Context) {
     var req struct {
-        RecipientUserID string `json:"recipient_user_id" binding:"required"`
-        Amount          int64  `json:"amount" binding:"required,min=50"`
+        RecipientUserID string `json:"recipient_user_id"`
+        // Email or phone of a recipient who may not have an account yet
+        RecipientEmail  string `json:"recipient_email"`
+        RecipientPhone  string `json:"recipient_phone"`
+        // Minor units; at least the currency's minimum payment
+        Amount          int64  `json:"amount" binding:"required,min=1"`
+        // The sender's default currency when empty
         Currency        string `json:"currency"`
         CustomerID      string `json:"customer_id" binding:"required"`
+        // The sender's default payment method when empty
         PaymentMethodID string `json:"payment_method_id"`
+        // standard (default) or instant; instant costs more
+        Speed           string `json:"speed"`
+        // bank, card, or wallet; taken from the payment method when empty
+        FundingSource   string `json:"funding_source"`
+        // recipient (default) or sender; the sender's fee is added to the charge
+        FeePayer        string `json:"fee_payer"`
+        // Added to amount for recipients who are service providers
+        Tip             int64  `json:"tip" binding:"min=0"`
+        // Catalog items the amount pays for; their total must equal amount
+        LineItems       []LineItemRequest `json:"line_items" binding:"omitempty,max=50,dive"`
+        // From GET /fx/quote, to pay a recipient in another currency; amount,
+        // currency, speed, and funding_source must match the quote
+        QuoteID         string `json:"quote_id"`
     }
     if err := c.ShouldBindJSON(&req); err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
-    if req.Currency == "" { req.Currency = "usd" }
+    if req.Speed == "" { req.Speed = FeeSpeedStandard }
+    if req.Speed != FeeSpeedStandard && req.Speed != FeeSpeedInstant {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "speed must be standard or instant"})
+        return
+    }
+    if req.FeePayer == "" { req.FeePayer = FeePayerRecipient }
+    if !validFeePayer(req.FeePayer) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "fee_payer must be sender or recipient"})
+        return
+    }
+    if req.FundingSource != "" && !validFundingSource(req.FundingSource) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "funding_source must be bank, card, or wallet"})
+        return
+    }
+    req.RecipientEmail = normalizeEmail(req.RecipientEmail)
+    req.RecipientPhone = normalizePhone(req.RecipientPhone)
+    if req.RecipientUserID == "" && req.RecipientEmail == "" && req.RecipientPhone == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "recipient_user_id, recipient_email, or recipient_phone is required"})
+        return
+    }
 
-    stripeClient, exists := c.Get("stripeClient")
-    if !exists {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+    pp, ok := paymentProviderFor(c)
+    if !ok {
         return
     }
-    sc := stripeClient.(*StripeClient)
     uidVal, ok := c.Get("userID")
     if !ok {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
         return
     }
     senderUID := uidVal.(string)
-
-    recipientAccountID := c.Query("recipient_account_id")
-    if recipientAccountID == "" {
-        if v, ok := c.Get("firestore"); ok {
-            fs := v.(*firestore.Client)
-            doc, err := fs.Collection("users").Doc(req.RecipientUserID).Get(c.Request.Context())
-            if err == nil {
-                if val, err2 := doc.DataAt("stripe_account_id"); err2 == nil {
-                    if s, ok2 := val.(string); ok2 {
-                        recipientAccountID = s
-                    }
-                }
-            }
-        }
+    if !validatePaymentCurrency(c, senderUID, &req.Currency, req.Amount) {
+        return
     }
-    if recipientAccountID == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "recipient_account_id required"})
+    if !enforceSendLimits(c, senderUID, req.Amount+req.Tip, req.Currency) {
         return
     }
-
-    // Create platform PaymentIntent with recipient metadata
-    meta := map[string]string{
-        "recipient_account_id": recipientAccountID,
-        "sender_user_id":       senderUID,
-        "recipient_user_id":    req.RecipientUserID,
-        "flow":                 "scat",
+    if req.QuoteID != "" && (req.RecipientUserID == "" || req.FundingSource == FeeMethodWallet || req.Tip > 0 || len(req.LineItems) > 0 || req.FeePayer != FeePayerRecipient) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "quote_id pays a recipient_user_id from a bank account or card, without tips or line items, with the recipient paying the fee"})
+        return
     }
-    idem := c.GetHeader("Idempotency-Key")
-    if req.Currency == "" { req.Currency = "usd" }
-    // Lookup sender customer
-    var senderCustomerID string
-    if v, ok := c.Get("firestore"); ok {
-        fs := v.(*firestore.Client)
-        doc, err := fs.Collection("users").Doc(senderUID).Get(c.Request.Context())
-        if err == nil {
-            if val, err2 := doc.DataAt("stripe_customer_id"); err2 == nil {
-                if s, ok2 := val.(string); ok2 { senderCustomerID = s }
-            }
+    if req.Tip > 0 {
+        v, ok := c.Get("firestore")
+        if req.RecipientUserID == "" || req.FundingSource == FeeMethodWallet || !ok || !acceptsTips(c.Request.Context(), v.(*firestore.Client), req.RecipientUserID) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "This recipient can't be tipped"})
+            return
         }
     }
-    if senderCustomerID == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "sender customer not found"})
+    if req.FundingSource == FeeMethodWallet {
+        // Wallet balance moves between Sila wallets; nothing is charged
+        if req.RecipientUserID == "" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "recipient_user_id is required for wallet payments"})
+            return
+        }
+        if len(req.LineItems) > 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "line_items can't be paid from a wallet"})
+            return
+        }
+        if req.Currency != walletCurrency {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Wallet payments are in %s", strings.ToUpper(walletCurrency)), "code": "currency_not_allowed"})
+            return
+        }
+        if req.RecipientUserID == senderUID {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot send to yourself"})
+            return
+        }
+        sendWalletTransfer(c, senderUID, req.RecipientUserID, req.Amount, "")
         return
     }
-    pi, err := sc.CreatePaymentIntentWithIdempotency(c.Request.Context(), req.Amount, req.Currency, senderCustomerID, req.PaymentMethodID, meta, idem)
+    var lineItems []LineItem
+    if len(req.LineItems) > 0 {
+        v, ok := c.Get("firestore")
+        if req.RecipientUserID == "" || !ok {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "recipient_user_id is required for line items"})
+            return
+        }
+        items, total, err := resolveLineItems(c.Request.Context(), v.(*firestore.Client), req.RecipientUserID, req.Currency, req.LineItems)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if total != req.Amount {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "amount must equal the line items' total", "line_items_total": total})
+            return
+        }
+        lineItems = items
+    }
+    if req.PaymentMethodID == "" {
+        if v, ok := c.Get("firestore"); ok {
+            req.PaymentMethodID = defaultPaymentMethod(c.Request.Context(), v.(*firestore.Client), senderUID)
+        }
+    }
+    method, err := paymentFeeMethod(c.Request.Context(), pp, req.PaymentMethodID)
     if err != nil {
-        sc.LogAPIInteraction(c.Request.Context(), "create_payment_intent", senderUID, false, err.Error())
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment"})
+        pp.LogAPIError(c.Request.Context(), "get_payment_method", senderUID, err)
+        c.JSON(http.StatusBadRequest, stripeErrorBody(c, "Invalid payment method", err))
         return
     }
-
-    // Create transfer if charge succeeded
-    var tr *StripeTransfer
-    if pi.Status == "succeeded" {
-        tr, err = sc.ProcessTransferWithIdempotency(c.Request.Context(), req.Amount, req.Currency, recipientAccountID, pi.ID, idem)
+    if req.FundingSource == "" {
+        req.FundingSource = method
+    } else if req.PaymentMethodID != "" && method != req.FundingSource {
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Payment method is not a %s", req.FundingSource)})
+        return
+    } else {
+        // Priced by what the client says it will confirm with
+        method = req.FundingSource
+    }
+    // The fee is kept from the transfer, or added to the charge when the
+    // sender pays it
+    fee := ComputeFee(req.Amount+req.Tip, req.Speed, method, req.FeePayer)
+    if fee.NetAmount <= 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Amount is too small to cover the fee", "fee": fee})
+        return
+    }
+    // Scored before the quote is claimed or anything is charged; a payment
+    // in review goes ahead with its transfer held
+    risk, ok := assessPaymentRisk(c, pp, RiskPayment{
+        SenderUID:       senderUID,
+        RecipientUID:    req.RecipientUserID,
+        Amount:          fee.Amount,
+        Currency:        req.Currency,
+        FundingSource:   req.FundingSource,
+        PaymentMethodID: req.PaymentMethodID,
+    })
+    if !ok {
+        return
+    }
+    if risk.reviewID() != "" {
+        // A payment that fails before it is charged leaves nothing to review
+        defer cancelUnchargedRiskReview(context.WithoutCancel(c.Request.Context()), c.MustGet("firestore").(*firestore.Client), risk)
+    }
+    var fxQuote *FXQuote
+    if req.QuoteID != "" {
+        v, ok := c.Get("firestore")
+        if !ok {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+            return
+        }
+        fxQuote, err = claimFXQuote(c.Request.Context(), v.(*firestore.Client), req.QuoteID, senderUID, req.Currency, req.Amount, req.Speed, method)
+        switch {
+        case errors.Is(err, ErrFXQuoteNotFound):
+            c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "code": "fx_quote_not_found"})
+            return
+        case errors.Is(err, ErrFXQuoteUsed), errors.Is(err, ErrFXQuoteExpired):
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "fx_quote_unavailable"})
+            return
+        case errors.Is(err, ErrFXQuoteMismatch):
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "fx_quote_mismatch"})
+            return
+        case err != nil:
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim quote"})
+            return
+        }
+        // The quote's fee covers the payment's fee and the conversion
+        fee = fxQuote.feeBreakdown()
+    }
+    if req.RecipientUserID == "" {
+        v, ok := c.Get("firestore")
+        if !ok {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+            return
+        }
+        fs := v.(*firestore.Client)
+        uid, err := userIDForContact(c.Request.Context(), fs, req.RecipientEmail, req.RecipientPhone)
         if err != nil {
-            sc.LogAPIInteraction(c.Request.Context(), "create_transfer", req.RecipientUserID, false, err.Error())
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer funds"})
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up recipient"})
+            return
+        }
+        if uid == "" {
+            // Not registered yet: hold the funds until they claim them
+            initiateEscrowedPayment(c, pp, fs, req.RecipientEmail, req.RecipientPhone, p2pPayment{
+                SenderUID:       senderUID,
+                Amount:          fee.Amount,
+                Currency:        req.Currency,
+                PaymentMethodID: req.PaymentMethodID,
+                FundingSource:   req.FundingSource,
+                IdempotencyKey:  c.GetHeader("Idempotency-Key"),
+                Fee:             fee,
+                RiskReviewID:    risk.reviewID(),
+            })
             return
         }
-        sc.LogAPIInteraction(c.Request.Context(), "create_transfer", req.RecipientUserID, true, fmt.Sprintf("Transfer: %s", tr.ID))
+        req.RecipientUserID = uid
     }
 
-    // Persist transaction to Firestore if available
-    if v, ok := c.Get("firestore"); ok {
-        fs := v.(*firestore.Client)
-        data := map[string]interface{}{
-        "sender_user_id":    senderUID,
-        "recipient_user_id": req.RecipientUserID,
-            "amount":            req.Amount,
-            "currency":          req.Currency,
-            "payment_intent_id": pi.ID,
-            "status":            pi.Status,
-            "transfer_id":       func() string { if tr != nil { return tr.ID }; return "" }(),
-            "created_at":        time.Now(),
+    pi, tr, err := createP2PPayment(c, pp, p2pPayment{
+        SenderUID:          senderUID,
+        RecipientUID:       req.RecipientUserID,
+        Amount:             fee.Amount,
+        Currency:           req.Currency,
+        PaymentMethodID:    req.PaymentMethodID,
+        FundingSource:      req.FundingSource,
+        RecipientAccountID: c.Query("recipient_account_id"),
+        IdempotencyKey:     c.GetHeader("Idempotency-Key"),
+        Fee:                fee,
+        Tip:                req.Tip,
+        FX:                 fxQuote,
+        Fields:             func() map[string]interface{} { if lineItems == nil { return nil }; return map[string]interface{}{"line_items": lineItems} }(),
+        RiskReviewID:       risk.reviewID(),
+    })
+    if err != nil {
+        if fxQuote != nil && pi == nil {
+            // Nothing was charged, so the quote can be used again
+            if rerr := releaseFXQuote(c.Request.Context(), c.MustGet("firestore").(*firestore.Client), fxQuote.ID); rerr != nil {
+                pp.LogAPIError(c.Request.Context(), "release_fx_quote", senderUID, rerr)
+            }
         }
-        _, _ = fs.Collection("transactions").Doc(pi.ID).Set(c.Request.Context(), data, firestore.MergeAll)
+        respondP2PError(c, err)
+        return
     }
 
-    c.JSON(http.StatusOK, gin.H{
+    resp := gin.H{
         "payment_intent": pi,
         "transfer":       tr,
-    })
+        "fee":            fee,
+        "gross_amount":   fee.Amount,
+        "net_amount":     fee.NetAmount,
+        "tip":            req.Tip,
+    }
+    if fxQuote != nil { resp["fx_quote"] = fxQuote }
+    if tr == nil && pi.Status == "succeeded" {
+        resp["transfer_status"] = TransferStatusRetrying
+    }
+    if risk.reviewID() != "" {
+        resp["transfer_status"] = TransferStatusFrozen
+    }
+    if pi.NextAction != nil {
+        // The client completes authentication, then calls /stripe/transfers/{id}/finalize
+        resp["requires_action"] = true
+    }
+    c.JSON(http.StatusOK, withBalanceCheck(c, resp))
 }
 
 // CreateSetupIntentForCustomer creates a SetupIntent for saving payment methods
@@ -746,8 +1807,8 @@ func CreateSetupIntentForCustomer(c *gin.Context) {
 
     si, err := sc.CreateSetupIntent(c.Request.Context(), req.CustomerID)
     if err != nil {
-        sc.LogAPIInteraction(c.Request.Context(), "create_setup_intent", "", false, err.Error())
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create setup intent"})
+        sc.LogAPIError(c.Request.Context(), "create_setup_intent", "", err)
+        c.JSON(http.StatusInternalServerError, stripeErrorBody(c, "Failed to create setup intent", err))
         return
     }
 
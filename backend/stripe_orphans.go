@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of orphaned Stripe resource
+const (
+	// StripeOrphanMissingUser means the resource's metadata user_id names a
+	// user who no longer exists
+	StripeOrphanMissingUser = "missing_user"
+	// StripeOrphanUnlinked means the user exists but references another
+	// resource, or none, e.g. a duplicate left by a retried onboarding
+	StripeOrphanUnlinked = "unlinked"
+	// StripeOrphanMissingResource means a user references a resource Stripe
+	// doesn't have
+	StripeOrphanMissingResource = "missing_resource"
+)
+
+// Stripe resource types checked for orphans
+const (
+	StripeResourceCustomer = "customer"
+	StripeResourceAccount  = "account"
+)
+
+// Orphan statuses and the admin actions that resolve them
+const (
+	StripeOrphanOpen     = "open"
+	StripeOrphanResolved = "resolved"
+
+	StripeOrphanActionDelete = "delete_resource"
+	StripeOrphanActionLink   = "link_user"
+	StripeOrphanActionUnlink = "unlink_user"
+	StripeOrphanActionIgnore = "dismiss"
+	// StripeOrphanCleared is recorded when a later scan no longer finds the orphan
+	StripeOrphanCleared = "cleared"
+)
+
+// defaultStripeOrphanGrace skips resources created this recently, which may
+// belong to an onboarding that hasn't saved the ID yet
+const defaultStripeOrphanGrace = 24 * time.Hour
+
+// stripeOrphanUserFields are the user document fields that reference each resource type
+var stripeOrphanUserFields = map[string]string{
+	StripeResourceCustomer: "stripe_customer_id",
+	StripeResourceAccount:  "stripe_account_id",
+}
+
+// StripeOrphan is a Stripe customer or connected account out of step with
+// the users in Firestore, stored at stripe_orphans/{resourceType}_{resourceID}
+// for admin review
+type StripeOrphan struct {
+	ID           string    `json:"id" firestore:"-"`
+	Kind         string    `json:"kind" firestore:"kind"`
+	ResourceType string    `json:"resource_type" firestore:"resource_type"`
+	ResourceID   string    `json:"resource_id" firestore:"resource_id"`
+	UserID       string    `json:"user_id,omitempty" firestore:"user_id,omitempty"`
+	Status       string    `json:"status" firestore:"status"`
+	Resolution   string    `json:"resolution,omitempty" firestore:"resolution,omitempty"`
+	ResolvedBy   string    `json:"resolved_by,omitempty" firestore:"resolved_by,omitempty"`
+	FirstSeenAt  time.Time `json:"first_seen_at" firestore:"first_seen_at"`
+	LastSeenAt   time.Time `json:"last_seen_at" firestore:"last_seen_at"`
+	ResolvedAt   time.Time `json:"resolved_at,omitempty" firestore:"resolved_at,omitempty"`
+}
+
+// stripeOrphanGrace reads STRIPE_ORPHAN_GRACE, e.g. "24h"
+func stripeOrphanGrace() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("STRIPE_ORPHAN_GRACE")); err == nil && d > 0 {
+		return d
+	}
+	return defaultStripeOrphanGrace
+}
+
+// stripeOrphanRef returns the orphan document for a resource
+func stripeOrphanRef(fs *firestore.Client, resourceType, resourceID string) *firestore.DocumentRef {
+	return fs.Collection("stripe_orphans").Doc(resourceType + "_" + resourceID)
+}
+
+// stripeResource is the part of a customer or connected account the scan needs
+type stripeResource struct {
+	ID      string
+	UserID  string
+	Region  string
+	Created time.Time
+}
+
+// listStripeResources lists live customers or connected accounts
+func listStripeResources(ctx context.Context, sc *StripeClient, resourceType string) ([]stripeResource, error) {
+	var resources []stripeResource
+	if resourceType == StripeResourceCustomer {
+		customers, err := sc.ListCustomers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, cust := range customers {
+			if !cust.Deleted {
+				resources = append(resources, stripeResource{ID: cust.ID, UserID: cust.Metadata["user_id"], Region: cust.Metadata["region"], Created: time.Unix(cust.Created, 0)})
+			}
+		}
+		return resources, nil
+	}
+	accounts, err := sc.ListConnectAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range accounts {
+		if !acc.Deleted {
+			resources = append(resources, stripeResource{ID: acc.ID, UserID: acc.Metadata["user_id"], Region: acc.Metadata["region"], Created: time.Unix(acc.Created, 0)})
+		}
+	}
+	return resources, nil
+}
+
+// ScanStripeOrphans compares Stripe customers and connected accounts with the
+// users referencing them and records each mismatch in stripe_orphans. Open
+// orphans a scan no longer finds are closed as cleared. Resources without a
+// user_id, from another region, or inside the grace period are left alone.
+func ScanStripeOrphans(ctx context.Context, d *webhookDeps) error {
+	scanStarted := time.Now()
+	cutoff := scanStarted.Add(-stripeOrphanGrace())
+	for _, resourceType := range []string{StripeResourceCustomer, StripeResourceAccount} {
+		field := stripeOrphanUserFields[resourceType]
+		resources, err := listStripeResources(ctx, d.sc, resourceType)
+		if err != nil {
+			return err
+		}
+		users, err := QueryUsers(ctx, d.fs, func(users *firestore.CollectionRef) firestore.Query {
+			return users.Where(field, ">", "")
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list users with %s: %w", field, err)
+		}
+		referencedBy := make(map[string]string, len(users))
+		for _, user := range users {
+			referencedBy[stringField(user.Data(), field)] = user.Ref.ID
+		}
+
+		inStripe := make(map[string]bool, len(resources))
+		for _, res := range resources {
+			inStripe[res.ID] = true
+			if res.UserID == "" || (res.Region != "" && res.Region != currentRegion.Name) || res.Created.After(cutoff) {
+				continue
+			}
+			if referencedBy[res.ID] != "" {
+				continue
+			}
+			kind := StripeOrphanUnlinked
+			if _, err := getDocument(ctx, UserDoc(ctx, d.fs, res.UserID)); status.Code(err) == codes.NotFound {
+				kind = StripeOrphanMissingUser
+			} else if err != nil {
+				slog.WarnContext(ctx, "stripe orphan check skipped", "component", "stripe_orphans", "resource_id", res.ID, "error", err)
+				continue
+			}
+			if err := recordStripeOrphan(ctx, d.fs, kind, resourceType, res.ID, res.UserID, scanStarted); err != nil {
+				return err
+			}
+		}
+		for resourceID, uid := range referencedBy {
+			if inStripe[resourceID] {
+				continue
+			}
+			if err := recordStripeOrphan(ctx, d.fs, StripeOrphanMissingResource, resourceType, resourceID, uid, scanStarted); err != nil {
+				return err
+			}
+		}
+	}
+	return clearStripeOrphans(ctx, d.fs, scanStarted)
+}
+
+// recordStripeOrphan opens an orphan or, if it is already open, marks it seen
+func recordStripeOrphan(ctx context.Context, fs *firestore.Client, kind, resourceType, resourceID, uid string, seenAt time.Time) error {
+	ref := stripeOrphanRef(fs, resourceType, resourceID)
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			data := snap.Data()
+			if stringField(data, "status") == StripeOrphanOpen {
+				return tx.Update(ref, []firestore.Update{
+					{Path: "kind", Value: kind},
+					{Path: "user_id", Value: uid},
+					{Path: "last_seen_at", Value: seenAt},
+				})
+			}
+			// A dismissed orphan stays dismissed while it is the same kind
+			if stringField(data, "resolution") == StripeOrphanActionIgnore && stringField(data, "kind") == kind {
+				return tx.Update(ref, []firestore.Update{{Path: "last_seen_at", Value: seenAt}})
+			}
+		}
+		// New, or found again after being resolved
+		return tx.Set(ref, StripeOrphan{
+			Kind:         kind,
+			ResourceType: resourceType,
+			ResourceID:   resourceID,
+			UserID:       uid,
+			Status:       StripeOrphanOpen,
+			FirstSeenAt:  seenAt,
+			LastSeenAt:   seenAt,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record stripe orphan %s: %w", resourceID, err)
+	}
+	slog.WarnContext(ctx, "orphaned stripe resource", "component", "stripe_orphans", "kind", kind, "resource_type", resourceType, "resource_id", resourceID, "user_id", uid)
+	return nil
+}
+
+// clearStripeOrphans closes open orphans the scan starting at scanStarted didn't see
+func clearStripeOrphans(ctx context.Context, fs *firestore.Client, scanStarted time.Time) error {
+	docs, err := fs.Collection("stripe_orphans").
+		Where("status", "==", StripeOrphanOpen).
+		Where("last_seen_at", "<", scanStarted).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load stale stripe orphans: %w", err)
+	}
+	for _, doc := range docs {
+		if _, err := doc.Ref.Update(ctx, []firestore.Update{
+			{Path: "status", Value: StripeOrphanResolved},
+			{Path: "resolution", Value: StripeOrphanCleared},
+			{Path: "resolved_at", Value: time.Now()},
+		}); err != nil {
+			slog.ErrorContext(ctx, "failed to clear stripe orphan", "component", "stripe_orphans", "orphan_id", doc.Ref.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// ListStripeOrphans returns orphans by status, open by default, most recently seen first
+func ListStripeOrphans(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("stripe_orphans").
+		Where("status", "==", c.DefaultQuery("status", StripeOrphanOpen)).
+		OrderBy("last_seen_at", firestore.Desc).
+		Limit(200).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load orphans"})
+		return
+	}
+	orphans := make([]StripeOrphan, 0, len(docs))
+	counts := map[string]int{}
+	for _, doc := range docs {
+		var orphan StripeOrphan
+		if err := doc.DataTo(&orphan); err != nil {
+			continue
+		}
+		orphan.ID = doc.Ref.ID
+		orphans = append(orphans, orphan)
+		counts[orphan.Kind]++
+	}
+	c.JSON(http.StatusOK, gin.H{"orphans": orphans, "counts": counts, "actions": stripeOrphanActions})
+}
+
+// stripeOrphanActions lists the cleanup actions offered for each kind of orphan
+var stripeOrphanActions = map[string][]string{
+	StripeOrphanMissingUser:     {StripeOrphanActionDelete, StripeOrphanActionIgnore},
+	StripeOrphanUnlinked:        {StripeOrphanActionDelete, StripeOrphanActionLink, StripeOrphanActionIgnore},
+	StripeOrphanMissingResource: {StripeOrphanActionUnlink, StripeOrphanActionIgnore},
+}
+
+// ResolveStripeOrphan applies a cleanup action to an open orphan: delete the
+// Stripe resource, link it to its user, clear a user's reference to a
+// resource Stripe no longer has, or dismiss. The orphan is re-checked first so
+// an action never undoes something fixed since the scan.
+func ResolveStripeOrphan(c *gin.Context) {
+	var req struct {
+		Action string `json:"action" binding:"required,oneof=delete_resource link_user unlink_user dismiss"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	ref := fs.Collection("stripe_orphans").Doc(c.Param("id"))
+	doc, err := ref.Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Orphan not found"})
+		return
+	}
+	var orphan StripeOrphan
+	if err := doc.DataTo(&orphan); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read orphan"})
+		return
+	}
+	orphan.ID = doc.Ref.ID
+	if orphan.Status != StripeOrphanOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": "Orphan is already resolved"})
+		return
+	}
+	allowed := false
+	for _, action := range stripeOrphanActions[orphan.Kind] {
+		allowed = allowed || action == req.Action
+	}
+	if !allowed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not available for %s orphans", req.Action, orphan.Kind)})
+		return
+	}
+
+	if req.Action != StripeOrphanActionIgnore {
+		scVal, exists := c.Get("stripeClient")
+		if !exists {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stripe client not available"})
+			return
+		}
+		if status, msg := applyStripeOrphanAction(c, fs, scVal.(*StripeClient), orphan, req.Action); status != http.StatusOK {
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+	}
+
+	orphan.Status = StripeOrphanResolved
+	orphan.Resolution = req.Action
+	orphan.ResolvedBy = c.GetString("userID")
+	orphan.ResolvedAt = time.Now()
+	if _, err := ref.Update(ctx, []firestore.Update{
+		{Path: "status", Value: orphan.Status},
+		{Path: "resolution", Value: orphan.Resolution},
+		{Path: "resolved_by", Value: orphan.ResolvedBy},
+		{Path: "resolved_at", Value: orphan.ResolvedAt},
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve orphan"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: orphan.ResolvedBy, Action: AdminAccessWrite, SubjectType: "stripe_orphan", SubjectID: orphan.ID, Query: req.Action}); err != nil {
+		slog.ErrorContext(ctx, "failed to log stripe orphan access", "component", "stripe_orphans", "orphan_id", orphan.ID, "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"orphan": orphan})
+}
+
+// errOrphanUserChanged stops a link or unlink when the user's reference
+// changed after the orphan was re-checked
+var errOrphanUserChanged = errors.New("user reference changed")
+
+// applyStripeOrphanAction re-checks an orphan and carries out a cleanup
+// action, returning the HTTP status and message to report if it can't
+func applyStripeOrphanAction(c *gin.Context, fs *firestore.Client, sc *StripeClient, orphan StripeOrphan, action string) (int, string) {
+	ctx := c.Request.Context()
+	field := stripeOrphanUserFields[orphan.ResourceType]
+
+	var userData map[string]interface{}
+	user, err := getDocument(ctx, UserDoc(ctx, fs, orphan.UserID))
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return http.StatusInternalServerError, "Failed to load user"
+	default:
+		userData = user.Data()
+	}
+	current := stringField(userData, field)
+
+	switch action {
+	case StripeOrphanActionDelete:
+		if current == orphan.ResourceID {
+			return http.StatusConflict, "The user now references this resource"
+		}
+		if orphan.Kind == StripeOrphanMissingUser && userData != nil {
+			return http.StatusConflict, "The user exists again; review before deleting"
+		}
+		if orphan.ResourceType == StripeResourceCustomer {
+			err = sc.DeleteCustomer(ctx, orphan.ResourceID)
+		} else {
+			err = sc.DeleteConnectAccount(ctx, orphan.ResourceID)
+		}
+		if err != nil {
+			sc.LogAPIError(ctx, "delete_orphaned_"+orphan.ResourceType, orphan.UserID, err)
+			return http.StatusBadGateway, "Failed to delete Stripe " + orphan.ResourceType
+		}
+		sc.LogAPIInteraction(ctx, "delete_orphaned_"+orphan.ResourceType, orphan.UserID, true, fmt.Sprintf("Resource: %s", orphan.ResourceID))
+
+	case StripeOrphanActionLink:
+		if userData == nil {
+			return http.StatusConflict, "The user no longer exists"
+		}
+		if current != "" && current != orphan.ResourceID {
+			return http.StatusConflict, "The user already references " + current
+		}
+		// Only if the user still references nothing else when written
+		err := UpdateUser(ctx, fs, orphan.UserID, func(user *firestore.DocumentSnapshot) (map[string]interface{}, error) {
+			if !user.Exists() {
+				return nil, errOrphanUserChanged
+			}
+			if current := stringField(user.Data(), field); current != "" && current != orphan.ResourceID {
+				return nil, errOrphanUserChanged
+			}
+			return map[string]interface{}{field: orphan.ResourceID, "updated_at": time.Now()}, nil
+		})
+		if errors.Is(err, errOrphanUserChanged) {
+			return http.StatusConflict, "The user changed; review again"
+		}
+		if err != nil {
+			return http.StatusInternalServerError, "Failed to link user"
+		}
+
+	case StripeOrphanActionUnlink:
+		if current != orphan.ResourceID {
+			return http.StatusConflict, "The user no longer references this resource"
+		}
+		exists, err := stripeResourceExists(ctx, sc, orphan.ResourceType, orphan.ResourceID)
+		if err != nil {
+			return http.StatusBadGateway, "Failed to check Stripe"
+		}
+		if exists {
+			return http.StatusConflict, "Stripe has this resource again"
+		}
+		err = UpdateUser(ctx, fs, orphan.UserID, func(user *firestore.DocumentSnapshot) (map[string]interface{}, error) {
+			if stringField(user.Data(), field) != orphan.ResourceID {
+				return nil, errOrphanUserChanged
+			}
+			fields := map[string]interface{}{field: firestore.Delete, "updated_at": time.Now()}
+			if orphan.ResourceType == StripeResourceCustomer {
+				// Saved payment methods went with the customer, as on customer.deleted
+				fields["verified_payment_methods"] = firestore.Delete
+			}
+			return fields, nil
+		})
+		if errors.Is(err, errOrphanUserChanged) {
+			return http.StatusConflict, "The user changed; review again"
+		}
+		if err != nil {
+			return http.StatusInternalServerError, "Failed to unlink user"
+		}
+	}
+	return http.StatusOK, ""
+}
+
+// stripeResourceExists reports whether Stripe still has a live customer or connected account
+func stripeResourceExists(ctx context.Context, sc *StripeClient, resourceType, resourceID string) (bool, error) {
+	var err error
+	if resourceType == StripeResourceCustomer {
+		var cust *stripe.Customer
+		if cust, err = sc.GetCustomer(ctx, resourceID); err == nil {
+			return !cust.Deleted, nil
+		}
+	} else if _, err = sc.GetConnectAccountStatus(ctx, resourceID); err == nil {
+		return true, nil
+	}
+	if d := stripeErrorDetails(err); d != nil && (d.HTTPStatus == http.StatusNotFound || d.Code == string(stripe.ErrorCodeResourceMissing)) {
+		return false, nil
+	}
+	return false, err
+}
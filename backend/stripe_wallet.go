@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// walletTopUpFlow marks PaymentIntents that fund a Stripe-backed wallet. The
+// funds stay in the platform's Stripe balance and the wallet is credited
+// when the payment succeeds.
+const walletTopUpFlow = "wallet_topup"
+
+// GetWalletBalance returns the caller's wallet from whichever provider holds it
+func GetWalletBalance(c *gin.Context) {
+	wp, ok := walletProviderFor(c)
+	if !ok {
+		return
+	}
+	if wp.Name() == ProcessorSila {
+		GetSilaBalance(c)
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	wallet, err := loadWallet(c.Request.Context(), v.(*firestore.Client), uidVal.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wallet"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"balance":   wallet.Balance,
+		"held":      wallet.Held,
+		"available": wallet.Available(),
+		"currency":  wallet.Currency,
+		"provider":  wp.Name(),
+	})
+}
+
+// TopUpWallet adds funds from the caller's bank or card to their wallet
+func TopUpWallet(c *gin.Context) {
+	wp, ok := walletProviderFor(c)
+	if !ok {
+		return
+	}
+	switch wp.Name() {
+	case ProcessorSila:
+		DepositToSilaWallet(c)
+	case ProcessorStripe:
+		topUpStripeWallet(c)
+	default:
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Top-ups are not available for this wallet"})
+	}
+}
+
+// WithdrawFromWallet sends wallet funds to the caller's bank
+func WithdrawFromWallet(c *gin.Context) {
+	wp, ok := walletProviderFor(c)
+	if !ok {
+		return
+	}
+	switch wp.Name() {
+	case ProcessorSila:
+		WithdrawFromSilaWallet(c)
+	case ProcessorStripe:
+		withdrawFromStripeWallet(c)
+	default:
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Withdrawals are not available for this wallet"})
+	}
+}
+
+// topUpStripeWallet charges one of the caller's saved payment methods into
+// the platform balance. The wallet is credited once the charge succeeds: at
+// once for most cards, from the webhook for bank debits.
+func topUpStripeWallet(c *gin.Context) {
+	var req struct {
+		Amount          int64  `json:"amount" binding:"required,min=100"` // cents
+		PaymentMethodID string `json:"payment_method_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if _, err := walletHandleForUser(ctx, fs, uid, ProcessorStripe); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your wallet is held with Sila; top it up from your linked bank"})
+		return
+	}
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	customerID := stringField(doc.Data(), providerUserField(ProcessorStripe, "customer_id"))
+	if customerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Add a payment method first"})
+		return
+	}
+	source, err := paymentFeeMethod(ctx, sc, req.PaymentMethodID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment method"})
+		return
+	}
+	sca, err := providerSCAPolicy(ctx, sc, req.PaymentMethodID, req.Amount, walletCurrency, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment method"})
+		return
+	}
+	var achAuth *ACHAuthorization
+	if source == FeeMethodBank {
+		if achAuth, err = AuthorizeACHDebit(ctx, fs, uid, req.Amount, walletCurrency, c.ClientIP(), c.Request.UserAgent()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record authorization"})
+			return
+		}
+	}
+
+	idempotencyKey := "wallet_topup_" + uuid.NewString()
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		idempotencyKey = "wallet_topup_" + uid + "_" + key
+	}
+	pi, err := sc.CreatePaymentIntentWithIdempotency(ctx, PaymentParams{
+		Amount:             req.Amount,
+		Currency:           walletCurrency,
+		CustomerID:         customerID,
+		PaymentMethodID:    req.PaymentMethodID,
+		Metadata:           map[string]string{"flow": walletTopUpFlow, "wallet_user_id": uid},
+		IdempotencyKey:     idempotencyKey,
+		SCA:                sca,
+		PaymentMethodTypes: fundingPaymentMethodTypes(source),
+		ACHAuthorization:   achAuth,
+	})
+	if err != nil {
+		sc.LogAPIError(ctx, "wallet_topup", uid, err)
+		c.JSON(http.StatusPaymentRequired, stripeErrorBody(c, "Top-up failed", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "wallet_topup", uid, true, fmt.Sprintf("PaymentIntent: %s", pi.ID))
+	if achAuth != nil {
+		if err := LinkACHAuthorization(ctx, fs, achAuth, pi.ID); err != nil {
+			sc.LogAPIError(ctx, "link_ach_authorization", uid, err)
+		}
+	}
+	if pi.Status == "succeeded" {
+		var ledger LedgerStore
+		if v, ok := c.Get("ledger"); ok {
+			ledger = v.(LedgerStore)
+		}
+		if err := creditWalletTopUp(ctx, fs, ledger, uid, pi.ID, pi.Amount); err != nil {
+			// The webhook credits it when it arrives
+			slog.ErrorContext(ctx, "failed to credit wallet top-up", "component", "wallet", "payment_intent", pi.ID, "error", err)
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"payment_intent_id": pi.ID,
+		"status":            pi.Status,
+		"client_secret":     pi.ClientSecret,
+		"next_action":       pi.NextAction,
+	})
+}
+
+// creditWalletTopUp credits a succeeded top-up to the user's wallet, once
+func creditWalletTopUp(ctx context.Context, fs *firestore.Client, ledger LedgerStore, uid, paymentIntentID string, amount int64) error {
+	entry := &WalletEntry{
+		UserID:    uid,
+		Reference: paymentIntentID,
+		Source:    ProcessorStripe,
+		Type:      "topup",
+		Amount:    amount,
+	}
+	applied, err := ApplyWalletEntry(ctx, fs, entry, "")
+	if err != nil || !applied {
+		return err
+	}
+	postWalletLedger(ctx, ledger, entry)
+	NotifyUser(ctx, fs, uid, NotificationWalletCredited, "Top-up completed",
+		fmt.Sprintf("%s was added to your wallet", currencyOrDefault(walletCurrency).Format(amount)),
+		map[string]interface{}{"payment_intent_id": paymentIntentID})
+	return nil
+}
+
+// reverseWalletTopUp takes a top-up whose bank debit was returned back out
+// of the wallet, which may leave it negative. It reports whether
+// paymentIntentID was a top-up.
+func reverseWalletTopUp(ctx context.Context, fs *firestore.Client, ledger LedgerStore, paymentIntentID, returnCode string) (bool, error) {
+	doc, err := getDocument(ctx, fs.Collection("wallet_entries").Doc(paymentIntentID))
+	if err != nil {
+		return false, nil
+	}
+	var original WalletEntry
+	if err := doc.DataTo(&original); err != nil || original.Type != "topup" {
+		return false, nil
+	}
+	reversal := &WalletEntry{
+		UserID:    original.UserID,
+		Reference: paymentIntentID + "_reversal",
+		Source:    ProcessorStripe,
+		Type:      "topup_reversal",
+		Amount:    -original.Amount,
+	}
+	applied, err := ApplyWalletEntry(ctx, fs, reversal, "")
+	if err != nil || !applied {
+		return true, err
+	}
+	postWalletLedger(ctx, ledger, reversal)
+	msg := failureMessageFor(returnCode, defaultLocale)
+	NotifyUser(ctx, fs, original.UserID, NotificationWalletDebited, "Top-up returned",
+		fmt.Sprintf("Your bank returned a %s top-up, so it has been taken back out of your wallet. %s", currencyOrDefault(walletCurrency).Format(original.Amount), msg.Message),
+		map[string]interface{}{"payment_intent_id": paymentIntentID, "return_code": achReturnCode(returnCode)})
+	return true, nil
+}
+
+// withdrawFromStripeWallet transfers wallet funds to the caller's connected
+// account, which pays them out to their bank on its payout schedule
+func withdrawFromStripeWallet(c *gin.Context) {
+	var req struct {
+		Amount int64 `json:"amount" binding:"required,min=100"` // cents
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if _, err := walletHandleForUser(ctx, fs, uid, ProcessorStripe); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your wallet is held with Sila; withdraw to your linked bank"})
+		return
+	}
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	accountID := stringField(doc.Data(), providerUserField(ProcessorStripe, "account_id"))
+	if accountID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set up payouts before withdrawing"})
+		return
+	}
+
+	holdID := "hold_" + uuid.NewString()
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		holdID = "hold_" + uid + "_" + key
+	}
+	hold, err := PlaceWalletHold(ctx, fs, uid, holdID, req.Amount, requestDurationSetting("WALLET_HOLD_TTL", defaultWalletHoldTTL))
+	if errors.Is(err, ErrInsufficientFunds) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient wallet balance"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to place wallet hold", "component", "wallet", "user_id", uid, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve funds"})
+		return
+	}
+	if hold.Status != WalletHoldActive {
+		c.JSON(http.StatusOK, gin.H{"transfer_id": hold.Reference})
+		return
+	}
+	if hold.Advance > 0 {
+		// The overdraft buffer covers sends, not cash-outs
+		if err := ReleaseWalletHold(ctx, fs, hold.ID, "overdraft_withdrawal"); err != nil {
+			slog.ErrorContext(ctx, "failed to release wallet hold", "component", "wallet", "hold_id", hold.ID, "error", err)
+		}
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient wallet balance"})
+		return
+	}
+
+	tr, err := sc.ProcessTransferWithIdempotency(ctx, req.Amount, walletCurrency, accountID, "", "wallet_withdraw_"+hold.ID)
+	if err != nil {
+		if relErr := ReleaseWalletHold(ctx, fs, hold.ID, "withdrawal_failed"); relErr != nil {
+			slog.ErrorContext(ctx, "failed to release wallet hold", "component", "wallet", "hold_id", hold.ID, "error", relErr)
+		}
+		sc.LogAPIError(ctx, "wallet_withdraw", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Withdrawal failed; your funds were not moved", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "wallet_withdraw", uid, true, fmt.Sprintf("Transfer: %s", tr.ID))
+
+	debit := &WalletEntry{Reference: tr.ID, Source: ProcessorStripe, Type: "withdraw"}
+	if err := CommitWalletHold(ctx, fs, hold.ID, debit); err != nil {
+		slog.ErrorContext(ctx, "withdrawal transferred but hold commit failed", "component", "wallet", "transfer", tr.ID, "error", err)
+	} else {
+		recordWalletMovement(c, fs, debit)
+	}
+	c.JSON(http.StatusCreated, gin.H{"transfer_id": tr.ID, "amount": tr.Amount})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// syncPageSize bounds how many documents of each kind a single /sync call returns
+const syncPageSize = 200
+
+// SyncResponse is the compact delta returned to mobile clients
+type SyncResponse struct {
+	Transactions  []SyncTransaction        `json:"transactions"`
+	Contacts      []map[string]interface{} `json:"contacts"`
+	Notifications []map[string]interface{} `json:"notifications"`
+	NextCursor    string                   `json:"next_cursor"`
+	HasMore       bool                     `json:"has_more"`
+}
+
+// SyncTransaction is a changed transaction, in the shape GET /transactions lists it
+type SyncTransaction struct {
+	TransactionRecord
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// syncCursor is the position of the last change a client has: its updated_at
+// and, to break ties between documents written at the same instant, its ID
+type syncCursor struct {
+	At time.Time
+	ID string
+}
+
+// before orders cursors by updated_at, then ID
+func (s syncCursor) before(o syncCursor) bool {
+	if !s.At.Equal(o.At) {
+		return s.At.Before(o.At)
+	}
+	return s.ID < o.ID
+}
+
+// String encodes the cursor as "{unix nanoseconds}_{id}"
+func (s syncCursor) String() string {
+	return strconv.FormatInt(s.At.UnixNano(), 10) + "_" + s.ID
+}
+
+// parseSyncCursor decodes a cursor; empty means full sync. Cursors issued
+// before IDs were added are unix milliseconds, and resume from that instant.
+func parseSyncCursor(cursor string) (syncCursor, error) {
+	if cursor == "" {
+		return syncCursor{At: time.Unix(0, 0)}, nil
+	}
+	at, id, ok := strings.Cut(cursor, "_")
+	n, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return syncCursor{}, err
+	}
+	if !ok {
+		return syncCursor{At: time.UnixMilli(n)}, nil
+	}
+	if strings.Contains(id, "/") {
+		return syncCursor{}, fmt.Errorf("invalid document ID in cursor")
+	}
+	return syncCursor{At: time.Unix(0, n), ID: id}, nil
+}
+
+// changedSince returns documents from a query changed after the cursor,
+// oldest change first, and the position of the last one
+func changedSince(ctx context.Context, q firestore.Query, since syncCursor) ([]*firestore.DocumentSnapshot, syncCursor, bool, error) {
+	if since.ID == "" {
+		q = q.Where("updated_at", ">=", since.At).OrderBy("updated_at", firestore.Asc).OrderBy(firestore.DocumentID, firestore.Asc)
+	} else {
+		q = q.OrderBy("updated_at", firestore.Asc).OrderBy(firestore.DocumentID, firestore.Asc).StartAfter(since.At, since.ID)
+	}
+	docs, err := q.Limit(syncPageSize).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, since, false, err
+	}
+
+	latest := since
+	if len(docs) > 0 {
+		last := docs[len(docs)-1]
+		latest.At, _ = last.Data()["updated_at"].(time.Time)
+		latest.ID = last.Ref.ID
+	}
+	return docs, latest, len(docs) == syncPageSize, nil
+}
+
+// syncDocument is a changed contact or notification with its ID
+func syncDocument(doc *firestore.DocumentSnapshot) map[string]interface{} {
+	data := doc.Data()
+	data["id"] = doc.Ref.ID
+	return data
+}
+
+// Sync returns transactions, contacts, and notifications changed since the given cursor
+func Sync(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	since, err := parseSyncCursor(c.Query("cursor"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	locale := requestLocale(c)
+	resp := SyncResponse{
+		Transactions:  []SyncTransaction{},
+		Contacts:      []map[string]interface{}{},
+		Notifications: []map[string]interface{}{},
+	}
+	addTransaction := func(doc *firestore.DocumentSnapshot) {
+		var item SyncTransaction
+		if err := doc.DataTo(&item.TransactionRecord); err != nil {
+			return
+		}
+		item.ID = doc.Ref.ID
+		item.UpdatedAt, _ = doc.Data()["updated_at"].(time.Time)
+		if item.FailureCode != "" {
+			item.FailureMessage = failureMessageFor(item.FailureCode, locale)
+		}
+		resp.Transactions = append(resp.Transactions, item)
+	}
+	queries := []struct {
+		query firestore.Query
+		add   func(*firestore.DocumentSnapshot)
+	}{
+		{fs.Collection("transactions").Where("sender_user_id", "==", uid), addTransaction},
+		{fs.Collection("transactions").Where("recipient_user_id", "==", uid), addTransaction},
+		{UserDoc(ctx, fs, uid).Collection("contacts").Query, func(doc *firestore.DocumentSnapshot) {
+			resp.Contacts = append(resp.Contacts, syncDocument(doc))
+		}},
+		{fs.Collection("notifications").Where("user_id", "==", uid), func(doc *firestore.DocumentSnapshot) {
+			resp.Notifications = append(resp.Notifications, syncDocument(doc))
+		}},
+	}
+
+	// The next cursor must not skip past anything a truncated page left behind,
+	// so it advances to the smallest high-water mark among truncated queries.
+	next := since
+	var truncatedMark *syncCursor
+	for _, q := range queries {
+		docs, latest, truncated, err := changedSince(ctx, q.query, since)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load changes"})
+			return
+		}
+		for _, doc := range docs {
+			q.add(doc)
+		}
+		if next.before(latest) {
+			next = latest
+		}
+		if truncated {
+			resp.HasMore = true
+			if truncatedMark == nil || latest.before(*truncatedMark) {
+				truncatedMark = &latest
+			}
+		}
+	}
+	if truncatedMark != nil {
+		next = *truncatedMark
+	}
+
+	sort.Slice(resp.Transactions, func(i, j int) bool {
+		ti, tj := resp.Transactions[i], resp.Transactions[j]
+		return syncCursor{ti.UpdatedAt, ti.ID}.before(syncCursor{tj.UpdatedAt, tj.ID})
+	})
+
+	resp.NextCursor = next.String()
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultTipPercents are the tip suggestions offered when TIP_SUGGESTIONS,
+// a comma-separated list of percentages, is unset
+var defaultTipPercents = []int64{15, 18, 20}
+
+// TipSuggestion is a suggested tip on a payment
+type TipSuggestion struct {
+	Percent int64 `json:"percent"`
+	Amount  int64 `json:"amount"`
+}
+
+// tipPercents reads the configured tip suggestions
+func tipPercents() []int64 {
+	v := os.Getenv("TIP_SUGGESTIONS")
+	if v == "" {
+		return defaultTipPercents
+	}
+	var percents []int64
+	for _, part := range strings.Split(v, ",") {
+		p, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return defaultTipPercents
+		}
+		percents = append(percents, p)
+	}
+	return percents
+}
+
+// tipSuggestions prices each suggested tip on a payment of amount cents,
+// rounded half up to the cent
+func tipSuggestions(amount int64) []TipSuggestion {
+	percents := tipPercents()
+	suggestions := make([]TipSuggestion, 0, len(percents))
+	for _, p := range percents {
+		suggestions = append(suggestions, TipSuggestion{Percent: p, Amount: (amount*p + 50) / 100})
+	}
+	return suggestions
+}
+
+// tipAmount is the tip recorded in a PaymentIntent's metadata
+func tipAmount(meta map[string]string) int64 {
+	tip, _ := strconv.ParseInt(meta["tip_amount"], 10, 64)
+	return tip
+}
+
+// acceptsTips reports whether a user is a service provider, who may be
+// tipped on payments to them
+func acceptsTips(ctx context.Context, fs *firestore.Client, uid string) bool {
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		return false
+	}
+	provider, _ := doc.Data()["service_provider"].(bool)
+	return provider
+}
+
+// SetServiceProvider marks the caller as a service provider, so senders are
+// offered tips on payments to them and their tips are reported separately
+func SetServiceProvider(c *gin.Context) {
+	var req struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	ctx := c.Request.Context()
+	if err := SaveUserFields(ctx, v.(*firestore.Client), uidVal.(string), map[string]interface{}{
+		"service_provider": *req.Enabled,
+		"updated_at":       time.Now(),
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save service provider setting"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"service_provider": *req.Enabled})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the trace ID on requests and every response
+const RequestIDHeader = "X-Request-ID"
+
+// traceRetention is how long trace documents are kept (via a TTL policy on expire_at)
+const traceRetention = 30 * 24 * time.Hour
+
+// validRequestID bounds caller-supplied IDs so they are safe as document IDs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{8,128}$`)
+
+type traceContextKey struct{}
+
+// TraceAuditEntry is one LogAPIInteraction call made while serving a request
+type TraceAuditEntry struct {
+	Operation string    `json:"operation" firestore:"operation"`
+	UserID    string    `json:"user_id,omitempty" firestore:"user_id,omitempty"`
+	Success   bool      `json:"success" firestore:"success"`
+	Details   string    `json:"details,omitempty" firestore:"details,omitempty"`
+	At        time.Time `json:"at" firestore:"at"`
+
+	StripeError *StripeErrorDetails `json:"stripe_error,omitempty" firestore:"stripe_error,omitempty"`
+}
+
+// TraceStripeRequest is one Stripe API call made while serving a request
+type TraceStripeRequest struct {
+	RequestID  string    `json:"request_id" firestore:"request_id"`
+	Method     string    `json:"method" firestore:"method"`
+	Path       string    `json:"path" firestore:"path"`
+	StatusCode int       `json:"status_code" firestore:"status_code"`
+	ObjectID   string    `json:"object_id,omitempty" firestore:"object_id,omitempty"`
+	At         time.Time `json:"at" firestore:"at"`
+}
+
+// RequestTrace collects what happened while serving one request or webhook
+// job, stored at traces/{id}
+type RequestTrace struct {
+	ID             string               `json:"id" firestore:"-"`
+	Method         string               `json:"method,omitempty" firestore:"method,omitempty"`
+	Route          string               `json:"route,omitempty" firestore:"route,omitempty"`
+	StatusCode     int                  `json:"status_code,omitempty" firestore:"status_code,omitempty"`
+	UserID         string               `json:"user_id,omitempty" firestore:"user_id,omitempty"`
+	Client         *ClientInfo          `json:"client,omitempty" firestore:"client,omitempty"`
+	Audit          []TraceAuditEntry    `json:"audit" firestore:"audit"`
+	StripeRequests []TraceStripeRequest `json:"stripe_requests" firestore:"stripe_requests"`
+	References     []string             `json:"references" firestore:"references"`
+	StartedAt      time.Time            `json:"started_at" firestore:"started_at"`
+	DurationMS     int64                `json:"duration_ms" firestore:"duration_ms"`
+	ExpireAt       time.Time            `json:"-" firestore:"expire_at"`
+
+	mu sync.Mutex
+}
+
+// withTrace returns a context carrying a new trace with the given ID
+func withTrace(ctx context.Context, id string) (context.Context, *RequestTrace) {
+	t := &RequestTrace{ID: id, Audit: []TraceAuditEntry{}, StripeRequests: []TraceStripeRequest{}, References: []string{}, StartedAt: time.Now()}
+	return context.WithValue(ctx, traceContextKey{}, t), t
+}
+
+// traceFromContext returns the trace being collected for ctx, if any
+func traceFromContext(ctx context.Context) *RequestTrace {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(traceContextKey{}).(*RequestTrace)
+	return t
+}
+
+// RequestIDFromContext returns the trace ID for ctx, or ""
+func RequestIDFromContext(ctx context.Context) string {
+	if t := traceFromContext(ctx); t != nil {
+		return t.ID
+	}
+	return ""
+}
+
+func (t *RequestTrace) recordAudit(operation, userID string, success bool, details string, stripeErr *StripeErrorDetails) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Audit = append(t.Audit, TraceAuditEntry{Operation: operation, UserID: userID, Success: success, Details: details, At: time.Now(), StripeError: stripeErr})
+	if stripeErr != nil && stripeErr.PaymentIntentID != "" {
+		t.References = append(t.References, stripeErr.PaymentIntentID)
+	}
+}
+
+func (t *RequestTrace) recordStripe(r TraceStripeRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.StripeRequests = append(t.StripeRequests, r)
+	if r.ObjectID != "" {
+		t.References = append(t.References, r.ObjectID)
+	}
+}
+
+// empty reports whether nothing worth keeping was recorded
+func (t *RequestTrace) empty() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.Audit) == 0 && len(t.StripeRequests) == 0
+}
+
+// save writes the trace; callers run it off the request path
+func (t *RequestTrace) save(ctx context.Context, fs *firestore.Client) {
+	t.mu.Lock()
+	t.DurationMS = time.Since(t.StartedAt).Milliseconds()
+	t.ExpireAt = t.StartedAt.Add(traceRetention)
+	_, err := fs.Collection("traces").Doc(t.ID).Set(ctx, t)
+	t.mu.Unlock()
+	if err != nil {
+		slog.Error("failed to save trace", "component", "trace", "request_id", t.ID, "error", err)
+	}
+}
+
+// errorBodyWriter holds back error responses so the trace ID can be added to their JSON body
+type errorBodyWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *errorBodyWriter) Write(b []byte) (int, error) {
+	if w.Status() >= http.StatusBadRequest {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorBodyWriter) WriteString(s string) (int, error) {
+	if w.Status() >= http.StatusBadRequest {
+		return w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// RequestIDMiddleware assigns every request a trace ID (honouring a valid
+// X-Request-ID from the caller), returns it in the response header and in
+// JSON error bodies, logs the request, and stores a trace of audit entries and Stripe calls for
+// requests that made any or that failed.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		ctx, trace := withTrace(c.Request.Context(), id)
+		c.Request = c.Request.WithContext(ctx)
+		c.Set("requestID", id)
+		c.Header(RequestIDHeader, id)
+
+		writer := &errorBodyWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = writer
+
+		c.Next()
+
+		status := writer.Status()
+		slog.InfoContext(ctx, "request",
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"status", status,
+			"duration_ms", time.Since(trace.StartedAt).Milliseconds(),
+			"user_id", c.GetString("userID"),
+		)
+		if writer.body.Len() > 0 {
+			body := writer.body.Bytes()
+			var obj map[string]interface{}
+			if strings.HasPrefix(writer.Header().Get("Content-Type"), "application/json") && json.Unmarshal(body, &obj) == nil {
+				obj["request_id"] = id
+				if b, err := json.Marshal(obj); err == nil {
+					body = b
+				}
+			}
+			_, _ = writer.ResponseWriter.Write(body)
+		}
+
+		v, ok := c.Get("firestore")
+		if !ok || (trace.empty() && status < http.StatusBadRequest) {
+			return
+		}
+		trace.Method = c.Request.Method
+		trace.Route = c.FullPath()
+		trace.StatusCode = status
+		trace.UserID = c.GetString("userID")
+		if client := ClientFromContext(ctx); client.known() {
+			trace.Client = &client
+		}
+		if !inflightWork.start() {
+			return
+		}
+		go func() {
+			defer inflightWork.done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			trace.save(ctx, v.(*firestore.Client))
+		}()
+	}
+}
+
+// stripeTraceTransport records the Stripe request ID and object of every API
+// call made with a traced context
+type stripeTraceTransport struct {
+	base http.RoundTripper
+}
+
+func (t *stripeTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	trace := traceFromContext(req.Context())
+	if err != nil || trace == nil {
+		return resp, err
+	}
+	entry := TraceStripeRequest{
+		RequestID:  resp.Header.Get("Request-Id"),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		StatusCode: resp.StatusCode,
+		At:         time.Now(),
+	}
+	if body, readErr := io.ReadAll(resp.Body); readErr == nil {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		var obj struct {
+			ID     string `json:"id"`
+			Object string `json:"object"`
+		}
+		if json.Unmarshal(body, &obj) == nil && obj.Object != "list" {
+			entry.ObjectID = obj.ID
+		}
+	}
+	trace.recordStripe(entry)
+	return resp, err
+}
+
+// GetTrace assembles everything recorded for a request ID: its audit entries,
+// Stripe request IDs, and the webhook events received for the objects it touched
+func GetTrace(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	id := c.Param("id")
+	doc, err := fs.Collection("traces").Doc(id).Get(ctx)
+	if err != nil || !doc.Exists() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trace not found"})
+		return
+	}
+	var trace RequestTrace
+	if err := doc.DataTo(&trace); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read trace"})
+		return
+	}
+	trace.ID = doc.Ref.ID
+
+	seen := map[string]bool{}
+	refs := make([]string, 0, len(trace.References))
+	for _, ref := range trace.References {
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	webhooks := []WebhookJob{}
+	for start := 0; start < len(refs); start += firestoreInLimit {
+		chunk := refs[start:min(start+firestoreInLimit, len(refs))]
+		docs, err := fs.Collection("webhook_jobs").Where("object_id", "in", chunk).Documents(ctx).GetAll()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load webhook events"})
+			return
+		}
+		for _, d := range docs {
+			var job WebhookJob
+			if err := d.DataTo(&job); err != nil {
+				continue
+			}
+			job.ID = d.Ref.ID
+			webhooks = append(webhooks, job)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"trace": &trace, "webhook_events": webhooks})
+}
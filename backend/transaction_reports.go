@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons a participant can report a transaction for
+const (
+	ReportNotReceived  = "not_received"
+	ReportWrongAmount  = "wrong_amount"
+	ReportUnauthorized = "unauthorized"
+)
+
+// Transaction report statuses. A report waits for its required evidence,
+// then for review.
+const (
+	ReportAwaitingEvidence = "awaiting_evidence"
+	ReportInReview         = "in_review"
+	ReportResolved         = "resolved"
+)
+
+// Queues reports are routed to. Unauthorized payments and large amounts go to
+// the AML team; the rest to support.
+const (
+	ReportQueueSupport = "support"
+	ReportQueueAML     = "aml"
+)
+
+// Outcomes an admin can resolve a report with
+const (
+	ReportUpheld   = "upheld"
+	ReportRejected = "rejected"
+)
+
+// Money movements a report can freeze
+const (
+	FrozenTransfer = "transfer"
+	FrozenEscrow   = "escrow"
+	FrozenReserve  = "reserve"
+)
+
+const (
+	NotificationReportReceived = "transaction_report_received"
+	NotificationReportResolved = "transaction_report_resolved"
+)
+
+const (
+	// defaultReportAMLThreshold is REPORT_AML_THRESHOLD's default, in minor units
+	defaultReportAMLThreshold = 200000
+	// reportEvidenceMaxBytes is Stripe's limit on a dispute evidence file,
+	// which report evidence is uploaded as so it can back a dispute later
+	reportEvidenceMaxBytes = 5 << 20
+	reportStatementMaxLen  = 5000
+)
+
+// errReportResolved is returned when resolving a report twice
+var errReportResolved = errors.New("report already resolved")
+
+// ReportEvidenceItem is something a reporter is asked to upload. Files are
+// sent as multipart fields named by Kind.
+type ReportEvidenceItem struct {
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+}
+
+// reportEvidence is the evidence asked for each reason
+var reportEvidence = map[string][]ReportEvidenceItem{
+	ReportNotReceived: {
+		{Kind: "payment_confirmation", Description: "A receipt or screenshot showing the payment was sent", Required: true},
+		{Kind: "communication", Description: "Messages with the other person about the missing payment"},
+	},
+	ReportWrongAmount: {
+		{Kind: "agreed_amount", Description: "An invoice, receipt, or message showing the amount agreed", Required: true},
+		{Kind: "communication", Description: "Messages with the other person about the amount"},
+	},
+	ReportUnauthorized: {
+		{Kind: "bank_statement", Description: "A bank or card statement showing the payment you didn't make", Required: true},
+		{Kind: "police_report", Description: "A police or identity theft report, if you filed one"},
+	},
+}
+
+// ReportEvidence is a file uploaded for a report, kept as a Stripe file
+type ReportEvidence struct {
+	Kind       string    `json:"kind" firestore:"kind"`
+	FileID     string    `json:"file_id" firestore:"file_id"`
+	Filename   string    `json:"filename" firestore:"filename"`
+	UploadedAt time.Time `json:"uploaded_at" firestore:"uploaded_at"`
+}
+
+// TransactionReport is a participant's case about a transaction, stored at
+// transaction_reports/{transactionID}; a transaction has at most one
+type TransactionReport struct {
+	ID              string           `json:"id" firestore:"-"`
+	TransactionID   string           `json:"transaction_id" firestore:"transaction_id"`
+	ReporterUserID  string           `json:"reporter_user_id" firestore:"reporter_user_id"`
+	ReporterRole    string           `json:"reporter_role" firestore:"reporter_role"` // sender or recipient
+	SenderUserID    string           `json:"sender_user_id" firestore:"sender_user_id"`
+	RecipientUserID string           `json:"recipient_user_id" firestore:"recipient_user_id"`
+	Amount          int64            `json:"amount" firestore:"amount"`
+	Currency        string           `json:"currency" firestore:"currency"`
+	Reason          string           `json:"reason" firestore:"reason"`
+	Description     string           `json:"description,omitempty" firestore:"description,omitempty"`
+	Statement       string           `json:"statement,omitempty" firestore:"statement,omitempty"`
+	Status          string           `json:"status" firestore:"status"`
+	Queue           string           `json:"queue" firestore:"queue"`
+	Frozen          []string         `json:"frozen" firestore:"frozen"`
+	Evidence        []ReportEvidence `json:"evidence" firestore:"evidence"`
+	Outcome         string           `json:"outcome,omitempty" firestore:"outcome,omitempty"`
+	ResolutionNote  string           `json:"resolution_note,omitempty" firestore:"resolution_note,omitempty"`
+	ResolvedBy      string           `json:"resolved_by,omitempty" firestore:"resolved_by,omitempty"`
+	ResolvedAt      *time.Time       `json:"resolved_at,omitempty" firestore:"resolved_at,omitempty"`
+	CreatedAt       time.Time        `json:"created_at" firestore:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at" firestore:"updated_at"`
+}
+
+// missingEvidence returns the required evidence not yet uploaded
+func (r *TransactionReport) missingEvidence() []ReportEvidenceItem {
+	missing := []ReportEvidenceItem{}
+	for _, item := range reportEvidence[r.Reason] {
+		if item.Required && !slices.ContainsFunc(r.Evidence, func(e ReportEvidence) bool { return e.Kind == item.Kind }) {
+			missing = append(missing, item)
+		}
+	}
+	return missing
+}
+
+// reportQueue routes a report to the AML team when it alleges fraud or is
+// for at least REPORT_AML_THRESHOLD
+func reportQueue(reason string, amount int64) string {
+	threshold := int64(defaultReportAMLThreshold)
+	if v, err := strconv.ParseInt(os.Getenv("REPORT_AML_THRESHOLD"), 10, 64); err == nil && v > 0 {
+		threshold = v
+	}
+	if reason == ReportUnauthorized || amount >= threshold {
+		return ReportQueueAML
+	}
+	return ReportQueueSupport
+}
+
+// reportResponse is how a report is returned to its reporter, with what they
+// still need to upload
+func reportResponse(r *TransactionReport) gin.H {
+	return gin.H{
+		"report":            r,
+		"evidence_requests": reportEvidence[r.Reason],
+		"missing_evidence":  r.missingEvidence(),
+	}
+}
+
+// freezeReportedTransfers stops money from a reported transaction reaching
+// its recipient where it hasn't yet: a transfer still waiting on the charge
+// or being retried, an escrowed payment, and a held reserve. A transfer
+// that already went out can't be frozen.
+func freezeReportedTransfers(ctx context.Context, fs *firestore.Client, transactionID string) ([]string, error) {
+	txnRef := fs.Collection("transactions").Doc(transactionID)
+	reserveRef := fs.Collection("reserves").Doc(transactionID)
+	var frozen []string
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		frozen = []string{}
+		snap, err := tx.Get(txnRef)
+		if err != nil {
+			return err
+		}
+		reserve, err := tx.Get(reserveRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if held := heldTransfer(snap.Data()); held != "" {
+			frozen = append(frozen, held)
+		}
+		if reserve != nil && reserve.Exists() && stringField(reserve.Data(), "status") == ReserveHeld {
+			frozen = append(frozen, FrozenReserve)
+			if err := tx.Update(reserveRef, []firestore.Update{{Path: "status", Value: ReserveFrozen}}); err != nil {
+				return err
+			}
+		}
+		updates := []firestore.Update{{Path: "report_id", Value: transactionID}, {Path: "updated_at", Value: time.Now()}}
+		if slices.Contains(frozen, FrozenTransfer) || slices.Contains(frozen, FrozenEscrow) {
+			updates = append(updates, firestore.Update{Path: "transfer_status", Value: TransferStatusFrozen})
+		}
+		return tx.Update(txnRef, updates)
+	})
+	return frozen, err
+}
+
+// releaseReportedTransfers undoes freezeReportedTransfers. A frozen transfer
+// whose charge has succeeded is retried at once; one still waiting on the
+// charge is made when it succeeds. A transfer also on hold stays frozen until
+// the hold is released.
+func releaseReportedTransfers(ctx context.Context, fs *firestore.Client, r *TransactionReport) error {
+	txnRef := fs.Collection("transactions").Doc(r.TransactionID)
+	reserveRef := fs.Collection("reserves").Doc(r.TransactionID)
+	return fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(txnRef)
+		if err != nil {
+			return err
+		}
+		reserve, err := tx.Get(reserveRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		data := snap.Data()
+		if stringField(data, "transfer_status") == TransferStatusFrozen && stringField(data, "hold_id") == "" {
+			updates := []firestore.Update{{Path: "updated_at", Value: time.Now()}}
+			if slices.Contains(r.Frozen, FrozenTransfer) && stringField(data, "status") == "succeeded" {
+				updates = append(updates,
+					firestore.Update{Path: "transfer_status", Value: TransferStatusRetrying},
+					firestore.Update{Path: "transfer_retry_at", Value: time.Now()})
+			} else {
+				updates = append(updates, firestore.Update{Path: "transfer_status", Value: firestore.Delete})
+			}
+			if err := tx.Update(txnRef, updates); err != nil {
+				return err
+			}
+		}
+		if reserve != nil && reserve.Exists() && stringField(reserve.Data(), "status") == ReserveFrozen {
+			return tx.Update(reserveRef, []firestore.Update{{Path: "status", Value: ReserveHeld}})
+		}
+		return nil
+	})
+}
+
+// loadOwnReport loads the caller's report on a transaction, responding 404 otherwise
+func loadOwnReport(c *gin.Context, fs *firestore.Client, uid string) (*TransactionReport, bool) {
+	doc, err := getDocument(c.Request.Context(), fs.Collection("transaction_reports").Doc(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return nil, false
+	}
+	var r TransactionReport
+	if err := doc.DataTo(&r); err != nil || r.ReporterUserID != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return nil, false
+	}
+	r.ID = doc.Ref.ID
+	return &r, true
+}
+
+// ReportTransaction opens a case about a transaction the caller sent or
+// received. Transfers not yet made are frozen while it is reviewed, and the
+// response lists the evidence to upload with UploadReportEvidence.
+func ReportTransaction(c *gin.Context) {
+	var req struct {
+		Reason      string `json:"reason" binding:"required,oneof=not_received wrong_amount unauthorized"`
+		Description string `json:"description" binding:"max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	txnID := c.Param("id")
+
+	doc, err := getDocument(ctx, fs.Collection("transactions").Doc(txnID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	var rec TransactionRecord
+	if err := doc.DataTo(&rec); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transaction"})
+		return
+	}
+	role := ""
+	switch uid {
+	case rec.SenderUserID:
+		role = "sender"
+	case rec.RecipientUserID:
+		role = "recipient"
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	if req.Reason == ReportUnauthorized && role != "sender" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only the sender can report a payment as unauthorized"})
+		return
+	}
+
+	now := time.Now()
+	r := TransactionReport{
+		ID:              txnID,
+		TransactionID:   txnID,
+		ReporterUserID:  uid,
+		ReporterRole:    role,
+		SenderUserID:    rec.SenderUserID,
+		RecipientUserID: rec.RecipientUserID,
+		Amount:          rec.Amount,
+		Currency:        rec.Currency,
+		Reason:          req.Reason,
+		Description:     req.Description,
+		Status:          ReportAwaitingEvidence,
+		Queue:           reportQueue(req.Reason, rec.Amount),
+		Frozen:          []string{},
+		Evidence:        []ReportEvidence{},
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	ref := fs.Collection("transaction_reports").Doc(txnID)
+	if _, err := ref.Create(ctx, r); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "This transaction has already been reported"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save report"})
+		return
+	}
+
+	// The report stands even if nothing could be frozen; review catches up
+	frozen, err := freezeReportedTransfers(ctx, fs, txnID)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to freeze reported transfers", "component", "reports", "transaction_id", txnID, "error", err)
+	} else if len(frozen) > 0 {
+		r.Frozen = frozen
+		if _, err := ref.Update(ctx, []firestore.Update{{Path: "frozen", Value: frozen}}); err != nil {
+			slog.ErrorContext(ctx, "failed to record frozen transfers", "component", "reports", "transaction_id", txnID, "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "transaction reported", "component", "reports", "transaction_id", txnID,
+		"reason", r.Reason, "queue", r.Queue, "frozen", frozen)
+
+	NotifyUser(ctx, fs, uid, NotificationReportReceived, "We're looking into your report",
+		"Upload the requested evidence so we can review this payment.",
+		map[string]interface{}{"transaction_id": txnID, "report_id": txnID})
+	c.JSON(http.StatusCreated, reportResponse(&r))
+}
+
+// GetTransactionReport returns the caller's report on a transaction and the
+// evidence it still needs
+func GetTransactionReport(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	r, ok := loadOwnReport(c, fs, uid)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, reportResponse(r))
+}
+
+// UploadReportEvidence adds evidence to the caller's report: multipart files
+// named by the evidence kinds it asks for, and an optional statement. The
+// report moves to review once its required evidence is in.
+func UploadReportEvidence(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	r, ok := loadOwnReport(c, fs, uid)
+	if !ok {
+		return
+	}
+	if r.Status == ReportResolved {
+		c.JSON(http.StatusConflict, gin.H{"error": "This report has been resolved"})
+		return
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected multipart form data"})
+		return
+	}
+	statement := c.PostForm("statement")
+	if len(statement) > reportStatementMaxLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("statement must be at most %d characters", reportStatementMaxLen)})
+		return
+	}
+
+	var added []ReportEvidence
+	for _, item := range reportEvidence[r.Reason] {
+		for _, header := range form.File[item.Kind] {
+			if header.Size > reportEvidenceMaxBytes {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is larger than 5MB", header.Filename)})
+				return
+			}
+			f, err := header.Open()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unable to read %s", item.Kind)})
+				return
+			}
+			fileID, err := sc.UploadDisputeEvidenceFile(ctx, header.Filename, f)
+			f.Close()
+			if err != nil {
+				sc.LogAPIError(ctx, "upload_report_evidence", uid, err)
+				c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to upload evidence", err))
+				return
+			}
+			added = append(added, ReportEvidence{Kind: item.Kind, FileID: fileID, Filename: header.Filename, UploadedAt: time.Now()})
+		}
+	}
+	if len(added) == 0 && statement == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No evidence provided", "evidence_requests": reportEvidence[r.Reason]})
+		return
+	}
+
+	r.Evidence = append(r.Evidence, added...)
+	if statement != "" {
+		r.Statement = statement
+	}
+	if r.Status == ReportAwaitingEvidence && len(r.missingEvidence()) == 0 {
+		r.Status = ReportInReview
+	}
+	r.UpdatedAt = time.Now()
+	updates := []firestore.Update{
+		{Path: "status", Value: r.Status},
+		{Path: "statement", Value: r.Statement},
+		{Path: "updated_at", Value: r.UpdatedAt},
+	}
+	if len(added) > 0 {
+		evidence := make([]interface{}, len(added))
+		for i, e := range added {
+			evidence[i] = e
+		}
+		updates = append(updates, firestore.Update{Path: "evidence", Value: firestore.ArrayUnion(evidence...)})
+	}
+	if _, err := fs.Collection("transaction_reports").Doc(r.ID).Update(ctx, updates); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save evidence"})
+		return
+	}
+	c.JSON(http.StatusOK, reportResponse(r))
+}
+
+// ListTransactionReports returns a queue's reports, oldest first so they are
+// worked in order; ?queue= (support by default) and ?status= (in_review by
+// default) pick the queue
+func ListTransactionReports(c *gin.Context) {
+	_, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	queue := c.DefaultQuery("queue", ReportQueueSupport)
+	if queue != ReportQueueSupport && queue != ReportQueueAML {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "queue must be support or aml"})
+		return
+	}
+	docs, err := fs.Collection("transaction_reports").
+		Where("queue", "==", queue).
+		Where("status", "==", c.DefaultQuery("status", ReportInReview)).
+		OrderBy("created_at", firestore.Asc).
+		Limit(100).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load reports"})
+		return
+	}
+	reports := make([]TransactionReport, 0, len(docs))
+	for _, doc := range docs {
+		var r TransactionReport
+		if err := doc.DataTo(&r); err != nil {
+			continue
+		}
+		r.ID = doc.Ref.ID
+		reports = append(reports, r)
+	}
+	c.JSON(http.StatusOK, gin.H{"reports": reports})
+}
+
+// ResolveTransactionReport closes a report. Frozen transfers go out when
+// release_transfers is set; otherwise they stay frozen so the payment can be
+// refunded.
+func ResolveTransactionReport(c *gin.Context) {
+	var req struct {
+		Outcome          string `json:"outcome" binding:"required,oneof=upheld rejected"`
+		Note             string `json:"note" binding:"max=2000"`
+		ReleaseTransfers bool   `json:"release_transfers"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminID, fs, ok := configAdminDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	ref := fs.Collection("transaction_reports").Doc(c.Param("id"))
+	doc, err := getDocument(ctx, ref)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+	var r TransactionReport
+	if err := doc.DataTo(&r); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load report"})
+		return
+	}
+	if r.Status == ReportResolved {
+		c.JSON(http.StatusConflict, gin.H{"error": "This report has already been resolved"})
+		return
+	}
+	// Released before the report is closed, so a failed release can be retried
+	if req.ReleaseTransfers {
+		if err := releaseReportedTransfers(ctx, fs, &r); err != nil {
+			slog.ErrorContext(ctx, "failed to release reported transfers", "component", "reports", "report_id", ref.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release transfers"})
+			return
+		}
+	}
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&r); err != nil {
+			return err
+		}
+		if r.Status == ReportResolved {
+			return errReportResolved
+		}
+		now := time.Now()
+		r.ID, r.Status, r.Outcome, r.ResolutionNote = doc.Ref.ID, ReportResolved, req.Outcome, req.Note
+		r.ResolvedBy, r.ResolvedAt, r.UpdatedAt = adminID, &now, now
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: r.Status},
+			{Path: "outcome", Value: r.Outcome},
+			{Path: "resolution_note", Value: r.ResolutionNote},
+			{Path: "resolved_by", Value: adminID},
+			{Path: "resolved_at", Value: now},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	switch {
+	case errors.Is(err, errReportResolved):
+		c.JSON(http.StatusConflict, gin.H{"error": "This report has already been resolved"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve report"})
+		return
+	}
+	if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "transaction_report", SubjectID: r.ID}); err != nil {
+		slog.ErrorContext(ctx, "failed to log report access", "component", "reports", "report_id", r.ID, "error", err)
+	}
+
+	body := "We reviewed your report and found in your favor."
+	if r.Outcome == ReportRejected {
+		body = "We reviewed your report and couldn't confirm the problem."
+	}
+	NotifyUser(ctx, fs, r.ReporterUserID, NotificationReportResolved, "Your report was reviewed", body,
+		map[string]interface{}{"transaction_id": r.TransactionID, "report_id": r.ID, "outcome": r.Outcome})
+	c.JSON(http.StatusOK, gin.H{"report": r})
+}
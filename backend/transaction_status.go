@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Transaction statuses a card payment moves through. Most mirror the Stripe
+// PaymentIntent status they were recorded from; failed is a payment_failed
+// webhook, returned is a bank debit returned after it succeeded, and expired
+// is set by CancelStalePaymentIntents.
+const (
+	TransactionStatusRequiresPaymentMethod = "requires_payment_method"
+	TransactionStatusRequiresConfirmation  = "requires_confirmation"
+	TransactionStatusRequiresAction        = "requires_action"
+	TransactionStatusProcessing            = "processing"
+	TransactionStatusSucceeded             = "succeeded"
+	TransactionStatusFailed                = "failed"
+	TransactionStatusCanceled              = "canceled"
+	TransactionStatusReturned              = "returned"
+)
+
+// transactionTransitions lists the statuses a transaction may move to from
+// each status. A payment that fails or needs authentication can still be
+// completed, since Stripe keeps the PaymentIntent open. A succeeded bank
+// debit can still be returned; returned, canceled, and expired are final.
+// Statuses not listed are not guarded.
+var transactionTransitions = map[string][]string{
+	TransactionStatusRequiresPaymentMethod: {TransactionStatusRequiresConfirmation, TransactionStatusRequiresAction, TransactionStatusProcessing, TransactionStatusSucceeded, TransactionStatusFailed, TransactionStatusCanceled, TransactionStatusExpired},
+	TransactionStatusRequiresConfirmation:  {TransactionStatusRequiresPaymentMethod, TransactionStatusRequiresAction, TransactionStatusProcessing, TransactionStatusSucceeded, TransactionStatusFailed, TransactionStatusCanceled, TransactionStatusExpired},
+	TransactionStatusRequiresAction:        {TransactionStatusRequiresPaymentMethod, TransactionStatusRequiresConfirmation, TransactionStatusProcessing, TransactionStatusSucceeded, TransactionStatusFailed, TransactionStatusCanceled, TransactionStatusExpired},
+	TransactionStatusProcessing:            {TransactionStatusRequiresPaymentMethod, TransactionStatusSucceeded, TransactionStatusFailed},
+	TransactionStatusFailed:                {TransactionStatusRequiresPaymentMethod, TransactionStatusRequiresConfirmation, TransactionStatusRequiresAction, TransactionStatusProcessing, TransactionStatusSucceeded, TransactionStatusCanceled, TransactionStatusExpired},
+	TransactionStatusSucceeded:             {TransactionStatusReturned},
+	TransactionStatusReturned:              {},
+	TransactionStatusCanceled:              {},
+	TransactionStatusExpired:               {},
+}
+
+// canTransitionTransaction reports whether a transaction in status from may
+// move to status to. Rewriting the current status is allowed so redelivered
+// webhooks stay harmless.
+func canTransitionTransaction(from, to string) bool {
+	if from == "" || from == to {
+		return true
+	}
+	allowed, guarded := transactionTransitions[from]
+	if !guarded {
+		return true
+	}
+	for _, s := range allowed {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTransactionStatus moves transactions/{id} to newStatus, merging fields
+// with it, unless that would be a transition the state machine forbids; then
+// nothing is written and it returns false. Webhooks and client calls race,
+// so a late requires_action must not overwrite a payment that has succeeded.
+// A missing transaction is only created when fields set created_at, since
+// history is ordered by it.
+func SetTransactionStatus(ctx context.Context, fs *firestore.Client, id, newStatus string, fields map[string]interface{}) (bool, error) {
+	merged := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		merged[k] = v
+	}
+	merged["status"] = newStatus
+	data, err := transactionData(ctx, merged)
+	if err != nil {
+		return false, err
+	}
+	ref := fs.Collection("transactions").Doc(id)
+	applied := false
+	err = fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		applied = false
+		var current string
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err != nil {
+			if _, creating := fields["created_at"]; !creating {
+				return nil
+			}
+		} else {
+			current = stringField(doc.Data(), "status")
+		}
+		if !canTransitionTransaction(current, newStatus) {
+			slog.WarnContext(ctx, "ignored transaction status change", "component", "transactions", "transaction_id", id, "from", current, "to", newStatus)
+			return nil
+		}
+		applied = true
+		return tx.Set(ref, data, firestore.MergeAll)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to set transaction %s status: %w", id, err)
+	}
+	return applied, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GET /stream/transactions pushes the caller's transaction status changes as
+// server-sent events. It listens to the caller's transactions in Firestore
+// rather than to webhooks in this process, so a change recorded by webhook
+// processing on any instance reaches every client connected to any other.
+
+const (
+	// streamHeartbeatInterval keeps idle streams from being closed by load
+	// balancers and proxies
+	streamHeartbeatInterval = 25 * time.Second
+	// streamMaxDuration ends a stream so the client reconnects, resuming
+	// with Last-Event-ID; it bounds how many changes one listener collects
+	streamMaxDuration = 30 * time.Minute
+	// streamMaxReplay is how far back Last-Event-ID can resume from
+	streamMaxReplay = time.Hour
+	// maxStreamsPerUser bounds one user's open streams on an instance
+	maxStreamsPerUser = 5
+)
+
+// MetricTransactionStreams counts transaction streams opened, closed, and
+// rejected for too many open; opened less closed is the number open
+const MetricTransactionStreams = "transaction_streams_total"
+
+// TransactionStatusEvent is the data of a transaction_status event. Its SSE
+// id is updated_at in Unix nanoseconds, which Last-Event-ID resumes from.
+type TransactionStatusEvent struct {
+	TransactionID  string    `json:"transaction_id"`
+	Status         string    `json:"status"`
+	TransferStatus string    `json:"transfer_status,omitempty"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	Role           string    `json:"role"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// transactionStreams counts open streams per user; shutdown is closed on
+// shutdown so open streams end instead of holding up the server's drain
+var transactionStreams = struct {
+	mu       sync.Mutex
+	open     map[string]int
+	shutdown chan struct{}
+	once     sync.Once
+}{open: map[string]int{}, shutdown: make(chan struct{})}
+
+// CloseTransactionStreams ends every open stream; clients reconnect to
+// another instance
+func CloseTransactionStreams() {
+	transactionStreams.once.Do(func() { close(transactionStreams.shutdown) })
+}
+
+// acquireStream reserves one of the user's streams, reporting false when
+// they have too many open
+func acquireStream(uid string) bool {
+	transactionStreams.mu.Lock()
+	defer transactionStreams.mu.Unlock()
+	if transactionStreams.open[uid] >= maxStreamsPerUser {
+		metrics.IncCounter(MetricTransactionStreams, map[string]string{"event": "rejected"})
+		return false
+	}
+	transactionStreams.open[uid]++
+	metrics.IncCounter(MetricTransactionStreams, map[string]string{"event": "opened"})
+	return true
+}
+
+func releaseStream(uid string) {
+	transactionStreams.mu.Lock()
+	defer transactionStreams.mu.Unlock()
+	if transactionStreams.open[uid]--; transactionStreams.open[uid] <= 0 {
+		delete(transactionStreams.open, uid)
+	}
+	metrics.IncCounter(MetricTransactionStreams, map[string]string{"event": "closed"})
+}
+
+// streamStart is where a stream begins: the Last-Event-ID the client resumes
+// from, at most streamMaxReplay ago, or now
+func streamStart(c *gin.Context) time.Time {
+	now := time.Now()
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_event_id")
+	}
+	nanos, err := strconv.ParseInt(lastID, 10, 64)
+	if err != nil {
+		return now
+	}
+	since := time.Unix(0, nanos)
+	if since.After(now) {
+		return now
+	}
+	if since.Before(now.Add(-streamMaxReplay)) {
+		return now.Add(-streamMaxReplay)
+	}
+	return since
+}
+
+// StreamTransactions sends a transaction_status event whenever one of the
+// caller's transactions, sent or received, changes status or transfer
+// status. Comments are sent as heartbeats. On reconnect, EventSource's
+// Last-Event-ID header (or ?last_event_id=) replays changes since that event.
+func StreamTransactions(c *gin.Context) {
+	uid, fs, ok := apiKeyDeps(c)
+	if !ok {
+		return
+	}
+	if !acquireStream(uid) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many open streams", "code": "too_many_streams"})
+		return
+	}
+	defer releaseStream(uid)
+
+	// The listener's context isn't derived from the request's: the request
+	// context's per-call Firestore deadline would cut the listen stream off.
+	// It still ends with the request.
+	ctx, cancel := context.WithTimeout(context.Background(), streamMaxDuration)
+	defer cancel()
+	stop := context.AfterFunc(c.Request.Context(), cancel)
+	defer stop()
+
+	since := streamStart(c)
+	snapshots := fs.Collection("transactions").
+		Where("participants", "array-contains", uid).
+		Where("updated_at", ">", since).
+		OrderBy("updated_at", firestore.Asc).
+		Snapshots(ctx)
+	defer snapshots.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-store")
+	c.Header("Connection", "keep-alive")
+	// Stops nginx-style proxies buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+	c.Writer.Flush()
+
+	changes := make(chan []TransactionStatusEvent)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(changes)
+		// Only status changes are sent; other writes to a transaction also
+		// move it in the listener
+		sent := map[string]string{}
+		for {
+			snap, err := snapshots.Next()
+			if err != nil {
+				errs <- err
+				return
+			}
+			var events []TransactionStatusEvent
+			for _, change := range snap.Changes {
+				if change.Kind == firestore.DocumentRemoved {
+					continue
+				}
+				evt := transactionStatusEvent(change.Doc, uid)
+				key := evt.Status + "/" + evt.TransferStatus
+				if sent[evt.TransactionID] == key {
+					continue
+				}
+				sent[evt.TransactionID] = key
+				events = append(events, evt)
+			}
+			if len(events) == 0 {
+				continue
+			}
+			select {
+			case changes <- events:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case events, ok := <-changes:
+			if !ok {
+				if ctx.Err() != nil {
+					return
+				}
+				// The listener stopped on its own, so it sent why
+				if err := <-errs; status.Code(err) != codes.Canceled {
+					slog.ErrorContext(c.Request.Context(), "transaction stream failed", "component", "streams", "user_id", uid, "error", err)
+					writeStreamEvent(c, "error", "", gin.H{"error": "Stream interrupted; reconnect to resume"})
+				}
+				return
+			}
+			for _, evt := range events {
+				if err := writeStreamEvent(c, "transaction_status", strconv.FormatInt(evt.UpdatedAt.UnixNano(), 10), evt); err != nil {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-transactionStreams.shutdown:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// transactionStatusEvent describes a transaction's status for one of its
+// participants
+func transactionStatusEvent(doc *firestore.DocumentSnapshot, uid string) TransactionStatusEvent {
+	data := doc.Data()
+	evt := TransactionStatusEvent{
+		TransactionID:  doc.Ref.ID,
+		Status:         stringField(data, "status"),
+		TransferStatus: stringField(data, "transfer_status"),
+		Currency:       stringField(data, "currency"),
+		Role:           "recipient",
+	}
+	if stringField(data, "sender_user_id") == uid {
+		evt.Role = "sender"
+	}
+	evt.Amount, _ = data["amount"].(int64)
+	evt.UpdatedAt, _ = data["updated_at"].(time.Time)
+	return evt
+}
+
+// writeStreamEvent writes and flushes one server-sent event
+func writeStreamEvent(c *gin.Context, event, id string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(c.Writer, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes for GET /transactions
+const (
+	defaultTransactionPageSize = 25
+	maxTransactionPageSize     = 100
+)
+
+// TransactionRecord mirrors a document in the transactions collection
+type TransactionRecord struct {
+	ID              string    `json:"id" firestore:"-"`
+	SenderUserID    string    `json:"sender_user_id" firestore:"sender_user_id"`
+	RecipientUserID string    `json:"recipient_user_id" firestore:"recipient_user_id"`
+	Amount          int64     `json:"amount" firestore:"amount"`
+	Currency        string    `json:"currency" firestore:"currency"`
+	PaymentIntentID string    `json:"payment_intent_id" firestore:"payment_intent_id"`
+	TransferID      string    `json:"transfer_id,omitempty" firestore:"transfer_id"`
+	Status          string    `json:"status" firestore:"status"`
+	CreatedAt       time.Time `json:"created_at" firestore:"created_at"`
+
+	// Retry linkage: every attempt carries the ID of the first one
+	PaymentMethodID       string `json:"payment_method_id,omitempty" firestore:"payment_method_id"`
+	FailureCode           string `json:"failure_code,omitempty" firestore:"failure_code"`
+	OriginalTransactionID string `json:"original_transaction_id,omitempty" firestore:"original_transaction_id"`
+	PreviousAttemptID     string `json:"previous_attempt_id,omitempty" firestore:"previous_attempt_id"`
+	Attempt               int    `json:"attempt,omitempty" firestore:"attempt"`
+	RetryAvailable        bool   `json:"retry_available" firestore:"retry_available"`
+	RetriedBy             string `json:"retried_by,omitempty" firestore:"retried_by"`
+
+	// TipAmount is the part of Amount the sender added as a tip
+	TipAmount int64 `json:"tip_amount,omitempty" firestore:"tip_amount"`
+
+	// AmountRefunded is how much of Amount has been refunded to the sender
+	AmountRefunded int64 `json:"amount_refunded,omitempty" firestore:"amount_refunded"`
+
+	// LineItems are the catalog items the payment was for
+	LineItems []LineItem `json:"line_items,omitempty" firestore:"line_items"`
+
+	// ACHAuthorizationID links a bank debit to the authorization the customer gave for it
+	ACHAuthorizationID string `json:"ach_authorization_id,omitempty" firestore:"ach_authorization_id"`
+
+	// FailureMessage explains FailureCode in the caller's language; it is not stored
+	FailureMessage *FailureMessage `json:"failure_message,omitempty" firestore:"-"`
+}
+
+// IsPending reports whether the transaction has not reached a terminal state
+func (t *TransactionRecord) IsPending() bool {
+	switch t.Status {
+	case TransactionStatusSucceeded, TransactionStatusFailed, TransactionStatusCanceled, TransactionStatusExpired, TransactionStatusReturned:
+		return false
+	}
+	return true
+}
+
+// ListUserTransactions returns every transaction the user sent or received,
+// newest first, read within tx
+func ListUserTransactions(tx *firestore.Transaction, fs *firestore.Client, uid string) ([]TransactionRecord, error) {
+	var records []TransactionRecord
+	for _, field := range []string{"sender_user_id", "recipient_user_id"} {
+		docs, err := tx.Documents(fs.Collection("transactions").Where(field, "==", uid)).GetAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to query transactions by %s: %w", field, err)
+		}
+		for _, doc := range docs {
+			var rec TransactionRecord
+			if err := doc.DataTo(&rec); err != nil {
+				continue
+			}
+			rec.ID = doc.Ref.ID
+			records = append(records, rec)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.After(records[j].CreatedAt)
+	})
+	return records, nil
+}
+
+// parseHistoryTime accepts RFC 3339 timestamps or plain dates (YYYY-MM-DD, UTC)
+func parseHistoryTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// transactionHistoryQuery builds the query for the caller's transactions,
+// newest first, filtered by the from, to, and status query params. It
+// responds 400 and returns false for invalid params.
+func transactionHistoryQuery(c *gin.Context, fs *firestore.Client, uid string) (firestore.Query, bool) {
+	query := fs.Collection("transactions").Where("participants", "array-contains", uid)
+	if from := c.Query("from"); from != "" {
+		t, err := parseHistoryTime(from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be RFC 3339 or YYYY-MM-DD"})
+			return query, false
+		}
+		query = query.Where("created_at", ">=", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseHistoryTime(to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be RFC 3339 or YYYY-MM-DD"})
+			return query, false
+		}
+		query = query.Where("created_at", "<", t)
+	}
+	if status := c.Query("status"); status != "" {
+		statuses := strings.Split(status, ",")
+		if len(statuses) > firestoreInLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Too many statuses"})
+			return query, false
+		}
+		query = query.Where("status", "in", statuses)
+	}
+	return query.OrderBy("created_at", firestore.Desc).OrderBy(firestore.DocumentID, firestore.Desc), true
+}
+
+// transactionCursorList names transaction history cursors
+const transactionCursorList = "transactions"
+
+// ListTransactions returns the caller's sent and received payments, newest
+// first by created_at, ties broken by ID. Query params: cursor (next_cursor
+// from the previous page; opaque and only valid with the same filters),
+// limit, from/to (created_at range, to is exclusive), and status
+// (comma-separated). Payments arriving while paging land before the first
+// page, so later pages neither repeat nor skip items.
+func ListTransactions(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	limit := defaultTransactionPageSize
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxTransactionPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxTransactionPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	query, ok := transactionHistoryQuery(c, fs, uid)
+	if !ok {
+		return
+	}
+
+	filters := fmt.Sprintf("from=%s&to=%s&status=%s", c.Query("from"), c.Query("to"), c.Query("status"))
+	if cursor := c.Query("cursor"); cursor != "" {
+		createdAt, id, err := parsePageCursor(cursor, transactionCursorList, uid, filters)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query = query.StartAfter(createdAt, id)
+	}
+
+	// Fetch one extra document to learn whether another page exists
+	docs, err := query.Limit(limit + 1).Documents(ctx).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transactions"})
+		return
+	}
+	hasMore := len(docs) > limit
+	if hasMore {
+		docs = docs[:limit]
+	}
+
+	locale := requestLocale(c)
+	records := make([]TransactionRecord, 0, len(docs))
+	for _, doc := range docs {
+		var rec TransactionRecord
+		if err := doc.DataTo(&rec); err != nil {
+			continue
+		}
+		rec.ID = doc.Ref.ID
+		if rec.FailureCode != "" {
+			rec.FailureMessage = failureMessageFor(rec.FailureCode, locale)
+		}
+		records = append(records, rec)
+	}
+	resp := gin.H{"transactions": records, "has_more": hasMore}
+	if hasMore {
+		last := docs[len(docs)-1]
+		createdAt, _ := last.Data()["created_at"].(time.Time)
+		cursor, err := signPageCursor(transactionCursorList, uid, filters, createdAt, last.Ref.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to sign page cursor", "component", "transactions", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transactions"})
+			return
+		}
+		resp["next_cursor"] = cursor
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// transactionExportColumns is the CSV header of a transaction export
+var transactionExportColumns = []string{"id", "created_at", "direction", "counterparty_user_id", "amount", "currency", "status", "payment_intent_id", "failure_code", "line_items"}
+
+// transactionExportRow is a transaction's row in a CSV export. The amount is
+// in major units of the transaction's currency.
+func transactionExportRow(rec *TransactionRecord, uid string) []string {
+	direction, counterparty := "sent", rec.RecipientUserID
+	if rec.RecipientUserID == uid {
+		direction, counterparty = "received", rec.SenderUserID
+	}
+	return csvRow([]string{
+		rec.ID, rec.CreatedAt.UTC().Format(time.RFC3339), direction, counterparty,
+		currencyOrDefault(rec.Currency).Decimal(rec.Amount), rec.Currency, rec.Status,
+		rec.PaymentIntentID, rec.FailureCode, formatLineItems(rec.LineItems, rec.Currency),
+	})
+}
+
+// defaultOFXPeriod is how far back an OFX export without from goes; OFX
+// states its period before listing transactions
+const defaultOFXPeriod = 90 * 24 * time.Hour
+
+// writeTransactionExport writes every transaction query matches to w in
+// format, calling afterPage, if set, after each page
+func writeTransactionExport(ctx context.Context, w io.Writer, query firestore.Query, uid, format string, ofx *ofxWriter, afterPage func() error) error {
+	var write func(rec *TransactionRecord) error
+	var finish func() error
+	switch format {
+	case ExportOFX:
+		write, finish = ofx.Add, ofx.Close
+	case ExportNDJSON:
+		enc := json.NewEncoder(w)
+		write = func(rec *TransactionRecord) error { return enc.Encode(rec) }
+		finish = func() error { return nil }
+	default:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(transactionExportColumns); err != nil {
+			return err
+		}
+		write = func(rec *TransactionRecord) error { return cw.Write(transactionExportRow(rec, uid)) }
+		finish = func() error { cw.Flush(); return cw.Error() }
+		if afterPage != nil {
+			flush := afterPage
+			afterPage = func() error { cw.Flush(); return flush() }
+		}
+	}
+	err := queryPages(ctx, query, func(doc *firestore.DocumentSnapshot) error {
+		var rec TransactionRecord
+		if err := doc.DataTo(&rec); err != nil {
+			return nil
+		}
+		rec.ID = doc.Ref.ID
+		return write(&rec)
+	}, afterPage)
+	if err != nil {
+		return err
+	}
+	return finish()
+}
+
+// ExportTransactions exports the caller's transactions as CSV, NDJSON, or an
+// OFX bank statement (?format=), newest first, with the same from, to, and
+// status filters as GET /transactions. OFX lists only succeeded transactions
+// in one currency (?currency=, default usd) and without from covers the last
+// 90 days. ?delivery=url returns a signed download URL instead of the file.
+func ExportTransactions(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	format, ok := exportFormat(c, ExportCSV, ExportNDJSON, ExportOFX)
+	if !ok {
+		return
+	}
+	delivery, ok := exportDelivery(c)
+	if !ok {
+		return
+	}
+	query, ok := transactionHistoryQuery(c, fs, uid)
+	if !ok {
+		return
+	}
+	filename := "transactions_" + time.Now().UTC().Format("20060102")
+
+	if format != ExportOFX && delivery == DeliveryInline {
+		stream := NewExportStream(c, format, filename, transactionExportColumns)
+		err := stream.Query(query, func(doc *firestore.DocumentSnapshot) error {
+			var rec TransactionRecord
+			if err := doc.DataTo(&rec); err != nil {
+				return nil
+			}
+			rec.ID = doc.Ref.ID
+			return stream.Write(rec, transactionExportRow(&rec, uid))
+		})
+		stream.Close(err)
+		return
+	}
+
+	// OFX states its period up front; from and to were checked above
+	var start, end time.Time
+	currency := strings.ToLower(c.DefaultQuery("currency", DefaultCurrency))
+	if format == ExportOFX {
+		if _, ok := lookupCurrency(currency); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency", "code": "unsupported_currency"})
+			return
+		}
+		end = time.Now()
+		if to := c.Query("to"); to != "" {
+			end, _ = parseHistoryTime(to)
+		}
+		if from := c.Query("from"); from != "" {
+			start, _ = parseHistoryTime(from)
+		} else {
+			start = end.Add(-defaultOFXPeriod)
+			query = query.Where("created_at", ">=", start)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), exportMaxDuration)
+	defer cancel()
+	write := func(w io.Writer, afterPage func() error) error {
+		var ofx *ofxWriter
+		if format == ExportOFX {
+			var err error
+			if ofx, err = newOFXWriter(w, uid, currency, start, end); err != nil {
+				return err
+			}
+		}
+		return writeTransactionExport(ctx, w, query, uid, format, ofx, afterPage)
+	}
+	filename += "." + format
+	if delivery == DeliveryURL {
+		deliverExportURL(c, ctx, uid, filename, func(w io.Writer) error { return write(w, nil) })
+		return
+	}
+	// An OFX file that stops early is left unterminated, so it fails to
+	// import rather than importing part of the period
+	setExportHeaders(c, filename)
+	c.Status(http.StatusOK)
+	if err := write(c.Writer, func() error { c.Writer.Flush(); return ctx.Err() }); err != nil {
+		slog.WarnContext(ctx, "export incomplete", "component", "exports", "path", c.FullPath(), "error", err)
+	}
+}
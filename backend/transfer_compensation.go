@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Transfer states for a payment whose Connect transfer failed after the charge succeeded
+const (
+	TransferStatusRetrying  = "retrying"
+	TransferStatusSucceeded = "succeeded"
+	TransferStatusRefunded  = "refunded"
+	// TransferStatusCanceled stops retries for a bank debit that was returned
+	TransferStatusCanceled = "canceled"
+	// TransferStatusFrozen holds the transfer of a reported payment until the
+	// report is resolved
+	TransferStatusFrozen = "frozen"
+)
+
+// NotificationPaymentRefunded tells a sender their payment could not be delivered and was refunded
+const NotificationPaymentRefunded = "payment_refunded"
+
+const (
+	// maxTransferAttempts is how many times a transfer is tried, including the
+	// original, before the charge is refunded
+	maxTransferAttempts = 5
+	// transferRetryLease keeps other instances off a retry while it runs
+	transferRetryLease = 2 * time.Minute
+)
+
+// transferRetryBackoff is the delay after the given failed attempt: a minute, doubling
+func transferRetryBackoff(attempt int) time.Duration {
+	return time.Minute << min(attempt-1, 6)
+}
+
+// transferFailureFields records a failed transfer attempt on the transaction
+// so RetryFailedTransfers picks it up
+func transferFailureFields(attempt int, err error) map[string]interface{} {
+	fields := map[string]interface{}{
+		"transfer_status":   TransferStatusRetrying,
+		"transfer_attempts": attempt,
+		"transfer_error":    err.Error(),
+		"transfer_retry_at": time.Now().Add(transferRetryBackoff(attempt)),
+	}
+	if se := stripeErrorDetails(err); se != nil {
+		fields["stripe_error"] = se
+	}
+	return fields
+}
+
+// RetryFailedTransfers retries transfers to recipients that failed after the
+// sender was charged. Each retry first checks Stripe for a transfer that did go
+// through; once attempts run out the sender's charge is refunded instead.
+func RetryFailedTransfers(ctx context.Context, d *webhookDeps) error {
+	docs, err := d.fs.Collection("transactions").
+		Where("transfer_status", "==", TransferStatusRetrying).
+		Where("transfer_retry_at", "<=", time.Now()).
+		Limit(50).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load failed transfers: %w", err)
+	}
+	for _, doc := range docs {
+		claimed, err := claimTransferRetry(ctx, d.fs, doc.Ref)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to claim transfer retry", "component", "transfers", "payment_intent", doc.Ref.ID, "error", err)
+			continue
+		}
+		if claimed {
+			compensateTransfer(ctx, d, doc.Ref.ID, doc.Data())
+		}
+	}
+	return nil
+}
+
+// claimTransferRetry pushes the retry time out by the lease, reporting false if
+// another instance got there first
+func claimTransferRetry(ctx context.Context, fs *firestore.Client, ref *firestore.DocumentRef) (bool, error) {
+	claimed := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		data := snap.Data()
+		retryAt, _ := data["transfer_retry_at"].(time.Time)
+		if stringField(data, "transfer_status") != TransferStatusRetrying || retryAt.After(time.Now()) {
+			return nil
+		}
+		claimed = true
+		return tx.Update(ref, []firestore.Update{{Path: "transfer_retry_at", Value: time.Now().Add(transferRetryLease)}})
+	})
+	return claimed, err
+}
+
+// compensateTransfer makes one more transfer attempt for a charged payment,
+// refunding the sender when it is the last
+func compensateTransfer(ctx context.Context, d *webhookDeps, paymentIntentID string, data map[string]interface{}) {
+	sc := d.sc
+	senderUID := stringField(data, "sender_user_id")
+	recipientUID := stringField(data, "recipient_user_id")
+	amount, _ := data["amount"].(int64)
+	attempts, _ := data["transfer_attempts"].(int64)
+	attempt := int(attempts) + 1
+
+	// A transfer whose response was lost may have gone through
+	tr, err := sc.FindTransferInGroup(ctx, paymentIntentID)
+	if err == nil && tr == nil {
+		var destination string
+		if doc, uerr := UserDoc(ctx, d.fs, recipientUID).Get(ctx); uerr == nil {
+			destination = stringField(doc.Data(), "stripe_account_id")
+		}
+		if destination == "" {
+			err = fmt.Errorf("recipient %s has no connected account", recipientUID)
+		} else {
+			transferAmount, transferCurrency := transactionTransferLeg(data)
+			tr, err = sc.ProcessTransferWithIdempotency(ctx, transferAmount, transferCurrency, destination, paymentIntentID, fmt.Sprintf("transfer_retry_%s_%d", paymentIntentID, attempt))
+		}
+	}
+	if err == nil {
+		sc.LogAPIInteraction(ctx, "retry_transfer", recipientUID, true, fmt.Sprintf("Transfer: %s (attempt %d)", tr.ID, attempt))
+		d.postLedger(ctx, recipientUID, TransferLedgerTransaction(tr.ID, recipientUID, tr.Amount, tr.Currency))
+		if err := SaveTransaction(ctx, d.fs, paymentIntentID, map[string]interface{}{
+			"transfer_id":       tr.ID,
+			"transfer_status":   TransferStatusSucceeded,
+			"transfer_attempts": attempt,
+			"transfer_retry_at": firestore.Delete,
+		}); err != nil {
+			slog.ErrorContext(ctx, "failed to record transfer", "component", "transfers", "payment_intent", paymentIntentID, "error", err)
+		}
+		return
+	}
+	sc.LogAPIError(ctx, "retry_transfer", recipientUID, err)
+
+	if attempt < maxTransferAttempts {
+		if err := SaveTransaction(ctx, d.fs, paymentIntentID, transferFailureFields(attempt, err)); err != nil {
+			slog.ErrorContext(ctx, "failed to record transfer attempt", "component", "transfers", "payment_intent", paymentIntentID, "error", err)
+		}
+		return
+	}
+
+	// Out of attempts: give the sender their money back
+	refund, rerr := sc.RefundPaymentIntent(ctx, paymentIntentID, map[string]string{"reason": "transfer_failed"}, "transfer_compensation_"+paymentIntentID)
+	if rerr != nil {
+		// Leave it retrying so the refund is attempted again
+		sc.LogAPIError(ctx, "compensation_refund", senderUID, rerr)
+		_ = SaveTransaction(ctx, d.fs, paymentIntentID, transferFailureFields(attempt, rerr))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "compensation_refund", senderUID, true, fmt.Sprintf("Refund: %s", refund.ID))
+	fields := map[string]interface{}{
+		"transfer_status":        TransferStatusRefunded,
+		"transfer_attempts":      attempt,
+		"transfer_error":         err.Error(),
+		"transfer_retry_at":      firestore.Delete,
+		"compensation_refund_id": refund.ID,
+	}
+	if err := SaveTransaction(ctx, d.fs, paymentIntentID, fields); err != nil {
+		slog.ErrorContext(ctx, "failed to record compensation refund", "component", "transfers", "payment_intent", paymentIntentID, "error", err)
+	}
+	NotifyUser(ctx, d.fs, senderUID, NotificationPaymentRefunded, "Payment refunded",
+		fmt.Sprintf("We couldn't deliver your %s payment, so it has been refunded", currencyOrDefault(stringField(data, "currency")).Format(amount)),
+		map[string]interface{}{"transaction_id": paymentIntentID, "refund_id": refund.ID})
+}
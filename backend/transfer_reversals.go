@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// recordTransferReversal applies a transfer.reversed event to the payment the
+// transfer paid out: each reversal is posted to the ledger and the reversed
+// total is saved on the transaction. Reversals we made for an ACH return were
+// already posted and notified by the clawback, so this only tells the
+// recipient about ones made elsewhere, such as from the Stripe dashboard.
+func recordTransferReversal(ctx context.Context, d *webhookDeps, tr *stripe.Transfer) error {
+	if d.fs == nil {
+		return nil
+	}
+	docs, err := d.fs.Collection("transactions").Where("transfer_id", "==", tr.ID).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to find transaction for transfer %s: %w", tr.ID, err)
+	}
+	if len(docs) == 0 {
+		slog.InfoContext(ctx, "reversed transfer has no transaction", "component", "transfers", "transfer_id", tr.ID)
+		return nil
+	}
+	doc := docs[0]
+	data := doc.Data()
+	recipientUID := stringField(data, "recipient_user_id")
+	previous, _ := data["transfer_reversed_amount"].(int64)
+	if tr.AmountReversed <= previous {
+		return nil
+	}
+
+	external := false
+	if tr.Reversals != nil {
+		for _, rev := range tr.Reversals.Data {
+			d.postLedger(ctx, recipientUID, TransferReversalLedgerTransaction(rev.ID, recipientUID, rev.Amount, string(rev.Currency)))
+			if rev.Metadata["reason"] != "ach_return" {
+				external = true
+			}
+		}
+	}
+	if err := SaveTransaction(ctx, d.fs, doc.Ref.ID, map[string]interface{}{
+		"transfer_reversed_amount": tr.AmountReversed,
+		"transfer_reversed_at":     time.Now(),
+	}); err != nil {
+		return fmt.Errorf("failed to record reversal of transfer %s: %w", tr.ID, err)
+	}
+	if external {
+		NotifyUser(ctx, d.fs, recipientUID, NotificationPaymentReversed, "A payment to you was reversed",
+			fmt.Sprintf("%s of a payment you received was taken back", currencyOrDefault(string(tr.Currency)).Format(tr.AmountReversed-previous)),
+			map[string]interface{}{"transaction_id": doc.Ref.ID})
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Direct deposit accounts are Stripe Treasury financial accounts opened on a
+// user's connected account. Their account and routing numbers can be given
+// to an employer for payroll, and every ACH credit to them is credited to the
+// user's Stripe-backed wallet when it arrives. The funds stay in the financial
+// account, tracked in the ledger as LedgerAccountTreasuryBalance.
+
+// Direct deposit account statuses, kept on treasury_accounts/{id}.status
+const (
+	// TreasuryAccountPending is an account Stripe hasn't finished opening;
+	// it has no routing number yet
+	TreasuryAccountPending = "pending"
+	TreasuryAccountActive  = "active"
+	TreasuryAccountClosed  = "closed"
+)
+
+// walletSourceTreasury marks wallet entries for money received into or
+// debited from a direct deposit account
+const walletSourceTreasury = "stripe_treasury"
+
+// LedgerAccountTreasuryBalance is the funds held in users' direct deposit
+// accounts
+const LedgerAccountTreasuryBalance = "platform:treasury_balance"
+
+// Wallet entry types for direct deposit account movements
+const (
+	walletEntryDirectDeposit = "direct_deposit"
+	walletEntryTreasuryDebit = "treasury_debit"
+)
+
+// TreasuryAccount is a user's direct deposit account, kept at
+// treasury_accounts/{financialAccountId}. Only the last four digits of the
+// account number are stored; the full number is fetched from Stripe when the
+// user asks for it.
+type TreasuryAccount struct {
+	FinancialAccountID string    `json:"financial_account_id" firestore:"financial_account_id"`
+	UserID             string    `json:"user_id" firestore:"user_id"`
+	StripeAccountID    string    `json:"-" firestore:"stripe_account_id"`
+	Status             string    `json:"status" firestore:"status"`
+	RoutingNumber      string    `json:"routing_number,omitempty" firestore:"routing_number,omitempty"`
+	AccountNumberLast4 string    `json:"account_number_last4,omitempty" firestore:"account_number_last4,omitempty"`
+	BankName           string    `json:"bank_name,omitempty" firestore:"bank_name,omitempty"`
+	CreatedAt          time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// abaAddress returns a financial account's ABA address, if it has one yet
+func abaAddress(fa *stripe.TreasuryFinancialAccount) *stripe.TreasuryFinancialAccountFinancialAddressABA {
+	for _, addr := range fa.FinancialAddresses {
+		if addr.ABA != nil {
+			return addr.ABA
+		}
+	}
+	return nil
+}
+
+// applyFinancialAccount copies a financial account's status and ABA address
+// onto the stored account
+func (a *TreasuryAccount) applyFinancialAccount(fa *stripe.TreasuryFinancialAccount) {
+	switch {
+	case fa.Status == stripe.TreasuryFinancialAccountStatusClosed:
+		a.Status = TreasuryAccountClosed
+	case slices.Contains(fa.ActiveFeatures, stripe.TreasuryFinancialAccountActiveFeatureFinancialAddressesABA):
+		a.Status = TreasuryAccountActive
+	default:
+		a.Status = TreasuryAccountPending
+	}
+	if aba := abaAddress(fa); aba != nil {
+		a.RoutingNumber = aba.RoutingNumber
+		a.AccountNumberLast4 = aba.AccountNumberLast4
+		a.BankName = aba.BankName
+	}
+}
+
+// loadTreasuryAccount reads a direct deposit account by financial account ID
+func loadTreasuryAccount(ctx context.Context, fs *firestore.Client, financialAccountID string) (*TreasuryAccount, error) {
+	doc, err := getDocument(ctx, fs.Collection("treasury_accounts").Doc(financialAccountID))
+	if err != nil {
+		return nil, err
+	}
+	var a TreasuryAccount
+	if err := doc.DataTo(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// CreateDirectDepositAccount opens a direct deposit account for the caller
+// on their connected account. Calling it again returns the account already
+// opened.
+func CreateDirectDepositAccount(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if _, err := walletHandleForUser(ctx, fs, uid, ProcessorStripe); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Direct deposit isn't available for wallets held with Sila", "code": "wallet_provider_unsupported"})
+		return
+	}
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if id := stringField(doc.Data(), "treasury_financial_account_id"); id != "" {
+		if existing, err := loadTreasuryAccount(ctx, fs, id); err == nil && existing.Status != TreasuryAccountClosed {
+			c.JSON(http.StatusOK, gin.H{"account": existing})
+			return
+		}
+	}
+	accountID := stringField(doc.Data(), "stripe_account_id")
+	if accountID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set up payouts before getting an account number", "code": "connect_account_required"})
+		return
+	}
+
+	if err := sc.EnableTreasury(ctx, accountID, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		sc.LogAPIError(ctx, "enable_treasury", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to open account", err))
+		return
+	}
+	fa, err := sc.CreateFinancialAccount(ctx, accountID, map[string]string{
+		"user_id": uid,
+		"region":  currentRegion.Name,
+	}, "treasury_account_"+uid)
+	if err != nil {
+		sc.LogAPIError(ctx, "create_financial_account", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to open account", err))
+		return
+	}
+	sc.LogAPIInteraction(ctx, "create_financial_account", uid, true, fmt.Sprintf("Financial account: %s", fa.ID))
+
+	now := time.Now()
+	account := &TreasuryAccount{
+		FinancialAccountID: fa.ID,
+		UserID:             uid,
+		StripeAccountID:    accountID,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+	account.applyFinancialAccount(fa)
+	if _, err := fs.Collection("treasury_accounts").Doc(fa.ID).Set(ctx, account); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save account"})
+		return
+	}
+	if err := SaveUserFields(ctx, fs, uid, map[string]interface{}{
+		"treasury_financial_account_id": fa.ID,
+		"updated_at":                    now,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save account"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"account": account})
+}
+
+// GetDirectDepositAccount returns the caller's direct deposit account with
+// its full account number, to give to an employer. Responses aren't cached.
+func GetDirectDepositAccount(c *gin.Context) {
+	uid, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	doc, err := getDocument(ctx, UserDoc(ctx, fs, uid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	id := stringField(doc.Data(), "treasury_financial_account_id")
+	if id == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No direct deposit account"})
+		return
+	}
+	account, err := loadTreasuryAccount(ctx, fs, id)
+	if err != nil || account.UserID != uid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No direct deposit account"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	resp := gin.H{"account": account}
+	if account.Status == TreasuryAccountClosed {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	fa, err := sc.GetFinancialAccount(ctx, account.StripeAccountID, account.FinancialAccountID, true)
+	if err != nil {
+		sc.LogAPIError(ctx, "get_financial_account", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to load account", err))
+		return
+	}
+	account.applyFinancialAccount(fa)
+	if aba := abaAddress(fa); aba != nil && account.Status == TreasuryAccountActive {
+		resp["account_number"] = aba.AccountNumber
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// syncTreasuryAccount stores a financial account's status from a webhook and
+// tells the user when their account number is ready or the account closes
+func syncTreasuryAccount(ctx context.Context, fs *firestore.Client, fa *stripe.TreasuryFinancialAccount) error {
+	account, err := loadTreasuryAccount(ctx, fs, fa.ID)
+	if err != nil {
+		// Not opened through this service, or in another region's database
+		slog.WarnContext(ctx, "unmatched financial account", "component", "treasury", "financial_account", fa.ID, "error", err)
+		return nil
+	}
+	previous := account.Status
+	account.applyFinancialAccount(fa)
+	account.UpdatedAt = time.Now()
+	if _, err := fs.Collection("treasury_accounts").Doc(fa.ID).Set(ctx, account); err != nil {
+		return fmt.Errorf("failed to save financial account %s: %w", fa.ID, err)
+	}
+	if account.Status == previous {
+		return nil
+	}
+	switch account.Status {
+	case TreasuryAccountActive:
+		NotifyUser(ctx, fs, account.UserID, NotificationWalletVerified, "Your account number is ready",
+			"Give your account and routing numbers to your employer to get paid straight into your wallet.",
+			map[string]interface{}{"financial_account_id": fa.ID})
+	case TreasuryAccountClosed:
+		NotifyUser(ctx, fs, account.UserID, NotificationWalletVerified, "Your account number was closed",
+			"Deposits to your old account number will be returned to the sender.",
+			map[string]interface{}{"financial_account_id": fa.ID})
+	}
+	return nil
+}
+
+// applyTreasuryMovement credits or debits the wallet of the user who owns a
+// financial account, once per Stripe object. Money arriving from a connected
+// account that doesn't own the financial account is ignored.
+func applyTreasuryMovement(ctx context.Context, d *webhookDeps, connectedAccountID, financialAccountID, reference, entryType string, amount int64, currency stripe.Currency) (*TreasuryAccount, bool, error) {
+	account, err := loadTreasuryAccount(ctx, d.fs, financialAccountID)
+	if err != nil {
+		slog.WarnContext(ctx, "unmatched financial account", "component", "treasury", "financial_account", financialAccountID, "error", err)
+		return nil, false, nil
+	}
+	if connectedAccountID != "" && connectedAccountID != account.StripeAccountID {
+		return nil, false, fmt.Errorf("financial account %s belongs to %s, not %s", financialAccountID, account.StripeAccountID, connectedAccountID)
+	}
+	if string(currency) != walletCurrency {
+		return nil, false, fmt.Errorf("financial account %s received %s; wallets hold %s", financialAccountID, currency, walletCurrency)
+	}
+	entry := &WalletEntry{
+		UserID:    account.UserID,
+		Reference: reference,
+		Source:    walletSourceTreasury,
+		Type:      entryType,
+		Amount:    amount,
+	}
+	applied, err := ApplyWalletEntry(ctx, d.fs, entry, "")
+	if err != nil || !applied {
+		return account, false, err
+	}
+	postWalletLedger(ctx, d.ledger, entry)
+	return account, true, nil
+}
+
+// processTreasuryEvent handles Treasury webhooks from connected accounts:
+// financial account status changes, ACH credits (direct deposits) and
+// debits, and credits reversed by their sender
+func processTreasuryEvent(ctx context.Context, d *webhookDeps, event stripe.Event) error {
+	if d.fs == nil {
+		return nil
+	}
+	switch event.Type {
+	case "treasury.financial_account.features_status_updated", "treasury.financial_account.closed":
+		var fa stripe.TreasuryFinancialAccount
+		if err := json.Unmarshal(event.Data.Raw, &fa); err != nil {
+			return nil
+		}
+		return syncTreasuryAccount(ctx, d.fs, &fa)
+
+	case "treasury.received_credit.succeeded":
+		var rc stripe.TreasuryReceivedCredit
+		if err := json.Unmarshal(event.Data.Raw, &rc); err != nil {
+			return nil
+		}
+		account, applied, err := applyTreasuryMovement(ctx, d, event.Account, rc.FinancialAccount, rc.ID, walletEntryDirectDeposit, rc.Amount, rc.Currency)
+		if err != nil || !applied {
+			return err
+		}
+		from := "A deposit"
+		if pm := rc.InitiatingPaymentMethodDetails; pm != nil && pm.BillingDetails != nil && pm.BillingDetails.Name != "" {
+			from = "A deposit from " + pm.BillingDetails.Name
+		}
+		NotifyUser(ctx, d.fs, account.UserID, NotificationWalletCredited, "Deposit received",
+			fmt.Sprintf("%s of %s was added to your wallet", from, currencyOrDefault(string(rc.Currency)).Format(rc.Amount)),
+			map[string]interface{}{"received_credit_id": rc.ID})
+
+	case "treasury.received_debit.created":
+		var rd stripe.TreasuryReceivedDebit
+		if err := json.Unmarshal(event.Data.Raw, &rd); err != nil || rd.Status != stripe.TreasuryReceivedDebitStatusSucceeded {
+			return nil
+		}
+		account, applied, err := applyTreasuryMovement(ctx, d, event.Account, rd.FinancialAccount, rd.ID, walletEntryTreasuryDebit, -rd.Amount, rd.Currency)
+		if err != nil || !applied {
+			return err
+		}
+		NotifyUser(ctx, d.fs, account.UserID, NotificationWalletDebited, "Debit from your account number",
+			fmt.Sprintf("%s was debited from your wallet through your account number", currencyOrDefault(string(rd.Currency)).Format(rd.Amount)),
+			map[string]interface{}{"received_debit_id": rd.ID})
+
+	case "treasury.credit_reversal.posted":
+		var cr stripe.TreasuryCreditReversal
+		if err := json.Unmarshal(event.Data.Raw, &cr); err != nil {
+			return nil
+		}
+		account, applied, err := applyTreasuryMovement(ctx, d, event.Account, cr.FinancialAccount, cr.ReceivedCredit+"_reversal", walletEntryDirectDeposit+"_reversal", -cr.Amount, cr.Currency)
+		if err != nil || !applied {
+			return err
+		}
+		NotifyUser(ctx, d.fs, account.UserID, NotificationWalletDebited, "Deposit returned",
+			fmt.Sprintf("A %s deposit was returned to its sender, so it has been taken back out of your wallet", currencyOrDefault(string(cr.Currency)).Format(cr.Amount)),
+			map[string]interface{}{"received_credit_id": cr.ReceivedCredit})
+	}
+	return nil
+}
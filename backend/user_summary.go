@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recentTransactionsLimit caps how many transactions are embedded in a summary
+const recentTransactionsLimit = 10
+
+// userSummaryVersion is the summary layout events can update in place.
+// Summaries from before it are rebuilt; version 3 stopped counting expired
+// payments as pending, and version 4 returned bank debits.
+const userSummaryVersion = 4
+
+// errUserSummaryStale is returned when a user has no summary at
+// userSummaryVersion to update
+var errUserSummaryStale = errors.New("user summary missing or out of date")
+
+// UserSummary is the denormalized home-screen document stored at
+// user_summaries/{uid}. Balance is the net received in Currency; Balances
+// holds it for every currency the user has moved money in.
+type UserSummary struct {
+	UserID             string               `json:"user_id" firestore:"user_id"`
+	Balance            int64                `json:"balance" firestore:"balance"`
+	Currency           string               `json:"currency" firestore:"currency"`
+	Balances           map[string]int64     `json:"balances" firestore:"balances"`
+	PendingCount       int                  `json:"pending_count" firestore:"pending_count"`
+	RecentTransactions []SummaryTransaction `json:"recent_transactions" firestore:"recent_transactions"`
+	LimitUsage         LimitUsage           `json:"limit_usage" firestore:"limit_usage"`
+	Version            int                  `json:"-" firestore:"version"`
+	UpdatedAt          time.Time            `json:"updated_at" firestore:"updated_at"`
+}
+
+// SummaryTransaction is the compact view of a transaction embedded in a summary
+type SummaryTransaction struct {
+	ID                 string    `json:"id" firestore:"id"`
+	Direction          string    `json:"direction" firestore:"direction"` // "sent" or "received"
+	CounterpartyUserID string    `json:"counterparty_user_id" firestore:"counterparty_user_id"`
+	Amount             int64     `json:"amount" firestore:"amount"`
+	Currency           string    `json:"currency" firestore:"currency"`
+	Status             string    `json:"status" firestore:"status"`
+	CreatedAt          time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// LimitUsage tracks how much a user has sent in the current UTC day and
+// month, in limitCurrency minor units
+type LimitUsage struct {
+	DailySent   int64  `json:"daily_sent" firestore:"daily_sent"`
+	MonthlySent int64  `json:"monthly_sent" firestore:"monthly_sent"`
+	Day         string `json:"day" firestore:"day"`
+	Month       string `json:"month" firestore:"month"`
+}
+
+// summaryContribution is what one transaction adds to a user's summary. It
+// is kept at user_summaries/{uid}/applied_transactions/{id}, so when the
+// transaction changes its old contribution can be taken back.
+type summaryContribution struct {
+	Currency string `firestore:"currency"`
+	Balance  int64  `firestore:"balance"` // signed: received positive, sent negative
+	Pending  bool   `firestore:"pending"`
+}
+
+// contributionOf is what a transaction adds to uid's summary
+func contributionOf(uid string, rec *TransactionRecord) summaryContribution {
+	c := summaryContribution{Currency: currencyOrDefault(rec.Currency).Code, Pending: rec.IsPending()}
+	if rec.Status == "succeeded" {
+		c.Balance = rec.Amount - rec.AmountRefunded
+		if rec.SenderUserID == uid {
+			c.Balance = -c.Balance
+		}
+	}
+	return c
+}
+
+// apply replaces a transaction's old contribution to the summary with its new one
+func (s *UserSummary) apply(old, next summaryContribution) {
+	if s.Balances == nil {
+		s.Balances = map[string]int64{}
+	}
+	if old.Balance != 0 {
+		s.Balances[old.Currency] -= old.Balance
+	}
+	if next.Balance != 0 {
+		s.Balances[next.Currency] += next.Balance
+	}
+	if old.Pending {
+		s.PendingCount--
+	}
+	if next.Pending {
+		s.PendingCount++
+	}
+	s.Balance = s.Balances[s.Currency]
+}
+
+// summaryItem is a transaction's entry in uid's recent transactions
+func summaryItem(uid string, rec *TransactionRecord) SummaryTransaction {
+	item := SummaryTransaction{
+		ID:        rec.ID,
+		Amount:    rec.Amount,
+		Currency:  rec.Currency,
+		Status:    rec.Status,
+		CreatedAt: rec.CreatedAt,
+	}
+	if rec.SenderUserID == uid {
+		item.Direction = "sent"
+		item.CounterpartyUserID = rec.RecipientUserID
+	} else {
+		item.Direction = "received"
+		item.CounterpartyUserID = rec.SenderUserID
+	}
+	return item
+}
+
+// upsertRecent puts a transaction's entry into the recent transactions,
+// replacing any earlier one and keeping the newest recentTransactionsLimit
+func (s *UserSummary) upsertRecent(item SummaryTransaction) {
+	recent := make([]SummaryTransaction, 0, recentTransactionsLimit+1)
+	for _, t := range s.RecentTransactions {
+		if t.ID != item.ID {
+			recent = append(recent, t)
+		}
+	}
+	i := sort.Search(len(recent), func(i int) bool { return recent[i].CreatedAt.Before(item.CreatedAt) })
+	recent = slices.Insert(recent, i, item)
+	if len(recent) > recentTransactionsLimit {
+		recent = recent[:recentTransactionsLimit]
+	}
+	s.RecentTransactions = recent
+}
+
+// BuildUserSummary derives a summary from the user's transactions. Limit
+// usage counts sends at rates' value in limitCurrency; one in a currency
+// without a rate can't be valued and isn't counted.
+func BuildUserSummary(uid string, records []TransactionRecord, rates *FXRatesConfig, now time.Time) *UserSummary {
+	now = now.UTC()
+	summary := &UserSummary{
+		UserID:             uid,
+		Currency:           DefaultCurrency,
+		Balances:           map[string]int64{},
+		RecentTransactions: []SummaryTransaction{},
+		LimitUsage: LimitUsage{
+			Day:   now.Format("2006-01-02"),
+			Month: now.Format("2006-01"),
+		},
+		Version:   userSummaryVersion,
+		UpdatedAt: now,
+	}
+
+	for i := range records {
+		rec := &records[i]
+		summary.apply(summaryContribution{}, contributionOf(uid, rec))
+		summary.upsertRecent(summaryItem(uid, rec))
+
+		if rec.SenderUserID == uid && rec.Status != "failed" && rec.Status != "canceled" && rec.Status != TransactionStatusExpired {
+			created := rec.CreatedAt.UTC()
+			amount, ok := toLimitCurrency(rates, rec.Amount, rec.Currency)
+			if ok && created.Format("2006-01") == summary.LimitUsage.Month {
+				summary.LimitUsage.MonthlySent += amount
+				if created.Format("2006-01-02") == summary.LimitUsage.Day {
+					summary.LimitUsage.DailySent += amount
+				}
+			}
+		}
+	}
+	return summary
+}
+
+// RefreshUserSummary builds and stores the summary document for a user who
+// has no current one, from all their transactions. Transaction events keep
+// it up to date from then on; a summary another caller built meanwhile is
+// returned as is. Send-limit usage is reserved as payments are made, so a
+// stored limit_usage is kept; only a new summary derives it from
+// transactions and wallet sends.
+func RefreshUserSummary(ctx context.Context, fs *firestore.Client, uid string) (*UserSummary, error) {
+	ref := fs.Collection("user_summaries").Doc(uid)
+	var summary *UserSummary
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Every read is in the transaction, so a transaction that changes
+		// mid-build can't leave the summary built from its old state
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		var stored *UserSummary
+		if snap != nil && snap.Exists() {
+			stored = &UserSummary{}
+			if err := snap.DataTo(stored); err != nil {
+				return err
+			}
+			if stored.Version >= userSummaryVersion {
+				summary = stored
+				return nil
+			}
+		}
+
+		records, err := ListUserTransactions(tx, fs, uid)
+		if err != nil {
+			return err
+		}
+		rates := &FXRatesConfig{}
+		ratesSnap, err := tx.Get(fs.Doc(ConfigFXRates))
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("failed to read %s: %w", ConfigFXRates, err)
+		}
+		if ratesSnap != nil && ratesSnap.Exists() {
+			if err := ratesSnap.DataTo(rates); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		built := BuildUserSummary(uid, records, rates, now)
+		if stored != nil {
+			built.LimitUsage = stored.LimitUsage.rollOver(now)
+		} else {
+			wallet, err := walletSentUsage(tx, fs, uid, now)
+			if err != nil {
+				return err
+			}
+			built.LimitUsage.DailySent += wallet.DailySent
+			built.LimitUsage.MonthlySent += wallet.MonthlySent
+		}
+		summary = built
+		for i := range records {
+			if err := tx.Set(ref.Collection("applied_transactions").Doc(records[i].ID), contributionOf(uid, &records[i])); err != nil {
+				return err
+			}
+		}
+		return tx.Set(ref, built)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store user summary: %w", err)
+	}
+	return summary, nil
+}
+
+// applySummaryTransaction updates a user's summary for one transaction,
+// swapping what it contributed before for what it contributes now. It reads
+// the transaction as it is rather than trusting the event, so events applied
+// late, twice, or out of order leave the same summary. It returns
+// errUserSummaryStale when the user has no current summary to update.
+func applySummaryTransaction(ctx context.Context, fs *firestore.Client, uid, transactionID string) error {
+	ref := fs.Collection("user_summaries").Doc(uid)
+	txnRef := fs.Collection("transactions").Doc(transactionID)
+	appliedRef := ref.Collection("applied_transactions").Doc(transactionID)
+	return fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return errUserSummaryStale
+		}
+		if err != nil {
+			return err
+		}
+		var summary UserSummary
+		if err := snap.DataTo(&summary); err != nil || summary.Version < userSummaryVersion {
+			return errUserSummaryStale
+		}
+
+		txnSnap, err := tx.Get(txnRef)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec TransactionRecord
+		if err := txnSnap.DataTo(&rec); err != nil {
+			return err
+		}
+		rec.ID = transactionID
+		if rec.SenderUserID != uid && rec.RecipientUserID != uid {
+			return nil
+		}
+
+		var old summaryContribution
+		appliedSnap, err := tx.Get(appliedRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if appliedSnap != nil && appliedSnap.Exists() {
+			if err := appliedSnap.DataTo(&old); err != nil {
+				return err
+			}
+		}
+		next := contributionOf(uid, &rec)
+		summary.apply(old, next)
+		summary.upsertRecent(summaryItem(uid, &rec))
+		summary.UpdatedAt = time.Now().UTC()
+		if err := tx.Set(appliedRef, next); err != nil {
+			return err
+		}
+		return tx.Set(ref, &summary)
+	})
+}
+
+// UserSummaryConsumer updates the summary of every user touched by a
+// transaction event, building it first for a user without a current one
+func UserSummaryConsumer(ctx context.Context, fs *firestore.Client, evt Event) error {
+	if fs == nil || evt.TransactionID == "" {
+		return nil
+	}
+	for _, uid := range evt.UserIDs {
+		if uid == "" {
+			continue
+		}
+		err := applySummaryTransaction(ctx, fs, uid, evt.TransactionID)
+		if errors.Is(err, errUserSummaryStale) {
+			// Building reads the transaction too; applying afterwards covers
+			// a summary another caller built just before it changed
+			if _, err = RefreshUserSummary(ctx, fs, uid); err == nil {
+				err = applySummaryTransaction(ctx, fs, uid, evt.TransactionID)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("update summary for %s: %w", uid, err)
+		}
+	}
+	return nil
+}
+
+// GetUserSummary serves the authenticated user's summary with a single document read.
+// It is ETag-tagged, so a client polling an unchanged summary gets a 304.
+func GetUserSummary(c *gin.Context) {
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	doc, err := fs.Collection("user_summaries").Doc(uid).Get(c.Request.Context())
+	if err == nil && doc.Exists() {
+		var summary UserSummary
+		if err := doc.DataTo(&summary); err == nil && summary.Version >= userSummaryVersion {
+			respondWithETag(c, gin.H{"summary": summary})
+			return
+		}
+	}
+
+	// First load, or a summary from before userSummaryVersion: build it once and store it
+	summary, err := RefreshUserSummary(c.Request.Context(), fs, uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load summary"})
+		return
+	}
+	respondWithETag(c, gin.H{"summary": summary})
+}
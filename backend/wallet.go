@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ledger kinds for wallet balance movements
+const (
+	LedgerWalletDeposit    = "wallet_deposit"
+	LedgerWalletWithdrawal = "wallet_withdrawal"
+	LedgerWalletTransfer   = "wallet_transfer"
+)
+
+// Platform accounts behind wallet balances. Stripe-backed wallets are held in
+// LedgerAccountStripeBalance, direct deposits in LedgerAccountTreasuryBalance,
+// and deposited checks in LedgerAccountCheckDeposits.
+const (
+	// LedgerAccountSilaBalance is the funds held in users' Sila wallets
+	LedgerAccountSilaBalance = "platform:sila_balance"
+	// LedgerAccountWalletClearing pairs the two sides of a wallet-to-wallet
+	// transfer, which are applied as separate entries; it nets to zero
+	LedgerAccountWalletClearing = "platform:wallet_clearing"
+)
+
+// LedgerAccountUserWallet is what the platform holds for a user in their wallet
+func LedgerAccountUserWallet(uid string) string {
+	return "user:" + uid + ":wallet"
+}
+
+// walletCurrency is the currency wallets hold; Sila moves US dollars only
+const walletCurrency = "usd"
+
+// Wallet is the internal view of a user's stored balance, kept at wallets/{uid}.
+// Amounts are minor units; one Sila token is one cent.
+type Wallet struct {
+	UserID         string    `json:"user_id" firestore:"user_id"`
+	SilaUserHandle string    `json:"sila_user_handle,omitempty" firestore:"sila_user_handle,omitempty"`
+	Balance        int64     `json:"balance" firestore:"balance"`
+	Held           int64     `json:"held" firestore:"held"` // reserved by open wallet holds
+	OverdraftLimit int64     `json:"overdraft_limit" firestore:"overdraft_limit"`
+	Currency       string    `json:"currency" firestore:"currency"`
+	UpdatedAt      time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// Available is what can be sent: the balance not reserved by open holds, plus
+// any overdraft buffer the user has opted into
+func (w *Wallet) Available() int64 {
+	return w.Balance - w.Held + w.OverdraftLimit
+}
+
+// WalletEntry is a single balance movement, kept at wallet_entries/{reference}
+type WalletEntry struct {
+	UserID       string    `json:"user_id" firestore:"user_id"`
+	Reference    string    `json:"reference" firestore:"reference"`
+	Source       string    `json:"source" firestore:"source"`
+	Type         string    `json:"type" firestore:"type"`
+	Amount       int64     `json:"amount" firestore:"amount"` // signed: credits positive, debits negative
+	BalanceAfter int64     `json:"balance_after" firestore:"balance_after"`
+	CreatedAt    time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// ApplyWalletEntry atomically records an entry and moves the wallet balance,
+// filling in entry.BalanceAfter. The entry reference makes it idempotent:
+// replaying the same reference is a no-op. It reports whether the entry was
+// newly applied.
+func ApplyWalletEntry(ctx context.Context, fs *firestore.Client, entry *WalletEntry, silaUserHandle string) (bool, error) {
+	walletRef := fs.Collection("wallets").Doc(entry.UserID)
+	entryRef := fs.Collection("wallet_entries").Doc(entry.Reference)
+
+	applied := false
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		applied = false
+		existing, err := tx.Get(entryRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if existing != nil && existing.Exists() {
+			return nil
+		}
+
+		wallet := Wallet{UserID: entry.UserID, Currency: walletCurrency}
+		snap, err := tx.Get(walletRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if snap != nil && snap.Exists() {
+			if err := snap.DataTo(&wallet); err != nil {
+				return err
+			}
+		}
+		if silaUserHandle != "" {
+			wallet.SilaUserHandle = silaUserHandle
+		}
+
+		now := time.Now()
+		wallet.Balance += entry.Amount
+		wallet.UpdatedAt = now
+		entry.BalanceAfter = wallet.Balance
+		entry.CreatedAt = now
+
+		if err := tx.Set(walletRef, wallet); err != nil {
+			return err
+		}
+		if err := tx.Set(entryRef, entry); err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to apply wallet entry %s: %w", entry.Reference, err)
+	}
+	return applied, nil
+}
+
+// WalletLedgerTransaction records an applied wallet entry: deposits and
+// withdrawals move funds between the user's wallet and the provider balance
+// holding it, and transfers move them through LedgerAccountWalletClearing.
+// Reversals post the opposite way. It returns nil for entries that moved
+// nothing, such as voids.
+func WalletLedgerTransaction(entry *WalletEntry) *LedgerTransaction {
+	if entry.Amount == 0 {
+		return nil
+	}
+	kind, counter := LedgerWalletTransfer, LedgerAccountWalletClearing
+	switch strings.TrimSuffix(entry.Type, "_reversal") {
+	case "issue", "topup", walletEntryDirectDeposit, walletEntryCheckDeposit:
+		kind = LedgerWalletDeposit
+	case "redeem", "withdraw", walletEntryTreasuryDebit:
+		kind = LedgerWalletWithdrawal
+	}
+	if kind != LedgerWalletTransfer {
+		switch entry.Source {
+		case ProcessorStripe:
+			counter = LedgerAccountStripeBalance
+		case walletSourceTreasury:
+			counter = LedgerAccountTreasuryBalance
+		case walletSourceCheckDeposit:
+			counter = LedgerAccountCheckDeposits
+		default:
+			counter = LedgerAccountSilaBalance
+		}
+	}
+	amount, walletSide, counterSide := entry.Amount, Credit, Debit
+	if amount < 0 {
+		amount, walletSide, counterSide = -amount, Debit, Credit
+	}
+	return &LedgerTransaction{
+		ID:        "wallet_" + entry.Reference,
+		Kind:      kind,
+		Reference: entry.Reference,
+		Currency:  walletCurrency,
+		Entries: []LedgerEntry{
+			{Account: counter, Direction: counterSide, Amount: amount},
+			{Account: LedgerAccountUserWallet(entry.UserID), Direction: walletSide, Amount: amount},
+		},
+	}
+}
+
+// postWalletLedger posts an applied wallet entry to ledger, which may be nil
+func postWalletLedger(ctx context.Context, ledger LedgerStore, entry *WalletEntry) {
+	txn := WalletLedgerTransaction(entry)
+	if ledger == nil || txn == nil {
+		return
+	}
+	if _, err := ledger.Post(ctx, txn); err != nil {
+		slog.ErrorContext(ctx, "failed to post wallet entry", "component", "wallet", "reference", entry.Reference, "error", err)
+	}
+}
+
+// recordWalletMovement posts an applied wallet entry and any overdraft
+// movement it caused to the request's ledger
+func recordWalletMovement(c *gin.Context, fs *firestore.Client, entry *WalletEntry) {
+	var ledger LedgerStore
+	if v, ok := c.Get("ledger"); ok {
+		ledger = v.(LedgerStore)
+	}
+	postWalletLedger(c.Request.Context(), ledger, entry)
+	recordOverdraftMovement(c, fs, entry)
+}
+
+// loadWallet reads a user's wallet; a user who has never held funds gets an
+// empty one
+func loadWallet(ctx context.Context, fs *firestore.Client, uid string) (*Wallet, error) {
+	wallet := &Wallet{UserID: uid, Currency: walletCurrency}
+	snap, err := fs.Collection("wallets").Doc(uid).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return wallet, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load wallet %s: %w", uid, err)
+	}
+	if err := snap.DataTo(wallet); err != nil {
+		return nil, fmt.Errorf("failed to read wallet %s: %w", uid, err)
+	}
+	return wallet, nil
+}
+
+// CheckWalletDrift compares every Sila-backed wallet against Sila's reported
+// balance and records mismatches in wallet_drift for reconciliation.
+func CheckWalletDrift(ctx context.Context, fs *firestore.Client, sila *SilaClient) error {
+	docs, err := fs.Collection("wallets").Where("sila_user_handle", ">", "").Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list wallets: %w", err)
+	}
+
+	for _, doc := range docs {
+		var wallet Wallet
+		if err := doc.DataTo(&wallet); err != nil {
+			continue
+		}
+		remote, err := sila.GetBalance(ctx, wallet.SilaUserHandle)
+		if err != nil {
+			slog.WarnContext(ctx, "wallet drift check skipped", "component", "wallet", "user_id", wallet.UserID, "error", err)
+			continue
+		}
+
+		remoteBalance := int64(remote.Balance)
+		driftRef := fs.Collection("wallet_drift").Doc(wallet.UserID)
+		if remoteBalance == wallet.Balance {
+			_, _ = driftRef.Delete(ctx)
+			continue
+		}
+
+		slog.WarnContext(ctx, "wallet balance drift", "component", "wallet", "user_id", wallet.UserID, "ledger_balance", wallet.Balance, "sila_balance", remoteBalance)
+		_, _ = driftRef.Set(ctx, map[string]interface{}{
+			"user_id":          wallet.UserID,
+			"sila_user_handle": wallet.SilaUserHandle,
+			"ledger_balance":   wallet.Balance,
+			"sila_balance":     remoteBalance,
+			"difference":       remoteBalance - wallet.Balance,
+			"detected_at":      time.Now(),
+		})
+	}
+	return nil
+}
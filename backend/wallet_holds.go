@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Wallet hold statuses
+const (
+	WalletHoldActive    = "held"
+	WalletHoldCommitted = "committed"
+	WalletHoldReleased  = "released"
+)
+
+// defaultWalletHoldTTL bounds how long funds stay reserved for a send that never completes
+const defaultWalletHoldTTL = 15 * time.Minute
+
+var (
+	// ErrInsufficientFunds is returned when a hold exceeds the wallet's available balance
+	ErrInsufficientFunds = errors.New("insufficient wallet balance")
+	// ErrWalletHoldClosed is returned when committing or releasing a hold that is no longer held
+	ErrWalletHoldClosed = errors.New("wallet hold is no longer active")
+)
+
+// WalletHold reserves part of a wallet balance for an in-flight send, kept at
+// wallet_holds/{id}. The reserved amount is counted in Wallet.Held until the
+// hold is committed (the balance is debited) or released.
+type WalletHold struct {
+	ID        string    `json:"id" firestore:"-"`
+	UserID    string    `json:"user_id" firestore:"user_id"`
+	Amount    int64     `json:"amount" firestore:"amount"`
+	Advance   int64     `json:"advance,omitempty" firestore:"advance,omitempty"` // part of Amount covered by the overdraft buffer
+	Status    string    `json:"status" firestore:"status"`
+	Reason    string    `json:"reason,omitempty" firestore:"reason,omitempty"`
+	Reference string    `json:"reference,omitempty" firestore:"reference,omitempty"`
+	ExpiresAt time.Time `json:"expires_at" firestore:"expires_at"`
+	CreatedAt time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// PlaceWalletHold atomically reserves amount from the user's available balance.
+// Placing the same hold ID again returns the existing hold, so retried sends
+// don't reserve twice.
+func PlaceWalletHold(ctx context.Context, fs *firestore.Client, uid, holdID string, amount int64, ttl time.Duration) (*WalletHold, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("hold amount must be positive")
+	}
+	walletRef := fs.Collection("wallets").Doc(uid)
+	holdRef := fs.Collection("wallet_holds").Doc(holdID)
+
+	var hold WalletHold
+	err := fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		existing, err := tx.Get(holdRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if existing != nil && existing.Exists() {
+			if err := existing.DataTo(&hold); err != nil {
+				return err
+			}
+			if hold.UserID != uid {
+				return fmt.Errorf("hold %s belongs to another user", holdID)
+			}
+			return nil
+		}
+
+		snap, err := tx.Get(walletRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		var wallet Wallet
+		if snap != nil && snap.Exists() {
+			if err := snap.DataTo(&wallet); err != nil {
+				return err
+			}
+		}
+		if wallet.Available() < amount {
+			return ErrInsufficientFunds
+		}
+
+		now := time.Now()
+		hold = WalletHold{
+			UserID:    uid,
+			Amount:    amount,
+			Advance:   min(max(amount-(wallet.Balance-wallet.Held), 0), amount),
+			Status:    WalletHoldActive,
+			ExpiresAt: now.Add(ttl),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := tx.Set(walletRef, map[string]interface{}{
+			"held":       firestore.Increment(amount),
+			"updated_at": now,
+		}, firestore.MergeAll); err != nil {
+			return err
+		}
+		return tx.Create(holdRef, hold)
+	})
+	if err != nil {
+		if errors.Is(err, ErrInsufficientFunds) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to place wallet hold %s: %w", holdID, err)
+	}
+	hold.ID = holdID
+	return &hold, nil
+}
+
+// closeWalletHold moves an active hold to committed or released, returning the
+// reserved amount and, when entry is set, debiting the balance in the same
+// transaction and filling in the entry.
+func closeWalletHold(ctx context.Context, fs *firestore.Client, holdID, newStatus, reason string, entry *WalletEntry) error {
+	holdRef := fs.Collection("wallet_holds").Doc(holdID)
+	return fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(holdRef)
+		if err != nil {
+			return err
+		}
+		var hold WalletHold
+		if err := snap.DataTo(&hold); err != nil {
+			return err
+		}
+		if hold.Status != WalletHoldActive {
+			return ErrWalletHoldClosed
+		}
+
+		walletRef := fs.Collection("wallets").Doc(hold.UserID)
+		var wallet Wallet
+		walletSnap, err := tx.Get(walletRef)
+		if err != nil {
+			return err
+		}
+		if err := walletSnap.DataTo(&wallet); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		wallet.Held = max(wallet.Held-hold.Amount, 0)
+		wallet.UpdatedAt = now
+		if entry != nil {
+			entry.UserID = hold.UserID
+			entry.Amount = -hold.Amount
+			wallet.Balance += entry.Amount
+			entry.BalanceAfter = wallet.Balance
+			entry.CreatedAt = now
+			if err := tx.Create(fs.Collection("wallet_entries").Doc(entry.Reference), entry); err != nil {
+				return err
+			}
+		}
+		if err := tx.Set(walletRef, wallet); err != nil {
+			return err
+		}
+
+		update := map[string]interface{}{"status": newStatus, "updated_at": now}
+		if reason != "" {
+			update["reason"] = reason
+		}
+		if entry != nil {
+			update["reference"] = entry.Reference
+		}
+		return tx.Set(holdRef, update, firestore.MergeAll)
+	})
+}
+
+// CommitWalletHold debits the held amount from the balance, recording entry
+// (whose reference should be the provider transaction) in the wallet history.
+// The balance goes negative when the hold drew on the overdraft buffer.
+func CommitWalletHold(ctx context.Context, fs *firestore.Client, holdID string, entry *WalletEntry) error {
+	if err := closeWalletHold(ctx, fs, holdID, WalletHoldCommitted, "", entry); err != nil {
+		if errors.Is(err, ErrWalletHoldClosed) {
+			return err
+		}
+		return fmt.Errorf("failed to commit wallet hold %s: %w", holdID, err)
+	}
+	return nil
+}
+
+// ReleaseWalletHold returns held funds to the available balance without moving them
+func ReleaseWalletHold(ctx context.Context, fs *firestore.Client, holdID, reason string) error {
+	if err := closeWalletHold(ctx, fs, holdID, WalletHoldReleased, reason, nil); err != nil {
+		if errors.Is(err, ErrWalletHoldClosed) {
+			return err
+		}
+		return fmt.Errorf("failed to release wallet hold %s: %w", holdID, err)
+	}
+	return nil
+}
+
+// ReleaseExpiredWalletHolds releases holds whose send never committed in time
+func ReleaseExpiredWalletHolds(ctx context.Context, fs *firestore.Client) error {
+	docs, err := fs.Collection("wallet_holds").
+		Where("status", "==", WalletHoldActive).
+		Where("expires_at", "<=", time.Now()).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to query expired wallet holds: %w", err)
+	}
+	for _, doc := range docs {
+		if err := ReleaseWalletHold(ctx, fs, doc.Ref.ID, "expired"); err != nil && !errors.Is(err, ErrWalletHoldClosed) {
+			slog.ErrorContext(ctx, "failed to release expired wallet hold", "component", "wallet", "hold_id", doc.Ref.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// walletHandleForUser returns the user's handle with a wallet provider, e.g.
+// sila_user_handle for Sila, or their user ID for Stripe
+func walletHandleForUser(ctx context.Context, fs *firestore.Client, uid, provider string) (string, error) {
+	doc, err := UserDoc(ctx, fs, uid).Get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load user %s: %w", uid, err)
+	}
+	// Stripe-backed wallets are balances the platform holds, keyed by user,
+	// for anyone whose wallet isn't already with Sila
+	if provider == ProcessorStripe {
+		if stringField(doc.Data(), providerUserField(ProcessorSila, "user_handle")) != "" {
+			return "", fmt.Errorf("user %s's wallet is held with %s", uid, ProcessorSila)
+		}
+		return uid, nil
+	}
+	handle := stringField(doc.Data(), providerUserField(provider, "user_handle"))
+	if handle == "" {
+		return "", fmt.Errorf("user %s has no %s wallet", uid, provider)
+	}
+	return handle, nil
+}
+
+// SendWalletTransfer sends wallet funds to another user. The amount is held
+// before the wallet provider is called so concurrent sends can't overdraw the
+// wallet; the hold is committed on success and released if the transfer fails.
+func SendWalletTransfer(c *gin.Context) {
+	var req struct {
+		RecipientUserID string `json:"recipient_user_id" binding:"required"`
+		Amount          int64  `json:"amount" binding:"required,min=1"` // cents
+		Descriptor      string `json:"descriptor" binding:"max=100"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	uid := uidVal.(string)
+	if req.RecipientUserID == uid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot send to yourself"})
+		return
+	}
+	if !enforceSendLimits(c, uid, req.Amount, walletCurrency) {
+		return
+	}
+
+	sendWalletTransfer(c, uid, req.RecipientUserID, req.Amount, req.Descriptor)
+}
+
+// sendWalletTransfer moves amount from the caller's wallet to the recipient's
+// and writes the response. It backs wallet transfers and P2P payments funded
+// from the wallet.
+func sendWalletTransfer(c *gin.Context, uid, recipientUID string, amount int64, descriptor string) {
+	wallet, ok := walletProviderFor(c)
+	if !ok {
+		return
+	}
+
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+	ctx := c.Request.Context()
+
+	fromHandle, err := walletHandleForUser(ctx, fs, uid, wallet.Name())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You don't have a wallet yet"})
+		return
+	}
+	toHandle, err := walletHandleForUser(ctx, fs, recipientUID, wallet.Name())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Recipient does not have a wallet"})
+		return
+	}
+
+	holdID := "hold_" + uuid.NewString()
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		holdID = "hold_" + uid + "_" + key
+	}
+	hold, err := PlaceWalletHold(ctx, fs, uid, holdID, amount, requestDurationSetting("WALLET_HOLD_TTL", defaultWalletHoldTTL))
+	if errors.Is(err, ErrInsufficientFunds) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient wallet balance"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to place wallet hold", "component", "wallet", "user_id", uid, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve funds"})
+		return
+	}
+	if hold.Status != WalletHoldActive {
+		// A replay of a send that already finished
+		c.JSON(http.StatusOK, gin.H{"hold": hold, "transaction_id": hold.Reference})
+		return
+	}
+
+	if hold.Advance > 0 {
+		// Top the sender's Sila wallet up by the overdraft advance; the wallet
+		// balance goes negative when the hold commits and is repaid from the
+		// next incoming funds.
+		fundingHandle := os.Getenv("SILA_OVERDRAFT_FUNDING_HANDLE")
+		if fundingHandle == "" {
+			_ = ReleaseWalletHold(ctx, fs, hold.ID, "overdraft_unavailable")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Overdraft is not available right now"})
+			return
+		}
+		if _, err := wallet.SendWalletFunds(ctx, fundingHandle, fromHandle, hold.Advance, "Overdraft advance"); err != nil {
+			if relErr := ReleaseWalletHold(ctx, fs, hold.ID, "advance_failed"); relErr != nil {
+				slog.ErrorContext(ctx, "failed to release wallet hold", "component", "wallet", "hold_id", hold.ID, "error", relErr)
+			}
+			slog.ErrorContext(ctx, "overdraft advance failed", "component", "wallet", "user_id", uid, "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Transfer failed; your funds were not moved"})
+			return
+		}
+	}
+
+	txID, err := wallet.SendWalletFunds(ctx, fromHandle, toHandle, amount, descriptor)
+	if err != nil {
+		if relErr := ReleaseWalletHold(ctx, fs, hold.ID, "transfer_failed"); relErr != nil {
+			slog.ErrorContext(ctx, "failed to release wallet hold", "component", "wallet", "hold_id", hold.ID, "error", relErr)
+		}
+		slog.ErrorContext(ctx, "wallet transfer failed", "component", "wallet", "user_id", uid, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Transfer failed; your funds were not moved"})
+		return
+	}
+
+	debit := &WalletEntry{Reference: txID, Source: wallet.Name(), Type: "transfer_out"}
+	if err := CommitWalletHold(ctx, fs, hold.ID, debit); err != nil {
+		// The provider has moved the funds; the drift check will surface the mismatch
+		slog.ErrorContext(ctx, "wallet transfer succeeded but hold commit failed", "component", "wallet", "wallet_transaction", txID, "error", err)
+	} else {
+		recordWalletMovement(c, fs, debit)
+	}
+	credit := &WalletEntry{
+		UserID:    recipientUID,
+		Reference: txID + "_in",
+		Source:    wallet.Name(),
+		Type:      "transfer_in",
+		Amount:    amount,
+	}
+	// Only Sila wallets are tracked by handle; Stripe's handle is the user ID
+	silaHandle := ""
+	if wallet.Name() == ProcessorSila {
+		silaHandle = toHandle
+	}
+	if applied, err := ApplyWalletEntry(ctx, fs, credit, silaHandle); err != nil {
+		slog.ErrorContext(ctx, "failed to credit wallet transfer", "component", "wallet", "wallet_transaction", txID, "error", err)
+	} else if applied {
+		recordWalletMovement(c, fs, credit)
+	}
+
+	NotifyUser(ctx, fs, recipientUID, NotificationWalletCredited, "Money received",
+		fmt.Sprintf("%s was added to your wallet", currencyOrDefault(walletCurrency).Format(amount)),
+		map[string]interface{}{"sila_transaction_id": txID, "sender_user_id": uid})
+
+	hold.Status = WalletHoldCommitted
+	hold.Reference = txID
+	c.JSON(http.StatusCreated, gin.H{"hold": hold, "transaction_id": txID})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Webhook endpoint scopes. The platform endpoint receives events about our
+// own account's objects, the Connect endpoint those of connected accounts.
+const (
+	WebhookScopePlatform = "platform"
+	WebhookScopeConnect  = "connect"
+)
+
+// Problems a webhook endpoint check can find
+const (
+	WebhookEndpointMissing       = "missing"
+	WebhookEndpointDisabled      = "disabled"
+	WebhookEndpointMissingEvents = "missing_events"
+	// WebhookEndpointAPIVersion can't be fixed in place: Stripe doesn't let an
+	// endpoint's API version change, so it has to be recreated
+	WebhookEndpointAPIVersion = "api_version"
+)
+
+// webhookEndpointScopeKey is the metadata key marking the endpoints this
+// service registered
+const webhookEndpointScopeKey = "digital_payments_scope"
+
+// stripeWebhookEvents are the events processStripeEvent handles, by the
+// endpoint they arrive on
+var stripeWebhookEvents = map[string][]string{
+	WebhookScopePlatform: {
+		"payment_intent.succeeded",
+		"payment_intent.payment_failed",
+		"charge.succeeded",
+		"charge.refunded",
+		"charge.dispute.created",
+		"charge.dispute.updated",
+		"charge.dispute.closed",
+		"customer.updated",
+		"customer.deleted",
+		"transfer.reversed",
+		"setup_intent.created",
+		"setup_intent.succeeded",
+		"identity.verification_session.verified",
+		"identity.verification_session.requires_input",
+	},
+	WebhookScopeConnect: {
+		"account.updated",
+		"payout.paid",
+		"payout.failed",
+		"payout.canceled",
+		"treasury.financial_account.features_status_updated",
+		"treasury.financial_account.closed",
+		"treasury.received_credit.succeeded",
+		"treasury.received_debit.created",
+		"treasury.credit_reversal.posted",
+	},
+}
+
+// WebhookEndpointCheck is what a check found for one scope's endpoint
+type WebhookEndpointCheck struct {
+	Scope         string   `json:"scope"`
+	URL           string   `json:"url"`
+	EndpointID    string   `json:"endpoint_id,omitempty"`
+	Status        string   `json:"status,omitempty"`
+	APIVersion    string   `json:"api_version,omitempty"`
+	Issues        []string `json:"issues"`
+	MissingEvents []string `json:"missing_events,omitempty"`
+	// Unresolved are the issues still there after the check, all of them
+	// unless it was allowed to fix the endpoint
+	Unresolved []string `json:"unresolved"`
+	Created    bool     `json:"created,omitempty"`
+	// Secret is the signing secret of a newly created endpoint; Stripe only
+	// returns it once
+	Secret string `json:"secret,omitempty"`
+}
+
+// stripeWebhookURL is the public URL of HandleStripeWebhook, e.g.
+// https://api.example.com/webhooks/stripe
+func stripeWebhookURL() string {
+	return os.Getenv("STRIPE_WEBHOOK_URL")
+}
+
+// findWebhookEndpoint picks the endpoint registered at url for scope: one
+// this service marked with the scope, else an unmarked one already
+// subscribed to some of the scope's events
+func findWebhookEndpoint(endpoints []*stripe.WebhookEndpoint, url, scope string) *stripe.WebhookEndpoint {
+	var unmarked *stripe.WebhookEndpoint
+	for _, ep := range endpoints {
+		if ep.URL != url {
+			continue
+		}
+		switch ep.Metadata[webhookEndpointScopeKey] {
+		case scope:
+			return ep
+		case "":
+			if unmarked == nil && slices.ContainsFunc(stripeWebhookEvents[scope], func(e string) bool {
+				return slices.Contains(ep.EnabledEvents, e)
+			}) {
+				unmarked = ep
+			}
+		}
+	}
+	return unmarked
+}
+
+// CheckWebhookEndpoints verifies that a platform and a Connect endpoint are
+// registered at STRIPE_WEBHOOK_URL, enabled, on our API version, and
+// subscribed to every event we handle. With fix, a missing endpoint is
+// created and a disabled or incomplete one is enabled and given the missing
+// events; events it already had are kept.
+func CheckWebhookEndpoints(ctx context.Context, sc *StripeClient, fix bool) ([]*WebhookEndpointCheck, error) {
+	url := stripeWebhookURL()
+	if url == "" {
+		return nil, errors.New("STRIPE_WEBHOOK_URL not configured")
+	}
+	endpoints, err := sc.ListWebhookEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []*WebhookEndpointCheck
+	for _, scope := range []string{WebhookScopePlatform, WebhookScopeConnect} {
+		required := stripeWebhookEvents[scope]
+		meta := map[string]string{webhookEndpointScopeKey: scope}
+		check := &WebhookEndpointCheck{Scope: scope, URL: url, Issues: []string{}, Unresolved: []string{}}
+		checks = append(checks, check)
+
+		ep := findWebhookEndpoint(endpoints, url, scope)
+		if ep == nil {
+			check.Issues = append(check.Issues, WebhookEndpointMissing)
+			if !fix {
+				check.Unresolved = check.Issues
+				continue
+			}
+			created, err := sc.CreateWebhookEndpoint(ctx, url, scope == WebhookScopeConnect, required, meta)
+			if err != nil {
+				return nil, err
+			}
+			check.EndpointID, check.Status, check.APIVersion = created.ID, created.Status, created.APIVersion
+			check.Created, check.Secret = true, created.Secret
+			continue
+		}
+
+		check.EndpointID, check.Status, check.APIVersion = ep.ID, ep.Status, ep.APIVersion
+		if ep.Status != "enabled" {
+			check.Issues = append(check.Issues, WebhookEndpointDisabled)
+		}
+		if !slices.Contains(ep.EnabledEvents, "*") {
+			for _, event := range required {
+				if !slices.Contains(ep.EnabledEvents, event) {
+					check.MissingEvents = append(check.MissingEvents, event)
+				}
+			}
+		}
+		if len(check.MissingEvents) > 0 {
+			check.Issues = append(check.Issues, WebhookEndpointMissingEvents)
+		}
+		// Endpoints without a version get the account's default, which
+		// can't be seen here
+		if ep.APIVersion != "" && ep.APIVersion != stripe.APIVersion {
+			check.Issues = append(check.Issues, WebhookEndpointAPIVersion)
+		}
+
+		fixable := slices.ContainsFunc(check.Issues, func(issue string) bool { return issue != WebhookEndpointAPIVersion })
+		if !fix || !fixable {
+			check.Unresolved = check.Issues
+			continue
+		}
+		updated, err := sc.UpdateWebhookEndpoint(ctx, ep.ID, slices.Concat(ep.EnabledEvents, check.MissingEvents), meta)
+		if err != nil {
+			return nil, err
+		}
+		check.Status = updated.Status
+		if slices.Contains(check.Issues, WebhookEndpointAPIVersion) {
+			check.Unresolved = []string{WebhookEndpointAPIVersion}
+		}
+	}
+	return checks, nil
+}
+
+// reportWebhookEndpointChecks logs unresolved problems and counts them for
+// the StripeWebhookEndpoint alert
+func reportWebhookEndpointChecks(ctx context.Context, checks []*WebhookEndpointCheck) {
+	for _, check := range checks {
+		if check.Created {
+			slog.WarnContext(ctx, "created stripe webhook endpoint; set its signing secret from the Stripe dashboard",
+				"component", "webhook_endpoints", "scope", check.Scope, "endpoint_id", check.EndpointID)
+		}
+		for _, issue := range check.Unresolved {
+			metrics.IncCounter(MetricWebhookEndpointIssues, map[string]string{"scope": check.Scope, "issue": issue})
+			slog.ErrorContext(ctx, "stripe webhook endpoint misconfigured", "component", "webhook_endpoints",
+				"scope", check.Scope, "issue", issue, "endpoint_id", check.EndpointID, "url", check.URL,
+				"missing_events", strings.Join(check.MissingEvents, ","))
+		}
+	}
+}
+
+// VerifyWebhookEndpoints checks the webhook endpoints in the background,
+// fixing them when STRIPE_WEBHOOK_AUTOCONFIGURE is true
+func VerifyWebhookEndpoints(ctx context.Context, sc *StripeClient) error {
+	checks, err := CheckWebhookEndpoints(ctx, sc, os.Getenv("STRIPE_WEBHOOK_AUTOCONFIGURE") == "true")
+	if err != nil {
+		return err
+	}
+	reportWebhookEndpointChecks(ctx, checks)
+	return nil
+}
+
+// GetWebhookEndpoints reports whether the webhook endpoints are registered
+// as this service needs, without changing them
+func GetWebhookEndpoints(c *gin.Context) {
+	uid, sc, _, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	checks, err := CheckWebhookEndpoints(ctx, sc, false)
+	if err != nil {
+		sc.LogAPIError(ctx, "check_webhook_endpoints", uid, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to check webhook endpoints", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"endpoints": checks})
+}
+
+// SyncWebhookEndpoints creates or repairs the webhook endpoints. A created
+// endpoint's signing secret is in the response, and only there; it has to be
+// set as STRIPE_WEBHOOK_SECRET or STRIPE_CONNECT_WEBHOOK_SECRET.
+func SyncWebhookEndpoints(c *gin.Context) {
+	adminID, sc, fs, ok := paymentMethodDeps(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	checks, err := CheckWebhookEndpoints(ctx, sc, true)
+	if err != nil {
+		sc.LogAPIError(ctx, "sync_webhook_endpoints", adminID, err)
+		c.JSON(http.StatusBadGateway, stripeErrorBody(c, "Failed to sync webhook endpoints", err))
+		return
+	}
+	reportWebhookEndpointChecks(ctx, checks)
+	for _, check := range checks {
+		if check.EndpointID == "" || len(check.Issues) == 0 {
+			continue
+		}
+		if err := logAdminAccess(ctx, fs, AdminAccess{AdminID: adminID, Action: AdminAccessWrite, SubjectType: "webhook_endpoint", SubjectID: check.EndpointID}); err != nil {
+			slog.ErrorContext(ctx, "failed to log webhook endpoint access", "component", "webhook_endpoints", "endpoint_id", check.EndpointID, "error", err)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"endpoints": checks})
+}
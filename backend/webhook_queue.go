@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Webhook job statuses
+const (
+	WebhookJobPending    = "pending"
+	WebhookJobProcessing = "processing"
+	WebhookJobSucceeded  = "succeeded"
+	WebhookJobDead       = "dead"
+)
+
+// MetricWebhookJobsTotal counts finished webhook jobs by outcome
+const MetricWebhookJobsTotal = "webhook_jobs_total"
+
+const (
+	// maxWebhookAttempts is how many times a job runs before it is dead-lettered
+	maxWebhookAttempts = 8
+	// webhookJobLease is how long a worker owns a job; a job still processing
+	// after its lease (e.g. the instance died) is picked up again
+	webhookJobLease = 2 * time.Minute
+	// webhookPollInterval is how often persisted jobs are swept for due retries
+	webhookPollInterval = 15 * time.Second
+)
+
+// WebhookJob is a received webhook event awaiting processing, kept at
+// webhook_jobs/{eventId} so duplicate deliveries collapse into one job.
+type WebhookJob struct {
+	ID            string    `json:"id" firestore:"-"`
+	Provider      string    `json:"provider" firestore:"provider"`
+	EventType     string    `json:"event_type" firestore:"event_type"`
+	ObjectID      string    `json:"object_id,omitempty" firestore:"object_id,omitempty"`
+	Payload       string    `json:"-" firestore:"payload"`
+	Status        string    `json:"status" firestore:"status"`
+	Attempts      int       `json:"attempts" firestore:"attempts"`
+	LastError     string    `json:"last_error,omitempty" firestore:"last_error,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at" firestore:"next_attempt_at"`
+	LeaseUntil    time.Time `json:"lease_until,omitempty" firestore:"lease_until,omitempty"`
+	CreatedAt     time.Time `json:"created_at" firestore:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// WebhookQueue persists webhook events in Firestore and processes them on an
+// in-process worker pool, retrying failures with backoff and dead-lettering
+// jobs that exhaust their attempts.
+type WebhookQueue struct {
+	fs    *firestore.Client
+	deps  *webhookDeps
+	ready chan string
+}
+
+// NewWebhookQueue returns a queue whose jobs run with the given clients
+func NewWebhookQueue(fs *firestore.Client, sc *StripeClient, ledger LedgerStore, fbAuth *auth.Client) *WebhookQueue {
+	return &WebhookQueue{
+		fs:    fs,
+		deps:  &webhookDeps{fs: fs, sc: sc, ledger: ledger, auth: fbAuth},
+		ready: make(chan string, 256),
+	}
+}
+
+// webhookBackoff is the delay before retrying after the given attempt: 30s
+// doubling up to an hour
+func webhookBackoff(attempt int) time.Duration {
+	d := 30 * time.Second << min(attempt-1, 7)
+	return min(d, time.Hour)
+}
+
+// Enqueue persists the event for processing. Redelivery of an event that is
+// already queued is a no-op.
+func (q *WebhookQueue) Enqueue(ctx context.Context, event stripe.Event, payload []byte) error {
+	now := time.Now()
+	job := WebhookJob{
+		Provider:      "stripe",
+		EventType:     string(event.Type),
+		Payload:       string(payload),
+		Status:        WebhookJobPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if event.Data != nil {
+		// Lets a request trace find the webhooks for the objects it created
+		job.ObjectID, _ = event.Data.Object["id"].(string)
+	}
+	if _, err := q.fs.Collection("webhook_jobs").Doc(event.ID).Create(ctx, job); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			return nil
+		}
+		return fmt.Errorf("failed to enqueue %s: %w", event.ID, err)
+	}
+	q.notify(event.ID)
+	return nil
+}
+
+// notify hands a job to the workers without blocking; if they are busy the
+// poller picks it up instead
+func (q *WebhookQueue) notify(id string) {
+	select {
+	case q.ready <- id:
+	default:
+	}
+}
+
+// Run starts the worker pool and the poller that sweeps due and abandoned jobs
+func (q *WebhookQueue) Run(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-q.ready:
+					// The job stays persisted, so one left queued at shutdown is swept up later
+					if !inflightWork.start() {
+						return
+					}
+					q.process(context.WithoutCancel(ctx), id)
+					inflightWork.done()
+				}
+			}
+		}()
+	}
+	slog.InfoContext(ctx, "webhook workers started", "component", "webhooks", "workers", workers)
+	RunPeriodic(ctx, "webhook_queue_poll", webhookPollInterval, q.sweep)
+}
+
+// sweep queues jobs whose retry is due and jobs whose worker lease lapsed.
+// It never waits on the workers: they stop reading at shutdown, and a job
+// they are too busy to take is still due at the next sweep.
+func (q *WebhookQueue) sweep(ctx context.Context) error {
+	now := time.Now()
+	queries := []firestore.Query{
+		q.fs.Collection("webhook_jobs").Where("status", "==", WebhookJobPending).Where("next_attempt_at", "<=", now),
+		q.fs.Collection("webhook_jobs").Where("status", "==", WebhookJobProcessing).Where("lease_until", "<=", now),
+	}
+	for _, query := range queries {
+		docs, err := query.Limit(100).Documents(ctx).GetAll()
+		if err != nil {
+			return fmt.Errorf("failed to sweep webhook jobs: %w", err)
+		}
+		for _, doc := range docs {
+			q.notify(doc.Ref.ID)
+		}
+	}
+	return nil
+}
+
+// claim takes the lease on a job that is due, reporting false if another
+// worker holds it or it has already finished
+func (q *WebhookQueue) claim(ctx context.Context, id string) (*WebhookJob, bool, error) {
+	ref := q.fs.Collection("webhook_jobs").Doc(id)
+	var job WebhookJob
+	claimed := false
+	err := q.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := snap.DataTo(&job); err != nil {
+			return err
+		}
+		now := time.Now()
+		due := job.Status == WebhookJobPending && !job.NextAttemptAt.After(now)
+		abandoned := job.Status == WebhookJobProcessing && job.LeaseUntil.Before(now)
+		if !due && !abandoned {
+			return nil
+		}
+		job.Status = WebhookJobProcessing
+		job.Attempts++
+		job.LeaseUntil = now.Add(webhookJobLease)
+		job.UpdatedAt = now
+		claimed = true
+		return tx.Set(ref, job)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	job.ID = id
+	return &job, claimed, nil
+}
+
+// process runs one job and records its outcome
+func (q *WebhookQueue) process(ctx context.Context, id string) {
+	ctx, span := tracer.Start(withCorrelationID(ctx, "webhook"), "webhook_job", trace.WithAttributes(attribute.String("webhook_job.id", id)))
+	defer span.End()
+	job, claimed, err := q.claim(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to claim webhook job", "component", "webhooks", "job_id", id, "error", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	var event stripe.Event
+	runErr := json.Unmarshal([]byte(job.Payload), &event)
+	if runErr == nil {
+		jobCtx, cancel := context.WithTimeout(ctx, webhookJobLease)
+		runErr = processStripeEvent(jobCtx, q.deps, event)
+		cancel()
+	}
+
+	now := time.Now()
+	update := map[string]interface{}{"updated_at": now, "lease_until": firestore.Delete}
+	outcome := WebhookJobSucceeded
+	switch {
+	case runErr == nil:
+		update["status"] = WebhookJobSucceeded
+		update["last_error"] = firestore.Delete
+	case job.Attempts >= maxWebhookAttempts:
+		outcome = WebhookJobDead
+		update["status"] = WebhookJobDead
+		update["last_error"] = runErr.Error()
+		slog.ErrorContext(ctx, "webhook job dead-lettered", "component", "webhooks", "job_id", id, "event_type", job.EventType, "attempts", job.Attempts, "error", runErr)
+	default:
+		outcome = "retry"
+		update["status"] = WebhookJobPending
+		update["last_error"] = runErr.Error()
+		update["next_attempt_at"] = now.Add(webhookBackoff(job.Attempts))
+	}
+	metrics.IncCounter(MetricWebhookJobsTotal, map[string]string{"provider": job.Provider, "outcome": outcome})
+	if outcome == WebhookJobSucceeded {
+		// Lag runs from when the provider created the event to when its side effects landed
+		metrics.Observe(MetricWebhookLag, map[string]string{"provider": job.Provider}, now.Sub(time.Unix(event.Created, 0)).Seconds())
+	}
+	if _, err := q.fs.Collection("webhook_jobs").Doc(id).Set(ctx, update, firestore.MergeAll); err != nil {
+		slog.ErrorContext(ctx, "failed to record webhook job outcome", "component", "webhooks", "job_id", id, "error", err)
+	}
+}
+
+// ListDeadWebhookJobs returns dead-lettered webhook jobs for admins to inspect
+func ListDeadWebhookJobs(c *gin.Context) {
+	v, ok := c.Get("firestore")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Firestore not available"})
+		return
+	}
+	fs := v.(*firestore.Client)
+
+	docs, err := fs.Collection("webhook_jobs").
+		Where("status", "==", WebhookJobDead).
+		OrderBy("updated_at", firestore.Desc).
+		Limit(100).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load webhook jobs"})
+		return
+	}
+	jobs := make([]WebhookJob, 0, len(docs))
+	for _, doc := range docs {
+		var job WebhookJob
+		if err := doc.DataTo(&job); err != nil {
+			continue
+		}
+		job.ID = doc.Ref.ID
+		jobs = append(jobs, job)
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+// ReplayWebhookJob resets a dead-lettered job so the workers run it again
+func ReplayWebhookJob(c *gin.Context) {
+	v, ok := c.Get("webhookQueue")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Webhook queue not available"})
+		return
+	}
+	q := v.(*WebhookQueue)
+	ctx := c.Request.Context()
+
+	ref := q.fs.Collection("webhook_jobs").Doc(c.Param("id"))
+	err := q.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if s, _ := snap.Data()["status"].(string); s != WebhookJobDead {
+			return fmt.Errorf("job is %s", s)
+		}
+		return tx.Set(ref, map[string]interface{}{
+			"status":          WebhookJobPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+			"updated_at":      time.Now(),
+		}, firestore.MergeAll)
+	})
+	if status.Code(err) == codes.NotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook job not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	q.notify(ref.ID)
+	c.JSON(http.StatusOK, gin.H{"id": ref.ID, "status": WebhookJobPending})
+}
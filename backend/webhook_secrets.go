@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stripe webhook signing secrets can be rotated without dropping events: every
+// active secret is tried until one verifies the signature. They come from
+//
+//   - STRIPE_WEBHOOK_SECRET and STRIPE_CONNECT_WEBHOOK_SECRET, each a
+//     comma-separated list, newest first;
+//   - STRIPE_WEBHOOK_SECRETS_FILE, one secret per line with # comments, e.g. a
+//     secret manager version mounted into the container. The file is re-read
+//     when it changes, so a rotation doesn't need a restart.
+//
+// To rotate, add the new secret ahead of the old one, roll the endpoint's
+// secret in Stripe, and remove the old secret once
+// stripe_webhook_secret_matches_total stops counting it.
+
+// MetricWebhookSecretMatches counts verified webhooks by the position of the
+// secret that verified them
+const MetricWebhookSecretMatches = "stripe_webhook_secret_matches_total"
+
+// webhookSecretsFile caches STRIPE_WEBHOOK_SECRETS_FILE by modification time
+var webhookSecretsFile struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	secrets []string
+}
+
+// splitSecrets parses a list of secrets separated by commas or newlines,
+// skipping blanks and # comments
+func splitSecrets(raw string) []string {
+	var secrets []string
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(raw, ",", "\n")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+	return secrets
+}
+
+// fileWebhookSecrets returns the secrets in STRIPE_WEBHOOK_SECRETS_FILE. If
+// the file can't be read the secrets last read from it are kept.
+func fileWebhookSecrets() []string {
+	path := os.Getenv("STRIPE_WEBHOOK_SECRETS_FILE")
+	if path == "" {
+		return nil
+	}
+	webhookSecretsFile.mu.Lock()
+	defer webhookSecretsFile.mu.Unlock()
+	info, err := os.Stat(path)
+	if err != nil {
+		slog.Error("failed to read webhook secrets file", "component", "webhooks", "path", path, "error", err)
+		return webhookSecretsFile.secrets
+	}
+	if path == webhookSecretsFile.path && info.ModTime().Equal(webhookSecretsFile.modTime) {
+		return webhookSecretsFile.secrets
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("failed to read webhook secrets file", "component", "webhooks", "path", path, "error", err)
+		return webhookSecretsFile.secrets
+	}
+	webhookSecretsFile.path, webhookSecretsFile.modTime = path, info.ModTime()
+	webhookSecretsFile.secrets = splitSecrets(string(raw))
+	slog.Info("loaded webhook secrets", "component", "webhooks", "path", path, "count", len(webhookSecretsFile.secrets))
+	return webhookSecretsFile.secrets
+}
+
+// stripeWebhookSecrets returns every active signing secret, without
+// duplicates, in the order they are tried
+func stripeWebhookSecrets() ([]string, error) {
+	var secrets []string
+	seen := map[string]bool{}
+	for _, list := range [][]string{
+		splitSecrets(os.Getenv("STRIPE_WEBHOOK_SECRET")),
+		fileWebhookSecrets(),
+		splitSecrets(os.Getenv("STRIPE_CONNECT_WEBHOOK_SECRET")),
+	} {
+		for _, s := range list {
+			if !seen[s] {
+				seen[s] = true
+				secrets = append(secrets, s)
+			}
+		}
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("STRIPE_WEBHOOK_SECRET not configured")
+	}
+	return secrets, nil
+}
+
+// recordWebhookSecretMatch counts which secret verified a webhook, so an old
+// secret can be removed once nothing is signed with it
+func recordWebhookSecretMatch(position int) {
+	metrics.IncCounter(MetricWebhookSecretMatches, map[string]string{"secret": strconv.Itoa(position)})
+}